@@ -1,6 +1,7 @@
 package aw
 
 import (
+	"github.com/renproject/aw/broadcast"
 	"github.com/renproject/aw/dht"
 	"github.com/renproject/aw/handshake"
 	"github.com/renproject/aw/peer"
@@ -10,11 +11,17 @@ import (
 
 const (
 	V1        = protocol.V1
+	V2        = protocol.V2
+	V3        = protocol.V3
 	Ping      = protocol.Ping
 	Pong      = protocol.Pong
 	Cast      = protocol.Cast
 	Multicast = protocol.Multicast
 	Broadcast = protocol.Broadcast
+	CatchUp   = protocol.CatchUp
+
+	SHA256 = protocol.SHA256
+	BLAKE3 = protocol.BLAKE3
 )
 
 type (
@@ -27,6 +34,7 @@ type (
 	MessageBody      = protocol.MessageBody
 	MessageSender    = protocol.MessageSender
 	MessageReceiver  = protocol.MessageReceiver
+	Hasher           = protocol.Hasher
 
 	// Events
 	Event                = protocol.Event
@@ -34,21 +42,35 @@ type (
 	EventReceiver        = protocol.EventReceiver
 	EventPeerChanged     = protocol.EventPeerChanged
 	EventMessageReceived = protocol.EventMessageReceived
+	EventBroadcastAcked  = protocol.EventBroadcastAcked
+	EventBroadcastFailed = protocol.EventBroadcastFailed
+	EventMessageRejected = protocol.EventMessageRejected
+	EventLoadShed        = protocol.EventLoadShed
+	EventGroupDegraded   = protocol.EventGroupDegraded
+	EventGroupRepaired   = protocol.EventGroupRepaired
+	EventGroupExpired    = protocol.EventGroupExpired
+	EventPeerRateLimited = protocol.EventPeerRateLimited
 
 	// Peers
 	Peer             = peer.Peer
 	PeerOptions      = peer.Options
+	PeerStats        = peer.Stats
 	PeerID           = protocol.PeerID
 	PeerIDs          = protocol.PeerIDs
 	GroupID          = protocol.GroupID
 	PeerAddress      = protocol.PeerAddress
 	PeerAddresses    = protocol.PeerAddresses
 	PeerAddressCodec = protocol.PeerAddressCodec
+	MultiPeerAddress = protocol.MultiPeerAddress
+
+	// Broadcasting
+	BroadcastReport = broadcast.Report
 
 	// Network
 	DHT            = dht.DHT
 	Client         = protocol.Client
 	Server         = protocol.Server
+	Servers        = protocol.Servers
 	Session        = protocol.Session
 	SessionManager = protocol.SessionManager
 	SignVerifier   = protocol.SignVerifier
@@ -64,11 +86,13 @@ var NilGroupID = protocol.NilGroupID
 
 // Constructors
 var (
-	NewMessage   = protocol.NewMessage
-	NewPeer      = peer.New
-	NewDHT       = dht.New
-	NewTCPPeer   = peer.NewTCP
-	NewConnPool  = tcp.NewConnPool
-	NewTCPClient = tcp.NewClient
-	NewTCPServer = tcp.NewServer
+	NewMessage           = protocol.NewMessage
+	NewMessageWithHasher = protocol.NewMessageWithHasher
+	NewPeer              = peer.New
+	NewDHT               = dht.New
+	NewTCPPeer           = peer.NewTCP
+	NewTCPPeerWithEvents = peer.NewTCPWithEvents
+	NewConnPool          = tcp.NewConnPool
+	NewTCPClient         = tcp.NewClient
+	NewTCPServer         = tcp.NewServer
 )
@@ -0,0 +1,231 @@
+package ban
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/renproject/aw/protocol"
+	"github.com/renproject/kv"
+)
+
+// Reason explains why a peer was banned.
+type Reason uint8
+
+const (
+	// ReasonManual is used for bans added by an operator.
+	ReasonManual = Reason(1)
+	// ReasonMisbehaviour is used for peers that have been penalised too often
+	// (e.g. for exceeding decompression limits).
+	ReasonMisbehaviour = Reason(2)
+	// ReasonSpam is used for peers that flood the network with messages.
+	ReasonSpam = Reason(3)
+	// ReasonProtocolViolation is used for peers that send malformed or
+	// unsupported messages.
+	ReasonProtocolViolation = Reason(4)
+)
+
+func (reason Reason) String() string {
+	switch reason {
+	case ReasonManual:
+		return "manual"
+	case ReasonMisbehaviour:
+		return "misbehaviour"
+	case ReasonSpam:
+		return "spam"
+	case ReasonProtocolViolation:
+		return "protocol-violation"
+	default:
+		return fmt.Sprintf("reason(%d)", uint8(reason))
+	}
+}
+
+// MarshalText implements the `TextMarshaler` interface.
+func (reason Reason) MarshalText() ([]byte, error) {
+	return []byte(reason.String()), nil
+}
+
+// UnmarshalText implements the `TextUnmarshaler` interface.
+func (reason *Reason) UnmarshalText(text []byte) error {
+	for _, r := range []Reason{ReasonManual, ReasonMisbehaviour, ReasonSpam, ReasonProtocolViolation} {
+		if r.String() == string(text) {
+			*reason = r
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown ban reason=%v", string(text))
+}
+
+// A Ban prevents a peer from connecting. A ban can be keyed by the PeerID of
+// the peer, by its IP (or a subnet in CIDR notation), or by both, in which case
+// the peer is banned if either of them matches. Bans without an expiry are
+// permanent.
+type Ban struct {
+	PeerID  string    `json:"peerID,omitempty"`
+	IP      string    `json:"ip,omitempty"`
+	Reason  Reason    `json:"reason"`
+	Note    string    `json:"note,omitempty"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+// Validate returns an error if the ban does not have a PeerID or an IP, or if
+// the IP is neither an IP nor a subnet.
+func (ban Ban) Validate() error {
+	if ban.PeerID == "" && ban.IP == "" {
+		return fmt.Errorf("ban must have a peer id or an ip")
+	}
+	if ban.IP != "" && net.ParseIP(ban.IP) == nil {
+		if _, _, err := net.ParseCIDR(ban.IP); err != nil {
+			return fmt.Errorf("invalid ip=%v", ban.IP)
+		}
+	}
+	return nil
+}
+
+// Expired returns true if the ban has expired at the given time.
+func (ban Ban) Expired(now time.Time) bool {
+	return !ban.Expires.IsZero() && !now.Before(ban.Expires)
+}
+
+// Matches returns true if the ban applies to the peer with the given PeerID
+// or IP. Either of them can be nil.
+func (ban Ban) Matches(peerID protocol.PeerID, ip net.IP) bool {
+	if ban.PeerID != "" && peerID != nil && ban.PeerID == peerID.String() {
+		return true
+	}
+	if ban.IP == "" || ip == nil {
+		return false
+	}
+	if banned := net.ParseIP(ban.IP); banned != nil {
+		return banned.Equal(ip)
+	}
+	_, subnet, err := net.ParseCIDR(ban.IP)
+	return err == nil && subnet.Contains(ip)
+}
+
+func (ban Ban) key() string {
+	return key(ban.PeerID, ban.IP)
+}
+
+func key(peerID, ip string) string {
+	return fmt.Sprintf("%s/%s", peerID, ip)
+}
+
+// A List of bans. Bans are persisted, so that they survive restarts, and
+// expired bans are removed automatically.
+type List interface {
+	// Add a ban to the list. A ban with the same PeerID and IP as an existing
+	// ban replaces it. Bans without a reason are manual bans.
+	Add(ban Ban) error
+
+	// Remove the ban with the given PeerID and IP. It does not return an
+	// error if there is no such ban.
+	Remove(peerID, ip string) error
+
+	// Bans returns all bans that have not expired.
+	Bans() ([]Ban, error)
+
+	// IsBanned returns the ban that applies to the peer with the given PeerID
+	// or IP, if there is one. Either of them can be nil.
+	IsBanned(peerID protocol.PeerID, ip net.IP) (Ban, bool)
+}
+
+type list struct {
+	mu    *sync.RWMutex
+	store kv.Table
+	bans  map[string]Ban
+}
+
+// NewList returns a List that persists its bans in the given store. Bans that
+// are already in the store are loaded. An in-memory store is used if the store
+// is nil.
+func NewList(store kv.Table) (List, error) {
+	if store == nil {
+		store = kv.NewTable(kv.NewMemDB(kv.JSONCodec), "ban")
+	}
+	list := &list{
+		mu:    new(sync.RWMutex),
+		store: store,
+		bans:  map[string]Ban{},
+	}
+
+	iter := store.Iterator()
+	defer iter.Close()
+	for iter.Next() {
+		ban := Ban{}
+		if err := iter.Value(&ban); err != nil {
+			return nil, fmt.Errorf("error scanning ban iterator: %v", err)
+		}
+		list.bans[ban.key()] = ban
+	}
+	return list, nil
+}
+
+func (list *list) Add(ban Ban) error {
+	if err := ban.Validate(); err != nil {
+		return err
+	}
+	if ban.Reason == 0 {
+		ban.Reason = ReasonManual
+	}
+	if ban.Created.IsZero() {
+		ban.Created = time.Now()
+	}
+
+	list.mu.Lock()
+	defer list.mu.Unlock()
+
+	if err := list.store.Insert(ban.key(), ban); err != nil {
+		return fmt.Errorf("error inserting ban peer=%v ip=%v: %v", ban.PeerID, ban.IP, err)
+	}
+	list.bans[ban.key()] = ban
+	return nil
+}
+
+func (list *list) Remove(peerID, ip string) error {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+
+	return list.removeWithoutLock(key(peerID, ip))
+}
+
+func (list *list) Bans() ([]Ban, error) {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+
+	now := time.Now()
+	bans := make([]Ban, 0, len(list.bans))
+	for key, ban := range list.bans {
+		if ban.Expired(now) {
+			if err := list.removeWithoutLock(key); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		bans = append(bans, ban)
+	}
+	return bans, nil
+}
+
+func (list *list) IsBanned(peerID protocol.PeerID, ip net.IP) (Ban, bool) {
+	list.mu.RLock()
+	defer list.mu.RUnlock()
+
+	now := time.Now()
+	for _, ban := range list.bans {
+		if !ban.Expired(now) && ban.Matches(peerID, ip) {
+			return ban, true
+		}
+	}
+	return Ban{}, false
+}
+
+func (list *list) removeWithoutLock(key string) error {
+	if err := list.store.Delete(key); err != nil && err != kv.ErrKeyNotFound {
+		return fmt.Errorf("error deleting ban=%v: %v", key, err)
+	}
+	delete(list.bans, key)
+	return nil
+}
@@ -0,0 +1,13 @@
+package ban_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestBan(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Ban Suite")
+}
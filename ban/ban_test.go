@@ -0,0 +1,110 @@
+package ban_test
+
+import (
+	"encoding/json"
+	"net"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/ban"
+	. "github.com/renproject/aw/testutil"
+)
+
+var _ = Describe("Ban list", func() {
+	Context("when validating a ban", func() {
+		It("should require a peer id or a valid ip", func() {
+			Expect(Ban{}.Validate()).NotTo(Succeed())
+			Expect(Ban{IP: "not-an-ip"}.Validate()).NotTo(Succeed())
+			Expect(Ban{PeerID: "peer"}.Validate()).To(Succeed())
+			Expect(Ban{IP: "10.0.0.1"}.Validate()).To(Succeed())
+			Expect(Ban{IP: "10.0.0.0/24"}.Validate()).To(Succeed())
+		})
+	})
+
+	Context("when marshaling a reason", func() {
+		It("should return the same reason", func() {
+			for _, reason := range []Reason{ReasonManual, ReasonMisbehaviour, ReasonSpam, ReasonProtocolViolation} {
+				data, err := json.Marshal(reason)
+				Expect(err).NotTo(HaveOccurred())
+				var decoded Reason
+				Expect(json.Unmarshal(data, &decoded)).To(Succeed())
+				Expect(decoded).To(Equal(reason))
+			}
+			var decoded Reason
+			Expect(json.Unmarshal([]byte(`"unknown"`), &decoded)).NotTo(Succeed())
+		})
+	})
+
+	Context("when checking if a peer is banned", func() {
+		It("should match the peer id, the ip, or the subnet", func() {
+			list, err := NewList(nil)
+			Expect(err).NotTo(HaveOccurred())
+			peerID := RandomPeerID()
+			Expect(list.Add(Ban{PeerID: peerID.String(), Reason: ReasonSpam})).To(Succeed())
+			Expect(list.Add(Ban{IP: "10.0.0.1"})).To(Succeed())
+			Expect(list.Add(Ban{IP: "192.168.1.0/24"})).To(Succeed())
+
+			ban, ok := list.IsBanned(peerID, nil)
+			Expect(ok).To(BeTrue())
+			Expect(ban.Reason).To(Equal(ReasonSpam))
+			Expect(ban.Created).NotTo(BeZero())
+			_, ok = list.IsBanned(nil, net.ParseIP("10.0.0.1"))
+			Expect(ok).To(BeTrue())
+			_, ok = list.IsBanned(RandomPeerID(), net.ParseIP("192.168.1.42"))
+			Expect(ok).To(BeTrue())
+			_, ok = list.IsBanned(RandomPeerID(), net.ParseIP("10.0.0.2"))
+			Expect(ok).To(BeFalse())
+		})
+
+		It("should ignore expired bans", func() {
+			list, err := NewList(nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(list.Add(Ban{IP: "10.0.0.1", Expires: time.Now().Add(50 * time.Millisecond)})).To(Succeed())
+			_, ok := list.IsBanned(nil, net.ParseIP("10.0.0.1"))
+			Expect(ok).To(BeTrue())
+
+			time.Sleep(100 * time.Millisecond)
+			_, ok = list.IsBanned(nil, net.ParseIP("10.0.0.1"))
+			Expect(ok).To(BeFalse())
+			bans, err := list.Bans()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(bans).To(BeEmpty())
+		})
+	})
+
+	Context("when removing a ban", func() {
+		It("should no longer ban the peer", func() {
+			list, err := NewList(nil)
+			Expect(err).NotTo(HaveOccurred())
+			peerID := RandomPeerID()
+			Expect(list.Add(Ban{PeerID: peerID.String(), IP: "10.0.0.1"})).To(Succeed())
+			Expect(list.Remove(peerID.String(), "")).To(Succeed())
+			_, ok := list.IsBanned(peerID, nil)
+			Expect(ok).To(BeTrue())
+
+			Expect(list.Remove(peerID.String(), "10.0.0.1")).To(Succeed())
+			_, ok = list.IsBanned(peerID, net.ParseIP("10.0.0.1"))
+			Expect(ok).To(BeFalse())
+		})
+	})
+
+	Context("when re-opening a list from the same store", func() {
+		It("should load the bans", func() {
+			store := NewTable("ban")
+			list, err := NewList(store)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(list.Add(Ban{PeerID: "peer", Note: "flooding"})).To(Succeed())
+			Expect(list.Add(Ban{IP: "10.0.0.1"})).To(Succeed())
+
+			list, err = NewList(store)
+			Expect(err).NotTo(HaveOccurred())
+			bans, err := list.Bans()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(bans).To(HaveLen(2))
+			ban, ok := list.IsBanned(RandomPeerID(), net.ParseIP("10.0.0.1"))
+			Expect(ok).To(BeTrue())
+			Expect(ban.IP).To(Equal("10.0.0.1"))
+		})
+	})
+})
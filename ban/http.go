@@ -0,0 +1,83 @@
+package ban
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// NewHandler returns an http.Handler that serves the admin API of a List at
+// /bans. GET lists the bans, POST adds the ban in the JSON body, and DELETE
+// removes the ban identified by the peerID and ip query parameters. When
+// adding a ban, a duration query parameter (e.g. "24h") sets its expiry. It
+// does not authorise requests, so it must only be served to operators (see
+// peer.NewAdminHandler).
+func NewHandler(list List) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/bans", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			bans, err := list.Bans()
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, bans)
+
+		case http.MethodPost:
+			ban := Ban{}
+			if err := json.NewDecoder(r.Body).Decode(&ban); err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("error decoding ban: %v", err))
+				return
+			}
+			if ban.Reason == 0 {
+				ban.Reason = ReasonManual
+			}
+			if ban.Created.IsZero() {
+				ban.Created = time.Now()
+			}
+			if duration := r.URL.Query().Get("duration"); duration != "" {
+				d, err := time.ParseDuration(duration)
+				if err != nil {
+					writeError(w, http.StatusBadRequest, fmt.Errorf("invalid duration=%v: %v", duration, err))
+					return
+				}
+				ban.Expires = ban.Created.Add(d)
+			}
+			if err := ban.Validate(); err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			if err := list.Add(ban); err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			writeJSON(w, http.StatusCreated, ban)
+
+		case http.MethodDelete:
+			query := r.URL.Query()
+			if err := list.Remove(query.Get("peerID"), query.Get("ip")); err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+
+		default:
+			w.Header().Set("Allow", "GET, POST, DELETE")
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %v is not allowed", r.Method))
+		}
+	})
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	w.WriteHeader(status)
+	fmt.Fprintln(w, err)
+}
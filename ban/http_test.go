@@ -0,0 +1,61 @@
+package ban_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/ban"
+)
+
+var _ = Describe("Ban admin API", func() {
+	serve := func(handler http.Handler, method, url string, body []byte) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(method, url, bytes.NewReader(body)))
+		return recorder
+	}
+
+	It("should add, list and remove bans", func() {
+		list, err := NewList(nil)
+		Expect(err).NotTo(HaveOccurred())
+		handler := NewHandler(list)
+
+		response := serve(handler, http.MethodPost, "/bans?duration=1h", []byte(`{"ip":"10.0.0.1","note":"flooding"}`))
+		Expect(response.Code).To(Equal(http.StatusCreated))
+		ban, ok := list.IsBanned(nil, net.ParseIP("10.0.0.1"))
+		Expect(ok).To(BeTrue())
+		Expect(ban.Reason).To(Equal(ReasonManual))
+		Expect(ban.Expires.Sub(ban.Created)).To(Equal(time.Hour))
+
+		response = serve(handler, http.MethodGet, "/bans", nil)
+		Expect(response.Code).To(Equal(http.StatusOK))
+		bans := []Ban{}
+		Expect(json.Unmarshal(response.Body.Bytes(), &bans)).To(Succeed())
+		Expect(bans).To(HaveLen(1))
+		Expect(bans[0].Note).To(Equal("flooding"))
+
+		response = serve(handler, http.MethodDelete, "/bans?ip=10.0.0.1", nil)
+		Expect(response.Code).To(Equal(http.StatusNoContent))
+		_, ok = list.IsBanned(nil, net.ParseIP("10.0.0.1"))
+		Expect(ok).To(BeFalse())
+	})
+
+	It("should reject invalid bans", func() {
+		list, err := NewList(nil)
+		Expect(err).NotTo(HaveOccurred())
+		handler := NewHandler(list)
+
+		Expect(serve(handler, http.MethodPost, "/bans", []byte(`{`)).Code).To(Equal(http.StatusBadRequest))
+		Expect(serve(handler, http.MethodPost, "/bans", []byte(`{}`)).Code).To(Equal(http.StatusBadRequest))
+		Expect(serve(handler, http.MethodPost, "/bans?duration=soon", []byte(`{"peerID":"peer"}`)).Code).To(Equal(http.StatusBadRequest))
+		Expect(serve(handler, http.MethodPut, "/bans", nil).Code).To(Equal(http.StatusMethodNotAllowed))
+		bans, err := list.Bans()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(bans).To(BeEmpty())
+	})
+})
@@ -0,0 +1,209 @@
+package broadcast
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/renproject/aw/protocol"
+	"github.com/renproject/id"
+)
+
+// pendingBroadcast is a reliable broadcast that has not been acknowledged by
+// all of the peers it was sent to.
+type pendingBroadcast struct {
+	message protocol.Message
+	unacked map[string]protocol.PeerID
+	total   int
+	crossed int // Number of thresholds crossed so far
+	retries int
+	sentAt  time.Time
+}
+
+// retry is a message that must be resent to the peers that have not
+// acknowledged it.
+type retry struct {
+	message protocol.Message
+	peerIDs protocol.PeerIDs
+}
+
+// An ackTracker tracks the reliable broadcasts of a Broadcaster until they
+// have been acknowledged by all of the peers they were sent to, or until they
+// have been resent too many times. It is safe for concurrent use.
+type ackTracker struct {
+	thresholds []float64
+	everyAck   bool
+
+	mu      *sync.Mutex
+	pending map[id.Hash]*pendingBroadcast
+}
+
+// newAckTracker returns an ackTracker that reports when the fraction of peers
+// that acknowledged a message crosses one of the thresholds. Thresholds that
+// are not positive report every acknowledgement.
+func newAckTracker(thresholds []float64) *ackTracker {
+	tracker := &ackTracker{
+		thresholds: make([]float64, 0, len(thresholds)),
+		mu:         new(sync.Mutex),
+		pending:    map[id.Hash]*pendingBroadcast{},
+	}
+	for _, threshold := range thresholds {
+		if threshold <= 0 {
+			tracker.everyAck = true
+			continue
+		}
+		tracker.thresholds = append(tracker.thresholds, threshold)
+	}
+	sort.Float64s(tracker.thresholds)
+	return tracker
+}
+
+// track a message that is about to be sent to the given peers.
+func (tracker *ackTracker) track(message protocol.Message, peerIDs protocol.PeerIDs, now time.Time) {
+	unacked := make(map[string]protocol.PeerID, len(peerIDs))
+	for _, peerID := range peerIDs {
+		unacked[peerID.String()] = peerID
+	}
+	if len(unacked) == 0 {
+		return
+	}
+
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	tracker.pending[message.Hash()] = &pendingBroadcast{
+		message: message,
+		unacked: unacked,
+		total:   len(unacked),
+		sentAt:  now,
+	}
+}
+
+// forget a message that was tracked, but could not be sent.
+func (tracker *ackTracker) forget(hash id.Hash) {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	delete(tracker.pending, hash)
+}
+
+// ack records that the peer acknowledged the message with the given hash, and
+// returns the events for the thresholds that were crossed. Acknowledgements of
+// unknown messages, and from unknown peers, are ignored.
+func (tracker *ackTracker) ack(hash id.Hash, from protocol.PeerID, now time.Time) []protocol.EventBroadcastAcked {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	pending, ok := tracker.pending[hash]
+	if !ok {
+		return nil
+	}
+	if _, ok := pending.unacked[from.String()]; !ok {
+		return nil
+	}
+	delete(pending.unacked, from.String())
+	acked := pending.total - len(pending.unacked)
+	if len(pending.unacked) == 0 {
+		delete(tracker.pending, hash)
+	}
+
+	crossed := false
+	for pending.crossed < len(tracker.thresholds) && float64(acked) >= tracker.thresholds[pending.crossed]*float64(pending.total) {
+		pending.crossed++
+		crossed = true
+	}
+	if !crossed && !tracker.everyAck {
+		return nil
+	}
+	return []protocol.EventBroadcastAcked{{
+		Time:       now,
+		Hash:       hash,
+		GroupID:    pending.message.GroupID,
+		AckedPeers: acked,
+		TotalPeers: pending.total,
+	}}
+}
+
+// due returns the messages that have not been acknowledged within the interval
+// since they were last sent, and the peers that must be sent them again.
+// Messages that have already been resent maxRetries times, or that have
+// expired, are forgotten, and the events for their failure are returned.
+func (tracker *ackTracker) due(now time.Time, interval time.Duration, maxRetries int) ([]retry, []protocol.EventBroadcastFailed) {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	retries := []retry{}
+	failures := []protocol.EventBroadcastFailed{}
+	for hash, pending := range tracker.pending {
+		if now.Sub(pending.sentAt) < interval {
+			continue
+		}
+		if pending.retries >= maxRetries || pending.message.Expired(now) {
+			delete(tracker.pending, hash)
+			failures = append(failures, protocol.EventBroadcastFailed{
+				Time:       now,
+				Hash:       hash,
+				GroupID:    pending.message.GroupID,
+				AckedPeers: pending.total - len(pending.unacked),
+				TotalPeers: pending.total,
+			})
+			continue
+		}
+		pending.retries++
+		pending.sentAt = now
+
+		peerIDs := make(protocol.PeerIDs, 0, len(pending.unacked))
+		for _, peerID := range pending.unacked {
+			peerIDs = append(peerIDs, peerID)
+		}
+		retries = append(retries, retry{message: pending.message, peerIDs: peerIDs})
+	}
+	return retries, failures
+}
+
+// snapshot returns the PendingStates of the tracked messages.
+func (tracker *ackTracker) snapshot() []PendingState {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	states := make([]PendingState, 0, len(tracker.pending))
+	for _, pending := range tracker.pending {
+		unacked := make([]string, 0, len(pending.unacked))
+		for peerID := range pending.unacked {
+			unacked = append(unacked, peerID)
+		}
+		sort.Strings(unacked)
+		states = append(states, PendingState{
+			Message: pending.message,
+			Unacked: unacked,
+			Total:   pending.total,
+			Crossed: pending.crossed,
+			Retries: pending.retries,
+		})
+	}
+	return states
+}
+
+// restore a message that was tracked by another ackTracker, as if it was last
+// sent now. It is not restored if none of its unacknowledged peers are known.
+func (tracker *ackTracker) restore(state PendingState, peerIDs protocol.PeerIDs, now time.Time) {
+	unacked := make(map[string]protocol.PeerID, len(state.Unacked))
+	for _, peerID := range peerIDs {
+		unacked[peerID.String()] = peerID
+	}
+	if len(unacked) == 0 {
+		return
+	}
+
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	tracker.pending[state.Message.Hash()] = &pendingBroadcast{
+		message: state.Message,
+		unacked: unacked,
+		total:   state.Total,
+		crossed: state.Crossed,
+		retries: state.Retries,
+		sentAt:  now,
+	}
+}
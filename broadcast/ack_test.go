@@ -0,0 +1,239 @@
+package broadcast_test
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/broadcast"
+	. "github.com/renproject/aw/testutil"
+
+	"github.com/renproject/aw/dht"
+	"github.com/renproject/aw/protocol"
+	"github.com/renproject/id"
+)
+
+var _ = Describe("Reliable broadcaster", func() {
+	reliableOptions := TestOptions
+	reliableOptions.Reliable = true
+	reliableOptions.RetryInterval = 100 * time.Millisecond
+
+	// newGroup returns a DHT, and a group of n other peers that it knows.
+	newGroup := func(n int) (dht.DHT, protocol.GroupID, protocol.PeerAddresses) {
+		addrs := RandomAddresses(n + 1)
+		table := NewDHT(addrs[0], NewTable("dht"), nil)
+		groupID := RandomGroupID()
+		for _, addr := range addrs[1:] {
+			Expect(table.AddPeerAddress(addr)).To(Succeed())
+		}
+		Expect(table.AddGroup(groupID, FromAddressesToIDs(addrs[1:]))).To(Succeed())
+		return table, groupID, addrs[1:]
+	}
+
+	ackOf := func(message protocol.Message) protocol.Message {
+		hash := message.Hash()
+		return protocol.NewMessage(protocol.V1, protocol.BroadcastAck, protocol.NilGroupID, hash[:])
+	}
+
+	Context("when accepting broadcasts", func() {
+		It("should acknowledge every copy to the peer that sent it", func() {
+			messages := make(chan protocol.MessageOnTheWire, 128)
+			events := make(chan protocol.Event, 16)
+			table, groupID, addrs := newGroup(4)
+			broadcaster := NewBroadcasterWithOptions(reliableOptions, messages, events, table)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			message := protocol.NewMessage(protocol.V1, protocol.Broadcast, groupID, RandomMessageBody())
+			for i := 0; i < 2; i++ {
+				Expect(broadcaster.AcceptBroadcast(ctx, addrs[i].PeerID(), message)).To(Succeed())
+			}
+			Eventually(events).Should(Receive())
+
+			acked := map[string]bool{}
+			for len(messages) > 0 {
+				messageOtw := <-messages
+				if messageOtw.Message.Variant == protocol.BroadcastAck {
+					Expect(messageOtw.Message.Body).To(Equal(ackOf(message).Body))
+					acked[messageOtw.To.String()] = true
+				}
+			}
+			Expect(acked).To(HaveLen(2))
+			Expect(acked).To(HaveKey(addrs[0].String()))
+			Expect(acked).To(HaveKey(addrs[1].String()))
+		})
+	})
+
+	Context("when broadcasting", func() {
+		It("should emit an event when the acknowledgements cross a threshold", func() {
+			messages := make(chan protocol.MessageOnTheWire, 128)
+			events := make(chan protocol.Event, 16)
+			table, groupID, addrs := newGroup(4)
+			broadcaster := NewBroadcasterWithOptions(reliableOptions, messages, events, table)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			Expect(broadcaster.Broadcast(ctx, groupID, RandomMessageBody())).To(Succeed())
+			var sent protocol.MessageOnTheWire
+			Eventually(messages).Should(Receive(&sent))
+
+			ack := ackOf(sent.Message)
+			expected := map[int]bool{2: true, 4: true}
+			for i, addr := range addrs {
+				Expect(broadcaster.AcceptBroadcastAck(ctx, addr.PeerID(), ack)).To(Succeed())
+				// Acknowledging twice does not count twice
+				Expect(broadcaster.AcceptBroadcastAck(ctx, addr.PeerID(), ack)).To(Succeed())
+				if !expected[i+1] {
+					Expect(events).ShouldNot(Receive())
+					continue
+				}
+				var event protocol.Event
+				Expect(events).Should(Receive(&event))
+				Expect(event).To(Equal(protocol.EventBroadcastAcked{
+					Time:       event.(protocol.EventBroadcastAcked).Time,
+					Hash:       sent.Message.Hash(),
+					GroupID:    groupID,
+					AckedPeers: i + 1,
+					TotalPeers: len(addrs),
+				}))
+			}
+		})
+
+		It("should emit an event for every acknowledgement when a threshold is zero", func() {
+			messages := make(chan protocol.MessageOnTheWire, 128)
+			events := make(chan protocol.Event, 16)
+			table, groupID, addrs := newGroup(4)
+			options := reliableOptions
+			options.AckThresholds = []float64{0}
+			broadcaster := NewBroadcasterWithOptions(options, messages, events, table)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			Expect(broadcaster.Broadcast(ctx, groupID, RandomMessageBody())).To(Succeed())
+			var sent protocol.MessageOnTheWire
+			Eventually(messages).Should(Receive(&sent))
+
+			for i, addr := range addrs {
+				Expect(broadcaster.AcceptBroadcastAck(ctx, addr.PeerID(), ackOf(sent.Message))).To(Succeed())
+				var event protocol.Event
+				Expect(events).Should(Receive(&event))
+				Expect(event.(protocol.EventBroadcastAcked).AckedPeers).To(Equal(i + 1))
+			}
+		})
+
+		It("should resend the message to the peers that have not acknowledged it", func() {
+			messages := make(chan protocol.MessageOnTheWire, 128)
+			events := make(chan protocol.Event, 16)
+			table, groupID, addrs := newGroup(4)
+			options := reliableOptions
+			options.MaxRetries = 2
+			broadcaster := NewBroadcasterWithOptions(options, messages, events, table)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go broadcaster.Run(ctx)
+			Expect(broadcaster.Broadcast(ctx, groupID, RandomMessageBody())).To(Succeed())
+			var sent protocol.MessageOnTheWire
+			for range addrs {
+				Eventually(messages).Should(Receive(&sent))
+			}
+			for _, addr := range addrs[1:] {
+				Expect(broadcaster.AcceptBroadcastAck(ctx, addr.PeerID(), ackOf(sent.Message))).To(Succeed())
+			}
+			Expect(events).Should(Receive(BeAssignableToTypeOf(protocol.EventBroadcastAcked{})))
+
+			// The message is resent MaxRetries times, and only to the peer that
+			// has not acknowledged it
+			for i := 0; i < options.MaxRetries; i++ {
+				var resent protocol.MessageOnTheWire
+				Eventually(messages).Should(Receive(&resent))
+				Expect(resent.To.String()).To(Equal(addrs[0].String()))
+				Expect(resent.Message.Hash()).To(Equal(sent.Message.Hash()))
+			}
+			Consistently(messages, 500*time.Millisecond).ShouldNot(Receive())
+
+			// The broadcast fails once it is no longer resent
+			var event protocol.Event
+			Eventually(events).Should(Receive(&event))
+			Expect(event).To(Equal(protocol.EventBroadcastFailed{
+				Time:       event.(protocol.EventBroadcastFailed).Time,
+				Hash:       sent.Message.Hash(),
+				GroupID:    groupID,
+				AckedPeers: len(addrs) - 1,
+				TotalPeers: len(addrs),
+			}))
+		})
+
+		It("should not wait for the excluded peers to acknowledge the message", func() {
+			messages := make(chan protocol.MessageOnTheWire, 128)
+			events := make(chan protocol.Event, 16)
+			table, groupID, addrs := newGroup(4)
+			options := reliableOptions
+			options.AckThresholds = []float64{1}
+			broadcaster := NewBroadcasterWithOptions(options, messages, events, table)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go broadcaster.Run(ctx)
+			exclude := protocol.PeerIDs{addrs[0].PeerID()}
+			_, err := broadcaster.BroadcastWithOptions(ctx, groupID, RandomMessageBody(), BroadcastOptions{Exclude: exclude})
+			Expect(err).NotTo(HaveOccurred())
+			var sent protocol.MessageOnTheWire
+			for range addrs[1:] {
+				Eventually(messages).Should(Receive(&sent))
+				Expect(sent.To.String()).NotTo(Equal(addrs[0].String()))
+			}
+			for _, addr := range addrs[1:] {
+				Expect(broadcaster.AcceptBroadcastAck(ctx, addr.PeerID(), ackOf(sent.Message))).To(Succeed())
+			}
+			var event protocol.Event
+			Eventually(events).Should(Receive(&event))
+			Expect(event.(protocol.EventBroadcastAcked).AckedPeers).To(Equal(len(addrs) - 1))
+			Expect(event.(protocol.EventBroadcastAcked).TotalPeers).To(Equal(len(addrs) - 1))
+
+			// The excluded peer is never sent the message, not even when the
+			// message is resent
+			Consistently(messages, 500*time.Millisecond).ShouldNot(Receive())
+		})
+	})
+
+	Context("when restoring the state of another broadcaster", func() {
+		It("should keep resending its unacknowledged broadcasts", func() {
+			messages := make(chan protocol.MessageOnTheWire, 128)
+			events := make(chan protocol.Event, 16)
+			table, groupID, addrs := newGroup(4)
+			broadcaster := NewBroadcasterWithOptions(reliableOptions, messages, events, table)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			Expect(broadcaster.Broadcast(ctx, groupID, RandomMessageBody())).To(Succeed())
+			var sent protocol.MessageOnTheWire
+			Eventually(messages).Should(Receive(&sent))
+			for _, addr := range addrs[1:] {
+				Expect(broadcaster.AcceptBroadcastAck(ctx, addr.PeerID(), ackOf(sent.Message))).To(Succeed())
+			}
+			state, err := broadcaster.State()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(state.Seen).Should(Equal([]id.Hash{sent.Message.Hash()}))
+			Expect(state.Pending).Should(HaveLen(1))
+			Expect(state.Pending[0].Unacked).Should(ConsistOf(addrs[0].PeerID().String()))
+
+			// The restored broadcaster has seen the message, and resends it to
+			// the peer that has not acknowledged it
+			messages = make(chan protocol.MessageOnTheWire, 128)
+			events = make(chan protocol.Event, 16)
+			restored := NewBroadcasterWithOptions(reliableOptions, messages, events, table)
+			Expect(restored.Restore(state)).To(Succeed())
+			go restored.Run(ctx)
+			Expect(restored.AcceptBroadcast(ctx, addrs[1].PeerID(), sent.Message)).To(Succeed())
+			Consistently(events).ShouldNot(Receive())
+			var resent protocol.MessageOnTheWire
+			Eventually(func() string {
+				Eventually(messages).Should(Receive(&resent))
+				return resent.To.String()
+			}).Should(Equal(addrs[0].String()))
+			Expect(resent.Message.Hash()).To(Equal(sent.Message.Hash()))
+		})
+	})
+})
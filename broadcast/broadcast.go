@@ -3,12 +3,16 @@ package broadcast
 import (
 	"context"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/renproject/aw/dht"
+	"github.com/renproject/aw/metrics"
 	"github.com/renproject/aw/protocol"
 	"github.com/renproject/id"
 	"github.com/renproject/kv"
+	"github.com/renproject/phi"
 	"github.com/sirupsen/logrus"
 )
 
@@ -28,107 +32,818 @@ type Broadcaster interface {
 	AcceptBroadcast(ctx context.Context, from protocol.PeerID, message protocol.Message) error
 }
 
+// An ExtendedBroadcaster is a Broadcaster that reports on, acknowledges, hands
+// off and pauses its broadcasts. The Broadcasters returned by this package are
+// ExtendedBroadcasters, so that a Broadcaster can be type asserted to use these
+// features without breaking other implementations of the Broadcaster.
+type ExtendedBroadcaster interface {
+	Broadcaster
+
+	// BroadcastWithReport is the same as Broadcast, but it also returns a
+	// Report describing what happened to each peer in the group.
+	BroadcastWithReport(ctx context.Context, groupID protocol.GroupID, body protocol.MessageBody) (Report, error)
+
+	// BroadcastWithDeadline is the same as BroadcastWithReport, but every peer
+	// drops the message, and stops propagating it, once the deadline has
+	// passed. It is used to bound the lifetime of time-sensitive messages.
+	BroadcastWithDeadline(ctx context.Context, groupID protocol.GroupID, body protocol.MessageBody, deadline time.Time) (Report, error)
+
+	// BroadcastWithOptions is the same as BroadcastWithDeadline, but it is
+	// parameterised by BroadcastOptions, so that it can also exclude peers
+	// from the fanout of the message.
+	BroadcastWithOptions(ctx context.Context, groupID protocol.GroupID, body protocol.MessageBody, options BroadcastOptions) (Report, error)
+
+	// AcceptBroadcastAck message from another peer in the network, that
+	// acknowledges a reliable broadcast.
+	AcceptBroadcastAck(ctx context.Context, from protocol.PeerID, message protocol.Message) error
+
+	// State returns the runtime state of the Broadcaster, so that it can be
+	// handed off to the process that replaces it during a restart.
+	State() (State, error)
+
+	// Restore the State that was handed off by the process that the
+	// Broadcaster replaces. It must be called before the Broadcaster is used.
+	Restore(State) error
+
+	// ShedByGroup returns the broadcasts accepted from other peers that were
+	// shed by every group, because the group exceeded its GroupLimit.
+	ShedByGroup() map[protocol.GroupID]GroupShed
+
+	// PauseRelaying stops, or resumes, the re-broadcasting and bridging of
+	// messages accepted from other peers (e.g. while a mobile peer is in the
+	// background). Accepted messages are still emitted, and acknowledged,
+	// while relaying is paused, but they are not relayed once it resumes.
+	PauseRelaying(paused bool)
+
+	// Run the background propagation of accepted messages until the context
+	// is done. It must be running when asynchronous propagation is enabled,
+	// otherwise accepted messages will never be re-broadcast, and it must be
+	// running for the hashes of seen messages to be deleted once they expire.
+	protocol.Runner
+}
+
+// A Retainer is given every message that the Broadcaster sees for the first
+// time, whether it was broadcast locally or accepted from another peer. It must
+// not block.
+type Retainer interface {
+	Retain(message protocol.Message)
+}
+
+// A Validator checks every message accepted from another peer before an event
+// is emitted for it, and before it is propagated. Messages that are not valid
+// are dropped.
+type Validator interface {
+	Validate(from protocol.PeerID, message protocol.Message) error
+}
+
+// A SignedValidator is a Validator that is also given the peer that signed the
+// message, when the Broadcaster has a SignVerifier (e.g. to check that the
+// signer is allowed to broadcast to the group of the message). ValidateSigned
+// is called instead of Validate.
+type SignedValidator interface {
+	Validator
+	ValidateSigned(from, signer protocol.PeerID, message protocol.Message) error
+}
+
+// A RelayPolicy decides into which other groups a message accepted from another
+// peer is bridged, in addition to being re-broadcast in its own group. It must
+// not block.
+//
+// Bridged messages keep their body, so a message that is bridged back into a
+// group that it has already been broadcast to has the same hash as before, and
+// is dropped as already seen. This prevents loops, even when groups are
+// mirrored into each other by different peers. Signed messages are never
+// bridged, because their signatures cover their group (see
+// Options.SignVerifier).
+type RelayPolicy interface {
+	Bridge(from protocol.PeerID, message protocol.Message) []protocol.GroupID
+}
+
+// Mirror is a RelayPolicy that bridges every message accepted in a group into
+// the groups it is mapped to.
+type Mirror map[protocol.GroupID][]protocol.GroupID
+
+// Bridge implements the RelayPolicy interface.
+func (mirror Mirror) Bridge(from protocol.PeerID, message protocol.Message) []protocol.GroupID {
+	return mirror[message.GroupID]
+}
+
+// Options are used to parameterise the behaviour of a Broadcaster.
+type Options struct {
+	Logger     logrus.FieldLogger
+	NumWorkers int
+
+	// AsyncPropagation makes AcceptBroadcast return as soon as the event has
+	// been emitted, leaving the re-broadcast of the message to the Run loop.
+	// Messages are propagated in the order they were accepted.
+	AsyncPropagation bool
+	// PropagationQueueCapacity is the number of accepted messages that can be
+	// waiting for propagation before AcceptBroadcast blocks. Defaults to 1024.
+	PropagationQueueCapacity int
+
+	// Retainer is optional. When set, it is given every new message.
+	Retainer Retainer
+
+	// Validator is optional. When set, it is used to check every message
+	// accepted from another peer.
+	Validator Validator
+
+	// RelayPolicy is optional. When set, valid messages accepted from other
+	// peers are bridged into the groups it returns. By default, messages are
+	// only re-broadcast in their own group.
+	RelayPolicy RelayPolicy
+
+	// Hasher used to identify the messages broadcast by this peer. Messages
+	// accepted from other peers keep the Hasher they declare. Defaults to
+	// SHA256.
+	Hasher protocol.Hasher
+
+	// Ordered makes the Broadcaster emit the events for messages broadcast by
+	// the same origin to the same group in the order they were broadcast.
+	// Messages are sequenced by their origin, so it must be enabled by all
+	// peers in the network. Messages that are missing are waited for during
+	// the OrderWindow (defaults to 1 second), or until OrderBufferCapacity
+	// (defaults to 256) messages from the origin are waiting, after which they
+	// are skipped. The Run loop must be running to skip missing messages after
+	// the OrderWindow.
+	Ordered             bool
+	OrderWindow         time.Duration
+	OrderBufferCapacity int
+
+	// Reliable makes the Broadcaster acknowledge every broadcast it accepts to
+	// the peer that sent it, and resend the messages it broadcasts to the
+	// peers that have not acknowledged them every RetryInterval (defaults to 1
+	// second), up to MaxRetries times (defaults to 3). An EventBroadcastAcked
+	// is emitted whenever the fraction of peers that acknowledged a message
+	// crosses one of the AckThresholds (defaults to 50% and 100%), so that
+	// applications can wait for delivery quorums. A threshold of zero emits an
+	// event for every acknowledgement. It must be enabled by all peers in the
+	// network, and the Run loop must be running to resend messages.
+	Reliable      bool
+	RetryInterval time.Duration
+	MaxRetries    int
+	AckThresholds []float64
+
+	// Finder is optional. When set, the addresses of the members of a group
+	// that are not in the DHT are looked up when a message is broadcast to
+	// the group, for as long as the context of the broadcast allows, and the
+	// message is sent to the members that are found. Members that are not
+	// found are reported as AddressMissing. Messages accepted from other
+	// peers are only re-broadcast to the members that are in the DHT.
+	Finder protocol.AddressFinder
+
+	// DeadlineSkew is how much the clocks of other peers are tolerated to be
+	// ahead of the local clock. Messages accepted from other peers are only
+	// dropped once their deadline has passed by more than the DeadlineSkew.
+	// MaxDeadline is optional. When set, the deadlines of accepted messages
+	// that are further than the MaxDeadline (and the DeadlineSkew) in the
+	// future are handled by the DeadlinePolicy (defaults to RejectDeadline).
+	// Clock is used to check the deadlines of accepted messages (e.g. the Now
+	// of a pingpong.Clock, that corrects the local clock by its estimated
+	// offset from the clocks of other peers). Defaults to time.Now.
+	DeadlineSkew   time.Duration
+	MaxDeadline    time.Duration
+	DeadlinePolicy DeadlinePolicy
+	Clock          func() time.Time
+
+	// Store is optional. When set, the hashes of the messages that have been
+	// seen are recorded in it, so that they can be persisted across restarts
+	// (e.g. in a LevelDB table), and messages are not emitted or propagated
+	// again after a restart. Otherwise, they are recorded in memory. Hashes
+	// expire after the SeenTTL (defaults to 1 hour), or after the deadline of
+	// their message if it is later, and expired hashes are deleted from the
+	// Store every GCInterval (defaults to 1 minute) by the Run loop. The Store
+	// must not be shared by Broadcasters.
+	Store      kv.Table
+	SeenTTL    time.Duration
+	GCInterval time.Duration
+
+	// FilterSelf stops the Broadcaster from sending messages to the local peer
+	// when it is a member of the group (or is in the DHT), because it would
+	// only drop them as already seen. The local peer is left out of Reports.
+	FilterSelf bool
+
+	// SignVerifier is optional. When set, the bodies of the messages broadcast
+	// by this peer are signed with it, and messages accepted from other peers
+	// are rejected, and not propagated, unless their bodies are signed with a
+	// valid signature. Signatures cover the group and the deadline of the
+	// message as well as its body, so signed messages are never bridged into
+	// other groups, and their deadlines are rejected instead of being clamped.
+	// The signer is given to the Validator if it is a SignedValidator. Events
+	// are emitted with the bodies that were signed. It must be set by all
+	// peers in the network.
+	SignVerifier protocol.SignVerifier
+
+	// Strategy decides to which members of its group a message is propagated
+	// when it is broadcast, or relayed, by this peer (defaults to the
+	// FloodStrategy). Rounds after the first are sent every RoundInterval
+	// (defaults to 200 milliseconds) by the Run loop. Members that are not
+	// sent the message straight away are reported as Deferred.
+	Strategy      Strategy
+	RoundInterval time.Duration
+
+	// GroupLimits are optional. When set, new broadcasts accepted from other
+	// peers are shed, and not acknowledged, once their group exceeds its
+	// GroupLimit, so that one noisy group cannot starve the processing of the
+	// others. Groups that are not in the GroupLimits are limited by the
+	// DefaultGroupLimit, which is not enforced unless it is set.
+	GroupLimits       map[protocol.GroupID]GroupLimit
+	DefaultGroupLimit GroupLimit
+
+	// Metrics is optional. When set, the broadcasts accepted from other peers
+	// that had already been seen are counted in it.
+	Metrics *metrics.Metrics
+
+	// Piggyback is the number of recently seen PeerAddresses that are
+	// piggybacked onto acknowledgements (see Reliable), encoded with the
+	// Codec, so that fresh addresses are disseminated to the peers that
+	// broadcast messages. Piggybacked addresses are added to the DHT of the
+	// peer that accepts the acknowledgement. The Codec must be set when
+	// Piggyback is set, and Piggyback must be set by all peers in the network
+	// (although its value can differ). Defaults to zero (i.e. nothing is
+	// piggybacked), and is capped at protocol.MaxPiggybackedAddresses.
+	Piggyback int
+	Codec     protocol.PeerAddressCodec
+}
+
+func (options *Options) setZerosToDefaults() {
+	if options.Logger == nil {
+		options.Logger = logrus.New()
+	}
+	if options.NumWorkers <= 0 {
+		options.NumWorkers = 1
+	}
+	if options.PropagationQueueCapacity <= 0 {
+		options.PropagationQueueCapacity = 1024
+	}
+	if options.Hasher == 0 {
+		options.Hasher = protocol.SHA256
+	}
+	if options.OrderWindow <= 0 {
+		options.OrderWindow = time.Second
+	}
+	if options.OrderBufferCapacity <= 0 {
+		options.OrderBufferCapacity = 256
+	}
+	if options.RetryInterval <= 0 {
+		options.RetryInterval = time.Second
+	}
+	if options.MaxRetries <= 0 {
+		options.MaxRetries = 3
+	}
+	if len(options.AckThresholds) == 0 {
+		options.AckThresholds = []float64{0.5, 1}
+	}
+	if options.DeadlineSkew < 0 {
+		options.DeadlineSkew = 0
+	}
+	if options.DeadlinePolicy == 0 {
+		options.DeadlinePolicy = RejectDeadline
+	}
+	if options.Clock == nil {
+		options.Clock = time.Now
+	}
+	if options.Store == nil {
+		options.Store = kv.NewTable(kv.NewMemDB(kv.GobCodec), "broadcaster")
+	}
+	if options.SeenTTL <= 0 {
+		options.SeenTTL = time.Hour
+	}
+	if options.GCInterval <= 0 {
+		options.GCInterval = time.Minute
+	}
+	if options.Strategy == nil {
+		options.Strategy = FloodStrategy{}
+	}
+	if options.RoundInterval <= 0 {
+		options.RoundInterval = 200 * time.Millisecond
+	}
+	if options.Piggyback > protocol.MaxPiggybackedAddresses {
+		options.Piggyback = protocol.MaxPiggybackedAddresses
+	}
+}
+
+// DeadlinePolicy decides what happens to messages accepted from other peers
+// with deadlines that are too far in the future (see Options).
+type DeadlinePolicy uint8
+
+const (
+	// RejectDeadline drops the message as invalid.
+	RejectDeadline = DeadlinePolicy(1)
+	// ClampDeadline accepts the message, but relays it with its deadline
+	// clamped to the MaxDeadline. The deadline of a message is not part of
+	// its identity, so clamping it does not change the hash of the message.
+	ClampDeadline = DeadlinePolicy(2)
+)
+
+func (policy DeadlinePolicy) String() string {
+	switch policy {
+	case RejectDeadline:
+		return "reject"
+	case ClampDeadline:
+		return "clamp"
+	default:
+		return fmt.Sprintf("deadlinePolicy(%d)", uint8(policy))
+	}
+}
+
+// Outcome of sending a broadcast to a single peer.
+type Outcome uint8
+
+const (
+	// Enqueued means the message was handed to the MessageSender.
+	Enqueued = Outcome(1)
+	// AddressMissing means the peer is in the group but its PeerAddress is
+	// unknown, so the message could not be sent.
+	AddressMissing = Outcome(2)
+	// EnqueueTimeout means the context was done before the message could be
+	// handed to the MessageSender.
+	EnqueueTimeout = Outcome(3)
+	// Deferred means the Strategy did not send the message to the peer
+	// straight away. It is sent in a later round, or relayed to the peer by
+	// other peers.
+	Deferred = Outcome(4)
+	// Excluded means the peer was excluded from the fanout of the message by
+	// the BroadcastOptions. It can still be relayed to the peer by other
+	// peers.
+	Excluded = Outcome(5)
+)
+
+func (outcome Outcome) String() string {
+	switch outcome {
+	case Enqueued:
+		return "enqueued"
+	case AddressMissing:
+		return "address-missing"
+	case EnqueueTimeout:
+		return "enqueue-timeout"
+	case Deferred:
+		return "deferred"
+	case Excluded:
+		return "excluded"
+	default:
+		return fmt.Sprintf("outcome(%d)", uint8(outcome))
+	}
+}
+
+// PeerOutcome is the Outcome of a broadcast for one peer.
+type PeerOutcome struct {
+	PeerID  protocol.PeerID
+	Outcome Outcome
+}
+
+// Report describes the fanout of a broadcast. Targeted is the number of peers
+// in the group, and is always the sum of the other counters. The Hash
+// identifies the message in the events that are emitted for it (e.g. when it
+// is received by other peers, or acknowledged).
+type Report struct {
+	Hash           id.Hash
+	AlreadySeen    bool
+	Targeted       int
+	Enqueued       int
+	AddressMissing int
+	EnqueueTimeout int
+	Deferred       int
+	Excluded       int
+	Peers          []PeerOutcome
+}
+
+// BroadcastOptions parameterise a single broadcast (see
+// ExtendedBroadcaster.BroadcastWithOptions).
+type BroadcastOptions struct {
+	// Deadline after which the message is dropped by every peer. The zero time
+	// means that there is no deadline.
+	Deadline time.Time
+	// Exclude the peers from the fanout of the message (e.g. the peer that
+	// asked for the message). The peers are only excluded from the fanout of
+	// this peer, so they can still receive the message when it is relayed by
+	// other peers, and they are not expected to acknowledge reliable
+	// broadcasts.
+	Exclude protocol.PeerIDs
+}
+
+func (report *Report) add(peerID protocol.PeerID, outcome Outcome) {
+	report.Targeted++
+	switch outcome {
+	case Enqueued:
+		report.Enqueued++
+	case AddressMissing:
+		report.AddressMissing++
+	case EnqueueTimeout:
+		report.EnqueueTimeout++
+	case Deferred:
+		report.Deferred++
+	case Excluded:
+		report.Excluded++
+	}
+	report.Peers = append(report.Peers, PeerOutcome{PeerID: peerID, Outcome: outcome})
+}
+
+func (report *Report) merge(other Report) {
+	for _, peer := range other.Peers {
+		report.add(peer.PeerID, peer.Outcome)
+	}
+}
+
 type broadcaster struct {
-	logger     logrus.FieldLogger
-	numWorkers int
-	store      kv.Table
-	messages   protocol.MessageSender
-	events     protocol.EventSender
-	dht        dht.DHT
+	logger       logrus.FieldLogger
+	options      Options
+	messages     protocol.MessageSender
+	events       protocol.EventSender
+	dht          dht.ExtendedDHT
+	propagations chan protocol.Message
+	readiness    protocol.Readiness
+
+	// seenLocks make checking and seeing a hash atomic
+	seenLocks hashLocks
+
+	// Only used when the Broadcaster is ordered
+	sequencer *sequencer
+	orderMu   *sync.Mutex
+	orderer   *orderer
+
+	// Only used when the Broadcaster is reliable
+	acks *ackTracker
+
+	// Later rounds of the Strategy
+	rounds *roundScheduler
+
+	limiter *groupLimiter
+
+	relayingPaused int32
 }
 
 // NewBroadcaster returns a Broadcaster that will use the given Storage
 // interface and DHT interface for storing messages and peer addresses
 // respectively.
 func NewBroadcaster(logger logrus.FieldLogger, numWorkers int, messages protocol.MessageSender, events protocol.EventSender, dht dht.DHT) Broadcaster {
-	store := kv.NewTable(kv.NewMemDB(kv.GobCodec), "broadcaster")
+	return NewBroadcasterWithOptions(Options{Logger: logger, NumWorkers: numWorkers}, messages, events, dht)
+}
+
+// NewBroadcasterWithOptions returns an ExtendedBroadcaster that is
+// parameterised by the Options.
+func NewBroadcasterWithOptions(options Options, messages protocol.MessageSender, events protocol.EventSender, table dht.DHT) ExtendedBroadcaster {
+	options.setZerosToDefaults()
 	return &broadcaster{
-		logger:     logger,
-		numWorkers: numWorkers,
-		store:      store,
-		messages:   messages,
-		events:     events,
-		dht:        dht,
+		logger:       options.Logger,
+		options:      options,
+		messages:     messages,
+		events:       events,
+		dht:          dht.Extend(table),
+		propagations: make(chan protocol.Message, options.PropagationQueueCapacity),
+		readiness:    protocol.NewReadiness(),
+		seenLocks:    newHashLocks(),
+
+		sequencer: &sequencer{
+			origin: table.Me().PeerID().String(),
+			epoch:  newEpoch(),
+			mu:     new(sync.Mutex),
+			seqs:   map[protocol.GroupID]uint64{},
+		},
+		orderMu: new(sync.Mutex),
+		orderer: newOrderer(options.OrderWindow, options.OrderBufferCapacity),
+		acks:    newAckTracker(options.AckThresholds),
+		rounds:  newRoundScheduler(),
+		limiter: newGroupLimiter(options.GroupLimits, options.DefaultGroupLimit),
 	}
 }
 
 // Broadcast a message to multiple remote servers in an attempt to saturate the
 // network.
 func (broadcaster *broadcaster) Broadcast(ctx context.Context, groupID protocol.GroupID, body protocol.MessageBody) error {
+	_, err := broadcaster.BroadcastWithReport(ctx, groupID, body)
+	return err
+}
+
+// BroadcastWithReport broadcasts a message in the same way as Broadcast and
+// reports the outcome for every peer in the group.
+func (broadcaster *broadcaster) BroadcastWithReport(ctx context.Context, groupID protocol.GroupID, body protocol.MessageBody) (Report, error) {
+	return broadcaster.BroadcastWithDeadline(ctx, groupID, body, time.Time{})
+}
+
+// BroadcastWithDeadline broadcasts a message in the same way as
+// BroadcastWithReport, but the message is dropped by every peer after the
+// deadline. The zero time means that there is no deadline.
+func (broadcaster *broadcaster) BroadcastWithDeadline(ctx context.Context, groupID protocol.GroupID, body protocol.MessageBody, deadline time.Time) (Report, error) {
+	return broadcaster.BroadcastWithOptions(ctx, groupID, body, BroadcastOptions{Deadline: deadline})
+}
+
+// BroadcastWithOptions broadcasts a message in the same way as
+// BroadcastWithDeadline, but it does not send the message to the peers that
+// are excluded by the options.
+func (broadcaster *broadcaster) BroadcastWithOptions(ctx context.Context, groupID protocol.GroupID, body protocol.MessageBody, options BroadcastOptions) (Report, error) {
+	deadline := options.Deadline
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		return Report{}, newErrBroadcasting(fmt.Errorf("deadline %v has passed", deadline), groupID)
+	}
+	if broadcaster.options.Ordered {
+		body = wrapSequenced(broadcaster.sequencer.next(groupID), body)
+	}
+	if broadcaster.options.SignVerifier != nil {
+		var err error
+		if body, err = wrapSigned(broadcaster.options.SignVerifier, groupID, deadline, body); err != nil {
+			return Report{}, newErrBroadcasting(err, groupID)
+		}
+	}
+	message := protocol.NewMessageWithDeadline(protocol.Broadcast, groupID, body, broadcaster.options.Hasher, deadline)
+	if !broadcaster.options.Reliable {
+		report, err := broadcaster.broadcastMessage(ctx, message, options.Exclude)
+		report.Hash = message.Hash()
+		return report, err
+	}
+
+	// Reliable broadcasts are tracked before they are sent, so that no
+	// acknowledgement is missed
+	if err := broadcaster.track(message, options.Exclude); err != nil {
+		return Report{}, err
+	}
+	report, err := broadcaster.broadcastMessage(ctx, message, options.Exclude)
+	report.Hash = message.Hash()
+	if err != nil || report.AlreadySeen {
+		broadcaster.acks.forget(report.Hash)
+	}
+	return report, err
+}
+
+// track a reliable broadcast until it has been acknowledged by all other
+// members of its group, except for the members that are excluded from it.
+func (broadcaster *broadcaster) track(message protocol.Message, exclude protocol.PeerIDs) error {
+	ids, err := broadcaster.dht.GroupIDs(message.GroupID)
+	if err != nil {
+		return err
+	}
+	me := broadcaster.dht.Me().PeerID()
+	peerIDs := make(protocol.PeerIDs, 0, len(ids))
+	for _, peerID := range ids {
+		if !peerID.Equal(me) && !isExcluded(exclude, peerID) {
+			peerIDs = append(peerIDs, peerID)
+		}
+	}
+	broadcaster.acks.track(message, peerIDs, time.Now())
+	return nil
+}
+
+func (broadcaster *broadcaster) broadcastMessage(ctx context.Context, message protocol.Message, exclude protocol.PeerIDs) (Report, error) {
+	groupID := message.GroupID
+
 	// Ignore message if it already been sent.
-	message := protocol.NewMessage(protocol.V1, protocol.Broadcast, groupID, body)
 	ok, err := broadcaster.messageHashAlreadySeen(message.Hash())
 	if err != nil {
-		return newErrBroadcastInternal(fmt.Errorf("error getting message hash=%v: %v", message.Hash(), err))
+		return Report{}, newErrBroadcastInternal(fmt.Errorf("error getting message hash=%v: %v", message.Hash(), err))
 	}
 	if ok {
-		return nil
+		return Report{AlreadySeen: true}, nil
 	}
 
-	// Get all addresses in the group with the given ID.
-	addrs, err := broadcaster.dht.GroupAddresses(groupID)
+	// Get all members and addresses in the group with the given ID, from a
+	// single snapshot of the DHT.
+	info, err := broadcaster.dht.GroupInfo(groupID)
 	if err != nil {
-		return err
+		return Report{}, err
 	}
 
 	// Check if context is already expired
 	select {
 	case <-ctx.Done():
-		return newErrBroadcasting(ctx.Err(), groupID)
+		return Report{}, newErrBroadcasting(ctx.Err(), groupID)
 	default:
 	}
 
 	// Insert the message to cache to prevent getting a broadcast back of the same message before
-	// finish broadcasting.
-	if err := broadcaster.store.Insert(message.Hash().String(), true); err != nil {
-		return err
+	// finish broadcasting. Concurrent broadcasts of the same message can all
+	// get here, but only the first one to see it propagates it.
+	first, err := broadcaster.seeFirst(message)
+	if err != nil {
+		return Report{}, err
+	}
+	if !first {
+		return Report{AlreadySeen: true}, nil
+	}
+	broadcaster.retain(message)
+	if len(exclude) == 0 {
+		return broadcaster.fanout(ctx, message, info), nil
 	}
+	info, excluded := excludeMembers(info, exclude)
+	report := broadcaster.fanout(ctx, message, info)
+	for _, peerID := range excluded {
+		report.add(peerID, Excluded)
+	}
+	return report, nil
+}
 
-	protocol.ParForAllAddresses(addrs, broadcaster.numWorkers, func(to protocol.PeerAddress) {
-		if to == nil {
-			return
+// excludeMembers removes the excluded peers from the members, and addresses,
+// of the group in the snapshot, and returns the members that were removed.
+func excludeMembers(info dht.GroupInfo, exclude protocol.PeerIDs) (dht.GroupInfo, protocol.PeerIDs) {
+	excluded := protocol.PeerIDs{}
+	addrs := make(protocol.PeerAddresses, 0, len(info.Addresses))
+	for _, addr := range info.Addresses {
+		if addr != nil && isExcluded(exclude, addr.PeerID()) {
+			excluded = append(excluded, addr.PeerID())
+			continue
 		}
-		messageWire := protocol.MessageOnTheWire{
-			To:      to,
-			Message: message,
+		addrs = append(addrs, addr)
+	}
+	missing := make(protocol.PeerIDs, 0, len(info.Missing))
+	for _, peerID := range info.Missing {
+		if isExcluded(exclude, peerID) {
+			excluded = append(excluded, peerID)
+			continue
 		}
+		missing = append(missing, peerID)
+	}
+	info.Addresses, info.Missing = addrs, missing
+	return info, excluded
+}
 
-		select {
-		case <-ctx.Done():
-			broadcaster.logger.Debugf("cannot send message to %v, %v", to.PeerID(), ctx.Err())
-		case broadcaster.messages <- messageWire:
+func isExcluded(exclude protocol.PeerIDs, peerID protocol.PeerID) bool {
+	for _, excluded := range exclude {
+		if excluded.Equal(peerID) {
+			return true
 		}
-	})
+	}
+	return false
+}
+
+// relay a message that has been accepted from another peer, and has already
+// been seen, to the members of its group.
+func (broadcaster *broadcaster) relay(ctx context.Context, message protocol.Message) error {
+	info, err := broadcaster.dht.GroupInfo(message.GroupID)
+	if err != nil {
+		return err
+	}
+
+	// Check if context is already expired
+	select {
+	case <-ctx.Done():
+		return newErrBroadcasting(ctx.Err(), message.GroupID)
+	default:
+	}
 
+	// See the message again, because its deadline may have been clamped
+	if err := broadcaster.see(message); err != nil {
+		return err
+	}
+	broadcaster.retain(message)
+	broadcaster.fanout(ctx, message, info)
 	return nil
 }
 
+// fanout the message to the members of the group in the snapshot, and report
+// the outcome for every member. The addresses of the members that are missing
+// from the snapshot are looked up if a Finder is set.
+func (broadcaster *broadcaster) fanout(ctx context.Context, message protocol.Message, info dht.GroupInfo) Report {
+	report := broadcaster.gossip(ctx, info.Addresses, message)
+	missing := info.Missing
+	if broadcaster.options.Finder != nil && len(missing) > 0 {
+		var found protocol.PeerAddresses
+		found, missing = broadcaster.findAddresses(ctx, missing)
+		report.merge(broadcaster.propagate(ctx, found, message))
+	}
+	for _, id := range missing {
+		report.add(id, AddressMissing)
+	}
+	return report
+}
+
+// findAddresses looks up the addresses of the peers concurrently, and returns
+// the addresses that were found, and the peers that were not found.
+func (broadcaster *broadcaster) findAddresses(ctx context.Context, ids protocol.PeerIDs) (protocol.PeerAddresses, protocol.PeerIDs) {
+	addrs := make(protocol.PeerAddresses, len(ids))
+	phi.ParForAll(ids, func(i int) {
+		addr, err := broadcaster.options.Finder.FindNode(ctx, ids[i])
+		if err != nil {
+			broadcaster.logger.Debugf("cannot find address of peer=%v: %v", ids[i], err)
+			return
+		}
+		addrs[i] = addr
+	})
+
+	found := make(protocol.PeerAddresses, 0, len(ids))
+	missing := make(protocol.PeerIDs, 0, len(ids))
+	for i, addr := range addrs {
+		if addr == nil {
+			missing = append(missing, ids[i])
+			continue
+		}
+		found = append(found, addr)
+	}
+	return found, missing
+}
+
 // AcceptBroadcast from a remote client and propagate it to all peers in the
 // network.
 func (broadcaster *broadcaster) AcceptBroadcast(ctx context.Context, from protocol.PeerID, message protocol.Message) error {
 	// Pre-condition checks
-	if message.Version != protocol.V1 {
+	if message.Version != protocol.V1 && message.Version != protocol.V2 && message.Version != protocol.V3 {
 		return protocol.NewErrMessageVersionIsNotSupported(message.Version)
 	}
 	if message.Variant != protocol.Broadcast {
 		return protocol.NewErrMessageVariantIsNotSupported(message.Variant)
 	}
 
-	// Ignore messages that have already been seen
+	// Shed new messages to groups that exceed their limit before they are
+	// acknowledged, so that reliable broadcasts are resent to this peer
 	messageHash := message.Hash()
-	ok, err := broadcaster.messageHashAlreadySeen(messageHash)
+	if err := broadcaster.admit(message, messageHash); err != nil {
+		return err
+	}
+
+	// Reject messages that are not signed, or that have bad signatures, before
+	// they are acknowledged or seen, so that a copy with a forged group or
+	// deadline cannot stop the signed message from being accepted. Signed
+	// messages are validated, and emitted, without their signature
+	body := message.Body
+	var signer protocol.PeerID
+	if broadcaster.options.SignVerifier != nil {
+		var err error
+		if signer, body, err = unwrapSigned(broadcaster.options.SignVerifier, message); err != nil {
+			return newErrAcceptingBroadcast(protocol.NewErrInvalidMessage(protocol.Broadcast, fmt.Errorf("hash=%v: %v", messageHash, err)))
+		}
+	}
+
+	// Acknowledge every copy of a reliable broadcast, because the sender
+	// resends it until it is acknowledged
+	if broadcaster.options.Reliable {
+		if err := broadcaster.acknowledge(ctx, from, messageHash); err != nil {
+			return err
+		}
+	}
+
+	// Ignore messages that have already been seen, without checking them
+	// again
+	seen, err := broadcaster.messageHashAlreadySeen(messageHash)
 	if err != nil {
 		return newErrBroadcastInternal(fmt.Errorf("error getting message hash=%v: %v", messageHash, err))
 	}
-	if ok {
+	if seen {
+		broadcaster.options.Metrics.Deduplicated()
+		return nil
+	}
+
+	// Messages that are dropped, or rejected, below are not seen. The hash of
+	// a message does not cover its deadline, so a copy that is dropped must
+	// not stop the same message, with another deadline, from being accepted
+	// later.
+
+	// Drop messages whose deadline has passed
+	if broadcaster.expired(message) {
+		broadcaster.logger.Debugf("dropping broadcast hash=%v: deadline %v has passed", messageHash, message.Deadline)
+		return nil
+	}
+
+	// Reject, or clamp, deadlines that are too far in the future. The
+	// deadlines of signed messages are never clamped, because the signature
+	// covers the deadline
+	if maxDeadline, ok := broadcaster.maxDeadline(message); ok {
+		if broadcaster.options.DeadlinePolicy != ClampDeadline || broadcaster.options.SignVerifier != nil {
+			return newErrAcceptingBroadcast(protocol.NewErrInvalidMessage(protocol.Broadcast, fmt.Errorf("hash=%v: deadline %v is after %v", messageHash, message.Deadline, maxDeadline)))
+		}
+		broadcaster.logger.Debugf("clamping broadcast hash=%v: deadline %v is after %v", messageHash, message.Deadline, maxDeadline)
+		message.Deadline = maxDeadline
+	}
+
+	// Ordered messages are validated, and emitted, without their sequence
+	seq := sequence{}
+	if broadcaster.options.Ordered {
+		if seq, body, err = unwrapSequenced(body); err != nil {
+			return newErrAcceptingBroadcast(protocol.NewErrInvalidMessage(protocol.Broadcast, fmt.Errorf("hash=%v: %v", messageHash, err)))
+		}
+	}
+
+	// Drop invalid messages
+	if broadcaster.options.Validator != nil {
+		unwrapped := message
+		unwrapped.Body = body
+		validate := broadcaster.options.Validator.Validate
+		if signedValidator, ok := broadcaster.options.Validator.(SignedValidator); ok && signer != nil {
+			validate = func(from protocol.PeerID, message protocol.Message) error {
+				return signedValidator.ValidateSigned(from, signer, message)
+			}
+		}
+		if err := validate(from, unwrapped); err != nil {
+			return newErrAcceptingBroadcast(protocol.NewErrInvalidMessage(protocol.Broadcast, fmt.Errorf("hash=%v: %v", messageHash, err)))
+		}
+	}
+
+	// See the message. Checking and seeing the message is atomic, so that a
+	// message that is accepted from many peers at the same time is only
+	// emitted, and propagated, once.
+	first, err := broadcaster.seeFirst(message)
+	if err != nil {
+		return newErrBroadcastInternal(fmt.Errorf("error inserting message hash=%v: %v", messageHash, err))
+	}
+	if !first {
+		broadcaster.options.Metrics.Deduplicated()
 		return nil
 	}
 
 	// Emit an event for this newly seen message
 	event := protocol.EventMessageReceived{
 		Time:    time.Now(),
-		Message: message.Body,
+		Message: body,
 		From:    from,
+		GroupID: message.GroupID,
+		Hash:    messageHash,
 	}
 
 	// Check if context is already expired
@@ -138,24 +853,468 @@ func (broadcaster *broadcaster) AcceptBroadcast(ctx context.Context, from protoc
 	default:
 	}
 
+	if broadcaster.options.Ordered {
+		broadcaster.orderMu.Lock()
+		events := broadcaster.orderer.push(seq, event, event.Time)
+		err := broadcaster.emit(ctx, events)
+		broadcaster.orderMu.Unlock()
+		if err != nil {
+			return newErrAcceptingBroadcast(err)
+		}
+	} else {
+		select {
+		case <-ctx.Done():
+			return newErrAcceptingBroadcast(ctx.Err())
+		case broadcaster.events <- event:
+		}
+	}
+
+	// Re-broadcasting the message will downgrade its version to the lowest
+	// version that declares its hasher and its deadline
+	rebroadcast := protocol.NewMessageWithDeadline(protocol.Broadcast, message.GroupID, message.Body, message.HasherOrDefault(), message.Deadline)
+	// Remember the message while relaying is paused, so that it is not
+	// emitted again, without relaying it
+	if atomic.LoadInt32(&broadcaster.relayingPaused) == 1 {
+		if err := broadcaster.see(rebroadcast); err != nil {
+			return newErrBroadcastInternal(fmt.Errorf("error inserting message hash=%v: %v", rebroadcast.Hash(), err))
+		}
+		broadcaster.retain(rebroadcast)
+		return nil
+	}
+
+	if broadcaster.options.AsyncPropagation {
+		if err := broadcaster.enqueuePropagation(ctx, message); err != nil {
+			return err
+		}
+		return broadcaster.bridge(ctx, from, message)
+	}
+	if err := broadcaster.relay(ctx, rebroadcast); err != nil {
+		return err
+	}
+	return broadcaster.bridge(ctx, from, message)
+}
+
+// admit returns an ErrGroupRateLimited if the message has not been seen, and
+// its group exceeds its GroupLimit. Messages that have been seen do not count
+// towards the limit, because they are dropped without being processed.
+func (broadcaster *broadcaster) admit(message protocol.Message, messageHash id.Hash) error {
+	if !broadcaster.limiter.enforced(message.GroupID) {
+		return nil
+	}
+	seen, err := broadcaster.messageHashAlreadySeen(messageHash)
+	if err != nil {
+		return newErrBroadcastInternal(fmt.Errorf("error getting message hash=%v: %v", messageHash, err))
+	}
+	if seen {
+		return nil
+	}
+	ok, first := broadcaster.limiter.allow(message.GroupID, len(message.Body), time.Now())
+	if ok {
+		return nil
+	}
+	if first {
+		broadcaster.logger.Warnf("shedding broadcasts to group=%v: group exceeds its limit", message.GroupID)
+	}
+	return newErrGroupRateLimited(message.GroupID)
+}
+
+func (broadcaster *broadcaster) ShedByGroup() map[protocol.GroupID]GroupShed {
+	return broadcaster.limiter.shedByGroup()
+}
+
+func (broadcaster *broadcaster) PauseRelaying(paused bool) {
+	if paused {
+		atomic.StoreInt32(&broadcaster.relayingPaused, 1)
+	} else {
+		atomic.StoreInt32(&broadcaster.relayingPaused, 0)
+	}
+}
+
+// acknowledge the message with the given hash to the peer that sent it. Peers
+// with unknown addresses are not acknowledged.
+func (broadcaster *broadcaster) acknowledge(ctx context.Context, from protocol.PeerID, messageHash id.Hash) error {
+	to, err := broadcaster.dht.PeerAddress(from)
+	if err != nil || to == nil {
+		broadcaster.logger.Debugf("cannot acknowledge message hash=%v to peer=%v: unknown address", messageHash, from)
+		return nil
+	}
+	body := protocol.MessageBody(messageHash[:])
+	if broadcaster.options.Piggyback > 0 {
+		if body, err = broadcaster.piggyback(body, from); err != nil {
+			return newErrAcceptingBroadcast(err)
+		}
+	}
+	ack := protocol.MessageOnTheWire{
+		To:      to,
+		Message: protocol.NewMessage(protocol.V1, protocol.BroadcastAck, protocol.NilGroupID, body),
+	}
 	select {
 	case <-ctx.Done():
 		return newErrAcceptingBroadcast(ctx.Err())
-	case broadcaster.events <- event:
+	case broadcaster.messages <- ack:
+		return nil
+	}
+}
+
+// AcceptBroadcastAck from a remote client, and emit an event if the
+// acknowledgement makes the message cross one of the AckThresholds.
+func (broadcaster *broadcaster) AcceptBroadcastAck(ctx context.Context, from protocol.PeerID, message protocol.Message) error {
+	// Pre-condition checks
+	if message.Version != protocol.V1 {
+		return protocol.NewErrMessageVersionIsNotSupported(message.Version)
+	}
+	if message.Variant != protocol.BroadcastAck {
+		return protocol.NewErrMessageVariantIsNotSupported(message.Variant)
+	}
+	if !broadcaster.options.Reliable {
+		return nil
+	}
+	body := message.Body
+	var piggybacked protocol.PeerAddresses
+	if broadcaster.options.Piggyback > 0 {
+		var err error
+		if body, piggybacked, err = protocol.SplitPeerAddresses(body, broadcaster.options.Codec); err != nil {
+			return newErrAcceptingBroadcast(protocol.NewErrInvalidMessage(protocol.BroadcastAck, fmt.Errorf("from peer=%v: %v", from, err)))
+		}
+	}
+	messageHash := id.Hash{}
+	if len(body) != len(messageHash) {
+		return newErrAcceptingBroadcast(protocol.NewErrInvalidMessage(protocol.BroadcastAck, fmt.Errorf("from peer=%v: expected len=%v, got len=%v", from, len(messageHash), len(body))))
+	}
+	copy(messageHash[:], body)
+
+	me := broadcaster.dht.Me().PeerID()
+	for _, peerAddr := range piggybacked {
+		if peerAddr.PeerID().Equal(me) {
+			continue
+		}
+		if _, err := broadcaster.dht.UpdatePeerAddress(peerAddr); err != nil {
+			broadcaster.logger.Debugf("cannot update address of peer=%v piggybacked by peer=%v: %v", peerAddr.PeerID(), from, err)
+		}
 	}
 
-	// Re-broadcasting the message will downgrade its version to the version
-	// supported by this broadcaster
-	return broadcaster.Broadcast(ctx, message.GroupID, message.Body)
+	for _, event := range broadcaster.acks.ack(messageHash, from, time.Now()) {
+		select {
+		case <-ctx.Done():
+			return newErrAcceptingBroadcast(ctx.Err())
+		case broadcaster.events <- event:
+		}
+	}
+	return nil
 }
 
-func (broadcaster *broadcaster) messageHashAlreadySeen(hash id.Hash) (bool, error) {
-	var exists bool
-	err := broadcaster.store.Get(hash.String(), &exists)
-	if err == kv.ErrKeyNotFound {
-		return false, nil
+// piggyback the PeerAddresses of the peers that have been seen most recently
+// onto the body of an acknowledgement, except for the local peer and the
+// recipient.
+func (broadcaster *broadcaster) piggyback(body protocol.MessageBody, to protocol.PeerID) (protocol.MessageBody, error) {
+	recent, err := broadcaster.dht.RecentPeerAddresses(broadcaster.options.Piggyback + 2)
+	if err != nil {
+		// Acknowledgements are still sent when there is nothing to piggyback
+		broadcaster.logger.Debugf("cannot piggyback addresses onto acknowledgement to peer=%v: %v", to, err)
+	}
+	me := broadcaster.dht.Me().PeerID()
+	peerAddrs := make(protocol.PeerAddresses, 0, broadcaster.options.Piggyback)
+	for _, peerAddr := range recent {
+		if len(peerAddrs) == broadcaster.options.Piggyback {
+			break
+		}
+		if peerAddr.PeerID().Equal(me) || peerAddr.PeerID().Equal(to) {
+			continue
+		}
+		peerAddrs = append(peerAddrs, peerAddr)
+	}
+	return protocol.AppendPeerAddresses(body, broadcaster.options.Codec, peerAddrs)
+}
+
+// bridge an accepted message into the groups returned by the RelayPolicy.
+// Messages are never bridged into their own group, and bridged messages that
+// have already been seen are dropped.
+func (broadcaster *broadcaster) bridge(ctx context.Context, from protocol.PeerID, message protocol.Message) error {
+	if broadcaster.options.RelayPolicy == nil {
+		return nil
+	}
+	if broadcaster.options.SignVerifier != nil {
+		broadcaster.logger.Debugf("not bridging signed message hash=%v: signature covers group=%v", message.Hash(), message.GroupID)
+		return nil
+	}
+
+	bridged := map[protocol.GroupID]struct{}{message.GroupID: {}}
+	for _, groupID := range broadcaster.options.RelayPolicy.Bridge(from, message) {
+		if _, ok := bridged[groupID]; ok || groupID.Equal(protocol.NilGroupID) {
+			continue
+		}
+		bridged[groupID] = struct{}{}
+
+		bridgedMessage := protocol.NewMessageWithDeadline(protocol.Broadcast, groupID, message.Body, message.HasherOrDefault(), message.Deadline)
+		if broadcaster.options.AsyncPropagation {
+			first, err := broadcaster.seeFirst(bridgedMessage)
+			if err != nil {
+				return newErrBroadcastInternal(fmt.Errorf("error inserting message hash=%v: %v", bridgedMessage.Hash(), err))
+			}
+			if !first {
+				continue
+			}
+			if err := broadcaster.enqueuePropagation(ctx, bridgedMessage); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := broadcaster.broadcastMessage(ctx, bridgedMessage, nil); err != nil {
+			return newErrAcceptingBroadcast(fmt.Errorf("error bridging message hash=%v into group=%v: %v", message.Hash(), groupID, err))
+		}
+	}
+	return nil
+}
+
+// Run the background propagation of accepted messages, skip missing ordered
+// messages, and delete expired hashes from the store, until the context is
+// done.
+func (broadcaster *broadcaster) Run(ctx context.Context) error {
+	var expiries <-chan time.Time
+	if broadcaster.options.Ordered {
+		ticker := time.NewTicker(broadcaster.options.OrderWindow / 2)
+		defer ticker.Stop()
+		expiries = ticker.C
+	}
+	var retries <-chan time.Time
+	if broadcaster.options.Reliable {
+		ticker := time.NewTicker(broadcaster.options.RetryInterval / 2)
+		defer ticker.Stop()
+		retries = ticker.C
+	}
+	gc := time.NewTicker(broadcaster.options.GCInterval)
+	defer gc.Stop()
+	rounds := time.NewTicker(broadcaster.options.RoundInterval / 2)
+	defer rounds.Stop()
+
+	broadcaster.readiness.Signal()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case now := <-expiries:
+			broadcaster.orderMu.Lock()
+			events := broadcaster.orderer.expire(now)
+			err := broadcaster.emit(ctx, events)
+			broadcaster.orderMu.Unlock()
+			if err != nil {
+				broadcaster.logger.Errorf("error emitting ordered broadcasts: %v", err)
+			}
+		case now := <-retries:
+			broadcaster.resend(ctx, now)
+		case now := <-rounds.C:
+			for _, round := range broadcaster.rounds.due(now) {
+				if broadcaster.expired(round.message) {
+					continue
+				}
+				broadcaster.propagate(ctx, round.addrs, round.message)
+			}
+		case now := <-gc.C:
+			n, err := broadcaster.collectGarbage(now)
+			if err != nil {
+				broadcaster.logger.Errorf("error collecting expired broadcasts: %v", err)
+				continue
+			}
+			if n > 0 {
+				broadcaster.logger.Debugf("collected %v expired broadcasts", n)
+			}
+		case message := <-broadcaster.propagations:
+			if broadcaster.expired(message) {
+				broadcaster.logger.Debugf("dropping broadcast hash=%v: deadline %v has passed", message.Hash(), message.Deadline)
+				continue
+			}
+			addrs, err := broadcaster.dht.GroupAddresses(message.GroupID)
+			if err != nil {
+				broadcaster.logger.Errorf("error propagating broadcast: error loading group=%v: %v", message.GroupID, err)
+				continue
+			}
+			broadcaster.gossip(ctx, addrs, message)
+		}
+	}
+}
+
+// resend the reliable broadcasts that have not been acknowledged within the
+// RetryInterval to the peers that have not acknowledged them, and emit an event
+// for the broadcasts that are no longer resent.
+func (broadcaster *broadcaster) resend(ctx context.Context, now time.Time) {
+	retries, failures := broadcaster.acks.due(now, broadcaster.options.RetryInterval, broadcaster.options.MaxRetries)
+	for _, event := range failures {
+		broadcaster.logger.Debugf("giving up broadcast hash=%v: acknowledged by %v/%v peers", event.Hash, event.AckedPeers, event.TotalPeers)
+		select {
+		case <-ctx.Done():
+			return
+		case broadcaster.events <- event:
+		}
+	}
+	for _, retry := range retries {
+		addrs := make(protocol.PeerAddresses, 0, len(retry.peerIDs))
+		for _, peerID := range retry.peerIDs {
+			addr, err := broadcaster.dht.PeerAddress(peerID)
+			if err != nil || addr == nil {
+				continue
+			}
+			addrs = append(addrs, addr)
+		}
+		broadcaster.propagate(ctx, addrs, retry.message)
+	}
+}
+
+// expired returns true if the deadline of the message has passed by more than
+// the DeadlineSkew, according to the Clock.
+func (broadcaster *broadcaster) expired(message protocol.Message) bool {
+	return message.Expired(broadcaster.options.Clock().Add(-broadcaster.options.DeadlineSkew))
+}
+
+// expiry returns the time, according to the local clock, at which the message
+// expires.
+func (broadcaster *broadcaster) expiry(message protocol.Message) time.Time {
+	now := time.Now()
+	return message.Deadline.Add(broadcaster.options.DeadlineSkew).Add(now.Sub(broadcaster.options.Clock()))
+}
+
+// maxDeadline returns the latest deadline that is accepted, and true if the
+// deadline of the message is after it.
+func (broadcaster *broadcaster) maxDeadline(message protocol.Message) (time.Time, bool) {
+	if broadcaster.options.MaxDeadline <= 0 || message.Version != protocol.V3 || message.Deadline.IsZero() {
+		return time.Time{}, false
+	}
+	now := broadcaster.options.Clock()
+	maxDeadline := now.Add(broadcaster.options.MaxDeadline)
+	return maxDeadline, message.Deadline.After(maxDeadline.Add(broadcaster.options.DeadlineSkew))
+}
+
+// Ready returns a channel that is closed once the Run loop is running.
+func (broadcaster *broadcaster) Ready() <-chan struct{} {
+	return broadcaster.readiness.Ready()
+}
+
+// enqueuePropagation marks the message as seen and queues it for the Run loop
+// to re-broadcast. The message is marked as seen before it is queued so that
+// receiving it again while it is waiting does not emit a second event.
+func (broadcaster *broadcaster) enqueuePropagation(ctx context.Context, message protocol.Message) error {
+	// Re-broadcasting the message will downgrade its version to the lowest
+	// version that declares its hasher and its deadline
+	message = protocol.NewMessageWithDeadline(protocol.Broadcast, message.GroupID, message.Body, message.HasherOrDefault(), message.Deadline)
+	if err := broadcaster.see(message); err != nil {
+		return newErrBroadcastInternal(fmt.Errorf("error inserting message hash=%v: %v", message.Hash(), err))
+	}
+	broadcaster.retain(message)
+
+	select {
+	case <-ctx.Done():
+		return newErrAcceptingBroadcast(ctx.Err())
+	case broadcaster.propagations <- message:
+		return nil
+	}
+}
+
+// gossip the message to the addresses that are selected by the Strategy. The
+// first round is propagated straight away, and later rounds are scheduled for
+// the Run loop. The addresses that are not in the first round are reported as
+// Deferred.
+func (broadcaster *broadcaster) gossip(ctx context.Context, addrs protocol.PeerAddresses, message protocol.Message) Report {
+	// The local peer is not given to the Strategy, so that it is not
+	// selected instead of another peer
+	if broadcaster.options.FilterSelf {
+		me := broadcaster.dht.Me().PeerID()
+		others := make(protocol.PeerAddresses, 0, len(addrs))
+		for _, addr := range addrs {
+			if addr != nil && !addr.PeerID().Equal(me) {
+				others = append(others, addr)
+			}
+		}
+		addrs = others
+	}
+
+	rounds := broadcaster.options.Strategy.Select(message, addrs)
+	if len(rounds) == 0 {
+		rounds = []protocol.PeerAddresses{nil}
+	}
+	report := broadcaster.propagate(ctx, rounds[0], message)
+	if len(rounds[0]) == len(addrs) {
+		return report
+	}
+	first := make(map[string]struct{}, len(rounds[0]))
+	for _, addr := range rounds[0] {
+		if addr != nil {
+			first[addr.PeerID().String()] = struct{}{}
+		}
+	}
+	for _, addr := range addrs {
+		if addr == nil {
+			continue
+		}
+		if _, ok := first[addr.PeerID().String()]; !ok {
+			report.add(addr.PeerID(), Deferred)
+		}
+	}
+	broadcaster.rounds.schedule(message, rounds[1:], time.Now(), broadcaster.options.RoundInterval)
+	return report
+}
+
+func (broadcaster *broadcaster) propagate(ctx context.Context, addrs protocol.PeerAddresses, message protocol.Message) Report {
+	reportMu := new(sync.Mutex)
+	report := Report{}
+
+	// Stop propagating the message once its deadline has passed
+	if message.Version == protocol.V3 && !message.Deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, broadcaster.expiry(message))
+		defer cancel()
+	}
+
+	err := protocol.ParForAllAddressesWithContext(ctx, addrs, broadcaster.options.NumWorkers, func(ctx context.Context, to protocol.PeerAddress) error {
+		if to == nil {
+			return nil
+		}
+		if broadcaster.options.FilterSelf && to.PeerID().Equal(broadcaster.dht.Me().PeerID()) {
+			return nil
+		}
+		messageWire := protocol.MessageOnTheWire{
+			To:      to,
+			Message: message,
+		}
+
+		select {
+		case <-ctx.Done():
+			broadcaster.logger.Debugf("cannot send message to %v, %v", to.PeerID(), ctx.Err())
+			return ctx.Err()
+		case broadcaster.messages <- messageWire:
+		}
+
+		reportMu.Lock()
+		defer reportMu.Unlock()
+		report.add(to.PeerID(), Enqueued)
+		return nil
+	})
+
+	// Addresses fail when the context is done before the message could be
+	// enqueued for them (including those that were never attempted)
+	if err, ok := err.(protocol.ErrAddresses); ok {
+		for _, addrErr := range err.Errs {
+			report.add(addrErr.PeerAddress.PeerID(), EnqueueTimeout)
+		}
+	}
+	return report
+}
+
+// emit the events in order. It must be called while holding the order mutex, so
+// that events from the same stream are not interleaved.
+func (broadcaster *broadcaster) emit(ctx context.Context, events []protocol.EventMessageReceived) error {
+	for _, event := range events {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case broadcaster.events <- event:
+		}
+	}
+	return nil
+}
+
+func (broadcaster *broadcaster) retain(message protocol.Message) {
+	if broadcaster.options.Retainer != nil {
+		broadcaster.options.Retainer.Retain(message)
 	}
-	return exists, err
 }
 
 // ErrBroadcastInternal is returned when there is an internal broadcasting
@@ -163,33 +1322,73 @@ func (broadcaster *broadcaster) messageHashAlreadySeen(hash id.Hash) (bool, erro
 // implementation.
 type ErrBroadcastInternal struct {
 	error
+	cause error
 }
 
 func newErrBroadcastInternal(err error) error {
 	return ErrBroadcastInternal{
 		error: fmt.Errorf("internal broadcast error: %v", err),
+		cause: err,
 	}
 }
 
+func (err ErrBroadcastInternal) Is(target error) bool {
+	return target == protocol.ErrInternal
+}
+
+func (err ErrBroadcastInternal) Unwrap() error {
+	return err.cause
+}
+
 // ErrBroadcasting is returned when there is an error when broadcasting.
 type ErrBroadcasting struct {
 	error
+	cause error
 }
 
 func newErrBroadcasting(err error, groupID protocol.GroupID) error {
 	return ErrBroadcasting{
 		error: fmt.Errorf("error broadcasting to group [%v] : %v", groupID, err),
+		cause: err,
 	}
 }
 
+func (err ErrBroadcasting) Unwrap() error {
+	return err.cause
+}
+
 // ErrAcceptingBroadcast is returned when there is an error when accepting a
 // broadcast.
 type ErrAcceptingBroadcast struct {
 	error
+	cause error
 }
 
 func newErrAcceptingBroadcast(err error) error {
 	return ErrAcceptingBroadcast{
 		error: fmt.Errorf("error accepting broadcast: %v", err),
+		cause: err,
 	}
 }
+
+func (err ErrAcceptingBroadcast) Unwrap() error {
+	return err.cause
+}
+
+// ErrGroupRateLimited is returned when a broadcast accepted from another peer
+// is shed, because its group exceeds its GroupLimit.
+type ErrGroupRateLimited struct {
+	error
+	GroupID protocol.GroupID
+}
+
+func newErrGroupRateLimited(groupID protocol.GroupID) error {
+	return ErrGroupRateLimited{
+		error:   fmt.Errorf("error accepting broadcast: group=%v exceeds its limit", groupID),
+		GroupID: groupID,
+	}
+}
+
+func (err ErrGroupRateLimited) Is(target error) bool {
+	return target == protocol.ErrUnavailable
+}
@@ -3,7 +3,10 @@ package broadcast_test
 import (
 	"bytes"
 	"context"
+	"errors"
+	"sync"
 	"testing/quick"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -11,9 +14,15 @@ import (
 	. "github.com/renproject/aw/testutil"
 
 	"github.com/renproject/aw/protocol"
+	"github.com/renproject/kv"
 	"github.com/sirupsen/logrus"
 )
 
+var TestOptions = Options{
+	Logger:     logrus.New(),
+	NumWorkers: 8,
+}
+
 var _ = Describe("Broadcaster", func() {
 
 	Context("when broadcasting", func() {
@@ -135,6 +144,822 @@ var _ = Describe("Broadcaster", func() {
 		})
 	})
 
+	Context("when broadcasting to a group with subgroups", func() {
+		It("should send the message once to every member of the group and its subgroups", func() {
+			messages := make(chan protocol.MessageOnTheWire, 256)
+			events := make(chan protocol.Event, 1)
+			dht := NewExtendedDHT(RandomAddress(), NewTable("dht"), nil)
+			broadcaster := NewBroadcasterWithOptions(TestOptions, messages, events, dht)
+
+			// The parent group has no members of its own, and one peer is in
+			// both subgroups.
+			parent := RandomGroupID()
+			childID1, addrs1, err := NewGroup(dht)
+			Expect(err).NotTo(HaveOccurred())
+			childID2, addrs2, err := NewGroup(dht)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dht.AddGroup(childID2, append(FromAddressesToIDs(addrs2), addrs1[0].PeerID()))).To(Succeed())
+			Expect(dht.AddSubgroup(parent, childID1)).To(Succeed())
+			Expect(dht.AddSubgroup(parent, childID2)).To(Succeed())
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			Expect(broadcaster.Broadcast(ctx, parent, RandomMessageBody())).To(Succeed())
+
+			addrs := append(addrs1, addrs2...)
+			received := map[string]struct{}{}
+			for range addrs {
+				var message protocol.MessageOnTheWire
+				Eventually(messages).Should(Receive(&message))
+				Expect(addrs).Should(ContainElement(message.To))
+				Expect(message.Message.GroupID).Should(Equal(parent))
+				received[message.To.PeerID().String()] = struct{}{}
+			}
+			Expect(received).Should(HaveLen(len(addrs)))
+			Eventually(messages).ShouldNot(Receive())
+		})
+	})
+
+	Context("when a retainer is set", func() {
+		It("should retain every new message exactly once", func() {
+			messages := make(chan protocol.MessageOnTheWire, 128)
+			events := make(chan protocol.Event, 16)
+			dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+			retainer := &mockRetainer{}
+			options := TestOptions
+			options.Retainer = retainer
+			broadcaster := NewBroadcasterWithOptions(options, messages, events, dht)
+
+			groupID, _, err := NewGroup(dht)
+			Expect(err).NotTo(HaveOccurred())
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			Expect(broadcaster.Broadcast(ctx, groupID, RandomMessageBody())).To(Succeed())
+			message := protocol.NewMessage(protocol.V1, protocol.Broadcast, groupID, RandomMessageBody())
+			Expect(broadcaster.AcceptBroadcast(ctx, RandomPeerID(), message)).To(Succeed())
+			Expect(broadcaster.AcceptBroadcast(ctx, RandomPeerID(), message)).To(Succeed())
+
+			Expect(retainer.messages).Should(HaveLen(2))
+			Expect(retainer.messages[1].Hash()).Should(Equal(message.Hash()))
+		})
+	})
+
+	Context("when a sign verifier is set", func() {
+		It("should only accept, and propagate, messages with valid signatures", func() {
+			signer, verifier := NewMockSignVerifier(), NewMockSignVerifier()
+			verifier.Whitelist(signer.ID())
+
+			// Sign a broadcast
+			signerMessages := make(chan protocol.MessageOnTheWire, 128)
+			signerOptions := TestOptions
+			signerOptions.SignVerifier = signer
+			signerDHT := NewDHT(RandomAddress(), NewTable("dht"), nil)
+			signerBroadcaster := NewBroadcasterWithOptions(signerOptions, signerMessages, make(chan protocol.Event, 16), signerDHT)
+			signerGroupID, addrs, err := NewGroup(signerDHT)
+			Expect(err).NotTo(HaveOccurred())
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			messageBody := RandomMessageBody()
+			Expect(signerBroadcaster.Broadcast(ctx, signerGroupID, messageBody)).To(Succeed())
+			var signed protocol.MessageOnTheWire
+			Eventually(signerMessages).Should(Receive(&signed))
+			Expect(bytes.Equal(signed.Message.Body, messageBody)).Should(BeFalse())
+
+			// Verify the broadcast
+			messages := make(chan protocol.MessageOnTheWire, 128)
+			events := make(chan protocol.Event, 16)
+			options := TestOptions
+			options.SignVerifier = verifier
+			dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+			broadcaster := NewBroadcasterWithOptions(options, messages, events, dht)
+			ids := make(protocol.PeerIDs, len(addrs))
+			for i := range addrs {
+				Expect(dht.AddPeerAddress(addrs[i])).To(Succeed())
+				ids[i] = addrs[i].PeerID()
+			}
+			Expect(dht.AddGroup(signerGroupID, ids)).To(Succeed())
+			groupID, _, err := NewGroup(dht)
+			Expect(err).NotTo(HaveOccurred())
+
+			message := signed.Message
+			Expect(broadcaster.AcceptBroadcast(ctx, RandomPeerID(), message)).To(Succeed())
+			var event protocol.Event
+			Eventually(events).Should(Receive(&event))
+			Expect(bytes.Equal(event.(protocol.EventMessageReceived).Message, messageBody)).Should(BeTrue())
+			for range addrs {
+				var propagated protocol.MessageOnTheWire
+				Eventually(messages).Should(Receive(&propagated))
+				Expect(propagated.Message.Hash()).Should(Equal(message.Hash()))
+			}
+
+			// Reject messages that are unsigned, signed by unknown peers,
+			// tampered with, or signed for another group or deadline
+			unknownMessages := make(chan protocol.MessageOnTheWire, 128)
+			unknownOptions := TestOptions
+			unknownOptions.SignVerifier = NewMockSignVerifier()
+			unknownBroadcaster := NewBroadcasterWithOptions(unknownOptions, unknownMessages, make(chan protocol.Event, 16), signerDHT)
+			Expect(unknownBroadcaster.Broadcast(ctx, signerGroupID, messageBody)).To(Succeed())
+			var unknownSigned protocol.MessageOnTheWire
+			Eventually(unknownMessages).Should(Receive(&unknownSigned))
+			tampered := append(protocol.MessageBody{}, signed.Message.Body...)
+			tampered[len(tampered)-1] ^= 1
+			for _, body := range []protocol.MessageBody{RandomMessageBody(), unknownSigned.Message.Body, tampered} {
+				message := protocol.NewMessage(protocol.V1, protocol.Broadcast, signerGroupID, body)
+				Expect(broadcaster.AcceptBroadcast(ctx, RandomPeerID(), message)).NotTo(Succeed())
+			}
+			otherGroup := protocol.NewMessage(protocol.V1, protocol.Broadcast, groupID, signed.Message.Body)
+			Expect(broadcaster.AcceptBroadcast(ctx, RandomPeerID(), otherGroup)).NotTo(Succeed())
+			otherDeadline := protocol.NewMessageWithDeadline(protocol.Broadcast, signerGroupID, signed.Message.Body, signed.Message.HasherOrDefault(), time.Now().Add(time.Minute))
+			Expect(broadcaster.AcceptBroadcast(ctx, RandomPeerID(), otherDeadline)).NotTo(Succeed())
+			Consistently(events).ShouldNot(Receive())
+			Consistently(messages).ShouldNot(Receive())
+		})
+
+		It("should give the signer to a signed validator", func() {
+			signer, verifier := NewMockSignVerifier(), NewMockSignVerifier()
+			verifier.Whitelist(signer.ID())
+
+			signerMessages := make(chan protocol.MessageOnTheWire, 128)
+			signerOptions := TestOptions
+			signerOptions.SignVerifier = signer
+			signerDHT := NewDHT(RandomAddress(), NewTable("dht"), nil)
+			signerBroadcaster := NewBroadcasterWithOptions(signerOptions, signerMessages, make(chan protocol.Event, 16), signerDHT)
+			groupID, _, err := NewGroup(signerDHT)
+			Expect(err).NotTo(HaveOccurred())
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			Expect(signerBroadcaster.Broadcast(ctx, groupID, RandomMessageBody())).To(Succeed())
+			var signed protocol.MessageOnTheWire
+			Eventually(signerMessages).Should(Receive(&signed))
+
+			validator := &mockSignedValidator{}
+			options := TestOptions
+			options.SignVerifier = verifier
+			options.Validator = validator
+			broadcaster := NewBroadcasterWithOptions(options, make(chan protocol.MessageOnTheWire, 128), make(chan protocol.Event, 16), signerDHT)
+			Expect(broadcaster.AcceptBroadcast(ctx, RandomPeerID(), signed.Message)).To(Succeed())
+			Expect(validator.signers).Should(Equal([]protocol.PeerID{SimplePeerID(signer.ID())}))
+		})
+	})
+
+	Context("when a hasher is set", func() {
+		It("should declare the hasher in the broadcast messages", func() {
+			messages := make(chan protocol.MessageOnTheWire, 128)
+			events := make(chan protocol.Event, 16)
+			dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+			options := TestOptions
+			options.Hasher = protocol.BLAKE3
+			broadcaster := NewBroadcasterWithOptions(options, messages, events, dht)
+
+			groupID, addrs, err := NewGroup(dht)
+			Expect(err).NotTo(HaveOccurred())
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			messageBody := RandomMessageBody()
+			Expect(broadcaster.Broadcast(ctx, groupID, messageBody)).To(Succeed())
+
+			for range addrs {
+				var message protocol.MessageOnTheWire
+				Eventually(messages).Should(Receive(&message))
+				Expect(message.Message.Version).Should(Equal(protocol.V2))
+				Expect(message.Message.Hasher).Should(Equal(protocol.BLAKE3))
+				Expect(bytes.Equal(message.Message.Body, messageBody)).Should(BeTrue())
+			}
+		})
+
+		It("should propagate accepted messages with the hasher they declare", func() {
+			messages := make(chan protocol.MessageOnTheWire, 128)
+			events := make(chan protocol.Event, 16)
+			dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+			broadcaster := NewBroadcasterWithOptions(TestOptions, messages, events, dht)
+
+			groupID, addrs, err := NewGroup(dht)
+			Expect(err).NotTo(HaveOccurred())
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			message := protocol.NewMessageWithHasher(protocol.Broadcast, groupID, RandomMessageBody(), protocol.BLAKE3)
+			Expect(broadcaster.AcceptBroadcast(ctx, RandomPeerID(), message)).To(Succeed())
+			Eventually(events).Should(Receive())
+
+			for range addrs {
+				var propagated protocol.MessageOnTheWire
+				Eventually(messages).Should(Receive(&propagated))
+				Expect(propagated.Message.Version).Should(Equal(protocol.V2))
+				Expect(propagated.Message.Hash()).Should(Equal(message.Hash()))
+			}
+
+			// Expect the message to be deduplicated using the declared hasher
+			Expect(broadcaster.AcceptBroadcast(ctx, RandomPeerID(), message)).To(Succeed())
+			Eventually(events).ShouldNot(Receive())
+		})
+	})
+
+	Context("when a deadline is set", func() {
+		It("should declare the deadline in the broadcast messages", func() {
+			messages := make(chan protocol.MessageOnTheWire, 128)
+			events := make(chan protocol.Event, 16)
+			dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+			broadcaster := NewBroadcasterWithOptions(TestOptions, messages, events, dht)
+
+			groupID, addrs, err := NewGroup(dht)
+			Expect(err).NotTo(HaveOccurred())
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			deadline := time.Unix(0, time.Now().Add(time.Minute).UnixNano())
+			messageBody := RandomMessageBody()
+			report, err := broadcaster.BroadcastWithDeadline(ctx, groupID, messageBody, deadline)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(report.Enqueued).To(Equal(len(addrs)))
+
+			for range addrs {
+				var message protocol.MessageOnTheWire
+				Eventually(messages).Should(Receive(&message))
+				Expect(message.Message.Version).Should(Equal(protocol.V3))
+				Expect(message.Message.Deadline.Equal(deadline)).Should(BeTrue())
+				Expect(bytes.Equal(message.Message.Body, messageBody)).Should(BeTrue())
+			}
+
+			_, err = broadcaster.BroadcastWithDeadline(ctx, groupID, RandomMessageBody(), time.Now().Add(-time.Second))
+			Expect(err).To(BeAssignableToTypeOf(ErrBroadcasting{}))
+		})
+
+		It("should propagate accepted messages with the deadline they declare", func() {
+			messages := make(chan protocol.MessageOnTheWire, 128)
+			events := make(chan protocol.Event, 16)
+			dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+			broadcaster := NewBroadcasterWithOptions(TestOptions, messages, events, dht)
+
+			groupID, addrs, err := NewGroup(dht)
+			Expect(err).NotTo(HaveOccurred())
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			message := protocol.NewMessageWithDeadline(protocol.Broadcast, groupID, RandomMessageBody(), protocol.SHA256, time.Now().Add(time.Minute))
+			Expect(broadcaster.AcceptBroadcast(ctx, RandomPeerID(), message)).To(Succeed())
+			Eventually(events).Should(Receive())
+
+			for range addrs {
+				var propagated protocol.MessageOnTheWire
+				Eventually(messages).Should(Receive(&propagated))
+				Expect(propagated.Message.Version).Should(Equal(protocol.V3))
+				Expect(propagated.Message.Deadline).Should(Equal(message.Deadline))
+				Expect(propagated.Message.Hash()).Should(Equal(message.Hash()))
+			}
+		})
+
+		It("should drop accepted messages after their deadline", func() {
+			messages := make(chan protocol.MessageOnTheWire, 128)
+			events := make(chan protocol.Event, 16)
+			dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+			broadcaster := NewBroadcasterWithOptions(TestOptions, messages, events, dht)
+
+			groupID, _, err := NewGroup(dht)
+			Expect(err).NotTo(HaveOccurred())
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			message := protocol.NewMessageWithDeadline(protocol.Broadcast, groupID, RandomMessageBody(), protocol.SHA256, time.Now().Add(-time.Second))
+			Expect(broadcaster.AcceptBroadcast(ctx, RandomPeerID(), message)).To(Succeed())
+			Consistently(events).ShouldNot(Receive())
+			Expect(messages).ShouldNot(Receive())
+		})
+
+		It("should accept a message after dropping a copy of it with another deadline", func() {
+			messages := make(chan protocol.MessageOnTheWire, 128)
+			events := make(chan protocol.Event, 16)
+			dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+			options := TestOptions
+			options.MaxDeadline = time.Minute
+			broadcaster := NewBroadcasterWithOptions(options, messages, events, dht)
+
+			groupID, addrs, err := NewGroup(dht)
+			Expect(err).NotTo(HaveOccurred())
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			body := RandomMessageBody()
+			expired := protocol.NewMessageWithDeadline(protocol.Broadcast, groupID, body, protocol.SHA256, time.Now().Add(-time.Second))
+			Expect(broadcaster.AcceptBroadcast(ctx, RandomPeerID(), expired)).To(Succeed())
+			tooFar := protocol.NewMessageWithDeadline(protocol.Broadcast, groupID, body, protocol.SHA256, time.Now().Add(time.Hour))
+			Expect(broadcaster.AcceptBroadcast(ctx, RandomPeerID(), tooFar)).NotTo(Succeed())
+			Expect(events).ShouldNot(Receive())
+			Expect(messages).ShouldNot(Receive())
+
+			fresh := protocol.NewMessageWithDeadline(protocol.Broadcast, groupID, body, protocol.SHA256, time.Now().Add(time.Second))
+			Expect(broadcaster.AcceptBroadcast(ctx, RandomPeerID(), fresh)).To(Succeed())
+			var event protocol.EventMessageReceived
+			Eventually(events).Should(Receive(&event))
+			Expect(bytes.Equal(event.Message, body)).Should(BeTrue())
+			for range addrs {
+				var message protocol.MessageOnTheWire
+				Eventually(messages).Should(Receive(&message))
+				Expect(message.Message.Deadline.Equal(fresh.Deadline)).Should(BeTrue())
+			}
+		})
+
+		It("should stop propagating messages in the background after their deadline", func() {
+			messages := make(chan protocol.MessageOnTheWire)
+			events := make(chan protocol.Event, 16)
+			dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+			options := TestOptions
+			options.AsyncPropagation = true
+			broadcaster := NewBroadcasterWithOptions(options, messages, events, dht)
+
+			groupID, _, err := NewGroup(dht)
+			Expect(err).NotTo(HaveOccurred())
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go broadcaster.Run(ctx)
+
+			// Nobody reads the messages until the deadline has passed
+			message := protocol.NewMessageWithDeadline(protocol.Broadcast, groupID, RandomMessageBody(), protocol.SHA256, time.Now().Add(100*time.Millisecond))
+			Expect(broadcaster.AcceptBroadcast(ctx, RandomPeerID(), message)).To(Succeed())
+			Eventually(events).Should(Receive())
+			time.Sleep(200 * time.Millisecond)
+			Consistently(messages).ShouldNot(Receive())
+		})
+
+		It("should tolerate the deadline skew of other peers", func() {
+			messages := make(chan protocol.MessageOnTheWire, 128)
+			events := make(chan protocol.Event, 16)
+			dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+			options := TestOptions
+			options.DeadlineSkew = time.Minute
+			broadcaster := NewBroadcasterWithOptions(options, messages, events, dht)
+
+			groupID, _, err := NewGroup(dht)
+			Expect(err).NotTo(HaveOccurred())
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			message := protocol.NewMessageWithDeadline(protocol.Broadcast, groupID, RandomMessageBody(), protocol.SHA256, time.Now().Add(-time.Second))
+			Expect(broadcaster.AcceptBroadcast(ctx, RandomPeerID(), message)).To(Succeed())
+			Eventually(events).Should(Receive())
+			Eventually(messages).Should(Receive())
+
+			message = protocol.NewMessageWithDeadline(protocol.Broadcast, groupID, RandomMessageBody(), protocol.SHA256, time.Now().Add(-2*time.Minute))
+			Expect(broadcaster.AcceptBroadcast(ctx, RandomPeerID(), message)).To(Succeed())
+			Consistently(events).ShouldNot(Receive())
+		})
+
+		It("should check deadlines using the clock", func() {
+			messages := make(chan protocol.MessageOnTheWire, 128)
+			events := make(chan protocol.Event, 16)
+			dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+			options := TestOptions
+			options.Clock = func() time.Time { return time.Now().Add(-time.Minute) }
+			broadcaster := NewBroadcasterWithOptions(options, messages, events, dht)
+
+			groupID, _, err := NewGroup(dht)
+			Expect(err).NotTo(HaveOccurred())
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			message := protocol.NewMessageWithDeadline(protocol.Broadcast, groupID, RandomMessageBody(), protocol.SHA256, time.Now().Add(-time.Second))
+			Expect(broadcaster.AcceptBroadcast(ctx, RandomPeerID(), message)).To(Succeed())
+			Eventually(events).Should(Receive())
+			Eventually(messages).Should(Receive())
+		})
+
+		It("should reject deadlines after the max deadline", func() {
+			messages := make(chan protocol.MessageOnTheWire, 128)
+			events := make(chan protocol.Event, 16)
+			dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+			options := TestOptions
+			options.MaxDeadline = time.Minute
+			broadcaster := NewBroadcasterWithOptions(options, messages, events, dht)
+
+			groupID, _, err := NewGroup(dht)
+			Expect(err).NotTo(HaveOccurred())
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			message := protocol.NewMessageWithDeadline(protocol.Broadcast, groupID, RandomMessageBody(), protocol.SHA256, time.Now().Add(time.Hour))
+			err = broadcaster.AcceptBroadcast(ctx, RandomPeerID(), message)
+			Expect(err).To(BeAssignableToTypeOf(ErrAcceptingBroadcast{}))
+			Expect(errors.Is(err, protocol.ErrInvalid)).To(BeTrue())
+			Consistently(events).ShouldNot(Receive())
+			Expect(messages).ShouldNot(Receive())
+
+			message = protocol.NewMessageWithDeadline(protocol.Broadcast, groupID, RandomMessageBody(), protocol.SHA256, time.Now().Add(30*time.Second))
+			Expect(broadcaster.AcceptBroadcast(ctx, RandomPeerID(), message)).To(Succeed())
+			Eventually(events).Should(Receive())
+		})
+
+		It("should clamp deadlines after the max deadline", func() {
+			messages := make(chan protocol.MessageOnTheWire, 128)
+			events := make(chan protocol.Event, 16)
+			dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+			options := TestOptions
+			options.MaxDeadline = time.Minute
+			options.DeadlinePolicy = ClampDeadline
+			broadcaster := NewBroadcasterWithOptions(options, messages, events, dht)
+
+			groupID, addrs, err := NewGroup(dht)
+			Expect(err).NotTo(HaveOccurred())
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			message := protocol.NewMessageWithDeadline(protocol.Broadcast, groupID, RandomMessageBody(), protocol.SHA256, time.Now().Add(time.Hour))
+			Expect(broadcaster.AcceptBroadcast(ctx, RandomPeerID(), message)).To(Succeed())
+			Eventually(events).Should(Receive())
+
+			for range addrs {
+				var propagated protocol.MessageOnTheWire
+				Eventually(messages).Should(Receive(&propagated))
+				Expect(propagated.Message.Deadline.After(time.Now().Add(time.Minute))).Should(BeFalse())
+				Expect(propagated.Message.Deadline.After(time.Now())).Should(BeTrue())
+				Expect(propagated.Message.Hash()).Should(Equal(message.Hash()))
+			}
+		})
+	})
+
+	Context("when the same message is broadcast concurrently", func() {
+		It("should only broadcast it once", func() {
+			messages := make(chan protocol.MessageOnTheWire, 1024)
+			events := make(chan protocol.Event, 1)
+			dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+			options := TestOptions
+			options.Store = slowTable{Table: NewTable("broadcaster")}
+			broadcaster := NewBroadcasterWithOptions(options, messages, events, dht)
+
+			groupID, addrs, err := NewGroup(dht)
+			Expect(err).NotTo(HaveOccurred())
+			body := RandomMessageBody()
+
+			wg := new(sync.WaitGroup)
+			reports := make(chan Report, 32)
+			for i := 0; i < 32; i++ {
+				wg.Add(1)
+				go func() {
+					defer GinkgoRecover()
+					defer wg.Done()
+					report, err := broadcaster.BroadcastWithReport(context.Background(), groupID, body)
+					Expect(err).NotTo(HaveOccurred())
+					reports <- report
+				}()
+			}
+			wg.Wait()
+			close(reports)
+			numBroadcast := 0
+			for report := range reports {
+				if !report.AlreadySeen {
+					numBroadcast++
+				}
+			}
+			Expect(numBroadcast).Should(Equal(1))
+			Expect(messages).Should(HaveLen(len(addrs)))
+		})
+	})
+
+	Context("when filtering self", func() {
+		It("should not send the message to the local peer", func() {
+			messages := make(chan protocol.MessageOnTheWire, 8)
+			events := make(chan protocol.Event, 1)
+			me := RandomAddress()
+			dht := NewDHT(me, NewTable("dht"), nil)
+			addrs := RandomAddresses(3)
+			for _, addr := range addrs {
+				Expect(dht.AddPeerAddress(addr)).To(Succeed())
+			}
+			groupID := RandomGroupID()
+			Expect(dht.AddGroup(groupID, append(FromAddressesToIDs(addrs), me.PeerID()))).To(Succeed())
+
+			options := TestOptions
+			options.FilterSelf = true
+			broadcaster := NewBroadcasterWithOptions(options, messages, events, dht)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			report, err := broadcaster.BroadcastWithReport(ctx, groupID, RandomMessageBody())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(report.Enqueued).Should(Equal(len(addrs)))
+			Expect(report.AddressMissing).Should(BeZero())
+			Expect(messages).Should(HaveLen(len(addrs)))
+			for i := 0; i < len(addrs); i++ {
+				message := <-messages
+				Expect(message.To.PeerID().Equal(me.PeerID())).Should(BeFalse())
+			}
+		})
+	})
+
+	Context("when a strategy is set", func() {
+		newGroup := func(dht interface {
+			AddPeerAddress(protocol.PeerAddress) error
+			AddGroup(protocol.GroupID, protocol.PeerIDs) error
+		}, n int) (protocol.GroupID, protocol.PeerAddresses) {
+			addrs := RandomAddresses(n)
+			for _, addr := range addrs {
+				Expect(dht.AddPeerAddress(addr)).To(Succeed())
+			}
+			groupID := RandomGroupID()
+			Expect(dht.AddGroup(groupID, FromAddressesToIDs(addrs))).To(Succeed())
+			return groupID, addrs
+		}
+
+		It("should send the message to k members and defer the others when using a random subset", func() {
+			messages := make(chan protocol.MessageOnTheWire, 16)
+			events := make(chan protocol.Event, 1)
+			dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+			groupID, addrs := newGroup(dht, 8)
+
+			options := TestOptions
+			options.Strategy = RandomSubset(3)
+			broadcaster := NewBroadcasterWithOptions(options, messages, events, dht)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			report, err := broadcaster.BroadcastWithReport(ctx, groupID, RandomMessageBody())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(report.Targeted).Should(Equal(len(addrs)))
+			Expect(report.Enqueued).Should(Equal(3))
+			Expect(report.Deferred).Should(Equal(len(addrs) - 3))
+			Expect(messages).Should(HaveLen(3))
+		})
+
+		It("should send the message to every member over the rounds when using an epidemic", func() {
+			messages := make(chan protocol.MessageOnTheWire, 16)
+			events := make(chan protocol.Event, 1)
+			dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+			groupID, addrs := newGroup(dht, 8)
+
+			options := TestOptions
+			options.Strategy = Epidemic(3, 3)
+			options.RoundInterval = 50 * time.Millisecond
+			broadcaster := NewBroadcasterWithOptions(options, messages, events, dht)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go broadcaster.Run(ctx)
+			report, err := broadcaster.BroadcastWithReport(ctx, groupID, RandomMessageBody())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(report.Enqueued).Should(Equal(3))
+			Expect(report.Deferred).Should(Equal(len(addrs) - 3))
+
+			sent := map[string]int{}
+			for i := 0; i < len(addrs); i++ {
+				var message protocol.MessageOnTheWire
+				Eventually(messages).Should(Receive(&message))
+				sent[message.To.PeerID().String()]++
+			}
+			Expect(sent).Should(HaveLen(len(addrs)))
+			Consistently(messages, 200*time.Millisecond).ShouldNot(Receive())
+		})
+
+		It("should flood every member by default", func() {
+			messages := make(chan protocol.MessageOnTheWire, 16)
+			events := make(chan protocol.Event, 1)
+			dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+			groupID, addrs := newGroup(dht, 8)
+			broadcaster := NewBroadcasterWithOptions(TestOptions, messages, events, dht)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			report, err := broadcaster.BroadcastWithReport(ctx, groupID, RandomMessageBody())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(report.Enqueued).Should(Equal(len(addrs)))
+			Expect(report.Deferred).Should(BeZero())
+			Expect(messages).Should(HaveLen(len(addrs)))
+		})
+	})
+
+	Context("when groups are limited", func() {
+		It("should shed new broadcasts to a group that exceeds its limit without starving other groups", func() {
+			messages := make(chan protocol.MessageOnTheWire, 64)
+			events := make(chan protocol.Event, 16)
+			dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+			noisy, quiet := RandomGroupID(), RandomGroupID()
+			Expect(dht.AddGroup(noisy, protocol.PeerIDs{})).To(Succeed())
+			Expect(dht.AddGroup(quiet, protocol.PeerIDs{})).To(Succeed())
+
+			options := TestOptions
+			options.GroupLimits = map[protocol.GroupID]GroupLimit{noisy: {Messages: 2}}
+			broadcaster := NewBroadcasterWithOptions(options, messages, events, dht)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			accepted := []protocol.Message{}
+			for i := 0; i < 5; i++ {
+				message := protocol.NewMessage(protocol.V1, protocol.Broadcast, noisy, []byte{byte(i)})
+				err := broadcaster.AcceptBroadcast(ctx, RandomPeerID(), message)
+				if i < 2 {
+					Expect(err).NotTo(HaveOccurred())
+					accepted = append(accepted, message)
+					continue
+				}
+				Expect(err).To(BeAssignableToTypeOf(ErrGroupRateLimited{}))
+				Expect(errors.Is(err, protocol.ErrUnavailable)).To(BeTrue())
+			}
+			for i := 0; i < 5; i++ {
+				message := protocol.NewMessage(protocol.V1, protocol.Broadcast, quiet, []byte{byte(i)})
+				Expect(broadcaster.AcceptBroadcast(ctx, RandomPeerID(), message)).To(Succeed())
+			}
+
+			// Messages that have been seen do not count towards the limit
+			Expect(broadcaster.AcceptBroadcast(ctx, RandomPeerID(), accepted[0])).To(Succeed())
+
+			Expect(events).Should(HaveLen(7))
+			Expect(broadcaster.ShedByGroup()).Should(Equal(map[protocol.GroupID]GroupShed{
+				noisy: {Messages: 3, Bytes: 3},
+			}))
+		})
+	})
+
+	Context("when broadcasting with a report", func() {
+		It("should report the outcome for every peer in the group", func() {
+			check := func(messageBody []byte) bool {
+				messages := make(chan protocol.MessageOnTheWire, 128)
+				events := make(chan protocol.Event, 1)
+				dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+				broadcaster := NewBroadcasterWithOptions(TestOptions, messages, events, dht)
+
+				groupID, addrs, err := NewGroup(dht)
+				Expect(err).NotTo(HaveOccurred())
+				missing := 0
+				if !addrs[0].PeerID().Equal(dht.Me().PeerID()) {
+					Expect(dht.RemovePeerAddress(addrs[0].PeerID())).NotTo(HaveOccurred())
+					missing = 1
+				}
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				report, err := broadcaster.BroadcastWithReport(ctx, groupID, messageBody)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(report.AlreadySeen).Should(BeFalse())
+				Expect(report.Targeted).Should(Equal(len(addrs)))
+				Expect(report.Enqueued).Should(Equal(len(addrs) - missing))
+				Expect(report.AddressMissing).Should(Equal(missing))
+				Expect(report.EnqueueTimeout).Should(BeZero())
+				Expect(report.Peers).Should(HaveLen(len(addrs)))
+				for _, peer := range report.Peers {
+					if missing == 1 && peer.PeerID.Equal(addrs[0].PeerID()) {
+						Expect(peer.Outcome).Should(Equal(AddressMissing))
+						continue
+					}
+					Expect(peer.Outcome).Should(Equal(Enqueued))
+				}
+
+				report, err = broadcaster.BroadcastWithReport(ctx, groupID, messageBody)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(report.AlreadySeen).Should(BeTrue())
+				Expect(report.Targeted).Should(BeZero())
+				return true
+			}
+
+			Expect(quick.Check(check, nil)).Should(BeNil())
+		})
+
+		It("should look up the addresses that are missing if a finder is set", func() {
+			messages := make(chan protocol.MessageOnTheWire, 8)
+			events := make(chan protocol.Event, 1)
+			dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+			addrs := RandomAddresses(3)
+			Expect(dht.AddPeerAddress(addrs[0])).To(Succeed())
+			groupID := RandomGroupID()
+			Expect(dht.AddGroup(groupID, FromAddressesToIDs(addrs))).To(Succeed())
+
+			options := TestOptions
+			options.Finder = MockAddressFinder{DHT: dht, Addrs: addrs[1:2]}
+			broadcaster := NewBroadcasterWithOptions(options, messages, events, dht)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			report, err := broadcaster.BroadcastWithReport(ctx, groupID, RandomMessageBody())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(report.Targeted).Should(Equal(3))
+			Expect(report.Enqueued).Should(Equal(2))
+			Expect(report.AddressMissing).Should(Equal(1))
+			for _, peer := range report.Peers {
+				if peer.PeerID.Equal(addrs[2].PeerID()) {
+					Expect(peer.Outcome).Should(Equal(AddressMissing))
+					continue
+				}
+				Expect(peer.Outcome).Should(Equal(Enqueued))
+			}
+
+			sent := map[string]bool{}
+			for i := 0; i < 2; i++ {
+				var msg protocol.MessageOnTheWire
+				Eventually(messages).Should(Receive(&msg))
+				sent[msg.To.PeerID().String()] = true
+			}
+			Expect(sent).Should(HaveKey(addrs[0].PeerID().String()))
+			Expect(sent).Should(HaveKey(addrs[1].PeerID().String()))
+			_, err = dht.PeerAddress(addrs[1].PeerID())
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should report peers that could not be enqueued in time", func() {
+			messages := make(chan protocol.MessageOnTheWire)
+			events := make(chan protocol.Event, 1)
+			dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+			broadcaster := NewBroadcasterWithOptions(TestOptions, messages, events, dht)
+
+			groupID, addrs, err := NewGroup(dht)
+			Expect(err).NotTo(HaveOccurred())
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			report, err := broadcaster.BroadcastWithReport(ctx, groupID, RandomMessageBody())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(report.Targeted).Should(Equal(len(addrs)))
+			Expect(report.EnqueueTimeout).Should(Equal(len(addrs)))
+		})
+
+		It("should report the hash of the events emitted by the receivers", func() {
+			messages := make(chan protocol.MessageOnTheWire, 128)
+			dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+			broadcaster := NewBroadcasterWithOptions(TestOptions, messages, make(chan protocol.Event, 1), dht)
+
+			groupID, _, err := NewGroup(dht)
+			Expect(err).NotTo(HaveOccurred())
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			report, err := broadcaster.BroadcastWithReport(ctx, groupID, RandomMessageBody())
+			Expect(err).NotTo(HaveOccurred())
+			var sent protocol.MessageOnTheWire
+			Eventually(messages).Should(Receive(&sent))
+
+			events := make(chan protocol.Event, 1)
+			receiverDHT := NewDHT(RandomAddress(), NewTable("dht"), nil)
+			Expect(receiverDHT.AddGroup(groupID, protocol.PeerIDs{})).To(Succeed())
+			receiver := NewBroadcasterWithOptions(TestOptions, make(chan protocol.MessageOnTheWire, 128), events, receiverDHT)
+			Expect(receiver.AcceptBroadcast(ctx, dht.Me().PeerID(), sent.Message)).To(Succeed())
+			var event protocol.Event
+			Eventually(events).Should(Receive(&event))
+			Expect(event.(protocol.EventMessageReceived).Hash).To(Equal(report.Hash))
+		})
+	})
+
+	Context("when excluding peers", func() {
+		It("should not send the message to the excluded peers", func() {
+			messages := make(chan protocol.MessageOnTheWire, 8)
+			events := make(chan protocol.Event, 1)
+			dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+			addrs := RandomAddresses(4)
+			for _, addr := range addrs[:3] {
+				Expect(dht.AddPeerAddress(addr)).To(Succeed())
+			}
+			groupID := RandomGroupID()
+			Expect(dht.AddGroup(groupID, FromAddressesToIDs(addrs))).To(Succeed())
+			broadcaster := NewBroadcasterWithOptions(TestOptions, messages, events, dht)
+
+			// The last peer is excluded even though its address is missing
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			exclude := protocol.PeerIDs{addrs[0].PeerID(), addrs[3].PeerID()}
+			report, err := broadcaster.BroadcastWithOptions(ctx, groupID, RandomMessageBody(), BroadcastOptions{Exclude: exclude})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(report.Targeted).Should(Equal(4))
+			Expect(report.Enqueued).Should(Equal(2))
+			Expect(report.Excluded).Should(Equal(2))
+			Expect(report.AddressMissing).Should(BeZero())
+			for _, peer := range report.Peers {
+				if peer.PeerID.Equal(addrs[0].PeerID()) || peer.PeerID.Equal(addrs[3].PeerID()) {
+					Expect(peer.Outcome).Should(Equal(Excluded))
+					continue
+				}
+				Expect(peer.Outcome).Should(Equal(Enqueued))
+			}
+
+			sent := map[string]bool{}
+			for i := 0; i < 2; i++ {
+				var msg protocol.MessageOnTheWire
+				Eventually(messages).Should(Receive(&msg))
+				sent[msg.To.PeerID().String()] = true
+			}
+			Expect(sent).Should(HaveKey(addrs[1].PeerID().String()))
+			Expect(sent).Should(HaveKey(addrs[2].PeerID().String()))
+			Consistently(messages).ShouldNot(Receive())
+		})
+
+		It("should declare the deadline in the broadcast messages", func() {
+			messages := make(chan protocol.MessageOnTheWire, 128)
+			dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+			broadcaster := NewBroadcasterWithOptions(TestOptions, messages, make(chan protocol.Event, 1), dht)
+
+			groupID, _, err := NewGroup(dht)
+			Expect(err).NotTo(HaveOccurred())
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			deadline := time.Unix(0, time.Now().Add(time.Minute).UnixNano())
+			_, err = broadcaster.BroadcastWithOptions(ctx, groupID, RandomMessageBody(), BroadcastOptions{Deadline: deadline})
+			Expect(err).NotTo(HaveOccurred())
+			var sent protocol.MessageOnTheWire
+			Eventually(messages).Should(Receive(&sent))
+			Expect(sent.Message.Deadline.Equal(deadline)).Should(BeTrue())
+		})
+	})
+
 	Context("when accepting broadcasts", func() {
 		It("should be able to receive messages", func() {
 			check := func(messageBody []byte) bool {
@@ -267,6 +1092,399 @@ var _ = Describe("Broadcaster", func() {
 
 				Expect(quick.Check(check, nil)).Should(BeNil())
 			})
+
+			It("should only emit and broadcast the message once when it is accepted concurrently", func() {
+				messages := make(chan protocol.MessageOnTheWire, 1024)
+				events := make(chan protocol.Event, 64)
+				dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+				options := TestOptions
+				options.Store = slowTable{Table: NewTable("broadcaster")}
+				broadcaster := NewBroadcasterWithOptions(options, messages, events, dht)
+
+				groupID, addrs, err := NewGroup(dht)
+				Expect(err).NotTo(HaveOccurred())
+				message := protocol.NewMessage(protocol.V1, protocol.Broadcast, groupID, RandomMessageBody())
+
+				wg := new(sync.WaitGroup)
+				for i := 0; i < 32; i++ {
+					wg.Add(1)
+					go func() {
+						defer GinkgoRecover()
+						defer wg.Done()
+						Expect(broadcaster.AcceptBroadcast(context.Background(), RandomPeerID(), message)).To(Succeed())
+					}()
+				}
+				wg.Wait()
+				Expect(events).Should(HaveLen(1))
+				Expect(messages).Should(HaveLen(len(addrs)))
+			})
+		})
+
+		Context("when a store is set", func() {
+			It("should not emit messages again after a restart", func() {
+				messages := make(chan protocol.MessageOnTheWire, 128)
+				events := make(chan protocol.Event, 16)
+				dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+				options := TestOptions
+				options.Store = NewTable("broadcaster")
+				broadcaster := NewBroadcasterWithOptions(options, messages, events, dht)
+
+				groupID, _, err := NewGroup(dht)
+				Expect(err).NotTo(HaveOccurred())
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				message := protocol.NewMessage(protocol.V1, protocol.Broadcast, groupID, RandomMessageBody())
+				Expect(broadcaster.AcceptBroadcast(ctx, RandomPeerID(), message)).To(Succeed())
+				Eventually(events).Should(Receive())
+
+				// A new broadcaster with the same store has seen the message
+				restarted := NewBroadcasterWithOptions(options, messages, events, dht)
+				Expect(restarted.AcceptBroadcast(ctx, RandomPeerID(), message)).To(Succeed())
+				Consistently(events).ShouldNot(Receive())
+			})
+
+			It("should delete messages from the store once they expire", func() {
+				messages := make(chan protocol.MessageOnTheWire, 128)
+				events := make(chan protocol.Event, 16)
+				dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+				options := TestOptions
+				options.Store = NewTable("broadcaster")
+				options.SeenTTL = 100 * time.Millisecond
+				options.GCInterval = 50 * time.Millisecond
+				broadcaster := NewBroadcasterWithOptions(options, messages, events, dht)
+
+				groupID, _, err := NewGroup(dht)
+				Expect(err).NotTo(HaveOccurred())
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				message := protocol.NewMessage(protocol.V1, protocol.Broadcast, groupID, RandomMessageBody())
+				Expect(broadcaster.AcceptBroadcast(ctx, RandomPeerID(), message)).To(Succeed())
+				Eventually(events).Should(Receive())
+				Expect(options.Store.Size()).To(Equal(1))
+
+				go broadcaster.Run(ctx)
+				Eventually(options.Store.Size, time.Second).Should(Equal(0))
+
+				// The message is emitted again once it has expired
+				Expect(broadcaster.AcceptBroadcast(ctx, RandomPeerID(), message)).To(Succeed())
+				Eventually(events).Should(Receive())
+			})
+
+			It("should keep messages until their deadline if it is after the ttl", func() {
+				messages := make(chan protocol.MessageOnTheWire, 128)
+				events := make(chan protocol.Event, 16)
+				dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+				options := TestOptions
+				options.Store = NewTable("broadcaster")
+				options.SeenTTL = 50 * time.Millisecond
+				options.GCInterval = 50 * time.Millisecond
+				broadcaster := NewBroadcasterWithOptions(options, messages, events, dht)
+
+				groupID, _, err := NewGroup(dht)
+				Expect(err).NotTo(HaveOccurred())
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				go broadcaster.Run(ctx)
+				message := protocol.NewMessageWithDeadline(protocol.Broadcast, groupID, RandomMessageBody(), protocol.SHA256, time.Now().Add(time.Minute))
+				Expect(broadcaster.AcceptBroadcast(ctx, RandomPeerID(), message)).To(Succeed())
+				Eventually(events).Should(Receive())
+
+				Consistently(options.Store.Size, 300*time.Millisecond).Should(Equal(1))
+				Expect(broadcaster.AcceptBroadcast(ctx, RandomPeerID(), message)).To(Succeed())
+				Consistently(events).ShouldNot(Receive())
+			})
+		})
+
+		Context("when propagation is asynchronous", func() {
+			It("should return after emitting the event and propagate the message in the background", func() {
+				check := func(messageBody []byte) bool {
+					messages := make(chan protocol.MessageOnTheWire, 128)
+					events := make(chan protocol.Event, 16)
+					dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+					options := TestOptions
+					options.AsyncPropagation = true
+					broadcaster := NewBroadcasterWithOptions(options, messages, events, dht)
+
+					groupID, addrs, err := NewGroup(dht)
+					Expect(err).NotTo(HaveOccurred())
+
+					ctx, cancel := context.WithCancel(context.Background())
+					defer cancel()
+					message := protocol.NewMessage(protocol.V1, protocol.Broadcast, groupID, messageBody)
+					Expect(broadcaster.AcceptBroadcast(ctx, RandomPeerID(), message)).ToNot(HaveOccurred())
+
+					var event protocol.EventMessageReceived
+					Eventually(events).Should(Receive(&event))
+					Expect(bytes.Equal(event.Message, messageBody)).Should(BeTrue())
+
+					// Nothing is propagated until the broadcaster is running.
+					Consistently(messages).ShouldNot(Receive())
+					go broadcaster.Run(ctx)
+
+					for range addrs {
+						var message protocol.MessageOnTheWire
+						Eventually(messages).Should(Receive(&message))
+						Expect(message.Message.Variant).Should(Equal(protocol.Broadcast))
+						Expect(bytes.Equal(message.Message.Body, messageBody)).Should(BeTrue())
+						Expect(addrs).Should(ContainElement(message.To))
+					}
+
+					// Receiving the message again must not emit another event.
+					Expect(broadcaster.AcceptBroadcast(ctx, RandomPeerID(), message)).ToNot(HaveOccurred())
+					Eventually(events).ShouldNot(Receive())
+					Eventually(messages).ShouldNot(Receive())
+					return true
+				}
+
+				Expect(quick.Check(check, &quick.Config{MaxCount: 10})).Should(BeNil())
+			})
+		})
+
+		Context("when relaying is paused", func() {
+			It("should emit the message without relaying it, until relaying resumes", func() {
+				messages := make(chan protocol.MessageOnTheWire, 128)
+				events := make(chan protocol.Event, 16)
+				dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+				broadcaster := NewBroadcasterWithOptions(TestOptions, messages, events, dht)
+
+				groupID, addrs, err := NewGroup(dht)
+				Expect(err).NotTo(HaveOccurred())
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				broadcaster.PauseRelaying(true)
+				message := protocol.NewMessage(protocol.V1, protocol.Broadcast, groupID, []byte("paused"))
+				Expect(broadcaster.AcceptBroadcast(ctx, RandomPeerID(), message)).NotTo(HaveOccurred())
+				Eventually(events).Should(Receive())
+				Expect(messages).ShouldNot(Receive())
+
+				// The message is remembered, so it is neither emitted nor
+				// relayed when it is received again after relaying resumes
+				broadcaster.PauseRelaying(false)
+				Expect(broadcaster.AcceptBroadcast(ctx, RandomPeerID(), message)).NotTo(HaveOccurred())
+				Expect(events).ShouldNot(Receive())
+				Expect(messages).ShouldNot(Receive())
+
+				message = protocol.NewMessage(protocol.V1, protocol.Broadcast, groupID, []byte("resumed"))
+				Expect(broadcaster.AcceptBroadcast(ctx, RandomPeerID(), message)).NotTo(HaveOccurred())
+				Eventually(events).Should(Receive())
+				for range addrs {
+					Eventually(messages).Should(Receive())
+				}
+			})
+		})
+
+		Context("when a relay policy is set", func() {
+			It("should bridge the message into the other groups without looping", func() {
+				check := func(messageBody []byte) bool {
+					messages := make(chan protocol.MessageOnTheWire, 128)
+					events := make(chan protocol.Event, 16)
+					dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+					groupA, addrsA, err := NewGroup(dht)
+					Expect(err).NotTo(HaveOccurred())
+					groupB, addrsB, err := NewGroup(dht)
+					Expect(err).NotTo(HaveOccurred())
+
+					// Mirror the groups into each other
+					options := TestOptions
+					options.RelayPolicy = Mirror{groupA: {groupB}, groupB: {groupA}}
+					broadcaster := NewBroadcasterWithOptions(options, messages, events, dht)
+
+					ctx, cancel := context.WithCancel(context.Background())
+					defer cancel()
+					message := protocol.NewMessage(protocol.V1, protocol.Broadcast, groupA, messageBody)
+					Expect(broadcaster.AcceptBroadcast(ctx, RandomPeerID(), message)).NotTo(HaveOccurred())
+
+					var event protocol.EventMessageReceived
+					Eventually(events).Should(Receive(&event))
+					Expect(event.GroupID).To(Equal(groupA))
+
+					received := map[protocol.GroupID]int{}
+					for i := 0; i < len(addrsA)+len(addrsB); i++ {
+						var message protocol.MessageOnTheWire
+						Eventually(messages).Should(Receive(&message))
+						Expect(bytes.Equal(message.Message.Body, messageBody)).Should(BeTrue())
+						// Random PeerIDs can be shared by both groups, in which
+						// case the DHT only knows the address of one of them
+						if message.Message.GroupID.Equal(groupA) {
+							Expect(FromAddressesToIDs(addrsA)).Should(ContainElement(message.To.PeerID()))
+						} else {
+							Expect(message.Message.GroupID).To(Equal(groupB))
+							Expect(FromAddressesToIDs(addrsB)).Should(ContainElement(message.To.PeerID()))
+						}
+						received[message.Message.GroupID]++
+					}
+					Expect(received[groupA]).To(Equal(len(addrsA)))
+					Expect(received[groupB]).To(Equal(len(addrsB)))
+
+					// The bridged message is not bridged back
+					bridged := protocol.NewMessage(protocol.V1, protocol.Broadcast, groupB, messageBody)
+					Expect(broadcaster.AcceptBroadcast(ctx, RandomPeerID(), bridged)).NotTo(HaveOccurred())
+					Expect(events).ShouldNot(Receive())
+					Expect(messages).ShouldNot(Receive())
+					return true
+				}
+
+				Expect(quick.Check(check, &quick.Config{MaxCount: 10})).Should(BeNil())
+			})
+
+			It("should only re-broadcast the message in its own group by default", func() {
+				messages := make(chan protocol.MessageOnTheWire, 128)
+				events := make(chan protocol.Event, 16)
+				dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+				groupA, addrsA, err := NewGroup(dht)
+				Expect(err).NotTo(HaveOccurred())
+				groupB, _, err := NewGroup(dht)
+				Expect(err).NotTo(HaveOccurred())
+
+				options := TestOptions
+				options.RelayPolicy = Mirror{groupB: {groupA}}
+				broadcaster := NewBroadcasterWithOptions(options, messages, events, dht)
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				message := protocol.NewMessage(protocol.V1, protocol.Broadcast, groupA, RandomMessageBody())
+				Expect(broadcaster.AcceptBroadcast(ctx, RandomPeerID(), message)).NotTo(HaveOccurred())
+				Eventually(events).Should(Receive())
+				for range addrsA {
+					var message protocol.MessageOnTheWire
+					Eventually(messages).Should(Receive(&message))
+					Expect(message.Message.GroupID).To(Equal(groupA))
+				}
+				Expect(messages).ShouldNot(Receive())
+			})
+		})
+	})
+	Context("when created with options", func() {
+		It("should be able to send messages", func() {
+			check := func(messageBody []byte) bool {
+				messages := make(chan protocol.MessageOnTheWire, 128)
+				events := make(chan protocol.Event, 1)
+				dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+				broadcaster := NewBroadcasterWithOptions(TestOptions, messages, events, dht)
+
+				groupID, addrs, err := NewGroup(dht)
+				Expect(err).NotTo(HaveOccurred())
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				Expect(broadcaster.Broadcast(ctx, groupID, messageBody)).NotTo(HaveOccurred())
+
+				for i := 0; i < len(addrs); i++ {
+					var message protocol.MessageOnTheWire
+					Eventually(messages).Should(Receive(&message))
+					Expect(addrs).Should(ContainElement(message.To))
+					Expect(message.Message.Version).Should(Equal(protocol.V1))
+					Expect(message.Message.Variant).Should(Equal(protocol.Broadcast))
+					Expect(bytes.Equal(message.Message.Body, messageBody)).Should(BeTrue())
+				}
+				return true
+			}
+
+			Expect(quick.Check(check, nil)).Should(BeNil())
+		})
+
+		It("should return an error if the context is cancelled", func() {
+			messages := make(chan protocol.MessageOnTheWire)
+			events := make(chan protocol.Event, 1)
+			dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+			broadcaster := NewBroadcasterWithOptions(TestOptions, messages, events, dht)
+
+			groupID, _, err := NewGroup(dht)
+			Expect(err).NotTo(HaveOccurred())
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			Expect(broadcaster.Broadcast(ctx, groupID, RandomMessageBody())).To(HaveOccurred())
+			message := protocol.NewMessage(protocol.V1, protocol.Broadcast, groupID, RandomMessageBody())
+			Expect(broadcaster.AcceptBroadcast(ctx, RandomPeerID(), message)).To(HaveOccurred())
+		})
+
+		It("should receive, and propagate, messages only once", func() {
+			check := func(messageBody []byte) bool {
+				messages := make(chan protocol.MessageOnTheWire, 128)
+				events := make(chan protocol.Event, 16)
+				dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+				broadcaster := NewBroadcasterWithOptions(TestOptions, messages, events, dht)
+
+				groupID, addrs, err := NewGroup(dht)
+				Expect(err).NotTo(HaveOccurred())
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				message := protocol.NewMessage(protocol.V1, protocol.Broadcast, groupID, messageBody)
+				Expect(broadcaster.AcceptBroadcast(ctx, RandomPeerID(), message)).NotTo(HaveOccurred())
+
+				var event protocol.EventMessageReceived
+				Eventually(events).Should(Receive(&event))
+				Expect(bytes.Equal(event.Message, messageBody)).Should(BeTrue())
+
+				for range addrs {
+					var message protocol.MessageOnTheWire
+					Eventually(messages).Should(Receive(&message))
+					Expect(bytes.Equal(message.Message.Body, messageBody)).Should(BeTrue())
+					Expect(addrs).Should(ContainElement(message.To))
+				}
+
+				Expect(broadcaster.AcceptBroadcast(ctx, RandomPeerID(), message)).NotTo(HaveOccurred())
+				Eventually(events).ShouldNot(Receive())
+				return true
+			}
+
+			Expect(quick.Check(check, nil)).Should(BeNil())
+		})
+
+		It("should reject messages with an unsupported version or variant", func() {
+			messages := make(chan protocol.MessageOnTheWire, 128)
+			events := make(chan protocol.Event, 16)
+			dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+			broadcaster := NewBroadcasterWithOptions(TestOptions, messages, events, dht)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			message := protocol.NewMessage(protocol.V1, protocol.Broadcast, RandomGroupID(), RandomMessageBody())
+			message.Version = InvalidMessageVersion()
+			Expect(broadcaster.AcceptBroadcast(ctx, RandomPeerID(), message)).To(HaveOccurred())
+
+			message = protocol.NewMessage(protocol.V1, protocol.Broadcast, RandomGroupID(), RandomMessageBody())
+			message.Variant = InvalidMessageVariant(protocol.Broadcast)
+			Expect(broadcaster.AcceptBroadcast(ctx, RandomPeerID(), message)).To(HaveOccurred())
 		})
 	})
 })
+
+type mockRetainer struct {
+	messages []protocol.Message
+}
+
+func (retainer *mockRetainer) Retain(message protocol.Message) {
+	retainer.messages = append(retainer.messages, message)
+}
+
+// slowTable is a kv.Table that is slow to return the values it gets, so that
+// concurrent calls are likely to interleave.
+type slowTable struct {
+	kv.Table
+}
+
+func (table slowTable) Get(key string, value interface{}) error {
+	err := table.Table.Get(key, value)
+	time.Sleep(10 * time.Millisecond)
+	return err
+}
+
+type mockSignedValidator struct {
+	signers []protocol.PeerID
+}
+
+func (validator *mockSignedValidator) Validate(from protocol.PeerID, message protocol.Message) error {
+	return errors.New("expected ValidateSigned to be called")
+}
+
+func (validator *mockSignedValidator) ValidateSigned(from, signer protocol.PeerID, message protocol.Message) error {
+	validator.signers = append(validator.signers, signer)
+	return nil
+}
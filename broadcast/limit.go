@@ -0,0 +1,171 @@
+package broadcast
+
+import (
+	"sync"
+	"time"
+
+	"github.com/renproject/aw/protocol"
+)
+
+// groupLimitSweepInterval is how often the buckets that are full again are
+// dropped, so that the buckets of groups that have gone quiet do not
+// accumulate.
+const groupLimitSweepInterval = time.Minute
+
+// maxShedGroups is the number of groups that shed broadcasts are counted for,
+// so that broadcasts to many different groups cannot grow the counts without
+// bound.
+const maxShedGroups = 4096
+
+// GroupLimit is the rate at which new broadcasts to a group are accepted from
+// other peers, in Messages and Bytes (of their bodies) per second. A group can
+// burst up to one second of its rate. Rates that are not positive are not
+// enforced.
+type GroupLimit struct {
+	Messages float64 `json:"messages"`
+	Bytes    float64 `json:"bytes"`
+}
+
+// GroupShed is the number of broadcasts to a group, and the bytes of their
+// bodies, that were shed because the group exceeded its GroupLimit.
+type GroupShed struct {
+	Messages uint64 `json:"messages"`
+	Bytes    uint64 `json:"bytes"`
+}
+
+type groupBucket struct {
+	messages float64
+	bytes    float64
+	updated  time.Time
+	limited  bool // True once the bucket has run out, until it is refilled
+}
+
+// groupLimiter is a token bucket of messages, and of bytes, for every group.
+// It is safe for concurrent use.
+type groupLimiter struct {
+	limits   map[protocol.GroupID]GroupLimit
+	fallback GroupLimit
+
+	mu        *sync.Mutex
+	buckets   map[protocol.GroupID]*groupBucket
+	shed      map[protocol.GroupID]GroupShed
+	lastSweep time.Time
+}
+
+func newGroupLimiter(limits map[protocol.GroupID]GroupLimit, fallback GroupLimit) *groupLimiter {
+	return &groupLimiter{
+		limits:   limits,
+		fallback: fallback,
+
+		mu:        new(sync.Mutex),
+		buckets:   map[protocol.GroupID]*groupBucket{},
+		shed:      map[protocol.GroupID]GroupShed{},
+		lastSweep: time.Now(),
+	}
+}
+
+// limit returns the GroupLimit of the group, which is the fallback if the group
+// does not have its own.
+func (limiter *groupLimiter) limit(groupID protocol.GroupID) GroupLimit {
+	if limit, ok := limiter.limits[groupID]; ok {
+		return limit
+	}
+	return limiter.fallback
+}
+
+// enforced returns true if the group has a GroupLimit that is enforced.
+func (limiter *groupLimiter) enforced(groupID protocol.GroupID) bool {
+	limit := limiter.limit(groupID)
+	return limit.Messages > 0 || limit.Bytes > 0
+}
+
+// allow takes a message with a body of the given size from the buckets of the
+// group. It returns false, and counts the message as shed, if one of the
+// buckets is empty, and also returns true for first when this is the first
+// time that the group is limited since its buckets last had tokens. A message
+// is allowed while the bucket of bytes is not empty, so that messages that are
+// larger than the rate of bytes are not always shed.
+func (limiter *groupLimiter) allow(groupID protocol.GroupID, bytes int, now time.Time) (ok bool, first bool) {
+	limit := limiter.limit(groupID)
+	if limit.Messages <= 0 && limit.Bytes <= 0 {
+		return true, false
+	}
+
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	if now.Sub(limiter.lastSweep) >= groupLimitSweepInterval {
+		limiter.sweepWithoutLock(now)
+	}
+	bucket, exists := limiter.buckets[groupID]
+	if !exists {
+		bucket = &groupBucket{messages: messageBurst(limit), bytes: limit.Bytes, updated: now}
+		limiter.buckets[groupID] = bucket
+	}
+	limiter.refillWithoutLock(bucket, limit, now)
+	if (limit.Messages > 0 && bucket.messages < 1) || (limit.Bytes > 0 && bucket.bytes <= 0) {
+		first = !bucket.limited
+		bucket.limited = true
+		if shed, ok := limiter.shed[groupID]; ok || len(limiter.shed) < maxShedGroups {
+			shed.Messages++
+			shed.Bytes += uint64(bytes)
+			limiter.shed[groupID] = shed
+		}
+		return false, first
+	}
+	bucket.messages--
+	bucket.bytes -= float64(bytes)
+	bucket.limited = false
+	return true, false
+}
+
+// shedByGroup returns the broadcasts that have been shed by every group.
+func (limiter *groupLimiter) shedByGroup() map[protocol.GroupID]GroupShed {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	shed := make(map[protocol.GroupID]GroupShed, len(limiter.shed))
+	for groupID, groupShed := range limiter.shed {
+		shed[groupID] = groupShed
+	}
+	return shed
+}
+
+func (limiter *groupLimiter) refillWithoutLock(bucket *groupBucket, limit GroupLimit, now time.Time) {
+	elapsed := now.Sub(bucket.updated).Seconds()
+	if elapsed < 0 {
+		return
+	}
+	bucket.messages += elapsed * limit.Messages
+	if burst := messageBurst(limit); bucket.messages > burst {
+		bucket.messages = burst
+	}
+	bucket.bytes += elapsed * limit.Bytes
+	if bucket.bytes > limit.Bytes {
+		bucket.bytes = limit.Bytes
+	}
+	bucket.updated = now
+}
+
+// sweepWithoutLock drops the buckets that are full, because they are the same
+// as new buckets.
+func (limiter *groupLimiter) sweepWithoutLock(now time.Time) {
+	for groupID, bucket := range limiter.buckets {
+		limit := limiter.limit(groupID)
+		limiter.refillWithoutLock(bucket, limit, now)
+		if bucket.messages >= messageBurst(limit) && bucket.bytes >= limit.Bytes {
+			delete(limiter.buckets, groupID)
+		}
+	}
+	limiter.lastSweep = now
+}
+
+// messageBurst returns the number of messages that a group can burst, which is
+// at least one, so that a rate of less than one message per second is not
+// always exceeded.
+func messageBurst(limit GroupLimit) float64 {
+	if limit.Messages < 1 {
+		return 1
+	}
+	return limit.Messages
+}
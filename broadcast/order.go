@@ -0,0 +1,175 @@
+package broadcast
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/renproject/aw/protocol"
+)
+
+// sequence identifies the position of a message in the stream of messages
+// broadcast by its origin to a group. The epoch changes whenever the origin
+// restarts, so that its sequence numbers can restart from one.
+type sequence struct {
+	Origin string
+	Epoch  uint64
+	Seq    uint64
+}
+
+// wrapSequenced prefixes the body with its sequence.
+func wrapSequenced(seq sequence, body protocol.MessageBody) protocol.MessageBody {
+	buffer := new(bytes.Buffer)
+	buffer.Grow(18 + len(seq.Origin) + len(body))
+	binary.Write(buffer, binary.LittleEndian, seq.Epoch)
+	binary.Write(buffer, binary.LittleEndian, seq.Seq)
+	binary.Write(buffer, binary.LittleEndian, uint16(len(seq.Origin)))
+	buffer.WriteString(seq.Origin)
+	buffer.Write(body)
+	return buffer.Bytes()
+}
+
+// unwrapSequenced returns the sequence and the original body of a body that
+// was wrapped by wrapSequenced.
+func unwrapSequenced(body protocol.MessageBody) (sequence, protocol.MessageBody, error) {
+	seq := sequence{}
+	if len(body) < 18 {
+		return seq, nil, fmt.Errorf("error unwrapping sequenced body: expected length>=18, got length=%v", len(body))
+	}
+	seq.Epoch = binary.LittleEndian.Uint64(body[0:8])
+	seq.Seq = binary.LittleEndian.Uint64(body[8:16])
+	originLen := int(binary.LittleEndian.Uint16(body[16:18]))
+	if len(body) < 18+originLen {
+		return seq, nil, fmt.Errorf("error unwrapping sequenced body: expected length>=%v, got length=%v", 18+originLen, len(body))
+	}
+	seq.Origin = string(body[18 : 18+originLen])
+	return seq, body[18+originLen:], nil
+}
+
+type streamKey struct {
+	origin  string
+	epoch   uint64
+	groupID protocol.GroupID
+}
+
+type stream struct {
+	next     uint64
+	pending  map[uint64]protocol.EventMessageReceived
+	gapSince time.Time
+}
+
+// An orderer buffers the events of each stream until the events before them
+// have been delivered, or until the missing events are skipped. It is not safe
+// for concurrent use.
+type orderer struct {
+	window   time.Duration
+	capacity int
+	streams  map[streamKey]*stream
+}
+
+func newOrderer(window time.Duration, capacity int) *orderer {
+	return &orderer{
+		window:   window,
+		capacity: capacity,
+		streams:  map[streamKey]*stream{},
+	}
+}
+
+// push the event with the given sequence, and return the events that can now
+// be delivered, in order. The first event seen in a stream starts the stream.
+// Events from before the start of the stream, or that have already been
+// delivered, are dropped.
+func (o *orderer) push(seq sequence, event protocol.EventMessageReceived, now time.Time) []protocol.EventMessageReceived {
+	key := streamKey{origin: seq.Origin, epoch: seq.Epoch, groupID: event.GroupID}
+	s, ok := o.streams[key]
+	if !ok {
+		s = &stream{next: seq.Seq, pending: map[uint64]protocol.EventMessageReceived{}}
+		o.streams[key] = s
+	}
+	if seq.Seq < s.next {
+		return nil
+	}
+	if len(s.pending) == 0 && seq.Seq > s.next {
+		s.gapSince = now
+	}
+	s.pending[seq.Seq] = event
+
+	// Skip the missing events when the buffer is full
+	if len(s.pending) > o.capacity {
+		s.skip()
+	}
+	return s.release(now)
+}
+
+// expire skips the missing events of all streams that have been waiting for
+// longer than the window, and returns the events that can now be delivered.
+func (o *orderer) expire(now time.Time) []protocol.EventMessageReceived {
+	events := []protocol.EventMessageReceived{}
+	for _, s := range o.streams {
+		if len(s.pending) > 0 && now.Sub(s.gapSince) >= o.window {
+			s.skip()
+			events = append(events, s.release(now)...)
+		}
+	}
+	return events
+}
+
+// skip to the lowest pending sequence number.
+func (s *stream) skip() {
+	first := true
+	for seq := range s.pending {
+		if first || seq < s.next {
+			s.next = seq
+			first = false
+		}
+	}
+}
+
+// release the consecutive pending events from the next sequence number.
+func (s *stream) release(now time.Time) []protocol.EventMessageReceived {
+	events := []protocol.EventMessageReceived{}
+	for {
+		event, ok := s.pending[s.next]
+		if !ok {
+			break
+		}
+		events = append(events, event)
+		delete(s.pending, s.next)
+		s.next++
+	}
+	if len(s.pending) > 0 && len(events) > 0 {
+		s.gapSince = now
+	}
+	return events
+}
+
+// newEpoch returns a random epoch, so that the sequence numbers of a peer are
+// not confused with those it used before restarting.
+func newEpoch() uint64 {
+	var epoch uint64
+	if err := binary.Read(rand.Reader, binary.LittleEndian, &epoch); err != nil {
+		panic(fmt.Errorf("error generating epoch: %v", err))
+	}
+	return epoch
+}
+
+// sequencer assigns the sequence numbers of the messages broadcast by this
+// peer.
+type sequencer struct {
+	origin string
+	epoch  uint64
+
+	mu   *sync.Mutex
+	seqs map[protocol.GroupID]uint64
+}
+
+func (s *sequencer) next(groupID protocol.GroupID) sequence {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.seqs[groupID]++
+	return sequence{Origin: s.origin, Epoch: s.epoch, Seq: s.seqs[groupID]}
+}
@@ -0,0 +1,142 @@
+package broadcast_test
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"testing/quick"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/broadcast"
+	. "github.com/renproject/aw/testutil"
+
+	"github.com/renproject/aw/dht"
+	"github.com/renproject/aw/protocol"
+)
+
+var _ = Describe("Ordered broadcaster", func() {
+	orderedOptions := TestOptions
+	orderedOptions.Ordered = true
+	orderedOptions.OrderWindow = 100 * time.Millisecond
+
+	groupID := RandomGroupID()
+
+	// newGroupDHT returns a DHT with a group of one peer.
+	newGroupDHT := func() dht.DHT {
+		dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+		addr := RandomAddress()
+		Expect(dht.AddPeerAddress(addr)).To(Succeed())
+		Expect(dht.AddGroup(groupID, protocol.PeerIDs{addr.PeerID()})).To(Succeed())
+		return dht
+	}
+
+	// broadcastN broadcasts n messages from a new peer to the group, and
+	// returns the bodies and the messages sent on the wire in order.
+	broadcastN := func(ctx context.Context, n int) ([]protocol.MessageBody, []protocol.Message) {
+		messages := make(chan protocol.MessageOnTheWire, n)
+		broadcaster := NewBroadcasterWithOptions(orderedOptions, messages, make(chan protocol.Event), newGroupDHT())
+
+		bodies := make([]protocol.MessageBody, n)
+		sent := make([]protocol.Message, n)
+		for i := range bodies {
+			bodies[i] = RandomMessageBody()
+			Expect(broadcaster.Broadcast(ctx, groupID, bodies[i])).To(Succeed())
+			var message protocol.MessageOnTheWire
+			Eventually(messages).Should(Receive(&message))
+			sent[i] = message.Message
+		}
+		return bodies, sent
+	}
+
+	newReceiver := func() (ExtendedBroadcaster, chan protocol.Event) {
+		events := make(chan protocol.Event, 128)
+		return NewBroadcasterWithOptions(orderedOptions, make(chan protocol.MessageOnTheWire, 128), events, newGroupDHT()), events
+	}
+
+	expectBody := func(events chan protocol.Event, body protocol.MessageBody) {
+		var event protocol.Event
+		Eventually(events).Should(Receive(&event))
+		Expect(bytes.Equal(event.(protocol.EventMessageReceived).Message, body)).Should(BeTrue())
+	}
+
+	Context("when messages are received out of order", func() {
+		It("should emit them in the order they were broadcast", func() {
+			check := func() bool {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				bodies, sent := broadcastN(ctx, 8)
+				receiver, events := newReceiver()
+
+				// The first message starts the stream, and the rest arrive in
+				// any order
+				Expect(receiver.AcceptBroadcast(ctx, RandomPeerID(), sent[0])).To(Succeed())
+				for _, i := range rand.Perm(len(sent) - 1) {
+					Expect(receiver.AcceptBroadcast(ctx, RandomPeerID(), sent[i+1])).To(Succeed())
+				}
+				for _, body := range bodies {
+					expectBody(events, body)
+				}
+				Expect(events).ShouldNot(Receive())
+				return true
+			}
+			Expect(quick.Check(check, &quick.Config{MaxCount: 10})).Should(BeNil())
+		})
+	})
+
+	Context("when a message is missing", func() {
+		It("should skip it after the order window", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			bodies, sent := broadcastN(ctx, 4)
+			receiver, events := newReceiver()
+			go receiver.Run(ctx)
+
+			Expect(receiver.AcceptBroadcast(ctx, RandomPeerID(), sent[0])).To(Succeed())
+			Expect(receiver.AcceptBroadcast(ctx, RandomPeerID(), sent[2])).To(Succeed())
+			Expect(receiver.AcceptBroadcast(ctx, RandomPeerID(), sent[3])).To(Succeed())
+			expectBody(events, bodies[0])
+			Consistently(events, orderedOptions.OrderWindow/2).ShouldNot(Receive())
+
+			expectBody(events, bodies[2])
+			expectBody(events, bodies[3])
+
+			// The missing message is dropped if it arrives late
+			Expect(receiver.AcceptBroadcast(ctx, RandomPeerID(), sent[1])).To(Succeed())
+			Consistently(events).ShouldNot(Receive())
+		})
+
+		It("should skip it when the buffer is full", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			options := orderedOptions
+			options.OrderWindow = time.Hour
+			options.OrderBufferCapacity = 2
+			events := make(chan protocol.Event, 128)
+			receiver := NewBroadcasterWithOptions(options, make(chan protocol.MessageOnTheWire, 128), events, newGroupDHT())
+			bodies, sent := broadcastN(ctx, 5)
+
+			Expect(receiver.AcceptBroadcast(ctx, RandomPeerID(), sent[0])).To(Succeed())
+			expectBody(events, bodies[0])
+			Expect(receiver.AcceptBroadcast(ctx, RandomPeerID(), sent[2])).To(Succeed())
+			Expect(receiver.AcceptBroadcast(ctx, RandomPeerID(), sent[3])).To(Succeed())
+			Expect(events).ShouldNot(Receive())
+			Expect(receiver.AcceptBroadcast(ctx, RandomPeerID(), sent[4])).To(Succeed())
+			expectBody(events, bodies[2])
+			expectBody(events, bodies[3])
+			expectBody(events, bodies[4])
+		})
+	})
+
+	Context("when a message is not sequenced", func() {
+		It("should reject it", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			receiver, events := newReceiver()
+			message := protocol.NewMessage(protocol.V1, protocol.Broadcast, groupID, []byte{1, 2, 3})
+			Expect(receiver.AcceptBroadcast(ctx, RandomPeerID(), message)).To(BeAssignableToTypeOf(ErrAcceptingBroadcast{}))
+			Expect(events).ShouldNot(Receive())
+		})
+	})
+})
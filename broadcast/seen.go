@@ -0,0 +1,135 @@
+package broadcast
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/renproject/aw/protocol"
+	"github.com/renproject/id"
+	"github.com/renproject/kv"
+)
+
+// see the message, so that it is not emitted or propagated again until it
+// expires from the store. Messages expire after the SeenTTL, or after their
+// deadline if it is later, so that they cannot be accepted again while they
+// are still being propagated.
+func (broadcaster *broadcaster) see(message protocol.Message) error {
+	expiry := time.Now().Add(broadcaster.options.SeenTTL)
+	if !message.Deadline.IsZero() {
+		if deadline := broadcaster.expiry(message); deadline.After(expiry) {
+			expiry = deadline
+		}
+	}
+	return broadcaster.seeUntil(message.Hash(), expiry)
+}
+
+// seeUntil stores the hash with the time at which it expires.
+func (broadcaster *broadcaster) seeUntil(hash id.Hash, expiry time.Time) error {
+	return broadcaster.options.Store.Insert(hash.String(), expiry.UnixNano())
+}
+
+// seeFirst sees the message, unless it has already been seen, and returns
+// whether it had not been seen. Checking and seeing the hash is atomic, so only
+// one of the concurrent calls for the same message returns true.
+func (broadcaster *broadcaster) seeFirst(message protocol.Message) (bool, error) {
+	hash := message.Hash()
+	unlock := broadcaster.seenLocks.lock(hash)
+	defer unlock()
+
+	seen, err := broadcaster.messageHashAlreadySeen(hash)
+	if err != nil || seen {
+		return false, err
+	}
+	return true, broadcaster.see(message)
+}
+
+// messageHashAlreadySeen returns true if the hash is in the store, and has not
+// expired.
+func (broadcaster *broadcaster) messageHashAlreadySeen(hash id.Hash) (bool, error) {
+	var expiry int64
+	switch err := broadcaster.options.Store.Get(hash.String(), &expiry); err {
+	case nil:
+		return time.Now().Before(time.Unix(0, expiry)), nil
+	case kv.ErrKeyNotFound:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// collectGarbage deletes the hashes that have expired from the store, and
+// returns the number of hashes that were deleted.
+func (broadcaster *broadcaster) collectGarbage(now time.Time) (int, error) {
+	expired := []string{}
+	iter := broadcaster.options.Store.Iterator()
+	for iter.Next() {
+		key, err := iter.Key()
+		if err != nil {
+			iter.Close()
+			return 0, newErrBroadcastInternal(fmt.Errorf("error loading message hash: %v", err))
+		}
+		var expiry int64
+		if err := iter.Value(&expiry); err != nil {
+			iter.Close()
+			return 0, newErrBroadcastInternal(fmt.Errorf("error loading message hash=%v: %v", key, err))
+		}
+		if !now.Before(time.Unix(0, expiry)) {
+			expired = append(expired, key)
+		}
+	}
+	iter.Close()
+
+	// Hashes are deleted once the iterator is closed, because not all stores
+	// can be modified while they are iterated
+	for _, key := range expired {
+		if err := broadcaster.options.Store.Delete(key); err != nil && err != kv.ErrKeyNotFound {
+			return 0, newErrBroadcastInternal(fmt.Errorf("error deleting message hash=%v: %v", key, err))
+		}
+	}
+	return len(expired), nil
+}
+
+// hashLocks are mutexes for each hash. A mutex only exists while it is held,
+// or waited for, so that the number of mutexes does not grow with the number
+// of hashes that have been seen.
+type hashLocks struct {
+	mu    *sync.Mutex
+	locks map[id.Hash]*hashLock
+}
+
+type hashLock struct {
+	mu   sync.Mutex
+	refs int // Number of callers holding, or waiting for, the mutex
+}
+
+func newHashLocks() hashLocks {
+	return hashLocks{
+		mu:    new(sync.Mutex),
+		locks: map[id.Hash]*hashLock{},
+	}
+}
+
+// lock the mutex of the hash, and return the function that unlocks it.
+func (locks hashLocks) lock(hash id.Hash) func() {
+	locks.mu.Lock()
+	lock, ok := locks.locks[hash]
+	if !ok {
+		lock = new(hashLock)
+		locks.locks[hash] = lock
+	}
+	lock.refs++
+	locks.mu.Unlock()
+
+	lock.mu.Lock()
+	return func() {
+		lock.mu.Unlock()
+
+		locks.mu.Lock()
+		defer locks.mu.Unlock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(locks.locks, hash)
+		}
+	}
+}
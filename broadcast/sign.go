@@ -0,0 +1,72 @@
+package broadcast
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/renproject/aw/protocol"
+)
+
+// signedDigest returns the digest that is signed by wrapSigned. It covers the
+// group and the deadline of the message, as well as its body, so that a
+// signed body cannot be broadcast to another group, or after the deadline that
+// it was signed with. The zero time means that there is no deadline.
+func signedDigest(signVerifier protocol.SignVerifier, groupID protocol.GroupID, deadline time.Time, body protocol.MessageBody) []byte {
+	var unixNano int64
+	if !deadline.IsZero() {
+		unixNano = deadline.UnixNano()
+	}
+	data := make([]byte, 0, len(groupID)+8+len(body))
+	data = append(data, groupID[:]...)
+	data = append(data, make([]byte, 8)...)
+	binary.LittleEndian.PutUint64(data[len(groupID):], uint64(unixNano))
+	data = append(data, body...)
+	return signVerifier.Hash(data)
+}
+
+// wrapSigned prefixes the body with the signature of the SignVerifier over the
+// group, the deadline and the body of the message (see signedDigest).
+func wrapSigned(signVerifier protocol.SignVerifier, groupID protocol.GroupID, deadline time.Time, body protocol.MessageBody) (protocol.MessageBody, error) {
+	sig, err := signVerifier.Sign(signedDigest(signVerifier, groupID, deadline, body))
+	if err != nil {
+		return nil, fmt.Errorf("error signing body: %v", err)
+	}
+	if len(sig) > 0xffff {
+		return nil, fmt.Errorf("error signing body: expected signature length<=%v, got length=%v", 0xffff, len(sig))
+	}
+	buffer := new(bytes.Buffer)
+	buffer.Grow(2 + len(sig) + len(body))
+	binary.Write(buffer, binary.LittleEndian, uint16(len(sig)))
+	buffer.Write(sig)
+	buffer.Write(body)
+	return buffer.Bytes(), nil
+}
+
+// unwrapSigned returns the signer and the original body of a message whose
+// body was wrapped by wrapSigned. It returns an error if the body is not
+// signed, or if the signature is not valid for the group and the deadline of
+// the message.
+func unwrapSigned(signVerifier protocol.SignVerifier, message protocol.Message) (protocol.PeerID, protocol.MessageBody, error) {
+	body := message.Body
+	if len(body) < 2 {
+		return nil, nil, fmt.Errorf("error unwrapping signed body: expected length>=2, got length=%v", len(body))
+	}
+	sigLen := int(binary.LittleEndian.Uint16(body[0:2]))
+	if sigLen == 0 {
+		return nil, nil, fmt.Errorf("error unwrapping signed body: body is not signed")
+	}
+	if len(body) < 2+sigLen {
+		return nil, nil, fmt.Errorf("error unwrapping signed body: expected length>=%v, got length=%v", 2+sigLen, len(body))
+	}
+	sig, unwrapped := body[2:2+sigLen], body[2+sigLen:]
+	signer, err := signVerifier.Verify(signedDigest(signVerifier, message.GroupID, message.Deadline, unwrapped), sig)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error verifying signed body: %v", err)
+	}
+	if signer == nil {
+		return nil, nil, fmt.Errorf("error verifying signed body: unknown signer")
+	}
+	return signer, unwrapped, nil
+}
@@ -0,0 +1,93 @@
+package broadcast
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/renproject/aw/protocol"
+	"github.com/renproject/id"
+)
+
+// State is the runtime state of a Broadcaster. It is handed off to the process
+// that replaces a Peer during a restart, so that the new process does not emit
+// events for the broadcasts that have already been seen, and keeps resending
+// the reliable broadcasts that have not been acknowledged.
+type State struct {
+	Seen    []id.Hash      `json:"seen"`    // Hashes of the broadcasts that have been seen, and have not expired
+	Pending []PendingState `json:"pending"` // Reliable broadcasts that have not been acknowledged
+}
+
+// PendingState is a reliable broadcast that has not been acknowledged by all of
+// the peers it was sent to.
+type PendingState struct {
+	Message protocol.Message `json:"message"`
+	Unacked []string         `json:"unacked"` // PeerIDs that have not acknowledged the message
+	Total   int              `json:"total"`   // Number of peers the message was sent to
+	Crossed int              `json:"crossed"` // Number of thresholds crossed so far
+	Retries int              `json:"retries"` // Number of times the message has been resent
+}
+
+// State implements the Broadcaster interface.
+func (broadcaster *broadcaster) State() (State, error) {
+	state := State{
+		Seen:    []id.Hash{},
+		Pending: broadcaster.acks.snapshot(),
+	}
+	now := time.Now()
+	iter := broadcaster.options.Store.Iterator()
+	defer iter.Close()
+	for iter.Next() {
+		key, err := iter.Key()
+		if err != nil {
+			return State{}, newErrBroadcastInternal(fmt.Errorf("error loading message hash: %v", err))
+		}
+		var expiry int64
+		if err := iter.Value(&expiry); err != nil {
+			return State{}, newErrBroadcastInternal(fmt.Errorf("error loading message hash=%v: %v", key, err))
+		}
+		if !now.Before(time.Unix(0, expiry)) {
+			continue
+		}
+		var hash id.Hash
+		if err := hash.UnmarshalText([]byte(key)); err != nil {
+			return State{}, newErrBroadcastInternal(fmt.Errorf("error decoding message hash=%v: %v", key, err))
+		}
+		state.Seen = append(state.Seen, hash)
+	}
+	return state, nil
+}
+
+// Restore implements the Broadcaster interface.
+func (broadcaster *broadcaster) Restore(state State) error {
+	now := time.Now()
+	for _, hash := range state.Seen {
+		if err := broadcaster.seeUntil(hash, now.Add(broadcaster.options.SeenTTL)); err != nil {
+			return newErrBroadcastInternal(fmt.Errorf("error inserting message hash=%v: %v", hash, err))
+		}
+	}
+
+	for _, pending := range state.Pending {
+		if pending.Message.Expired(now) {
+			continue
+		}
+		// Only the unacknowledged peers that are still in the group are
+		// restored, because PeerIDs cannot be decoded from their strings
+		groupIDs, err := broadcaster.dht.GroupIDs(pending.Message.GroupID)
+		if err != nil {
+			broadcaster.logger.Errorf("error restoring broadcast hash=%v: error loading group=%v: %v", pending.Message.Hash(), pending.Message.GroupID, err)
+			continue
+		}
+		unacked := make(map[string]struct{}, len(pending.Unacked))
+		for _, peerID := range pending.Unacked {
+			unacked[peerID] = struct{}{}
+		}
+		peerIDs := make(protocol.PeerIDs, 0, len(pending.Unacked))
+		for _, peerID := range groupIDs {
+			if _, ok := unacked[peerID.String()]; ok {
+				peerIDs = append(peerIDs, peerID)
+			}
+		}
+		broadcaster.acks.restore(pending, peerIDs, now)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package broadcast
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/renproject/aw/protocol"
+)
+
+// A Strategy decides to which members of its group a message is propagated by
+// this peer, so that operators can trade bandwidth for propagation latency.
+// Members that are not selected rely on other peers to relay the message to
+// them. It must be safe for concurrent use.
+type Strategy interface {
+	// Select returns the addresses that the message is sent to in every
+	// round, out of the addresses of the members of its group. The first
+	// round is sent straight away, and every other round is sent one
+	// RoundInterval after the round before it.
+	Select(message protocol.Message, addrs protocol.PeerAddresses) []protocol.PeerAddresses
+}
+
+// FloodStrategy sends every message to all members of its group in one round.
+// It is the default Strategy.
+type FloodStrategy struct{}
+
+// Select implements the Strategy interface.
+func (FloodStrategy) Select(message protocol.Message, addrs protocol.PeerAddresses) []protocol.PeerAddresses {
+	return []protocol.PeerAddresses{addrs}
+}
+
+// RandomSubset returns a Strategy that sends every message to k random members
+// of its group in one round, or to all of them if there are fewer.
+func RandomSubset(k int) Strategy {
+	return epidemic{fanout: k, rounds: 1}
+}
+
+// Epidemic returns a Strategy that sends every message to fanout random members
+// of its group in each of the rounds, without sending it to the same member
+// twice, until it has been sent to all of them.
+func Epidemic(fanout, rounds int) Strategy {
+	return epidemic{fanout: fanout, rounds: rounds}
+}
+
+type epidemic struct {
+	fanout int
+	rounds int
+}
+
+func (strategy epidemic) Select(message protocol.Message, addrs protocol.PeerAddresses) []protocol.PeerAddresses {
+	if strategy.fanout <= 0 || strategy.rounds <= 0 {
+		return nil
+	}
+	indexes := rand.Perm(len(addrs))
+	rounds := make([]protocol.PeerAddresses, 0, strategy.rounds)
+	for len(rounds) < strategy.rounds && len(indexes) > 0 {
+		n := strategy.fanout
+		if n > len(indexes) {
+			n = len(indexes)
+		}
+		round := make(protocol.PeerAddresses, n)
+		for i := range round {
+			round[i] = addrs[indexes[i]]
+		}
+		rounds = append(rounds, round)
+		indexes = indexes[n:]
+	}
+	return rounds
+}
+
+// pendingRound is a round of a message that has not been sent yet.
+type pendingRound struct {
+	due     time.Time
+	message protocol.Message
+	addrs   protocol.PeerAddresses
+}
+
+// roundScheduler holds the later rounds of messages until they are due.
+type roundScheduler struct {
+	mu      *sync.Mutex
+	pending []pendingRound
+}
+
+func newRoundScheduler() *roundScheduler {
+	return &roundScheduler{mu: new(sync.Mutex)}
+}
+
+// schedule the rounds of the message, one interval apart, starting one
+// interval after now.
+func (scheduler *roundScheduler) schedule(message protocol.Message, rounds []protocol.PeerAddresses, now time.Time, interval time.Duration) {
+	if len(rounds) == 0 {
+		return
+	}
+
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+
+	for i, addrs := range rounds {
+		scheduler.pending = append(scheduler.pending, pendingRound{
+			due:     now.Add(time.Duration(i+1) * interval),
+			message: message,
+			addrs:   addrs,
+		})
+	}
+}
+
+// due removes, and returns, the rounds that are due at the given time.
+func (scheduler *roundScheduler) due(now time.Time) []pendingRound {
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+
+	due := []pendingRound{}
+	pending := scheduler.pending[:0]
+	for _, round := range scheduler.pending {
+		if now.Before(round.due) {
+			pending = append(pending, round)
+			continue
+		}
+		due = append(due, round)
+	}
+	scheduler.pending = pending
+	return due
+}
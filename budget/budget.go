@@ -0,0 +1,280 @@
+package budget
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/renproject/aw/protocol"
+	"github.com/sirupsen/logrus"
+)
+
+// Subsystems of a Peer that are accounted for by a Budget.
+const (
+	Outbound = "outbound" // Messages that are being sent by the client
+	Inbound  = "inbound"  // Messages that were received, but have not been handled
+)
+
+// Priority of a message. When a subsystem is under pressure, messages with a
+// lower priority are shed first.
+type Priority uint8
+
+const (
+	// Low priority messages maintain the network (e.g. pings and lookups), and
+	// are retried by their senders.
+	Low = Priority(1)
+	// Normal priority messages are gossiped to groups of peers.
+	Normal = Priority(2)
+	// High priority messages are sent from one peer to another, and are not
+	// gossiped.
+	High = Priority(3)
+)
+
+func (priority Priority) String() string {
+	switch priority {
+	case Low:
+		return "low"
+	case Normal:
+		return "normal"
+	case High:
+		return "high"
+	default:
+		return fmt.Sprintf("priority(%d)", uint8(priority))
+	}
+}
+
+// PriorityOf returns the priority of messages of the variant.
+func PriorityOf(variant protocol.MessageVariant) Priority {
+	switch variant {
+	case protocol.Cast:
+		return High
+	case protocol.Broadcast, protocol.BroadcastAck, protocol.Multicast:
+		return Normal
+	default:
+		return Low
+	}
+}
+
+// Limits are the ceilings of a subsystem. Limits that are not positive are not
+// enforced.
+type Limits struct {
+	Goroutines int `json:"goroutines"` // Maximum number of goroutines
+	Bytes      int `json:"bytes"`      // Maximum number of buffered bytes
+}
+
+// Usage of a subsystem, and the number of messages it has shed, in total and
+// by variant.
+type Usage struct {
+	Goroutines    int                                `json:"goroutines"`
+	Bytes         int                                `json:"bytes"`
+	Shed          uint64                             `json:"shed"`
+	ShedByVariant map[protocol.MessageVariant]uint64 `json:"shedByVariant,omitempty"`
+}
+
+// Options are used to parameterise the behaviour of a Budget.
+type Options struct {
+	Logger logrus.FieldLogger
+
+	// Limits of every subsystem. Subsystems without Limits are not limited,
+	// but their usage is still accounted for.
+	Limits map[string]Limits
+
+	// LowWatermark and NormalWatermark are the fractions of the Limits that
+	// can be used by Low and Normal priority messages. High priority messages
+	// can use all of the Limits. They default to 50% and 80%.
+	LowWatermark    float64
+	NormalWatermark float64
+
+	// Policy is optional. When set, it decides which messages are shed when
+	// the queue of a subsystem is under pressure (see Budget.Shed), even if
+	// the subsystem is within its Limits.
+	Policy Policy
+}
+
+func (options *Options) setZerosToDefaults() {
+	if options.Logger == nil {
+		options.Logger = logrus.New()
+	}
+	if options.LowWatermark <= 0 || options.LowWatermark > 1 {
+		options.LowWatermark = 0.5
+	}
+	if options.NormalWatermark <= 0 || options.NormalWatermark > 1 {
+		options.NormalWatermark = 0.8
+	}
+}
+
+type usage struct {
+	Usage
+	shedding bool
+}
+
+func (u *usage) shed(variant protocol.MessageVariant) {
+	if u.ShedByVariant == nil {
+		u.ShedByVariant = map[protocol.MessageVariant]uint64{}
+	}
+	u.Shed++
+	u.ShedByVariant[variant]++
+}
+
+// A Budget accounts for the goroutines and buffered bytes of the subsystems of
+// a Peer, so that a gossip storm cannot exhaust the memory of the host. When a
+// subsystem reaches the watermark of a Priority, messages of that Priority are
+// shed, and a protocol.EventLoadShed is emitted. It is safe for concurrent
+// use. A nil Budget does not account for anything, and never sheds messages.
+type Budget struct {
+	logger  logrus.FieldLogger
+	options Options
+	events  protocol.EventSender
+
+	mu     *sync.Mutex
+	usages map[string]*usage
+}
+
+// New returns a Budget that emits events to the EventSender. Events are
+// dropped, rather than blocking, when the EventSender is full.
+func New(options Options, events protocol.EventSender) *Budget {
+	options.setZerosToDefaults()
+	return &Budget{
+		logger:  options.Logger,
+		options: options,
+		events:  events,
+
+		mu:     new(sync.Mutex),
+		usages: map[string]*usage{},
+	}
+}
+
+// Acquire the bytes of a message of the variant, and a goroutine if one will
+// be spawned for it, in the subsystem. It returns false if the message must be
+// shed, in which case nothing is acquired. Otherwise, the caller must Release
+// what it acquired once the message has been handled.
+func (budget *Budget) Acquire(subsystem string, variant protocol.MessageVariant, goroutine bool, bytes int) bool {
+	if budget == nil {
+		return true
+	}
+	goroutines := 0
+	if goroutine {
+		goroutines = 1
+	}
+
+	budget.mu.Lock()
+	u := budget.usageWithoutLock(subsystem)
+	watermark := budget.watermark(PriorityOf(variant))
+	limits := budget.options.Limits[subsystem]
+	if exceeds(u.Goroutines+goroutines, limits.Goroutines, watermark) || exceeds(u.Bytes+bytes, limits.Bytes, watermark) {
+		u.shed(variant)
+		var event *protocol.EventLoadShed
+		if !u.shedding {
+			u.shedding = true
+			event = &protocol.EventLoadShed{
+				Time:       time.Now(),
+				Subsystem:  subsystem,
+				Variant:    variant,
+				Goroutines: u.Goroutines,
+				Bytes:      u.Bytes,
+			}
+		}
+		budget.mu.Unlock()
+
+		if event != nil {
+			budget.logger.Warnf("%v exceeds its budget with goroutines=%v and bytes=%v: shedding messages", subsystem, event.Goroutines, event.Bytes)
+			select {
+			case budget.events <- *event:
+			default:
+			}
+		}
+		return false
+	}
+	u.Goroutines += goroutines
+	u.Bytes += bytes
+	budget.mu.Unlock()
+	return true
+}
+
+// Shed returns true if the Policy sheds the message from the queue of the
+// subsystem at the pressure, which is the fraction of the queue that is full.
+// Messages are never shed when there is no Policy. Messages that are not shed
+// must still be acquired.
+func (budget *Budget) Shed(subsystem string, message protocol.Message, pressure float64) bool {
+	if budget == nil || budget.options.Policy == nil {
+		return false
+	}
+	if !budget.options.Policy.Shed(message, pressure) {
+		return false
+	}
+
+	budget.mu.Lock()
+	defer budget.mu.Unlock()
+
+	budget.usageWithoutLock(subsystem).shed(message.Variant)
+	return true
+}
+
+// Release the bytes, and the goroutine, acquired for a message in the
+// subsystem.
+func (budget *Budget) Release(subsystem string, goroutine bool, bytes int) {
+	if budget == nil {
+		return
+	}
+
+	budget.mu.Lock()
+	defer budget.mu.Unlock()
+
+	u := budget.usageWithoutLock(subsystem)
+	if goroutine {
+		u.Goroutines--
+	}
+	u.Bytes -= bytes
+	// The subsystem is back within its budget once even the lowest priority
+	// messages are accepted again
+	limits := budget.options.Limits[subsystem]
+	if u.shedding && !exceeds(u.Goroutines, limits.Goroutines, budget.options.LowWatermark) && !exceeds(u.Bytes, limits.Bytes, budget.options.LowWatermark) {
+		u.shedding = false
+	}
+}
+
+// Usage returns the usage of the subsystem.
+func (budget *Budget) Usage(subsystem string) Usage {
+	if budget == nil {
+		return Usage{}
+	}
+
+	budget.mu.Lock()
+	defer budget.mu.Unlock()
+
+	u := budget.usageWithoutLock(subsystem).Usage
+	if u.ShedByVariant != nil {
+		shedByVariant := make(map[protocol.MessageVariant]uint64, len(u.ShedByVariant))
+		for variant, shed := range u.ShedByVariant {
+			shedByVariant[variant] = shed
+		}
+		u.ShedByVariant = shedByVariant
+	}
+	return u
+}
+
+func (budget *Budget) usageWithoutLock(subsystem string) *usage {
+	u, ok := budget.usages[subsystem]
+	if !ok {
+		u = &usage{}
+		budget.usages[subsystem] = u
+	}
+	return u
+}
+
+func (budget *Budget) watermark(priority Priority) float64 {
+	switch priority {
+	case Low:
+		return budget.options.LowWatermark
+	case Normal:
+		return budget.options.NormalWatermark
+	default:
+		return 1
+	}
+}
+
+// exceeds returns true if the value exceeds the fraction of the limit. Limits
+// that are not positive are never exceeded.
+func exceeds(value, limit int, fraction float64) bool {
+	return limit > 0 && float64(value) > fraction*float64(limit)
+}
@@ -0,0 +1,137 @@
+package budget_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/budget"
+
+	"github.com/renproject/aw/protocol"
+)
+
+var _ = Describe("Budget", func() {
+	Context("when the budget is nil", func() {
+		It("should never shed messages", func() {
+			var budget *Budget
+			Expect(budget.Acquire(Inbound, protocol.Ping, true, 1<<30)).To(BeTrue())
+			budget.Release(Inbound, true, 1<<30)
+			Expect(budget.Usage(Inbound)).To(Equal(Usage{}))
+		})
+	})
+
+	Context("when a subsystem is not limited", func() {
+		It("should account for its usage without shedding messages", func() {
+			budget := New(Options{}, make(chan protocol.Event, 1))
+			Expect(budget.Acquire(Outbound, protocol.Ping, true, 100)).To(BeTrue())
+			Expect(budget.Acquire(Outbound, protocol.Ping, true, 100)).To(BeTrue())
+			Expect(budget.Usage(Outbound)).To(Equal(Usage{Goroutines: 2, Bytes: 200}))
+
+			budget.Release(Outbound, true, 100)
+			Expect(budget.Usage(Outbound)).To(Equal(Usage{Goroutines: 1, Bytes: 100}))
+		})
+	})
+
+	Context("when a subsystem is under pressure", func() {
+		It("should shed lower priority messages first", func() {
+			budget := New(Options{Limits: map[string]Limits{Inbound: {Bytes: 100}}}, make(chan protocol.Event, 1))
+
+			// Low priority messages can use 50% of the bytes
+			Expect(budget.Acquire(Inbound, protocol.Ping, false, 50)).To(BeTrue())
+			Expect(budget.Acquire(Inbound, protocol.Ping, false, 10)).To(BeFalse())
+
+			// Normal priority messages can use 80% of the bytes
+			Expect(budget.Acquire(Inbound, protocol.Broadcast, false, 30)).To(BeTrue())
+			Expect(budget.Acquire(Inbound, protocol.Broadcast, false, 10)).To(BeFalse())
+
+			// High priority messages can use all of the bytes
+			Expect(budget.Acquire(Inbound, protocol.Cast, false, 20)).To(BeTrue())
+			Expect(budget.Acquire(Inbound, protocol.Cast, false, 1)).To(BeFalse())
+
+			Expect(budget.Usage(Inbound)).To(Equal(Usage{
+				Bytes: 100,
+				Shed:  3,
+				ShedByVariant: map[protocol.MessageVariant]uint64{
+					protocol.Ping:      1,
+					protocol.Broadcast: 1,
+					protocol.Cast:      1,
+				},
+			}))
+		})
+
+		It("should limit the number of goroutines", func() {
+			budget := New(Options{Limits: map[string]Limits{Outbound: {Goroutines: 2}}}, make(chan protocol.Event, 1))
+			Expect(budget.Acquire(Outbound, protocol.Cast, true, 0)).To(BeTrue())
+			Expect(budget.Acquire(Outbound, protocol.Cast, true, 0)).To(BeTrue())
+			Expect(budget.Acquire(Outbound, protocol.Cast, true, 0)).To(BeFalse())
+
+			budget.Release(Outbound, true, 0)
+			Expect(budget.Acquire(Outbound, protocol.Cast, true, 0)).To(BeTrue())
+		})
+
+		It("should only emit an event when it starts shedding messages", func() {
+			events := make(chan protocol.Event, 2)
+			budget := New(Options{Limits: map[string]Limits{Inbound: {Bytes: 10}}}, events)
+
+			Expect(budget.Acquire(Inbound, protocol.Cast, false, 10)).To(BeTrue())
+			Expect(budget.Acquire(Inbound, protocol.Ping, false, 1)).To(BeFalse())
+			Expect(budget.Acquire(Inbound, protocol.Multicast, false, 1)).To(BeFalse())
+
+			var event protocol.Event
+			Eventually(events).Should(Receive(&event))
+			Expect(event).To(BeAssignableToTypeOf(protocol.EventLoadShed{}))
+			Expect(event.(protocol.EventLoadShed).Subsystem).To(Equal(Inbound))
+			Expect(event.(protocol.EventLoadShed).Variant).To(Equal(protocol.Ping))
+			Expect(event.(protocol.EventLoadShed).Bytes).To(Equal(10))
+			Consistently(events).ShouldNot(Receive())
+
+			// The subsystem is back within its budget once low priority
+			// messages are accepted again
+			budget.Release(Inbound, false, 10)
+			Expect(budget.Acquire(Inbound, protocol.Cast, false, 10)).To(BeTrue())
+			Expect(budget.Acquire(Inbound, protocol.Ping, false, 1)).To(BeFalse())
+			Eventually(events).Should(Receive())
+		})
+
+		It("should not block when the events are not being read", func() {
+			budget := New(Options{Limits: map[string]Limits{Inbound: {Bytes: 1}}}, make(chan protocol.Event))
+			Expect(budget.Acquire(Inbound, protocol.Ping, false, 10)).To(BeFalse())
+		})
+	})
+
+	Context("when the queue of a subsystem is under pressure", func() {
+		It("should shed the messages that the policy sheds", func() {
+			budget := New(Options{Policy: NewPolicy(PolicyOptions{})}, make(chan protocol.Event, 1))
+			ping := protocol.NewMessage(protocol.V1, protocol.Ping, protocol.NilGroupID, protocol.MessageBody("ping"))
+			cast := protocol.NewMessage(protocol.V1, protocol.Cast, protocol.NilGroupID, protocol.MessageBody("cast"))
+
+			Expect(budget.Shed(Inbound, ping, 0.1)).To(BeFalse())
+			Expect(budget.Shed(Inbound, ping, 0.6)).To(BeTrue())
+			Expect(budget.Shed(Inbound, ping, 0.7)).To(BeTrue())
+			Expect(budget.Shed(Inbound, cast, 1)).To(BeFalse())
+
+			usage := budget.Usage(Inbound)
+			Expect(usage.Shed).To(Equal(uint64(2)))
+			Expect(usage.ShedByVariant).To(Equal(map[protocol.MessageVariant]uint64{protocol.Ping: 2}))
+
+			// The usage is a copy
+			usage.ShedByVariant[protocol.Ping] = 0
+			Expect(budget.Usage(Inbound).ShedByVariant[protocol.Ping]).To(Equal(uint64(2)))
+		})
+
+		It("should not shed messages without a policy", func() {
+			budget := New(Options{}, make(chan protocol.Event, 1))
+			ping := protocol.NewMessage(protocol.V1, protocol.Ping, protocol.NilGroupID, protocol.MessageBody("ping"))
+			Expect(budget.Shed(Inbound, ping, 1)).To(BeFalse())
+		})
+	})
+
+	Context("when prioritising messages", func() {
+		It("should prioritise direct messages over gossip over maintenance", func() {
+			Expect(PriorityOf(protocol.Cast)).To(Equal(High))
+			Expect(PriorityOf(protocol.Broadcast)).To(Equal(Normal))
+			Expect(PriorityOf(protocol.Multicast)).To(Equal(Normal))
+			Expect(PriorityOf(protocol.BroadcastAck)).To(Equal(Normal))
+			Expect(PriorityOf(protocol.Ping)).To(Equal(Low))
+			Expect(PriorityOf(protocol.FindNode)).To(Equal(Low))
+		})
+	})
+})
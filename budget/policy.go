@@ -0,0 +1,114 @@
+package budget
+
+import (
+	"crypto/sha256"
+	"sync"
+
+	"github.com/renproject/aw/protocol"
+)
+
+// A Policy decides which messages are shed when a queue is under pressure,
+// before they are accounted for by the Budget. The pressure is the fraction of
+// the queue that is full, from 0 (empty) to 1 (full). It must not block.
+type Policy interface {
+	Shed(message protocol.Message, pressure float64) bool
+}
+
+// PolicyOptions are used to parameterise the behaviour of the Policy returned
+// by NewPolicy. Every pressure is a fraction of the queue.
+type PolicyOptions struct {
+	// LowPressure is the pressure at which Low priority messages (e.g. pings)
+	// are shed. Defaults to 50%.
+	LowPressure float64
+	// DuplicatePressure is the pressure at which broadcasts that look like
+	// duplicates of one of the last DuplicateWindow broadcasts are shed.
+	// Broadcasts look like duplicates when they have the same group and body,
+	// which is the case when they are re-broadcast by more than one peer.
+	// Defaults to 50%, and a window of 1024 broadcasts.
+	DuplicatePressure float64
+	DuplicateWindow   int
+	// NormalPressure is the pressure at which Normal priority messages (e.g.
+	// broadcasts and multicasts) are shed. Defaults to 90%.
+	NormalPressure float64
+}
+
+func (options *PolicyOptions) setZerosToDefaults() {
+	if options.LowPressure <= 0 || options.LowPressure > 1 {
+		options.LowPressure = 0.5
+	}
+	if options.DuplicatePressure <= 0 || options.DuplicatePressure > 1 {
+		options.DuplicatePressure = 0.5
+	}
+	if options.DuplicateWindow <= 0 {
+		options.DuplicateWindow = 1024
+	}
+	if options.NormalPressure <= 0 || options.NormalPressure > 1 {
+		options.NormalPressure = 0.9
+	}
+}
+
+type policy struct {
+	options PolicyOptions
+
+	mu     *sync.Mutex
+	recent map[[sha256.Size]byte]struct{}
+	window [][sha256.Size]byte
+	next   int
+}
+
+// NewPolicy returns a Policy that sheds Low priority messages first, then
+// broadcasts that look like duplicates, and then Normal priority messages, as
+// the pressure increases. High priority messages (i.e. casts) are never shed
+// by the Policy, so that point-to-point traffic survives overload.
+func NewPolicy(options PolicyOptions) Policy {
+	options.setZerosToDefaults()
+	return &policy{
+		options: options,
+
+		mu:     new(sync.Mutex),
+		recent: make(map[[sha256.Size]byte]struct{}, options.DuplicateWindow),
+		window: make([][sha256.Size]byte, 0, options.DuplicateWindow),
+	}
+}
+
+// Shed implements the Policy interface.
+func (policy *policy) Shed(message protocol.Message, pressure float64) bool {
+	switch PriorityOf(message.Variant) {
+	case Low:
+		return pressure >= policy.options.LowPressure
+	case Normal:
+		if pressure >= policy.options.NormalPressure {
+			return true
+		}
+		if message.Variant == protocol.Broadcast {
+			return policy.duplicate(message) && pressure >= policy.options.DuplicatePressure
+		}
+		return false
+	default:
+		return false
+	}
+}
+
+// duplicate returns true if the broadcast has the same group and body as one
+// of the recent broadcasts, and remembers it otherwise. Broadcasts are
+// remembered regardless of the pressure, so that duplicates can be recognised
+// as soon as the pressure rises.
+func (policy *policy) duplicate(message protocol.Message) bool {
+	hash := sha256.Sum256(append(message.GroupID[:], message.Body...))
+
+	policy.mu.Lock()
+	defer policy.mu.Unlock()
+
+	if _, ok := policy.recent[hash]; ok {
+		return true
+	}
+	if len(policy.window) < policy.options.DuplicateWindow {
+		policy.window = append(policy.window, hash)
+	} else {
+		delete(policy.recent, policy.window[policy.next])
+		policy.window[policy.next] = hash
+		policy.next = (policy.next + 1) % len(policy.window)
+	}
+	policy.recent[hash] = struct{}{}
+	return false
+}
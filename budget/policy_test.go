@@ -0,0 +1,60 @@
+package budget_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/budget"
+
+	"github.com/renproject/aw/protocol"
+)
+
+var _ = Describe("Policy", func() {
+	groupID := protocol.GroupID{1}
+
+	Context("when the pressure increases", func() {
+		It("should shed pings, then duplicate broadcasts, then gossip, but never casts", func() {
+			policy := NewPolicy(PolicyOptions{LowPressure: 0.3, DuplicatePressure: 0.5, NormalPressure: 0.9})
+			ping := protocol.NewMessage(protocol.V1, protocol.Ping, protocol.NilGroupID, protocol.MessageBody("ping"))
+			cast := protocol.NewMessage(protocol.V1, protocol.Cast, protocol.NilGroupID, protocol.MessageBody("cast"))
+			multicast := protocol.NewMessage(protocol.V1, protocol.Multicast, groupID, protocol.MessageBody("multicast"))
+			broadcast := protocol.NewMessage(protocol.V1, protocol.Broadcast, groupID, protocol.MessageBody("broadcast"))
+
+			Expect(policy.Shed(ping, 0.2)).To(BeFalse())
+			Expect(policy.Shed(ping, 0.3)).To(BeTrue())
+
+			// The first broadcast is not a duplicate
+			Expect(policy.Shed(broadcast, 0.5)).To(BeFalse())
+			Expect(policy.Shed(broadcast, 0.4)).To(BeFalse())
+			Expect(policy.Shed(broadcast, 0.5)).To(BeTrue())
+			Expect(policy.Shed(multicast, 0.5)).To(BeFalse())
+
+			Expect(policy.Shed(multicast, 0.9)).To(BeTrue())
+			Expect(policy.Shed(cast, 1)).To(BeFalse())
+		})
+	})
+
+	Context("when broadcasts have the same body in different groups", func() {
+		It("should not consider them duplicates", func() {
+			policy := NewPolicy(PolicyOptions{})
+			body := protocol.MessageBody("broadcast")
+			Expect(policy.Shed(protocol.NewMessage(protocol.V1, protocol.Broadcast, protocol.GroupID{1}, body), 0.5)).To(BeFalse())
+			Expect(policy.Shed(protocol.NewMessage(protocol.V1, protocol.Broadcast, protocol.GroupID{2}, body), 0.5)).To(BeFalse())
+		})
+	})
+
+	Context("when more broadcasts than the window are received", func() {
+		It("should forget the oldest broadcasts", func() {
+			policy := NewPolicy(PolicyOptions{DuplicateWindow: 2})
+			messages := []protocol.Message{
+				protocol.NewMessage(protocol.V1, protocol.Broadcast, groupID, protocol.MessageBody("1")),
+				protocol.NewMessage(protocol.V1, protocol.Broadcast, groupID, protocol.MessageBody("2")),
+				protocol.NewMessage(protocol.V1, protocol.Broadcast, groupID, protocol.MessageBody("3")),
+			}
+			for _, message := range messages {
+				Expect(policy.Shed(message, 0.5)).To(BeFalse())
+			}
+			Expect(policy.Shed(messages[0], 0.5)).To(BeFalse())
+			Expect(policy.Shed(messages[0], 0.5)).To(BeTrue())
+		})
+	})
+})
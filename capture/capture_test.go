@@ -0,0 +1,171 @@
+package capture_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/capture"
+
+	"github.com/renproject/aw/protocol"
+	"github.com/renproject/aw/testutil"
+)
+
+// block of a pcapng capture.
+type block struct {
+	Type uint32
+	Body []byte
+}
+
+// readBlocks of a little-endian pcapng capture, checking that the leading and
+// trailing lengths of every block match.
+func readBlocks(data []byte) []block {
+	blocks := []block{}
+	for len(data) > 0 {
+		Expect(len(data)).To(BeNumerically(">=", 12))
+		length := binary.LittleEndian.Uint32(data[4:])
+		Expect(length % 4).To(BeZero())
+		Expect(len(data)).To(BeNumerically(">=", int(length)))
+		Expect(binary.LittleEndian.Uint32(data[length-4:])).To(Equal(length))
+		blocks = append(blocks, block{
+			Type: binary.LittleEndian.Uint32(data),
+			Body: data[8 : length-4],
+		})
+		data = data[length:]
+	}
+	return blocks
+}
+
+var _ = Describe("Capture", func() {
+	Context("when writing frames", func() {
+		It("should write a pcapng capture", func() {
+			buf := new(bytes.Buffer)
+			writer, err := NewWriter(buf)
+			Expect(err).NotTo(HaveOccurred())
+
+			now := time.Unix(1, 2)
+			message := protocol.NewMessage(protocol.V1, protocol.Cast, protocol.NilGroupID, protocol.MessageBody("hello"))
+			Expect(writer.WriteFrame(Frame{Time: now, PeerID: testutil.SimplePeerID("peer"), Direction: Sent, Message: message})).To(Succeed())
+
+			blocks := readBlocks(buf.Bytes())
+			Expect(blocks).To(HaveLen(3))
+
+			// Section header
+			Expect(blocks[0].Type).To(Equal(uint32(0x0A0D0D0A)))
+			Expect(binary.LittleEndian.Uint32(blocks[0].Body)).To(Equal(uint32(0x1A2B3C4D)))
+
+			// Interface description
+			Expect(blocks[1].Type).To(Equal(uint32(1)))
+			Expect(binary.LittleEndian.Uint16(blocks[1].Body)).To(Equal(uint16(LinkType)))
+
+			// Enhanced packet
+			data, err := message.MarshalBinary()
+			Expect(err).NotTo(HaveOccurred())
+			body := blocks[2].Body
+			Expect(blocks[2].Type).To(Equal(uint32(6)))
+			timestamp := uint64(binary.LittleEndian.Uint32(body[4:]))<<32 | uint64(binary.LittleEndian.Uint32(body[8:]))
+			Expect(timestamp).To(Equal(uint64(now.UnixNano())))
+			Expect(binary.LittleEndian.Uint32(body[12:])).To(Equal(uint32(len(data))))
+			Expect(body[20 : 20+len(data)]).To(Equal(data))
+
+			// The direction is in the flags, and the peer in the comment
+			options := body[20+len(data)+(4-len(data)%4)%4:]
+			Expect(binary.LittleEndian.Uint16(options)).To(Equal(uint16(2)))
+			Expect(binary.LittleEndian.Uint32(options[4:])).To(Equal(uint32(Sent)))
+			Expect(string(options[8:])).To(ContainSubstring("peer=peer direction=sent variant=cast"))
+		})
+	})
+
+	Context("when tapping a peer", func() {
+		var dir string
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "capture")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		It("should only capture frames while it is capturing", func() {
+			tap := NewTap(Options{Dir: dir})
+			message := protocol.NewMessage(protocol.V1, protocol.Ping, protocol.NilGroupID, protocol.MessageBody("ping"))
+			tap.Capture(testutil.SimplePeerID("peer"), Received, message)
+
+			status, err := tap.Start("test.pcapng")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(status.Path).To(Equal(filepath.Join(dir, "test.pcapng")))
+			_, err = tap.Start("other.pcapng")
+			Expect(err).To(Equal(ErrCapturing))
+			tap.Capture(testutil.SimplePeerID("peer"), Received, message)
+			tap.Capture(testutil.SimplePeerID("peer"), Sent, message)
+
+			status, err = tap.Stop()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(status.Capturing).To(BeFalse())
+			Expect(status.Frames).To(Equal(uint64(2)))
+			tap.Capture(testutil.SimplePeerID("peer"), Sent, message)
+			_, err = tap.Stop()
+			Expect(err).To(Equal(ErrNotCapturing))
+
+			data, err := ioutil.ReadFile(status.Path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(readBlocks(data)).To(HaveLen(4))
+		})
+
+		It("should not capture outside of its directory", func() {
+			tap := NewTap(Options{Dir: dir})
+			for _, name := range []string{"../escape.pcapng", "sub/dir.pcapng", ".."} {
+				_, err := tap.Start(name)
+				Expect(err).To(Equal(ErrInvalidName))
+			}
+			Expect(tap.Status().Capturing).To(BeFalse())
+		})
+
+		It("should be nil-safe", func() {
+			var tap *Tap
+			tap.Capture(testutil.SimplePeerID("peer"), Sent, protocol.NewMessage(protocol.V1, protocol.Ping, protocol.NilGroupID, nil))
+		})
+	})
+
+	Context("when using the admin API", func() {
+		serve := func(handler http.Handler, method, body string) *httptest.ResponseRecorder {
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, httptest.NewRequest(method, "/capture", strings.NewReader(body)))
+			return recorder
+		}
+
+		It("should start, report and stop captures", func() {
+			dir, err := ioutil.TempDir("", "capture")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(dir)
+			tap := NewTap(Options{Dir: dir})
+			handler := NewHandler(tap)
+
+			Expect(serve(handler, http.MethodPost, `{"name":"../escape"}`).Code).To(Equal(http.StatusBadRequest))
+			Expect(serve(handler, http.MethodPost, "").Code).To(Equal(http.StatusCreated))
+			Expect(tap.Status().Capturing).To(BeTrue())
+			Expect(filepath.Dir(tap.Status().Path)).To(Equal(dir))
+			Expect(serve(handler, http.MethodPost, `{"name":"other"}`).Code).To(Equal(http.StatusConflict))
+
+			response := serve(handler, http.MethodGet, "")
+			Expect(response.Code).To(Equal(http.StatusOK))
+			Expect(response.Body.String()).To(ContainSubstring(`"capturing":true`))
+
+			Expect(serve(handler, http.MethodDelete, "").Code).To(Equal(http.StatusOK))
+			Expect(tap.Status().Capturing).To(BeFalse())
+			Expect(serve(handler, http.MethodDelete, "").Code).To(Equal(http.StatusConflict))
+			Expect(serve(handler, http.MethodPut, "").Code).To(Equal(http.StatusMethodNotAllowed))
+		})
+	})
+})
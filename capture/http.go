@@ -0,0 +1,75 @@
+package capture
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// NewHandler returns an http.Handler that serves the admin API of a Tap at
+// /capture. GET returns its Status, POST starts capturing to the file named
+// by the optional name in the JSON body, and DELETE stops capturing. It does
+// not authorise requests, so it must only be served to operators (see
+// peer.NewAdminHandler).
+func NewHandler(tap *Tap) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/capture", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, tap.Status())
+
+		case http.MethodPost:
+			request := struct {
+				Name string `json:"name"`
+			}{}
+			if err := json.NewDecoder(r.Body).Decode(&request); err != nil && err != io.EOF {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("error decoding capture: %v", err))
+				return
+			}
+			status, err := tap.Start(request.Name)
+			switch err {
+			case nil:
+			case ErrCapturing:
+				writeError(w, http.StatusConflict, err)
+				return
+			case ErrInvalidName:
+				writeError(w, http.StatusBadRequest, err)
+				return
+			default:
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			writeJSON(w, http.StatusCreated, status)
+
+		case http.MethodDelete:
+			status, err := tap.Stop()
+			switch err {
+			case nil:
+			case ErrNotCapturing:
+				writeError(w, http.StatusConflict, err)
+				return
+			default:
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, status)
+
+		default:
+			w.Header().Set("Allow", "GET, POST, DELETE")
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %v is not allowed", r.Method))
+		}
+	})
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	w.WriteHeader(status)
+	fmt.Fprintln(w, err)
+}
@@ -0,0 +1,160 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/renproject/aw/protocol"
+)
+
+// LinkType of the interface that frames are captured on. Frames are messages
+// encoded by protocol.Message.MarshalBinary, which have no registered link
+// type, so the first of the link types reserved for private use is used
+// (LINKTYPE_USER0). Wireshark can decode them by mapping it to a dissector.
+const LinkType = 147
+
+// Block types and options of the pcapng format (see
+// https://www.ietf.org/archive/id/draft-tuexen-opsawg-pcapng-05.html).
+const (
+	blockSectionHeader       = 0x0A0D0D0A
+	blockInterfaceDescriptor = 0x00000001
+	blockEnhancedPacket      = 0x00000006
+
+	byteOrderMagic = 0x1A2B3C4D
+
+	// Options of every block
+	optEndOfOpt = 0
+	optComment  = 1
+
+	// Options of interface description blocks
+	optIfName    = 2
+	optIfTsResol = 9
+
+	// Options of enhanced packet blocks
+	optEPBFlags = 2
+)
+
+// Direction of a frame, encoded as the inbound and outbound direction of the
+// flags of an enhanced packet block.
+type Direction uint32
+
+const (
+	Received = Direction(1)
+	Sent     = Direction(2)
+)
+
+// String implements the `fmt.Stringer` interface.
+func (direction Direction) String() string {
+	switch direction {
+	case Received:
+		return "received"
+	case Sent:
+		return "sent"
+	default:
+		return fmt.Sprintf("direction(%d)", uint32(direction))
+	}
+}
+
+// A Frame is a message that was sent to, or received from, a peer.
+type Frame struct {
+	Time      time.Time
+	PeerID    protocol.PeerID
+	Direction Direction
+	Message   protocol.Message
+}
+
+// A Writer writes Frames to a pcapng capture, which can be analysed offline
+// with standard tooling (e.g. Wireshark or tshark). Every Frame is written as
+// an enhanced packet block with a nanosecond timestamp, its direction in the
+// flags, and its peer and variant in the comment. It is not safe for
+// concurrent use.
+type Writer struct {
+	w io.Writer
+}
+
+// NewWriter writes the section header and interface description of a pcapng
+// capture, and returns a Writer that writes Frames to it.
+func NewWriter(w io.Writer) (*Writer, error) {
+	// Section header with an unspecified section length
+	shb := new(bytes.Buffer)
+	binary.Write(shb, binary.LittleEndian, uint32(byteOrderMagic))
+	binary.Write(shb, binary.LittleEndian, uint16(1))
+	binary.Write(shb, binary.LittleEndian, uint16(0))
+	binary.Write(shb, binary.LittleEndian, int64(-1))
+	writeOption(shb, optEndOfOpt, nil)
+	if err := writeBlock(w, blockSectionHeader, shb.Bytes()); err != nil {
+		return nil, fmt.Errorf("error writing section header: %v", err)
+	}
+
+	// Interface description with nanosecond timestamps
+	idb := new(bytes.Buffer)
+	binary.Write(idb, binary.LittleEndian, uint16(LinkType))
+	binary.Write(idb, binary.LittleEndian, uint16(0))
+	binary.Write(idb, binary.LittleEndian, uint32(0))
+	writeOption(idb, optIfName, []byte("aw"))
+	writeOption(idb, optIfTsResol, []byte{9})
+	writeOption(idb, optEndOfOpt, nil)
+	if err := writeBlock(w, blockInterfaceDescriptor, idb.Bytes()); err != nil {
+		return nil, fmt.Errorf("error writing interface description: %v", err)
+	}
+	return &Writer{w: w}, nil
+}
+
+// WriteFrame writes the Frame as an enhanced packet block.
+func (writer *Writer) WriteFrame(frame Frame) error {
+	data, err := frame.Message.MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("error marshaling %v message: %v", frame.Message.Variant, err)
+	}
+	timestamp := uint64(frame.Time.UnixNano())
+
+	epb := new(bytes.Buffer)
+	binary.Write(epb, binary.LittleEndian, uint32(0)) // Interface ID
+	binary.Write(epb, binary.LittleEndian, uint32(timestamp>>32))
+	binary.Write(epb, binary.LittleEndian, uint32(timestamp))
+	binary.Write(epb, binary.LittleEndian, uint32(len(data)))
+	binary.Write(epb, binary.LittleEndian, uint32(len(data)))
+	epb.Write(data)
+	epb.Write(make([]byte, padding(len(data))))
+	flags := make([]byte, 4)
+	binary.LittleEndian.PutUint32(flags, uint32(frame.Direction))
+	writeOption(epb, optEPBFlags, flags)
+	writeOption(epb, optComment, []byte(fmt.Sprintf("peer=%v direction=%v variant=%v", frame.PeerID, frame.Direction, frame.Message.Variant)))
+	writeOption(epb, optEndOfOpt, nil)
+	if err := writeBlock(writer.w, blockEnhancedPacket, epb.Bytes()); err != nil {
+		return fmt.Errorf("error writing frame: %v", err)
+	}
+	return nil
+}
+
+// writeBlock writes the body of a block between its type and total length,
+// and its trailing total length. The body must be padded to 32 bits.
+func writeBlock(w io.Writer, blockType uint32, body []byte) error {
+	length := uint32(12 + len(body))
+	block := make([]byte, 0, length)
+	block = appendUint32(block, blockType)
+	block = appendUint32(block, length)
+	block = append(block, body...)
+	block = appendUint32(block, length)
+	_, err := w.Write(block)
+	return err
+}
+
+// writeOption writes the option, padded to 32 bits.
+func writeOption(buf *bytes.Buffer, code uint16, value []byte) {
+	binary.Write(buf, binary.LittleEndian, code)
+	binary.Write(buf, binary.LittleEndian, uint16(len(value)))
+	buf.Write(value)
+	buf.Write(make([]byte, padding(len(value))))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+func padding(n int) int {
+	return (4 - n%4) % 4
+}
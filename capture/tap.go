@@ -0,0 +1,183 @@
+package capture
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/renproject/aw/protocol"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrCapturing is returned when a Tap that is capturing is started.
+	ErrCapturing = errors.New("already capturing")
+	// ErrNotCapturing is returned when a Tap that is not capturing is stopped.
+	ErrNotCapturing = errors.New("not capturing")
+	// ErrInvalidName is returned when a Tap is started with a name that is
+	// not the name of a file in its directory.
+	ErrInvalidName = errors.New("invalid capture name")
+)
+
+// Options are used to parameterise the behaviour of a Tap.
+type Options struct {
+	Logger logrus.FieldLogger
+
+	// Dir is the directory that captures are written to. Captures cannot be
+	// written anywhere else, so that the admin API cannot be used to
+	// overwrite other files. Defaults to the temporary directory.
+	Dir string
+}
+
+func (options *Options) setZerosToDefaults() {
+	if options.Logger == nil {
+		options.Logger = logrus.New()
+	}
+	if options.Dir == "" {
+		options.Dir = os.TempDir()
+	}
+}
+
+// Status of a Tap.
+type Status struct {
+	Capturing bool      `json:"capturing"`
+	Path      string    `json:"path,omitempty"`
+	Started   time.Time `json:"started,omitempty"`
+	Frames    uint64    `json:"frames"`
+	Errors    uint64    `json:"errors"`
+}
+
+// A Tap captures the Frames sent and received by a Peer to a pcapng capture
+// file, while it is started. It can be started and stopped at runtime (e.g.
+// using the admin API returned by NewHandler). It is safe for concurrent use,
+// and a nil Tap never captures anything.
+type Tap struct {
+	logger  logrus.FieldLogger
+	options Options
+
+	mu     *sync.Mutex
+	status Status
+	file   *os.File
+	buf    *bufio.Writer
+	writer *Writer
+}
+
+// NewTap returns a Tap that is stopped.
+func NewTap(options Options) *Tap {
+	options.setZerosToDefaults()
+	return &Tap{
+		logger:  options.Logger,
+		options: options,
+
+		mu: new(sync.Mutex),
+	}
+}
+
+// Start capturing to the file with the given name in the directory of the
+// Tap. The file is truncated if it exists. A name is generated from the
+// current time if it is empty. It returns ErrCapturing if the Tap is already
+// capturing.
+func (tap *Tap) Start(name string) (Status, error) {
+	tap.mu.Lock()
+	defer tap.mu.Unlock()
+
+	if tap.status.Capturing {
+		return tap.status, ErrCapturing
+	}
+	now := time.Now()
+	if name == "" {
+		name = fmt.Sprintf("aw-%v.pcapng", now.UTC().Format("20060102T150405Z"))
+	}
+	if base := filepath.Base(name); base != name || base == "." || base == ".." {
+		return tap.status, ErrInvalidName
+	}
+	path := filepath.Join(tap.options.Dir, name)
+	file, err := os.Create(path)
+	if err != nil {
+		return tap.status, fmt.Errorf("error creating capture: %v", err)
+	}
+	buf := bufio.NewWriter(file)
+	writer, err := NewWriter(buf)
+	if err != nil {
+		file.Close()
+		return tap.status, err
+	}
+
+	tap.file = file
+	tap.buf = buf
+	tap.writer = writer
+	tap.status = Status{
+		Capturing: true,
+		Path:      path,
+		Started:   now,
+	}
+	tap.logger.Infof("capturing frames to %v", path)
+	return tap.status, nil
+}
+
+// Stop capturing, and close the capture file. It returns the Status of the
+// capture that was stopped.
+func (tap *Tap) Stop() (Status, error) {
+	tap.mu.Lock()
+	defer tap.mu.Unlock()
+
+	if !tap.status.Capturing {
+		return tap.status, ErrNotCapturing
+	}
+	err := tap.buf.Flush()
+	if closeErr := tap.file.Close(); err == nil {
+		err = closeErr
+	}
+	tap.file = nil
+	tap.buf = nil
+	tap.writer = nil
+	tap.status.Capturing = false
+	tap.logger.Infof("captured %v frames to %v", tap.status.Frames, tap.status.Path)
+	if err != nil {
+		return tap.status, fmt.Errorf("error closing capture: %v", err)
+	}
+	return tap.status, nil
+}
+
+// Status returns the Status of the Tap.
+func (tap *Tap) Status() Status {
+	tap.mu.Lock()
+	defer tap.mu.Unlock()
+
+	return tap.status
+}
+
+// Capture the message sent to, or received from, the peer, if the Tap is
+// capturing.
+func (tap *Tap) Capture(peerID protocol.PeerID, direction Direction, message protocol.Message) {
+	if tap == nil {
+		return
+	}
+
+	tap.mu.Lock()
+	defer tap.mu.Unlock()
+
+	if !tap.status.Capturing {
+		return
+	}
+	frame := Frame{
+		Time:      time.Now(),
+		PeerID:    peerID,
+		Direction: direction,
+		Message:   message,
+	}
+	if err := tap.writer.WriteFrame(frame); err != nil {
+		// Only the first error is logged, so that a full disk does not flood
+		// the logs
+		if tap.status.Errors == 0 {
+			tap.logger.Errorf("error capturing %v frame: %v", direction, err)
+		}
+		tap.status.Errors++
+		return
+	}
+	tap.status.Frames++
+}
@@ -7,6 +7,7 @@ import (
 
 	"github.com/renproject/aw/dht"
 	"github.com/renproject/aw/protocol"
+	"github.com/renproject/id"
 	"github.com/sirupsen/logrus"
 )
 
@@ -15,48 +16,152 @@ type Caster interface {
 	AcceptCast(ctx context.Context, from protocol.PeerID, message protocol.Message) error
 }
 
+// An ExtendedCaster is a Caster that returns the hashes of its casts, and that
+// can be run. The Casters returned by this package are ExtendedCasters, so that
+// a Caster can be type asserted to use these features without breaking other
+// implementations of the Caster.
+type ExtendedCaster interface {
+	Caster
+
+	// CastWithHash is the same as Cast, but it also returns the hash of the
+	// message, which is the Hash of the protocol.EventMessageReceived that is
+	// emitted by the peer that receives it.
+	CastWithHash(ctx context.Context, to protocol.PeerID, body protocol.MessageBody) (id.Hash, error)
+
+	// Run until the context is done. The Caster has no background loops, so
+	// it can be used without running it.
+	protocol.Runner
+}
+
+// Options are used to parameterise the behaviour of a Caster.
+type Options struct {
+	Logger logrus.FieldLogger
+
+	// Finder is optional. When set, the address of a peer that is not in the
+	// DHT is looked up before casting to it, for as long as the context of
+	// the cast allows. By default, casting to such a peer fails straight
+	// away.
+	Finder protocol.AddressFinder
+
+	// Loopback makes casts to the local peer emit an event straight away,
+	// instead of sending the message to the local peer through the network.
+	// The event is the same as the one that would be emitted if the message
+	// was accepted from the network.
+	Loopback bool
+}
+
+func (options *Options) setZerosToDefaults() {
+	if options.Logger == nil {
+		options.Logger = logrus.New()
+	}
+}
+
 type caster struct {
 	logger   logrus.FieldLogger
+	options  Options
 	messages protocol.MessageSender
 	events   protocol.EventSender
 	dht      dht.DHT
+
+	readiness protocol.Readiness
 }
 
 func NewCaster(logger logrus.FieldLogger, messages protocol.MessageSender, events protocol.EventSender, dht dht.DHT) Caster {
+	return NewCasterWithOptions(Options{Logger: logger}, messages, events, dht)
+}
+
+// NewCasterWithOptions returns a Caster that is parameterised by the Options.
+func NewCasterWithOptions(options Options, messages protocol.MessageSender, events protocol.EventSender, dht dht.DHT) ExtendedCaster {
+	options.setZerosToDefaults()
 	return &caster{
-		logger:   logger,
+		logger:   options.Logger,
+		options:  options,
 		messages: messages,
 		events:   events,
 		dht:      dht,
+
+		readiness: protocol.NewReadiness(),
 	}
 }
 
+func (caster *caster) Run(ctx context.Context) error {
+	caster.readiness.Signal()
+	<-ctx.Done()
+	return nil
+}
+
+func (caster *caster) Ready() <-chan struct{} {
+	return caster.readiness.Ready()
+}
+
 func (caster *caster) Cast(ctx context.Context, to protocol.PeerID, body protocol.MessageBody) error {
-	toAddr, err := caster.dht.PeerAddress(to)
+	_, err := caster.CastWithHash(ctx, to, body)
+	return err
+}
+
+func (caster *caster) CastWithHash(ctx context.Context, to protocol.PeerID, body protocol.MessageBody) (id.Hash, error) {
+	if caster.options.Loopback && to.Equal(caster.dht.Me().PeerID()) {
+		return caster.loopback(ctx, body)
+	}
+	toAddr, err := caster.peerAddress(ctx, to)
 	if err != nil {
-		return err
+		return id.Hash{}, err
 	}
 	message := protocol.MessageOnTheWire{
 		To:      toAddr,
 		Message: protocol.NewMessage(protocol.V1, protocol.Cast, protocol.NilGroupID, body),
 	}
+	hash := message.Message.Hash()
 
 	// Check if context is already expired
 	select {
 	case <-ctx.Done():
-		return newErrCasting(to, ctx.Err())
+		return hash, newErrCasting(to, ctx.Err())
 	default:
 	}
 
 	// Try to send the message via the message sender within the given context.
 	select {
 	case <-ctx.Done():
-		return newErrCasting(to, ctx.Err())
+		return hash, newErrCasting(to, ctx.Err())
 	case caster.messages <- message:
-		return nil
+		return hash, nil
 	}
 }
 
+// loopback emits the event for a cast to the local peer, without sending it.
+func (caster *caster) loopback(ctx context.Context, body protocol.MessageBody) (id.Hash, error) {
+	me := caster.dht.Me().PeerID()
+	message := protocol.NewMessage(protocol.V1, protocol.Cast, protocol.NilGroupID, body)
+	event := protocol.EventMessageReceived{
+		Time:    time.Now(),
+		Message: message.Body,
+		From:    me,
+		Hash:    message.Hash(),
+	}
+	select {
+	case <-ctx.Done():
+		return event.Hash, newErrCasting(me, ctx.Err())
+	case caster.events <- event:
+		return event.Hash, nil
+	}
+}
+
+// peerAddress returns the address of the peer in the DHT, or looks it up if it
+// is not in the DHT and a Finder is set.
+func (caster *caster) peerAddress(ctx context.Context, to protocol.PeerID) (protocol.PeerAddress, error) {
+	toAddr, err := caster.dht.PeerAddress(to)
+	if err == nil || caster.options.Finder == nil {
+		return toAddr, err
+	}
+	caster.logger.Debugf("looking up address of peer=%v: %v", to, err)
+	toAddr, err = caster.options.Finder.FindNode(ctx, to)
+	if err != nil {
+		return nil, newErrCasting(to, err)
+	}
+	return toAddr, nil
+}
+
 func (caster *caster) AcceptCast(ctx context.Context, from protocol.PeerID, message protocol.Message) error {
 	// Pre-condition checks
 	if message.Version != protocol.V1 {
@@ -70,6 +175,7 @@ func (caster *caster) AcceptCast(ctx context.Context, from protocol.PeerID, mess
 		Time:    time.Now(),
 		Message: message.Body,
 		From:    from,
+		Hash:    message.Hash(),
 	}
 
 	// Check if context is already expired
@@ -91,11 +197,17 @@ func (caster *caster) AcceptCast(ctx context.Context, from protocol.PeerID, mess
 type ErrCasting struct {
 	error
 	PeerID protocol.PeerID
+	cause  error
 }
 
 func newErrCasting(peerID protocol.PeerID, err error) error {
 	return ErrCasting{
 		error:  fmt.Errorf("error casting to %v: %v", peerID, err),
 		PeerID: peerID,
+		cause:  err,
 	}
 }
+
+func (err ErrCasting) Unwrap() error {
+	return err.cause
+}
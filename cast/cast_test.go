@@ -3,6 +3,7 @@ package cast_test
 import (
 	"bytes"
 	"context"
+	"errors"
 	"testing/quick"
 
 	. "github.com/onsi/ginkgo"
@@ -44,6 +45,50 @@ var _ = Describe("Caster", func() {
 			Expect(quick.Check(check, nil)).Should(BeNil())
 		})
 
+		It("should return the hash of the event emitted by the receiver", func() {
+			messages := make(chan protocol.MessageOnTheWire, 1)
+			events := make(chan protocol.Event, 1)
+			dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+			caster := NewCasterWithOptions(Options{}, messages, events, dht)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			to := RandomAddress()
+			Expect(dht.AddPeerAddress(to)).NotTo(HaveOccurred())
+			hash, err := caster.CastWithHash(ctx, to.PeerID(), RandomMessageBody())
+			Expect(err).NotTo(HaveOccurred())
+
+			var msg protocol.MessageOnTheWire
+			Eventually(messages).Should(Receive(&msg))
+			Expect(caster.AcceptCast(ctx, RandomAddress().PeerID(), msg.Message)).To(Succeed())
+			var event protocol.Event
+			Eventually(events).Should(Receive(&event))
+			Expect(event.(protocol.EventMessageReceived).Hash).To(Equal(hash))
+		})
+
+		Context("when casting to self with loopback", func() {
+			It("should emit the event without sending the message", func() {
+				messages := make(chan protocol.MessageOnTheWire, 1)
+				events := make(chan protocol.Event, 1)
+				me := RandomAddress()
+				dht := NewDHT(me, NewTable("dht"), nil)
+				caster := NewCasterWithOptions(Options{Loopback: true}, messages, events, dht)
+
+				body := RandomMessageBody()
+				hash, err := caster.CastWithHash(context.Background(), me.PeerID(), body)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(messages).Should(BeEmpty())
+
+				var event protocol.Event
+				Eventually(events).Should(Receive(&event))
+				received := event.(protocol.EventMessageReceived)
+				Expect(received.From.Equal(me.PeerID())).Should(BeTrue())
+				Expect(bytes.Equal(received.Message, body)).Should(BeTrue())
+				Expect(received.Hash).To(Equal(hash))
+			})
+		})
+
 		Context("when the context is cancelled", func() {
 			It("should return ErrCasting", func() {
 				check := func(message []byte) bool {
@@ -58,13 +103,47 @@ var _ = Describe("Caster", func() {
 
 					to := RandomAddress()
 					Expect(dht.AddPeerAddress(to)).NotTo(HaveOccurred())
-					Expect(caster.Cast(ctx, to.PeerID(), message)).Should(HaveOccurred())
+					err := caster.Cast(ctx, to.PeerID(), message)
+					Expect(err).Should(BeAssignableToTypeOf(ErrCasting{}))
+					Expect(errors.Is(err, context.Canceled)).Should(BeTrue())
 					return true
 				}
 
 				Expect(quick.Check(check, nil)).Should(BeNil())
 			})
 		})
+
+		Context("when the address of the peer is not in the DHT", func() {
+			It("should return an error if no finder is set", func() {
+				messages := make(chan protocol.MessageOnTheWire, 1)
+				events := make(chan protocol.Event, 1)
+				dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+				caster := NewCaster(logrus.New(), messages, events, dht)
+
+				Expect(caster.Cast(context.Background(), RandomPeerID(), RandomMessageBody())).Should(HaveOccurred())
+				Expect(messages).ShouldNot(Receive())
+			})
+
+			It("should look up the address of the peer if a finder is set", func() {
+				messages := make(chan protocol.MessageOnTheWire, 1)
+				events := make(chan protocol.Event, 1)
+				dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+				to := RandomAddress()
+				finder := MockAddressFinder{DHT: dht, Addrs: protocol.PeerAddresses{to}}
+				caster := NewCasterWithOptions(Options{Finder: finder}, messages, events, dht)
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				Expect(caster.Cast(ctx, to.PeerID(), RandomMessageBody())).To(Succeed())
+				var msg protocol.MessageOnTheWire
+				Eventually(messages).Should(Receive(&msg))
+				Expect(msg.To.Equal(to)).Should(BeTrue())
+
+				err := caster.Cast(ctx, RandomPeerID(), RandomMessageBody())
+				Expect(err).Should(HaveOccurred())
+				Expect(err).Should(BeAssignableToTypeOf(ErrCasting{}))
+			})
+		})
 	})
 
 	Context("when accepting casts", func() {
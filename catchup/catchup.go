@@ -0,0 +1,346 @@
+package catchup
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/renproject/aw/dht"
+	"github.com/renproject/aw/protocol"
+	"github.com/renproject/id"
+	"github.com/sirupsen/logrus"
+)
+
+// A CatchUpper stores recent group broadcasts and forwards them to members of
+// the group that were offline when the messages were broadcast. Members ask
+// for a catch-up by sending a CatchUp message that identifies the last message
+// they have seen (or the time they went offline). Retained messages after that
+// point are sent back to them as Broadcast messages, so the usual broadcast
+// deduplication applies on the receiving side.
+type CatchUpper interface {
+	// Retain a broadcast message so that it can be forwarded to group members
+	// that catch up later. It implements the broadcast.Retainer interface.
+	Retain(message protocol.Message)
+
+	// ReadSince returns the retained entries of the group with a sequence
+	// number greater than seq. Applications can use it to implement their own
+	// recovery logic.
+	ReadSince(groupID protocol.GroupID, seq uint64) ([]Entry, error)
+
+	// CatchUp asks the other members of the group for all messages that were
+	// broadcast since the given point.
+	CatchUp(ctx context.Context, groupID protocol.GroupID, since Since) error
+
+	// AcceptCatchUp from a member of the group and forward the retained
+	// messages to it.
+	AcceptCatchUp(ctx context.Context, from protocol.PeerID, message protocol.Message) error
+}
+
+// Options are used to parameterise the behaviour of a CatchUpper. Messages are
+// retained in the Log, which defaults to an in-memory Log with the given
+// limits. The limits apply to each group separately, and the oldest messages
+// are dropped first.
+type Options struct {
+	Logger      logrus.FieldLogger
+	Log         Log
+	MaxMessages int           // Defaults to 256
+	MaxBytes    int           // Defaults to 4 MB
+	MaxAge      time.Duration // Defaults to 10 minutes
+}
+
+func (options *Options) setZerosToDefaults() {
+	if options.Logger == nil {
+		options.Logger = logrus.New()
+	}
+	if options.MaxMessages <= 0 {
+		options.MaxMessages = 256
+	}
+	if options.MaxBytes <= 0 {
+		options.MaxBytes = 4 * 1024 * 1024
+	}
+	if options.MaxAge <= 0 {
+		options.MaxAge = 10 * time.Minute
+	}
+	if options.Log == nil {
+		options.Log = NewLog(nil, options.MaxMessages, options.MaxBytes, options.MaxAge)
+	}
+}
+
+// Since identifies the point from which a peer wants to catch up. When Hash is
+// set, only messages retained after the message with that hash are forwarded
+// (or all of them, if that message is no longer retained). Otherwise, when Seq
+// is set, messages with a greater sequence number in the group are forwarded.
+// Otherwise, messages retained after Time are forwarded.
+type Since struct {
+	Hash id.Hash
+	Seq  uint64
+	Time time.Time
+}
+
+// SinceHash returns a Since that refers to the message with the given hash.
+func SinceHash(hash id.Hash) Since {
+	return Since{Hash: hash}
+}
+
+// SinceSeq returns a Since that refers to the given sequence number.
+func SinceSeq(seq uint64) Since {
+	return Since{Seq: seq}
+}
+
+// SinceTime returns a Since that refers to the given time.
+func SinceTime(t time.Time) Since {
+	return Since{Time: t}
+}
+
+const (
+	sinceKindHash = uint8(0)
+	sinceKindTime = uint8(1)
+	sinceKindSeq  = uint8(2)
+)
+
+// MarshalBinary implements the `BinaryMarshaler` interface.
+func (since Since) MarshalBinary() ([]byte, error) {
+	buffer := new(bytes.Buffer)
+	if since.Hash != (id.Hash{}) {
+		if err := binary.Write(buffer, binary.LittleEndian, sinceKindHash); err != nil {
+			return nil, fmt.Errorf("error marshaling since kind: %v", err)
+		}
+		if err := binary.Write(buffer, binary.LittleEndian, since.Hash); err != nil {
+			return nil, fmt.Errorf("error marshaling since hash: %v", err)
+		}
+		return buffer.Bytes(), nil
+	}
+	if since.Seq != 0 {
+		if err := binary.Write(buffer, binary.LittleEndian, sinceKindSeq); err != nil {
+			return nil, fmt.Errorf("error marshaling since kind: %v", err)
+		}
+		if err := binary.Write(buffer, binary.LittleEndian, since.Seq); err != nil {
+			return nil, fmt.Errorf("error marshaling since seq: %v", err)
+		}
+		return buffer.Bytes(), nil
+	}
+	if err := binary.Write(buffer, binary.LittleEndian, sinceKindTime); err != nil {
+		return nil, fmt.Errorf("error marshaling since kind: %v", err)
+	}
+	if err := binary.Write(buffer, binary.LittleEndian, since.Time.UnixNano()); err != nil {
+		return nil, fmt.Errorf("error marshaling since time: %v", err)
+	}
+	return buffer.Bytes(), nil
+}
+
+// UnmarshalBinary implements the `BinaryUnmarshaler` interface.
+func (since *Since) UnmarshalBinary(data []byte) error {
+	buffer := bytes.NewBuffer(data)
+	var kind uint8
+	if err := binary.Read(buffer, binary.LittleEndian, &kind); err != nil {
+		return fmt.Errorf("error unmarshaling since kind: %v", err)
+	}
+	switch kind {
+	case sinceKindHash:
+		if err := binary.Read(buffer, binary.LittleEndian, &since.Hash); err != nil {
+			return fmt.Errorf("error unmarshaling since hash: %v", err)
+		}
+	case sinceKindTime:
+		var nanos int64
+		if err := binary.Read(buffer, binary.LittleEndian, &nanos); err != nil {
+			return fmt.Errorf("error unmarshaling since time: %v", err)
+		}
+		since.Time = time.Unix(0, nanos)
+	case sinceKindSeq:
+		if err := binary.Read(buffer, binary.LittleEndian, &since.Seq); err != nil {
+			return fmt.Errorf("error unmarshaling since seq: %v", err)
+		}
+	default:
+		return fmt.Errorf("error unmarshaling since: unknown kind=%v", kind)
+	}
+	if buffer.Len() != 0 {
+		return fmt.Errorf("error unmarshaling since: %v trailing bytes", buffer.Len())
+	}
+	return nil
+}
+
+type catchUpper struct {
+	logger   logrus.FieldLogger
+	options  Options
+	messages protocol.MessageSender
+	dht      dht.DHT
+}
+
+// NewCatchUpper returns a CatchUpper that retains messages in the Log given by
+// the Options.
+func NewCatchUpper(options Options, messages protocol.MessageSender, dht dht.DHT) CatchUpper {
+	options.setZerosToDefaults()
+	return &catchUpper{
+		logger:   options.Logger,
+		options:  options,
+		messages: messages,
+		dht:      dht,
+	}
+}
+
+func (catchUpper *catchUpper) Retain(message protocol.Message) {
+	if _, err := catchUpper.options.Log.Append(message); err != nil {
+		catchUpper.logger.Errorf("error retaining message hash=%v: %v", message.Hash(), err)
+	}
+}
+
+func (catchUpper *catchUpper) ReadSince(groupID protocol.GroupID, seq uint64) ([]Entry, error) {
+	return catchUpper.options.Log.ReadSince(groupID, seq)
+}
+
+func (catchUpper *catchUpper) CatchUp(ctx context.Context, groupID protocol.GroupID, since Since) error {
+	body, err := since.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	addrs, err := catchUpper.dht.GroupAddresses(groupID)
+	if err != nil {
+		return err
+	}
+
+	// Check if context is already expired
+	select {
+	case <-ctx.Done():
+		return newErrCatchingUp(ctx.Err(), groupID)
+	default:
+	}
+
+	message := protocol.NewMessage(protocol.V1, protocol.CatchUp, groupID, body)
+	for _, addr := range addrs {
+		if addr.PeerID().Equal(catchUpper.dht.Me().PeerID()) {
+			continue
+		}
+		messageWire := protocol.MessageOnTheWire{
+			To:      addr,
+			Message: message,
+		}
+		select {
+		case <-ctx.Done():
+			return newErrCatchingUp(ctx.Err(), groupID)
+		case catchUpper.messages <- messageWire:
+		}
+	}
+	return nil
+}
+
+func (catchUpper *catchUpper) AcceptCatchUp(ctx context.Context, from protocol.PeerID, message protocol.Message) error {
+	// Pre-condition checks
+	if message.Version != protocol.V1 {
+		return protocol.NewErrMessageVersionIsNotSupported(message.Version)
+	}
+	if message.Variant != protocol.CatchUp {
+		return protocol.NewErrMessageVariantIsNotSupported(message.Variant)
+	}
+
+	since := Since{}
+	if err := since.UnmarshalBinary(message.Body); err != nil {
+		return newErrAcceptingCatchUp(err)
+	}
+
+	// Only members of the group are allowed to catch up on its messages.
+	ids, err := catchUpper.dht.GroupIDs(message.GroupID)
+	if err != nil {
+		return newErrAcceptingCatchUp(err)
+	}
+	isMember := false
+	for _, id := range ids {
+		if id.Equal(from) {
+			isMember = true
+			break
+		}
+	}
+	if !isMember {
+		return newErrAcceptingCatchUp(fmt.Errorf("peer=%v is not a member of group=%v", from, message.GroupID))
+	}
+	to, err := catchUpper.dht.PeerAddress(from)
+	if err != nil {
+		return newErrAcceptingCatchUp(err)
+	}
+
+	entries, err := catchUpper.entriesSince(message.GroupID, since)
+	if err != nil {
+		return newErrAcceptingCatchUp(err)
+	}
+	now := time.Now()
+	for _, entry := range entries {
+		// Messages whose deadline has passed would be dropped by the peer
+		if entry.Message.Expired(now) {
+			continue
+		}
+		messageWire := protocol.MessageOnTheWire{
+			To:      to,
+			Message: entry.Message,
+		}
+		select {
+		case <-ctx.Done():
+			return newErrAcceptingCatchUp(ctx.Err())
+		case catchUpper.messages <- messageWire:
+		}
+	}
+	return nil
+}
+
+func (catchUpper *catchUpper) entriesSince(groupID protocol.GroupID, since Since) ([]Entry, error) {
+	if since.Hash == (id.Hash{}) && since.Seq != 0 {
+		return catchUpper.options.Log.ReadSince(groupID, since.Seq)
+	}
+	entries, err := catchUpper.options.Log.ReadSince(groupID, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	start := 0
+	if since.Hash != (id.Hash{}) {
+		for i := range entries {
+			if entries[i].Message.Hash() == since.Hash {
+				start = i + 1
+				break
+			}
+		}
+	} else {
+		for start < len(entries) && !entries[start].Time.After(since.Time) {
+			start++
+		}
+	}
+	return entries[start:], nil
+}
+
+// ErrCatchingUp is returned when there is an error when asking a group to
+// catch up.
+type ErrCatchingUp struct {
+	error
+	cause   error
+	GroupID protocol.GroupID
+}
+
+func newErrCatchingUp(err error, groupID protocol.GroupID) error {
+	return ErrCatchingUp{
+		error:   fmt.Errorf("error catching up with group=%v: %v", groupID, err),
+		cause:   err,
+		GroupID: groupID,
+	}
+}
+
+func (err ErrCatchingUp) Unwrap() error {
+	return err.cause
+}
+
+// ErrAcceptingCatchUp is returned when there is an error when accepting a
+// catch-up request.
+type ErrAcceptingCatchUp struct {
+	error
+	cause error
+}
+
+func newErrAcceptingCatchUp(err error) error {
+	return ErrAcceptingCatchUp{
+		error: fmt.Errorf("error accepting catch-up: %v", err),
+		cause: err,
+	}
+}
+
+func (err ErrAcceptingCatchUp) Unwrap() error {
+	return err.cause
+}
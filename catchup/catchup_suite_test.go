@@ -0,0 +1,13 @@
+package catchup_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestCatchUp(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "CatchUp Suite")
+}
@@ -0,0 +1,309 @@
+package catchup_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math"
+	"testing/quick"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/catchup"
+	. "github.com/renproject/aw/testutil"
+
+	"github.com/renproject/aw/protocol"
+	"github.com/sirupsen/logrus"
+)
+
+var TestOptions = Options{
+	Logger: logrus.New(),
+}
+
+var _ = Describe("CatchUpper", func() {
+	Context("when marshaling and unmarshaling a since", func() {
+		It("should return the same since", func() {
+			check := func(hash [32]byte, seq uint64, nanos int64) bool {
+				for _, since := range []Since{SinceHash(hash), SinceSeq(seq), SinceTime(time.Unix(0, nanos))} {
+					data, err := since.MarshalBinary()
+					Expect(err).NotTo(HaveOccurred())
+					decoded := Since{}
+					Expect(decoded.UnmarshalBinary(data)).To(Succeed())
+					Expect(decoded.Hash).Should(Equal(since.Hash))
+					Expect(decoded.Seq).Should(Equal(since.Seq))
+					Expect(decoded.Time.Equal(since.Time)).Should(BeTrue())
+				}
+				return true
+			}
+
+			Expect(quick.Check(check, nil)).Should(BeNil())
+		})
+
+		It("should return an error for malformed data", func() {
+			Expect((&Since{}).UnmarshalBinary(nil)).NotTo(Succeed())
+			Expect((&Since{}).UnmarshalBinary([]byte{2})).NotTo(Succeed())
+			Expect((&Since{}).UnmarshalBinary(make([]byte, 10))).NotTo(Succeed())
+		})
+	})
+
+	Context("when catching up", func() {
+		It("should send a catch-up request to the other members of the group", func() {
+			messages := make(chan protocol.MessageOnTheWire, 128)
+			dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+			catchUpper := NewCatchUpper(TestOptions, messages, dht)
+
+			groupID, addrs, err := NewGroup(dht)
+			Expect(err).NotTo(HaveOccurred())
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			Expect(catchUpper.CatchUp(ctx, groupID, SinceTime(time.Now()))).To(Succeed())
+
+			for range addrs {
+				var message protocol.MessageOnTheWire
+				Eventually(messages).Should(Receive(&message))
+				Expect(addrs).Should(ContainElement(message.To))
+				Expect(message.Message.Variant).Should(Equal(protocol.CatchUp))
+				Expect(message.Message.GroupID).Should(Equal(groupID))
+			}
+			Eventually(messages).ShouldNot(Receive())
+		})
+
+		It("should return an error if the context is cancelled", func() {
+			messages := make(chan protocol.MessageOnTheWire, 128)
+			dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+			catchUpper := NewCatchUpper(TestOptions, messages, dht)
+
+			groupID, _, err := NewGroup(dht)
+			Expect(err).NotTo(HaveOccurred())
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			err = catchUpper.CatchUp(ctx, groupID, SinceTime(time.Now()))
+			Expect(err).To(BeAssignableToTypeOf(ErrCatchingUp{}))
+			Expect(errors.Is(err, context.Canceled)).To(BeTrue())
+		})
+	})
+
+	Context("when accepting catch-up requests", func() {
+		It("should return an error if the context is cancelled", func() {
+			messages := make(chan protocol.MessageOnTheWire)
+			dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+			catchUpper := NewCatchUpper(TestOptions, messages, dht)
+
+			groupID, addrs, err := NewGroup(dht)
+			Expect(err).NotTo(HaveOccurred())
+			catchUpper.Retain(protocol.NewMessage(protocol.V1, protocol.Broadcast, groupID, RandomMessageBody()))
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			body, err := SinceSeq(0).MarshalBinary()
+			Expect(err).NotTo(HaveOccurred())
+			request := protocol.NewMessage(protocol.V1, protocol.CatchUp, groupID, body)
+			err = catchUpper.AcceptCatchUp(ctx, addrs[len(addrs)-1].PeerID(), request)
+			Expect(err).To(BeAssignableToTypeOf(ErrAcceptingCatchUp{}))
+			Expect(errors.Is(err, context.Canceled)).To(BeTrue())
+		})
+
+		It("should forward the messages retained after the given hash", func() {
+			check := func() bool {
+				messages := make(chan protocol.MessageOnTheWire, 128)
+				dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+				catchUpper := NewCatchUpper(TestOptions, messages, dht)
+
+				groupID, addrs, err := NewGroup(dht)
+				Expect(err).NotTo(HaveOccurred())
+				from := addrs[0]
+				if from.PeerID().Equal(dht.Me().PeerID()) {
+					return true
+				}
+
+				retained := make([]protocol.Message, 8)
+				for i := range retained {
+					retained[i] = protocol.NewMessage(protocol.V1, protocol.Broadcast, groupID, RandomMessageBody())
+					catchUpper.Retain(retained[i])
+				}
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				body, err := SinceHash(retained[4].Hash()).MarshalBinary()
+				Expect(err).NotTo(HaveOccurred())
+				request := protocol.NewMessage(protocol.V1, protocol.CatchUp, groupID, body)
+				Expect(catchUpper.AcceptCatchUp(ctx, from.PeerID(), request)).To(Succeed())
+
+				for _, expected := range retained[5:] {
+					var message protocol.MessageOnTheWire
+					Eventually(messages).Should(Receive(&message))
+					Expect(message.To.Equal(from)).Should(BeTrue())
+					Expect(message.Message.Variant).Should(Equal(protocol.Broadcast))
+					Expect(bytes.Equal(message.Message.Body, expected.Body)).Should(BeTrue())
+				}
+				Eventually(messages).ShouldNot(Receive())
+				return true
+			}
+
+			Expect(quick.Check(check, &quick.Config{MaxCount: 10})).Should(BeNil())
+		})
+
+		It("should forward the messages retained after the given sequence number", func() {
+			messages := make(chan protocol.MessageOnTheWire, 128)
+			dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+			catchUpper := NewCatchUpper(TestOptions, messages, dht)
+
+			groupID, addrs, err := NewGroup(dht)
+			Expect(err).NotTo(HaveOccurred())
+			from := addrs[0]
+			retained := make([]protocol.Message, 8)
+			for i := range retained {
+				retained[i] = protocol.NewMessage(protocol.V1, protocol.Broadcast, groupID, RandomMessageBody())
+				catchUpper.Retain(retained[i])
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			body, err := SinceSeq(6).MarshalBinary()
+			Expect(err).NotTo(HaveOccurred())
+			request := protocol.NewMessage(protocol.V1, protocol.CatchUp, groupID, body)
+			Expect(catchUpper.AcceptCatchUp(ctx, from.PeerID(), request)).To(Succeed())
+
+			for _, expected := range retained[6:] {
+				var message protocol.MessageOnTheWire
+				Eventually(messages).Should(Receive(&message))
+				Expect(bytes.Equal(message.Message.Body, expected.Body)).Should(BeTrue())
+			}
+			Eventually(messages).ShouldNot(Receive())
+		})
+
+		It("should not forward any messages for a sequence number at, or after, the next one", func() {
+			messages := make(chan protocol.MessageOnTheWire, 128)
+			dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+			catchUpper := NewCatchUpper(TestOptions, messages, dht)
+
+			groupID, addrs, err := NewGroup(dht)
+			Expect(err).NotTo(HaveOccurred())
+			for i := 0; i < 8; i++ {
+				catchUpper.Retain(protocol.NewMessage(protocol.V1, protocol.Broadcast, groupID, RandomMessageBody()))
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			for _, seq := range []uint64{9, 1000, math.MaxUint64} {
+				body, err := SinceSeq(seq).MarshalBinary()
+				Expect(err).NotTo(HaveOccurred())
+				request := protocol.NewMessage(protocol.V1, protocol.CatchUp, groupID, body)
+				Expect(catchUpper.AcceptCatchUp(ctx, addrs[0].PeerID(), request)).To(Succeed())
+			}
+			Eventually(messages).ShouldNot(Receive())
+		})
+
+		It("should forward all retained messages if the hash is unknown", func() {
+			messages := make(chan protocol.MessageOnTheWire, 128)
+			dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+			catchUpper := NewCatchUpper(TestOptions, messages, dht)
+
+			groupID, addrs, err := NewGroup(dht)
+			Expect(err).NotTo(HaveOccurred())
+			from := addrs[0]
+			for i := 0; i < 4; i++ {
+				catchUpper.Retain(protocol.NewMessage(protocol.V1, protocol.Broadcast, groupID, RandomMessageBody()))
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			body, err := SinceHash([32]byte{1}).MarshalBinary()
+			Expect(err).NotTo(HaveOccurred())
+			request := protocol.NewMessage(protocol.V1, protocol.CatchUp, groupID, body)
+			Expect(catchUpper.AcceptCatchUp(ctx, from.PeerID(), request)).To(Succeed())
+			Eventually(messages).Should(HaveLen(4))
+		})
+
+		It("should only keep the latest messages within the limits", func() {
+			messages := make(chan protocol.MessageOnTheWire, 128)
+			dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+			options := TestOptions
+			options.MaxMessages = 3
+			catchUpper := NewCatchUpper(options, messages, dht)
+
+			groupID, addrs, err := NewGroup(dht)
+			Expect(err).NotTo(HaveOccurred())
+			from := addrs[0]
+			retained := make([]protocol.Message, 8)
+			for i := range retained {
+				retained[i] = protocol.NewMessage(protocol.V1, protocol.Broadcast, groupID, RandomMessageBody())
+				catchUpper.Retain(retained[i])
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			body, err := SinceTime(time.Time{}).MarshalBinary()
+			Expect(err).NotTo(HaveOccurred())
+			request := protocol.NewMessage(protocol.V1, protocol.CatchUp, groupID, body)
+			Expect(catchUpper.AcceptCatchUp(ctx, from.PeerID(), request)).To(Succeed())
+
+			for _, expected := range retained[5:] {
+				var message protocol.MessageOnTheWire
+				Eventually(messages).Should(Receive(&message))
+				Expect(bytes.Equal(message.Message.Body, expected.Body)).Should(BeTrue())
+			}
+			Eventually(messages).ShouldNot(Receive())
+		})
+
+		It("should not forward expired messages", func() {
+			messages := make(chan protocol.MessageOnTheWire, 128)
+			dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+			options := TestOptions
+			options.MaxAge = 10 * time.Millisecond
+			catchUpper := NewCatchUpper(options, messages, dht)
+
+			groupID, addrs, err := NewGroup(dht)
+			Expect(err).NotTo(HaveOccurred())
+			catchUpper.Retain(protocol.NewMessage(protocol.V1, protocol.Broadcast, groupID, RandomMessageBody()))
+			time.Sleep(20 * time.Millisecond)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			body, err := SinceTime(time.Time{}).MarshalBinary()
+			Expect(err).NotTo(HaveOccurred())
+			request := protocol.NewMessage(protocol.V1, protocol.CatchUp, groupID, body)
+			Expect(catchUpper.AcceptCatchUp(ctx, addrs[0].PeerID(), request)).To(Succeed())
+			Eventually(messages).ShouldNot(Receive())
+		})
+
+		It("should reject requests from peers outside of the group", func() {
+			messages := make(chan protocol.MessageOnTheWire, 128)
+			dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+			catchUpper := NewCatchUpper(TestOptions, messages, dht)
+
+			groupID, _, err := NewGroup(dht)
+			Expect(err).NotTo(HaveOccurred())
+			catchUpper.Retain(protocol.NewMessage(protocol.V1, protocol.Broadcast, groupID, RandomMessageBody()))
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			body, err := SinceTime(time.Time{}).MarshalBinary()
+			Expect(err).NotTo(HaveOccurred())
+			request := protocol.NewMessage(protocol.V1, protocol.CatchUp, groupID, body)
+			Expect(catchUpper.AcceptCatchUp(ctx, RandomPeerID(), request)).NotTo(Succeed())
+			Eventually(messages).ShouldNot(Receive())
+		})
+
+		It("should reject messages with an unsupported version or variant", func() {
+			messages := make(chan protocol.MessageOnTheWire, 128)
+			dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+			catchUpper := NewCatchUpper(TestOptions, messages, dht)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			body, err := SinceTime(time.Now()).MarshalBinary()
+			Expect(err).NotTo(HaveOccurred())
+			message := protocol.NewMessage(protocol.V1, protocol.CatchUp, RandomGroupID(), body)
+			message.Version = InvalidMessageVersion()
+			Expect(catchUpper.AcceptCatchUp(ctx, RandomPeerID(), message)).NotTo(Succeed())
+
+			message = protocol.NewMessage(protocol.V1, protocol.CatchUp, RandomGroupID(), body)
+			message.Variant = InvalidMessageVariant(protocol.CatchUp)
+			Expect(catchUpper.AcceptCatchUp(ctx, RandomPeerID(), message)).NotTo(Succeed())
+		})
+	})
+})
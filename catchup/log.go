@@ -0,0 +1,197 @@
+package catchup
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/renproject/aw/protocol"
+	"github.com/renproject/kv"
+)
+
+// Entry is a message in the Log, together with its sequence number in the
+// group and the time at which it was appended.
+type Entry struct {
+	Seq     uint64
+	Time    time.Time
+	Message protocol.Message
+}
+
+// A Log is an append-only log of broadcast messages for each group. Every
+// message appended to a group is given the next sequence number in that group,
+// starting from 1. Old entries are compacted away, so a Log only ever holds the
+// most recent messages of each group.
+type Log interface {
+	// Append a message to the log of its group and return its sequence number.
+	Append(message protocol.Message) (uint64, error)
+
+	// ReadSince returns all entries of the group with a sequence number
+	// greater than seq, in order. Entries that have been compacted are not
+	// returned.
+	ReadSince(groupID protocol.GroupID, seq uint64) ([]Entry, error)
+
+	// Compact the log of the group by removing the oldest entries until it is
+	// within its limits.
+	Compact(groupID protocol.GroupID) error
+}
+
+// logHead stores the range of sequence numbers currently held for a group.
+// Entries in [First, Next) are in the store.
+type logHead struct {
+	First uint64
+	Next  uint64
+	Bytes int
+}
+
+type log struct {
+	maxMessages int
+	maxBytes    int
+	maxAge      time.Duration
+
+	mu    *sync.Mutex
+	store kv.Table
+	heads map[protocol.GroupID]logHead
+}
+
+// NewLog returns a Log that stores its entries in the given store. The number
+// of messages, the total size of message bodies, and the age of the entries in
+// each group are kept within the given limits. The log can be re-opened from
+// the same store after a restart.
+func NewLog(store kv.Table, maxMessages, maxBytes int, maxAge time.Duration) Log {
+	// Create a in-memory store if user doesn't provide one.
+	if store == nil {
+		store = kv.NewTable(kv.NewMemDB(kv.GobCodec), "catchup")
+	}
+	return &log{
+		maxMessages: maxMessages,
+		maxBytes:    maxBytes,
+		maxAge:      maxAge,
+
+		mu:    new(sync.Mutex),
+		store: store,
+		heads: map[protocol.GroupID]logHead{},
+	}
+}
+
+func (log *log) Append(message protocol.Message) (uint64, error) {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+
+	head, err := log.headWithoutLock(message.GroupID)
+	if err != nil {
+		return 0, err
+	}
+	entry := Entry{
+		Seq:     head.Next,
+		Time:    time.Now(),
+		Message: message,
+	}
+	if err := log.store.Insert(entryKey(message.GroupID, entry.Seq), entry); err != nil {
+		return 0, fmt.Errorf("error inserting entry seq=%v into log: %v", entry.Seq, err)
+	}
+	head.Next++
+	head.Bytes += len(message.Body)
+	if err := log.putHeadWithoutLock(message.GroupID, head); err != nil {
+		return 0, err
+	}
+	return entry.Seq, log.compactWithoutLock(message.GroupID)
+}
+
+func (log *log) ReadSince(groupID protocol.GroupID, seq uint64) ([]Entry, error) {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+
+	// Expired entries must not be read, even if nothing new has been appended
+	// since they expired.
+	if err := log.compactWithoutLock(groupID); err != nil {
+		return nil, err
+	}
+	head, err := log.headWithoutLock(groupID)
+	if err != nil {
+		return nil, err
+	}
+	if seq < head.First {
+		seq = head.First - 1
+	}
+	// The seq comes from other peers (see AcceptCatchUp), so it can be at, or
+	// after, the last entry (and even be the largest uint64). Next is never
+	// zero.
+	if seq >= head.Next-1 {
+		return []Entry{}, nil
+	}
+	entries := make([]Entry, 0, head.Next-seq-1)
+	for i := seq + 1; i < head.Next; i++ {
+		entry := Entry{}
+		if err := log.store.Get(entryKey(groupID, i), &entry); err != nil {
+			return nil, fmt.Errorf("error getting entry seq=%v from log: %v", i, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (log *log) Compact(groupID protocol.GroupID) error {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+
+	return log.compactWithoutLock(groupID)
+}
+
+func (log *log) compactWithoutLock(groupID protocol.GroupID) error {
+	head, err := log.headWithoutLock(groupID)
+	if err != nil {
+		return err
+	}
+	expiry := time.Now().Add(-log.maxAge)
+	compacted := false
+	for head.First < head.Next {
+		entry := Entry{}
+		if err := log.store.Get(entryKey(groupID, head.First), &entry); err != nil {
+			return fmt.Errorf("error getting entry seq=%v from log: %v", head.First, err)
+		}
+		if int(head.Next-head.First) <= log.maxMessages && head.Bytes <= log.maxBytes && entry.Time.After(expiry) {
+			break
+		}
+		if err := log.store.Delete(entryKey(groupID, head.First)); err != nil {
+			return fmt.Errorf("error deleting entry seq=%v from log: %v", head.First, err)
+		}
+		head.First++
+		head.Bytes -= len(entry.Message.Body)
+		compacted = true
+	}
+	if !compacted {
+		return nil
+	}
+	return log.putHeadWithoutLock(groupID, head)
+}
+
+func (log *log) headWithoutLock(groupID protocol.GroupID) (logHead, error) {
+	if head, ok := log.heads[groupID]; ok {
+		return head, nil
+	}
+	head := logHead{}
+	if err := log.store.Get(headKey(groupID), &head); err != nil {
+		if err != kv.ErrKeyNotFound {
+			return head, fmt.Errorf("error getting head of group=%v from log: %v", groupID, err)
+		}
+		return logHead{First: 1, Next: 1}, nil
+	}
+	log.heads[groupID] = head
+	return head, nil
+}
+
+func (log *log) putHeadWithoutLock(groupID protocol.GroupID, head logHead) error {
+	if err := log.store.Insert(headKey(groupID), head); err != nil {
+		return fmt.Errorf("error inserting head of group=%v into log: %v", groupID, err)
+	}
+	log.heads[groupID] = head
+	return nil
+}
+
+func headKey(groupID protocol.GroupID) string {
+	return fmt.Sprintf("%x/head", groupID[:])
+}
+
+func entryKey(groupID protocol.GroupID, seq uint64) string {
+	return fmt.Sprintf("%x/%020d", groupID[:], seq)
+}
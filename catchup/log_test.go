@@ -0,0 +1,147 @@
+package catchup_test
+
+import (
+	"bytes"
+	"math"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/catchup"
+	. "github.com/renproject/aw/testutil"
+
+	"github.com/renproject/aw/protocol"
+	"github.com/renproject/kv"
+)
+
+var _ = Describe("Log", func() {
+	appendMessages := func(log Log, groupID protocol.GroupID, n int) []protocol.Message {
+		messages := make([]protocol.Message, n)
+		for i := range messages {
+			messages[i] = protocol.NewMessage(protocol.V1, protocol.Broadcast, groupID, RandomMessageBody())
+			seq, err := log.Append(messages[i])
+			Expect(err).NotTo(HaveOccurred())
+			Expect(seq).Should(Equal(uint64(i + 1)))
+		}
+		return messages
+	}
+
+	expectEntries := func(entries []Entry, messages []protocol.Message, firstSeq uint64) {
+		Expect(entries).Should(HaveLen(len(messages)))
+		for i, entry := range entries {
+			Expect(entry.Seq).Should(Equal(firstSeq + uint64(i)))
+			Expect(entry.Message.GroupID).Should(Equal(messages[i].GroupID))
+			Expect(bytes.Equal(entry.Message.Body, messages[i].Body)).Should(BeTrue())
+		}
+	}
+
+	Context("when appending messages", func() {
+		It("should number the messages of each group separately", func() {
+			log := NewLog(nil, 100, 1024*1024, time.Minute)
+			groupID1, groupID2 := RandomGroupID(), RandomGroupID()
+			messages1 := appendMessages(log, groupID1, 4)
+			messages2 := appendMessages(log, groupID2, 2)
+
+			entries, err := log.ReadSince(groupID1, 0)
+			Expect(err).NotTo(HaveOccurred())
+			expectEntries(entries, messages1, 1)
+
+			entries, err = log.ReadSince(groupID2, 0)
+			Expect(err).NotTo(HaveOccurred())
+			expectEntries(entries, messages2, 1)
+		})
+
+		It("should only return the entries after the given sequence number", func() {
+			log := NewLog(nil, 100, 1024*1024, time.Minute)
+			groupID := RandomGroupID()
+			messages := appendMessages(log, groupID, 8)
+
+			entries, err := log.ReadSince(groupID, 5)
+			Expect(err).NotTo(HaveOccurred())
+			expectEntries(entries, messages[5:], 6)
+
+			entries, err = log.ReadSince(groupID, 8)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(entries).Should(BeEmpty())
+
+			entries, err = log.ReadSince(RandomGroupID(), 0)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(entries).Should(BeEmpty())
+		})
+
+		It("should not return any entries for a sequence number at, or after, the next one", func() {
+			log := NewLog(nil, 100, 1024*1024, time.Minute)
+			groupID := RandomGroupID()
+			appendMessages(log, groupID, 8)
+
+			for _, seq := range []uint64{9, 10, 1000, math.MaxUint64} {
+				entries, err := log.ReadSince(groupID, seq)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(entries).Should(BeEmpty())
+			}
+			entries, err := log.ReadSince(RandomGroupID(), math.MaxUint64)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(entries).Should(BeEmpty())
+		})
+	})
+
+	Context("when compacting the log", func() {
+		It("should drop the oldest entries above the message limit", func() {
+			log := NewLog(nil, 3, 1024*1024, time.Minute)
+			groupID := RandomGroupID()
+			messages := appendMessages(log, groupID, 8)
+
+			entries, err := log.ReadSince(groupID, 0)
+			Expect(err).NotTo(HaveOccurred())
+			expectEntries(entries, messages[5:], 6)
+		})
+
+		It("should drop the oldest entries above the byte limit", func() {
+			log := NewLog(nil, 100, 10, time.Minute)
+			groupID := RandomGroupID()
+			for i := 0; i < 4; i++ {
+				_, err := log.Append(protocol.NewMessage(protocol.V1, protocol.Broadcast, groupID, make([]byte, 4)))
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			entries, err := log.ReadSince(groupID, 0)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(entries).Should(HaveLen(2))
+			Expect(entries[0].Seq).Should(Equal(uint64(3)))
+		})
+
+		It("should drop expired entries", func() {
+			log := NewLog(nil, 100, 1024*1024, 10*time.Millisecond)
+			groupID := RandomGroupID()
+			appendMessages(log, groupID, 4)
+			time.Sleep(20 * time.Millisecond)
+
+			Expect(log.Compact(groupID)).To(Succeed())
+			entries, err := log.ReadSince(groupID, 0)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(entries).Should(BeEmpty())
+
+			seq, err := log.Append(protocol.NewMessage(protocol.V1, protocol.Broadcast, groupID, RandomMessageBody()))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(seq).Should(Equal(uint64(5)))
+		})
+	})
+
+	Context("when re-opening the log from the same store", func() {
+		It("should keep the entries and sequence numbers", func() {
+			store := kv.NewTable(kv.NewMemDB(kv.GobCodec), "catchup")
+			log := NewLog(store, 100, 1024*1024, time.Minute)
+			groupID := RandomGroupID()
+			messages := appendMessages(log, groupID, 4)
+
+			log = NewLog(store, 100, 1024*1024, time.Minute)
+			entries, err := log.ReadSince(groupID, 0)
+			Expect(err).NotTo(HaveOccurred())
+			expectEntries(entries, messages, 1)
+
+			seq, err := log.Append(protocol.NewMessage(protocol.V1, protocol.Broadcast, groupID, RandomMessageBody()))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(seq).Should(Equal(uint64(5)))
+		})
+	})
+})
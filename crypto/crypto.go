@@ -0,0 +1,57 @@
+// Package crypto provides SignVerifiers that can be used to authenticate peers
+// during the handshake, so that users do not need to implement the
+// protocol.SignVerifier interface to get started. Signing keys can be
+// generated, saved and loaded using the helpers in this package.
+package crypto
+
+import (
+	"crypto/sha256"
+
+	"github.com/renproject/aw/protocol"
+	"golang.org/x/crypto/sha3"
+)
+
+// PeerID is the identity of a peer, derived from its public key. For ed25519
+// keys, it is the hex encoding of the public key. For secp256k1 keys, it is
+// the hex encoding of the Ethereum address of the public key.
+type PeerID string
+
+// String implements the protocol.PeerID interface.
+func (peerID PeerID) String() string {
+	return string(peerID)
+}
+
+// Equal implements the protocol.PeerID interface.
+func (peerID PeerID) Equal(other protocol.PeerID) bool {
+	if other == nil {
+		return false
+	}
+	return peerID.String() == other.String()
+}
+
+// A HashFunc returns the 32 byte digest of some data. Digests are signed when
+// authenticating a peer.
+type HashFunc func(data []byte) []byte
+
+// SHA256 is a HashFunc that hashes data using SHA256.
+func SHA256(data []byte) []byte {
+	hash := sha256.Sum256(data)
+	return hash[:]
+}
+
+// Keccak256 is a HashFunc that hashes data using the legacy Keccak256 used by
+// Ethereum.
+func Keccak256(data []byte) []byte {
+	hash := sha3.NewLegacyKeccak256()
+	hash.Write(data)
+	return hash.Sum(nil)
+}
+
+// A SignVerifier is a protocol.SignVerifier with a signing key, that can
+// return the PeerID of its own public key.
+type SignVerifier interface {
+	protocol.SignVerifier
+
+	// ID returns the PeerID of the public key of the SignVerifier.
+	ID() PeerID
+}
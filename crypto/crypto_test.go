@@ -0,0 +1,65 @@
+package crypto_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/crypto"
+
+	"github.com/renproject/aw/handshake"
+	"github.com/renproject/aw/protocol"
+	"github.com/renproject/phi"
+)
+
+var _ = Describe("SignVerifiers", func() {
+	newSignVerifiers := map[string]func() SignVerifier{
+		"ed25519": func() SignVerifier {
+			privKey, err := GenerateEd25519Key()
+			Expect(err).NotTo(HaveOccurred())
+			return NewEd25519SignVerifier(privKey)
+		},
+		"secp256k1 with keccak256": func() SignVerifier {
+			privKey, err := GenerateSecp256k1Key()
+			Expect(err).NotTo(HaveOccurred())
+			return NewSecp256k1SignVerifier(privKey, Keccak256)
+		},
+		"secp256k1 with sha256": func() SignVerifier {
+			privKey, err := GenerateSecp256k1Key()
+			Expect(err).NotTo(HaveOccurred())
+			return NewSecp256k1SignVerifier(privKey, SHA256)
+		},
+	}
+
+	for name, newSignVerifier := range newSignVerifiers {
+		name, newSignVerifier := name, newSignVerifier
+
+		Context(fmt.Sprintf("when handshaking with %v SignVerifiers", name), func() {
+			It("should authenticate the client and server", func() {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+				defer cancel()
+
+				clientSignVerifier := newSignVerifier()
+				serverSignVerifier := newSignVerifier()
+				clientHandshaker := handshake.New(clientSignVerifier, handshake.NewGCMSessionManager())
+				serverHandshaker := handshake.New(serverSignVerifier, handshake.NewGCMSessionManager())
+
+				clientConn, serverConn := net.Pipe()
+				var clientSession, serverSession protocol.Session
+				var clientErr, serverErr error
+				phi.ParBegin(func() {
+					clientSession, clientErr = clientHandshaker.Handshake(ctx, clientConn)
+				}, func() {
+					serverSession, serverErr = serverHandshaker.AcceptHandshake(ctx, serverConn)
+				})
+				Expect(clientErr).NotTo(HaveOccurred())
+				Expect(serverErr).NotTo(HaveOccurred())
+				Expect(protocol.SessionPeerID(clientSession).Equal(serverSignVerifier.ID())).Should(BeTrue())
+				Expect(protocol.SessionPeerID(serverSession).Equal(clientSignVerifier.ID())).Should(BeTrue())
+			})
+		})
+	}
+})
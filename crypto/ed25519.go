@@ -0,0 +1,65 @@
+package crypto
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"github.com/renproject/aw/protocol"
+	"golang.org/x/crypto/ed25519"
+)
+
+// Ed25519SigLength is the length of the signatures produced by an ed25519
+// SignVerifier. Public keys cannot be recovered from ed25519 signatures, so
+// the public key is prepended to the signature.
+const Ed25519SigLength = ed25519.PublicKeySize + ed25519.SignatureSize
+
+type ed25519SignVerifier struct {
+	privKey ed25519.PrivateKey
+	hash    HashFunc
+}
+
+// NewEd25519SignVerifier returns a SignVerifier that signs digests using the
+// given ed25519 private key, and hashes data using SHA256.
+func NewEd25519SignVerifier(privKey ed25519.PrivateKey) SignVerifier {
+	if len(privKey) != ed25519.PrivateKeySize {
+		panic(fmt.Sprintf("pre-condition violation: expected ed25519 private key of length=%v, got length=%v", ed25519.PrivateKeySize, len(privKey)))
+	}
+	return &ed25519SignVerifier{
+		privKey: privKey,
+		hash:    SHA256,
+	}
+}
+
+// Ed25519PeerID returns the PeerID of an ed25519 public key.
+func Ed25519PeerID(pubKey ed25519.PublicKey) PeerID {
+	return PeerID(hex.EncodeToString(pubKey))
+}
+
+func (sv *ed25519SignVerifier) Sign(digest []byte) ([]byte, error) {
+	sig := make([]byte, 0, Ed25519SigLength)
+	sig = append(sig, sv.privKey.Public().(ed25519.PublicKey)...)
+	return append(sig, ed25519.Sign(sv.privKey, digest)...), nil
+}
+
+func (sv *ed25519SignVerifier) Verify(digest, sig []byte) (protocol.PeerID, error) {
+	if len(sig) != Ed25519SigLength {
+		return nil, fmt.Errorf("error verifying ed25519 signature: expected length=%v, got length=%v", Ed25519SigLength, len(sig))
+	}
+	pubKey := ed25519.PublicKey(sig[:ed25519.PublicKeySize])
+	if !ed25519.Verify(pubKey, digest, sig[ed25519.PublicKeySize:]) {
+		return nil, fmt.Errorf("error verifying ed25519 signature: invalid signature")
+	}
+	return Ed25519PeerID(pubKey), nil
+}
+
+func (sv *ed25519SignVerifier) Hash(data []byte) []byte {
+	return sv.hash(data)
+}
+
+func (sv *ed25519SignVerifier) SigLength() uint64 {
+	return Ed25519SigLength
+}
+
+func (sv *ed25519SignVerifier) ID() PeerID {
+	return Ed25519PeerID(sv.privKey.Public().(ed25519.PublicKey))
+}
@@ -0,0 +1,63 @@
+package crypto_test
+
+import (
+	"testing/quick"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/crypto"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+var _ = Describe("Ed25519 SignVerifier", func() {
+	newSignVerifier := func() SignVerifier {
+		privKey, err := GenerateEd25519Key()
+		Expect(err).NotTo(HaveOccurred())
+		return NewEd25519SignVerifier(privKey)
+	}
+
+	Context("when signing and verifying", func() {
+		It("should return the PeerID of the signer", func() {
+			signVerifier := newSignVerifier()
+			check := func(data []byte) bool {
+				digest := signVerifier.Hash(data)
+				Expect(digest).Should(HaveLen(32))
+				sig, err := signVerifier.Sign(digest)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(uint64(len(sig))).Should(Equal(signVerifier.SigLength()))
+
+				peerID, err := newSignVerifier().Verify(digest, sig)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(peerID.Equal(signVerifier.ID())).Should(BeTrue())
+				return true
+			}
+			Expect(quick.Check(check, nil)).Should(BeNil())
+		})
+
+		It("should return an error for an invalid signature", func() {
+			signVerifier := newSignVerifier()
+			check := func(data []byte, i uint) bool {
+				digest := signVerifier.Hash(data)
+				sig, err := signVerifier.Sign(digest)
+				Expect(err).NotTo(HaveOccurred())
+				sig[i%uint(len(sig))] ^= 1
+
+				_, err = signVerifier.Verify(digest, sig)
+				Expect(err).To(HaveOccurred())
+				_, err = signVerifier.Verify(digest, sig[1:])
+				Expect(err).To(HaveOccurred())
+				return true
+			}
+			Expect(quick.Check(check, nil)).Should(BeNil())
+		})
+	})
+
+	Context("when initializing a SignVerifier", func() {
+		It("should panic if providing an invalid private key", func() {
+			Expect(func() {
+				_ = NewEd25519SignVerifier(ed25519.PrivateKey{})
+			}).Should(Panic())
+		})
+	})
+})
@@ -0,0 +1,382 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	ethcrypto "github.com/ethereum/go-ethereum/crypto"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/scrypt"
+)
+
+// KeyType identifies the type of key stored in a key file.
+type KeyType string
+
+// Types of keys that can be stored in a key file.
+const (
+	KeyTypeEd25519   = KeyType("ed25519")
+	KeyTypeSecp256k1 = KeyType("secp256k1")
+)
+
+// KeyFileOptions are used to parameterise the scrypt key derivation used to
+// encrypt key files. The parameters are stored in the key file, so key files
+// can be decrypted regardless of the options used when loading them.
+type KeyFileOptions struct {
+	ScryptN int // Defaults to 2^18, cannot be larger than MaxScryptN
+	ScryptR int // Defaults to 8, cannot be larger than MaxScryptR
+	ScryptP int // Defaults to 1, cannot be larger than MaxScryptP
+}
+
+// Limits of the scrypt parameters of key files, so that a crafted key file
+// cannot make loading it use more than 1 GB of memory (which is 128*N*r
+// bytes), or an unbounded amount of time.
+const (
+	MaxScryptN = 1 << 20
+	MaxScryptR = 16
+	MaxScryptP = 16
+
+	maxScryptMemory = 1 << 30
+)
+
+func (options *KeyFileOptions) setZerosToDefaults() {
+	if options.ScryptN <= 0 {
+		options.ScryptN = 1 << 18
+	}
+	if options.ScryptR <= 0 {
+		options.ScryptR = 8
+	}
+	if options.ScryptP <= 0 {
+		options.ScryptP = 1
+	}
+}
+
+const keyFileVersion = 1
+
+// keyFile is the JSON encoding of an encrypted key file. The private key is
+// encrypted using AES-256-GCM, with a key derived from the passphrase using
+// scrypt. The type of the key is authenticated as additional data.
+type keyFile struct {
+	Version    int     `json:"version"`
+	Type       KeyType `json:"type"`
+	KDF        string  `json:"kdf"`
+	ScryptN    int     `json:"scryptN"`
+	ScryptR    int     `json:"scryptR"`
+	ScryptP    int     `json:"scryptP"`
+	Salt       string  `json:"salt"`
+	Nonce      string  `json:"nonce"`
+	Ciphertext string  `json:"ciphertext"`
+}
+
+// ErrWrongPassphrase is returned when a key file cannot be decrypted with the
+// given passphrase.
+type ErrWrongPassphrase struct {
+	error
+	Filename string
+}
+
+func newErrWrongPassphrase(filename string) error {
+	return ErrWrongPassphrase{
+		error:    fmt.Errorf("error decrypting key file %v: wrong passphrase", filename),
+		Filename: filename,
+	}
+}
+
+// SaveEncryptedEd25519Key writes an ed25519 private key to a file, encrypted
+// with the passphrase. The file is only readable by its owner.
+func SaveEncryptedEd25519Key(filename string, privKey ed25519.PrivateKey, passphrase []byte, options KeyFileOptions) error {
+	if len(privKey) != ed25519.PrivateKeySize {
+		return fmt.Errorf("error saving ed25519 key: expected length=%v, got length=%v", ed25519.PrivateKeySize, len(privKey))
+	}
+	return saveEncryptedKey(filename, KeyTypeEd25519, privKey.Seed(), passphrase, options)
+}
+
+// LoadEncryptedEd25519Key reads an ed25519 private key that was written by
+// SaveEncryptedEd25519Key.
+func LoadEncryptedEd25519Key(filename string, passphrase []byte) (ed25519.PrivateKey, error) {
+	seed, err := loadEncryptedKey(filename, KeyTypeEd25519, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("error loading ed25519 key from %v: expected length=%v, got length=%v", filename, ed25519.SeedSize, len(seed))
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// SaveEncryptedSecp256k1Key writes a secp256k1 private key to a file,
+// encrypted with the passphrase. The file is only readable by its owner.
+func SaveEncryptedSecp256k1Key(filename string, privKey *ecdsa.PrivateKey, passphrase []byte, options KeyFileOptions) error {
+	return saveEncryptedKey(filename, KeyTypeSecp256k1, ethcrypto.FromECDSA(privKey), passphrase, options)
+}
+
+// LoadEncryptedSecp256k1Key reads a secp256k1 private key that was written by
+// SaveEncryptedSecp256k1Key.
+func LoadEncryptedSecp256k1Key(filename string, passphrase []byte) (*ecdsa.PrivateKey, error) {
+	data, err := loadEncryptedKey(filename, KeyTypeSecp256k1, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	privKey, err := ethcrypto.ToECDSA(data)
+	if err != nil {
+		return nil, fmt.Errorf("error loading secp256k1 key from %v: %v", filename, err)
+	}
+	return privKey, nil
+}
+
+// LoadEncryptedSignVerifier returns a SignVerifier for the key in an encrypted
+// key file. The HashFunc is only used by secp256k1 keys; ed25519 keys always
+// use SHA256.
+func LoadEncryptedSignVerifier(filename string, passphrase []byte, hash HashFunc) (SignVerifier, error) {
+	keyType, err := encryptedKeyType(filename)
+	if err != nil {
+		return nil, err
+	}
+	switch keyType {
+	case KeyTypeEd25519:
+		privKey, err := LoadEncryptedEd25519Key(filename, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		return NewEd25519SignVerifier(privKey), nil
+	case KeyTypeSecp256k1:
+		privKey, err := LoadEncryptedSecp256k1Key(filename, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		return NewSecp256k1SignVerifier(privKey, hash), nil
+	default:
+		return nil, fmt.Errorf("error loading key from %v: unsupported type=%v", filename, keyType)
+	}
+}
+
+// LoadOrGenerateEncryptedSignVerifier returns a SignVerifier for the key in an
+// encrypted key file. If the file does not exist, a new key of the given type
+// is generated and saved to the file first, so that the identity of a node
+// survives restarts.
+func LoadOrGenerateEncryptedSignVerifier(filename string, keyType KeyType, passphrase []byte, hash HashFunc, options KeyFileOptions) (SignVerifier, error) {
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		if err := generateEncryptedKey(filename, keyType, passphrase, options); err != nil {
+			return nil, err
+		}
+	}
+	return LoadEncryptedSignVerifier(filename, passphrase, hash)
+}
+
+// RotateEncryptedKey replaces the key in an encrypted key file with a new key
+// of the same type, encrypted with the new passphrase. The new key changes the
+// identity (i.e. the PeerID) of the node that uses the key file, so other peers
+// will not recognise it as the same node. The previous key file is kept next
+// to the new one, with the ".old" suffix, so that it can be recovered if
+// needed. The current passphrase must be able to decrypt the previous key. To
+// keep the identity of the node, use ChangeEncryptedKeyPassphrase instead.
+func RotateEncryptedKey(filename string, passphrase, newPassphrase []byte, options KeyFileOptions) error {
+	keyType, err := encryptedKeyType(filename)
+	if err != nil {
+		return err
+	}
+	if _, err := loadEncryptedKey(filename, keyType, passphrase); err != nil {
+		return err
+	}
+
+	// Write the new key before replacing the previous one, so that a failure
+	// does not leave the node without an identity.
+	tmp := filename + ".new"
+	if err := generateEncryptedKey(tmp, keyType, newPassphrase, options); err != nil {
+		return err
+	}
+	if err := os.Rename(filename, filename+".old"); err != nil {
+		return fmt.Errorf("error rotating key file %v: %v", filename, err)
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		return fmt.Errorf("error rotating key file %v: %v", filename, err)
+	}
+	return nil
+}
+
+// ChangeEncryptedKeyPassphrase encrypts the key in an encrypted key file with
+// the new passphrase, so that the identity of the node that uses the key file
+// does not change. The key file is replaced atomically, and no copy that is
+// encrypted with the current passphrase is kept.
+func ChangeEncryptedKeyPassphrase(filename string, passphrase, newPassphrase []byte, options KeyFileOptions) error {
+	keyType, err := encryptedKeyType(filename)
+	if err != nil {
+		return err
+	}
+	data, err := loadEncryptedKey(filename, keyType, passphrase)
+	if err != nil {
+		return err
+	}
+
+	tmp := filename + ".new"
+	if err := saveEncryptedKey(tmp, keyType, data, newPassphrase, options); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		return fmt.Errorf("error changing passphrase of key file %v: %v", filename, err)
+	}
+	return nil
+}
+
+func generateEncryptedKey(filename string, keyType KeyType, passphrase []byte, options KeyFileOptions) error {
+	switch keyType {
+	case KeyTypeEd25519:
+		privKey, err := GenerateEd25519Key()
+		if err != nil {
+			return err
+		}
+		return SaveEncryptedEd25519Key(filename, privKey, passphrase, options)
+	case KeyTypeSecp256k1:
+		privKey, err := GenerateSecp256k1Key()
+		if err != nil {
+			return err
+		}
+		return SaveEncryptedSecp256k1Key(filename, privKey, passphrase, options)
+	default:
+		return fmt.Errorf("error generating key: unsupported type=%v", keyType)
+	}
+}
+
+func saveEncryptedKey(filename string, keyType KeyType, data, passphrase []byte, options KeyFileOptions) error {
+	options.setZerosToDefaults()
+	if err := checkScryptParams(options.ScryptN, options.ScryptR, options.ScryptP); err != nil {
+		return fmt.Errorf("error saving key to %v: %v", filename, err)
+	}
+
+	salt := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return fmt.Errorf("error generating salt: %v", err)
+	}
+	gcm, err := newKeyFileCipher(passphrase, salt, options.ScryptN, options.ScryptR, options.ScryptP)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return fmt.Errorf("error generating nonce: %v", err)
+	}
+
+	encoded, err := json.Marshal(keyFile{
+		Version:    keyFileVersion,
+		Type:       keyType,
+		KDF:        "scrypt",
+		ScryptN:    options.ScryptN,
+		ScryptR:    options.ScryptR,
+		ScryptP:    options.ScryptP,
+		Salt:       hex.EncodeToString(salt),
+		Nonce:      hex.EncodeToString(nonce),
+		Ciphertext: hex.EncodeToString(gcm.Seal(nil, nonce, data, []byte(keyType))),
+	})
+	if err != nil {
+		return fmt.Errorf("error marshaling key file: %v", err)
+	}
+	if err := ioutil.WriteFile(filename, encoded, 0600); err != nil {
+		return fmt.Errorf("error saving key to %v: %v", filename, err)
+	}
+	return nil
+}
+
+func loadEncryptedKey(filename string, keyType KeyType, passphrase []byte) ([]byte, error) {
+	file, err := readKeyFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if file.Type != keyType {
+		return nil, fmt.Errorf("error loading key from %v: expected type=%v, got type=%v", filename, keyType, file.Type)
+	}
+
+	salt, err := hex.DecodeString(file.Salt)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding salt from %v: %v", filename, err)
+	}
+	nonce, err := hex.DecodeString(file.Nonce)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding nonce from %v: %v", filename, err)
+	}
+	ciphertext, err := hex.DecodeString(file.Ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding ciphertext from %v: %v", filename, err)
+	}
+	gcm, err := newKeyFileCipher(passphrase, salt, file.ScryptN, file.ScryptR, file.ScryptP)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != gcm.NonceSize() {
+		return nil, fmt.Errorf("error loading key from %v: expected nonce length=%v, got length=%v", filename, gcm.NonceSize(), len(nonce))
+	}
+	data, err := gcm.Open(nil, nonce, ciphertext, []byte(file.Type))
+	if err != nil {
+		return nil, newErrWrongPassphrase(filename)
+	}
+	return data, nil
+}
+
+func encryptedKeyType(filename string) (KeyType, error) {
+	file, err := readKeyFile(filename)
+	if err != nil {
+		return "", err
+	}
+	return file.Type, nil
+}
+
+func readKeyFile(filename string) (keyFile, error) {
+	file := keyFile{}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return file, fmt.Errorf("error loading key from %v: %v", filename, err)
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return file, fmt.Errorf("error unmarshaling key file %v: %v", filename, err)
+	}
+	if file.Version != keyFileVersion {
+		return file, fmt.Errorf("error loading key from %v: unsupported version=%v", filename, file.Version)
+	}
+	if file.KDF != "scrypt" {
+		return file, fmt.Errorf("error loading key from %v: unsupported kdf=%v", filename, file.KDF)
+	}
+	if err := checkScryptParams(file.ScryptN, file.ScryptR, file.ScryptP); err != nil {
+		return file, fmt.Errorf("error loading key from %v: %v", filename, err)
+	}
+	return file, nil
+}
+
+// checkScryptParams returns an error if the scrypt parameters are larger than
+// their limits.
+func checkScryptParams(n, r, p int) error {
+	if n <= 1 || n > MaxScryptN {
+		return fmt.Errorf("expected 1<scryptN<=%v, got scryptN=%v", MaxScryptN, n)
+	}
+	if r <= 0 || r > MaxScryptR {
+		return fmt.Errorf("expected 0<scryptR<=%v, got scryptR=%v", MaxScryptR, r)
+	}
+	if p <= 0 || p > MaxScryptP {
+		return fmt.Errorf("expected 0<scryptP<=%v, got scryptP=%v", MaxScryptP, p)
+	}
+	if 128*uint64(n)*uint64(r) > maxScryptMemory {
+		return fmt.Errorf("expected scrypt memory<=%v, got scryptN=%v, scryptR=%v", maxScryptMemory, n, r)
+	}
+	return nil
+}
+
+func newKeyFileCipher(passphrase, salt []byte, n, r, p int) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, salt, n, r, p, 32)
+	if err != nil {
+		return nil, fmt.Errorf("error deriving key from passphrase: %v", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("error creating cipher: %v", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("error creating cipher: %v", err)
+	}
+	return gcm, nil
+}
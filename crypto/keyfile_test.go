@@ -0,0 +1,167 @@
+package crypto_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/crypto"
+)
+
+var _ = Describe("Encrypted key files", func() {
+	// Cheap key derivation to keep the tests fast
+	options := KeyFileOptions{ScryptN: 1 << 10}
+	passphrase := []byte("passphrase")
+
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "aw-keyfile")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	Context("when saving and loading an encrypted key", func() {
+		It("should return the same ed25519 key", func() {
+			privKey, err := GenerateEd25519Key()
+			Expect(err).NotTo(HaveOccurred())
+			filename := filepath.Join(dir, "ed25519.json")
+			Expect(SaveEncryptedEd25519Key(filename, privKey, passphrase, options)).To(Succeed())
+
+			loaded, err := LoadEncryptedEd25519Key(filename, passphrase)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(loaded).Should(Equal(privKey))
+
+			signVerifier, err := LoadEncryptedSignVerifier(filename, passphrase, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(signVerifier.ID()).Should(Equal(NewEd25519SignVerifier(privKey).ID()))
+		})
+
+		It("should return the same secp256k1 key", func() {
+			privKey, err := GenerateSecp256k1Key()
+			Expect(err).NotTo(HaveOccurred())
+			filename := filepath.Join(dir, "secp256k1.json")
+			Expect(SaveEncryptedSecp256k1Key(filename, privKey, passphrase, options)).To(Succeed())
+
+			loaded, err := LoadEncryptedSecp256k1Key(filename, passphrase)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(loaded.D.Cmp(privKey.D)).Should(Equal(0))
+
+			signVerifier, err := LoadEncryptedSignVerifier(filename, passphrase, Keccak256)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(signVerifier.ID()).Should(Equal(NewSecp256k1SignVerifier(privKey, Keccak256).ID()))
+		})
+
+		It("should not store the key in plaintext", func() {
+			privKey, err := GenerateEd25519Key()
+			Expect(err).NotTo(HaveOccurred())
+			filename := filepath.Join(dir, "ed25519.json")
+			Expect(SaveEncryptedEd25519Key(filename, privKey, passphrase, options)).To(Succeed())
+
+			data, err := ioutil.ReadFile(filename)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(data)).ShouldNot(ContainSubstring(string(privKey.Seed())))
+			Expect(string(data)).ShouldNot(ContainSubstring(hexString(privKey.Seed())))
+		})
+
+		It("should return an error for the wrong passphrase or key type", func() {
+			privKey, err := GenerateEd25519Key()
+			Expect(err).NotTo(HaveOccurred())
+			filename := filepath.Join(dir, "ed25519.json")
+			Expect(SaveEncryptedEd25519Key(filename, privKey, passphrase, options)).To(Succeed())
+
+			_, err = LoadEncryptedEd25519Key(filename, []byte("wrong"))
+			Expect(err).To(BeAssignableToTypeOf(ErrWrongPassphrase{}))
+			_, err = LoadEncryptedSecp256k1Key(filename, passphrase)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should return an error for scrypt parameters that are too large", func() {
+			privKey, err := GenerateEd25519Key()
+			Expect(err).NotTo(HaveOccurred())
+			filename := filepath.Join(dir, "ed25519.json")
+			Expect(SaveEncryptedEd25519Key(filename, privKey, passphrase, KeyFileOptions{ScryptN: MaxScryptN * 2})).NotTo(Succeed())
+			Expect(SaveEncryptedEd25519Key(filename, privKey, passphrase, options)).To(Succeed())
+
+			// A crafted key file must be rejected before deriving the key
+			data, err := ioutil.ReadFile(filename)
+			Expect(err).NotTo(HaveOccurred())
+			for param, crafted := range map[string]string{
+				`"scryptN":1024,`: `"scryptN":1073741824,`,
+				`"scryptR":8,`:    `"scryptR":1048576,`,
+				`"scryptP":1,`:    `"scryptP":1048576,`,
+			} {
+				Expect(string(data)).Should(ContainSubstring(param))
+				crafted := strings.Replace(string(data), param, crafted, 1)
+				Expect(ioutil.WriteFile(filename, []byte(crafted), 0600)).To(Succeed())
+				_, err = LoadEncryptedEd25519Key(filename, passphrase)
+				Expect(err).To(HaveOccurred())
+				Expect(err).NotTo(BeAssignableToTypeOf(ErrWrongPassphrase{}))
+			}
+		})
+	})
+
+	Context("when loading or generating an encrypted key", func() {
+		It("should generate the key once and load it afterwards", func() {
+			filename := filepath.Join(dir, "identity.json")
+			for _, keyType := range []KeyType{KeyTypeEd25519, KeyTypeSecp256k1} {
+				Expect(os.RemoveAll(filename)).To(Succeed())
+				signVerifier, err := LoadOrGenerateEncryptedSignVerifier(filename, keyType, passphrase, Keccak256, options)
+				Expect(err).NotTo(HaveOccurred())
+				loaded, err := LoadOrGenerateEncryptedSignVerifier(filename, keyType, passphrase, Keccak256, options)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(loaded.ID()).Should(Equal(signVerifier.ID()))
+			}
+		})
+	})
+
+	Context("when rotating an encrypted key", func() {
+		It("should replace the key and keep the previous one", func() {
+			filename := filepath.Join(dir, "identity.json")
+			signVerifier, err := LoadOrGenerateEncryptedSignVerifier(filename, KeyTypeEd25519, passphrase, nil, options)
+			Expect(err).NotTo(HaveOccurred())
+
+			newPassphrase := []byte("new passphrase")
+			Expect(RotateEncryptedKey(filename, []byte("wrong"), newPassphrase, options)).NotTo(Succeed())
+			Expect(RotateEncryptedKey(filename, passphrase, newPassphrase, options)).To(Succeed())
+
+			rotated, err := LoadEncryptedSignVerifier(filename, newPassphrase, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rotated.ID()).ShouldNot(Equal(signVerifier.ID()))
+
+			previous, err := LoadEncryptedSignVerifier(filename+".old", passphrase, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(previous.ID()).Should(Equal(signVerifier.ID()))
+		})
+	})
+
+	Context("when changing the passphrase of an encrypted key", func() {
+		It("should keep the key", func() {
+			filename := filepath.Join(dir, "identity.json")
+			signVerifier, err := LoadOrGenerateEncryptedSignVerifier(filename, KeyTypeSecp256k1, passphrase, Keccak256, options)
+			Expect(err).NotTo(HaveOccurred())
+
+			newPassphrase := []byte("new passphrase")
+			Expect(ChangeEncryptedKeyPassphrase(filename, []byte("wrong"), newPassphrase, options)).NotTo(Succeed())
+			Expect(ChangeEncryptedKeyPassphrase(filename, passphrase, newPassphrase, options)).To(Succeed())
+
+			_, err = LoadEncryptedSignVerifier(filename, passphrase, Keccak256)
+			Expect(err).To(BeAssignableToTypeOf(ErrWrongPassphrase{}))
+			loaded, err := LoadEncryptedSignVerifier(filename, newPassphrase, Keccak256)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(loaded.ID()).Should(Equal(signVerifier.ID()))
+		})
+	})
+})
+
+func hexString(data []byte) string {
+	return fmt.Sprintf("%x", data)
+}
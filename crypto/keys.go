@@ -0,0 +1,92 @@
+package crypto
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	ethcrypto "github.com/ethereum/go-ethereum/crypto"
+	"golang.org/x/crypto/ed25519"
+)
+
+// GenerateEd25519Key returns a random ed25519 private key.
+func GenerateEd25519Key() (ed25519.PrivateKey, error) {
+	_, privKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("error generating ed25519 key: %v", err)
+	}
+	return privKey, nil
+}
+
+// GenerateSecp256k1Key returns a random secp256k1 private key.
+func GenerateSecp256k1Key() (*ecdsa.PrivateKey, error) {
+	privKey, err := ethcrypto.GenerateKey()
+	if err != nil {
+		return nil, fmt.Errorf("error generating secp256k1 key: %v", err)
+	}
+	return privKey, nil
+}
+
+// SaveEd25519Key writes the seed of an ed25519 private key to a file, as hex.
+// The file is only readable by its owner.
+func SaveEd25519Key(filename string, privKey ed25519.PrivateKey) error {
+	if len(privKey) != ed25519.PrivateKeySize {
+		return fmt.Errorf("error saving ed25519 key: expected length=%v, got length=%v", ed25519.PrivateKeySize, len(privKey))
+	}
+	return saveHex(filename, privKey.Seed())
+}
+
+// LoadEd25519Key reads an ed25519 private key that was written by
+// SaveEd25519Key.
+func LoadEd25519Key(filename string) (ed25519.PrivateKey, error) {
+	seed, err := loadHex(filename)
+	if err != nil {
+		return nil, err
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("error loading ed25519 key from %v: expected length=%v, got length=%v", filename, ed25519.SeedSize, len(seed))
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// SaveSecp256k1Key writes a secp256k1 private key to a file, as hex. The file
+// is only readable by its owner.
+func SaveSecp256k1Key(filename string, privKey *ecdsa.PrivateKey) error {
+	return saveHex(filename, ethcrypto.FromECDSA(privKey))
+}
+
+// LoadSecp256k1Key reads a secp256k1 private key that was written by
+// SaveSecp256k1Key (which uses the same format as Ethereum key files).
+func LoadSecp256k1Key(filename string) (*ecdsa.PrivateKey, error) {
+	data, err := loadHex(filename)
+	if err != nil {
+		return nil, err
+	}
+	privKey, err := ethcrypto.ToECDSA(data)
+	if err != nil {
+		return nil, fmt.Errorf("error loading secp256k1 key from %v: %v", filename, err)
+	}
+	return privKey, nil
+}
+
+func saveHex(filename string, data []byte) error {
+	if err := ioutil.WriteFile(filename, []byte(hex.EncodeToString(data)), 0600); err != nil {
+		return fmt.Errorf("error saving key to %v: %v", filename, err)
+	}
+	return nil
+}
+
+func loadHex(filename string) ([]byte, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error loading key from %v: %v", filename, err)
+	}
+	decoded, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding key from %v: %v", filename, err)
+	}
+	return decoded, nil
+}
@@ -0,0 +1,73 @@
+package crypto_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/crypto"
+)
+
+var _ = Describe("Keys", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "aw-crypto")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	Context("when saving and loading an ed25519 key", func() {
+		It("should return the same key", func() {
+			privKey, err := GenerateEd25519Key()
+			Expect(err).NotTo(HaveOccurred())
+			filename := filepath.Join(dir, "ed25519.key")
+			Expect(SaveEd25519Key(filename, privKey)).To(Succeed())
+
+			loaded, err := LoadEd25519Key(filename)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(loaded).Should(Equal(privKey))
+			Expect(NewEd25519SignVerifier(loaded).ID()).Should(Equal(NewEd25519SignVerifier(privKey).ID()))
+		})
+	})
+
+	Context("when saving and loading a secp256k1 key", func() {
+		It("should return the same key", func() {
+			privKey, err := GenerateSecp256k1Key()
+			Expect(err).NotTo(HaveOccurred())
+			filename := filepath.Join(dir, "secp256k1.key")
+			Expect(SaveSecp256k1Key(filename, privKey)).To(Succeed())
+
+			loaded, err := LoadSecp256k1Key(filename)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(loaded.D.Cmp(privKey.D)).Should(Equal(0))
+			Expect(NewSecp256k1SignVerifier(loaded, Keccak256).ID()).Should(Equal(NewSecp256k1SignVerifier(privKey, Keccak256).ID()))
+		})
+	})
+
+	Context("when loading an invalid key", func() {
+		It("should return an error", func() {
+			_, err := LoadEd25519Key(filepath.Join(dir, "missing.key"))
+			Expect(err).To(HaveOccurred())
+
+			filename := filepath.Join(dir, "invalid.key")
+			Expect(ioutil.WriteFile(filename, []byte("not hex"), 0600)).To(Succeed())
+			_, err = LoadEd25519Key(filename)
+			Expect(err).To(HaveOccurred())
+			_, err = LoadSecp256k1Key(filename)
+			Expect(err).To(HaveOccurred())
+
+			Expect(ioutil.WriteFile(filename, []byte("abcd"), 0600)).To(Succeed())
+			_, err = LoadEd25519Key(filename)
+			Expect(err).To(HaveOccurred())
+			_, err = LoadSecp256k1Key(filename)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,67 @@
+package crypto
+
+import (
+	"crypto/ecdsa"
+	"fmt"
+
+	ethcrypto "github.com/ethereum/go-ethereum/crypto"
+	"github.com/renproject/aw/protocol"
+)
+
+// Secp256k1SigLength is the length of the recoverable signatures produced by
+// a secp256k1 SignVerifier.
+const Secp256k1SigLength = 65
+
+type secp256k1SignVerifier struct {
+	privKey *ecdsa.PrivateKey
+	hash    HashFunc
+}
+
+// NewSecp256k1SignVerifier returns a SignVerifier that signs digests using the
+// given secp256k1 private key, and hashes data using the given HashFunc
+// (usually Keccak256 or SHA256). Peers must use the same HashFunc to be able to
+// authenticate each other.
+func NewSecp256k1SignVerifier(privKey *ecdsa.PrivateKey, hash HashFunc) SignVerifier {
+	if privKey == nil {
+		panic("pre-condition violation: secp256k1 private key cannot be nil")
+	}
+	if hash == nil {
+		panic("pre-condition violation: HashFunc cannot be nil")
+	}
+	return &secp256k1SignVerifier{
+		privKey: privKey,
+		hash:    hash,
+	}
+}
+
+// Secp256k1PeerID returns the PeerID of a secp256k1 public key.
+func Secp256k1PeerID(pubKey ecdsa.PublicKey) PeerID {
+	return PeerID(ethcrypto.PubkeyToAddress(pubKey).String())
+}
+
+func (sv *secp256k1SignVerifier) Sign(digest []byte) ([]byte, error) {
+	return ethcrypto.Sign(digest, sv.privKey)
+}
+
+func (sv *secp256k1SignVerifier) Verify(digest, sig []byte) (protocol.PeerID, error) {
+	if len(sig) != Secp256k1SigLength {
+		return nil, fmt.Errorf("error verifying secp256k1 signature: expected length=%v, got length=%v", Secp256k1SigLength, len(sig))
+	}
+	pubKey, err := ethcrypto.SigToPub(digest, sig)
+	if err != nil {
+		return nil, fmt.Errorf("error verifying secp256k1 signature: %v", err)
+	}
+	return Secp256k1PeerID(*pubKey), nil
+}
+
+func (sv *secp256k1SignVerifier) Hash(data []byte) []byte {
+	return sv.hash(data)
+}
+
+func (sv *secp256k1SignVerifier) SigLength() uint64 {
+	return Secp256k1SigLength
+}
+
+func (sv *secp256k1SignVerifier) ID() PeerID {
+	return Secp256k1PeerID(sv.privKey.PublicKey)
+}
@@ -0,0 +1,78 @@
+package crypto_test
+
+import (
+	"testing/quick"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/crypto"
+)
+
+var _ = Describe("Secp256k1 SignVerifier", func() {
+	newSignVerifier := func(hash HashFunc) SignVerifier {
+		privKey, err := GenerateSecp256k1Key()
+		Expect(err).NotTo(HaveOccurred())
+		return NewSecp256k1SignVerifier(privKey, hash)
+	}
+
+	Context("when signing and verifying", func() {
+		It("should return the PeerID of the signer", func() {
+			for _, hash := range []HashFunc{Keccak256, SHA256} {
+				signVerifier := newSignVerifier(hash)
+				check := func(data []byte) bool {
+					digest := signVerifier.Hash(data)
+					Expect(digest).Should(HaveLen(32))
+					sig, err := signVerifier.Sign(digest)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(uint64(len(sig))).Should(Equal(signVerifier.SigLength()))
+
+					peerID, err := newSignVerifier(hash).Verify(digest, sig)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(peerID.Equal(signVerifier.ID())).Should(BeTrue())
+					return true
+				}
+				Expect(quick.Check(check, nil)).Should(BeNil())
+			}
+		})
+
+		It("should not return the PeerID of the signer for an invalid signature", func() {
+			signVerifier := newSignVerifier(Keccak256)
+			check := func(data []byte) bool {
+				digest := signVerifier.Hash(data)
+				sig, err := signVerifier.Sign(digest)
+				Expect(err).NotTo(HaveOccurred())
+
+				peerID, err := signVerifier.Verify(signVerifier.Hash(append(data, 0)), sig)
+				if err == nil {
+					Expect(peerID.Equal(signVerifier.ID())).Should(BeFalse())
+				}
+				_, err = signVerifier.Verify(digest, sig[1:])
+				Expect(err).To(HaveOccurred())
+				return true
+			}
+			Expect(quick.Check(check, nil)).Should(BeNil())
+		})
+	})
+
+	Context("when hashing", func() {
+		It("should use the given HashFunc", func() {
+			Expect(newSignVerifier(Keccak256).Hash([]byte("aw"))).Should(Equal(Keccak256([]byte("aw"))))
+			Expect(newSignVerifier(SHA256).Hash([]byte("aw"))).Should(Equal(SHA256([]byte("aw"))))
+			Expect(Keccak256([]byte("aw"))).ShouldNot(Equal(SHA256([]byte("aw"))))
+		})
+	})
+
+	Context("when initializing a SignVerifier", func() {
+		It("should panic if providing a nil private key or HashFunc", func() {
+			Expect(func() {
+				_ = NewSecp256k1SignVerifier(nil, Keccak256)
+			}).Should(Panic())
+
+			privKey, err := GenerateSecp256k1Key()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(func() {
+				_ = NewSecp256k1SignVerifier(privKey, nil)
+			}).Should(Panic())
+		})
+	})
+})
@@ -0,0 +1,94 @@
+package dht
+
+import (
+	"math/rand"
+
+	"github.com/renproject/aw/protocol"
+)
+
+// numBuckets is the number of k-buckets. The peers in the i-th bucket have
+// hashes that share a prefix of exactly i bits with the hash of this peer (see
+// CommonPrefixLength), so the last bucket only ever holds this peer.
+const numBuckets = 257
+
+// buckets organise the PeerIDs in the DHT by their XOR distance from this
+// peer, in the same way as Kademlia. Far buckets hold about half of all peers,
+// and every closer bucket holds about half as many peers as the one before it.
+type buckets struct {
+	me  protocol.PeerID
+	ids [numBuckets]map[string]protocol.PeerID
+}
+
+func newBuckets(me protocol.PeerID) *buckets {
+	return &buckets{me: me}
+}
+
+// index returns the index of the bucket that the peer belongs in.
+func (b *buckets) index(id protocol.PeerID) int {
+	return CommonPrefixLength(b.me, id)
+}
+
+func (b *buckets) add(id protocol.PeerID) {
+	i := b.index(id)
+	if b.ids[i] == nil {
+		b.ids[i] = map[string]protocol.PeerID{}
+	}
+	b.ids[i][id.String()] = id
+}
+
+func (b *buckets) remove(id protocol.PeerID) {
+	delete(b.ids[b.index(id)], id.String())
+}
+
+// size returns the number of peers in the bucket that the peer belongs in.
+func (b *buckets) size(id protocol.PeerID) int {
+	return len(b.ids[b.index(id)])
+}
+
+// closest returns at least n of the peers that are the closest to the target,
+// if there are that many, or all of them otherwise. They are not sorted. Peers
+// in the bucket of the target are closer to it than peers in any further
+// bucket from this peer, which are closer than peers in the buckets before
+// them, so buckets are taken in that order until there are enough peers.
+func (b *buckets) closest(target protocol.PeerID, n int) protocol.PeerIDs {
+	ids := protocol.PeerIDs{}
+	i := b.index(target)
+	for _, id := range b.ids[i] {
+		ids = append(ids, id)
+	}
+	if len(ids) >= n {
+		return ids
+	}
+	for j := i + 1; j < numBuckets; j++ {
+		for _, id := range b.ids[j] {
+			ids = append(ids, id)
+		}
+	}
+	for j := i - 1; j >= 0 && len(ids) < n; j-- {
+		for _, id := range b.ids[j] {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// preferClose returns the indexes of the addresses in random order, taking one
+// address from every bucket in turn, from the closest bucket to the furthest,
+// so that close peers are preferred even though there are far fewer of them.
+func (b *buckets) preferClose(addrs protocol.PeerAddresses) []int {
+	byBucket := make([][]int, numBuckets)
+	for _, i := range rand.Perm(len(addrs)) {
+		j := b.index(addrs[i].PeerID())
+		byBucket[j] = append(byBucket[j], i)
+	}
+	indexes := make([]int, 0, len(addrs))
+	for len(indexes) < len(addrs) {
+		for j := numBuckets - 1; j >= 0; j-- {
+			if len(byBucket[j]) > 0 {
+				indexes = append(indexes, byBucket[j][0])
+				byBucket[j] = byBucket[j][1:]
+			}
+		}
+	}
+	return indexes
+}
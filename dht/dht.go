@@ -1,9 +1,13 @@
 package dht
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/renproject/aw/protocol"
 	"github.com/renproject/kv"
@@ -11,7 +15,10 @@ import (
 
 // A DHT is a distributed hash table. It is used for storing peer addresses. A
 // DHT is not required to be persistent and will often purge stale peer
-// addresses.
+// addresses. The DHTs returned by this package are also protocol.Runners, so
+// that they can be started and stopped with the other subsystems of a Peer.
+// Runner is not part of the DHT interface, because it would conflict with the
+// Ready method of the Peer, which embeds the DHT interface.
 type DHT interface {
 
 	// Me returns self PeerAddress
@@ -45,33 +52,205 @@ type DHT interface {
 	// AddGroup creates a new group in the DHT with given ID and PeerIDs.
 	AddGroup(protocol.GroupID, protocol.PeerIDs) error
 
-	// GroupIDs returns the PeerIDs in the group with the given ID.
+	// GroupIDs returns the PeerIDs in the group with the given ID, and in all
+	// of its subgroups. A peer that is in more than one of these groups is
+	// only returned once.
 	GroupIDs(protocol.GroupID) (protocol.PeerIDs, error)
 
-	// GroupAddresses returns the PeerAddresses in the group with the given ID.
-	// It will not return peers for which we do not have the PeerAddresses.
+	// GroupAddresses returns the PeerAddresses in the group with the given ID,
+	// and in all of its subgroups. It will not return peers for which we do
+	// not have the PeerAddresses.
 	GroupAddresses(protocol.GroupID) (protocol.PeerAddresses, error)
 
-	// Remove a group from the DHT with the given ID.
+	// Remove a group from the DHT with the given ID. The group is also removed
+	// from the hierarchy of groups, but its subgroups are not removed.
 	RemoveGroup(protocol.GroupID)
 }
 
+// An ExtendedDHT is a DHT that tracks when peers are seen, finds the peers that
+// are the closest to a PeerID, nests groups into subgroups, and publishes the
+// changes of its PeerAddresses. The DHTs returned by this package are
+// ExtendedDHTs, so that a DHT can be type asserted (see Extend) to use these
+// features without breaking other implementations of the DHT.
+type ExtendedDHT interface {
+	DHT
+
+	// UpdateMe replaces the PeerAddress of this peer, when its network address
+	// changes (e.g. when a router forwards a port to it, see nat.Map). The
+	// PeerID of the new PeerAddress must be the same.
+	UpdateMe(protocol.PeerAddress) error
+
+	// ClosestPeerAddresses returns (at max) n PeerAddresses that are the
+	// closest to the target PeerID (see Distance), from the closest to the
+	// furthest.
+	ClosestPeerAddresses(target protocol.PeerID, n int) (protocol.PeerAddresses, error)
+
+	// Seen records that the peer is alive (e.g. because a message, or a pong,
+	// was received from it). Peers that the DHT has no PeerAddress for are
+	// ignored.
+	Seen(protocol.PeerID)
+
+	// LastSeen returns the time at which the peer was last seen, or the time
+	// at which its PeerAddress was added (or loaded from the store) if it has
+	// not been seen since. It returns an ErrPeerNotFound if the PeerID cannot
+	// be found.
+	LastSeen(protocol.PeerID) (time.Time, error)
+
+	// RemoveStalePeers removes the PeerAddresses of the peers that have not
+	// been seen since the given time, so that they are no longer dialed, and
+	// returns their PeerIDs. Bootstrap peers are never removed.
+	RemoveStalePeers(since time.Time) (protocol.PeerIDs, error)
+
+	// RecentPeerAddresses returns the PeerAddresses of up to n peers, in the
+	// order in which they were last seen, most recent first, so that fresh
+	// addresses can be shared with other peers.
+	RecentPeerAddresses(n int) (protocol.PeerAddresses, error)
+
+	// GroupInfo returns the members of the group with the given ID, and of all
+	// of its subgroups, together with their PeerAddresses, read from a single
+	// consistent view of the groups and the addresses.
+	GroupInfo(protocol.GroupID) (GroupInfo, error)
+
+	// AddSubgroup makes the child group a subgroup of the parent group, so
+	// that messages sent to the parent group also reach the members of the
+	// child group (e.g. region, datacenter, shard). A group can have many
+	// parents, but the hierarchy cannot have cycles. The groups do not need
+	// to exist when they are linked.
+	AddSubgroup(parent, child protocol.GroupID) error
+
+	// Subgroups returns the direct subgroups of the group with the given ID.
+	Subgroups(protocol.GroupID) []protocol.GroupID
+
+	// RemoveSubgroup removes the child group from the subgroups of the parent
+	// group. It wouldn't return any error if the child is not a subgroup.
+	RemoveSubgroup(parent, child protocol.GroupID)
+
+	// Subscribe to the changes of the PeerAddresses in the DHT, so that other
+	// subsystems can react to them without polling PeerAddresses. Changes are
+	// sent to the given channel without blocking, so the subscriber must read
+	// them quickly enough (or give the channel enough capacity) to avoid
+	// dropping changes. The returned function unsubscribes the channel.
+	Subscribe(changes chan<- PeerChange) (unsubscribe func())
+}
+
+// Options are used to parameterise the behaviour of a DHT.
+type Options struct {
+	// MaxPeersPerSubnet limits the number of peers from the same subnet that
+	// are learnt from other peers, and that are returned together by
+	// RandomPeerAddresses, so that an attacker that controls a subnet cannot
+	// easily eclipse this peer. Peers that are added explicitly, bootstrap
+	// peers, and members of groups are always kept. Random peers are only
+	// taken from the same subnet once there are not enough peers from other
+	// subnets. It is not enforced unless it is positive.
+	MaxPeersPerSubnet int
+	// SubnetPrefixIPv4 and SubnetPrefixIPv6 are the lengths of the prefixes
+	// that define a subnet. They default to 24 and 48.
+	SubnetPrefixIPv4 int
+	SubnetPrefixIPv6 int
+
+	// BucketSize limits the number of peers that are learnt from other peers
+	// in each k-bucket, in the same way as Kademlia, where the k-buckets hold
+	// the peers by their XOR distance from this peer (see
+	// CommonPrefixLength). Peers that have been known for longest are kept,
+	// and the exemptions of MaxPeersPerSubnet also apply. It is not enforced
+	// unless it is positive.
+	BucketSize int
+	// PreferClosePeers makes RandomPeerAddresses take peers from every
+	// k-bucket in turn, from the closest to the furthest, instead of taking
+	// them uniformly at random, so that the few close peers are preferred
+	// over the many far peers.
+	PreferClosePeers bool
+
+	// SchemaVersion is the version of the records of peer addresses that are
+	// encoded by the PeerAddressCodec (defaults to 1). It is recorded in the
+	// store, and when the DHT is created, the records of older versions are
+	// upgraded by the Migrations, where Migrations[v] upgrades a record from
+	// version v to version v+1. The DHT cannot be created when a migration is
+	// missing, or when the store is from a newer version. Records that cannot
+	// be migrated, or decoded, are deleted, because the addresses of peers can
+	// be learnt again.
+	SchemaVersion int
+	Migrations    map[int]Migration
+}
+
+func (options *Options) setZerosToDefaults() {
+	if options.SubnetPrefixIPv4 <= 0 || options.SubnetPrefixIPv4 > 32 {
+		options.SubnetPrefixIPv4 = 24
+	}
+	if options.SubnetPrefixIPv6 <= 0 || options.SubnetPrefixIPv6 > 128 {
+		options.SubnetPrefixIPv6 = 48
+	}
+	if options.SchemaVersion <= 0 {
+		options.SchemaVersion = 1
+	}
+}
+
+// GroupInfo is a snapshot of a group. Its Members, Addresses, and Missing
+// members are read together, so that they agree with each other even when the
+// group or the addresses are changed concurrently.
+type GroupInfo struct {
+	GroupID   protocol.GroupID
+	Members   protocol.PeerIDs       // Members of the group and of its subgroups
+	Addresses protocol.PeerAddresses // Addresses of the members that are resolved
+	Missing   protocol.PeerIDs       // Members that do not have an address
+
+	// Version of the DHT that the snapshot was read from. It changes whenever
+	// a group or an address changes, so two snapshots with the same Version
+	// are the same view.
+	Version uint64
+}
+
+// Resolved returns the number of members that have an address.
+func (info GroupInfo) Resolved() int {
+	return len(info.Addresses)
+}
+
 type dht struct {
-	me    protocol.PeerAddress
-	codec protocol.PeerAddressCodec
-	store kv.Table
+	me      protocol.PeerAddress
+	codec   protocol.PeerAddressCodec
+	store   kv.Table
+	options Options
 
-	groupsMu *sync.RWMutex
-	groups   map[protocol.GroupID]protocol.PeerIDs
+	groupsMu  *sync.RWMutex
+	groups    map[protocol.GroupID]protocol.PeerIDs
+	subgroups map[protocol.GroupID][]protocol.GroupID
 
 	inMemCacheMu *sync.RWMutex
 	inMemCache   map[string]protocol.PeerAddress
+	subnets      map[string]int // Number of peers in the in-memory cache from each subnet
+	buckets      *buckets       // PeerIDs in the in-memory cache by their distance
+
+	// The times at which the peers in the in-memory cache were last seen. It
+	// is locked after the in-memory cache, so that recording that a peer was
+	// seen does not block readers of the cache.
+	seenMu *sync.Mutex
+	seen   map[string]time.Time
+
+	// Observers only keep the addresses of bootstrap peers and members of
+	// groups, and do not persist them. Bootstrap peers are also exempt from
+	// the MaxPeersPerSubnet limit.
+	observer     bool
+	bootstrapIDs map[string]struct{}
+
+	// version is incremented whenever a group or an address changes (see
+	// GroupInfo). Groups and addresses are guarded by different locks, so it
+	// is updated atomically.
+	version uint64
+
+	subscribers *subscribers
+	readiness   protocol.Readiness
 }
 
 // New DHT that stores peer addresses in the given store. It will cache all
 // peer addresses in memory for fast access. It is safe for concurrent use,
 // regardless of the underlying store.
 func New(me protocol.PeerAddress, codec protocol.PeerAddressCodec, store kv.Table, bootstrapAddrs ...protocol.PeerAddress) (DHT, error) {
+	return NewWithOptions(Options{}, me, codec, store, bootstrapAddrs...)
+}
+
+// NewWithOptions returns a DHT with the given Options that stores peer
+// addresses in the given store.
+func NewWithOptions(options Options, me protocol.PeerAddress, codec protocol.PeerAddressCodec, store kv.Table, bootstrapAddrs ...protocol.PeerAddress) (ExtendedDHT, error) {
 	// Validate input parameters
 	if me == nil {
 		panic("pre-condition violation: self PeerAddress cannot be nil")
@@ -85,16 +264,30 @@ func New(me protocol.PeerAddress, codec protocol.PeerAddressCodec, store kv.Tabl
 		store = kv.NewTable(kv.NewMemDB(kv.GobCodec), "dht")
 	}
 
+	options.setZerosToDefaults()
 	dht := &dht{
-		me:    me,
-		codec: codec,
-		store: store,
+		me:      me,
+		codec:   codec,
+		store:   store,
+		options: options,
 
-		groupsMu: new(sync.RWMutex),
-		groups:   map[protocol.GroupID]protocol.PeerIDs{},
+		groupsMu:  new(sync.RWMutex),
+		groups:    map[protocol.GroupID]protocol.PeerIDs{},
+		subgroups: map[protocol.GroupID][]protocol.GroupID{},
 
 		inMemCacheMu: new(sync.RWMutex),
 		inMemCache:   map[string]protocol.PeerAddress{},
+		subnets:      map[string]int{},
+		buckets:      newBuckets(me.PeerID()),
+		seenMu:       new(sync.Mutex),
+		seen:         map[string]time.Time{},
+
+		bootstrapIDs: map[string]struct{}{},
+		subscribers:  newSubscribers(),
+		readiness:    protocol.NewReadiness(),
+	}
+	for _, addr := range bootstrapAddrs {
+		dht.bootstrapIDs[addr.PeerID().String()] = struct{}{}
 	}
 
 	if err := dht.fillInMemCache(); err != nil {
@@ -103,10 +296,80 @@ func New(me protocol.PeerAddress, codec protocol.PeerAddressCodec, store kv.Tabl
 	return dht, dht.addBootstrapNodes(bootstrapAddrs)
 }
 
+// NewObserver returns a DHT for light clients that do not maintain a full
+// routing table. It keeps the addresses of the bootstrap peers and of the
+// members of the groups that have been added, and ignores updates to the
+// addresses of all other peers (e.g. those learnt from address gossip). Peer
+// addresses are only held in memory. Addresses that are added explicitly are
+// always kept.
+func NewObserver(me protocol.PeerAddress, codec protocol.PeerAddressCodec, bootstrapAddrs ...protocol.PeerAddress) (ExtendedDHT, error) {
+	if me == nil {
+		panic("pre-condition violation: self PeerAddress cannot be nil")
+	}
+	if codec == nil {
+		panic("pre-condition violation: PeerAddressCodec cannot be nil")
+	}
+
+	options := Options{}
+	options.setZerosToDefaults()
+	dht := &dht{
+		me:      me,
+		codec:   codec,
+		options: options,
+
+		groupsMu:  new(sync.RWMutex),
+		groups:    map[protocol.GroupID]protocol.PeerIDs{},
+		subgroups: map[protocol.GroupID][]protocol.GroupID{},
+
+		inMemCacheMu: new(sync.RWMutex),
+		inMemCache:   map[string]protocol.PeerAddress{},
+		subnets:      map[string]int{},
+		buckets:      newBuckets(me.PeerID()),
+		seenMu:       new(sync.Mutex),
+		seen:         map[string]time.Time{},
+
+		observer:     true,
+		bootstrapIDs: map[string]struct{}{},
+		subscribers:  newSubscribers(),
+		readiness:    protocol.NewReadiness(),
+	}
+	for _, addr := range bootstrapAddrs {
+		dht.bootstrapIDs[addr.PeerID().String()] = struct{}{}
+	}
+	return dht, dht.addBootstrapNodes(bootstrapAddrs)
+}
+
+// Run until the context is done. The DHT has no background loops, so it can be
+// used without running it.
+func (dht *dht) Run(ctx context.Context) error {
+	dht.readiness.Signal()
+	<-ctx.Done()
+	return nil
+}
+
+func (dht *dht) Ready() <-chan struct{} {
+	return dht.readiness.Ready()
+}
+
 func (dht *dht) Me() protocol.PeerAddress {
+	dht.inMemCacheMu.RLock()
+	defer dht.inMemCacheMu.RUnlock()
+
 	return dht.me
 }
 
+func (dht *dht) UpdateMe(me protocol.PeerAddress) error {
+	dht.inMemCacheMu.Lock()
+	defer dht.inMemCacheMu.Unlock()
+
+	if me == nil || !me.PeerID().Equal(dht.me.PeerID()) {
+		return fmt.Errorf("error updating address of peer=%v: address has a different peer id", dht.me.PeerID())
+	}
+	dht.me = me
+	atomic.AddUint64(&dht.version, 1)
+	return nil
+}
+
 func (dht *dht) NumPeers() (int, error) {
 	dht.inMemCacheMu.RLock()
 	defer dht.inMemCacheMu.RUnlock()
@@ -135,7 +398,15 @@ func (dht *dht) RandomPeerAddresses(groupID protocol.GroupID, n int) (protocol.P
 		n = len(addrs)
 	}
 
-	indexes := rand.Perm(len(addrs))
+	var indexes []int
+	if dht.options.PreferClosePeers {
+		indexes = dht.buckets.preferClose(addrs)
+	} else {
+		indexes = rand.Perm(len(addrs))
+	}
+	if dht.options.MaxPeersPerSubnet > 0 {
+		return dht.diverseAddresses(addrs, indexes, n), nil
+	}
 	randAddrs := make(protocol.PeerAddresses, n)
 	for i := range randAddrs {
 		randAddrs[i] = addrs[indexes[i]]
@@ -143,6 +414,51 @@ func (dht *dht) RandomPeerAddresses(groupID protocol.GroupID, n int) (protocol.P
 	return randAddrs, nil
 }
 
+func (dht *dht) ClosestPeerAddresses(target protocol.PeerID, n int) (protocol.PeerAddresses, error) {
+	dht.inMemCacheMu.RLock()
+	ids := dht.buckets.closest(target, n)
+	addrs := make(protocol.PeerAddresses, 0, len(ids))
+	for _, id := range ids {
+		addrs = append(addrs, dht.inMemCache[id.String()])
+	}
+	dht.inMemCacheMu.RUnlock()
+
+	SortByDistance(target, addrs)
+	if len(addrs) > n {
+		addrs = addrs[:n]
+	}
+	return addrs, nil
+}
+
+// diverseAddresses returns n of the addresses, in the order of the given
+// indexes, without taking more than MaxPeersPerSubnet addresses from the same
+// subnet unless there are not enough addresses from other subnets.
+func (dht *dht) diverseAddresses(addrs protocol.PeerAddresses, indexes []int, n int) protocol.PeerAddresses {
+	selected := make(protocol.PeerAddresses, 0, n)
+	skipped := make([]int, 0, len(indexes))
+	subnets := map[string]int{}
+	for _, i := range indexes {
+		if len(selected) == n {
+			return selected
+		}
+		if subnet, ok := dht.subnet(addrs[i]); ok {
+			if subnets[subnet] >= dht.options.MaxPeersPerSubnet {
+				skipped = append(skipped, i)
+				continue
+			}
+			subnets[subnet]++
+		}
+		selected = append(selected, addrs[i])
+	}
+	for _, i := range skipped {
+		if len(selected) == n {
+			break
+		}
+		selected = append(selected, addrs[i])
+	}
+	return selected
+}
+
 func (dht *dht) AddPeerAddress(peerAddr protocol.PeerAddress) error {
 	dht.inMemCacheMu.Lock()
 	defer dht.inMemCacheMu.Unlock()
@@ -169,6 +485,12 @@ func (dht *dht) UpdatePeerAddress(peerAddr protocol.PeerAddress) (bool, error) {
 	if ok && !peerAddr.IsNewer(prevPeerAddr) {
 		return false, nil
 	}
+	if !ok && dht.observer && !dht.isObservedPeer(peerAddr.PeerID()) {
+		return false, nil
+	}
+	if !ok && (dht.isSubnetFullWithoutLock(peerAddr) || dht.isBucketFullWithoutLock(peerAddr)) && !dht.isObservedPeer(peerAddr.PeerID()) {
+		return false, nil
+	}
 
 	err := dht.addPeerAddressWithoutLock(peerAddr)
 	return err == nil, err
@@ -178,14 +500,115 @@ func (dht *dht) RemovePeerAddress(id protocol.PeerID) error {
 	dht.inMemCacheMu.Lock()
 	defer dht.inMemCacheMu.Unlock()
 
-	if err := dht.store.Delete(id.String()); err != nil {
-		return fmt.Errorf("error deleting peer=%v from dht: %v", id, err)
+	return dht.removePeerAddressWithoutLock(id)
+}
+
+func (dht *dht) removePeerAddressWithoutLock(id protocol.PeerID) error {
+	if dht.store != nil {
+		if err := dht.store.Delete(id.String()); err != nil {
+			return fmt.Errorf("error deleting peer=%v from dht: %v", id, err)
+		}
 	}
 
+	peerAddr, ok := dht.inMemCache[id.String()]
+	if ok {
+		dht.untrackSubnetWithoutLock(peerAddr)
+		dht.buckets.remove(id)
+	}
 	delete(dht.inMemCache, id.String())
+	dht.seenMu.Lock()
+	delete(dht.seen, id.String())
+	dht.seenMu.Unlock()
+	atomic.AddUint64(&dht.version, 1)
+	if ok {
+		dht.subscribers.notify(PeerChange{Kind: PeerRemoved, PeerID: id, PeerAddress: peerAddr})
+	}
 	return nil
 }
 
+func (dht *dht) Seen(id protocol.PeerID) {
+	dht.inMemCacheMu.RLock()
+	defer dht.inMemCacheMu.RUnlock()
+
+	if _, ok := dht.inMemCache[id.String()]; !ok {
+		return
+	}
+	dht.seenMu.Lock()
+	defer dht.seenMu.Unlock()
+
+	dht.seen[id.String()] = time.Now()
+}
+
+func (dht *dht) LastSeen(id protocol.PeerID) (time.Time, error) {
+	dht.inMemCacheMu.RLock()
+	defer dht.inMemCacheMu.RUnlock()
+
+	if _, ok := dht.inMemCache[id.String()]; !ok {
+		return time.Time{}, NewErrPeerNotFound(id)
+	}
+	dht.seenMu.Lock()
+	defer dht.seenMu.Unlock()
+
+	return dht.seen[id.String()], nil
+}
+
+func (dht *dht) RecentPeerAddresses(n int) (protocol.PeerAddresses, error) {
+	if n <= 0 {
+		return protocol.PeerAddresses{}, nil
+	}
+
+	dht.inMemCacheMu.RLock()
+	defer dht.inMemCacheMu.RUnlock()
+
+	type recentPeer struct {
+		peerAddr protocol.PeerAddress
+		seen     time.Time
+	}
+	recent := make([]recentPeer, 0, len(dht.inMemCache))
+	dht.seenMu.Lock()
+	for key, peerAddr := range dht.inMemCache {
+		recent = append(recent, recentPeer{peerAddr: peerAddr, seen: dht.seen[key]})
+	}
+	dht.seenMu.Unlock()
+
+	sort.Slice(recent, func(i, j int) bool {
+		return recent[i].seen.After(recent[j].seen)
+	})
+	if len(recent) > n {
+		recent = recent[:n]
+	}
+	peerAddrs := make(protocol.PeerAddresses, len(recent))
+	for i := range recent {
+		peerAddrs[i] = recent[i].peerAddr
+	}
+	return peerAddrs, nil
+}
+
+func (dht *dht) RemoveStalePeers(since time.Time) (protocol.PeerIDs, error) {
+	dht.inMemCacheMu.Lock()
+	defer dht.inMemCacheMu.Unlock()
+
+	stale := protocol.PeerIDs{}
+	dht.seenMu.Lock()
+	for _, peerAddr := range dht.inMemCache {
+		id := peerAddr.PeerID()
+		if _, ok := dht.bootstrapIDs[id.String()]; ok {
+			continue
+		}
+		if dht.seen[id.String()].Before(since) {
+			stale = append(stale, id)
+		}
+	}
+	dht.seenMu.Unlock()
+
+	for i, id := range stale {
+		if err := dht.removePeerAddressWithoutLock(id); err != nil {
+			return stale[:i], err
+		}
+	}
+	return stale, nil
+}
+
 func (dht *dht) AddGroup(id protocol.GroupID, ids protocol.PeerIDs) error {
 	if id.Equal(protocol.NilGroupID) {
 		return protocol.ErrInvalidGroupID
@@ -195,6 +618,7 @@ func (dht *dht) AddGroup(id protocol.GroupID, ids protocol.PeerIDs) error {
 	defer dht.groupsMu.Unlock()
 
 	dht.groups[id] = ids
+	atomic.AddUint64(&dht.version, 1)
 	return nil
 }
 
@@ -214,13 +638,7 @@ func (dht *dht) GroupIDs(groupID protocol.GroupID) (protocol.PeerIDs, error) {
 	dht.groupsMu.RLock()
 	defer dht.groupsMu.RUnlock()
 
-	peerIDs, ok := dht.groups[groupID]
-	if !ok {
-		return nil, NewErrGroupNotFound(groupID)
-	}
-	peerIDsCopy := make([]protocol.PeerID, len(peerIDs))
-	copy(peerIDsCopy, peerIDs)
-	return peerIDsCopy, nil
+	return dht.groupIDsWithoutLock(groupID)
 }
 
 func (dht *dht) GroupAddresses(groupID protocol.GroupID) (protocol.PeerAddresses, error) {
@@ -228,25 +646,54 @@ func (dht *dht) GroupAddresses(groupID protocol.GroupID) (protocol.PeerAddresses
 		return dht.PeerAddresses()
 	}
 
-	ids, err := dht.GroupIDs(groupID)
+	info, err := dht.GroupInfo(groupID)
 	if err != nil {
 		return nil, err
 	}
-	addrs := make([]protocol.PeerAddress, 0, len(ids))
+	return info.Addresses, nil
+}
+
+func (dht *dht) GroupInfo(groupID protocol.GroupID) (GroupInfo, error) {
+	// The locks are taken in the same order as UpdatePeerAddress takes them.
 	dht.inMemCacheMu.RLock()
 	defer dht.inMemCacheMu.RUnlock()
+	dht.groupsMu.RLock()
+	defer dht.groupsMu.RUnlock()
+
+	info := GroupInfo{
+		GroupID: groupID,
+		Missing: protocol.PeerIDs{},
+		Version: atomic.LoadUint64(&dht.version),
+	}
+	if groupID.Equal(protocol.NilGroupID) {
+		info.Members = make(protocol.PeerIDs, 0, len(dht.inMemCache))
+		info.Addresses = make(protocol.PeerAddresses, 0, len(dht.inMemCache))
+		for _, addr := range dht.inMemCache {
+			info.Members = append(info.Members, addr.PeerID())
+			info.Addresses = append(info.Addresses, addr)
+		}
+		return info, nil
+	}
+
+	ids, err := dht.groupIDsWithoutLock(groupID)
+	if err != nil {
+		return GroupInfo{}, err
+	}
+	info.Members = ids
+	info.Addresses = make(protocol.PeerAddresses, 0, len(ids))
 	for _, id := range ids {
 		if id.Equal(dht.me.PeerID()) {
-			addrs = append(addrs, dht.me)
+			info.Addresses = append(info.Addresses, dht.me)
 			continue
 		}
 		addr, ok := dht.inMemCache[id.String()]
 		if !ok {
+			info.Missing = append(info.Missing, id)
 			continue
 		}
-		addrs = append(addrs, addr)
+		info.Addresses = append(info.Addresses, addr)
 	}
-	return addrs, nil
+	return info, nil
 }
 
 func (dht *dht) RemoveGroup(id protocol.GroupID) {
@@ -254,6 +701,122 @@ func (dht *dht) RemoveGroup(id protocol.GroupID) {
 	defer dht.groupsMu.Unlock()
 
 	delete(dht.groups, id)
+	delete(dht.subgroups, id)
+	for parent := range dht.subgroups {
+		dht.removeSubgroupWithoutLock(parent, id)
+	}
+	atomic.AddUint64(&dht.version, 1)
+}
+
+func (dht *dht) AddSubgroup(parent, child protocol.GroupID) error {
+	if parent.Equal(protocol.NilGroupID) || child.Equal(protocol.NilGroupID) {
+		return protocol.ErrInvalidGroupID
+	}
+	if parent.Equal(child) {
+		return NewErrGroupCycle(parent, child)
+	}
+
+	dht.groupsMu.Lock()
+	defer dht.groupsMu.Unlock()
+
+	for _, descendant := range dht.descendantsWithoutLock(child) {
+		if descendant.Equal(parent) {
+			return NewErrGroupCycle(parent, child)
+		}
+	}
+	for _, subgroup := range dht.subgroups[parent] {
+		if subgroup.Equal(child) {
+			return nil
+		}
+	}
+	dht.subgroups[parent] = append(dht.subgroups[parent], child)
+	atomic.AddUint64(&dht.version, 1)
+	return nil
+}
+
+func (dht *dht) Subgroups(id protocol.GroupID) []protocol.GroupID {
+	dht.groupsMu.RLock()
+	defer dht.groupsMu.RUnlock()
+
+	subgroups := make([]protocol.GroupID, len(dht.subgroups[id]))
+	copy(subgroups, dht.subgroups[id])
+	return subgroups
+}
+
+func (dht *dht) RemoveSubgroup(parent, child protocol.GroupID) {
+	dht.groupsMu.Lock()
+	defer dht.groupsMu.Unlock()
+
+	dht.removeSubgroupWithoutLock(parent, child)
+	atomic.AddUint64(&dht.version, 1)
+}
+
+func (dht *dht) removeSubgroupWithoutLock(parent, child protocol.GroupID) {
+	subgroups := dht.subgroups[parent]
+	for i := range subgroups {
+		if subgroups[i].Equal(child) {
+			subgroups = append(subgroups[:i], subgroups[i+1:]...)
+			break
+		}
+	}
+	if len(subgroups) == 0 {
+		delete(dht.subgroups, parent)
+		return
+	}
+	dht.subgroups[parent] = subgroups
+}
+
+// groupIDsWithoutLock returns the PeerIDs in the group, and in all of its
+// subgroups (see GroupIDs). The group must not be the NilGroupID.
+func (dht *dht) groupIDsWithoutLock(groupID protocol.GroupID) (protocol.PeerIDs, error) {
+	peerIDs, ok := dht.groups[groupID]
+	if !ok && len(dht.subgroups[groupID]) == 0 {
+		return nil, NewErrGroupNotFound(groupID)
+	}
+	peerIDsCopy := make([]protocol.PeerID, len(peerIDs))
+	copy(peerIDsCopy, peerIDs)
+
+	// Add the members of all subgroups that are not already in the group.
+	descendants := dht.descendantsWithoutLock(groupID)
+	if len(descendants) == 0 {
+		return peerIDsCopy, nil
+	}
+	seen := make(map[string]struct{}, len(peerIDsCopy))
+	for _, id := range peerIDsCopy {
+		seen[id.String()] = struct{}{}
+	}
+	for _, descendant := range descendants {
+		for _, id := range dht.groups[descendant] {
+			if _, ok := seen[id.String()]; ok {
+				continue
+			}
+			seen[id.String()] = struct{}{}
+			peerIDsCopy = append(peerIDsCopy, id)
+		}
+	}
+	return peerIDsCopy, nil
+}
+
+// descendantsWithoutLock returns all subgroups of the group, and their
+// subgroups, in breadth-first order. Each group is only returned once, even if
+// it is reachable through more than one parent.
+func (dht *dht) descendantsWithoutLock(id protocol.GroupID) []protocol.GroupID {
+	descendants := []protocol.GroupID{}
+	visited := map[protocol.GroupID]struct{}{id: {}}
+	queue := []protocol.GroupID{id}
+	for len(queue) > 0 {
+		next := queue[0]
+		queue = queue[1:]
+		for _, subgroup := range dht.subgroups[next] {
+			if _, ok := visited[subgroup]; ok {
+				continue
+			}
+			visited[subgroup] = struct{}{}
+			descendants = append(descendants, subgroup)
+			queue = append(queue, subgroup)
+		}
+	}
+	return descendants
 }
 
 func (dht *dht) addPeerAddressWithoutLock(peerAddr protocol.PeerAddress) error {
@@ -261,31 +824,150 @@ func (dht *dht) addPeerAddressWithoutLock(peerAddr protocol.PeerAddress) error {
 	if err != nil {
 		return fmt.Errorf("error encoding peer address=%v: %v", peerAddr, err)
 	}
-	if err := dht.store.Insert(peerAddr.PeerID().String(), data); err != nil {
-		return fmt.Errorf("error inserting peer address=%v into dht: %v", peerAddr, err)
+	if dht.store != nil {
+		if err := dht.store.Insert(peerAddr.PeerID().String(), data); err != nil {
+			return fmt.Errorf("error inserting peer address=%v into dht: %v", peerAddr, err)
+		}
+	}
+	kind := PeerAdded
+	if prevPeerAddr, ok := dht.inMemCache[peerAddr.PeerID().String()]; ok {
+		dht.untrackSubnetWithoutLock(prevPeerAddr)
+		kind = PeerUpdated
+	} else {
+		// New peers are given the full window to be seen before they are
+		// stale
+		dht.seenMu.Lock()
+		dht.seen[peerAddr.PeerID().String()] = time.Now()
+		dht.seenMu.Unlock()
 	}
 	dht.inMemCache[peerAddr.PeerID().String()] = peerAddr
+	dht.trackSubnetWithoutLock(peerAddr)
+	dht.buckets.add(peerAddr.PeerID())
+	atomic.AddUint64(&dht.version, 1)
+	dht.subscribers.notify(PeerChange{Kind: kind, PeerID: peerAddr.PeerID(), PeerAddress: peerAddr})
 	return nil
 }
 
+func (dht *dht) subnet(peerAddr protocol.PeerAddress) (string, bool) {
+	return protocol.Subnet(peerAddr.NetworkAddress(), dht.options.SubnetPrefixIPv4, dht.options.SubnetPrefixIPv6)
+}
+
+// isSubnetFullWithoutLock returns true if the DHT already has MaxPeersPerSubnet
+// peers from the subnet of the peer address.
+func (dht *dht) isSubnetFullWithoutLock(peerAddr protocol.PeerAddress) bool {
+	if dht.options.MaxPeersPerSubnet <= 0 {
+		return false
+	}
+	subnet, ok := dht.subnet(peerAddr)
+	return ok && dht.subnets[subnet] >= dht.options.MaxPeersPerSubnet
+}
+
+// isBucketFullWithoutLock returns true if the DHT already has BucketSize peers
+// in the k-bucket of the peer address.
+func (dht *dht) isBucketFullWithoutLock(peerAddr protocol.PeerAddress) bool {
+	return dht.options.BucketSize > 0 && dht.buckets.size(peerAddr.PeerID()) >= dht.options.BucketSize
+}
+
+func (dht *dht) trackSubnetWithoutLock(peerAddr protocol.PeerAddress) {
+	if dht.options.MaxPeersPerSubnet <= 0 {
+		return
+	}
+	if subnet, ok := dht.subnet(peerAddr); ok {
+		dht.subnets[subnet]++
+	}
+}
+
+func (dht *dht) untrackSubnetWithoutLock(peerAddr protocol.PeerAddress) {
+	if dht.options.MaxPeersPerSubnet <= 0 {
+		return
+	}
+	if subnet, ok := dht.subnet(peerAddr); ok {
+		if dht.subnets[subnet]--; dht.subnets[subnet] <= 0 {
+			delete(dht.subnets, subnet)
+		}
+	}
+}
+
+// fillInMemCache with the records in the store, after migrating them to the
+// SchemaVersion of the DHT.
 func (dht *dht) fillInMemCache() error {
-	iter := dht.store.Iterator()
-	defer iter.Close()
+	version, err := dht.loadSchemaVersion()
+	if err != nil {
+		return err
+	}
+	if err := dht.checkMigrations(version); err != nil {
+		return err
+	}
 
+	// Records are loaded before they are migrated, because not all stores can
+	// be modified while they are iterated
+	records := []record{}
+	iter := dht.store.Iterator()
 	for iter.Next() {
+		key, err := iter.Key()
+		if err != nil {
+			iter.Close()
+			return fmt.Errorf("error scanning dht iterator: %v", err)
+		}
+		if key == schemaVersionKey {
+			continue
+		}
 		var data []byte
 		if err := iter.Value(&data); err != nil {
+			iter.Close()
 			return fmt.Errorf("error scanning dht iterator: %v", err)
 		}
-		peerAddr, err := dht.codec.Decode(data)
+		records = append(records, record{key: key, data: data})
+	}
+	iter.Close()
+
+	for _, record := range records {
+		data, err := dht.migrate(record.data, version)
+		if err == nil && version < dht.options.SchemaVersion {
+			err = dht.store.Insert(record.key, data)
+		}
+		var peerAddr protocol.PeerAddress
+		if err == nil {
+			peerAddr, err = dht.codec.Decode(data)
+		}
 		if err != nil {
-			return fmt.Errorf("error decoding peerAddress: %v", err)
+			if err := dht.store.Delete(record.key); err != nil && err != kv.ErrKeyNotFound {
+				return fmt.Errorf("error deleting peer=%v from dht: %v", record.key, err)
+			}
+			continue
 		}
 		dht.inMemCache[peerAddr.PeerID().String()] = peerAddr
+		dht.seen[peerAddr.PeerID().String()] = time.Now()
+		dht.trackSubnetWithoutLock(peerAddr)
+		dht.buckets.add(peerAddr.PeerID())
+	}
+
+	if err := dht.store.Insert(schemaVersionKey, dht.options.SchemaVersion); err != nil {
+		return fmt.Errorf("error inserting schema version: %v", err)
 	}
 	return nil
 }
 
+// isObservedPeer returns true if the peer is a bootstrap peer, or a member of
+// any group.
+func (dht *dht) isObservedPeer(id protocol.PeerID) bool {
+	if _, ok := dht.bootstrapIDs[id.String()]; ok {
+		return true
+	}
+
+	dht.groupsMu.RLock()
+	defer dht.groupsMu.RUnlock()
+
+	for _, ids := range dht.groups {
+		for _, member := range ids {
+			if member.Equal(id) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // addBootstrapNodes loops through all the bootstrap nodes, update the store if
 // it is newer than the stored addresses.
 func (dht *dht) addBootstrapNodes(addrs protocol.PeerAddresses) error {
@@ -312,6 +994,10 @@ func NewErrPeerNotFound(peerID protocol.PeerID) error {
 	}
 }
 
+func (err ErrPeerNotFound) Is(target error) bool {
+	return target == protocol.ErrNotFound
+}
+
 type ErrGroupNotFound struct {
 	error
 	protocol.GroupID
@@ -323,3 +1009,25 @@ func NewErrGroupNotFound(groupID protocol.GroupID) error {
 		GroupID: groupID,
 	}
 }
+
+func (err ErrGroupNotFound) Is(target error) bool {
+	return target == protocol.ErrNotFound
+}
+
+type ErrGroupCycle struct {
+	error
+	Parent protocol.GroupID
+	Child  protocol.GroupID
+}
+
+func NewErrGroupCycle(parent, child protocol.GroupID) error {
+	return ErrGroupCycle{
+		error:  fmt.Errorf("peer group=%v cannot be a subgroup of peer group=%v: cycle detected", child, parent),
+		Parent: parent,
+		Child:  child,
+	}
+}
+
+func (err ErrGroupCycle) Is(target error) bool {
+	return target == protocol.ErrInvalid
+}
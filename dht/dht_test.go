@@ -1,6 +1,9 @@
 package dht_test
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"math/rand"
 	"testing/quick"
 	"time"
@@ -116,6 +119,68 @@ var _ = Describe("DHT", func() {
 		})
 	})
 
+	Context("when the schema of the store changes", func() {
+		// migration sets the nonce of every record to one
+		migration := func(data []byte) ([]byte, error) {
+			record := map[string]interface{}{}
+			if err := json.Unmarshal(data, &record); err != nil {
+				return nil, err
+			}
+			record["nonce"] = 1
+			return json.Marshal(record)
+		}
+
+		It("should migrate old records when loading the store", func() {
+			me, addrs := RandomAddress(), RandomAddresses(rand.Intn(32)+1)
+			store := NewTable("dht")
+			_ = NewDHT(me, store, addrs)
+			Expect(store.Insert(RandomPeerID().String(), []byte("corrupted"))).To(Succeed())
+
+			options := Options{SchemaVersion: 2, Migrations: map[int]Migration{1: migration}}
+			dht, err := NewWithOptions(options, me, NewSimpleTCPPeerAddressCodec(), store)
+			Expect(err).NotTo(HaveOccurred())
+
+			// Records that cannot be migrated are deleted
+			loaded, err := dht.PeerAddresses()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(loaded).To(HaveLen(len(addrs)))
+			for _, addr := range addrs {
+				migrated := addr.(SimpleTCPPeerAddress)
+				migrated.Nonce = 1
+				Expect(loaded).To(ContainElement(migrated))
+			}
+
+			// Migrated records are not migrated again
+			options.Migrations = nil
+			dht, err = NewWithOptions(options, me, NewSimpleTCPPeerAddressCodec(), store)
+			Expect(err).NotTo(HaveOccurred())
+			num, err := dht.NumPeers()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(num).To(Equal(len(addrs)))
+		})
+
+		It("should return an error when a migration is missing", func() {
+			me := RandomAddress()
+			store := NewTable("dht")
+			_ = NewDHT(me, store, RandomAddresses(4))
+
+			options := Options{SchemaVersion: 3, Migrations: map[int]Migration{1: migration}}
+			_, err := NewWithOptions(options, me, NewSimpleTCPPeerAddressCodec(), store)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should return an error when the store is from a newer version", func() {
+			me := RandomAddress()
+			store := NewTable("dht")
+			options := Options{SchemaVersion: 2}
+			_, err := NewWithOptions(options, me, NewSimpleTCPPeerAddressCodec(), store, RandomAddresses(4)...)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = New(me, NewSimpleTCPPeerAddressCodec(), store)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
 	Context("when adding, updating and deleting addresses", func() {
 		It("should be able to add and delete new addresses to dht", func() {
 			test := func() bool {
@@ -125,6 +190,7 @@ var _ = Describe("DHT", func() {
 				newAddr := RandomAddress()
 				queriedAddr, err := dht.PeerAddress(newAddr.PeerID())
 				Expect(err).Should(HaveOccurred())
+				Expect(errors.Is(err, protocol.ErrNotFound)).Should(BeTrue())
 
 				Expect(dht.AddPeerAddress(newAddr)).NotTo(HaveOccurred())
 				queriedAddr, err = dht.PeerAddress(newAddr.PeerID())
@@ -156,6 +222,20 @@ var _ = Describe("DHT", func() {
 			Expect(quick.Check(test, nil)).Should(BeNil())
 		})
 
+		It("should update its own address, but not its PeerID", func() {
+			me := RandomAddress()
+			dht := NewExtendedDHT(me, NewTable("dht"), nil)
+
+			readdressed := me
+			readdressed.IPAddress, readdressed.Nonce = "1.2.3.4", me.Nonce+1
+			Expect(dht.UpdateMe(readdressed)).To(Succeed())
+			Expect(dht.Me()).To(Equal(readdressed))
+
+			Expect(dht.UpdateMe(RandomAddress())).NotTo(Succeed())
+			Expect(dht.UpdateMe(nil)).NotTo(Succeed())
+			Expect(dht.Me()).To(Equal(readdressed))
+		})
+
 		It("should be able to update a PeerAddress and return a boolean showing whether the address is newer", func() {
 			test := func() bool {
 				dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
@@ -179,6 +259,101 @@ var _ = Describe("DHT", func() {
 			Expect(quick.Check(test, nil)).NotTo(HaveOccurred())
 		})
 
+		It("should notify subscribers when addresses are added, updated and removed", func() {
+			dht := NewExtendedDHT(RandomAddress(), NewTable("dht"), nil)
+			changes := make(chan PeerChange, 8)
+			unsubscribe := dht.Subscribe(changes)
+
+			added := RandomAddress()
+			Expect(dht.AddPeerAddress(added)).To(Succeed())
+			addr := added
+			addr.Nonce = time.Now().Unix()
+			ok, err := dht.UpdatePeerAddress(addr)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ok).To(BeTrue())
+
+			// Addresses that are not newer do not change the dht
+			ok, err = dht.UpdatePeerAddress(addr)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ok).To(BeFalse())
+			Expect(dht.RemovePeerAddress(addr.PeerID())).To(Succeed())
+
+			// Removing an address that the dht does not have is not a change
+			Expect(dht.RemovePeerAddress(addr.PeerID())).To(Succeed())
+
+			expected := []PeerChange{
+				{Kind: PeerAdded, PeerID: addr.PeerID(), PeerAddress: added},
+				{Kind: PeerUpdated, PeerID: addr.PeerID(), PeerAddress: addr},
+				{Kind: PeerRemoved, PeerID: addr.PeerID(), PeerAddress: addr},
+			}
+			for _, change := range expected {
+				Expect(changes).To(Receive(Equal(change)))
+			}
+			Expect(changes).To(BeEmpty())
+
+			unsubscribe()
+			Expect(dht.AddPeerAddress(RandomAddress())).To(Succeed())
+			Expect(changes).To(BeEmpty())
+		})
+
+		It("should remove the peers that have not been seen, except bootstrap peers", func() {
+			addrs := RandomAddresses(5)
+			me, bootstrap, seen, stale := addrs[0], addrs[1], addrs[2], addrs[3:]
+			dht := NewExtendedDHT(me, NewTable("dht"), protocol.PeerAddresses{bootstrap})
+			for _, addr := range append(protocol.PeerAddresses{seen}, stale...) {
+				Expect(dht.AddPeerAddress(addr)).To(Succeed())
+			}
+			added, err := dht.LastSeen(seen.PeerID())
+			Expect(err).NotTo(HaveOccurred())
+
+			time.Sleep(10 * time.Millisecond)
+			since := time.Now()
+			dht.Seen(seen.PeerID())
+			lastSeen, err := dht.LastSeen(seen.PeerID())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(lastSeen.After(added)).To(BeTrue())
+
+			removed, err := dht.RemoveStalePeers(since)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(removed).To(ConsistOf(stale[0].PeerID(), stale[1].PeerID()))
+			for _, addr := range stale {
+				_, err := dht.PeerAddress(addr.PeerID())
+				Expect(err).To(HaveOccurred())
+				_, err = dht.LastSeen(addr.PeerID())
+				Expect(err).To(HaveOccurred())
+			}
+			num, err := dht.NumPeers()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(num).To(Equal(2))
+
+			// Peers that are not in the dht are not seen
+			dht.Seen(stale[0].PeerID())
+			_, err = dht.LastSeen(stale[0].PeerID())
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should return the peers that have been seen most recently first", func() {
+			addrs := RandomAddresses(4)
+			dht := NewExtendedDHT(addrs[0], NewTable("dht"), nil)
+			for _, addr := range addrs[1:] {
+				Expect(dht.AddPeerAddress(addr)).To(Succeed())
+				time.Sleep(time.Millisecond)
+			}
+			dht.Seen(addrs[1].PeerID())
+
+			recent, err := dht.RecentPeerAddresses(2)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(recent).To(Equal(protocol.PeerAddresses{addrs[1], addrs[3]}))
+
+			recent, err = dht.RecentPeerAddresses(10)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(recent).To(Equal(protocol.PeerAddresses{addrs[1], addrs[3], addrs[2]}))
+
+			recent, err = dht.RecentPeerAddresses(0)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(recent).To(BeEmpty())
+		})
+
 		Context("when calling different functions concurrently", func() {
 			It("should be concurrent safe to use", func() {
 				addAndDelete := func(dht DHT) error {
@@ -337,6 +512,73 @@ var _ = Describe("DHT", func() {
 			Expect(quick.Check(test, nil)).NotTo(HaveOccurred())
 		})
 
+		It("should return the members, the resolved addresses, and the missing members of a group", func() {
+			test := func() bool {
+				// Take our own address from the same addresses, so that it
+				// cannot have the PeerID of a member.
+				peerAddrs := RandomAddresses(rand.Intn(32) + 2)
+				dht := NewExtendedDHT(peerAddrs[0], NewTable("dht"), nil)
+				peerAddrs = peerAddrs[1:]
+				ids := FromAddressesToIDs(peerAddrs)
+
+				// Purposely not adding the last PeerAddress
+				for i := range peerAddrs[:len(peerAddrs)-1] {
+					Expect(dht.AddPeerAddress(peerAddrs[i])).NotTo(HaveOccurred())
+				}
+				groupID := RandomGroupID()
+				Expect(dht.AddGroup(groupID, ids)).NotTo(HaveOccurred())
+
+				info, err := dht.GroupInfo(groupID)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(info.GroupID).Should(Equal(groupID))
+				Expect(info.Members).Should(ConsistOf(ids))
+				Expect(info.Addresses).Should(ConsistOf(peerAddrs[:len(peerAddrs)-1]))
+				Expect(info.Resolved()).Should(Equal(len(peerAddrs) - 1))
+				Expect(info.Missing).Should(ConsistOf(ids[len(ids)-1]))
+
+				// The version only changes when the view changes.
+				same, err := dht.GroupInfo(groupID)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(same.Version).Should(Equal(info.Version))
+				Expect(dht.AddPeerAddress(peerAddrs[len(peerAddrs)-1])).NotTo(HaveOccurred())
+				next, err := dht.GroupInfo(groupID)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(next.Version).ShouldNot(Equal(info.Version))
+				Expect(next.Missing).Should(BeEmpty())
+				Expect(next.Resolved()).Should(Equal(len(peerAddrs)))
+
+				dht.RemoveGroup(groupID)
+				_, err = dht.GroupInfo(groupID)
+				Expect(err).To(HaveOccurred())
+				return true
+			}
+
+			Expect(quick.Check(test, nil)).NotTo(HaveOccurred())
+		})
+
+		It("should return consistent snapshots when the group and addresses change concurrently", func() {
+			dht := NewExtendedDHT(RandomAddress(), NewTable("dht"), nil)
+			groupID, peerAddrs := RandomGroupID(), RandomAddresses(32)
+			peerIDs := FromAddressesToIDs(peerAddrs)
+			Expect(dht.AddGroup(groupID, peerIDs)).NotTo(HaveOccurred())
+
+			phi.ParBegin(func() {
+				for i, peerAddr := range peerAddrs {
+					Expect(dht.AddPeerAddress(peerAddr)).NotTo(HaveOccurred())
+					Expect(dht.AddGroup(groupID, peerIDs[:len(peerIDs)-i])).NotTo(HaveOccurred())
+				}
+			}, func() {
+				for i := 0; i < 100; i++ {
+					info, err := dht.GroupInfo(groupID)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(info.Resolved() + len(info.Missing)).Should(Equal(len(info.Members)))
+					for _, addr := range info.Addresses {
+						Expect(info.Members).Should(ContainElement(addr.PeerID()))
+					}
+				}
+			})
+		})
+
 		It("should be concurrent safe to use Group", func() {
 			test := func() bool {
 				dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
@@ -365,6 +607,277 @@ var _ = Describe("DHT", func() {
 		})
 	})
 
+	Context("when creating, querying and deleting subgroups", func() {
+		It("should return the members of the group and all of its subgroups", func() {
+			test := func() bool {
+				dht := NewExtendedDHT(RandomAddress(), NewTable("dht"), nil)
+				addrs := RandomAddresses(48)
+				for i := range addrs {
+					Expect(dht.AddPeerAddress(addrs[i])).NotTo(HaveOccurred())
+				}
+				ids := FromAddressesToIDs(addrs)
+
+				// Build a hierarchy of region -> datacenter -> shard, where
+				// the last peer of each shard is also in the datacenter.
+				region, datacenter, shard1, shard2 := RandomGroupID(), RandomGroupID(), RandomGroupID(), RandomGroupID()
+				Expect(dht.AddGroup(datacenter, ids[15:17])).NotTo(HaveOccurred())
+				Expect(dht.AddGroup(shard1, ids[:16])).NotTo(HaveOccurred())
+				Expect(dht.AddGroup(shard2, ids[16:32])).NotTo(HaveOccurred())
+				Expect(dht.AddSubgroup(region, datacenter)).NotTo(HaveOccurred())
+				Expect(dht.AddSubgroup(datacenter, shard1)).NotTo(HaveOccurred())
+				Expect(dht.AddSubgroup(datacenter, shard2)).NotTo(HaveOccurred())
+				Expect(dht.Subgroups(datacenter)).Should(Equal([]protocol.GroupID{shard1, shard2}))
+
+				// Every peer should only be returned once
+				for _, groupID := range []protocol.GroupID{region, datacenter} {
+					storedIDs, err := dht.GroupIDs(groupID)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(storedIDs).Should(ConsistOf(ids[:32]))
+					storedAddrs, err := dht.GroupAddresses(groupID)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(storedAddrs).Should(ConsistOf(addrs[:32]))
+				}
+				storedIDs, err := dht.GroupIDs(shard2)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(storedIDs).Should(ConsistOf(ids[16:32]))
+
+				// Remove a subgroup and a group from the hierarchy
+				dht.RemoveSubgroup(datacenter, shard2)
+				storedIDs, err = dht.GroupIDs(region)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(storedIDs).Should(ConsistOf(ids[:17]))
+				dht.RemoveGroup(datacenter)
+				Expect(dht.Subgroups(region)).Should(BeEmpty())
+				_, err = dht.GroupIDs(region)
+				Expect(err).To(HaveOccurred())
+				return true
+			}
+
+			Expect(quick.Check(test, &quick.Config{MaxCount: 10})).NotTo(HaveOccurred())
+		})
+
+		It("should return an error when the subgroup would create a cycle", func() {
+			dht := NewExtendedDHT(RandomAddress(), NewTable("dht"), nil)
+			groupID1, groupID2, groupID3 := RandomGroupID(), RandomGroupID(), RandomGroupID()
+			Expect(dht.AddSubgroup(groupID1, groupID2)).NotTo(HaveOccurred())
+			Expect(dht.AddSubgroup(groupID2, groupID3)).NotTo(HaveOccurred())
+			Expect(dht.AddSubgroup(groupID1, groupID3)).NotTo(HaveOccurred())
+
+			Expect(dht.AddSubgroup(groupID3, groupID1)).To(BeAssignableToTypeOf(ErrGroupCycle{}))
+			Expect(dht.AddSubgroup(groupID2, groupID2)).To(BeAssignableToTypeOf(ErrGroupCycle{}))
+			Expect(errors.Is(dht.AddSubgroup(groupID3, groupID1), protocol.ErrInvalid)).To(BeTrue())
+			Expect(dht.AddSubgroup(protocol.NilGroupID, groupID1)).To(HaveOccurred())
+			Expect(dht.AddSubgroup(groupID1, protocol.NilGroupID)).To(HaveOccurred())
+		})
+	})
+
+	Context("when the dht is an observer", func() {
+		It("should only keep the bootstrap peers and the members of groups", func() {
+			check := func() bool {
+				// Take the addresses from a single set, so that their IDs are
+				// distinct
+				numBootstrap, numGossip, numGroup := rand.Intn(8), rand.Intn(8), rand.Intn(8)+1
+				addrs := RandomAddresses(1 + numBootstrap + numGossip + numGroup)
+				me, addrs := addrs[0], addrs[1:]
+				bootstrapAddrs := addrs[:numBootstrap]
+				gossipAddrs := addrs[numBootstrap : numBootstrap+numGossip]
+				groupAddrs := addrs[numBootstrap+numGossip:]
+				table, err := NewObserver(me, NewSimpleTCPPeerAddressCodec(), bootstrapAddrs...)
+				Expect(err).NotTo(HaveOccurred())
+				numPeers, err := table.NumPeers()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(numPeers).Should(Equal(len(bootstrapAddrs)))
+
+				// Addresses learnt from other peers are ignored
+				for _, addr := range gossipAddrs {
+					updated, err := table.UpdatePeerAddress(addr)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(updated).Should(BeFalse())
+				}
+				numPeers, err = table.NumPeers()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(numPeers).Should(Equal(len(bootstrapAddrs)))
+
+				// Unless they are members of a group
+				Expect(table.AddGroup(RandomGroupID(), FromAddressesToIDs(groupAddrs))).To(Succeed())
+				for _, addr := range groupAddrs {
+					updated, err := table.UpdatePeerAddress(addr)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(updated).Should(BeTrue())
+				}
+				numPeers, err = table.NumPeers()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(numPeers).Should(Equal(len(bootstrapAddrs) + len(groupAddrs)))
+				return true
+			}
+			Expect(quick.Check(check, nil)).Should(BeNil())
+		})
+	})
+
+	Context("when the dht limits the number of peers per subnet", func() {
+		addressInSubnet := func(subnet, host int) protocol.PeerAddress {
+			return NewSimpleTCPPeerAddress(RandomPeerID().String(), fmt.Sprintf("10.0.%v.%v", subnet, host), "8080")
+		}
+
+		It("should not learn more peers from a full subnet", func() {
+			options := Options{MaxPeersPerSubnet: 2}
+			bootstrapAddr := addressInSubnet(1, 1)
+			dht, err := NewWithOptions(options, RandomAddress(), NewSimpleTCPPeerAddressCodec(), NewTable("dht"), bootstrapAddr)
+			Expect(err).NotTo(HaveOccurred())
+
+			// The bootstrap peer counts towards the limit
+			updated, err := dht.UpdatePeerAddress(addressInSubnet(1, 2))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(updated).To(BeTrue())
+			updated, err = dht.UpdatePeerAddress(addressInSubnet(1, 3))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(updated).To(BeFalse())
+
+			// Other subnets are not affected
+			updated, err = dht.UpdatePeerAddress(addressInSubnet(2, 1))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(updated).To(BeTrue())
+
+			// Members of groups, and peers that are added explicitly, are kept
+			member := addressInSubnet(1, 4)
+			Expect(dht.AddGroup(RandomGroupID(), protocol.PeerIDs{member.PeerID()})).To(Succeed())
+			updated, err = dht.UpdatePeerAddress(member)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(updated).To(BeTrue())
+			explicit := addressInSubnet(1, 5)
+			Expect(dht.AddPeerAddress(explicit)).To(Succeed())
+			numPeers, err := dht.NumPeers()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(numPeers).To(Equal(5))
+
+			// Removing peers makes room in the subnet
+			for _, id := range []protocol.PeerID{bootstrapAddr.PeerID(), member.PeerID(), explicit.PeerID()} {
+				Expect(dht.RemovePeerAddress(id)).To(Succeed())
+			}
+			updated, err = dht.UpdatePeerAddress(addressInSubnet(1, 6))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(updated).To(BeTrue())
+		})
+
+		It("should prefer random peers from different subnets", func() {
+			test := func() bool {
+				options := Options{MaxPeersPerSubnet: 1}
+				dht, err := NewWithOptions(options, RandomAddress(), NewSimpleTCPPeerAddressCodec(), NewTable("dht"))
+				Expect(err).NotTo(HaveOccurred())
+				for subnet := 0; subnet < 4; subnet++ {
+					for host := 0; host < 8; host++ {
+						Expect(dht.AddPeerAddress(addressInSubnet(subnet, host))).To(Succeed())
+					}
+				}
+
+				addrs, err := dht.RandomPeerAddresses(protocol.NilGroupID, 4)
+				Expect(err).NotTo(HaveOccurred())
+				subnets := map[string]bool{}
+				for _, addr := range addrs {
+					subnets[addr.(SimpleTCPPeerAddress).IPAddress[:len("10.0.0")]] = true
+				}
+				Expect(subnets).To(HaveLen(4))
+
+				// Peers from the same subnet are returned when there are not
+				// enough peers from other subnets
+				addrs, err = dht.RandomPeerAddresses(protocol.NilGroupID, 6)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(addrs).To(HaveLen(6))
+				return true
+			}
+
+			Expect(quick.Check(test, &quick.Config{MaxCount: 10})).NotTo(HaveOccurred())
+		})
+	})
+
+	Context("when the dht organises peers in k-buckets", func() {
+		It("should return the closest peers to any target", func() {
+			test := func() bool {
+				dht := NewExtendedDHT(RandomAddress(), NewTable("dht"), nil)
+				addrs := RandomAddresses(64)
+				for i := range addrs {
+					Expect(dht.AddPeerAddress(addrs[i])).To(Succeed())
+				}
+
+				target := RandomPeerID()
+				if rand.Intn(2) == 0 {
+					target = addrs[rand.Intn(len(addrs))].PeerID()
+				}
+				n := rand.Intn(len(addrs)+8) + 1
+				closest, err := dht.ClosestPeerAddresses(target, n)
+				Expect(err).NotTo(HaveOccurred())
+
+				expected := append(protocol.PeerAddresses{}, addrs...)
+				SortByDistance(target, expected)
+				if len(expected) > n {
+					expected = expected[:n]
+				}
+				Expect(closest).To(Equal(expected))
+				return true
+			}
+
+			Expect(quick.Check(test, nil)).NotTo(HaveOccurred())
+		})
+
+		It("should not learn more peers into a full bucket", func() {
+			me := RandomAddress()
+			options := Options{BucketSize: 2}
+			dht, err := NewWithOptions(options, me, NewSimpleTCPPeerAddressCodec(), NewTable("dht"))
+			Expect(err).NotTo(HaveOccurred())
+
+			// About half of all peers are in the furthest bucket
+			furthest := protocol.PeerAddresses{}
+			for len(furthest) < 4 {
+				addr := RandomAddress()
+				if CommonPrefixLength(me.PeerID(), addr.PeerID()) == 0 {
+					furthest = append(furthest, addr)
+				}
+			}
+			for i, addr := range furthest {
+				updated, err := dht.UpdatePeerAddress(addr)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(updated).To(Equal(i < 2))
+			}
+
+			// Peers that are added explicitly are kept, and removing peers
+			// makes room in the bucket
+			Expect(dht.AddPeerAddress(furthest[2])).To(Succeed())
+			Expect(dht.RemovePeerAddress(furthest[0].PeerID())).To(Succeed())
+			Expect(dht.RemovePeerAddress(furthest[1].PeerID())).To(Succeed())
+			updated, err := dht.UpdatePeerAddress(furthest[3])
+			Expect(err).NotTo(HaveOccurred())
+			Expect(updated).To(BeTrue())
+		})
+
+		It("should prefer close peers when returning random peers", func() {
+			me := RandomAddress()
+			options := Options{PreferClosePeers: true}
+			dht, err := NewWithOptions(options, me, NewSimpleTCPPeerAddressCodec(), NewTable("dht"))
+			Expect(err).NotTo(HaveOccurred())
+			addrs := RandomAddresses(64)
+			for i := range addrs {
+				Expect(dht.AddPeerAddress(addrs[i])).To(Succeed())
+			}
+
+			// The first peer is always from the closest bucket
+			closest, err := dht.ClosestPeerAddresses(me.PeerID(), 1)
+			Expect(err).NotTo(HaveOccurred())
+			for i := 0; i < 16; i++ {
+				randAddrs, err := dht.RandomPeerAddresses(protocol.NilGroupID, 4)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(randAddrs).To(HaveLen(4))
+				Expect(CommonPrefixLength(me.PeerID(), randAddrs[0].PeerID())).To(Equal(CommonPrefixLength(me.PeerID(), closest[0].PeerID())))
+			}
+		})
+
+		It("should compute the length of the common prefix of peers", func() {
+			a, b := RandomPeerID(), RandomPeerID()
+			Expect(CommonPrefixLength(a, a)).To(Equal(256))
+			Expect(CommonPrefixLength(a, b)).To(Equal(CommonPrefixLength(b, a)))
+			Expect(CommonPrefixLength(a, b)).To(BeNumerically("<", 256))
+		})
+	})
+
 	Context("when retrieving random addresses from the dht", func() {
 		Context("when not specifying a group id", func() {
 			It("should be able to return specific number of random address in the dht", func() {
@@ -430,4 +943,63 @@ var _ = Describe("DHT", func() {
 			})
 		})
 	})
+
+	Context("when extending a DHT that is not an ExtendedDHT", func() {
+		It("should return ExtendedDHTs as they are", func() {
+			table := NewExtendedDHT(RandomAddress(), NewTable("dht"), nil)
+			Expect(Extend(table)).To(Equal(table))
+		})
+
+		It("should compute the closest peers and the groups from the DHT", func() {
+			table := Extend(baseDHT{NewDHT(RandomAddress(), NewTable("dht"), nil)})
+			groupID, addrs, err := NewGroup(table)
+			Expect(err).NotTo(HaveOccurred())
+
+			target := RandomPeerID()
+			closest, err := table.ClosestPeerAddresses(target, 8)
+			Expect(err).NotTo(HaveOccurred())
+			expected := append(protocol.PeerAddresses{}, addrs...)
+			SortByDistance(target, expected)
+			if len(expected) > 8 {
+				expected = expected[:8]
+			}
+			Expect(closest).To(Equal(expected))
+
+			info, err := table.GroupInfo(groupID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.Members).To(ConsistOf(FromAddressesToIDs(addrs)))
+			Expect(info.Addresses).To(HaveLen(len(addrs)))
+			Expect(info.Missing).To(BeEmpty())
+		})
+
+		It("should not support the features that need an ExtendedDHT", func() {
+			me := RandomAddress()
+			table := Extend(baseDHT{NewDHT(me, NewTable("dht"), nil)})
+			Expect(table.UpdateMe(me)).NotTo(Succeed())
+			Expect(table.AddSubgroup(RandomGroupID(), RandomGroupID())).NotTo(Succeed())
+
+			addr := RandomAddress()
+			Expect(table.AddPeerAddress(addr)).To(Succeed())
+			table.Seen(addr.PeerID())
+			_, err := table.LastSeen(addr.PeerID())
+			Expect(err).To(HaveOccurred())
+			recent, err := table.RecentPeerAddresses(8)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(recent).To(BeEmpty())
+			stale, err := table.RemoveStalePeers(time.Now())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stale).To(BeEmpty())
+
+			changes := make(chan PeerChange, 1)
+			unsubscribe := table.Subscribe(changes)
+			defer unsubscribe()
+			Expect(table.RemovePeerAddress(addr.PeerID())).To(Succeed())
+			Consistently(changes).ShouldNot(Receive())
+		})
+	})
 })
+
+// baseDHT hides the methods of an ExtendedDHT, so that it is only a DHT.
+type baseDHT struct {
+	DHT
+}
@@ -0,0 +1,50 @@
+package dht
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"math/bits"
+	"sort"
+
+	"github.com/renproject/aw/protocol"
+)
+
+// Distance returns the XOR distance between two PeerIDs. PeerIDs are hashed
+// using SHA256 before they are compared, so that distances are uniformly
+// distributed regardless of the format of the PeerIDs.
+func Distance(a, b protocol.PeerID) [32]byte {
+	hashA := sha256.Sum256([]byte(a.String()))
+	hashB := sha256.Sum256([]byte(b.String()))
+	distance := [32]byte{}
+	for i := range distance {
+		distance[i] = hashA[i] ^ hashB[i]
+	}
+	return distance
+}
+
+// SortByDistance sorts the peer addresses from the closest to the furthest
+// from the target PeerID.
+func SortByDistance(target protocol.PeerID, addrs protocol.PeerAddresses) {
+	distances := make(map[string][32]byte, len(addrs))
+	for _, addr := range addrs {
+		distances[addr.PeerID().String()] = Distance(target, addr.PeerID())
+	}
+	sort.SliceStable(addrs, func(i, j int) bool {
+		di := distances[addrs[i].PeerID().String()]
+		dj := distances[addrs[j].PeerID().String()]
+		return bytes.Compare(di[:], dj[:]) < 0
+	})
+}
+
+// CommonPrefixLength returns the number of leading bits that the hashes of two
+// PeerIDs have in common (see Distance). It is 256 when the PeerIDs are equal,
+// and the longer it is, the closer the PeerIDs are.
+func CommonPrefixLength(a, b protocol.PeerID) int {
+	distance := Distance(a, b)
+	for i, d := range distance {
+		if d != 0 {
+			return i*8 + bits.LeadingZeros8(d)
+		}
+	}
+	return len(distance) * 8
+}
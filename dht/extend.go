@@ -0,0 +1,110 @@
+package dht
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/renproject/aw/protocol"
+)
+
+// Extend returns the DHT as an ExtendedDHT. DHTs that are not ExtendedDHTs
+// (e.g. those implemented outside of this package) are wrapped, so that the
+// subsystems that use the features of an ExtendedDHT degrade gracefully. The
+// closest peers, and the information of groups, are computed from the
+// PeerAddresses and the groups of the DHT. Peers are never seen, stale or
+// recent, and changes are never published. Subgroups, and updates of the
+// PeerAddress of this peer, are not supported.
+func Extend(dht DHT) ExtendedDHT {
+	if extended, ok := dht.(ExtendedDHT); ok {
+		return extended
+	}
+	return extendedDHT{dht}
+}
+
+// extendedDHT wraps a DHT that is not an ExtendedDHT (see Extend).
+type extendedDHT struct {
+	DHT
+}
+
+func (dht extendedDHT) UpdateMe(protocol.PeerAddress) error {
+	return fmt.Errorf("error updating address of self: %T is not an ExtendedDHT", dht.DHT)
+}
+
+func (dht extendedDHT) ClosestPeerAddresses(target protocol.PeerID, n int) (protocol.PeerAddresses, error) {
+	addrs, err := dht.PeerAddresses()
+	if err != nil {
+		return nil, err
+	}
+	SortByDistance(target, addrs)
+	if len(addrs) > n {
+		addrs = addrs[:n]
+	}
+	return addrs, nil
+}
+
+func (dht extendedDHT) Seen(protocol.PeerID) {}
+
+func (dht extendedDHT) LastSeen(peerID protocol.PeerID) (time.Time, error) {
+	return time.Time{}, NewErrPeerNotFound(peerID)
+}
+
+func (dht extendedDHT) RemoveStalePeers(since time.Time) (protocol.PeerIDs, error) {
+	return protocol.PeerIDs{}, nil
+}
+
+func (dht extendedDHT) RecentPeerAddresses(n int) (protocol.PeerAddresses, error) {
+	return protocol.PeerAddresses{}, nil
+}
+
+func (dht extendedDHT) GroupInfo(groupID protocol.GroupID) (GroupInfo, error) {
+	info := GroupInfo{
+		GroupID: groupID,
+		Missing: protocol.PeerIDs{},
+	}
+	if groupID.Equal(protocol.NilGroupID) {
+		addrs, err := dht.PeerAddresses()
+		if err != nil {
+			return GroupInfo{}, err
+		}
+		info.Members = make(protocol.PeerIDs, 0, len(addrs))
+		for _, addr := range addrs {
+			info.Members = append(info.Members, addr.PeerID())
+		}
+		info.Addresses = addrs
+		return info, nil
+	}
+
+	ids, err := dht.GroupIDs(groupID)
+	if err != nil {
+		return GroupInfo{}, err
+	}
+	info.Members = ids
+	info.Addresses = make(protocol.PeerAddresses, 0, len(ids))
+	for _, id := range ids {
+		if id.Equal(dht.Me().PeerID()) {
+			info.Addresses = append(info.Addresses, dht.Me())
+			continue
+		}
+		addr, err := dht.PeerAddress(id)
+		if err != nil {
+			info.Missing = append(info.Missing, id)
+			continue
+		}
+		info.Addresses = append(info.Addresses, addr)
+	}
+	return info, nil
+}
+
+func (dht extendedDHT) AddSubgroup(parent, child protocol.GroupID) error {
+	return fmt.Errorf("error adding subgroup=%v to group=%v: %T is not an ExtendedDHT", child, parent, dht.DHT)
+}
+
+func (dht extendedDHT) Subgroups(protocol.GroupID) []protocol.GroupID {
+	return nil
+}
+
+func (dht extendedDHT) RemoveSubgroup(parent, child protocol.GroupID) {}
+
+func (dht extendedDHT) Subscribe(changes chan<- PeerChange) func() {
+	return func() {}
+}
@@ -0,0 +1,268 @@
+package dht
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/renproject/aw/protocol"
+)
+
+// ReplicationStats describe the rounds in which the records stored in the DHT
+// (e.g. provider and value records) are republished by their publishers, and
+// replicated by the peers that store them. Records are sent to the K peers
+// closest to their key, but delivery is not acknowledged, so the replication
+// factor of a record is the number of peers it was sent to.
+type ReplicationStats struct {
+	Rounds          uint64    // Number of rounds so far
+	LastRound       time.Time // Time at which the last round ended
+	Records         int       // Records sent in the last round
+	UnderReplicated int       // Records sent to fewer than K peers in the last round
+	MinReplication  int       // Smallest replication factor in the last round
+	MeanReplication float64   // Mean replication factor in the last round
+}
+
+// Observe a round in which records were sent to the given number of peers,
+// when they should have been sent to k peers.
+func (stats ReplicationStats) Observe(k int, factors []int) ReplicationStats {
+	stats.Rounds++
+	stats.LastRound = time.Now()
+	stats.Records = len(factors)
+	stats.UnderReplicated = 0
+	stats.MinReplication = 0
+	stats.MeanReplication = 0
+	if len(factors) == 0 {
+		return stats
+	}
+
+	sum := 0
+	stats.MinReplication = factors[0]
+	for _, factor := range factors {
+		if factor < k {
+			stats.UnderReplicated++
+		}
+		if factor < stats.MinReplication {
+			stats.MinReplication = factor
+		}
+		sum += factor
+	}
+	stats.MeanReplication = float64(sum) / float64(len(factors))
+	return stats
+}
+
+// KeyID maps a key onto the space of PeerIDs, so that the peers that store the
+// records of the key (e.g. provider and value records) can be chosen by their
+// distance to it.
+type KeyID string
+
+func (id KeyID) String() string {
+	return string(id)
+}
+
+func (id KeyID) Equal(another protocol.PeerID) bool {
+	return another != nil && id.String() == another.String()
+}
+
+// A Replicator sends records to the K peers closest to their keys, and keeps
+// the ReplicationStats of its rounds. It is safe for concurrent use.
+type Replicator struct {
+	k        int
+	dht      ExtendedDHT
+	messages protocol.MessageSender
+	variant  protocol.MessageVariant
+
+	mu    *sync.Mutex
+	stats ReplicationStats
+}
+
+// NewReplicator returns a Replicator that sends records to the k closest peers
+// in messages of the given variant.
+func NewReplicator(k int, dht ExtendedDHT, messages protocol.MessageSender, variant protocol.MessageVariant) *Replicator {
+	return &Replicator{
+		k:        k,
+		dht:      dht,
+		messages: messages,
+		variant:  variant,
+
+		mu: new(sync.Mutex),
+	}
+}
+
+// Replicate a marshaled record of the key at the peers closest to the key,
+// except its publisher. It returns the number of peers that the record was
+// sent to.
+func (replicator *Replicator) Replicate(ctx context.Context, key string, publisher protocol.PeerID, record []byte) (int, error) {
+	closest, err := replicator.dht.ClosestPeerAddresses(KeyID(key), replicator.k)
+	if err != nil {
+		return 0, err
+	}
+	sent := 0
+	for _, addr := range closest {
+		if addr.PeerID().String() == publisher.String() {
+			continue
+		}
+		messageWire := protocol.MessageOnTheWire{
+			To:      addr,
+			Message: protocol.NewMessage(protocol.V1, replicator.variant, protocol.NilGroupID, record),
+		}
+		select {
+		case <-ctx.Done():
+			return sent, ctx.Err()
+		case replicator.messages <- messageWire:
+			sent++
+		}
+	}
+	return sent, nil
+}
+
+// Round replicates n records, by calling the function with the index of every
+// record, and observes the number of peers that it returns for each of them.
+func (replicator *Replicator) Round(n int, replicate func(i int) int) {
+	factors := make([]int, 0, n)
+	for i := 0; i < n; i++ {
+		factors = append(factors, replicate(i))
+	}
+
+	replicator.mu.Lock()
+	defer replicator.mu.Unlock()
+
+	replicator.stats = replicator.stats.Observe(replicator.k, factors)
+}
+
+// Stats returns the ReplicationStats of the last round.
+func (replicator *Replicator) Stats() ReplicationStats {
+	replicator.mu.Lock()
+	defer replicator.mu.Unlock()
+
+	return replicator.stats
+}
+
+// A LookupResponse is the response of a peer to a Lookup. The Records are of
+// the type used by the package that made the Lookup (e.g. []provider.Record).
+type LookupResponse struct {
+	From    protocol.PeerID
+	Records interface{}
+}
+
+// Lookups keeps the Lookups of the records of keys that are waiting for the
+// peers they asked. It is safe for concurrent use.
+type Lookups struct {
+	mu      *sync.Mutex
+	lookups map[string]map[*Lookup]struct{}
+}
+
+// A Lookup only accepts responses from the peers it has asked, and only once
+// from each of them.
+type Lookup struct {
+	lookups   *Lookups
+	key       string
+	asked     map[string]struct{}
+	responses chan LookupResponse
+}
+
+// NewLookups returns Lookups that are not waiting for anything.
+func NewLookups() *Lookups {
+	return &Lookups{
+		mu:      new(sync.Mutex),
+		lookups: map[string]map[*Lookup]struct{}{},
+	}
+}
+
+// Ask the peers for the records of the key, by sending them a message of the
+// given variant and body. The Lookup accepts responses as soon as it is asking,
+// and it must be closed once it is done.
+func (lookups *Lookups) Ask(ctx context.Context, messages protocol.MessageSender, key string, peers protocol.PeerAddresses, variant protocol.MessageVariant, body []byte) (*Lookup, error) {
+	l := &Lookup{
+		lookups:   lookups,
+		key:       key,
+		asked:     make(map[string]struct{}, len(peers)),
+		responses: make(chan LookupResponse, len(peers)),
+	}
+	lookups.mu.Lock()
+	for _, addr := range peers {
+		l.asked[addr.PeerID().String()] = struct{}{}
+	}
+	if _, ok := lookups.lookups[key]; !ok {
+		lookups.lookups[key] = map[*Lookup]struct{}{}
+	}
+	lookups.lookups[key][l] = struct{}{}
+	lookups.mu.Unlock()
+
+	for _, addr := range peers {
+		messageWire := protocol.MessageOnTheWire{
+			To:      addr,
+			Message: protocol.NewMessage(protocol.V1, variant, protocol.NilGroupID, body),
+		}
+		select {
+		case <-ctx.Done():
+			l.Close()
+			return nil, ctx.Err()
+		case messages <- messageWire:
+		}
+	}
+	return l, nil
+}
+
+// Awaiting returns true if a Lookup of the key has asked the peer for its
+// records, and has not received them yet.
+func (lookups *Lookups) Awaiting(key string, from protocol.PeerID) bool {
+	lookups.mu.Lock()
+	defer lookups.mu.Unlock()
+
+	for l := range lookups.lookups[key] {
+		if _, ok := l.asked[from.String()]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Respond to the Lookups of the key that have asked the peer for its records.
+func (lookups *Lookups) Respond(key string, from protocol.PeerID, records interface{}) {
+	lookups.mu.Lock()
+	defer lookups.mu.Unlock()
+
+	for l := range lookups.lookups[key] {
+		if _, ok := l.asked[from.String()]; !ok {
+			continue
+		}
+		delete(l.asked, from.String())
+
+		// Never block the caller, which is usually the event loop of the
+		// peer.
+		select {
+		case l.responses <- LookupResponse{From: from, Records: records}:
+		default:
+		}
+	}
+}
+
+// Wait for the responses of the peers that were asked, and pass them to the
+// function, until all of them have responded, the timeout has passed, or the
+// context is done.
+func (l *Lookup) Wait(ctx context.Context, timeout time.Duration, f func(LookupResponse)) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for remaining := cap(l.responses); remaining > 0; remaining-- {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			return
+		case resp := <-l.responses:
+			f(resp)
+		}
+	}
+}
+
+// Close the Lookup, so that it stops accepting responses.
+func (l *Lookup) Close() {
+	l.lookups.mu.Lock()
+	defer l.lookups.mu.Unlock()
+
+	delete(l.lookups.lookups[l.key], l)
+	if len(l.lookups.lookups[l.key]) == 0 {
+		delete(l.lookups.lookups, l.key)
+	}
+}
@@ -0,0 +1,108 @@
+package dht_test
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/dht"
+	. "github.com/renproject/aw/testutil"
+
+	"github.com/renproject/aw/protocol"
+)
+
+var _ = Describe("Replication stats", func() {
+	Context("when observing a round", func() {
+		It("should describe the replication factors of the round", func() {
+			stats := ReplicationStats{}.Observe(3, []int{3, 1, 2, 4})
+			Expect(stats.Rounds).To(Equal(uint64(1)))
+			Expect(stats.Records).To(Equal(4))
+			Expect(stats.UnderReplicated).To(Equal(2))
+			Expect(stats.MinReplication).To(Equal(1))
+			Expect(stats.MeanReplication).To(Equal(2.5))
+
+			stats = stats.Observe(3, nil)
+			Expect(stats.Rounds).To(Equal(uint64(2)))
+			Expect(stats.Records).To(Equal(0))
+			Expect(stats.UnderReplicated).To(Equal(0))
+			Expect(stats.MinReplication).To(Equal(0))
+			Expect(stats.MeanReplication).To(Equal(0.0))
+		})
+	})
+})
+
+var _ = Describe("Replicator", func() {
+	Context("when replicating a record", func() {
+		It("should send it to the closest peers, except its publisher, and observe the round", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			addrs := RandomAddresses(5)
+			table := NewExtendedDHT(RandomAddress(), NewTable("dht"), addrs)
+			messages := make(chan protocol.MessageOnTheWire, 5)
+			replicator := NewReplicator(3, table, messages, protocol.Provide)
+
+			closest, err := table.ClosestPeerAddresses(KeyID("key"), 3)
+			Expect(err).NotTo(HaveOccurred())
+			replicator.Round(1, func(int) int {
+				sent, err := replicator.Replicate(ctx, "key", closest[0].PeerID(), []byte("record"))
+				Expect(err).NotTo(HaveOccurred())
+				return sent
+			})
+			Expect(messages).To(HaveLen(2))
+			for i := 1; i < 3; i++ {
+				message := <-messages
+				Expect(message.To.Equal(closest[i])).To(BeTrue())
+				Expect(message.Message.Variant).To(Equal(protocol.Provide))
+				Expect(message.Message.Body).To(Equal(protocol.MessageBody("record")))
+			}
+			Expect(replicator.Stats().Rounds).To(Equal(uint64(1)))
+			Expect(replicator.Stats().UnderReplicated).To(Equal(1))
+		})
+	})
+})
+
+var _ = Describe("Lookups", func() {
+	Context("when peers respond to a lookup", func() {
+		It("should only accept a response from every peer that was asked", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			lookups := NewLookups()
+			peers := RandomAddresses(2)
+			messages := make(chan protocol.MessageOnTheWire, 2)
+			lookup, err := lookups.Ask(ctx, messages, "key", peers, protocol.FindProviders, []byte("request"))
+			Expect(err).NotTo(HaveOccurred())
+			defer lookup.Close()
+			Expect(messages).To(HaveLen(2))
+
+			Expect(lookups.Awaiting("key", peers[0].PeerID())).To(BeTrue())
+			Expect(lookups.Awaiting("key", RandomPeerID())).To(BeFalse())
+			Expect(lookups.Awaiting("other key", peers[0].PeerID())).To(BeFalse())
+			lookups.Respond("key", peers[0].PeerID(), 1)
+			lookups.Respond("key", peers[0].PeerID(), 2)
+			lookups.Respond("key", RandomPeerID(), 3)
+			Expect(lookups.Awaiting("key", peers[0].PeerID())).To(BeFalse())
+
+			responses := []interface{}{}
+			lookup.Wait(ctx, 100*time.Millisecond, func(resp LookupResponse) {
+				Expect(resp.From.Equal(peers[0].PeerID())).To(BeTrue())
+				responses = append(responses, resp.Records)
+			})
+			Expect(responses).To(Equal([]interface{}{1}))
+		})
+
+		It("should not accept responses once it is closed", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			lookups := NewLookups()
+			peers := RandomAddresses(1)
+			lookup, err := lookups.Ask(ctx, make(chan protocol.MessageOnTheWire, 1), "key", peers, protocol.GetValue, nil)
+			Expect(err).NotTo(HaveOccurred())
+			lookup.Close()
+			Expect(lookups.Awaiting("key", peers[0].PeerID())).To(BeFalse())
+		})
+	})
+})
@@ -0,0 +1,70 @@
+package dht
+
+import (
+	"fmt"
+
+	"github.com/renproject/kv"
+)
+
+// schemaVersionKey is the key of the schema version of the records in the
+// store. It starts with a zero byte, so that it cannot be the key of a peer
+// address.
+const schemaVersionKey = "\x00schema"
+
+// A Migration upgrades a record of a peer address in the store of a DHT from
+// one schema version to the next (see Options).
+type Migration func(data []byte) ([]byte, error)
+
+// record is a peer address in the store, before it is decoded.
+type record struct {
+	key  string
+	data []byte
+}
+
+// loadSchemaVersion returns the schema version of the records in the store.
+// Stores that have records, but no schema version, were written before schema
+// versions were introduced, so their records have the first schema version.
+func (dht *dht) loadSchemaVersion() (int, error) {
+	var version int
+	switch err := dht.store.Get(schemaVersionKey, &version); err {
+	case nil:
+		return version, nil
+	case kv.ErrKeyNotFound:
+		size, err := dht.store.Size()
+		if err != nil {
+			return 0, fmt.Errorf("error loading schema version: %v", err)
+		}
+		if size == 0 {
+			return dht.options.SchemaVersion, nil
+		}
+		return 1, nil
+	default:
+		return 0, fmt.Errorf("error loading schema version: %v", err)
+	}
+}
+
+// checkMigrations returns an error if the records of the given schema version
+// cannot be migrated to the SchemaVersion of the DHT.
+func (dht *dht) checkMigrations(version int) error {
+	if version > dht.options.SchemaVersion {
+		return fmt.Errorf("error migrating dht: schema version=%v is newer than schema version=%v", version, dht.options.SchemaVersion)
+	}
+	for v := version; v < dht.options.SchemaVersion; v++ {
+		if dht.options.Migrations[v] == nil {
+			return fmt.Errorf("error migrating dht: no migration from schema version=%v", v)
+		}
+	}
+	return nil
+}
+
+// migrate the record from the given schema version to the SchemaVersion of the
+// DHT.
+func (dht *dht) migrate(data []byte, version int) ([]byte, error) {
+	for v := version; v < dht.options.SchemaVersion; v++ {
+		var err error
+		if data, err = dht.options.Migrations[v](data); err != nil {
+			return nil, fmt.Errorf("error migrating from schema version=%v: %v", v, err)
+		}
+	}
+	return data, nil
+}
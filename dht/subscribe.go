@@ -0,0 +1,92 @@
+package dht
+
+import (
+	"sync"
+
+	"github.com/renproject/aw/protocol"
+)
+
+// PeerChangeKind is the kind of change to the PeerAddress of a peer in a DHT.
+type PeerChangeKind uint8
+
+const (
+	// PeerAdded means that the DHT did not have an address for the peer.
+	PeerAdded = PeerChangeKind(1)
+	// PeerUpdated means that the address of the peer replaced the address
+	// that the DHT had for it.
+	PeerUpdated = PeerChangeKind(2)
+	// PeerRemoved means that the address of the peer was removed from the
+	// DHT.
+	PeerRemoved = PeerChangeKind(3)
+)
+
+// String implements the Stringer interface.
+func (kind PeerChangeKind) String() string {
+	switch kind {
+	case PeerAdded:
+		return "added"
+	case PeerUpdated:
+		return "updated"
+	case PeerRemoved:
+		return "removed"
+	default:
+		return "unknown"
+	}
+}
+
+// A PeerChange is sent to the subscribers of a DHT whenever the PeerAddress of
+// a peer is added, updated, or removed. The PeerAddress is the address that
+// was removed when the peer is removed.
+type PeerChange struct {
+	Kind        PeerChangeKind
+	PeerID      protocol.PeerID
+	PeerAddress protocol.PeerAddress
+}
+
+// subscribers of a DHT, that are sent its PeerChanges.
+type subscribers struct {
+	mu     *sync.RWMutex
+	nextID uint64
+	chans  map[uint64]chan<- PeerChange
+}
+
+func newSubscribers() *subscribers {
+	return &subscribers{
+		mu:    new(sync.RWMutex),
+		chans: map[uint64]chan<- PeerChange{},
+	}
+}
+
+func (subs *subscribers) subscribe(changes chan<- PeerChange) func() {
+	subs.mu.Lock()
+	defer subs.mu.Unlock()
+
+	id := subs.nextID
+	subs.nextID++
+	subs.chans[id] = changes
+
+	return func() {
+		subs.mu.Lock()
+		defer subs.mu.Unlock()
+
+		delete(subs.chans, id)
+	}
+}
+
+// notify the subscribers of the change, without blocking, so that a slow
+// subscriber cannot block changes to the DHT.
+func (subs *subscribers) notify(change PeerChange) {
+	subs.mu.RLock()
+	defer subs.mu.RUnlock()
+
+	for _, changes := range subs.chans {
+		select {
+		case changes <- change:
+		default:
+		}
+	}
+}
+
+func (dht *dht) Subscribe(changes chan<- PeerChange) func() {
+	return dht.subscribers.subscribe(changes)
+}
@@ -0,0 +1,292 @@
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/renproject/aw/dht"
+	"github.com/renproject/aw/protocol"
+	"github.com/sirupsen/logrus"
+)
+
+// A Discoverer exchanges the addresses of peers with other peers, so that a
+// peer can learn about the network from a single seed peer, instead of needing
+// the addresses of many bootstrap peers.
+type Discoverer interface {
+	// QueryPeers asks a peer for a batch of the addresses of the peers that it
+	// knows. The addresses in its answer are merged into the DHT when the
+	// answer is accepted.
+	QueryPeers(ctx context.Context, to protocol.PeerAddress) error
+
+	// AcceptQueryPeers from a peer, and answer it with a random batch of the
+	// addresses in the DHT. The address of the peer is also merged into the
+	// DHT.
+	AcceptQueryPeers(ctx context.Context, from protocol.PeerID, message protocol.Message) error
+
+	// AcceptAnswerPeers from a peer that was queried within the Timeout, and
+	// merge the addresses into the DHT.
+	AcceptAnswerPeers(ctx context.Context, from protocol.PeerID, message protocol.Message) error
+}
+
+// Options are used to parameterise the behaviour of a Discoverer.
+type Options struct {
+	Logger    logrus.FieldLogger
+	BatchSize int           // Maximum number of addresses in an answer, defaults to 32
+	Timeout   time.Duration // Time to wait for the answer of a query, defaults to 30 seconds
+}
+
+func (options *Options) setZerosToDefaults() {
+	if options.Logger == nil {
+		options.Logger = logrus.New()
+	}
+	if options.BatchSize <= 0 {
+		options.BatchSize = 32
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = 30 * time.Second
+	}
+}
+
+type discoverer struct {
+	logger   logrus.FieldLogger
+	options  Options
+	dht      dht.DHT
+	messages protocol.MessageSender
+	codec    protocol.PeerAddressCodec
+
+	// Answers are only accepted from the peers that were queried, and only
+	// until the queries expire, so that peers cannot fill the DHT with
+	// addresses that were not asked for.
+	mu      *sync.Mutex
+	queries map[string]time.Time
+}
+
+// NewDiscoverer returns a Discoverer that sends QueryPeers and AnswerPeers
+// messages using the given MessageSender.
+func NewDiscoverer(options Options, dht dht.DHT, messages protocol.MessageSender, codec protocol.PeerAddressCodec) Discoverer {
+	options.setZerosToDefaults()
+	return &discoverer{
+		logger:   options.Logger,
+		options:  options,
+		dht:      dht,
+		messages: messages,
+		codec:    codec,
+
+		mu:      new(sync.Mutex),
+		queries: map[string]time.Time{},
+	}
+}
+
+func (discoverer *discoverer) QueryPeers(ctx context.Context, to protocol.PeerAddress) error {
+	me, err := discoverer.codec.Encode(discoverer.dht.Me())
+	if err != nil {
+		return newErrQueryingPeers(err, to.PeerID())
+	}
+
+	discoverer.mu.Lock()
+	now := time.Now()
+	for id, expiry := range discoverer.queries {
+		if !now.Before(expiry) {
+			delete(discoverer.queries, id)
+		}
+	}
+	discoverer.queries[to.PeerID().String()] = now.Add(discoverer.options.Timeout)
+	discoverer.mu.Unlock()
+
+	messageWire := protocol.MessageOnTheWire{
+		To:      to,
+		Message: protocol.NewMessage(protocol.V1, protocol.QueryPeers, protocol.NilGroupID, me),
+	}
+	select {
+	case <-ctx.Done():
+		return newErrQueryingPeers(ctx.Err(), to.PeerID())
+	case discoverer.messages <- messageWire:
+		return nil
+	}
+}
+
+func (discoverer *discoverer) AcceptQueryPeers(ctx context.Context, from protocol.PeerID, message protocol.Message) error {
+	// Pre-condition checks
+	if message.Version != protocol.V1 {
+		return protocol.NewErrMessageVersionIsNotSupported(message.Version)
+	}
+	if message.Variant != protocol.QueryPeers {
+		return protocol.NewErrMessageVariantIsNotSupported(message.Variant)
+	}
+
+	requester, err := discoverer.codec.Decode(message.Body)
+	if err != nil {
+		return newErrAcceptingQueryPeers(fmt.Errorf("error decoding address: %v", err))
+	}
+	// Answers are only sent to the authenticated sender, so that the
+	// Discoverer cannot be used to send messages to arbitrary addresses.
+	if from == nil || !requester.PeerID().Equal(from) {
+		return newErrAcceptingQueryPeers(fmt.Errorf("address of peer=%v sent by peer=%v", requester.PeerID(), from))
+	}
+	if _, err := discoverer.dht.UpdatePeerAddress(requester); err != nil {
+		discoverer.logger.Errorf("error adding address of peer=%v to the dht: %v", from, err)
+	}
+
+	random, err := discoverer.dht.RandomPeerAddresses(protocol.NilGroupID, discoverer.options.BatchSize+1)
+	if err != nil {
+		return newErrAcceptingQueryPeers(err)
+	}
+	addrs := make([][]byte, 0, len(random))
+	for _, addr := range random {
+		if len(addrs) == discoverer.options.BatchSize {
+			break
+		}
+		if addr.PeerID().Equal(from) {
+			continue
+		}
+		data, err := discoverer.codec.Encode(addr)
+		if err != nil {
+			return newErrAcceptingQueryPeers(err)
+		}
+		addrs = append(addrs, data)
+	}
+	body, err := marshalAnswerPeers(addrs)
+	if err != nil {
+		return newErrAcceptingQueryPeers(err)
+	}
+
+	messageWire := protocol.MessageOnTheWire{
+		To:      requester,
+		Message: protocol.NewMessage(protocol.V1, protocol.AnswerPeers, protocol.NilGroupID, body),
+	}
+	select {
+	case <-ctx.Done():
+		return newErrAcceptingQueryPeers(ctx.Err())
+	case discoverer.messages <- messageWire:
+		return nil
+	}
+}
+
+func (discoverer *discoverer) AcceptAnswerPeers(ctx context.Context, from protocol.PeerID, message protocol.Message) error {
+	// Pre-condition checks
+	if message.Version != protocol.V1 {
+		return protocol.NewErrMessageVersionIsNotSupported(message.Version)
+	}
+	if message.Variant != protocol.AnswerPeers {
+		return protocol.NewErrMessageVariantIsNotSupported(message.Variant)
+	}
+	if from == nil {
+		return newErrAcceptingAnswerPeers(fmt.Errorf("unknown sender"))
+	}
+
+	discoverer.mu.Lock()
+	expiry, ok := discoverer.queries[from.String()]
+	delete(discoverer.queries, from.String())
+	discoverer.mu.Unlock()
+	if !ok || !time.Now().Before(expiry) {
+		return newErrAcceptingAnswerPeers(fmt.Errorf("peer=%v was not queried", from))
+	}
+
+	data, err := unmarshalAnswerPeers(message.Body)
+	if err != nil {
+		return newErrAcceptingAnswerPeers(err)
+	}
+	if len(data) > discoverer.options.BatchSize {
+		return newErrAcceptingAnswerPeers(fmt.Errorf("expected at most %v addresses, got %v", discoverer.options.BatchSize, len(data)))
+	}
+	for _, d := range data {
+		addr, err := discoverer.codec.Decode(d)
+		if err != nil {
+			return newErrAcceptingAnswerPeers(fmt.Errorf("error decoding address: %v", err))
+		}
+		if addr.PeerID().Equal(discoverer.dht.Me().PeerID()) {
+			continue
+		}
+		if _, err := discoverer.dht.UpdatePeerAddress(addr); err != nil {
+			discoverer.logger.Errorf("error adding address of peer=%v to the dht: %v", addr.PeerID(), err)
+		}
+	}
+	return nil
+}
+
+// The body of an AnswerPeers message is the number of encoded addresses,
+// followed by the addresses.
+func marshalAnswerPeers(addrs [][]byte) ([]byte, error) {
+	buffer := new(bytes.Buffer)
+	if err := binary.Write(buffer, binary.LittleEndian, uint32(len(addrs))); err != nil {
+		return nil, fmt.Errorf("error marshaling number of addresses: %v", err)
+	}
+	for _, addr := range addrs {
+		if err := binary.Write(buffer, binary.LittleEndian, uint32(len(addr))); err != nil {
+			return nil, fmt.Errorf("error marshaling address: %v", err)
+		}
+		if _, err := buffer.Write(addr); err != nil {
+			return nil, fmt.Errorf("error marshaling address: %v", err)
+		}
+	}
+	return buffer.Bytes(), nil
+}
+
+func unmarshalAnswerPeers(data []byte) ([][]byte, error) {
+	buffer := bytes.NewBuffer(data)
+	numAddrs := uint32(0)
+	if err := binary.Read(buffer, binary.LittleEndian, &numAddrs); err != nil {
+		return nil, fmt.Errorf("error unmarshaling number of addresses: %v", err)
+	}
+	// Every address takes at least 4 bytes, so the number of addresses
+	// cannot exceed the remaining bytes.
+	if int(numAddrs) > buffer.Len()/4 {
+		return nil, fmt.Errorf("error unmarshaling answer: expected at most %v addresses, got %v", buffer.Len()/4, numAddrs)
+	}
+	addrs := make([][]byte, 0, numAddrs)
+	for i := uint32(0); i < numAddrs; i++ {
+		length := uint32(0)
+		if err := binary.Read(buffer, binary.LittleEndian, &length); err != nil {
+			return nil, fmt.Errorf("error unmarshaling address: %v", err)
+		}
+		if int(length) > buffer.Len() {
+			return nil, fmt.Errorf("error unmarshaling address: expected len<=%v, got len=%v", buffer.Len(), length)
+		}
+		addrs = append(addrs, buffer.Next(int(length)))
+	}
+	if buffer.Len() != 0 {
+		return nil, fmt.Errorf("error unmarshaling answer: %v trailing bytes", buffer.Len())
+	}
+	return addrs, nil
+}
+
+// ErrQueryingPeers is returned when there is an error when querying a peer.
+type ErrQueryingPeers struct {
+	error
+	PeerID protocol.PeerID
+}
+
+func newErrQueryingPeers(err error, peerID protocol.PeerID) error {
+	return ErrQueryingPeers{
+		error:  fmt.Errorf("error querying peers of peer=%v: %v", peerID, err),
+		PeerID: peerID,
+	}
+}
+
+// ErrAcceptingQueryPeers is returned when there is an error when accepting a
+// QueryPeers message.
+type ErrAcceptingQueryPeers struct {
+	error
+}
+
+func newErrAcceptingQueryPeers(err error) error {
+	return ErrAcceptingQueryPeers{
+		error: fmt.Errorf("error accepting querypeers: %v", err),
+	}
+}
+
+// ErrAcceptingAnswerPeers is returned when there is an error when accepting an
+// AnswerPeers message.
+type ErrAcceptingAnswerPeers struct {
+	error
+}
+
+func newErrAcceptingAnswerPeers(err error) error {
+	return ErrAcceptingAnswerPeers{
+		error: fmt.Errorf("error accepting answerpeers: %v", err),
+	}
+}
@@ -0,0 +1,147 @@
+package discovery_test
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/discovery"
+	. "github.com/renproject/aw/testutil"
+
+	"github.com/renproject/aw/dht"
+	"github.com/renproject/aw/protocol"
+	"github.com/sirupsen/logrus"
+)
+
+var TestOptions = Options{
+	Logger:    logrus.New(),
+	BatchSize: 8,
+	Timeout:   time.Second,
+}
+
+type node struct {
+	addr       SimpleTCPPeerAddress
+	dht        dht.DHT
+	discoverer Discoverer
+	messages   chan protocol.MessageOnTheWire
+}
+
+func newNode(options Options) node {
+	addr := RandomAddress()
+	table := NewDHT(addr, NewTable("dht"), nil)
+	messages := make(chan protocol.MessageOnTheWire, 128)
+	return node{
+		addr:       addr,
+		dht:        table,
+		discoverer: NewDiscoverer(options, table, messages, SimpleTCPPeerAddressCodec{}),
+		messages:   messages,
+	}
+}
+
+// deliver the next message sent by one node to the other node.
+func deliver(ctx context.Context, from, to node) error {
+	var messageOtw protocol.MessageOnTheWire
+	Eventually(from.messages).Should(Receive(&messageOtw))
+	Expect(messageOtw.To.PeerID().Equal(to.addr.PeerID())).To(BeTrue())
+	switch messageOtw.Message.Variant {
+	case protocol.QueryPeers:
+		return to.discoverer.AcceptQueryPeers(ctx, from.addr.ID, messageOtw.Message)
+	case protocol.AnswerPeers:
+		return to.discoverer.AcceptAnswerPeers(ctx, from.addr.ID, messageOtw.Message)
+	default:
+		return protocol.NewErrMessageVariantIsNotSupported(messageOtw.Message.Variant)
+	}
+}
+
+var _ = Describe("Discovery", func() {
+	Context("when querying a seed peer", func() {
+		It("should learn a batch of the peers known by the seed", func() {
+			ctx := context.Background()
+			me, seed := newNode(TestOptions), newNode(TestOptions)
+			known := RandomAddresses(4)
+			for _, addr := range known {
+				Expect(seed.dht.AddPeerAddress(addr)).To(Succeed())
+			}
+
+			Expect(me.discoverer.QueryPeers(ctx, seed.addr)).To(Succeed())
+			Expect(deliver(ctx, me, seed)).To(Succeed())
+			Expect(deliver(ctx, seed, me)).To(Succeed())
+
+			for _, addr := range known {
+				learnt, err := me.dht.PeerAddress(addr.PeerID())
+				Expect(err).NotTo(HaveOccurred())
+				Expect(learnt.Equal(addr)).To(BeTrue())
+			}
+
+			// The seed learns the peer that queried it
+			learnt, err := seed.dht.PeerAddress(me.addr.PeerID())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(learnt.Equal(me.addr)).To(BeTrue())
+		})
+
+		It("should answer with at most a batch of peers, excluding the peer that queried it", func() {
+			ctx := context.Background()
+			me, seed := newNode(TestOptions), newNode(TestOptions)
+			for _, addr := range RandomAddresses(4 * TestOptions.BatchSize) {
+				Expect(seed.dht.AddPeerAddress(addr)).To(Succeed())
+			}
+
+			Expect(me.discoverer.QueryPeers(ctx, seed.addr)).To(Succeed())
+			Expect(deliver(ctx, me, seed)).To(Succeed())
+			Expect(deliver(ctx, seed, me)).To(Succeed())
+
+			num, err := me.dht.NumPeers()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(num).To(Equal(TestOptions.BatchSize))
+			_, err = me.dht.PeerAddress(me.addr.PeerID())
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("when receiving answers that were not asked for", func() {
+		It("should reject answers from peers that were not queried", func() {
+			ctx := context.Background()
+			me, seed, other := newNode(TestOptions), newNode(TestOptions), newNode(TestOptions)
+			Expect(seed.dht.AddPeerAddress(RandomAddress())).To(Succeed())
+
+			Expect(other.discoverer.QueryPeers(ctx, seed.addr)).To(Succeed())
+			Expect(deliver(ctx, other, seed)).To(Succeed())
+
+			// Redirect the answer to a peer that did not query the seed
+			var messageOtw protocol.MessageOnTheWire
+			Eventually(seed.messages).Should(Receive(&messageOtw))
+			Expect(me.discoverer.AcceptAnswerPeers(ctx, seed.addr.ID, messageOtw.Message)).To(HaveOccurred())
+
+			num, err := me.dht.NumPeers()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(num).To(BeZero())
+		})
+
+		It("should reject answers after the query has expired", func() {
+			ctx := context.Background()
+			options := TestOptions
+			options.Timeout = 10 * time.Millisecond
+			me, seed := newNode(options), newNode(options)
+			Expect(seed.dht.AddPeerAddress(RandomAddress())).To(Succeed())
+
+			Expect(me.discoverer.QueryPeers(ctx, seed.addr)).To(Succeed())
+			Expect(deliver(ctx, me, seed)).To(Succeed())
+			time.Sleep(20 * time.Millisecond)
+			Expect(deliver(ctx, seed, me)).To(HaveOccurred())
+		})
+	})
+
+	Context("when receiving queries from unauthenticated peers", func() {
+		It("should not answer queries that were sent on behalf of another peer", func() {
+			ctx := context.Background()
+			me, seed := newNode(TestOptions), newNode(TestOptions)
+
+			Expect(me.discoverer.QueryPeers(ctx, seed.addr)).To(Succeed())
+			var messageOtw protocol.MessageOnTheWire
+			Eventually(me.messages).Should(Receive(&messageOtw))
+			Expect(seed.discoverer.AcceptQueryPeers(ctx, RandomPeerID(), messageOtw.Message)).To(HaveOccurred())
+			Expect(seed.messages).To(BeEmpty())
+		})
+	})
+})
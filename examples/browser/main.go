@@ -0,0 +1,64 @@
+//go:build js && wasm
+// +build js,wasm
+
+// Command browser is an observer peer that runs in a browser. It dials the
+// node that serves the page, over a WebSocket, and prints the messages that the
+// node sends to it. See the README for how to build and serve it.
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"syscall/js"
+
+	"github.com/renproject/aw/crypto"
+	"github.com/renproject/aw/handshake"
+	"github.com/renproject/aw/protocol"
+	"github.com/renproject/aw/ws"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ed25519"
+)
+
+func main() {
+	ctx := context.Background()
+
+	_, privKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	signVerifier := crypto.NewEd25519SignVerifier(privKey)
+	transport := ws.New(ws.Options{}, logrus.New(), handshake.New(signVerifier, handshake.NewGCMSessionManager()))
+
+	messages := make(chan protocol.MessageOnTheWire, 128)
+	go transport.Server().Run(ctx, messages)
+
+	url := nodeURL()
+	peerID, err := transport.Dial(ctx, url)
+	if err != nil {
+		logf("error dialing %v: %v", url, err)
+		return
+	}
+	logf("connected to %v at %v as %v", peerID, url, signVerifier.ID())
+
+	for message := range messages {
+		logf("received %v message from %v: %q", message.Message.Variant, message.From, message.Message.Body)
+	}
+}
+
+// nodeURL returns the URL of the WebSocket endpoint of the node that serves
+// the page.
+func nodeURL() string {
+	location := js.Global().Get("location")
+	scheme := "ws"
+	if location.Get("protocol").String() == "https:" {
+		scheme = "wss"
+	}
+	return fmt.Sprintf("%v://%v/aw", scheme, location.Get("host").String())
+}
+
+// logf prints a line to the log element of the page.
+func logf(format string, args ...interface{}) {
+	log := js.Global().Get("document").Call("getElementById", "log")
+	log.Call("append", fmt.Sprintf(format, args...)+"\n")
+}
@@ -0,0 +1,488 @@
+package findnode
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/renproject/aw/dht"
+	"github.com/renproject/aw/protocol"
+	"github.com/sirupsen/logrus"
+)
+
+// A NodeFinder locates the addresses of peers that are not in the DHT, by
+// iteratively asking the peers closest to the target PeerID (see dht.Distance)
+// for the peers they know that are even closer, until the target is found or
+// no closer peers are left to ask.
+type NodeFinder interface {
+	// FindNode returns the address of the target PeerID. The address is
+	// added to the DHT when it is found in the network. It returns an
+	// ErrNodeNotFound if the lookup ends without finding the target.
+	FindNode(ctx context.Context, target protocol.PeerID) (protocol.PeerAddress, error)
+
+	// AcceptFindNode from a peer and send it the addresses of the peers
+	// closest to the target that are in the DHT.
+	AcceptFindNode(ctx context.Context, from protocol.PeerID, message protocol.Message) error
+
+	// AcceptNodes from a peer that was asked for the peers closest to a
+	// target by a lookup.
+	AcceptNodes(ctx context.Context, from protocol.PeerID, message protocol.Message) error
+}
+
+// Options are used to parameterise the behaviour of a NodeFinder.
+type Options struct {
+	Logger  logrus.FieldLogger
+	K       int           // Number of closest peers kept by a lookup, and sent in a response, defaults to 20
+	Alpha   int           // Number of peers asked concurrently, defaults to 3
+	Timeout time.Duration // Time to wait for the responses of each round of a lookup, defaults to 1 second
+}
+
+func (options *Options) setZerosToDefaults() {
+	if options.Logger == nil {
+		options.Logger = logrus.New()
+	}
+	if options.K <= 0 {
+		options.K = 20
+	}
+	if options.Alpha <= 0 {
+		options.Alpha = 3
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = time.Second
+	}
+}
+
+type response struct {
+	from  protocol.PeerID
+	addrs protocol.PeerAddresses
+}
+
+// A lookup only accepts responses from the peers it has asked.
+type lookup struct {
+	asked     map[string]struct{}
+	responses chan response
+}
+
+type nodeFinder struct {
+	logger   logrus.FieldLogger
+	options  Options
+	dht      dht.ExtendedDHT
+	messages protocol.MessageSender
+	codec    protocol.PeerAddressCodec
+
+	mu      *sync.Mutex
+	lookups map[string]map[*lookup]struct{}
+}
+
+// NewNodeFinder returns a NodeFinder that sends FindNode and Nodes messages
+// using the given MessageSender.
+func NewNodeFinder(options Options, table dht.DHT, messages protocol.MessageSender, codec protocol.PeerAddressCodec) NodeFinder {
+	options.setZerosToDefaults()
+	return &nodeFinder{
+		logger:   options.Logger,
+		options:  options,
+		dht:      dht.Extend(table),
+		messages: messages,
+		codec:    codec,
+
+		mu:      new(sync.Mutex),
+		lookups: map[string]map[*lookup]struct{}{},
+	}
+}
+
+func (finder *nodeFinder) FindNode(ctx context.Context, target protocol.PeerID) (protocol.PeerAddress, error) {
+	if addr, err := finder.dht.PeerAddress(target); err == nil {
+		return addr, nil
+	}
+	shortlist, err := finder.dht.ClosestPeerAddresses(target, finder.options.K)
+	if err != nil {
+		return nil, err
+	}
+	me, err := finder.codec.Encode(finder.dht.Me())
+	if err != nil {
+		return nil, err
+	}
+	body, err := marshalFindNode(target, me)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &lookup{
+		asked:     map[string]struct{}{},
+		responses: make(chan response, finder.options.K),
+	}
+	finder.register(target, l)
+	defer finder.unregister(target, l)
+
+	seen := map[string]struct{}{finder.dht.Me().PeerID().String(): {}}
+	for _, addr := range shortlist {
+		seen[addr.PeerID().String()] = struct{}{}
+	}
+	for {
+		// Ask the closest peers that have not been asked yet.
+		batch := make(map[string]struct{}, finder.options.Alpha)
+		finder.mu.Lock()
+		for _, addr := range shortlist {
+			if len(batch) == finder.options.Alpha {
+				break
+			}
+			if _, ok := l.asked[addr.PeerID().String()]; ok {
+				continue
+			}
+			l.asked[addr.PeerID().String()] = struct{}{}
+			batch[addr.PeerID().String()] = struct{}{}
+		}
+		finder.mu.Unlock()
+		if len(batch) == 0 {
+			return nil, newErrNodeNotFound(target)
+		}
+		for _, addr := range shortlist {
+			if _, ok := batch[addr.PeerID().String()]; !ok {
+				continue
+			}
+			messageWire := protocol.MessageOnTheWire{
+				To:      addr,
+				Message: protocol.NewMessage(protocol.V1, protocol.FindNode, protocol.NilGroupID, body),
+			}
+			select {
+			case <-ctx.Done():
+				return nil, newErrFindingNode(ctx.Err(), target)
+			case finder.messages <- messageWire:
+			}
+		}
+
+		// Wait for the responses of the batch, and merge them into the
+		// shortlist. Responses to previous batches are also merged.
+		timer := time.NewTimer(finder.options.Timeout)
+		for len(batch) > 0 {
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, newErrFindingNode(ctx.Err(), target)
+			case <-timer.C:
+				batch = map[string]struct{}{}
+			case resp := <-l.responses:
+				delete(batch, resp.from.String())
+				for _, addr := range resp.addrs {
+					if addr.PeerID().Equal(target) {
+						timer.Stop()
+						if _, err := finder.dht.UpdatePeerAddress(addr); err != nil {
+							finder.logger.Errorf("error adding address of peer=%v to the dht: %v", target, err)
+						}
+						return addr, nil
+					}
+					if _, ok := seen[addr.PeerID().String()]; ok {
+						continue
+					}
+					seen[addr.PeerID().String()] = struct{}{}
+					shortlist = append(shortlist, addr)
+				}
+			}
+		}
+		timer.Stop()
+
+		dht.SortByDistance(target, shortlist)
+		if len(shortlist) > finder.options.K {
+			shortlist = shortlist[:finder.options.K]
+		}
+	}
+}
+
+func (finder *nodeFinder) AcceptFindNode(ctx context.Context, from protocol.PeerID, message protocol.Message) error {
+	// Pre-condition checks
+	if message.Version != protocol.V1 {
+		return protocol.NewErrMessageVersionIsNotSupported(message.Version)
+	}
+	if message.Variant != protocol.FindNode {
+		return protocol.NewErrMessageVariantIsNotSupported(message.Variant)
+	}
+
+	target, data, err := unmarshalFindNode(message.Body)
+	if err != nil {
+		return newErrAcceptingFindNode(err)
+	}
+	requester, err := finder.codec.Decode(data)
+	if err != nil {
+		return newErrAcceptingFindNode(fmt.Errorf("error decoding address: %v", err))
+	}
+	// Responses are only sent to the authenticated sender, so that the
+	// NodeFinder cannot be used to send messages to arbitrary addresses.
+	if from == nil || !requester.PeerID().Equal(from) {
+		return newErrAcceptingFindNode(fmt.Errorf("address of peer=%v sent by peer=%v", requester.PeerID(), from))
+	}
+
+	closest, err := finder.dht.ClosestPeerAddresses(peerID(target), finder.options.K+1)
+	if err != nil {
+		return newErrAcceptingFindNode(err)
+	}
+	addrs := make([][]byte, 0, len(closest)+1)
+	if finder.dht.Me().PeerID().String() == target {
+		me, err := finder.codec.Encode(finder.dht.Me())
+		if err != nil {
+			return newErrAcceptingFindNode(err)
+		}
+		addrs = append(addrs, me)
+	}
+	for _, addr := range closest {
+		if len(addrs) == finder.options.K {
+			break
+		}
+		if addr.PeerID().Equal(from) {
+			continue
+		}
+		data, err := finder.codec.Encode(addr)
+		if err != nil {
+			return newErrAcceptingFindNode(err)
+		}
+		addrs = append(addrs, data)
+	}
+	body, err := marshalNodes(target, addrs)
+	if err != nil {
+		return newErrAcceptingFindNode(err)
+	}
+
+	messageWire := protocol.MessageOnTheWire{
+		To:      requester,
+		Message: protocol.NewMessage(protocol.V1, protocol.Nodes, protocol.NilGroupID, body),
+	}
+	select {
+	case <-ctx.Done():
+		return newErrAcceptingFindNode(ctx.Err())
+	case finder.messages <- messageWire:
+		return nil
+	}
+}
+
+func (finder *nodeFinder) AcceptNodes(ctx context.Context, from protocol.PeerID, message protocol.Message) error {
+	// Pre-condition checks
+	if message.Version != protocol.V1 {
+		return protocol.NewErrMessageVersionIsNotSupported(message.Version)
+	}
+	if message.Variant != protocol.Nodes {
+		return protocol.NewErrMessageVariantIsNotSupported(message.Variant)
+	}
+	if from == nil {
+		return newErrAcceptingNodes(fmt.Errorf("unknown sender"))
+	}
+
+	target, data, err := unmarshalNodes(message.Body)
+	if err != nil {
+		return newErrAcceptingNodes(err)
+	}
+	addrs := make(protocol.PeerAddresses, 0, len(data))
+	for _, d := range data {
+		addr, err := finder.codec.Decode(d)
+		if err != nil {
+			return newErrAcceptingNodes(fmt.Errorf("error decoding address: %v", err))
+		}
+		addrs = append(addrs, addr)
+	}
+
+	finder.mu.Lock()
+	defer finder.mu.Unlock()
+
+	for l := range finder.lookups[target] {
+		if _, ok := l.asked[from.String()]; !ok {
+			continue
+		}
+		// Never block the caller, which is usually the event loop of the
+		// peer. The lookup times out waiting for dropped responses.
+		select {
+		case l.responses <- response{from: from, addrs: addrs}:
+		default:
+			finder.logger.Warnf("dropping nodes from peer=%v: lookup of peer=%v is not reading fast enough", from, target)
+		}
+	}
+	return nil
+}
+
+func (finder *nodeFinder) register(target protocol.PeerID, l *lookup) {
+	finder.mu.Lock()
+	defer finder.mu.Unlock()
+
+	if _, ok := finder.lookups[target.String()]; !ok {
+		finder.lookups[target.String()] = map[*lookup]struct{}{}
+	}
+	finder.lookups[target.String()][l] = struct{}{}
+}
+
+func (finder *nodeFinder) unregister(target protocol.PeerID, l *lookup) {
+	finder.mu.Lock()
+	defer finder.mu.Unlock()
+
+	delete(finder.lookups[target.String()], l)
+	if len(finder.lookups[target.String()]) == 0 {
+		delete(finder.lookups, target.String())
+	}
+}
+
+// peerID is the target of a FindNode message. Distances only depend on the
+// string representation of a PeerID, so the target does not need to be decoded
+// into the PeerID implementation used by the network.
+type peerID string
+
+func (id peerID) String() string {
+	return string(id)
+}
+
+func (id peerID) Equal(another protocol.PeerID) bool {
+	return another != nil && id.String() == another.String()
+}
+
+// The body of a FindNode message is the target PeerID followed by the encoded
+// address of the sender.
+func marshalFindNode(target protocol.PeerID, addr []byte) ([]byte, error) {
+	buffer := new(bytes.Buffer)
+	if err := writeBytes(buffer, []byte(target.String())); err != nil {
+		return nil, fmt.Errorf("error marshaling target: %v", err)
+	}
+	if err := writeBytes(buffer, addr); err != nil {
+		return nil, fmt.Errorf("error marshaling address: %v", err)
+	}
+	return buffer.Bytes(), nil
+}
+
+func unmarshalFindNode(data []byte) (string, []byte, error) {
+	buffer := bytes.NewBuffer(data)
+	target, err := readBytes(buffer)
+	if err != nil {
+		return "", nil, fmt.Errorf("error unmarshaling target: %v", err)
+	}
+	addr, err := readBytes(buffer)
+	if err != nil {
+		return "", nil, fmt.Errorf("error unmarshaling address: %v", err)
+	}
+	if buffer.Len() != 0 {
+		return "", nil, fmt.Errorf("error unmarshaling findnode: %v trailing bytes", buffer.Len())
+	}
+	return string(target), addr, nil
+}
+
+// The body of a Nodes message is the target PeerID followed by the number of
+// encoded addresses, and the addresses.
+func marshalNodes(target string, addrs [][]byte) ([]byte, error) {
+	buffer := new(bytes.Buffer)
+	if err := writeBytes(buffer, []byte(target)); err != nil {
+		return nil, fmt.Errorf("error marshaling target: %v", err)
+	}
+	if err := binary.Write(buffer, binary.LittleEndian, uint32(len(addrs))); err != nil {
+		return nil, fmt.Errorf("error marshaling number of addresses: %v", err)
+	}
+	for _, addr := range addrs {
+		if err := writeBytes(buffer, addr); err != nil {
+			return nil, fmt.Errorf("error marshaling address: %v", err)
+		}
+	}
+	return buffer.Bytes(), nil
+}
+
+func unmarshalNodes(data []byte) (string, [][]byte, error) {
+	buffer := bytes.NewBuffer(data)
+	target, err := readBytes(buffer)
+	if err != nil {
+		return "", nil, fmt.Errorf("error unmarshaling target: %v", err)
+	}
+	numAddrs := uint32(0)
+	if err := binary.Read(buffer, binary.LittleEndian, &numAddrs); err != nil {
+		return "", nil, fmt.Errorf("error unmarshaling number of addresses: %v", err)
+	}
+	// Every address takes at least 4 bytes, so the number of addresses
+	// cannot exceed the remaining bytes.
+	if int(numAddrs) > buffer.Len()/4 {
+		return "", nil, fmt.Errorf("error unmarshaling nodes: expected at most %v addresses, got %v", buffer.Len()/4, numAddrs)
+	}
+	addrs := make([][]byte, 0, numAddrs)
+	for i := uint32(0); i < numAddrs; i++ {
+		addr, err := readBytes(buffer)
+		if err != nil {
+			return "", nil, fmt.Errorf("error unmarshaling address: %v", err)
+		}
+		addrs = append(addrs, addr)
+	}
+	if buffer.Len() != 0 {
+		return "", nil, fmt.Errorf("error unmarshaling nodes: %v trailing bytes", buffer.Len())
+	}
+	return string(target), addrs, nil
+}
+
+func writeBytes(buffer *bytes.Buffer, data []byte) error {
+	if err := binary.Write(buffer, binary.LittleEndian, uint32(len(data))); err != nil {
+		return err
+	}
+	_, err := buffer.Write(data)
+	return err
+}
+
+func readBytes(buffer *bytes.Buffer) ([]byte, error) {
+	length := uint32(0)
+	if err := binary.Read(buffer, binary.LittleEndian, &length); err != nil {
+		return nil, err
+	}
+	if int(length) > buffer.Len() {
+		return nil, fmt.Errorf("expected len<=%v, got len=%v", buffer.Len(), length)
+	}
+	return buffer.Next(int(length)), nil
+}
+
+// ErrNodeNotFound is returned when a lookup ends without finding the target.
+type ErrNodeNotFound struct {
+	error
+	Target protocol.PeerID
+}
+
+func newErrNodeNotFound(target protocol.PeerID) error {
+	return ErrNodeNotFound{
+		error:  fmt.Errorf("error finding node: peer=%v not found", target),
+		Target: target,
+	}
+}
+
+func (err ErrNodeNotFound) Is(target error) bool {
+	return target == protocol.ErrNotFound
+}
+
+// ErrFindingNode is returned when there is an error when finding a node.
+type ErrFindingNode struct {
+	error
+	Target protocol.PeerID
+	cause  error
+}
+
+func newErrFindingNode(err error, target protocol.PeerID) error {
+	return ErrFindingNode{
+		error:  fmt.Errorf("error finding node peer=%v: %v", target, err),
+		Target: target,
+		cause:  err,
+	}
+}
+
+func (err ErrFindingNode) Unwrap() error {
+	return err.cause
+}
+
+// ErrAcceptingFindNode is returned when there is an error when accepting a
+// FindNode message.
+type ErrAcceptingFindNode struct {
+	error
+}
+
+func newErrAcceptingFindNode(err error) error {
+	return ErrAcceptingFindNode{
+		error: fmt.Errorf("error accepting findnode: %v", err),
+	}
+}
+
+// ErrAcceptingNodes is returned when there is an error when accepting a Nodes
+// message.
+type ErrAcceptingNodes struct {
+	error
+}
+
+func newErrAcceptingNodes(err error) error {
+	return ErrAcceptingNodes{
+		error: fmt.Errorf("error accepting nodes: %v", err),
+	}
+}
@@ -0,0 +1,13 @@
+package findnode_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestFindnode(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Findnode Suite")
+}
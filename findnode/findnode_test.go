@@ -0,0 +1,177 @@
+package findnode_test
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/findnode"
+	. "github.com/renproject/aw/testutil"
+
+	"github.com/renproject/aw/dht"
+	"github.com/renproject/aw/protocol"
+	"github.com/sirupsen/logrus"
+)
+
+var TestOptions = Options{
+	Logger:  logrus.New(),
+	K:       4,
+	Alpha:   2,
+	Timeout: 100 * time.Millisecond,
+}
+
+type node struct {
+	addr     SimpleTCPPeerAddress
+	dht      dht.DHT
+	finder   NodeFinder
+	messages chan protocol.MessageOnTheWire
+}
+
+// newNetwork returns n nodes that only know the next node, so that a node can
+// only be found by walking through all of the nodes before it. Messages are
+// routed between the nodes until the context is done.
+func newNetwork(ctx context.Context, n int) []node {
+	nodes := make([]node, n)
+	for i := range nodes {
+		nodes[i].addr = NewSimpleTCPPeerAddress(fmt.Sprintf("node-%d", i), "127.0.0.1", fmt.Sprintf("%d", 46532+i))
+		nodes[i].dht = NewDHT(nodes[i].addr, NewTable(fmt.Sprintf("dht-%d", i)), nil)
+		nodes[i].messages = make(chan protocol.MessageOnTheWire, 128)
+		nodes[i].finder = NewNodeFinder(TestOptions, nodes[i].dht, nodes[i].messages, SimpleTCPPeerAddressCodec{})
+	}
+	for i := 0; i < n-1; i++ {
+		Expect(nodes[i].dht.AddPeerAddress(nodes[i+1].addr)).To(Succeed())
+	}
+
+	byID := map[string]node{}
+	for _, node := range nodes {
+		byID[node.addr.ID.String()] = node
+	}
+	for _, from := range nodes {
+		go func(from node) {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case messageOtw := <-from.messages:
+					to, ok := byID[messageOtw.To.PeerID().String()]
+					if !ok {
+						continue
+					}
+					switch messageOtw.Message.Variant {
+					case protocol.FindNode:
+						_ = to.finder.AcceptFindNode(ctx, from.addr.ID, messageOtw.Message)
+					case protocol.Nodes:
+						_ = to.finder.AcceptNodes(ctx, from.addr.ID, messageOtw.Message)
+					}
+				}
+			}
+		}(from)
+	}
+	return nodes
+}
+
+var _ = Describe("FindNode", func() {
+	Context("when the dht has the target PeerAddress", func() {
+		It("should return it without sending any message", func() {
+			me := RandomAddress()
+			messages := make(chan protocol.MessageOnTheWire, 128)
+			table := NewDHT(me, NewTable("dht"), nil)
+			finder := NewNodeFinder(TestOptions, table, messages, SimpleTCPPeerAddressCodec{})
+
+			target := RandomAddress()
+			Expect(table.AddPeerAddress(target)).To(Succeed())
+
+			addr, err := finder.FindNode(context.Background(), target.ID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(addr.Equal(target)).To(BeTrue())
+			Expect(messages).To(BeEmpty())
+		})
+	})
+
+	Context("when the target is only known by other peers", func() {
+		It("should iteratively ask the closest peers until it is found", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			nodes := newNetwork(ctx, 8)
+			target := nodes[len(nodes)-1].addr
+			_, err := nodes[0].dht.PeerAddress(target.ID)
+			Expect(err).To(HaveOccurred())
+
+			addr, err := nodes[0].finder.FindNode(ctx, target.ID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(addr.Equal(target)).To(BeTrue())
+
+			// The target is added to the dht
+			addr, err = nodes[0].dht.PeerAddress(target.ID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(addr.Equal(target)).To(BeTrue())
+		})
+	})
+
+	Context("when no peer knows the target", func() {
+		It("should return an ErrNodeNotFound", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			nodes := newNetwork(ctx, 4)
+			_, err := nodes[0].finder.FindNode(ctx, RandomPeerID())
+			Expect(err).To(HaveOccurred())
+			_, ok := err.(ErrNodeNotFound)
+			Expect(ok).To(BeTrue())
+		})
+	})
+
+	Context("when the context is done", func() {
+		It("should return an error", func() {
+			me := RandomAddress()
+			messages := make(chan protocol.MessageOnTheWire)
+			table := NewDHT(me, NewTable("dht"), nil)
+			Expect(table.AddPeerAddress(RandomAddress())).To(Succeed())
+			finder := NewNodeFinder(TestOptions, table, messages, SimpleTCPPeerAddressCodec{})
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			_, err := finder.FindNode(ctx, RandomPeerID())
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
+
+var _ = Describe("AcceptFindNode", func() {
+	Context("when the requester address does not belong to the sender", func() {
+		It("should return an error without responding", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			requester := RandomAddress()
+			requests := make(chan protocol.MessageOnTheWire, 1)
+			requesterTable := NewDHT(requester, NewTable("requester"), nil)
+			Expect(requesterTable.AddPeerAddress(RandomAddress())).To(Succeed())
+			go NewNodeFinder(TestOptions, requesterTable, requests, SimpleTCPPeerAddressCodec{}).FindNode(ctx, RandomPeerID())
+			var request protocol.MessageOnTheWire
+			Eventually(requests).Should(Receive(&request))
+
+			messages := make(chan protocol.MessageOnTheWire, 1)
+			finder := NewNodeFinder(TestOptions, NewDHT(RandomAddress(), NewTable("dht"), nil), messages, SimpleTCPPeerAddressCodec{})
+			Expect(finder.AcceptFindNode(ctx, RandomPeerID(), request.Message)).NotTo(Succeed())
+			Expect(messages).To(BeEmpty())
+		})
+	})
+
+	Context("when the message is malformed", func() {
+		It("should return an error", func() {
+			me := RandomAddress()
+			messages := make(chan protocol.MessageOnTheWire, 1)
+			finder := NewNodeFinder(TestOptions, NewDHT(me, NewTable("dht"), nil), messages, SimpleTCPPeerAddressCodec{})
+
+			message := protocol.NewMessage(protocol.V1, protocol.FindNode, protocol.NilGroupID, []byte("malformed"))
+			Expect(finder.AcceptFindNode(context.Background(), RandomPeerID(), message)).NotTo(Succeed())
+			message = protocol.NewMessage(protocol.V1, protocol.Nodes, protocol.NilGroupID, []byte("malformed"))
+			Expect(finder.AcceptNodes(context.Background(), RandomPeerID(), message)).NotTo(Succeed())
+			Expect(messages).To(BeEmpty())
+		})
+	})
+})
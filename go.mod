@@ -4,19 +4,23 @@ go 1.12
 
 require (
 	github.com/AndreasBriese/bbloom v0.0.0-20190825152654-46b345b51c96 // indirect
+	github.com/btcsuite/btcd v0.0.0-20171128150713-2e60448ffcc6 // indirect
 	github.com/dgryski/go-farm v0.0.0-20191112170834-c2139c5d712b // indirect
 	github.com/ethereum/go-ethereum v1.9.2
 	github.com/golang/groupcache v0.0.0-20191027212112-611e8accdfc9 // indirect
 	github.com/golang/protobuf v1.3.2 // indirect
-	github.com/golang/snappy v0.0.1 // indirect
+	github.com/golang/snappy v0.0.1
 	github.com/google/go-cmp v0.3.1
+	github.com/klauspost/cpuid/v2 v2.0.12 // indirect
 	github.com/onsi/ginkgo v1.9.0
 	github.com/onsi/gomega v1.7.0
+	github.com/prometheus/client_golang v1.2.1
 	github.com/renproject/id v0.1.1
 	github.com/renproject/kv v1.1.0
 	github.com/renproject/phi v0.1.0
 	github.com/sirupsen/logrus v1.4.2
 	golang.org/x/crypto v0.0.0-20191112222119-e1110fd1c708
-	golang.org/x/net v0.0.0-20191112182307-2180aed22343 // indirect
+	golang.org/x/net v0.0.0-20191112182307-2180aed22343
 	golang.org/x/sys v0.0.0-20191113165036-4c7a9d0fe056 // indirect
+	lukechampine.com/blake3 v1.1.6
 )
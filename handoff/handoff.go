@@ -0,0 +1,161 @@
+package handoff
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+
+	"github.com/renproject/aw/broadcast"
+	"github.com/renproject/aw/tcp"
+)
+
+// envListeners is the environment variable that tells a process that it was
+// started by a handoff, and how many listeners were handed off to it.
+const envListeners = "AW_HANDOFF_LISTENERS"
+
+// The files that are handed off are passed to the new process after the
+// standard input, output and error.
+const (
+	stateFD     = 3
+	readyFD     = 4
+	listenersFD = 5
+)
+
+// State is the minimal runtime state of a Peer that is handed off to the
+// process that replaces it during a restart, so that the new process keeps the
+// network position of the Peer.
+type State struct {
+	PeerAddresses [][]byte        `json:"peerAddresses"` // Encoded by the PeerAddressCodec of the Peer
+	Broadcaster   broadcast.State `json:"broadcaster"`
+}
+
+// Start the process that replaces this one during a restart (e.g. to upgrade
+// the binary), and hand off the files of its listeners and its State. The
+// command must not have been started, and its ExtraFiles must not be set. It
+// returns once the new process is Ready, after which this process should stop
+// without waiting for its connections to be closed by its peers. The new
+// process is killed if it is not Ready before the context is done.
+//
+// Because the listening sockets are shared by both processes, connections that
+// are waiting to be accepted are not dropped. Established connections are
+// closed when this process stops, and are re-established by the peers.
+func Start(ctx context.Context, cmd *exec.Cmd, files []*os.File, state State) error {
+	stateReader, stateWriter, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("error opening state pipe: %v", err)
+	}
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		stateReader.Close()
+		stateWriter.Close()
+		return fmt.Errorf("error opening ready pipe: %v", err)
+	}
+	defer readyReader.Close()
+
+	cmd.ExtraFiles = append([]*os.File{stateReader, readyWriter}, files...)
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, fmt.Sprintf("%v=%d", envListeners, len(files)))
+	err = cmd.Start()
+	// The new process has its own copies of the files
+	stateReader.Close()
+	readyWriter.Close()
+	if err != nil {
+		stateWriter.Close()
+		return fmt.Errorf("error starting process: %v", err)
+	}
+
+	written := make(chan error, 1)
+	go func() {
+		defer stateWriter.Close()
+		written <- json.NewEncoder(stateWriter).Encode(state)
+	}()
+	ready := make(chan error, 1)
+	go func() {
+		_, err := readyReader.Read(make([]byte, 1))
+		ready <- err
+	}()
+
+	select {
+	case <-ctx.Done():
+		cmd.Process.Kill()
+		go cmd.Wait()
+		return fmt.Errorf("error waiting for process=%v to be ready: %v", cmd.Process.Pid, ctx.Err())
+	case err := <-ready:
+		if err != nil {
+			go cmd.Wait()
+			return fmt.Errorf("process=%v stopped before it was ready: %v", cmd.Process.Pid, err)
+		}
+	}
+	if err := <-written; err != nil {
+		return fmt.Errorf("error writing state: %v", err)
+	}
+	return nil
+}
+
+// A Handoff is the listeners and State handed off to a process by the process
+// that it replaces.
+type Handoff struct {
+	Listeners []net.Listener
+	State     State
+
+	ready *os.File
+}
+
+// Inherit returns the Handoff of the process that started this one, or nil if
+// this process was not started by a handoff. The Listeners should be used as
+// the Listeners of the tcp.ServerOptions, and the State as the Handoff of the
+// peer.Options. Ready must be called once the Peer is running.
+func Inherit() (*Handoff, error) {
+	value, ok := os.LookupEnv(envListeners)
+	if !ok {
+		return nil, nil
+	}
+	os.Unsetenv(envListeners)
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid %v=%v", envListeners, value)
+	}
+
+	stateFile := os.NewFile(stateFD, "handoff-state")
+	defer stateFile.Close()
+	ready := os.NewFile(readyFD, "handoff-ready")
+	files := make([]*os.File, n)
+	for i := range files {
+		files[i] = os.NewFile(uintptr(listenersFD+i), fmt.Sprintf("handoff-listener-%d", i))
+	}
+	listeners, err := tcp.FileListeners(files...)
+	if err != nil {
+		ready.Close()
+		return nil, err
+	}
+
+	state := State{}
+	if err := json.NewDecoder(stateFile).Decode(&state); err != nil {
+		ready.Close()
+		for _, listener := range listeners {
+			listener.Close()
+		}
+		return nil, fmt.Errorf("error reading state: %v", err)
+	}
+
+	return &Handoff{
+		Listeners: listeners,
+		State:     state,
+		ready:     ready,
+	}, nil
+}
+
+// Ready tells the process that handed off to this one that it can stop.
+func (handoff *Handoff) Ready() error {
+	defer handoff.ready.Close()
+	if _, err := handoff.ready.Write([]byte{1}); err != nil {
+		return fmt.Errorf("error signalling ready: %v", err)
+	}
+	return nil
+}
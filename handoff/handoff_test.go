@@ -0,0 +1,113 @@
+package handoff_test
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/handoff"
+
+	"github.com/renproject/aw/broadcast"
+	"github.com/renproject/id"
+)
+
+var _ = Describe("Handoff", func() {
+	Context("when handing off to a new process", func() {
+		It("should hand off the listeners and the state", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+			file, err := listener.(*net.TCPListener).File()
+			Expect(err).NotTo(HaveOccurred())
+			state := State{
+				PeerAddresses: [][]byte{[]byte("peer")},
+				Broadcaster:   broadcast.State{Seen: []id.Hash{{1}}, Pending: []broadcast.PendingState{}},
+			}
+
+			cmd := newHandoffProcess("echo")
+			Expect(Start(ctx, cmd, []*os.File{file}, state)).To(Succeed())
+			defer cmd.Wait()
+
+			// Stop listening, and expect the new process to accept the
+			// connections to the listener
+			Expect(file.Close()).To(Succeed())
+			Expect(listener.Close()).To(Succeed())
+			conn, err := net.Dial("tcp", listener.Addr().String())
+			Expect(err).NotTo(HaveOccurred())
+			defer conn.Close()
+			inherited := State{}
+			Expect(json.NewDecoder(conn).Decode(&inherited)).To(Succeed())
+			Expect(inherited).To(Equal(state))
+		})
+
+		It("should return an error if the new process stops before it is ready", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			Expect(Start(ctx, newHandoffProcess("exit"), nil, State{})).NotTo(Succeed())
+		})
+
+		It("should return an error if the new process is not ready before the context is done", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+			defer cancel()
+
+			Expect(Start(ctx, newHandoffProcess("hang"), nil, State{})).NotTo(Succeed())
+		})
+	})
+
+	Context("when the process was not started by a handoff", func() {
+		It("should not inherit anything", func() {
+			handoff, err := Inherit()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(handoff).To(BeNil())
+		})
+	})
+})
+
+// newHandoffProcess returns a command that runs this test binary as the new
+// process of a handoff (see TestHandoffProcess).
+func newHandoffProcess(behaviour string) *exec.Cmd {
+	cmd := exec.Command(os.Args[0], "-test.run=TestHandoffProcess")
+	cmd.Env = append(os.Environ(), "HANDOFF_TEST_PROCESS="+behaviour)
+	return cmd
+}
+
+// TestHandoffProcess is not a real test. It is run as the new process of a
+// handoff, and writes the inherited state to the first connection accepted by
+// the inherited listener.
+func TestHandoffProcess(t *testing.T) {
+	switch os.Getenv("HANDOFF_TEST_PROCESS") {
+	case "":
+		return
+	case "exit":
+		os.Exit(1)
+	case "hang":
+		time.Sleep(time.Minute)
+		os.Exit(1)
+	}
+
+	handoff, err := Inherit()
+	if err != nil || handoff == nil || len(handoff.Listeners) != 1 {
+		os.Exit(2)
+	}
+	if err := handoff.Ready(); err != nil {
+		os.Exit(3)
+	}
+	conn, err := handoff.Listeners[0].Accept()
+	if err != nil {
+		os.Exit(4)
+	}
+	if err := json.NewEncoder(conn).Encode(handoff.State); err != nil {
+		os.Exit(5)
+	}
+	conn.Close()
+	os.Exit(0)
+}
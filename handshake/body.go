@@ -0,0 +1,202 @@
+package handshake
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/renproject/aw/protocol"
+)
+
+// bodyUncompressed is the flag of message bodies that are not compressed by a
+// bodyCompressedSession. Compressed bodies are flagged by their Compression.
+const bodyUncompressed = byte(0)
+
+// isBodyCompression returns true if the Compression compresses the body of
+// every message, instead of the whole stream.
+func isBodyCompression(compression Compression) bool {
+	return compression == CompressionBodyGzip || compression == CompressionBodySnappy
+}
+
+// A bodyCompressedSession compresses the body of every message before it is
+// written by the inner Session, and decompresses it after it is read, so that
+// bodies are compressed before they are encrypted. Every body is prefixed by a
+// flag, that is the Compression of the body, or bodyUncompressed if the body
+// is shorter than the threshold, or does not compress. The length of the
+// message is the length of the flagged body on the wire, and the length of the
+// decompressed body once it is read.
+type bodyCompressedSession struct {
+	protocol.IdentifiedSession
+
+	compression Compression
+	threshold   int
+
+	maxMessageLength     int
+	maxDecompressionTime time.Duration
+
+	mu         *sync.Mutex
+	stats      CompressionStats
+	gzipWriter *gzip.Writer
+}
+
+func (session *bodyCompressedSession) Compression() Compression {
+	return session.compression
+}
+
+func (session *bodyCompressedSession) Duplex() bool {
+	return IsDuplex(session.IdentifiedSession)
+}
+
+func (session *bodyCompressedSession) CompressionStats() CompressionStats {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	return session.stats
+}
+
+func (session *bodyCompressedSession) WriteMessage(w io.Writer, message protocol.Message) error {
+	body, err := session.compress(message.Body)
+	if err != nil {
+		return err
+	}
+	message.Body = body
+	message.Length = protocol.MessageLength(message.NonBodyLength() + len(body))
+	return session.IdentifiedSession.WriteMessage(w, message)
+}
+
+func (session *bodyCompressedSession) ReadMessageOnTheWire(r io.Reader) (protocol.MessageOnTheWire, error) {
+	otw, err := session.IdentifiedSession.ReadMessageOnTheWire(r)
+	if err != nil {
+		return otw, err
+	}
+	body, err := session.decompress(otw.Message.Body, otw.Message.NonBodyLength())
+	if err != nil {
+		return otw, err
+	}
+	otw.Message.Body = body
+	otw.Message.Length = protocol.MessageLength(otw.Message.NonBodyLength() + len(body))
+	return otw, nil
+}
+
+// compress the body, and flag it. Bodies that are shorter than the threshold,
+// or that are not shorter once they are compressed, are only flagged.
+func (session *bodyCompressedSession) compress(body protocol.MessageBody) (protocol.MessageBody, error) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	session.stats.UncompressedBytesWritten += uint64(len(body))
+	if len(body) >= session.threshold {
+		start := time.Now()
+		compressed := bytes.NewBuffer([]byte{byte(session.compression)})
+		switch session.compression {
+		case CompressionBodyGzip:
+			if session.gzipWriter == nil {
+				session.gzipWriter = gzip.NewWriter(compressed)
+			} else {
+				session.gzipWriter.Reset(compressed)
+			}
+			if _, err := session.gzipWriter.Write(body); err != nil {
+				return nil, fmt.Errorf("error compressing message body: %v", err)
+			}
+			if err := session.gzipWriter.Close(); err != nil {
+				return nil, fmt.Errorf("error compressing message body: %v", err)
+			}
+		case CompressionBodySnappy:
+			compressed.Write(snappy.Encode(nil, body))
+		}
+		session.stats.CompressionTime += time.Since(start)
+		if compressed.Len() < len(body)+1 {
+			session.stats.CompressedBytesWritten += uint64(compressed.Len())
+			return compressed.Bytes(), nil
+		}
+	}
+
+	flagged := make(protocol.MessageBody, 1+len(body))
+	flagged[0] = bodyUncompressed
+	copy(flagged[1:], body)
+	session.stats.CompressedBytesWritten += uint64(len(flagged))
+	return flagged, nil
+}
+
+// decompress the flagged body of a message with the given non-body length.
+// Bodies that would exceed the maximum message length once they are
+// decompressed, or that take longer than the maximum decompression time to
+// decompress, are rejected.
+func (session *bodyCompressedSession) decompress(body protocol.MessageBody, nonBodyLength int) (protocol.MessageBody, error) {
+	if len(body) == 0 {
+		return nil, fmt.Errorf("error reading compressed message body from peer=%v: expected flag", session.PeerID())
+	}
+	maxLength := session.maxMessageLength - nonBodyLength
+
+	var decompressed protocol.MessageBody
+	start := time.Now()
+	switch flag := body[0]; {
+	case flag == bodyUncompressed:
+		decompressed = body[1:]
+	case flag == byte(session.compression) && session.compression == CompressionBodyGzip:
+		reader, err := gzip.NewReader(bytes.NewReader(body[1:]))
+		if err != nil {
+			return nil, fmt.Errorf("error decompressing message body from peer=%v: %v", session.PeerID(), err)
+		}
+		data, err := ioutil.ReadAll(&timedReader{r: io.LimitReader(reader, int64(maxLength)+1), start: start, maxTime: session.maxDecompressionTime})
+		if err != nil {
+			if err == errDecompressionTooSlow {
+				return nil, newErrDecompressionTooSlow(session.PeerID(), session.maxDecompressionTime)
+			}
+			return nil, fmt.Errorf("error decompressing message body from peer=%v: %v", session.PeerID(), err)
+		}
+		if len(data) > maxLength {
+			return nil, newErrDecompressedMessageTooLarge(session.PeerID(), protocol.MessageLength(nonBodyLength+len(data)), session.maxMessageLength)
+		}
+		decompressed = data
+	case flag == byte(session.compression) && session.compression == CompressionBodySnappy:
+		length, err := snappy.DecodedLen(body[1:])
+		if err != nil {
+			return nil, fmt.Errorf("error decompressing message body from peer=%v: %v", session.PeerID(), err)
+		}
+		if length > maxLength {
+			return nil, newErrDecompressedMessageTooLarge(session.PeerID(), protocol.MessageLength(nonBodyLength+length), session.maxMessageLength)
+		}
+		data, err := snappy.Decode(nil, body[1:])
+		if err != nil {
+			return nil, fmt.Errorf("error decompressing message body from peer=%v: %v", session.PeerID(), err)
+		}
+		decompressed = data
+	default:
+		return nil, fmt.Errorf("error reading compressed message body from peer=%v: unexpected flag=%v", session.PeerID(), flag)
+	}
+	elapsed := time.Since(start)
+	if elapsed > session.maxDecompressionTime {
+		return nil, newErrDecompressionTooSlow(session.PeerID(), session.maxDecompressionTime)
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	session.stats.CompressedBytesRead += uint64(len(body))
+	session.stats.UncompressedBytesRead += uint64(len(decompressed))
+	session.stats.DecompressionTime += elapsed
+	return decompressed, nil
+}
+
+var errDecompressionTooSlow = fmt.Errorf("decompression too slow")
+
+// A timedReader returns errDecompressionTooSlow once the maximum time has
+// passed since the start.
+type timedReader struct {
+	r       io.Reader
+	start   time.Time
+	maxTime time.Duration
+}
+
+func (reader *timedReader) Read(p []byte) (int, error) {
+	if time.Since(reader.start) > reader.maxTime {
+		return 0, errDecompressionTooSlow
+	}
+	return reader.r.Read(p)
+}
@@ -0,0 +1,357 @@
+package handshake
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/renproject/aw/protocol"
+)
+
+// A Compression identifies the algorithm used to compress the whole stream of
+// a Session, or the body of every message. Unlike compressing each message,
+// compressing the stream also compresses message headers and the redundancy
+// between messages, which matters most when many small messages are sent.
+// Encrypted message bodies do not compress, so bodies are compressed before
+// they are encrypted, which matters most when large messages are sent.
+type Compression uint8
+
+const (
+	// CompressionNone does not compress the stream.
+	CompressionNone = Compression(1)
+
+	// CompressionSnappy compresses the stream using the snappy framing format.
+	CompressionSnappy = Compression(2)
+
+	// CompressionBodyGzip compresses the body of every message using gzip.
+	CompressionBodyGzip = Compression(3)
+
+	// CompressionBodySnappy compresses the body of every message using the
+	// snappy block format, which is faster than gzip, but compresses less.
+	CompressionBodySnappy = Compression(4)
+)
+
+// String implements the `fmt.Stringer` interface.
+func (compression Compression) String() string {
+	switch compression {
+	case CompressionNone:
+		return "none"
+	case CompressionSnappy:
+		return "snappy"
+	case CompressionBodyGzip:
+		return "body-gzip"
+	case CompressionBodySnappy:
+		return "body-snappy"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(compression))
+	}
+}
+
+// Compressions is a list of Compression, usually in order of preference.
+type Compressions []Compression
+
+// Contains returns true if the Compression is in the list.
+func (compressions Compressions) Contains(compression Compression) bool {
+	for _, c := range compressions {
+		if c == compression {
+			return true
+		}
+	}
+	return false
+}
+
+// CompressionStats can be used to evaluate the trade-off between CPU usage and
+// bandwidth of a compressed Session. Time is only spent in the compression
+// codec, and excludes reading/writing the connection and decrypting/encrypting
+// messages.
+type CompressionStats struct {
+	UncompressedBytesWritten uint64
+	CompressedBytesWritten   uint64
+	CompressedBytesRead      uint64
+	UncompressedBytesRead    uint64
+	CompressionTime          time.Duration
+	DecompressionTime        time.Duration
+}
+
+// A CompressedSession is a Session that compresses the whole stream.
+type CompressedSession interface {
+	protocol.IdentifiedSession
+
+	Compression() Compression
+	CompressionStats() CompressionStats
+}
+
+// Write the supported compressions and read the compression selected by the
+// server.
+func (hs *handshaker) proposeCompression(rw io.ReadWriter) (Compression, error) {
+	proposal := make([]byte, len(hs.options.Compressions))
+	for i, compression := range hs.options.Compressions {
+		proposal[i] = byte(compression)
+	}
+	if err := write(rw, proposal); err != nil {
+		return 0, fmt.Errorf("error writing compressions to io.Writer: %v", err)
+	}
+	selected, err := read(rw)
+	if err != nil {
+		return 0, fmt.Errorf("error reading compression from io.Reader: %v", err)
+	}
+	if len(selected) != 1 || !hs.options.Compressions.Contains(Compression(selected[0])) {
+		return 0, fmt.Errorf("error negotiating compression: no common compression in local compressions=%v", hs.options.Compressions)
+	}
+	return Compression(selected[0]), nil
+}
+
+// Read the compressions supported by the client and write the one most
+// preferred by the client that is also supported locally. The compression
+// applies in both directions.
+func (hs *handshaker) selectCompression(rw io.ReadWriter) (Compression, error) {
+	proposal, err := read(rw)
+	if err != nil {
+		return 0, fmt.Errorf("error reading compressions from io.Reader: %v", err)
+	}
+	for _, b := range proposal {
+		compression := Compression(b)
+		if !hs.options.Compressions.Contains(compression) {
+			continue
+		}
+		if err := write(rw, []byte{byte(compression)}); err != nil {
+			return 0, fmt.Errorf("error writing compression to io.Writer: %v", err)
+		}
+		return compression, nil
+	}
+	if err := write(rw, []byte{}); err != nil {
+		return 0, fmt.Errorf("error writing compression to io.Writer: %v", err)
+	}
+	return 0, fmt.Errorf("error negotiating compression: no common compression in local compressions=%v, remote compressions=%v", hs.options.Compressions, proposal)
+}
+
+func (hs *handshaker) compressSession(session protocol.IdentifiedSession, compression Compression) protocol.IdentifiedSession {
+	if isBodyCompression(compression) {
+		return &bodyCompressedSession{
+			IdentifiedSession: session,
+			compression:       compression,
+			threshold:         hs.options.BodyCompressionThreshold,
+
+			maxMessageLength:     hs.options.MaxDecompressedMessageLength,
+			maxDecompressionTime: hs.options.MaxDecompressionTime,
+
+			mu: new(sync.Mutex),
+		}
+	}
+	if compression != CompressionSnappy {
+		return session
+	}
+	return &snappySession{
+		IdentifiedSession: session,
+		mu:                new(sync.Mutex),
+
+		maxMessageLength:     hs.options.MaxDecompressedMessageLength,
+		maxDecompressionTime: hs.options.MaxDecompressionTime,
+	}
+}
+
+// A snappySession compresses everything written by the inner Session, and
+// decompresses everything read by it. The same session must always be used
+// with the same connection, because the decompressor reads ahead. Messages
+// that exceed the decompression limits are rejected, after which the stream is
+// corrupt and the connection must be closed.
+type snappySession struct {
+	protocol.IdentifiedSession
+
+	mu    *sync.Mutex
+	stats CompressionStats
+
+	maxMessageLength     int
+	maxDecompressionTime time.Duration
+
+	reader *meteredReader // Decompressed stream
+	source *meteredReader // Compressed stream
+
+	writer     *snappy.Writer
+	compressed *bytes.Buffer
+}
+
+func (session *snappySession) Compression() Compression {
+	return CompressionSnappy
+}
+
+func (session *snappySession) Duplex() bool {
+	return IsDuplex(session.IdentifiedSession)
+}
+
+func (session *snappySession) CompressionStats() CompressionStats {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	stats := session.stats
+	if session.reader != nil {
+		stats.CompressedBytesRead = session.source.bytesRead()
+		stats.UncompressedBytesRead = session.reader.bytesRead()
+		stats.DecompressionTime = session.decompressionTime()
+	}
+	return stats
+}
+
+func (session *snappySession) ReadMessageOnTheWire(r io.Reader) (protocol.MessageOnTheWire, error) {
+	session.mu.Lock()
+	if session.reader == nil {
+		session.source = &meteredReader{r: r}
+		session.reader = &meteredReader{r: snappy.NewReader(session.source)}
+	}
+	reader := &budgetReader{
+		session: session,
+		start:   session.decompressionTime(),
+	}
+	session.mu.Unlock()
+
+	// Read the length of the message before decompressing the rest of it, so
+	// that a message exceeding the limit is never decompressed (or allocated
+	// by the inner Session).
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return protocol.MessageOnTheWire{From: session.PeerID()}, err
+	}
+	length := protocol.MessageLength(binary.LittleEndian.Uint32(header))
+	trailer := 0
+	if uint32(length) == protocol.FrameMagic {
+		// Framed messages declare their length after the magic and the
+		// flags, and end with a checksum (see protocol.FrameMagic)
+		header = append(header, make([]byte, protocol.FrameHeaderLength)...)
+		if _, err := io.ReadFull(reader, header[4:]); err != nil {
+			return protocol.MessageOnTheWire{From: session.PeerID()}, err
+		}
+		length = protocol.MessageLength(binary.LittleEndian.Uint32(header[protocol.FrameHeaderLength:]))
+		trailer = protocol.FrameChecksumLength
+	}
+	if int64(length) > int64(session.maxMessageLength) {
+		return protocol.MessageOnTheWire{From: session.PeerID()}, newErrDecompressedMessageTooLarge(session.PeerID(), length, session.maxMessageLength)
+	}
+	// The length is the last field of the header, and it includes itself
+	limited := io.MultiReader(bytes.NewReader(header), io.LimitReader(reader, int64(length)-4+int64(trailer)))
+	otw, err := session.IdentifiedSession.ReadMessageOnTheWire(limited)
+	if reader.err != nil {
+		// Return the budget error itself, instead of the error wrapped by
+		// the inner Session, so that callers can check its type.
+		return otw, reader.err
+	}
+	return otw, err
+}
+
+// decompressionTime returns the total time spent in the decompressor. It must
+// only be called after the decompressor has been created.
+func (session *snappySession) decompressionTime() time.Duration {
+	return session.reader.timeReading() - session.source.timeReading()
+}
+
+func (session *snappySession) WriteMessage(w io.Writer, message protocol.Message) error {
+	uncompressed := new(bytes.Buffer)
+	if err := session.IdentifiedSession.WriteMessage(uncompressed, message); err != nil {
+		return err
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	if session.writer == nil {
+		session.compressed = new(bytes.Buffer)
+		session.writer = snappy.NewBufferedWriter(session.compressed)
+	}
+	session.compressed.Reset()
+	start := time.Now()
+	if _, err := session.writer.Write(uncompressed.Bytes()); err != nil {
+		return fmt.Errorf("error compressing message: %v", err)
+	}
+	if err := session.writer.Flush(); err != nil {
+		return fmt.Errorf("error compressing message: %v", err)
+	}
+	session.stats.CompressionTime += time.Since(start)
+	session.stats.UncompressedBytesWritten += uint64(uncompressed.Len())
+	session.stats.CompressedBytesWritten += uint64(session.compressed.Len())
+
+	n, err := w.Write(session.compressed.Bytes())
+	if n != session.compressed.Len() {
+		return fmt.Errorf("error writing message: expected n=%v, got n=%v", session.compressed.Len(), n)
+	}
+	return err
+}
+
+// A budgetReader reads a message from the decompressed stream of a
+// snappySession, and returns an error when the time spent decompressing the
+// message exceeds the budget of the session.
+type budgetReader struct {
+	session *snappySession
+	start   time.Duration
+	err     error
+}
+
+func (reader *budgetReader) Read(p []byte) (int, error) {
+	n, err := reader.session.reader.Read(p)
+	if reader.session.decompressionTime()-reader.start > reader.session.maxDecompressionTime {
+		reader.err = newErrDecompressionTooSlow(reader.session.PeerID(), reader.session.maxDecompressionTime)
+		return n, reader.err
+	}
+	return n, err
+}
+
+// A meteredReader counts the bytes read from the inner io.Reader, and the time
+// spent reading them. It is safe to get the counts while reading.
+type meteredReader struct {
+	n uint64 // Must be 64-bit aligned
+	d int64  // Must be 64-bit aligned
+	r io.Reader
+}
+
+func (reader *meteredReader) Read(p []byte) (int, error) {
+	start := time.Now()
+	n, err := reader.r.Read(p)
+	atomic.AddInt64(&reader.d, int64(time.Since(start)))
+	atomic.AddUint64(&reader.n, uint64(n))
+	return n, err
+}
+
+func (reader *meteredReader) bytesRead() uint64 {
+	return atomic.LoadUint64(&reader.n)
+}
+
+func (reader *meteredReader) timeReading() time.Duration {
+	return time.Duration(atomic.LoadInt64(&reader.d))
+}
+
+// ErrDecompressedMessageTooLarge is returned when a peer sends a compressed
+// message that exceeds the maximum message length once it is decompressed.
+type ErrDecompressedMessageTooLarge struct {
+	error
+	PeerID    protocol.PeerID
+	Length    protocol.MessageLength
+	MaxLength int
+}
+
+func newErrDecompressedMessageTooLarge(peerID protocol.PeerID, length protocol.MessageLength, maxLength int) error {
+	return ErrDecompressedMessageTooLarge{
+		error:     fmt.Errorf("decompressed message from peer=%v is too large: expected length<=%v, got length=%v", peerID, maxLength, length),
+		PeerID:    peerID,
+		Length:    length,
+		MaxLength: maxLength,
+	}
+}
+
+// ErrDecompressionTooSlow is returned when decompressing a message sent by a
+// peer takes longer than the maximum decompression time.
+type ErrDecompressionTooSlow struct {
+	error
+	PeerID  protocol.PeerID
+	MaxTime time.Duration
+}
+
+func newErrDecompressionTooSlow(peerID protocol.PeerID, maxTime time.Duration) error {
+	return ErrDecompressionTooSlow{
+		error:   fmt.Errorf("decompressing message from peer=%v took longer than %v", peerID, maxTime),
+		PeerID:  peerID,
+		MaxTime: maxTime,
+	}
+}
@@ -0,0 +1,74 @@
+package handshake
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/renproject/aw/protocol"
+)
+
+// Kinds of downgrades (see protocol.EventDowngraded).
+const (
+	DowngradeSuite     = "suite"     // A Suite that is weaker than the most preferred Suite was negotiated
+	DowngradeFraming   = "framing"   // An unframed message was read by a session that frames its messages
+	DowngradeHandshake = "handshake" // The legacy handshake was completed with a legacy peer (see LegacyHandshaker)
+)
+
+// ErrDowngrade is returned when a downgrade is refused (see
+// Options.RefuseDowngrades).
+type ErrDowngrade struct {
+	error
+	Kind       string
+	Preferred  string
+	Negotiated string
+}
+
+func newErrDowngrade(kind, preferred, negotiated string) error {
+	return ErrDowngrade{
+		error:      fmt.Errorf("refusing to downgrade %v from %v to %v", kind, preferred, negotiated),
+		Kind:       kind,
+		Preferred:  preferred,
+		Negotiated: negotiated,
+	}
+}
+
+// isSuiteDowngrade returns true if the Suite is weaker than the most preferred
+// Suite (see Suite.Strength).
+func (hs *handshaker) isSuiteDowngrade(suite Suite) bool {
+	return suite.Strength() < hs.suites[0].Strength()
+}
+
+// checkSuite refuses the Suite, and reports the refusal as a downgrade, if it
+// is a downgrade and downgrades are refused.
+func (hs *handshaker) checkSuite(suite Suite) error {
+	if !hs.isSuiteDowngrade(suite) {
+		return nil
+	}
+	if hs.options.RefuseDowngrades {
+		hs.downgraded(nil, DowngradeSuite, hs.suites[0].String(), suite.String(), true)
+		return newErrDowngrade(DowngradeSuite, hs.suites[0].String(), suite.String())
+	}
+	return nil
+}
+
+// checkSessionSuite reports the Suite of an established session as a
+// downgrade, once the remote peer is known.
+func (hs *handshaker) checkSessionSuite(session protocol.IdentifiedSession, suite Suite) {
+	if hs.isSuiteDowngrade(suite) {
+		hs.downgraded(session.PeerID(), DowngradeSuite, hs.suites[0].String(), suite.String(), false)
+	}
+}
+
+func (hs *handshaker) downgraded(peerID protocol.PeerID, kind, preferred, negotiated string, refused bool) {
+	if hs.options.Downgraded == nil {
+		return
+	}
+	hs.options.Downgraded(protocol.EventDowngraded{
+		Time:       time.Now(),
+		PeerID:     peerID,
+		Kind:       kind,
+		Preferred:  preferred,
+		Negotiated: negotiated,
+		Refused:    refused,
+	})
+}
@@ -0,0 +1,24 @@
+package handshake
+
+import "github.com/renproject/aw/protocol"
+
+// A DuplexSession is a Session that can read messages from, and write messages
+// to, the same connection at the same time, from different goroutines. Sessions
+// that are not full duplex can only be used to write messages on the side that
+// dialed the connection, and to read them on the side that accepted it.
+//
+// Sessions returned by NewInsecureSessionManager, NewHMACSessionManager and
+// NewDuplexGCMSessionManager are full duplex. Sessions returned by
+// NewGCMSessionManager are not, because their nonces are drawn from a single
+// stream that is shared by both directions.
+type DuplexSession interface {
+	protocol.IdentifiedSession
+
+	Duplex() bool
+}
+
+// IsDuplex returns true if the Session is full duplex.
+func IsDuplex(session protocol.Session) bool {
+	duplex, ok := session.(DuplexSession)
+	return ok && duplex.Duplex()
+}
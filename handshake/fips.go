@@ -0,0 +1,8 @@
+//go:build fips
+// +build fips
+
+package handshake
+
+// fipsBuild enables FIPS mode in all Handshakers when building with the "fips"
+// tag.
+const fipsBuild = true
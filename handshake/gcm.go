@@ -3,6 +3,9 @@ package handshake
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
+	cryptorand "crypto/rand"
+	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -25,7 +28,7 @@ func (gcmSessionManager) NewSession(peerID protocol.PeerID, key []byte) protocol
 
 func (gcmSessionManager) NewSessionKey() []byte {
 	key := [32]byte{}
-	n, err := rand.Read(key[:])
+	n, err := cryptorand.Read(key[:])
 	if n != 32 {
 		panic(fmt.Errorf("invariant violation: cannot generate session key: expected n=32, got n=%v", n))
 	}
@@ -60,6 +63,14 @@ func NewGCMSession(peerID protocol.PeerID, key [32]byte) protocol.Session {
 	}
 }
 
+func (session *gcmSession) PeerID() protocol.PeerID {
+	return session.peerID
+}
+
+func (session *gcmSession) Encrypted() bool {
+	return true
+}
+
 func (session *gcmSession) ReadMessageOnTheWire(r io.Reader) (protocol.MessageOnTheWire, error) {
 	otw := protocol.MessageOnTheWire{}
 	otw.From = session.peerID
@@ -76,7 +87,7 @@ func (session *gcmSession) ReadMessageOnTheWire(r io.Reader) (protocol.MessageOn
 	if err != nil {
 		return otw, err
 	}
-	length := otw.Message.Variant.NonBodyLength()
+	length := otw.Message.NonBodyLength()
 	otw.Message.Length = protocol.MessageLength(len(otw.Message.Body) + length)
 	return otw, nil
 }
@@ -88,7 +99,7 @@ func (session *gcmSession) WriteMessage(w io.Writer, message protocol.Message) e
 		return err
 	}
 	message.Body = session.gcm.Seal(nil, nonce, message.Body, nil)
-	length := message.Variant.NonBodyLength()
+	length := message.NonBodyLength()
 	message.Length = protocol.MessageLength(len(message.Body) + length)
 
 	data, err := message.MarshalBinary()
@@ -101,3 +112,120 @@ func (session *gcmSession) WriteMessage(w io.Writer, message protocol.Message) e
 	}
 	return err
 }
+
+type duplexGCMSessionManager struct {
+	gcmSessionManager
+	me protocol.PeerID
+}
+
+// NewDuplexGCMSessionManager returns a protocol.SessionManager that encrypts
+// messages with AES-GCM, like NewGCMSessionManager, but with sessions that are
+// full duplex. The messages sent in each direction are encrypted with their own
+// key, which is derived from the session key that is agreed during the
+// handshake and from the PeerID of the sender, and with nonces that are the
+// sequence numbers of the messages. The manager must be given the PeerID of the
+// local Peer. It is not compatible with NewGCMSessionManager.
+func NewDuplexGCMSessionManager(me protocol.PeerID) protocol.SessionManager {
+	return duplexGCMSessionManager{me: me}
+}
+
+func (manager duplexGCMSessionManager) NewSession(peerID protocol.PeerID, key []byte) protocol.Session {
+	return &duplexGCMSession{
+		peerID: peerID,
+		write:  newGCM(deriveGCMKey(key, manager.me)),
+		read:   newGCM(deriveGCMKey(key, peerID)),
+	}
+}
+
+// deriveGCMKey returns the key of the messages sent by the peer, so that the
+// messages sent in each direction are encrypted with different keys.
+func deriveGCMKey(key []byte, sender protocol.PeerID) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("aw/gcm/"))
+	mac.Write([]byte(sender.String()))
+	return mac.Sum(nil)
+}
+
+func newGCM(key []byte) cipher.AEAD {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(fmt.Errorf("invariant violation: cannot create cipher: %v", err))
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(fmt.Errorf("invariant violation: cannot create galios/counter mode: %v", err))
+	}
+	return gcm
+}
+
+type duplexGCMSession struct {
+	peerID protocol.PeerID
+	write  cipher.AEAD
+	read   cipher.AEAD
+
+	// Sequence numbers of the next messages written and read. They are used
+	// as the nonces of the messages, but are not sent.
+	writeSeq uint64
+	readSeq  uint64
+}
+
+func (session *duplexGCMSession) PeerID() protocol.PeerID {
+	return session.peerID
+}
+
+func (session *duplexGCMSession) Encrypted() bool {
+	return true
+}
+
+// Duplex returns true, because messages written and read by the session have
+// their own keys and sequence numbers.
+func (session *duplexGCMSession) Duplex() bool {
+	return true
+}
+
+func (session *duplexGCMSession) ReadMessageOnTheWire(r io.Reader) (protocol.MessageOnTheWire, error) {
+	otw := protocol.MessageOnTheWire{}
+	otw.From = session.peerID
+	if err := otw.Message.UnmarshalReader(r); err != nil {
+		return otw, err
+	}
+
+	var err error
+	otw.Message.Body, err = session.read.Open(nil, gcmNonce(session.read, session.readSeq), otw.Message.Body, nil)
+	if err != nil {
+		return otw, fmt.Errorf("error reading message: %v", err)
+	}
+	otw.Message.Length = protocol.MessageLength(len(otw.Message.Body) + otw.Message.NonBodyLength())
+	session.readSeq++
+	return otw, nil
+}
+
+func (session *duplexGCMSession) WriteMessage(w io.Writer, message protocol.Message) error {
+	message.Body = session.write.Seal(nil, gcmNonce(session.write, session.writeSeq), message.Body, nil)
+	message.Length = protocol.MessageLength(len(message.Body) + message.NonBodyLength())
+
+	data, err := message.MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("error writing message: %v", err)
+	}
+	n, err := w.Write(data)
+	// The sequence number is used up as soon as any of the message is written,
+	// so that a retry after a short write is not sent with the same nonce
+	session.writeSeq++
+	if err != nil {
+		return err
+	}
+	if n != len(data) {
+		return fmt.Errorf("error writing message: expected n=%v, got n=%v", len(data), n)
+	}
+	return nil
+}
+
+// gcmNonce returns the nonce of the message with the sequence number. The
+// sequence number is in the last 8 bytes of the nonce, and the other bytes are
+// zero.
+func gcmNonce(gcm cipher.AEAD, seq uint64) []byte {
+	nonce := make([]byte, gcm.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], seq)
+	return nonce
+}
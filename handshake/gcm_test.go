@@ -2,6 +2,7 @@ package handshake_test
 
 import (
 	"bytes"
+	"io"
 	"testing/quick"
 
 	. "github.com/onsi/ginkgo"
@@ -39,6 +40,8 @@ var _ = Describe("GCM session manager", func() {
 					key := manager.NewSessionKey()
 					senderSession := manager.NewSession(receiver, key)
 					receiverSession := manager.NewSession(sender, key)
+					Expect(protocol.SessionPeerID(senderSession).Equal(receiver)).Should(BeTrue())
+					Expect(protocol.SessionEncrypted(senderSession)).Should(BeTrue())
 
 					buf := bytes.NewBuffer([]byte{})
 					sentMsg := RandomMessage(protocol.V1, RandomMessageVariant())
@@ -76,3 +79,197 @@ var _ = Describe("GCM session manager", func() {
 		})
 	})
 })
+
+var _ = Describe("Duplex GCM session manager", func() {
+	newSessions := func() (protocol.Session, protocol.Session, protocol.PeerID, protocol.PeerID) {
+		sender, receiver := RandomPeerID(), RandomPeerID()
+		key := NewDuplexGCMSessionManager(sender).NewSessionKey()
+		senderSession := NewDuplexGCMSessionManager(sender).NewSession(receiver, key)
+		receiverSession := NewDuplexGCMSessionManager(receiver).NewSession(sender, key)
+		return senderSession, receiverSession, sender, receiver
+	}
+
+	Context("when writing and reading messages with the same session keys", func() {
+		It("should be able to write and then read, with encryption", func() {
+			test := func() bool {
+				senderSession, receiverSession, sender, receiver := newSessions()
+				Expect(protocol.SessionPeerID(senderSession).Equal(receiver)).Should(BeTrue())
+				Expect(protocol.SessionEncrypted(senderSession)).Should(BeTrue())
+				Expect(IsDuplex(senderSession)).Should(BeTrue())
+
+				buf := bytes.NewBuffer([]byte{})
+				sentMsgs := []protocol.Message{
+					RandomMessage(protocol.V1, RandomMessageVariant()),
+					RandomMessage(protocol.V1, RandomMessageVariant()),
+				}
+				for _, sentMsg := range sentMsgs {
+					Expect(senderSession.WriteMessage(buf, sentMsg)).NotTo(HaveOccurred())
+				}
+				for _, sentMsg := range sentMsgs {
+					receivedMsg, err := receiverSession.ReadMessageOnTheWire(buf)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(receivedMsg.From.Equal(sender)).Should(BeTrue())
+					Expect(cmp.Equal(receivedMsg.Message, sentMsg, cmpopts.EquateEmpty())).Should(BeTrue())
+				}
+				return true
+			}
+
+			Expect(quick.Check(test, nil)).NotTo(HaveOccurred())
+		})
+
+		It("should be able to write and read in both directions", func() {
+			senderSession, receiverSession, _, _ := newSessions()
+			toReceiver, toSender := bytes.NewBuffer([]byte{}), bytes.NewBuffer([]byte{})
+			for i := 0; i < 10; i++ {
+				sentMsg := RandomMessage(protocol.V1, protocol.Cast)
+				repliedMsg := RandomMessage(protocol.V1, protocol.Cast)
+				Expect(senderSession.WriteMessage(toReceiver, sentMsg)).NotTo(HaveOccurred())
+				Expect(receiverSession.WriteMessage(toSender, repliedMsg)).NotTo(HaveOccurred())
+
+				receivedMsg, err := receiverSession.ReadMessageOnTheWire(toReceiver)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(cmp.Equal(receivedMsg.Message, sentMsg, cmpopts.EquateEmpty())).Should(BeTrue())
+				receivedMsg, err = senderSession.ReadMessageOnTheWire(toSender)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(cmp.Equal(receivedMsg.Message, repliedMsg, cmpopts.EquateEmpty())).Should(BeTrue())
+			}
+		})
+	})
+
+	Context("when a message is replayed", func() {
+		It("should not be able to read it again", func() {
+			senderSession, receiverSession, _, _ := newSessions()
+			buf := bytes.NewBuffer([]byte{})
+			Expect(senderSession.WriteMessage(buf, RandomMessage(protocol.V1, protocol.Cast))).NotTo(HaveOccurred())
+			data := append([]byte{}, buf.Bytes()...)
+
+			_, err := receiverSession.ReadMessageOnTheWire(bytes.NewBuffer(data))
+			Expect(err).NotTo(HaveOccurred())
+			_, err = receiverSession.ReadMessageOnTheWire(bytes.NewBuffer(data))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("when a message is written short", func() {
+		It("should write the retry with the next nonce", func() {
+			senderSession, receiverSession, _, _ := newSessions()
+			w := &shortWriter{}
+			sentMsg := RandomMessage(protocol.V1, protocol.Cast)
+			Expect(senderSession.WriteMessage(w, sentMsg)).To(Equal(io.ErrShortWrite))
+			Expect(senderSession.WriteMessage(w, sentMsg)).To(Succeed())
+			Expect(w.writes).To(HaveLen(2))
+			Expect(w.writes[1]).NotTo(Equal(w.writes[0]))
+
+			// Both attempts can be read in order, so the first one used up the
+			// nonce of its sequence number
+			for _, data := range w.writes {
+				receivedMsg, err := receiverSession.ReadMessageOnTheWire(bytes.NewBuffer(data))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(cmp.Equal(receivedMsg.Message, sentMsg, cmpopts.EquateEmpty())).Should(BeTrue())
+			}
+		})
+	})
+
+	Context("when a message is reflected back to its sender", func() {
+		It("should not be able to read it", func() {
+			sender, receiver := RandomPeerID(), RandomPeerID()
+			key := NewDuplexGCMSessionManager(sender).NewSessionKey()
+			senderSession := NewDuplexGCMSessionManager(sender).NewSession(receiver, key)
+
+			buf := bytes.NewBuffer([]byte{})
+			Expect(senderSession.WriteMessage(buf, RandomMessage(protocol.V1, protocol.Cast))).NotTo(HaveOccurred())
+			_, err := senderSession.ReadMessageOnTheWire(buf)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
+
+var _ = Describe("Rekeying GCM session manager", func() {
+	newSessions := func(options RekeyOptions) (protocol.Session, protocol.Session, RekeyingSessionManager, RekeyingSessionManager) {
+		sender, receiver := RandomPeerID(), RandomPeerID()
+		senderManager := NewRekeyingGCMSessionManager(sender, options)
+		receiverManager := NewRekeyingGCMSessionManager(receiver, options)
+		key := senderManager.NewSessionKey()
+		return senderManager.NewSession(receiver, key), receiverManager.NewSession(sender, key), senderManager, receiverManager
+	}
+
+	Context("when the messages written exceed the rekeying bytes", func() {
+		It("should rekey both sides at the same message, and keep reading", func() {
+			events := make(chan RekeyEvent, 100)
+			senderSession, receiverSession, senderManager, receiverManager := newSessions(RekeyOptions{
+				Bytes:   1,
+				Rekeyed: func(event RekeyEvent) { events <- event },
+			})
+			Expect(IsDuplex(senderSession)).Should(BeTrue())
+
+			buf := bytes.NewBuffer([]byte{})
+			for i := 0; i < 10; i++ {
+				sentMsg := RandomMessage(protocol.V1, protocol.Cast)
+				Expect(senderSession.WriteMessage(buf, sentMsg)).NotTo(HaveOccurred())
+				receivedMsg, err := receiverSession.ReadMessageOnTheWire(buf)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(cmp.Equal(receivedMsg.Message, sentMsg, cmpopts.EquateEmpty())).Should(BeTrue())
+			}
+			Expect(senderManager.RekeyCounts()).To(Equal(RekeyCounts{Written: 10}))
+			Expect(receiverManager.RekeyCounts()).To(Equal(RekeyCounts{Read: 10}))
+			Expect(events).To(HaveLen(20))
+		})
+	})
+
+	Context("when the thresholds have not been exceeded", func() {
+		It("should not rekey", func() {
+			senderSession, receiverSession, senderManager, _ := newSessions(RekeyOptions{})
+			buf := bytes.NewBuffer([]byte{})
+			for i := 0; i < 10; i++ {
+				Expect(senderSession.WriteMessage(buf, RandomMessage(protocol.V1, protocol.Cast))).NotTo(HaveOccurred())
+				_, err := receiverSession.ReadMessageOnTheWire(buf)
+				Expect(err).NotTo(HaveOccurred())
+			}
+			Expect(senderManager.RekeyCounts()).To(Equal(RekeyCounts{}))
+		})
+	})
+
+	Context("when a message from before a rekey is replayed", func() {
+		It("should not be able to read it", func() {
+			senderSession, receiverSession, _, _ := newSessions(RekeyOptions{Bytes: 1})
+			buf := bytes.NewBuffer([]byte{})
+			Expect(senderSession.WriteMessage(buf, RandomMessage(protocol.V1, protocol.Cast))).NotTo(HaveOccurred())
+			data := append([]byte{}, buf.Bytes()...)
+
+			_, err := receiverSession.ReadMessageOnTheWire(bytes.NewBuffer(data))
+			Expect(err).NotTo(HaveOccurred())
+			_, err = receiverSession.ReadMessageOnTheWire(bytes.NewBuffer(data))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("when a message that exceeds the rekeying bytes is written short", func() {
+		It("should rekey, and seal the retry with the next key", func() {
+			senderSession, _, senderManager, _ := newSessions(RekeyOptions{Bytes: 1})
+			w := &shortWriter{}
+			message := RandomMessage(protocol.V1, protocol.Cast)
+			Expect(senderSession.WriteMessage(w, message)).To(Equal(io.ErrShortWrite))
+			Expect(senderManager.RekeyCounts()).To(Equal(RekeyCounts{Written: 1}))
+
+			Expect(senderSession.WriteMessage(w, message)).To(Succeed())
+			Expect(senderManager.RekeyCounts()).To(Equal(RekeyCounts{Written: 2}))
+			Expect(w.writes).To(HaveLen(2))
+			Expect(w.writes[1]).NotTo(Equal(w.writes[0]))
+		})
+	})
+})
+
+// shortWriter makes a short write the first time that it is written to, and
+// accepts every write after that. It records all of the data that it is asked
+// to write.
+type shortWriter struct {
+	writes [][]byte
+}
+
+func (w *shortWriter) Write(data []byte) (int, error) {
+	w.writes = append(w.writes, append([]byte{}, data...))
+	if len(w.writes) == 1 {
+		return len(data) / 2, io.ErrShortWrite
+	}
+	return len(data), nil
+}
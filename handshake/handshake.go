@@ -1,19 +1,30 @@
 package handshake
 
 import (
+	"bytes"
 	"context"
 	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
 	"io"
+	"math/big"
+	"net"
+	"time"
 
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/crypto/ecies"
-	"github.com/ethereum/go-ethereum/crypto/secp256k1"
 	"github.com/renproject/aw/protocol"
 )
 
+// A Handshaker authenticates remote peers and establishes sessions with them.
+// The client proposes the Suites that it supports, and the server selects one
+// of them, before they exchange keys. Handshakers are also LegacyHandshakers,
+// so that they can complete handshakes with legacy peers, which predate this
+// negotiation (see LegacyHandshaker).
 type Handshaker interface {
 	// Handshake with a remote server by initiating, and then interactively
 	// completing, a handshake protocol. The remote server is accessed by
@@ -26,39 +37,320 @@ type Handshaker interface {
 	AcceptHandshake(ctx context.Context, rw io.ReadWriter) (protocol.Session, error)
 }
 
+// Options are used to parameterise the behaviour of a Handshaker.
+type Options struct {
+	// FIPS restricts the handshake to FIPS-approved algorithms, and requires
+	// the resulting sessions to be encrypted. The SignVerifier and
+	// SessionManager are provided by the application, and must also use
+	// FIPS-approved algorithms (e.g. ECDSA P-256 with SHA-256, and AES-GCM).
+	// Defaults to true when building with the "fips" tag.
+	FIPS bool
+
+	// Suites supported by the Handshaker, in order of preference. Defaults to
+	// all Suites, or all FIPS-approved Suites in FIPS mode.
+	Suites Suites
+
+	// MinSuite is the weakest Suite that can be negotiated. Suites that are
+	// weaker (see Suite.Strength) are removed from the Suites. Defaults to
+	// allowing all Suites.
+	MinSuite Suite
+
+	// Compressions supported by the Handshaker, in order of preference. The
+	// preference of the client is used. Defaults to no compression, but
+	// accepting the other compressions when they are preferred by the client.
+	// Peers that do not support a compression skip it, so a compression can
+	// be preferred before every peer in the network supports it, as long as
+	// CompressionNone is also supported. Bodies that are shorter than the
+	// BodyCompressionThreshold (defaults to 1 KB) are not compressed by the
+	// compressions of message bodies.
+	Compressions             Compressions
+	BodyCompressionThreshold int
+
+	// MaxDecompressedMessageLength is the maximum length of a message after
+	// it has been decompressed. Defaults to 4 MB.
+	MaxDecompressedMessageLength int
+
+	// MaxDecompressionTime is the maximum time that can be spent decompressing
+	// a message. Defaults to 100 milliseconds.
+	MaxDecompressionTime time.Duration
+
+	// PaddingBucketSize enables padding when it is positive. Padded messages
+	// have a length on the wire that is a multiple of the bucket size, which
+	// makes traffic analysis of the length of messages harder when sessions
+	// are encrypted. Messages are padded if either peer enables padding, in
+	// which case the larger bucket size is used and the stream is not
+	// compressed. It cannot be larger than MaxPaddingBucketSize.
+	PaddingBucketSize int
+
+	// PSK is an optional pre-shared key. When it is set, handshakes are only
+	// completed with peers that prove they know the same PSK, so that only
+	// the nodes of a private network can join it. Proofs are bound to the
+	// ephemeral public keys of the handshake, so they cannot be replayed. The
+	// PSK is never sent.
+	PSK []byte
+
+	// NetworkID is optional. When it is set, the client and server exchange
+	// an identify frame, with the name and version of the protocol and the
+	// NetworkID, before the handshake (see IdentifyMagic). The server rejects
+	// clients that are in another network, or that do not speak the protocol
+	// (e.g. port scanners), with an ErrIdentify before it writes anything, so
+	// that they are rejected cheaply. It cannot be longer than
+	// MaxNetworkIDLength, and must be set by every peer in the network.
+	NetworkID string
+
+	// Strict rejects messages that are not encoded canonically (see
+	// protocol.ValidateCanonicalMessage), and padded messages whose padding
+	// is not zeroed, instead of parsing them on a best-effort basis. The
+	// connection is closed when such a message is read. It shrinks the attack
+	// surface of validating nodes, but must only be enabled once every peer
+	// in the network encodes its messages canonically.
+	Strict bool
+
+	// Framed writes every message with a magic number and a checksum around
+	// it (see protocol.FrameMagic), so that corrupted streams are detected
+	// instead of desynchronising the reader. Framing is not negotiated:
+	// framed messages are always read, whether Framed is set or not, and
+	// each end decides on its own whether to write them. They must only be
+	// written once every peer in the network can read them.
+	Framed bool
+
+	// Downgraded is optional. When set, it is called whenever a handshake
+	// negotiates a Suite that is weaker than the most preferred Suite (see
+	// Suite.Strength), and whenever a Framed session first reads a message
+	// that is not framed (see protocol.EventDowngraded). It must not block.
+	Downgraded func(protocol.EventDowngraded)
+
+	// RefuseDowngrades fails handshakes that negotiate a Suite that is weaker
+	// than the most preferred Suite, and closes Framed sessions that read a
+	// message that is not framed, with an ErrDowngrade. It must only be
+	// enabled once every peer in the network has been upgraded.
+	RefuseDowngrades bool
+
+	// Rand is the source of randomness of ephemeral keys, and of the
+	// encryption of session keys. Defaults to crypto/rand.Reader. It is only
+	// intended for reproducing handshakes byte-for-byte (e.g. the vectors
+	// package), and must not be set otherwise.
+	Rand io.Reader
+}
+
+func (options *Options) setZerosToDefaults() {
+	options.FIPS = options.FIPS || fipsBuild
+	if len(options.Suites) == 0 {
+		options.Suites = Suites{SuiteSecp256k1ECIES, SuiteP256ECDH, SuiteSecp256k1ECDH}
+	}
+	if len(options.Compressions) == 0 {
+		options.Compressions = Compressions{CompressionNone, CompressionSnappy, CompressionBodySnappy, CompressionBodyGzip}
+	}
+	if options.BodyCompressionThreshold <= 0 {
+		options.BodyCompressionThreshold = 1024
+	}
+	if options.MaxDecompressedMessageLength <= 0 {
+		options.MaxDecompressedMessageLength = 4 * 1024 * 1024
+	}
+	if options.MaxDecompressionTime <= 0 {
+		options.MaxDecompressionTime = 100 * time.Millisecond
+	}
+	if options.PaddingBucketSize < 0 {
+		options.PaddingBucketSize = 0
+	}
+	if options.PaddingBucketSize > MaxPaddingBucketSize {
+		options.PaddingBucketSize = MaxPaddingBucketSize
+	}
+	if options.FIPS {
+		approved := make(Suites, 0, len(options.Suites))
+		for _, suite := range options.Suites {
+			if suite.IsFIPSApproved() {
+				approved = append(approved, suite)
+			}
+		}
+		options.Suites = approved
+	}
+	if options.MinSuite != 0 {
+		strong := make(Suites, 0, len(options.Suites))
+		for _, suite := range options.Suites {
+			if suite.Strength() >= options.MinSuite.Strength() {
+				strong = append(strong, suite)
+			}
+		}
+		options.Suites = strong
+	}
+}
+
 type handshaker struct {
+	options        Options
+	suites         Suites
 	signVerifier   protocol.SignVerifier
 	sessionManager protocol.SessionManager
 }
 
+// New returns a Handshaker with the default Options.
 func New(signVerifier protocol.SignVerifier, sessionManager protocol.SessionManager) Handshaker {
+	return NewWithOptions(Options{}, signVerifier, sessionManager)
+}
+
+// NewWithOptions returns a Handshaker with the given Options.
+func NewWithOptions(options Options, signVerifier protocol.SignVerifier, sessionManager protocol.SessionManager) Handshaker {
 	if signVerifier == nil {
 		panic("invariant violation: SignVerifier cannot be nil")
 	}
 	if sessionManager == nil {
 		panic("invariant violation: SessionManager cannot be nil")
 	}
+	options.setZerosToDefaults()
+	if len(options.Suites) == 0 {
+		panic("invariant violation: no supported handshake suites")
+	}
+	if len(options.NetworkID) > MaxNetworkIDLength {
+		panic(fmt.Sprintf("invariant violation: network id is longer than %v bytes", MaxNetworkIDLength))
+	}
 	return &handshaker{
+		options:        options,
+		suites:         options.Suites,
 		signVerifier:   signVerifier,
 		sessionManager: sessionManager,
 	}
 }
 
 func (hs *handshaker) Handshake(ctx context.Context, rw io.ReadWriter) (protocol.Session, error) {
+	defer setDeadline(ctx, rw)()
+
+	// The identify frames are part of the transcript, so that they are
+	// authenticated by the handshake
+	negotiation := newTranscript(rw)
+	if err := hs.identify(negotiation, true); err != nil {
+		return nil, err
+	}
+	suite, err := hs.proposeSuite(negotiation)
+	if err != nil {
+		return nil, err
+	}
+	if err := hs.checkSuite(suite); err != nil {
+		return nil, err
+	}
+	compression, err := hs.proposeCompression(negotiation)
+	if err != nil {
+		return nil, err
+	}
+	bucketSize, err := hs.proposePadding(negotiation)
+	if err != nil {
+		return nil, err
+	}
+
+	var session protocol.IdentifiedSession
+	switch suite {
+	case SuiteSecp256k1ECIES:
+		session, err = hs.handshakeECIES(rw, negotiation.digest())
+	case SuiteP256ECDH, SuiteSecp256k1ECDH:
+		session, err = hs.exchangeECDH(rw, suite, negotiation.digest(), true)
+	default:
+		return nil, fmt.Errorf("invariant violation: unknown handshake suite=%v", suite)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := hs.checkSession(session); err != nil {
+		return nil, err
+	}
+	hs.checkSessionSuite(session, suite)
+	return hs.wrapSession(session, compression, bucketSize), nil
+}
+
+func (hs *handshaker) AcceptHandshake(ctx context.Context, rw io.ReadWriter) (protocol.Session, error) {
+	defer setDeadline(ctx, rw)()
+
+	rw, legacy, err := hs.detectLegacyClient(rw)
+	if err != nil {
+		return nil, err
+	}
+	if legacy {
+		return hs.acceptLegacyHandshake(rw)
+	}
+
+	negotiation := newTranscript(rw)
+	if err := hs.identify(negotiation, false); err != nil {
+		return nil, err
+	}
+	suite, err := hs.selectSuite(negotiation)
+	if err != nil {
+		return nil, err
+	}
+	if err := hs.checkSuite(suite); err != nil {
+		return nil, err
+	}
+	compression, err := hs.selectCompression(negotiation)
+	if err != nil {
+		return nil, err
+	}
+	bucketSize, err := hs.selectPadding(negotiation)
+	if err != nil {
+		return nil, err
+	}
+
+	var session protocol.IdentifiedSession
+	switch suite {
+	case SuiteSecp256k1ECIES:
+		session, err = hs.acceptHandshakeECIES(rw, negotiation.digest())
+	case SuiteP256ECDH, SuiteSecp256k1ECDH:
+		session, err = hs.exchangeECDH(rw, suite, negotiation.digest(), false)
+	default:
+		return nil, fmt.Errorf("invariant violation: unknown handshake suite=%v", suite)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := hs.checkSession(session); err != nil {
+		return nil, err
+	}
+	hs.checkSessionSuite(session, suite)
+	return hs.wrapSession(session, compression, bucketSize), nil
+}
+
+// setDeadline sets the deadline of the context on the connection, if it is a
+// net.Conn, so that a handshake that fails on the remote peer cannot block
+// forever. It returns a function that clears the deadline.
+func setDeadline(ctx context.Context, rw io.ReadWriter) func() {
+	conn, ok := rw.(net.Conn)
+	if !ok {
+		return func() {}
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return func() {}
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		return func() {}
+	}
+	return func() { conn.SetDeadline(time.Time{}) }
+}
+
+// Sessions established in FIPS mode must be encrypted (with a FIPS-approved
+// cipher provided by the SessionManager).
+func (hs *handshaker) checkSession(session protocol.IdentifiedSession) error {
+	if hs.options.FIPS && !session.Encrypted() {
+		return fmt.Errorf("error establishing session with peer=%v: plaintext sessions are not allowed in fips mode", session.PeerID())
+	}
+	return nil
+}
+
+func (hs *handshaker) handshakeECIES(rw io.ReadWriter, negotiation []byte) (protocol.IdentifiedSession, error) {
 	// 1. Write self ECDSA public key and Signature of it.
-	localPrivateKey, err := ecdsa.GenerateKey(secp256k1.S256(), rand.Reader)
+	localPrivateKey, err := hs.generateKey(crypto.S256())
 	if err != nil {
 		return nil, fmt.Errorf("error generating new ecdsa key : %v", err)
 	}
-	if err := hs.writePublicKey(rw, localPrivateKey); err != nil {
+	localPublicKeyBytes := crypto.FromECDSAPub(&localPrivateKey.PublicKey)
+	if err := hs.writePublicKey(rw, localPublicKeyBytes, nil, negotiation, true); err != nil {
 		return nil, err
 	}
 
 	// 2. Read the remote ECDSA public key and verify the signature.
-	remotePublicKey, remotePeerID, err := hs.readPublicKey(rw)
+	remotePublicKey, remotePublicKeyBytes, remotePeerID, err := hs.readSecp256k1PublicKey(rw, localPublicKeyBytes, negotiation, true)
 	if err != nil {
 		return nil, err
 	}
+	if err := hs.writePSKConfirmation(rw, negotiation, localPublicKeyBytes, remotePublicKeyBytes); err != nil {
+		return nil, err
+	}
 
 	// 3. Generate a session key, encrypted with remote ECDSA key and write to server
 	localSessionKey := hs.sessionManager.NewSessionKey()
@@ -72,22 +364,30 @@ func (hs *handshaker) Handshake(ctx context.Context, rw io.ReadWriter) (protocol
 		return nil, err
 	}
 
-	return hs.sessionManager.NewSession(remotePeerID, xorSessionKeys(localSessionKey, remoteSessionKey)), nil
+	sessionKey, err := xorSessionKeys(localSessionKey, remoteSessionKey)
+	if err != nil {
+		return nil, err
+	}
+	return identifySession(hs.sessionManager.NewSession(remotePeerID, sessionKey), remotePeerID), nil
 }
 
-func (hs *handshaker) AcceptHandshake(ctx context.Context, rw io.ReadWriter) (protocol.Session, error) {
+func (hs *handshaker) acceptHandshakeECIES(rw io.ReadWriter, negotiation []byte) (protocol.IdentifiedSession, error) {
 	// 1. Read the remote ECDSA public key and verify the signature.
-	remotePublicKey, remotePeerID, err := hs.readPublicKey(rw)
+	remotePublicKey, remotePublicKeyBytes, remotePeerID, err := hs.readSecp256k1PublicKey(rw, nil, negotiation, false)
 	if err != nil {
 		return nil, err
 	}
 
 	// 2. Write self ecdsa public key and Signature of it.
-	localPrivateKey, err := ecdsa.GenerateKey(secp256k1.S256(), rand.Reader)
+	localPrivateKey, err := hs.generateKey(crypto.S256())
 	if err != nil {
 		return nil, fmt.Errorf("error generating new ecdsa key : %v", err)
 	}
-	if err := hs.writePublicKey(rw, localPrivateKey); err != nil {
+	localPublicKeyBytes := crypto.FromECDSAPub(&localPrivateKey.PublicKey)
+	if err := hs.writePublicKey(rw, localPublicKeyBytes, remotePublicKeyBytes, negotiation, false); err != nil {
+		return nil, err
+	}
+	if err := hs.readPSKConfirmation(rw, remotePeerID, negotiation, remotePublicKeyBytes, localPublicKeyBytes); err != nil {
 		return nil, err
 	}
 
@@ -102,17 +402,90 @@ func (hs *handshaker) AcceptHandshake(ctx context.Context, rw io.ReadWriter) (pr
 	if err := hs.writeEncrypted(rw, localSessionKey, remotePublicKey); err != nil {
 		return nil, err
 	}
-	return hs.sessionManager.NewSession(remotePeerID, xorSessionKeys(localSessionKey, remoteSessionKey)), nil
+
+	sessionKey, err := xorSessionKeys(localSessionKey, remoteSessionKey)
+	if err != nil {
+		return nil, err
+	}
+	return identifySession(hs.sessionManager.NewSession(remotePeerID, sessionKey), remotePeerID), nil
+}
+
+// Exchange ephemeral public keys on the curve of the suite (the client writes
+// first) and derive the session key from the shared secret.
+func (hs *handshaker) exchangeECDH(rw io.ReadWriter, suite Suite, negotiation []byte, isClient bool) (protocol.IdentifiedSession, error) {
+	curve := elliptic.P256()
+	if suite == SuiteSecp256k1ECDH {
+		curve = crypto.S256()
+	}
+	localPrivateKey, err := hs.generateKey(curve)
+	if err != nil {
+		return nil, fmt.Errorf("error generating new ecdh key : %v", err)
+	}
+	localPublicKeyBytes := elliptic.Marshal(curve, localPrivateKey.X, localPrivateKey.Y)
+
+	if isClient {
+		if err := hs.writePublicKey(rw, localPublicKeyBytes, nil, negotiation, isClient); err != nil {
+			return nil, err
+		}
+		remotePublicKeyBytes, remotePeerID, err := hs.readPublicKey(rw, localPublicKeyBytes, negotiation, isClient)
+		if err != nil {
+			return nil, err
+		}
+		if err := hs.writePSKConfirmation(rw, negotiation, localPublicKeyBytes, remotePublicKeyBytes); err != nil {
+			return nil, err
+		}
+		return hs.newECDHSession(curve, suite, localPrivateKey, remotePublicKeyBytes, remotePeerID)
+	}
+	remotePublicKeyBytes, remotePeerID, err := hs.readPublicKey(rw, nil, negotiation, isClient)
+	if err != nil {
+		return nil, err
+	}
+	if err := hs.writePublicKey(rw, localPublicKeyBytes, remotePublicKeyBytes, negotiation, isClient); err != nil {
+		return nil, err
+	}
+	if err := hs.readPSKConfirmation(rw, remotePeerID, negotiation, remotePublicKeyBytes, localPublicKeyBytes); err != nil {
+		return nil, err
+	}
+	return hs.newECDHSession(curve, suite, localPrivateKey, remotePublicKeyBytes, remotePeerID)
 }
 
-// Write the ecdsa public along with a signature of it through the io.Writer
-func (hs *handshaker) writePublicKey(w io.Writer, key *ecdsa.PrivateKey) error {
-	localPublicKey := key.PublicKey
-	localPublicKeyBytes := crypto.FromECDSAPub(&localPublicKey)
-	if err := write(w, localPublicKeyBytes); err != nil {
+// newECDHSession derives the session key from the shared secret of the local
+// private key and the remote public key.
+func (hs *handshaker) newECDHSession(curve elliptic.Curve, suite Suite, localPrivateKey *ecdsa.PrivateKey, remotePublicKeyBytes []byte, remotePeerID protocol.PeerID) (protocol.IdentifiedSession, error) {
+	remoteX, remoteY := elliptic.Unmarshal(curve, remotePublicKeyBytes)
+	if remoteX == nil {
+		return nil, fmt.Errorf("error unmarshaling ecdh public key: invalid %v point", suite)
+	}
+	sharedX, _ := curve.ScalarMult(remoteX, remoteY, localPrivateKey.D.Bytes())
+	sharedSecret := make([]byte, 32)
+	sharedXBytes := sharedX.Bytes()
+	copy(sharedSecret[32-len(sharedXBytes):], sharedXBytes)
+	sessionKey := sha256.Sum256(sharedSecret)
+
+	return identifySession(hs.sessionManager.NewSession(remotePeerID, sessionKey[:]), remotePeerID), nil
+}
+
+// Write the public key, the digest of the negotiation transcript, and the PSK
+// proof, along with a signature of all of them, through the io.Writer. The
+// remote public key is nil if it has not been read yet, which is only the case
+// for the client.
+func (hs *handshaker) writePublicKey(w io.Writer, publicKeyBytes, remotePublicKeyBytes, negotiation []byte, isClient bool) error {
+	if err := write(w, publicKeyBytes); err != nil {
 		return fmt.Errorf("error writing ecdsa.PublicKey to io.Writer: %v", err)
 	}
-	pubKeySig, err := hs.signVerifier.Sign(hs.signVerifier.Hash(localPublicKeyBytes))
+	if err := write(w, negotiation); err != nil {
+		return fmt.Errorf("error writing negotiation transcript to io.Writer: %v", err)
+	}
+	var proof []byte
+	if isClient {
+		proof = hs.pskProof("client", negotiation, publicKeyBytes)
+	} else {
+		proof = hs.pskProof("server", negotiation, remotePublicKeyBytes, publicKeyBytes)
+	}
+	if err := write(w, proof); err != nil {
+		return fmt.Errorf("error writing psk proof to io.Writer: %v", err)
+	}
+	pubKeySig, err := hs.signVerifier.Sign(hs.signVerifier.Hash(concat(publicKeyBytes, negotiation, proof)))
 	if err != nil {
 		return fmt.Errorf("invariant violation: cannot sign ecdsa.publickey: %v", err)
 	}
@@ -122,35 +495,76 @@ func (hs *handshaker) writePublicKey(w io.Writer, key *ecdsa.PrivateKey) error {
 	return nil
 }
 
-// Unmarshal the read data to an ecdsa.PublicKey and verify the signature.
-func (hs *handshaker) readPublicKey(r io.Reader) (*ecdsa.PublicKey, protocol.PeerID, error) {
+// Read a public key, the digest of the negotiation transcript, and the PSK
+// proof, verify the signature, and check that the remote transcript matches the
+// local one. The PSK proof is only checked if there is a local PSK. The local
+// public key is nil if it has not been written yet, which is only the case for
+// the server.
+func (hs *handshaker) readPublicKey(r io.Reader, localPublicKeyBytes, negotiation []byte, isClient bool) ([]byte, protocol.PeerID, error) {
 	remotePubKeyBytes, err := read(r)
 	if err != nil {
-		return nil, nil, fmt.Errorf("error reading ecdsa.PublicKey from io.Reader (potential rate limit): %v", err)
+		return nil, nil, fmt.Errorf("error reading ecdsa.PublicKey from io.Reader: %v", err)
 	}
-	remotePublicKey, err := crypto.UnmarshalPubkey(remotePubKeyBytes)
+	remoteNegotiation, err := read(r)
 	if err != nil {
-		return nil, nil, fmt.Errorf("error unmarshaling ecdsa PublicKey: %v", err)
+		return nil, nil, fmt.Errorf("error reading negotiation transcript from io.Reader: %v", err)
+	}
+	remoteProof, err := read(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading psk proof from io.Reader: %v", err)
 	}
 	remotePubKeySig, err := read(r)
 	if err != nil {
 		return nil, nil, fmt.Errorf("error reading ecdsa.PublicKey signature from io.Reader: %v", err)
 	}
-	remotePeerID, err := hs.signVerifier.Verify(hs.signVerifier.Hash(remotePubKeyBytes), remotePubKeySig)
+	remotePeerID, err := hs.signVerifier.Verify(hs.signVerifier.Hash(concat(remotePubKeyBytes, remoteNegotiation, remoteProof)), remotePubKeySig)
 	if err != nil {
 		return nil, nil, fmt.Errorf("error verifying ecdsa.PublicKey: %v", err)
 	}
-	return remotePublicKey, remotePeerID, nil
+	if !bytes.Equal(remoteNegotiation, negotiation) {
+		return nil, nil, newErrNegotiationTampered(remotePeerID)
+	}
+	if len(hs.options.PSK) > 0 {
+		expectedProof := hs.pskProof("client", negotiation, remotePubKeyBytes)
+		if isClient {
+			expectedProof = hs.pskProof("server", negotiation, localPublicKeyBytes, remotePubKeyBytes)
+		}
+		if !hmac.Equal(remoteProof, expectedProof) {
+			return nil, nil, newErrPSKMismatch(remotePeerID)
+		}
+	}
+	return remotePubKeyBytes, remotePeerID, nil
+}
+
+// Unmarshal the read data to an ecdsa.PublicKey and verify the signature.
+func (hs *handshaker) readSecp256k1PublicKey(r io.Reader, localPublicKeyBytes, negotiation []byte, isClient bool) (*ecdsa.PublicKey, []byte, protocol.PeerID, error) {
+	remotePubKeyBytes, remotePeerID, err := hs.readPublicKey(r, localPublicKeyBytes, negotiation, isClient)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	remotePublicKey, err := crypto.UnmarshalPubkey(remotePubKeyBytes)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("error unmarshaling ecdsa PublicKey: %v", err)
+	}
+	return remotePublicKey, remotePubKeyBytes, remotePeerID, nil
 }
 
 // encrypt the data with given public key and write the encrypted data through an io.Writer.
 func (hs *handshaker) writeEncrypted(w io.Writer, data []byte, publicKey *ecdsa.PublicKey) error {
-	data, err := ecies.Encrypt(rand.Reader, ecies.ImportECDSAPublic(publicKey), data, nil, nil)
+	// ECIES cannot encrypt empty data (e.g. the session key of plaintext
+	// sessions), and there is nothing to hide anyway.
+	if len(data) == 0 {
+		if err := write(w, data); err != nil {
+			return fmt.Errorf("error writing session key to io.Writer: %v", err)
+		}
+		return nil
+	}
+	data, err := ecies.Encrypt(hs.rand(), ecies.ImportECDSAPublic(publicKey), data, nil, nil)
 	if err != nil {
 		return fmt.Errorf("error encrypting session key: %v", err)
 	}
 	if err := write(w, data); err != nil {
-		return fmt.Errorf("error writing ecdsa.PublicKey signature to io.Writer: %v", err)
+		return fmt.Errorf("error writing encrypted session key to io.Writer: %v", err)
 	}
 	return nil
 }
@@ -159,7 +573,10 @@ func (hs *handshaker) writeEncrypted(w io.Writer, data []byte, publicKey *ecdsa.
 func (hs *handshaker) readEncrypted(r io.Reader, privateKey *ecdsa.PrivateKey) ([]byte, error) {
 	encryptedSessionKey, err := read(r)
 	if err != nil {
-		return nil, fmt.Errorf("error reading ecdsa.PublicKey from io.Reader: %v", err)
+		return nil, fmt.Errorf("error reading encrypted session key from io.Reader: %v", err)
+	}
+	if len(encryptedSessionKey) == 0 {
+		return []byte{}, nil
 	}
 	eciesPrivateKey := ecies.ImportECDSA(privateKey)
 	decryptedSessionKey, err := eciesPrivateKey.Decrypt(encryptedSessionKey, nil, nil)
@@ -170,10 +587,48 @@ func (hs *handshaker) readEncrypted(r io.Reader, privateKey *ecdsa.PrivateKey) (
 	return decryptedSessionKey, nil
 }
 
+// generateKey returns an ephemeral private key on the curve. When the Rand
+// option is set, the key is derived from it using the extra random bits method
+// of FIPS 186-4 (B.4.1), so that the key only depends on the bytes that are
+// read: the key is one more than the big-endian integer of BitSize/8+8 bytes,
+// modulo one less than the order of the curve.
+func (hs *handshaker) generateKey(curve elliptic.Curve) (*ecdsa.PrivateKey, error) {
+	if hs.options.Rand == nil {
+		return ecdsa.GenerateKey(curve, rand.Reader)
+	}
+	params := curve.Params()
+	b := make([]byte, params.BitSize/8+8)
+	if _, err := io.ReadFull(hs.options.Rand, b); err != nil {
+		return nil, err
+	}
+	one := big.NewInt(1)
+	k := new(big.Int).SetBytes(b)
+	k.Mod(k, new(big.Int).Sub(params.N, one))
+	k.Add(k, one)
+
+	privateKey := new(ecdsa.PrivateKey)
+	privateKey.PublicKey.Curve = curve
+	privateKey.D = k
+	privateKey.PublicKey.X, privateKey.PublicKey.Y = curve.ScalarBaseMult(k.Bytes())
+	return privateKey, nil
+}
+
+func (hs *handshaker) rand() io.Reader {
+	if hs.options.Rand == nil {
+		return rand.Reader
+	}
+	return hs.options.Rand
+}
+
 func write(w io.Writer, data []byte) error {
 	if err := binary.Write(w, binary.LittleEndian, uint64(len(data))); err != nil {
 		return fmt.Errorf("error writing data len=%v: %v", len(data), err)
 	}
+	// Empty writes can block on synchronous connections, and there is nothing
+	// for the remote to read anyway.
+	if len(data) == 0 {
+		return nil
+	}
 	if err := binary.Write(w, binary.LittleEndian, data); err != nil {
 		return fmt.Errorf("error writing data: %v", err)
 	}
@@ -192,10 +647,23 @@ func read(r io.Reader) ([]byte, error) {
 	return data, nil
 }
 
-func xorSessionKeys(key1, key2 []byte) []byte {
+func concat(data ...[]byte) []byte {
+	concatenated := make([]byte, 0)
+	for _, d := range data {
+		concatenated = append(concatenated, d...)
+	}
+	return concatenated
+}
+
+func xorSessionKeys(key1, key2 []byte) ([]byte, error) {
+	// The remote peer might be using a different kind of session (e.g. a
+	// plaintext session).
+	if len(key1) != len(key2) {
+		return nil, fmt.Errorf("error combining session keys: expected len=%v, got len=%v", len(key1), len(key2))
+	}
 	sessionKey := make([]byte, 0)
 	for i := 0; i < len(key1); i++ {
 		sessionKey = append(sessionKey, key1[i]^key2[i])
 	}
-	return sessionKey
+	return sessionKey, nil
 }
@@ -1,8 +1,13 @@
 package handshake_test
 
 import (
+	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/binary"
 	"io"
+	"io/ioutil"
 	"net"
 	"testing/quick"
 	"time"
@@ -12,6 +17,8 @@ import (
 	. "github.com/renproject/aw/handshake"
 	. "github.com/renproject/aw/testutil"
 
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/crypto/ecies"
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/renproject/aw/protocol"
@@ -20,21 +27,36 @@ import (
 
 var _ = Describe("Handshaker", func() {
 
-	handshake := func(ctx context.Context, clientConn, serverConn io.ReadWriter) (protocol.Session, protocol.Session) {
+	// Close the connection if the handshake failed, so that the remote peer
+	// does not block waiting for the rest of the handshake.
+	closeOnError := func(conn io.ReadWriter, err error) {
+		if closer, ok := conn.(io.Closer); ok && err != nil {
+			closer.Close()
+		}
+	}
+
+	handshakeWithOptions := func(ctx context.Context, clientConn, serverConn io.ReadWriter, clientOptions, serverOptions Options, sessionManager protocol.SessionManager) (protocol.Session, protocol.Session, error, error) {
 		clientSignVerifier := NewMockSignVerifier()
 		serverSignVerifier := NewMockSignVerifier(clientSignVerifier.ID())
 		clientSignVerifier.Whitelist(serverSignVerifier.ID())
 
-		clientHandshaker := New(clientSignVerifier, NewGCMSessionManager())
-		serverHandshaker := New(serverSignVerifier, NewGCMSessionManager())
+		clientHandshaker := NewWithOptions(clientOptions, clientSignVerifier, sessionManager)
+		serverHandshaker := NewWithOptions(serverOptions, serverSignVerifier, sessionManager)
 
 		var clientErr, serverError error
 		var clientSession, serverSession protocol.Session
 		phi.ParBegin(func() {
 			clientSession, clientErr = clientHandshaker.Handshake(ctx, clientConn)
+			closeOnError(clientConn, clientErr)
 		}, func() {
 			serverSession, serverError = serverHandshaker.AcceptHandshake(ctx, serverConn)
+			closeOnError(serverConn, serverError)
 		})
+		return clientSession, serverSession, clientErr, serverError
+	}
+
+	handshake := func(ctx context.Context, clientConn, serverConn io.ReadWriter) (protocol.Session, protocol.Session) {
+		clientSession, serverSession, clientErr, serverError := handshakeWithOptions(ctx, clientConn, serverConn, Options{}, Options{}, NewGCMSessionManager())
 		Expect(clientErr).NotTo(HaveOccurred())
 		Expect(serverError).NotTo(HaveOccurred())
 
@@ -90,6 +112,942 @@ var _ = Describe("Handshaker", func() {
 
 				Expect(quick.Check(test, nil)).NotTo(HaveOccurred())
 			})
+
+			It("should establish plaintext sessions with every suite", func() {
+				for _, suite := range []Suite{SuiteSecp256k1ECIES, SuiteP256ECDH, SuiteSecp256k1ECDH} {
+					ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+					defer cancel()
+
+					clientConn, serverConn := net.Pipe()
+					options := Options{Suites: Suites{suite}}
+					clientSession, serverSession, clientErr, serverError := handshakeWithOptions(ctx, clientConn, serverConn, options, options, NewInsecureSessionManager())
+					Expect(clientErr).NotTo(HaveOccurred())
+					Expect(serverError).NotTo(HaveOccurred())
+					Expect(protocol.SessionEncrypted(clientSession)).Should(BeFalse())
+					Expect(protocol.SessionEncrypted(serverSession)).Should(BeFalse())
+				}
+			})
+
+			It("should establish authenticated sessions with every suite", func() {
+				for _, suite := range []Suite{SuiteSecp256k1ECIES, SuiteP256ECDH, SuiteSecp256k1ECDH} {
+					ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+					defer cancel()
+
+					clientConn, serverConn := net.Pipe()
+					options := Options{Suites: Suites{suite}}
+					clientSession, serverSession, clientErr, serverError := handshakeWithOptions(ctx, clientConn, serverConn, options, options, NewHMACSessionManager(RandomPeerID()))
+					Expect(clientErr).NotTo(HaveOccurred())
+					Expect(serverError).NotTo(HaveOccurred())
+					Expect(protocol.SessionEncrypted(clientSession)).Should(BeFalse())
+					Expect(protocol.SessionEncrypted(serverSession)).Should(BeFalse())
+				}
+			})
+		})
+
+		Context("when the remote peer stops responding", func() {
+			It("should return an error once the context is done", func() {
+				ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+				defer cancel()
+
+				// Nothing is read from, or written to, the server side
+				clientConn, serverConn := net.Pipe()
+				defer serverConn.Close()
+
+				clientHandshaker := New(NewMockSignVerifier(), NewGCMSessionManager())
+				_, err := clientHandshaker.Handshake(ctx, clientConn)
+				Expect(err).To(HaveOccurred())
+			})
+		})
+	})
+
+	Context("when negotiating the handshake suite", func() {
+		It("should cipher and decipher messages with every suite", func() {
+			for _, suite := range []Suite{SuiteSecp256k1ECIES, SuiteP256ECDH, SuiteSecp256k1ECDH} {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+				defer cancel()
+
+				clientConn, serverConn := net.Pipe()
+				options := Options{Suites: Suites{suite}}
+				clientSession, serverSession, clientErr, serverError := handshakeWithOptions(ctx, clientConn, serverConn, options, Options{}, NewGCMSessionManager())
+				Expect(clientErr).NotTo(HaveOccurred())
+				Expect(serverError).NotTo(HaveOccurred())
+
+				var readMessage protocol.MessageOnTheWire
+				message := RandomMessage(protocol.V1, RandomMessageVariant())
+				phi.ParBegin(func() {
+					clientErr = clientSession.WriteMessage(clientConn, message)
+				}, func() {
+					readMessage, serverError = serverSession.ReadMessageOnTheWire(serverConn)
+				})
+				Expect(clientErr).NotTo(HaveOccurred())
+				Expect(serverError).NotTo(HaveOccurred())
+				Expect(cmp.Equal(readMessage.Message, message, cmpopts.EquateEmpty())).Should(BeTrue())
+			}
+		})
+
+		It("should only use FIPS-approved suites in FIPS mode", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			clientConn, serverConn := net.Pipe()
+			clientSession, serverSession, clientErr, serverError := handshakeWithOptions(ctx, clientConn, serverConn, Options{FIPS: true}, Options{}, NewGCMSessionManager())
+			Expect(clientErr).NotTo(HaveOccurred())
+			Expect(serverError).NotTo(HaveOccurred())
+			Expect(protocol.SessionEncrypted(clientSession)).Should(BeTrue())
+			Expect(protocol.SessionEncrypted(serverSession)).Should(BeTrue())
+		})
+
+		It("should return an error if the peers have no suite in common", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			clientConn, serverConn := net.Pipe()
+			clientOptions := Options{Suites: Suites{SuiteSecp256k1ECIES}}
+			_, _, clientErr, serverError := handshakeWithOptions(ctx, clientConn, serverConn, clientOptions, Options{FIPS: true}, NewGCMSessionManager())
+			Expect(clientErr).To(BeAssignableToTypeOf(ErrNoCommonSuite{}))
+			Expect(serverError).To(BeAssignableToTypeOf(ErrNoCommonSuite{}))
+			Expect(serverError.(ErrNoCommonSuite).Remote).Should(Equal(Suites{SuiteSecp256k1ECIES}))
+		})
+
+		It("should return an error if the session is not encrypted in FIPS mode", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			clientConn, serverConn := net.Pipe()
+			_, _, clientErr, serverError := handshakeWithOptions(ctx, clientConn, serverConn, Options{FIPS: true}, Options{FIPS: true}, NewInsecureSessionManager())
+			Expect(clientErr).To(HaveOccurred())
+			Expect(serverError).To(HaveOccurred())
+		})
+
+		It("should not negotiate suites that are weaker than the minimum suite", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			clientConn, serverConn := net.Pipe()
+			clientOptions := Options{Suites: Suites{SuiteSecp256k1ECIES}}
+			_, _, clientErr, serverError := handshakeWithOptions(ctx, clientConn, serverConn, clientOptions, Options{MinSuite: SuiteP256ECDH}, NewGCMSessionManager())
+			Expect(clientErr).To(BeAssignableToTypeOf(ErrNoCommonSuite{}))
+			Expect(serverError).To(BeAssignableToTypeOf(ErrNoCommonSuite{}))
+			Expect(serverError.(ErrNoCommonSuite).Local).Should(Equal(Suites{SuiteP256ECDH}))
+		})
+
+		It("should not negotiate key transport when the minimum suite is a key agreement", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			clientConn, serverConn := net.Pipe()
+			clientOptions := Options{Suites: Suites{SuiteSecp256k1ECIES}}
+			_, _, clientErr, serverError := handshakeWithOptions(ctx, clientConn, serverConn, clientOptions, Options{MinSuite: SuiteSecp256k1ECDH}, NewGCMSessionManager())
+			Expect(clientErr).To(BeAssignableToTypeOf(ErrNoCommonSuite{}))
+			Expect(serverError).To(BeAssignableToTypeOf(ErrNoCommonSuite{}))
+			Expect(serverError.(ErrNoCommonSuite).Local).Should(Equal(Suites{SuiteP256ECDH, SuiteSecp256k1ECDH}))
+		})
+
+		It("should return an error if the suite proposal is tampered with", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			// An attacker in the middle removes the strongest suite from the
+			// proposal of the client, and relays everything else.
+			clientConn, attackerClientConn := net.Pipe()
+			attackerServerConn, serverConn := net.Pipe()
+			go func() {
+				defer attackerClientConn.Close()
+				defer attackerServerConn.Close()
+
+				dataLen := uint64(0)
+				Expect(binary.Read(attackerClientConn, binary.LittleEndian, &dataLen)).To(Succeed())
+				Expect(binary.Read(attackerClientConn, binary.LittleEndian, make([]byte, dataLen))).To(Succeed())
+				Expect(binary.Write(attackerServerConn, binary.LittleEndian, uint64(1))).To(Succeed())
+				Expect(binary.Write(attackerServerConn, binary.LittleEndian, []byte{byte(SuiteSecp256k1ECIES)})).To(Succeed())
+
+				go func() {
+					defer attackerClientConn.Close()
+					io.Copy(attackerClientConn, attackerServerConn)
+				}()
+				io.Copy(attackerServerConn, attackerClientConn)
+			}()
+
+			clientSignVerifier := NewMockSignVerifier()
+			serverSignVerifier := NewMockSignVerifier(clientSignVerifier.ID())
+			clientSignVerifier.Whitelist(serverSignVerifier.ID())
+			clientHandshaker := New(clientSignVerifier, NewGCMSessionManager())
+			serverHandshaker := New(serverSignVerifier, NewGCMSessionManager())
+
+			var clientErr, serverError error
+			phi.ParBegin(func() {
+				_, clientErr = clientHandshaker.Handshake(ctx, clientConn)
+			}, func() {
+				_, serverError = serverHandshaker.AcceptHandshake(ctx, serverConn)
+				serverConn.Close()
+			})
+			Expect(clientErr).To(HaveOccurred())
+			Expect(serverError).To(BeAssignableToTypeOf(ErrNegotiationTampered{}))
+			Expect(serverError.(ErrNegotiationTampered).PeerID.String()).Should(Equal(clientSignVerifier.ID()))
+		})
+
+		It("should panic if no suite is FIPS-approved in FIPS mode", func() {
+			Expect(func() {
+				_ = NewWithOptions(Options{FIPS: true, Suites: Suites{SuiteSecp256k1ECIES}}, NewMockSignVerifier(), NewGCMSessionManager())
+			}).Should(Panic())
+		})
+	})
+
+	Context("when using a pre-shared key", func() {
+		It("should handshake with peers that know the same key", func() {
+			for _, suite := range []Suite{SuiteSecp256k1ECIES, SuiteP256ECDH, SuiteSecp256k1ECDH} {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+				defer cancel()
+
+				clientConn, serverConn := net.Pipe()
+				options := Options{Suites: Suites{suite}, PSK: []byte("network")}
+				_, _, clientErr, serverError := handshakeWithOptions(ctx, clientConn, serverConn, options, options, NewGCMSessionManager())
+				Expect(clientErr).NotTo(HaveOccurred())
+				Expect(serverError).NotTo(HaveOccurred())
+			}
+		})
+
+		It("should return an error if the peers know different keys", func() {
+			for _, suite := range []Suite{SuiteSecp256k1ECIES, SuiteP256ECDH, SuiteSecp256k1ECDH} {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+				defer cancel()
+
+				clientConn, serverConn := net.Pipe()
+				clientOptions := Options{Suites: Suites{suite}, PSK: []byte("network")}
+				serverOptions := Options{Suites: Suites{suite}, PSK: []byte("another network")}
+				_, _, clientErr, serverError := handshakeWithOptions(ctx, clientConn, serverConn, clientOptions, serverOptions, NewGCMSessionManager())
+				Expect(clientErr).To(HaveOccurred())
+				Expect(serverError).To(BeAssignableToTypeOf(ErrPSKMismatch{}))
+			}
+		})
+
+		It("should return an error if the remote peer does not know the key", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			clientConn, serverConn := net.Pipe()
+			_, _, clientErr, serverError := handshakeWithOptions(ctx, clientConn, serverConn, Options{}, Options{PSK: []byte("network")}, NewGCMSessionManager())
+			Expect(clientErr).To(HaveOccurred())
+			Expect(serverError).To(BeAssignableToTypeOf(ErrPSKMismatch{}))
+
+			// The server cannot echo the proof of the client, because proofs
+			// are bound to the role of the peer.
+			clientConn, serverConn = net.Pipe()
+			_, _, clientErr, serverError = handshakeWithOptions(ctx, clientConn, serverConn, Options{PSK: []byte("network")}, Options{}, NewGCMSessionManager())
+			Expect(clientErr).To(BeAssignableToTypeOf(ErrPSKMismatch{}))
+			Expect(serverError).To(HaveOccurred())
+		})
+
+		It("should return an error if a captured proof is replayed under another identity", func() {
+			for _, suite := range []Suite{SuiteSecp256k1ECIES, SuiteP256ECDH, SuiteSecp256k1ECDH} {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+				defer cancel()
+
+				// Capture the handshake of a client that knows the key
+				options := Options{Suites: Suites{suite}, PSK: []byte("network")}
+				clientConn, serverConn := net.Pipe()
+				captured := recordingConn{Conn: clientConn, written: new(bytes.Buffer)}
+				_, _, clientErr, serverError := handshakeWithOptions(ctx, captured, serverConn, options, options, NewGCMSessionManager())
+				Expect(clientErr).NotTo(HaveOccurred())
+				Expect(serverError).NotTo(HaveOccurred())
+
+				// The client writes the suites, compressions and padding that
+				// it proposes, and then its public key, the negotiation
+				// transcript, its proof, its signature and its confirmation
+				items := [][]byte{}
+				for captured.written.Len() > 0 {
+					var length uint64
+					Expect(binary.Read(captured.written, binary.LittleEndian, &length)).To(Succeed())
+					items = append(items, captured.written.Next(int(length)))
+				}
+				Expect(len(items)).To(BeNumerically(">=", 8))
+				publicKey, negotiation, proof, confirmation := items[3], items[4], items[5], items[7]
+
+				// Replay the captured proof, signed by another identity, to a
+				// server that accepts the identity
+				attacker := NewMockSignVerifier()
+				signature, err := attacker.Sign(attacker.Hash(append(append(append([]byte{}, publicKey...), negotiation...), proof...)))
+				Expect(err).NotTo(HaveOccurred())
+				replayed := append(append([][]byte{}, items[:3]...), publicKey, negotiation, proof, signature, confirmation)
+				attackerConn, serverConn := net.Pipe()
+				serverHandshaker := NewWithOptions(options, NewMockSignVerifier(attacker.ID()), NewGCMSessionManager())
+				go io.Copy(ioutil.Discard, attackerConn)
+				go func() {
+					for _, item := range replayed {
+						if err := binary.Write(attackerConn, binary.LittleEndian, uint64(len(item))); err != nil {
+							return
+						}
+						if _, err := attackerConn.Write(item); err != nil {
+							return
+						}
+					}
+				}()
+				_, serverError = serverHandshaker.AcceptHandshake(ctx, serverConn)
+				serverConn.Close()
+				Expect(serverError).To(BeAssignableToTypeOf(ErrPSKMismatch{}))
+			}
+		})
+	})
+
+	Context("when identifying the network", func() {
+		It("should handshake with peers in the same network", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			clientConn, serverConn := net.Pipe()
+			options := Options{NetworkID: "mainnet"}
+			_, _, clientErr, serverError := handshakeWithOptions(ctx, clientConn, serverConn, options, options, NewGCMSessionManager())
+			Expect(clientErr).NotTo(HaveOccurred())
+			Expect(serverError).NotTo(HaveOccurred())
+		})
+
+		It("should reject peers in another network before the handshake", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			clientConn, serverConn := net.Pipe()
+			_, _, clientErr, serverError := handshakeWithOptions(ctx, clientConn, serverConn, Options{NetworkID: "testnet"}, Options{NetworkID: "mainnet"}, NewGCMSessionManager())
+			Expect(clientErr).To(HaveOccurred())
+			Expect(serverError).To(BeAssignableToTypeOf(ErrIdentify{}))
+			Expect(serverError.(ErrIdentify).Kind).To(Equal(IdentifyWrongNetwork))
+			Expect(serverError.(ErrIdentify).Remote).To(Equal(Identity{Protocol: IdentifyProtocol, Version: IdentifyVersion, NetworkID: "testnet"}))
+		})
+
+		It("should reject clients that do not identify themselves without writing anything", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			// The client is a port scanner that writes a request of another
+			// protocol
+			clientConn, serverConn := net.Pipe()
+			serverHandshaker := NewWithOptions(Options{NetworkID: "mainnet"}, NewMockSignVerifier(), NewGCMSessionManager())
+			var serverError error
+			var read int
+			phi.ParBegin(func() {
+				clientConn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+				read, _ = clientConn.Read(make([]byte, 1))
+			}, func() {
+				_, serverError = serverHandshaker.AcceptHandshake(ctx, serverConn)
+				serverConn.Close()
+			})
+			Expect(serverError).To(BeAssignableToTypeOf(ErrIdentify{}))
+			Expect(serverError.(ErrIdentify).Kind).To(Equal(IdentifyWrongProtocol))
+			Expect(read).To(BeZero())
+		})
+
+		It("should reject servers in another network", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			// The server reads the identify frame of the client, and then
+			// writes the identify frame of another network
+			clientConn, serverConn := net.Pipe()
+			clientHandshaker := NewWithOptions(Options{NetworkID: "mainnet"}, NewMockSignVerifier(), NewGCMSessionManager())
+			frame := make([]byte, 6)
+			binary.LittleEndian.PutUint32(frame, IdentifyMagic)
+			binary.LittleEndian.PutUint16(frame[4:], IdentifyVersion)
+			frame = append(frame, byte(len(IdentifyProtocol)))
+			frame = append(frame, IdentifyProtocol...)
+			frame = append(frame, byte(len("testnet")))
+			frame = append(frame, "testnet"...)
+			var clientErr error
+			phi.ParBegin(func() {
+				_, clientErr = clientHandshaker.Handshake(ctx, clientConn)
+				clientConn.Close()
+			}, func() {
+				_, err := io.ReadFull(serverConn, make([]byte, len(frame)))
+				Expect(err).NotTo(HaveOccurred())
+				serverConn.Write(frame)
+			})
+			Expect(clientErr).To(BeAssignableToTypeOf(ErrIdentify{}))
+			Expect(clientErr.(ErrIdentify).Kind).To(Equal(IdentifyWrongNetwork))
+		})
+
+		It("should panic if the network id is too long", func() {
+			Expect(func() {
+				NewWithOptions(Options{NetworkID: string(make([]byte, MaxNetworkIDLength+1))}, NewMockSignVerifier(), NewGCMSessionManager())
+			}).To(Panic())
+		})
+	})
+
+	Context("when padding messages", func() {
+		It("should write messages of uniform lengths", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			clientConn, serverConn := net.Pipe()
+			clientOptions := Options{PaddingBucketSize: 512}
+			serverOptions := Options{PaddingBucketSize: 1024}
+			clientSession, serverSession, clientErr, serverError := handshakeWithOptions(ctx, clientConn, serverConn, clientOptions, serverOptions, NewGCMSessionManager())
+			Expect(clientErr).NotTo(HaveOccurred())
+			Expect(serverError).NotTo(HaveOccurred())
+			Expect(clientSession.(PaddedSession).BucketSize()).Should(Equal(1024))
+			Expect(serverSession.(PaddedSession).BucketSize()).Should(Equal(1024))
+
+			lengths := map[int]bool{}
+			for _, size := range []int{0, 1, 100, 1000} {
+				buf := new(bytes.Buffer)
+				message := protocol.NewMessage(protocol.V1, protocol.Cast, protocol.NilGroupID, make(protocol.MessageBody, size))
+				Expect(clientSession.WriteMessage(buf, message)).To(Succeed())
+				lengths[buf.Len()] = true
+
+				readMessage, err := serverSession.ReadMessageOnTheWire(buf)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(cmp.Equal(readMessage.Message, message, cmpopts.EquateEmpty())).Should(BeTrue())
+			}
+			Expect(lengths).Should(HaveLen(1))
+		})
+
+		It("should discard cover messages", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			clientConn, serverConn := net.Pipe()
+			clientSession, serverSession, clientErr, serverError := handshakeWithOptions(ctx, clientConn, serverConn, Options{PaddingBucketSize: 256}, Options{}, NewGCMSessionManager())
+			Expect(clientErr).NotTo(HaveOccurred())
+			Expect(serverError).NotTo(HaveOccurred())
+
+			buf := new(bytes.Buffer)
+			message := RandomMessage(protocol.V1, RandomMessageVariant())
+			Expect(clientSession.(PaddedSession).WriteCover(buf)).To(Succeed())
+			Expect(clientSession.(PaddedSession).WriteCover(buf)).To(Succeed())
+			Expect(clientSession.WriteMessage(buf, message)).To(Succeed())
+
+			readMessage, err := serverSession.ReadMessageOnTheWire(buf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cmp.Equal(readMessage.Message, message, cmpopts.EquateEmpty())).Should(BeTrue())
+			Expect(buf.Len()).Should(Equal(0))
+		})
+
+		It("should not compress padded sessions", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			clientConn, serverConn := net.Pipe()
+			options := Options{Compressions: Compressions{CompressionSnappy}, PaddingBucketSize: 256}
+			clientSession, serverSession, clientErr, serverError := handshakeWithOptions(ctx, clientConn, serverConn, options, Options{}, NewGCMSessionManager())
+			Expect(clientErr).NotTo(HaveOccurred())
+			Expect(serverError).NotTo(HaveOccurred())
+			_, ok := clientSession.(CompressedSession)
+			Expect(ok).Should(BeFalse())
+			_, ok = serverSession.(CompressedSession)
+			Expect(ok).Should(BeFalse())
+		})
+	})
+
+	Context("when compressing message bodies", func() {
+		It("should compress large bodies before they are encrypted", func() {
+			for _, compression := range []Compression{CompressionBodyGzip, CompressionBodySnappy} {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+				defer cancel()
+
+				clientConn, serverConn := net.Pipe()
+				clientOptions := Options{Compressions: Compressions{compression, CompressionNone}}
+				clientSession, serverSession, clientErr, serverError := handshakeWithOptions(ctx, clientConn, serverConn, clientOptions, Options{}, NewGCMSessionManager())
+				Expect(clientErr).NotTo(HaveOccurred())
+				Expect(serverError).NotTo(HaveOccurred())
+				Expect(clientSession.(CompressedSession).Compression()).Should(Equal(compression))
+				Expect(serverSession.(CompressedSession).Compression()).Should(Equal(compression))
+
+				for _, size := range []int{0, 100, 100000} {
+					buf := new(bytes.Buffer)
+					message := protocol.NewMessage(protocol.V1, protocol.Broadcast, RandomGroupID(), bytes.Repeat([]byte("blob"), size/4))
+					Expect(clientSession.WriteMessage(buf, message)).To(Succeed())
+					if size < 1024 {
+						Expect(buf.Len()).Should(BeNumerically(">", size))
+					} else {
+						Expect(buf.Len()).Should(BeNumerically("<", size/10))
+					}
+
+					readMessage, err := serverSession.ReadMessageOnTheWire(buf)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(cmp.Equal(readMessage.Message, message, cmpopts.EquateEmpty())).Should(BeTrue())
+					Expect(buf.Len()).Should(Equal(0))
+				}
+				stats := clientSession.(CompressedSession).CompressionStats()
+				Expect(stats.CompressedBytesWritten).Should(BeNumerically("<", stats.UncompressedBytesWritten))
+				stats = serverSession.(CompressedSession).CompressionStats()
+				Expect(stats.UncompressedBytesRead).Should(BeNumerically(">", stats.CompressedBytesRead))
+			}
+		})
+
+		It("should not compress bodies when the remote peer does not support it", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			clientConn, serverConn := net.Pipe()
+			clientOptions := Options{Compressions: Compressions{CompressionBodyGzip, CompressionNone}}
+			serverOptions := Options{Compressions: Compressions{CompressionNone}}
+			clientSession, serverSession, clientErr, serverError := handshakeWithOptions(ctx, clientConn, serverConn, clientOptions, serverOptions, NewGCMSessionManager())
+			Expect(clientErr).NotTo(HaveOccurred())
+			Expect(serverError).NotTo(HaveOccurred())
+			_, ok := clientSession.(CompressedSession)
+			Expect(ok).Should(BeFalse())
+			_, ok = serverSession.(CompressedSession)
+			Expect(ok).Should(BeFalse())
+		})
+
+		It("should return an error if a body is too large once it is decompressed", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			clientConn, serverConn := net.Pipe()
+			clientOptions := Options{Compressions: Compressions{CompressionBodyGzip}}
+			serverOptions := Options{Compressions: Compressions{CompressionBodyGzip}, MaxDecompressedMessageLength: 1024 * 1024}
+			clientSession, serverSession, clientErr, serverError := handshakeWithOptions(ctx, clientConn, serverConn, clientOptions, serverOptions, NewGCMSessionManager())
+			Expect(clientErr).NotTo(HaveOccurred())
+			Expect(serverError).NotTo(HaveOccurred())
+
+			buf := new(bytes.Buffer)
+			message := protocol.NewMessage(protocol.V1, protocol.Cast, protocol.NilGroupID, make(protocol.MessageBody, 2*1024*1024))
+			Expect(clientSession.WriteMessage(buf, message)).To(Succeed())
+			_, err := serverSession.ReadMessageOnTheWire(buf)
+			Expect(err).To(BeAssignableToTypeOf(ErrDecompressedMessageTooLarge{}))
+		})
+	})
+
+	Context("when decoding messages strictly", func() {
+		It("should return an error if a message is not encoded canonically", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			clientConn, serverConn := net.Pipe()
+			clientSession, serverSession, clientErr, serverError := handshakeWithOptions(ctx, clientConn, serverConn, Options{}, Options{Strict: true}, NewInsecureSessionManager())
+			Expect(clientErr).NotTo(HaveOccurred())
+			Expect(serverError).NotTo(HaveOccurred())
+
+			buf := new(bytes.Buffer)
+			message := protocol.NewMessage(protocol.V1, protocol.Cast, protocol.NilGroupID, protocol.MessageBody("canonical"))
+			Expect(clientSession.WriteMessage(buf, message)).To(Succeed())
+			readMessage, err := serverSession.ReadMessageOnTheWire(buf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(readMessage.Message).Should(Equal(message))
+
+			message = protocol.NewMessage(protocol.V2, protocol.Cast, protocol.NilGroupID, protocol.MessageBody("non-canonical"))
+			Expect(clientSession.WriteMessage(buf, message)).To(Succeed())
+			_, err = serverSession.ReadMessageOnTheWire(buf)
+			Expect(err).To(BeAssignableToTypeOf(protocol.ErrNonCanonicalMessage{}))
+		})
+
+		It("should return an error if the padding of a message is not zeroed", func() {
+			for _, strict := range []bool{false, true} {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+				defer cancel()
+
+				clientConn, serverConn := net.Pipe()
+				_, serverSession, clientErr, serverError := handshakeWithOptions(ctx, clientConn, serverConn, Options{PaddingBucketSize: 64}, Options{Strict: strict}, NewInsecureSessionManager())
+				Expect(clientErr).NotTo(HaveOccurred())
+				Expect(serverError).NotTo(HaveOccurred())
+
+				// The insecure session writes messages as they are, so the
+				// padding can be written by hand
+				body := make(protocol.MessageBody, 56)
+				binary.LittleEndian.PutUint32(body, 1)
+				body[4] = 'a'
+				body[55] = 1
+				data, err := protocol.NewMessage(protocol.V1, protocol.Cast, protocol.NilGroupID, body).MarshalBinary()
+				Expect(err).NotTo(HaveOccurred())
+
+				_, err = serverSession.ReadMessageOnTheWire(bytes.NewReader(data))
+				if strict {
+					Expect(err).To(BeAssignableToTypeOf(protocol.ErrNonCanonicalMessage{}))
+				} else {
+					Expect(err).NotTo(HaveOccurred())
+				}
+			}
+		})
+	})
+
+	Context("when framing messages", func() {
+		It("should write framed messages, and read them whether they are framed or not", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			clientConn, serverConn := net.Pipe()
+			clientSession, serverSession, clientErr, serverError := handshakeWithOptions(ctx, clientConn, serverConn, Options{Framed: true}, Options{}, NewGCMSessionManager())
+			Expect(clientErr).NotTo(HaveOccurred())
+			Expect(serverError).NotTo(HaveOccurred())
+
+			buf := new(bytes.Buffer)
+			message := protocol.NewMessage(protocol.V1, protocol.Cast, protocol.NilGroupID, protocol.MessageBody("framed"))
+			Expect(clientSession.WriteMessage(buf, message)).To(Succeed())
+			Expect(binary.LittleEndian.Uint32(buf.Bytes())).To(Equal(protocol.FrameMagic))
+			readMessage, err := serverSession.ReadMessageOnTheWire(buf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(readMessage.Message.Framed).To(BeTrue())
+			Expect(readMessage.Message.Body).To(Equal(message.Body))
+
+			message = protocol.NewMessage(protocol.V1, protocol.Cast, protocol.NilGroupID, protocol.MessageBody("unframed"))
+			Expect(serverSession.WriteMessage(buf, message)).To(Succeed())
+			readMessage, err = clientSession.ReadMessageOnTheWire(buf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(readMessage.Message.Framed).To(BeFalse())
+			Expect(readMessage.Message.Body).To(Equal(message.Body))
+		})
+
+		It("should write and read framed messages in a compressed stream", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			clientConn, serverConn := net.Pipe()
+			clientOptions := Options{Framed: true, Compressions: Compressions{CompressionSnappy}}
+			serverOptions := Options{Compressions: Compressions{CompressionSnappy}, MaxDecompressedMessageLength: 1024}
+			clientSession, serverSession, clientErr, serverError := handshakeWithOptions(ctx, clientConn, serverConn, clientOptions, serverOptions, NewGCMSessionManager())
+			Expect(clientErr).NotTo(HaveOccurred())
+			Expect(serverError).NotTo(HaveOccurred())
+
+			toServer, toClient := new(bytes.Buffer), new(bytes.Buffer)
+			for i := 0; i < 4; i++ {
+				message := RandomMessage(protocol.V1, protocol.Cast)
+				Expect(clientSession.WriteMessage(toServer, message)).To(Succeed())
+				readMessage, err := serverSession.ReadMessageOnTheWire(toServer)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(readMessage.Message.Framed).To(BeTrue())
+				Expect(readMessage.Message.Body).To(Equal(message.Body))
+
+				message = RandomMessage(protocol.V1, protocol.Cast)
+				Expect(serverSession.WriteMessage(toClient, message)).To(Succeed())
+				readMessage, err = clientSession.ReadMessageOnTheWire(toClient)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(readMessage.Message.Framed).To(BeFalse())
+				Expect(readMessage.Message.Body).To(Equal(message.Body))
+			}
+
+			// The limit applies to the length of the framed message
+			message := protocol.NewMessage(protocol.V1, protocol.Cast, protocol.NilGroupID, make(protocol.MessageBody, 2048))
+			Expect(clientSession.WriteMessage(toServer, message)).To(Succeed())
+			_, err := serverSession.ReadMessageOnTheWire(toServer)
+			Expect(err).To(BeAssignableToTypeOf(ErrDecompressedMessageTooLarge{}))
+		})
+	})
+
+	Context("when a handshake or session is downgraded", func() {
+		It("should report the downgrade of the suite", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			events := make(chan protocol.EventDowngraded, 1)
+			clientConn, serverConn := net.Pipe()
+			clientOptions := Options{Suites: Suites{SuiteSecp256k1ECDH, SuiteSecp256k1ECIES}, Downgraded: func(event protocol.EventDowngraded) { events <- event }}
+			clientSession, _, clientErr, serverError := handshakeWithOptions(ctx, clientConn, serverConn, clientOptions, Options{Suites: Suites{SuiteSecp256k1ECIES}}, NewGCMSessionManager())
+			Expect(clientErr).NotTo(HaveOccurred())
+			Expect(serverError).NotTo(HaveOccurred())
+
+			var event protocol.EventDowngraded
+			Eventually(events).Should(Receive(&event))
+			Expect(event.Kind).To(Equal(DowngradeSuite))
+			Expect(event.Preferred).To(Equal(SuiteSecp256k1ECDH.String()))
+			Expect(event.Negotiated).To(Equal(SuiteSecp256k1ECIES.String()))
+			Expect(event.Refused).To(BeFalse())
+			Expect(event.PeerID.Equal(protocol.SessionPeerID(clientSession))).To(BeTrue())
+		})
+
+		It("should not report suites that are stronger than the most preferred suite", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			downgraded := false
+			clientConn, serverConn := net.Pipe()
+			clientOptions := Options{Downgraded: func(protocol.EventDowngraded) { downgraded = true }}
+			serverOptions := Options{Suites: Suites{SuiteP256ECDH}, RefuseDowngrades: true}
+			_, _, clientErr, serverError := handshakeWithOptions(ctx, clientConn, serverConn, clientOptions, serverOptions, NewGCMSessionManager())
+			Expect(clientErr).NotTo(HaveOccurred())
+			Expect(serverError).NotTo(HaveOccurred())
+			Expect(downgraded).To(BeFalse())
+		})
+
+		It("should refuse to downgrade the suite when downgrades are refused", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			events := make(chan protocol.EventDowngraded, 1)
+			clientConn, serverConn := net.Pipe()
+			clientOptions := Options{Suites: Suites{SuiteSecp256k1ECDH, SuiteSecp256k1ECIES}, RefuseDowngrades: true, Downgraded: func(event protocol.EventDowngraded) { events <- event }}
+			_, _, clientErr, serverError := handshakeWithOptions(ctx, clientConn, serverConn, clientOptions, Options{Suites: Suites{SuiteSecp256k1ECIES}}, NewGCMSessionManager())
+			Expect(clientErr).To(BeAssignableToTypeOf(ErrDowngrade{}))
+			Expect(clientErr.(ErrDowngrade).Kind).To(Equal(DowngradeSuite))
+			Expect(serverError).To(HaveOccurred())
+
+			var event protocol.EventDowngraded
+			Eventually(events).Should(Receive(&event))
+			Expect(event.Refused).To(BeTrue())
+		})
+
+		It("should report, and refuse when downgrades are refused, messages that are not framed", func() {
+			for _, refuse := range []bool{false, true} {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+				defer cancel()
+
+				events := make(chan protocol.EventDowngraded, 2)
+				clientConn, serverConn := net.Pipe()
+				serverOptions := Options{Framed: true, RefuseDowngrades: refuse, Downgraded: func(event protocol.EventDowngraded) { events <- event }}
+				clientSession, serverSession, clientErr, serverError := handshakeWithOptions(ctx, clientConn, serverConn, Options{}, serverOptions, NewInsecureSessionManager())
+				Expect(clientErr).NotTo(HaveOccurred())
+				Expect(serverError).NotTo(HaveOccurred())
+
+				buf := new(bytes.Buffer)
+				for i := 0; i < 2; i++ {
+					Expect(clientSession.WriteMessage(buf, protocol.NewMessage(protocol.V1, protocol.Cast, protocol.NilGroupID, protocol.MessageBody("unframed")))).To(Succeed())
+				}
+				_, err := serverSession.ReadMessageOnTheWire(buf)
+				if refuse {
+					Expect(err).To(BeAssignableToTypeOf(ErrDowngrade{}))
+				} else {
+					Expect(err).NotTo(HaveOccurred())
+					_, err = serverSession.ReadMessageOnTheWire(buf)
+					Expect(err).NotTo(HaveOccurred())
+				}
+
+				// Only the first message that is not framed is reported
+				Expect(events).To(HaveLen(1))
+				event := <-events
+				Expect(event.Kind).To(Equal(DowngradeFraming))
+				Expect(event.Refused).To(Equal(refuse))
+			}
+		})
+	})
+
+	Context("when handshaking with legacy peers", func() {
+		// legacyPeers returns the SignVerifier of a peer that trusts a legacy
+		// peer, and the SignVerifier of the legacy peer.
+		legacyPeers := func() (protocol.SignVerifier, protocol.SignVerifier) {
+			signVerifier := NewMockSignVerifier()
+			legacySignVerifier := NewMockSignVerifier(signVerifier.ID())
+			signVerifier.Whitelist(legacySignVerifier.ID())
+			return signVerifier, legacySignVerifier
+		}
+
+		// Expect messages to be written, and read, both ways.
+		expectMessages := func(session, legacySession protocol.Session) {
+			for _, sessions := range [][2]protocol.Session{{session, legacySession}, {legacySession, session}} {
+				buf := new(bytes.Buffer)
+				message := protocol.NewMessage(protocol.V1, protocol.Cast, protocol.NilGroupID, protocol.MessageBody("legacy"))
+				Expect(sessions[0].WriteMessage(buf, message)).To(Succeed())
+				otw, err := sessions[1].ReadMessageOnTheWire(buf)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(otw.Message).To(Equal(message))
+			}
+		}
+
+		It("should accept handshakes from legacy clients, and report the downgrade", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			events := make(chan protocol.EventDowngraded, 1)
+			signVerifier, legacySignVerifier := legacyPeers()
+			serverHandshaker := NewWithOptions(Options{Framed: true, Compressions: Compressions{CompressionSnappy}, Downgraded: func(event protocol.EventDowngraded) { events <- event }}, signVerifier, NewGCMSessionManager())
+
+			clientConn, serverConn := net.Pipe()
+			var clientSession, serverSession protocol.Session
+			var clientErr, serverError error
+			phi.ParBegin(func() {
+				clientSession, clientErr = legacyHandshake(clientConn, legacySignVerifier, true)
+				closeOnError(clientConn, clientErr)
+			}, func() {
+				serverSession, serverError = serverHandshaker.AcceptHandshake(ctx, serverConn)
+				closeOnError(serverConn, serverError)
+			})
+			Expect(clientErr).NotTo(HaveOccurred())
+			Expect(serverError).NotTo(HaveOccurred())
+			expectMessages(serverSession, clientSession)
+
+			var event protocol.EventDowngraded
+			Eventually(events).Should(Receive(&event))
+			Expect(event.Kind).To(Equal(DowngradeHandshake))
+			Expect(event.Refused).To(BeFalse())
+			Expect(event.PeerID.Equal(protocol.SessionPeerID(serverSession))).To(BeTrue())
+		})
+
+		It("should return an error from handshakes with legacy servers, and fall back to the legacy handshake", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			events := make(chan protocol.EventDowngraded, 1)
+			signVerifier, legacySignVerifier := legacyPeers()
+			clientHandshaker := NewWithOptions(Options{Downgraded: func(event protocol.EventDowngraded) { events <- event }}, signVerifier, NewGCMSessionManager())
+
+			clientConn, serverConn := net.Pipe()
+			var clientErr, serverError error
+			phi.ParBegin(func() {
+				_, clientErr = clientHandshaker.Handshake(ctx, clientConn)
+				closeOnError(clientConn, clientErr)
+			}, func() {
+				_, serverError = legacyHandshake(serverConn, legacySignVerifier, false)
+				closeOnError(serverConn, serverError)
+			})
+			Expect(clientErr).To(BeAssignableToTypeOf(ErrLegacyPeer{}))
+			Expect(clientErr.(ErrLegacyPeer).Fallback).To(BeTrue())
+			Expect(serverError).To(HaveOccurred())
+
+			clientConn, serverConn = net.Pipe()
+			var clientSession, serverSession protocol.Session
+			phi.ParBegin(func() {
+				clientSession, clientErr = clientHandshaker.(LegacyHandshaker).LegacyHandshake(ctx, clientConn)
+				closeOnError(clientConn, clientErr)
+			}, func() {
+				serverSession, serverError = legacyHandshake(serverConn, legacySignVerifier, false)
+				closeOnError(serverConn, serverError)
+			})
+			Expect(clientErr).NotTo(HaveOccurred())
+			Expect(serverError).NotTo(HaveOccurred())
+			expectMessages(clientSession, serverSession)
+
+			var event protocol.EventDowngraded
+			Eventually(events).Should(Receive(&event))
+			Expect(event.Kind).To(Equal(DowngradeHandshake))
+			Expect(event.Refused).To(BeFalse())
+		})
+
+		It("should refuse the legacy handshake when downgrades are refused", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			events := make(chan protocol.EventDowngraded, 1)
+			signVerifier, legacySignVerifier := legacyPeers()
+			serverHandshaker := NewWithOptions(Options{RefuseDowngrades: true, Downgraded: func(event protocol.EventDowngraded) { events <- event }}, signVerifier, NewGCMSessionManager())
+
+			clientConn, serverConn := net.Pipe()
+			var serverError error
+			phi.ParBegin(func() {
+				_, err := legacyHandshake(clientConn, legacySignVerifier, true)
+				closeOnError(clientConn, err)
+			}, func() {
+				_, serverError = serverHandshaker.AcceptHandshake(ctx, serverConn)
+				closeOnError(serverConn, serverError)
+			})
+			Expect(serverError).To(BeAssignableToTypeOf(ErrDowngrade{}))
+			Expect(serverError.(ErrDowngrade).Kind).To(Equal(DowngradeHandshake))
+
+			var event protocol.EventDowngraded
+			Eventually(events).Should(Receive(&event))
+			Expect(event.Refused).To(BeTrue())
+		})
+
+		It("should not fall back to the legacy handshake when using a pre-shared key", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			signVerifier, legacySignVerifier := legacyPeers()
+			clientHandshaker := NewWithOptions(Options{PSK: []byte("psk")}, signVerifier, NewGCMSessionManager())
+
+			clientConn, serverConn := net.Pipe()
+			var clientErr error
+			phi.ParBegin(func() {
+				_, clientErr = clientHandshaker.Handshake(ctx, clientConn)
+				closeOnError(clientConn, clientErr)
+			}, func() {
+				_, err := legacyHandshake(serverConn, legacySignVerifier, false)
+				closeOnError(serverConn, err)
+			})
+			Expect(clientErr).To(BeAssignableToTypeOf(ErrLegacyPeer{}))
+			Expect(clientErr.(ErrLegacyPeer).Fallback).To(BeFalse())
+		})
+	})
+
+	Context("when negotiating the stream compression", func() {
+		It("should compress and decompress messages with snappy", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			clientConn, serverConn := net.Pipe()
+			clientOptions := Options{Compressions: Compressions{CompressionSnappy}}
+			clientSession, serverSession, clientErr, serverError := handshakeWithOptions(ctx, clientConn, serverConn, clientOptions, Options{}, NewInsecureSessionManager())
+			Expect(clientErr).NotTo(HaveOccurred())
+			Expect(serverError).NotTo(HaveOccurred())
+			Expect(clientSession.(CompressedSession).Compression()).Should(Equal(CompressionSnappy))
+			Expect(serverSession.(CompressedSession).Compression()).Should(Equal(CompressionSnappy))
+
+			test := func() bool {
+				var clientErr, serverError error
+				var readMessage protocol.MessageOnTheWire
+				message := RandomMessage(protocol.V1, RandomMessageVariant())
+
+				phi.ParBegin(func() {
+					clientErr = clientSession.WriteMessage(clientConn, message)
+				}, func() {
+					readMessage, serverError = serverSession.ReadMessageOnTheWire(serverConn)
+				})
+
+				Expect(clientErr).NotTo(HaveOccurred())
+				Expect(serverError).NotTo(HaveOccurred())
+				return cmp.Equal(readMessage.Message, message, cmpopts.EquateEmpty())
+			}
+			Expect(quick.Check(test, nil)).NotTo(HaveOccurred())
+
+			clientStats := clientSession.(CompressedSession).CompressionStats()
+			serverStats := serverSession.(CompressedSession).CompressionStats()
+			Expect(clientStats.UncompressedBytesWritten).Should(BeNumerically(">", 0))
+			Expect(clientStats.CompressedBytesWritten).Should(BeNumerically(">", 0))
+			Expect(serverStats.CompressedBytesRead).Should(Equal(clientStats.CompressedBytesWritten))
+			Expect(serverStats.UncompressedBytesRead).Should(Equal(clientStats.UncompressedBytesWritten))
+		})
+
+		It("should not compress by default", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			clientConn, serverConn := net.Pipe()
+			clientSession, serverSession := handshake(ctx, clientConn, serverConn)
+			_, ok := clientSession.(CompressedSession)
+			Expect(ok).Should(BeFalse())
+			_, ok = serverSession.(CompressedSession)
+			Expect(ok).Should(BeFalse())
+		})
+
+		It("should return an error if a decompressed message is too large", func() {
+			for _, suite := range []Suite{SuiteSecp256k1ECIES, SuiteP256ECDH, SuiteSecp256k1ECDH} {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+				defer cancel()
+
+				clientConn, serverConn := net.Pipe()
+				clientOptions := Options{Suites: Suites{suite}, Compressions: Compressions{CompressionSnappy}}
+				serverOptions := Options{MaxDecompressedMessageLength: 1024}
+				clientSession, serverSession, clientErr, serverError := handshakeWithOptions(ctx, clientConn, serverConn, clientOptions, serverOptions, NewInsecureSessionManager())
+				Expect(clientErr).NotTo(HaveOccurred())
+				Expect(serverError).NotTo(HaveOccurred())
+
+				// A large message of zeros compresses well, but must not be
+				// decompressed by the server
+				buffer := new(bytes.Buffer)
+				message := protocol.NewMessage(protocol.V1, protocol.Cast, protocol.NilGroupID, make(protocol.MessageBody, 1024*1024))
+				Expect(clientSession.WriteMessage(buffer, message)).To(Succeed())
+				Expect(buffer.Len()).Should(BeNumerically("<", int(message.Length)))
+				_, err := serverSession.ReadMessageOnTheWire(buffer)
+				Expect(err).To(BeAssignableToTypeOf(ErrDecompressedMessageTooLarge{}))
+				Expect(err.(ErrDecompressedMessageTooLarge).Length).Should(Equal(message.Length))
+			}
+		})
+
+		It("should return an error if decompressing a message takes too long", func() {
+			for _, suite := range []Suite{SuiteSecp256k1ECIES, SuiteP256ECDH, SuiteSecp256k1ECDH} {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+				defer cancel()
+
+				clientConn, serverConn := net.Pipe()
+				clientOptions := Options{Suites: Suites{suite}, Compressions: Compressions{CompressionSnappy}}
+				serverOptions := Options{MaxDecompressionTime: time.Nanosecond}
+				clientSession, serverSession, clientErr, serverError := handshakeWithOptions(ctx, clientConn, serverConn, clientOptions, serverOptions, NewInsecureSessionManager())
+				Expect(clientErr).NotTo(HaveOccurred())
+				Expect(serverError).NotTo(HaveOccurred())
+
+				buffer := new(bytes.Buffer)
+				message := protocol.NewMessage(protocol.V1, protocol.Cast, protocol.NilGroupID, make(protocol.MessageBody, 1024*1024))
+				Expect(clientSession.WriteMessage(buffer, message)).To(Succeed())
+				_, err := serverSession.ReadMessageOnTheWire(buffer)
+				Expect(err).To(BeAssignableToTypeOf(ErrDecompressionTooSlow{}))
+			}
+		})
+
+		It("should return an error if the peers have no compression in common", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			clientConn, serverConn := net.Pipe()
+			clientOptions := Options{Compressions: Compressions{CompressionSnappy}}
+			serverOptions := Options{Compressions: Compressions{CompressionNone}}
+			_, _, clientErr, serverError := handshakeWithOptions(ctx, clientConn, serverConn, clientOptions, serverOptions, NewGCMSessionManager())
+			Expect(clientErr).To(HaveOccurred())
+			Expect(serverError).To(HaveOccurred())
 		})
 	})
 
@@ -187,3 +1145,120 @@ var _ = Describe("Handshaker", func() {
 		})
 	})
 })
+
+// recordingConn is a net.Conn that records the bytes written to it.
+type recordingConn struct {
+	net.Conn
+	written *bytes.Buffer
+}
+
+func (conn recordingConn) Write(p []byte) (int, error) {
+	n, err := conn.Conn.Write(p)
+	conn.written.Write(p[:n])
+	return n, err
+}
+
+// legacyHandshake completes the handshake of a legacy peer, which predates the
+// negotiation of handshakes, as a client or as a server.
+func legacyHandshake(rw io.ReadWriter, signVerifier protocol.SignVerifier, isClient bool) (protocol.Session, error) {
+	sessionManager := NewGCMSessionManager()
+	privateKey, err := crypto.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	writePublicKey := func() error {
+		publicKeyBytes := crypto.FromECDSAPub(&privateKey.PublicKey)
+		sig, err := signVerifier.Sign(signVerifier.Hash(publicKeyBytes))
+		if err != nil {
+			return err
+		}
+		if err := legacyWrite(rw, publicKeyBytes); err != nil {
+			return err
+		}
+		return legacyWrite(rw, sig)
+	}
+	readPublicKey := func() (*ecdsa.PublicKey, protocol.PeerID, error) {
+		publicKeyBytes, err := legacyRead(rw)
+		if err != nil {
+			return nil, nil, err
+		}
+		publicKey, err := crypto.UnmarshalPubkey(publicKeyBytes)
+		if err != nil {
+			return nil, nil, err
+		}
+		sig, err := legacyRead(rw)
+		if err != nil {
+			return nil, nil, err
+		}
+		peerID, err := signVerifier.Verify(signVerifier.Hash(publicKeyBytes), sig)
+		return publicKey, peerID, err
+	}
+	writeSessionKey := func(publicKey *ecdsa.PublicKey, key []byte) error {
+		encrypted, err := ecies.Encrypt(rand.Reader, ecies.ImportECDSAPublic(publicKey), key, nil, nil)
+		if err != nil {
+			return err
+		}
+		return legacyWrite(rw, encrypted)
+	}
+	readSessionKey := func() ([]byte, error) {
+		encrypted, err := legacyRead(rw)
+		if err != nil {
+			return nil, err
+		}
+		return ecies.ImportECDSA(privateKey).Decrypt(encrypted, nil, nil)
+	}
+
+	var remotePublicKey *ecdsa.PublicKey
+	var remotePeerID protocol.PeerID
+	var remoteSessionKey []byte
+	localSessionKey := sessionManager.NewSessionKey()
+	if isClient {
+		if err := writePublicKey(); err != nil {
+			return nil, err
+		}
+		if remotePublicKey, remotePeerID, err = readPublicKey(); err != nil {
+			return nil, err
+		}
+		if err := writeSessionKey(remotePublicKey, localSessionKey); err != nil {
+			return nil, err
+		}
+		if remoteSessionKey, err = readSessionKey(); err != nil {
+			return nil, err
+		}
+	} else {
+		if remotePublicKey, remotePeerID, err = readPublicKey(); err != nil {
+			return nil, err
+		}
+		if err := writePublicKey(); err != nil {
+			return nil, err
+		}
+		if remoteSessionKey, err = readSessionKey(); err != nil {
+			return nil, err
+		}
+		if err := writeSessionKey(remotePublicKey, localSessionKey); err != nil {
+			return nil, err
+		}
+	}
+	sessionKey := make([]byte, len(localSessionKey))
+	for i := range sessionKey {
+		sessionKey[i] = localSessionKey[i] ^ remoteSessionKey[i]
+	}
+	return sessionManager.NewSession(remotePeerID, sessionKey), nil
+}
+
+func legacyWrite(w io.Writer, data []byte) error {
+	if err := binary.Write(w, binary.LittleEndian, uint64(len(data))); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.LittleEndian, data)
+}
+
+func legacyRead(r io.Reader) ([]byte, error) {
+	dataLen := uint64(0)
+	if err := binary.Read(r, binary.LittleEndian, &dataLen); err != nil {
+		return nil, err
+	}
+	data := make([]byte, dataLen)
+	_, err := io.ReadFull(r, data)
+	return data, err
+}
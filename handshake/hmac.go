@@ -0,0 +1,153 @@
+package handshake
+
+import (
+	"crypto/hmac"
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/renproject/aw/protocol"
+)
+
+// hmacTagLength is the length of the HMAC-SHA256 tag that is appended to the
+// body of every message.
+const hmacTagLength = sha256.Size
+
+type hmacSessionManager struct {
+	me protocol.PeerID
+}
+
+// NewHMACSessionManager returns a protocol.SessionManager that authenticates
+// messages, without encrypting them, for deployments that do not need the
+// confidentiality of NewGCMSessionManager. Every message is written in the
+// clear, with an HMAC-SHA256 tag of its header, its body and its sequence
+// number appended to its body, so that messages that are tampered with,
+// replayed, reordered or reflected back to their sender are rejected. The tags
+// are keyed by the session key that is agreed during the handshake, and by the
+// PeerID of the sender, so the manager must be given the PeerID of the local
+// Peer.
+func NewHMACSessionManager(me protocol.PeerID) protocol.SessionManager {
+	return hmacSessionManager{me: me}
+}
+
+func (manager hmacSessionManager) NewSession(peerID protocol.PeerID, key []byte) protocol.Session {
+	return &hmacSession{
+		peerID:   peerID,
+		writeKey: deriveHMACKey(key, manager.me),
+		readKey:  deriveHMACKey(key, peerID),
+	}
+}
+
+func (hmacSessionManager) NewSessionKey() []byte {
+	key := [32]byte{}
+	n, err := cryptorand.Read(key[:])
+	if n != 32 {
+		panic(fmt.Errorf("invariant violation: cannot generate session key: expected n=32, got n=%v", n))
+	}
+	if err != nil {
+		panic(fmt.Errorf("invariant violation: cannot generate session key: %v", err))
+	}
+	return key[:]
+}
+
+// deriveHMACKey returns the key of the tags of the messages sent by the peer,
+// so that the tags of the messages sent in each direction have different
+// keys.
+func deriveHMACKey(key []byte, sender protocol.PeerID) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("aw/hmac/"))
+	mac.Write([]byte(sender.String()))
+	return mac.Sum(nil)
+}
+
+type hmacSession struct {
+	peerID   protocol.PeerID
+	writeKey []byte
+	readKey  []byte
+
+	// Sequence numbers of the next messages written and read. They are
+	// covered by the tags, but are not sent.
+	writeSeq uint64
+	readSeq  uint64
+}
+
+func (session *hmacSession) PeerID() protocol.PeerID {
+	return session.peerID
+}
+
+func (session *hmacSession) Encrypted() bool {
+	return false
+}
+
+// Duplex returns true, because messages written and read by the session have
+// their own keys and sequence numbers.
+func (session *hmacSession) Duplex() bool {
+	return true
+}
+
+func (session *hmacSession) ReadMessageOnTheWire(r io.Reader) (protocol.MessageOnTheWire, error) {
+	otw := protocol.MessageOnTheWire{}
+	otw.From = session.peerID
+	if err := otw.Message.UnmarshalReader(r); err != nil {
+		return otw, err
+	}
+	if len(otw.Message.Body) < hmacTagLength {
+		return otw, fmt.Errorf("error reading message: expected tag len=%v, got len=%v", hmacTagLength, len(otw.Message.Body))
+	}
+	tag := otw.Message.Body[len(otw.Message.Body)-hmacTagLength:]
+	otw.Message.Body = otw.Message.Body[:len(otw.Message.Body)-hmacTagLength]
+	otw.Message.Length = protocol.MessageLength(otw.Message.NonBodyLength() + len(otw.Message.Body))
+
+	expected, err := tagMessage(session.readKey, session.readSeq, otw.Message)
+	if err != nil {
+		return otw, fmt.Errorf("error reading message: %v", err)
+	}
+	if !hmac.Equal(tag, expected) {
+		return otw, fmt.Errorf("error reading message: invalid tag from peer=%v", session.peerID)
+	}
+	session.readSeq++
+	return otw, nil
+}
+
+func (session *hmacSession) WriteMessage(w io.Writer, message protocol.Message) error {
+	message.Length = protocol.MessageLength(message.NonBodyLength() + len(message.Body))
+	tag, err := tagMessage(session.writeKey, session.writeSeq, message)
+	if err != nil {
+		return fmt.Errorf("error writing message: %v", err)
+	}
+	message.Body = append(append(protocol.MessageBody{}, message.Body...), tag...)
+	message.Length = protocol.MessageLength(message.NonBodyLength() + len(message.Body))
+
+	data, err := message.MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("error writing message: %v", err)
+	}
+	n, err := w.Write(data)
+	// The sequence number is used up as soon as any of the message is written,
+	// so that a retry after a short write is not sent with the same nonce
+	session.writeSeq++
+	if err != nil {
+		return err
+	}
+	if n != len(data) {
+		return fmt.Errorf("error writing message: expected n=%v, got n=%v", len(data), n)
+	}
+	return nil
+}
+
+// tagMessage returns the HMAC-SHA256 tag of the sequence number and the
+// encoding of the message.
+func tagMessage(key []byte, seq uint64, message protocol.Message) ([]byte, error) {
+	data, err := message.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	seqData := [8]byte{}
+	binary.BigEndian.PutUint64(seqData[:], seq)
+	mac := hmac.New(sha256.New, key)
+	mac.Write(seqData[:])
+	mac.Write(data)
+	return mac.Sum(nil), nil
+}
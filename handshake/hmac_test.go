@@ -0,0 +1,135 @@
+package handshake_test
+
+import (
+	"bytes"
+	"io"
+	"testing/quick"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/handshake"
+	. "github.com/renproject/aw/testutil"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/renproject/aw/protocol"
+)
+
+var _ = Describe("HMAC session manager", func() {
+	newSessions := func() (protocol.Session, protocol.Session, protocol.PeerID, protocol.PeerID) {
+		sender, receiver := RandomPeerID(), RandomPeerID()
+		key := NewHMACSessionManager(sender).NewSessionKey()
+		senderSession := NewHMACSessionManager(sender).NewSession(receiver, key)
+		receiverSession := NewHMACSessionManager(receiver).NewSession(sender, key)
+		return senderSession, receiverSession, sender, receiver
+	}
+
+	Context("when writing and reading messages with the same session keys", func() {
+		It("should be able to write and then read, without encrypting", func() {
+			test := func() bool {
+				senderSession, receiverSession, sender, receiver := newSessions()
+				Expect(protocol.SessionPeerID(senderSession).Equal(receiver)).Should(BeTrue())
+				Expect(protocol.SessionEncrypted(senderSession)).Should(BeFalse())
+
+				buf := bytes.NewBuffer([]byte{})
+				sentMsgs := []protocol.Message{
+					RandomMessage(protocol.V1, RandomMessageVariant()),
+					RandomMessage(protocol.V1, RandomMessageVariant()),
+				}
+				for _, sentMsg := range sentMsgs {
+					Expect(senderSession.WriteMessage(buf, sentMsg)).NotTo(HaveOccurred())
+					Expect(bytes.Contains(buf.Bytes(), sentMsg.Body)).Should(BeTrue())
+				}
+				for _, sentMsg := range sentMsgs {
+					receivedMsg, err := receiverSession.ReadMessageOnTheWire(buf)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(receivedMsg.From.Equal(sender)).Should(BeTrue())
+					Expect(cmp.Equal(receivedMsg.Message, sentMsg, cmpopts.EquateEmpty())).Should(BeTrue())
+				}
+				return true
+			}
+
+			Expect(quick.Check(test, nil)).NotTo(HaveOccurred())
+		})
+	})
+
+	Context("when a message is tampered with", func() {
+		It("should not be able to read it", func() {
+			test := func() bool {
+				senderSession, receiverSession, _, _ := newSessions()
+				buf := bytes.NewBuffer([]byte{})
+				sentMsg := RandomMessage(protocol.V1, protocol.Cast)
+				Expect(senderSession.WriteMessage(buf, sentMsg)).NotTo(HaveOccurred())
+
+				data := buf.Bytes()
+				data[8] ^= 1
+				_, err := receiverSession.ReadMessageOnTheWire(bytes.NewBuffer(data))
+				Expect(err).To(HaveOccurred())
+				return true
+			}
+
+			Expect(quick.Check(test, nil)).NotTo(HaveOccurred())
+		})
+	})
+
+	Context("when a message is replayed", func() {
+		It("should not be able to read it again", func() {
+			senderSession, receiverSession, _, _ := newSessions()
+			buf := bytes.NewBuffer([]byte{})
+			Expect(senderSession.WriteMessage(buf, RandomMessage(protocol.V1, protocol.Cast))).NotTo(HaveOccurred())
+			data := append([]byte{}, buf.Bytes()...)
+
+			_, err := receiverSession.ReadMessageOnTheWire(bytes.NewBuffer(data))
+			Expect(err).NotTo(HaveOccurred())
+			_, err = receiverSession.ReadMessageOnTheWire(bytes.NewBuffer(data))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("when a message is written short", func() {
+		It("should write the retry with the next nonce", func() {
+			senderSession, receiverSession, _, _ := newSessions()
+			w := &shortWriter{}
+			sentMsg := RandomMessage(protocol.V1, protocol.Cast)
+			Expect(senderSession.WriteMessage(w, sentMsg)).To(Equal(io.ErrShortWrite))
+			Expect(senderSession.WriteMessage(w, sentMsg)).To(Succeed())
+			Expect(w.writes).To(HaveLen(2))
+			Expect(w.writes[1]).NotTo(Equal(w.writes[0]))
+
+			// Both attempts can be read in order, so the first one used up the
+			// nonce of its sequence number
+			for _, data := range w.writes {
+				receivedMsg, err := receiverSession.ReadMessageOnTheWire(bytes.NewBuffer(data))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(cmp.Equal(receivedMsg.Message, sentMsg, cmpopts.EquateEmpty())).Should(BeTrue())
+			}
+		})
+	})
+
+	Context("when a message is reflected back to its sender", func() {
+		It("should not be able to read it", func() {
+			sender, receiver := RandomPeerID(), RandomPeerID()
+			key := NewHMACSessionManager(sender).NewSessionKey()
+			senderSession := NewHMACSessionManager(sender).NewSession(receiver, key)
+
+			buf := bytes.NewBuffer([]byte{})
+			Expect(senderSession.WriteMessage(buf, RandomMessage(protocol.V1, protocol.Cast))).NotTo(HaveOccurred())
+			_, err := senderSession.ReadMessageOnTheWire(buf)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("when writing and reading messages with different session keys", func() {
+		It("should not be able to write and then read", func() {
+			sender, receiver := RandomPeerID(), RandomPeerID()
+			manager := NewHMACSessionManager(sender)
+			senderSession := manager.NewSession(receiver, manager.NewSessionKey())
+			receiverSession := NewHMACSessionManager(receiver).NewSession(sender, manager.NewSessionKey())
+
+			buf := bytes.NewBuffer([]byte{})
+			Expect(senderSession.WriteMessage(buf, RandomMessage(protocol.V1, protocol.Cast))).NotTo(HaveOccurred())
+			_, err := receiverSession.ReadMessageOnTheWire(buf)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,135 @@
+package handshake
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// IdentifyMagic is the first field of every identify frame, so that servers
+// can tell peers that speak the protocol apart from other clients (e.g. port
+// scanners) by reading four bytes.
+const IdentifyMagic = uint32(0x44495741) // "AWID" in little-endian
+
+// IdentifyProtocol and IdentifyVersion are the name and version of the protocol
+// that are declared in the identify frame. Peers with a different name or
+// version are rejected.
+const (
+	IdentifyProtocol = "aw"
+	IdentifyVersion  = uint16(1)
+)
+
+// MaxNetworkIDLength is the maximum length of a network ID, in bytes.
+const MaxNetworkIDLength = 255
+
+// Kinds of identify mismatches (see ErrIdentify).
+const (
+	IdentifyWrongProtocol = "protocol" // The remote peer does not speak the same protocol, or version of it
+	IdentifyWrongNetwork  = "network"  // The remote peer is in another network
+)
+
+// Identity is declared by a peer in its identify frame (see Options.NetworkID).
+type Identity struct {
+	Protocol  string
+	Version   uint16
+	NetworkID string
+}
+
+// ErrIdentify is returned when the identify frame of the remote peer does not
+// match the local one. Remote is the Identity declared by the remote peer, and
+// is empty if it did not write an identify frame.
+type ErrIdentify struct {
+	error
+	Kind   string
+	Remote Identity
+}
+
+func newErrIdentify(kind string, local, remote Identity) error {
+	return ErrIdentify{
+		error:  fmt.Errorf("error identifying remote peer: wrong %v: expected %v/%v in network=%q, got %q/%v in network=%q", kind, local.Protocol, local.Version, local.NetworkID, remote.Protocol, remote.Version, remote.NetworkID),
+		Kind:   kind,
+		Remote: remote,
+	}
+}
+
+// identify exchanges identify frames with the remote peer, if there is a
+// NetworkID. The client writes its frame first, so that the server can reject
+// clients that are not in the same network before it writes anything, and
+// before any cryptography is done.
+func (hs *handshaker) identify(rw io.ReadWriter, isClient bool) error {
+	if hs.options.NetworkID == "" {
+		return nil
+	}
+	if isClient {
+		if err := hs.writeIdentity(rw); err != nil {
+			return err
+		}
+		return hs.readIdentity(rw)
+	}
+	if err := hs.readIdentity(rw); err != nil {
+		return err
+	}
+	return hs.writeIdentity(rw)
+}
+
+func (hs *handshaker) writeIdentity(w io.Writer) error {
+	frame := make([]byte, 6, 8+len(IdentifyProtocol)+len(hs.options.NetworkID))
+	binary.LittleEndian.PutUint32(frame, IdentifyMagic)
+	binary.LittleEndian.PutUint16(frame[4:], IdentifyVersion)
+	frame = append(frame, byte(len(IdentifyProtocol)))
+	frame = append(frame, IdentifyProtocol...)
+	frame = append(frame, byte(len(hs.options.NetworkID)))
+	frame = append(frame, hs.options.NetworkID...)
+	if _, err := w.Write(frame); err != nil {
+		return fmt.Errorf("error writing identify frame to io.Writer: %v", err)
+	}
+	return nil
+}
+
+// readIdentity reads the identify frame of the remote peer, and rejects it as
+// soon as it does not match the local one, without reading the rest of it.
+func (hs *handshaker) readIdentity(r io.Reader) error {
+	local := Identity{Protocol: IdentifyProtocol, Version: IdentifyVersion, NetworkID: hs.options.NetworkID}
+	var header [6]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return fmt.Errorf("error reading identify frame from io.Reader: %v", err)
+	}
+	if binary.LittleEndian.Uint32(header[:]) != IdentifyMagic {
+		return newErrIdentify(IdentifyWrongProtocol, local, Identity{})
+	}
+	remote := Identity{Version: binary.LittleEndian.Uint16(header[4:])}
+	if remote.Version != IdentifyVersion {
+		return newErrIdentify(IdentifyWrongProtocol, local, remote)
+	}
+	protocolName, err := readIdentifyField(r)
+	if err != nil {
+		return err
+	}
+	remote.Protocol = protocolName
+	if remote.Protocol != IdentifyProtocol {
+		return newErrIdentify(IdentifyWrongProtocol, local, remote)
+	}
+	networkID, err := readIdentifyField(r)
+	if err != nil {
+		return err
+	}
+	remote.NetworkID = networkID
+	if remote.NetworkID != hs.options.NetworkID {
+		return newErrIdentify(IdentifyWrongNetwork, local, remote)
+	}
+	return nil
+}
+
+// readIdentifyField reads a field of an identify frame that is prefixed by its
+// length, which is never more than 255 bytes.
+func readIdentifyField(r io.Reader) (string, error) {
+	var length [1]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return "", fmt.Errorf("error reading identify frame from io.Reader: %v", err)
+	}
+	field := make([]byte, length[0])
+	if _, err := io.ReadFull(r, field); err != nil {
+		return "", fmt.Errorf("error reading identify frame from io.Reader: %v", err)
+	}
+	return string(field), nil
+}
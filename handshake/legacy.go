@@ -0,0 +1,265 @@
+package handshake
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/renproject/aw/protocol"
+)
+
+// A LegacyHandshaker can complete handshakes with legacy peers, which predate
+// the negotiation of handshakes. Legacy peers exchange session keys using
+// SuiteSecp256k1ECIES, without negotiating anything, and clients write their
+// public key first, instead of proposing Suites.
+//
+// Servers detect legacy clients, and fall back to the legacy handshake, by
+// themselves. Clients only learn that the server is a legacy peer when it
+// closes the connection after reading their proposal, in which case Handshake
+// returns an ErrLegacyPeer, and the handshake must be retried over a new
+// connection using LegacyHandshake. Either way, the legacy handshake is
+// reported as a downgrade (see DowngradeHandshake), and it is refused if
+// downgrades are refused. It is not allowed when there is a PSK or a
+// NetworkID, or when SuiteSecp256k1ECIES is not supported (e.g. in FIPS
+// mode), because legacy peers cannot prove that they are in the same network.
+// Sessions established by the legacy handshake are never framed, padded or
+// compressed, because legacy peers cannot read them.
+type LegacyHandshaker interface {
+	Handshaker
+
+	// LegacyHandshake with a remote legacy server.
+	LegacyHandshake(ctx context.Context, rw io.ReadWriter) (protocol.Session, error)
+}
+
+// legacyPublicKeyLength is the length of the uncompressed secp256k1 public key
+// that legacy clients write first. Servers tell legacy clients apart by
+// reading it where the length of the proposal of Suites is, because no
+// proposal is that long.
+const legacyPublicKeyLength = 65
+
+// The handshakes before, and after, a downgrade to the legacy handshake (see
+// DowngradeHandshake).
+const (
+	handshakeNegotiated = "negotiated"
+	handshakeLegacy     = "legacy"
+)
+
+// ErrLegacyPeer is returned when the remote peer is a legacy peer (see
+// LegacyHandshaker). Fallback is true if the handshake can be retried using
+// LegacyHandshake over a new connection, and false if the legacy handshake is
+// not allowed.
+type ErrLegacyPeer struct {
+	error
+	Fallback bool
+}
+
+func newErrLegacyPeer(fallback bool, reason string) error {
+	return ErrLegacyPeer{
+		error:    fmt.Errorf("error handshaking with legacy peer, which predates the negotiation of handshakes: %v", reason),
+		Fallback: fallback,
+	}
+}
+
+func (hs *handshaker) LegacyHandshake(ctx context.Context, rw io.ReadWriter) (protocol.Session, error) {
+	defer setDeadline(ctx, rw)()
+
+	if err := hs.checkLegacy(); err != nil {
+		return nil, err
+	}
+	session, err := hs.handshakeLegacy(rw)
+	if err != nil {
+		return nil, err
+	}
+	return hs.newLegacySession(session)
+}
+
+// acceptLegacyHandshake from a legacy client, once its first frame has been
+// detected (see detectLegacyClient).
+func (hs *handshaker) acceptLegacyHandshake(rw io.ReadWriter) (protocol.Session, error) {
+	if err := hs.checkLegacy(); err != nil {
+		return nil, err
+	}
+	session, err := hs.acceptHandshakeLegacy(rw)
+	if err != nil {
+		return nil, err
+	}
+	return hs.newLegacySession(session)
+}
+
+// checkLegacy returns an error if the legacy handshake is not allowed, or if
+// it is refused as a downgrade.
+func (hs *handshaker) checkLegacy() error {
+	if !hs.suites.Contains(SuiteSecp256k1ECIES) {
+		return newErrLegacyPeer(false, fmt.Sprintf("suite=%v is not supported", SuiteSecp256k1ECIES))
+	}
+	if len(hs.options.PSK) > 0 || hs.options.NetworkID != "" {
+		return newErrLegacyPeer(false, "legacy peers cannot prove that they are in the same network")
+	}
+	if hs.options.RefuseDowngrades {
+		hs.downgraded(nil, DowngradeHandshake, handshakeNegotiated, handshakeLegacy, true)
+		return newErrDowngrade(DowngradeHandshake, handshakeNegotiated, handshakeLegacy)
+	}
+	return nil
+}
+
+// legacyServer returns the error of a handshake with a server that closed the
+// connection after reading the proposal of Suites, which is what legacy
+// servers do.
+func (hs *handshaker) legacyServer() error {
+	if err := hs.checkLegacy(); err != nil {
+		return err
+	}
+	return newErrLegacyPeer(true, "connection closed after proposing suites")
+}
+
+// detectLegacyClient reads the first field written by the client, and returns
+// true if it is the length of the public key of a legacy client. The returned
+// io.ReadWriter reads the field again. Clients that declare a NetworkID write
+// an identify frame first, so legacy clients are rejected by it instead.
+func (hs *handshaker) detectLegacyClient(rw io.ReadWriter) (io.ReadWriter, bool, error) {
+	if hs.options.NetworkID != "" {
+		return rw, false, nil
+	}
+	var length [8]byte
+	if _, err := io.ReadFull(rw, length[:]); err != nil {
+		return rw, false, fmt.Errorf("error reading handshake suites from io.Reader (potential rate limit): %v", err)
+	}
+	rw = &prefixedReadWriter{
+		Reader: io.MultiReader(bytes.NewReader(length[:]), rw),
+		Writer: rw,
+	}
+	return rw, binary.LittleEndian.Uint64(length[:]) == legacyPublicKeyLength, nil
+}
+
+// newLegacySession checks, and reports, the session of a legacy handshake.
+func (hs *handshaker) newLegacySession(session protocol.IdentifiedSession) (protocol.Session, error) {
+	if err := hs.checkSession(session); err != nil {
+		return nil, err
+	}
+	hs.downgraded(session.PeerID(), DowngradeHandshake, handshakeNegotiated, handshakeLegacy, false)
+	if hs.options.Strict {
+		session = &strictSession{IdentifiedSession: session}
+	}
+	return session, nil
+}
+
+func (hs *handshaker) handshakeLegacy(rw io.ReadWriter) (protocol.IdentifiedSession, error) {
+	// 1. Write self ECDSA public key and Signature of it.
+	localPrivateKey, err := hs.generateKey(crypto.S256())
+	if err != nil {
+		return nil, fmt.Errorf("error generating new ecdsa key : %v", err)
+	}
+	if err := hs.writeLegacyPublicKey(rw, crypto.FromECDSAPub(&localPrivateKey.PublicKey)); err != nil {
+		return nil, err
+	}
+
+	// 2. Read the remote ECDSA public key and verify the signature.
+	remotePublicKeyBytes, remotePeerID, err := hs.readLegacyPublicKey(rw)
+	if err != nil {
+		return nil, err
+	}
+	remotePublicKey, err := crypto.UnmarshalPubkey(remotePublicKeyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshaling ecdsa PublicKey: %v", err)
+	}
+
+	// 3. Generate a session key, encrypted with remote ECDSA key and write to server
+	localSessionKey := hs.sessionManager.NewSessionKey()
+	if err := hs.writeEncrypted(rw, localSessionKey, remotePublicKey); err != nil {
+		return nil, err
+	}
+
+	// 4. Read and decrypt the session key from the server.
+	remoteSessionKey, err := hs.readEncrypted(rw, localPrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	sessionKey, err := xorSessionKeys(localSessionKey, remoteSessionKey)
+	if err != nil {
+		return nil, err
+	}
+	return identifySession(hs.sessionManager.NewSession(remotePeerID, sessionKey), remotePeerID), nil
+}
+
+func (hs *handshaker) acceptHandshakeLegacy(rw io.ReadWriter) (protocol.IdentifiedSession, error) {
+	// 1. Read the remote ECDSA public key and verify the signature.
+	remotePublicKeyBytes, remotePeerID, err := hs.readLegacyPublicKey(rw)
+	if err != nil {
+		return nil, err
+	}
+	remotePublicKey, err := crypto.UnmarshalPubkey(remotePublicKeyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshaling ecdsa PublicKey: %v", err)
+	}
+
+	// 2. Write self ecdsa public key and Signature of it.
+	localPrivateKey, err := hs.generateKey(crypto.S256())
+	if err != nil {
+		return nil, fmt.Errorf("error generating new ecdsa key : %v", err)
+	}
+	if err := hs.writeLegacyPublicKey(rw, crypto.FromECDSAPub(&localPrivateKey.PublicKey)); err != nil {
+		return nil, err
+	}
+
+	// 3. Read and decrypt the session key from the client.
+	remoteSessionKey, err := hs.readEncrypted(rw, localPrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// 4. Generate a session key and write to client
+	localSessionKey := hs.sessionManager.NewSessionKey()
+	if err := hs.writeEncrypted(rw, localSessionKey, remotePublicKey); err != nil {
+		return nil, err
+	}
+
+	sessionKey, err := xorSessionKeys(localSessionKey, remoteSessionKey)
+	if err != nil {
+		return nil, err
+	}
+	return identifySession(hs.sessionManager.NewSession(remotePeerID, sessionKey), remotePeerID), nil
+}
+
+// Write the public key along with a signature of it through the io.Writer,
+// which is all that legacy peers sign.
+func (hs *handshaker) writeLegacyPublicKey(w io.Writer, publicKeyBytes []byte) error {
+	if err := write(w, publicKeyBytes); err != nil {
+		return fmt.Errorf("error writing ecdsa.PublicKey to io.Writer: %v", err)
+	}
+	pubKeySig, err := hs.signVerifier.Sign(hs.signVerifier.Hash(publicKeyBytes))
+	if err != nil {
+		return fmt.Errorf("invariant violation: cannot sign ecdsa.publickey: %v", err)
+	}
+	if err := write(w, pubKeySig); err != nil {
+		return fmt.Errorf("error writing ecdsa.PublicKey signature to io.Writer: %v", err)
+	}
+	return nil
+}
+
+// Read a public key and verify its signature (see writeLegacyPublicKey).
+func (hs *handshaker) readLegacyPublicKey(r io.Reader) ([]byte, protocol.PeerID, error) {
+	remotePubKeyBytes, err := read(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading ecdsa.PublicKey from io.Reader: %v", err)
+	}
+	remotePubKeySig, err := read(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading ecdsa.PublicKey signature from io.Reader: %v", err)
+	}
+	remotePeerID, err := hs.signVerifier.Verify(hs.signVerifier.Hash(remotePubKeyBytes), remotePubKeySig)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error verifying ecdsa.PublicKey: %v", err)
+	}
+	return remotePubKeyBytes, remotePeerID, nil
+}
+
+// A prefixedReadWriter reads from the Reader, which starts with the bytes that
+// were read ahead, and writes to the Writer.
+type prefixedReadWriter struct {
+	io.Reader
+	io.Writer
+}
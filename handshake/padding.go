@@ -0,0 +1,172 @@
+package handshake
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/renproject/aw/protocol"
+)
+
+// MaxPaddingBucketSize is the largest bucket size that can be negotiated.
+const MaxPaddingBucketSize = 64 * 1024
+
+// coverLength marks the body of a cover message, which is discarded by the
+// remote Session.
+const coverLength = ^uint32(0)
+
+// A PaddedSession is a Session that pads every message, so that the length of
+// messages on the wire is a multiple of the bucket size. It also writes cover
+// messages, which are indistinguishable from other messages on the wire, and
+// are discarded by the remote Session. Padding only hides the length of
+// messages if the Session is encrypted.
+type PaddedSession interface {
+	protocol.IdentifiedSession
+
+	BucketSize() int
+	WriteCover(w io.Writer) error
+}
+
+// Write the padding bucket size of the client and read the bucket size
+// selected by the server. The server can select a larger bucket size, but not
+// a smaller one.
+func (hs *handshaker) proposePadding(rw io.ReadWriter) (int, error) {
+	proposal := make([]byte, 4)
+	binary.LittleEndian.PutUint32(proposal, uint32(hs.options.PaddingBucketSize))
+	if err := write(rw, proposal); err != nil {
+		return 0, fmt.Errorf("error writing padding to io.Writer: %v", err)
+	}
+	selected, err := read(rw)
+	if err != nil {
+		return 0, fmt.Errorf("error reading padding from io.Reader: %v", err)
+	}
+	if len(selected) != 4 {
+		return 0, fmt.Errorf("error negotiating padding: expected len=4, got len=%v", len(selected))
+	}
+	bucketSize := int(binary.LittleEndian.Uint32(selected))
+	if bucketSize < hs.options.PaddingBucketSize || bucketSize > MaxPaddingBucketSize {
+		return 0, fmt.Errorf("error negotiating padding: expected %v<=bucket size<=%v, got bucket size=%v", hs.options.PaddingBucketSize, MaxPaddingBucketSize, bucketSize)
+	}
+	return bucketSize, nil
+}
+
+// Read the padding bucket size of the client and write the larger of it and
+// the local bucket size, so that messages are padded if either peer wants
+// them to be.
+func (hs *handshaker) selectPadding(rw io.ReadWriter) (int, error) {
+	proposal, err := read(rw)
+	if err != nil {
+		return 0, fmt.Errorf("error reading padding from io.Reader: %v", err)
+	}
+	if len(proposal) != 4 {
+		return 0, fmt.Errorf("error negotiating padding: expected len=4, got len=%v", len(proposal))
+	}
+	bucketSize := hs.options.PaddingBucketSize
+	if remote := binary.LittleEndian.Uint32(proposal); remote > uint32(bucketSize) {
+		if remote > MaxPaddingBucketSize {
+			return 0, fmt.Errorf("error negotiating padding: expected bucket size<=%v, got bucket size=%v", MaxPaddingBucketSize, remote)
+		}
+		bucketSize = int(remote)
+	}
+	selected := make([]byte, 4)
+	binary.LittleEndian.PutUint32(selected, uint32(bucketSize))
+	if err := write(rw, selected); err != nil {
+		return 0, fmt.Errorf("error writing padding to io.Writer: %v", err)
+	}
+	return bucketSize, nil
+}
+
+// wrapSession pads or compresses the Session. Padded sessions are never
+// compressed, because compressing padded messages would reveal their lengths
+// again.
+func (hs *handshaker) wrapSession(session protocol.IdentifiedSession, compression Compression, bucketSize int) protocol.IdentifiedSession {
+	if hs.options.Strict {
+		session = &strictSession{IdentifiedSession: session}
+	}
+	if hs.options.Framed {
+		session = &framedSession{IdentifiedSession: session, refuse: hs.options.RefuseDowngrades, downgraded: hs.downgraded}
+	}
+	if bucketSize > 0 {
+		return &paddedSession{
+			IdentifiedSession: session,
+			bucketSize:        bucketSize,
+			strict:            hs.options.Strict,
+		}
+	}
+	return hs.compressSession(session, compression)
+}
+
+// A paddedSession prefixes the body of every message with its length, and pads
+// it with zeros before it is written by the inner Session. The length and the
+// padding are encrypted along with the body, if the inner Session is
+// encrypted.
+type paddedSession struct {
+	protocol.IdentifiedSession
+
+	bucketSize int
+	strict     bool // Rejects padding that is not zeroed
+}
+
+func (session *paddedSession) BucketSize() int {
+	return session.bucketSize
+}
+
+func (session *paddedSession) Duplex() bool {
+	return IsDuplex(session.IdentifiedSession)
+}
+
+func (session *paddedSession) ReadMessageOnTheWire(r io.Reader) (protocol.MessageOnTheWire, error) {
+	for {
+		otw, err := session.IdentifiedSession.ReadMessageOnTheWire(r)
+		if err != nil {
+			return otw, err
+		}
+		body := otw.Message.Body
+		if len(body) < 4 {
+			return otw, fmt.Errorf("error reading padded message: expected len>=4, got len=%v", len(body))
+		}
+		length := binary.LittleEndian.Uint32(body)
+		if length == coverLength {
+			continue
+		}
+		if uint64(length) > uint64(len(body)-4) {
+			return otw, fmt.Errorf("error reading padded message: expected len<=%v, got len=%v", len(body)-4, length)
+		}
+		if session.strict {
+			for _, b := range body[4+length:] {
+				if b != 0 {
+					return otw, protocol.NewErrNonCanonicalMessage(otw.Message.Variant, "padding is not zeroed")
+				}
+			}
+		}
+		otw.Message.Body = body[4 : 4+length]
+		otw.Message.Length = protocol.MessageLength(otw.Message.NonBodyLength() + int(length))
+		return otw, nil
+	}
+}
+
+func (session *paddedSession) WriteMessage(w io.Writer, message protocol.Message) error {
+	return session.IdentifiedSession.WriteMessage(w, session.pad(message, uint32(len(message.Body))))
+}
+
+func (session *paddedSession) WriteCover(w io.Writer) error {
+	return session.IdentifiedSession.WriteMessage(w, session.pad(protocol.NewMessage(protocol.V1, protocol.Cast, protocol.NilGroupID, nil), coverLength))
+}
+
+// pad the body of the message, so that the length of the message is a
+// multiple of the bucket size (not counting the overhead of the inner
+// Session, which is the same for all messages).
+func (session *paddedSession) pad(message protocol.Message, length uint32) protocol.Message {
+	nonBodyLength := message.NonBodyLength()
+	paddedLength := nonBodyLength + 4 + len(message.Body)
+	if remainder := paddedLength % session.bucketSize; remainder != 0 {
+		paddedLength += session.bucketSize - remainder
+	}
+	body := make([]byte, paddedLength-nonBodyLength)
+	binary.LittleEndian.PutUint32(body, length)
+	copy(body[4:], message.Body)
+
+	message.Body = body
+	message.Length = protocol.MessageLength(paddedLength)
+	return message
+}
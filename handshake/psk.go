@@ -0,0 +1,83 @@
+package handshake
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/renproject/aw/protocol"
+)
+
+// pskProof proves that the client, or the server, knows the PSK by
+// authenticating the digest of the negotiation transcript, and the ephemeral
+// public keys of the handshake, with it. The proof is bound to the role of the
+// peer, so that a peer that does not know the PSK cannot echo the proof of the
+// remote peer. The public keys are those of the client and then the server,
+// and the proof is only fresh if it covers a public key of the remote peer,
+// which is why the client confirms that it knows the PSK once it has read the
+// public key of the server (see writePSKConfirmation). The proof is empty if
+// there is no PSK.
+func (hs *handshaker) pskProof(role string, negotiation []byte, publicKeys ...[]byte) []byte {
+	if len(hs.options.PSK) == 0 {
+		return []byte{}
+	}
+	mac := hmac.New(sha256.New, hs.options.PSK)
+	mac.Write([]byte(role))
+	mac.Write(negotiation)
+	for _, publicKey := range publicKeys {
+		// The public keys are prefixed by their length, so that they cannot
+		// be split differently
+		var length [8]byte
+		binary.LittleEndian.PutUint64(length[:], uint64(len(publicKey)))
+		mac.Write(length[:])
+		mac.Write(publicKey)
+	}
+	return mac.Sum(nil)
+}
+
+// writePSKConfirmation writes the proof that the client knows the PSK, bound
+// to the public keys of the client and the server. The server chose its public
+// key for this handshake, so a proof that was captured from another handshake
+// cannot be replayed. Nothing is written if there is no PSK.
+func (hs *handshaker) writePSKConfirmation(w io.Writer, negotiation, clientPublicKey, serverPublicKey []byte) error {
+	if len(hs.options.PSK) == 0 {
+		return nil
+	}
+	if err := write(w, hs.pskProof("client confirmation", negotiation, clientPublicKey, serverPublicKey)); err != nil {
+		return fmt.Errorf("error writing psk confirmation to io.Writer: %v", err)
+	}
+	return nil
+}
+
+// readPSKConfirmation reads, and checks, the proof that the client knows the
+// PSK (see writePSKConfirmation). Nothing is read if there is no PSK.
+func (hs *handshaker) readPSKConfirmation(r io.Reader, remotePeerID protocol.PeerID, negotiation, clientPublicKey, serverPublicKey []byte) error {
+	if len(hs.options.PSK) == 0 {
+		return nil
+	}
+	confirmation, err := read(r)
+	if err != nil {
+		return fmt.Errorf("error reading psk confirmation from io.Reader: %v", err)
+	}
+	if !hmac.Equal(confirmation, hs.pskProof("client confirmation", negotiation, clientPublicKey, serverPublicKey)) {
+		return newErrPSKMismatch(remotePeerID)
+	}
+	return nil
+}
+
+// ErrPSKMismatch is returned when the remote peer does not prove that it knows
+// the PSK of the local peer, which means that it is not part of the same
+// private network.
+type ErrPSKMismatch struct {
+	error
+	PeerID protocol.PeerID
+}
+
+func newErrPSKMismatch(peerID protocol.PeerID) error {
+	return ErrPSKMismatch{
+		error:  fmt.Errorf("error verifying pre-shared key of peer=%v: proof does not match", peerID),
+		PeerID: peerID,
+	}
+}
@@ -0,0 +1,252 @@
+package handshake
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/renproject/aw/protocol"
+)
+
+// Flags that prefix the body of every message of a rekeying session, before it
+// is encrypted.
+const (
+	rekeyFlagNone = byte(0)
+	rekeyFlagLast = byte(1) // The last message encrypted with the current key
+)
+
+// RekeyOptions are used to parameterise the rekeying of sessions (see
+// NewRekeyingGCMSessionManager).
+type RekeyOptions struct {
+	// Interval after which the key of the messages written by a session is
+	// rekeyed. Keys are only rekeyed when a message is written, so the key
+	// of an idle session is rekeyed by its next message. Defaults to 10
+	// minutes.
+	Interval time.Duration
+
+	// Bytes of message bodies written by a session with the same key, after
+	// which the key is rekeyed. Defaults to 1 GB.
+	Bytes uint64
+
+	// Rekeyed is optional. When set, it is called whenever the key of the
+	// messages written to, or read from, a peer is rekeyed. It must not block.
+	Rekeyed func(RekeyEvent)
+}
+
+func (options *RekeyOptions) setZerosToDefaults() {
+	if options.Interval <= 0 {
+		options.Interval = 10 * time.Minute
+	}
+	if options.Bytes == 0 {
+		options.Bytes = 1024 * 1024 * 1024
+	}
+}
+
+// A RekeyEvent happens whenever the key of the messages written to, or read
+// from, a peer is rekeyed.
+type RekeyEvent struct {
+	Time    time.Time
+	PeerID  protocol.PeerID
+	Written bool   // Whether the key of the messages written to the peer was rekeyed, otherwise of the messages read from it
+	Epoch   uint64 // Number of times the key has been rekeyed
+}
+
+// RekeyCounts are the number of times that the keys of the sessions of a
+// RekeyingSessionManager have been rekeyed.
+type RekeyCounts struct {
+	Written uint64 `json:"written"`
+	Read    uint64 `json:"read"`
+}
+
+// A RekeyingSessionManager is a protocol.SessionManager with sessions that are
+// rekeyed periodically.
+type RekeyingSessionManager interface {
+	protocol.SessionManager
+
+	// RekeyCounts returns the number of times that the keys of its sessions
+	// have been rekeyed.
+	RekeyCounts() RekeyCounts
+}
+
+type rekeyingGCMSessionManager struct {
+	duplexGCMSessionManager
+	options RekeyOptions
+
+	written *uint64
+	read    *uint64
+}
+
+// NewRekeyingGCMSessionManager returns a RekeyingSessionManager that encrypts
+// messages with AES-GCM, like NewDuplexGCMSessionManager, but that rekeys the
+// messages sent in each direction once they exceed the thresholds of the
+// RekeyOptions. Keys are rekeyed with a ratchet (the next key is the HMAC of
+// the current key), and the current key is forgotten, so that the compromise
+// of a key does not expose the messages that were encrypted with the keys
+// before it. The last message that is encrypted with a key is flagged, so that
+// the peer reading it rekeys at the same message. It is not compatible with
+// NewGCMSessionManager or NewDuplexGCMSessionManager.
+func NewRekeyingGCMSessionManager(me protocol.PeerID, options RekeyOptions) RekeyingSessionManager {
+	options.setZerosToDefaults()
+	return rekeyingGCMSessionManager{
+		duplexGCMSessionManager: duplexGCMSessionManager{me: me},
+		options:                 options,
+
+		written: new(uint64),
+		read:    new(uint64),
+	}
+}
+
+func (manager rekeyingGCMSessionManager) NewSession(peerID protocol.PeerID, key []byte) protocol.Session {
+	now := time.Now()
+	writeKey, readKey := deriveGCMKey(key, manager.me), deriveGCMKey(key, peerID)
+	return &rekeyingGCMSession{
+		manager: manager,
+		peerID:  peerID,
+
+		writeKey:       writeKey,
+		write:          newGCM(writeKey),
+		writeRekeyedAt: now,
+
+		readKey: readKey,
+		read:    newGCM(readKey),
+	}
+}
+
+func (manager rekeyingGCMSessionManager) RekeyCounts() RekeyCounts {
+	return RekeyCounts{
+		Written: atomic.LoadUint64(manager.written),
+		Read:    atomic.LoadUint64(manager.read),
+	}
+}
+
+// rekeyed counts, and reports, the rekeying of a session.
+func (manager rekeyingGCMSessionManager) rekeyed(event RekeyEvent) {
+	if event.Written {
+		atomic.AddUint64(manager.written, 1)
+	} else {
+		atomic.AddUint64(manager.read, 1)
+	}
+	if manager.options.Rekeyed != nil {
+		manager.options.Rekeyed(event)
+	}
+}
+
+// A rekeyingGCMSession is a duplexGCMSession that ratchets the key of each
+// direction. The fields of each direction are only used by the goroutine that
+// writes, or reads, messages.
+type rekeyingGCMSession struct {
+	manager rekeyingGCMSessionManager
+	peerID  protocol.PeerID
+
+	writeKey       []byte
+	write          cipher.AEAD
+	writeSeq       uint64
+	writeBytes     uint64
+	writeEpoch     uint64
+	writeRekeyedAt time.Time
+
+	readKey   []byte
+	read      cipher.AEAD
+	readSeq   uint64
+	readEpoch uint64
+}
+
+func (session *rekeyingGCMSession) PeerID() protocol.PeerID {
+	return session.peerID
+}
+
+func (session *rekeyingGCMSession) Encrypted() bool {
+	return true
+}
+
+// Duplex returns true, because messages written and read by the session have
+// their own keys and sequence numbers.
+func (session *rekeyingGCMSession) Duplex() bool {
+	return true
+}
+
+func (session *rekeyingGCMSession) ReadMessageOnTheWire(r io.Reader) (protocol.MessageOnTheWire, error) {
+	otw := protocol.MessageOnTheWire{}
+	otw.From = session.peerID
+	if err := otw.Message.UnmarshalReader(r); err != nil {
+		return otw, err
+	}
+
+	body, err := session.read.Open(nil, gcmNonce(session.read, session.readSeq), otw.Message.Body, nil)
+	if err != nil {
+		return otw, fmt.Errorf("error reading message: %v", err)
+	}
+	if len(body) == 0 || body[0] > rekeyFlagLast {
+		return otw, fmt.Errorf("error reading message: expected rekey flag")
+	}
+	otw.Message.Body = body[1:]
+	otw.Message.Length = protocol.MessageLength(len(otw.Message.Body) + otw.Message.NonBodyLength())
+	session.readSeq++
+
+	if body[0] == rekeyFlagLast {
+		session.readKey = ratchet(session.readKey)
+		session.read = newGCM(session.readKey)
+		session.readSeq = 0
+		session.readEpoch++
+		session.manager.rekeyed(RekeyEvent{Time: time.Now(), PeerID: session.peerID, Written: false, Epoch: session.readEpoch})
+	}
+	return otw, nil
+}
+
+func (session *rekeyingGCMSession) WriteMessage(w io.Writer, message protocol.Message) error {
+	now := time.Now()
+	session.writeBytes += uint64(len(message.Body))
+	flag := rekeyFlagNone
+	if now.Sub(session.writeRekeyedAt) >= session.manager.options.Interval || session.writeBytes >= session.manager.options.Bytes {
+		flag = rekeyFlagLast
+	}
+
+	body := make([]byte, 1+len(message.Body))
+	body[0] = flag
+	copy(body[1:], message.Body)
+	message.Body = session.write.Seal(nil, gcmNonce(session.write, session.writeSeq), body, nil)
+	message.Length = protocol.MessageLength(len(message.Body) + message.NonBodyLength())
+
+	data, err := message.MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("error writing message: %v", err)
+	}
+	n, err := w.Write(data)
+	// The sequence number is used up, and the message may have been read, as
+	// soon as any of it is written, so the message is accounted for even if
+	// the write is short (and a retry is sealed with the next nonce)
+	session.writeSeq++
+
+	if flag == rekeyFlagLast {
+		session.writeKey = ratchet(session.writeKey)
+		session.write = newGCM(session.writeKey)
+		session.writeSeq = 0
+		session.writeBytes = 0
+		session.writeEpoch++
+		session.writeRekeyedAt = now
+		session.manager.rekeyed(RekeyEvent{Time: now, PeerID: session.peerID, Written: true, Epoch: session.writeEpoch})
+	}
+	if err != nil {
+		return err
+	}
+	if n != len(data) {
+		return fmt.Errorf("error writing message: expected n=%v, got n=%v", len(data), n)
+	}
+	return nil
+}
+
+// ratchet returns the key that comes after the key, and zeroes the key, so
+// that it cannot be recovered from the next key, or from memory.
+func ratchet(key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("aw/ratchet"))
+	next := mac.Sum(nil)
+	for i := range key {
+		key[i] = 0
+	}
+	return next
+}
@@ -50,3 +50,100 @@ func (session *insecureSession) WriteMessage(w io.Writer, message protocol.Messa
 	}
 	return err
 }
+
+func (session *insecureSession) PeerID() protocol.PeerID {
+	return session.peerID
+}
+
+func (session *insecureSession) Encrypted() bool {
+	return false
+}
+
+func (session *insecureSession) Duplex() bool {
+	return true
+}
+
+// An unidentifiedSession is a Session, returned by a SessionManager that is not
+// in this package, that does not know its remote Peer. It is assumed to be
+// plaintext, so that it is rejected by the policies that require encryption.
+type unidentifiedSession struct {
+	protocol.Session
+	peerID protocol.PeerID
+}
+
+// identifySession returns the Session as a protocol.IdentifiedSession, so that
+// the Sessions returned by the Handshaker always expose their security state.
+func identifySession(session protocol.Session, peerID protocol.PeerID) protocol.IdentifiedSession {
+	if session, ok := session.(protocol.IdentifiedSession); ok {
+		return session
+	}
+	return &unidentifiedSession{Session: session, peerID: peerID}
+}
+
+func (session *unidentifiedSession) PeerID() protocol.PeerID {
+	return session.peerID
+}
+
+func (session *unidentifiedSession) Encrypted() bool {
+	return false
+}
+
+func (session *unidentifiedSession) Duplex() bool {
+	return IsDuplex(session.Session)
+}
+
+// A strictSession rejects the messages read by the inner Session that are not
+// encoded canonically. It is the innermost wrapper of a Session, so that it
+// validates messages as they are read from the wire (after they are decrypted,
+// but before they are unpadded).
+type strictSession struct {
+	protocol.IdentifiedSession
+}
+
+func (session *strictSession) ReadMessageOnTheWire(r io.Reader) (protocol.MessageOnTheWire, error) {
+	otw, err := session.IdentifiedSession.ReadMessageOnTheWire(r)
+	if err != nil {
+		return otw, err
+	}
+	return otw, protocol.ValidateCanonicalMessage(otw.Message)
+}
+
+func (session *strictSession) Duplex() bool {
+	return IsDuplex(session.IdentifiedSession)
+}
+
+// A framedSession frames every message before it is written by the inner
+// Session (see protocol.Message.Framed). Messages are read whether they are
+// framed or not, unless downgrades are refused. The first message that is not
+// framed is reported as a downgrade.
+type framedSession struct {
+	protocol.IdentifiedSession
+
+	refuse     bool
+	downgraded func(peerID protocol.PeerID, kind, preferred, negotiated string, refused bool)
+	unframed   bool // Whether a message that is not framed has been read, which is only used by the goroutine that reads messages
+}
+
+func (session *framedSession) ReadMessageOnTheWire(r io.Reader) (protocol.MessageOnTheWire, error) {
+	otw, err := session.IdentifiedSession.ReadMessageOnTheWire(r)
+	if err != nil || otw.Message.Framed {
+		return otw, err
+	}
+	if !session.unframed {
+		session.unframed = true
+		session.downgraded(session.PeerID(), DowngradeFraming, "framed", "unframed", session.refuse)
+	}
+	if session.refuse {
+		return otw, newErrDowngrade(DowngradeFraming, "framed", "unframed")
+	}
+	return otw, nil
+}
+
+func (session *framedSession) WriteMessage(w io.Writer, message protocol.Message) error {
+	message.Framed = true
+	return session.IdentifiedSession.WriteMessage(w, message)
+}
+
+func (session *framedSession) Duplex() bool {
+	return IsDuplex(session.IdentifiedSession)
+}
@@ -34,6 +34,8 @@ var _ = Describe("Insecure session manager", func() {
 					manager := NewInsecureSessionManager()
 					sender := RandomPeerID()
 					session := manager.NewSession(sender, nil)
+					Expect(protocol.SessionPeerID(session).Equal(sender)).Should(BeTrue())
+					Expect(protocol.SessionEncrypted(session)).Should(BeFalse())
 
 					buf := bytes.NewBuffer([]byte{})
 					sentMsg := RandomMessage(protocol.V1, RandomMessageVariant())
@@ -0,0 +1,154 @@
+package handshake
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// A Suite identifies the algorithms used to exchange session keys during a
+// handshake. The client and server negotiate the Suite before exchanging keys.
+type Suite uint8
+
+const (
+	// SuiteSecp256k1ECIES exchanges session keys encrypted with ECIES using
+	// ephemeral secp256k1 keys.
+	SuiteSecp256k1ECIES = Suite(1)
+
+	// SuiteP256ECDH derives the session key from an ECDH key agreement using
+	// ephemeral P-256 keys, hashed with SHA-256. It only uses FIPS-approved
+	// algorithms.
+	SuiteP256ECDH = Suite(2)
+
+	// SuiteSecp256k1ECDH derives the session key from an ECDH key agreement
+	// using ephemeral secp256k1 keys, hashed with SHA-256. It completes in one
+	// round trip, instead of the two of SuiteSecp256k1ECIES, and uses the same
+	// curve as the keys of peers.
+	SuiteSecp256k1ECDH = Suite(3)
+)
+
+// String implements the `fmt.Stringer` interface.
+func (suite Suite) String() string {
+	switch suite {
+	case SuiteSecp256k1ECIES:
+		return "secp256k1-ecies"
+	case SuiteP256ECDH:
+		return "p256-ecdh"
+	case SuiteSecp256k1ECDH:
+		return "secp256k1-ecdh"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(suite))
+	}
+}
+
+// IsFIPSApproved returns true if the Suite only uses FIPS-approved algorithms.
+func (suite Suite) IsFIPSApproved() bool {
+	return suite == SuiteP256ECDH
+}
+
+// Strength ranks the Suite against other Suites, where a higher Strength is
+// stronger. SuiteSecp256k1ECDH is stronger than SuiteSecp256k1ECIES, because
+// its session key is derived from a key agreement instead of being
+// transported, and SuiteP256ECDH is the strongest, because it also only uses
+// FIPS-approved algorithms. Unknown Suites have no Strength.
+func (suite Suite) Strength() int {
+	switch suite {
+	case SuiteSecp256k1ECIES:
+		return 1
+	case SuiteSecp256k1ECDH:
+		return 2
+	case SuiteP256ECDH:
+		return 3
+	default:
+		return 0
+	}
+}
+
+// Suites is a list of Suite, usually in order of preference.
+type Suites []Suite
+
+// Contains returns true if the Suite is in the list.
+func (suites Suites) Contains(suite Suite) bool {
+	for _, s := range suites {
+		if s == suite {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrNoCommonSuite is returned when the client and server do not support a
+// common Suite, for example when a peer in FIPS mode handshakes with a peer
+// that does not support any FIPS-approved Suite.
+type ErrNoCommonSuite struct {
+	error
+	Local  Suites
+	Remote Suites
+}
+
+func newErrNoCommonSuite(local, remote Suites) error {
+	return ErrNoCommonSuite{
+		error:  fmt.Errorf("no common handshake suite: local suites=%v, remote suites=%v", local, remote),
+		Local:  local,
+		Remote: remote,
+	}
+}
+
+// Write the supported suites and read the suite selected by the server.
+func (hs *handshaker) proposeSuite(rw io.ReadWriter) (Suite, error) {
+	proposal := make([]byte, len(hs.suites))
+	for i, suite := range hs.suites {
+		proposal[i] = byte(suite)
+	}
+	if err := write(rw, proposal); err != nil {
+		return 0, fmt.Errorf("error writing handshake suites to io.Writer: %v", err)
+	}
+	// Legacy servers close the connection, because they cannot read the
+	// proposal as a public key.
+	selectedLen := uint64(0)
+	if err := binary.Read(rw, binary.LittleEndian, &selectedLen); err != nil {
+		if err == io.EOF {
+			return 0, hs.legacyServer()
+		}
+		return 0, fmt.Errorf("error reading handshake suite from io.Reader: %v", err)
+	}
+	selected := make([]byte, selectedLen)
+	if _, err := io.ReadFull(rw, selected); err != nil {
+		return 0, fmt.Errorf("error reading handshake suite from io.Reader: %v", err)
+	}
+	if len(selected) != 1 || !hs.suites.Contains(Suite(selected[0])) {
+		return 0, newErrNoCommonSuite(hs.suites, suitesFromBytes(selected))
+	}
+	return Suite(selected[0]), nil
+}
+
+// Read the suites supported by the client and write the most preferred suite
+// that is also supported locally. No suite is written if there is none.
+func (hs *handshaker) selectSuite(rw io.ReadWriter) (Suite, error) {
+	proposal, err := read(rw)
+	if err != nil {
+		return 0, fmt.Errorf("error reading handshake suites from io.Reader (potential rate limit): %v", err)
+	}
+	remote := suitesFromBytes(proposal)
+	for _, suite := range hs.suites {
+		if !remote.Contains(suite) {
+			continue
+		}
+		if err := write(rw, []byte{byte(suite)}); err != nil {
+			return 0, fmt.Errorf("error writing handshake suite to io.Writer: %v", err)
+		}
+		return suite, nil
+	}
+	if err := write(rw, []byte{}); err != nil {
+		return 0, fmt.Errorf("error writing handshake suite to io.Writer: %v", err)
+	}
+	return 0, newErrNoCommonSuite(hs.suites, remote)
+}
+
+func suitesFromBytes(data []byte) Suites {
+	suites := make(Suites, 0, len(data))
+	for _, b := range data {
+		suites = append(suites, Suite(b))
+	}
+	return suites
+}
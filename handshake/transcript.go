@@ -0,0 +1,60 @@
+package handshake
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/renproject/aw/protocol"
+)
+
+// A transcript records the bytes read and written while negotiating the Suite
+// and Compression of a handshake. The client and server read and write the
+// same bytes in the same order, so their transcripts are equal unless the
+// negotiation was tampered with. The digest of the transcript is signed along
+// with the ephemeral public keys, so that an active attacker cannot downgrade
+// the negotiation (e.g. by removing the strongest Suite from the proposal of
+// the client) without being detected.
+type transcript struct {
+	rw   io.ReadWriter
+	hash hash.Hash
+}
+
+func newTranscript(rw io.ReadWriter) *transcript {
+	return &transcript{
+		rw:   rw,
+		hash: sha256.New(),
+	}
+}
+
+func (t *transcript) Read(p []byte) (int, error) {
+	n, err := t.rw.Read(p)
+	t.hash.Write(p[:n])
+	return n, err
+}
+
+func (t *transcript) Write(p []byte) (int, error) {
+	n, err := t.rw.Write(p)
+	t.hash.Write(p[:n])
+	return n, err
+}
+
+func (t *transcript) digest() []byte {
+	return t.hash.Sum(nil)
+}
+
+// ErrNegotiationTampered is returned when the remote peer signed a different
+// negotiation transcript, which means that the Suite or Compression proposals
+// were modified in transit.
+type ErrNegotiationTampered struct {
+	error
+	PeerID protocol.PeerID
+}
+
+func newErrNegotiationTampered(peerID protocol.PeerID) error {
+	return ErrNegotiationTampered{
+		error:  fmt.Errorf("error verifying handshake negotiation with peer=%v: transcript does not match", peerID),
+		PeerID: peerID,
+	}
+}
@@ -0,0 +1,248 @@
+package metrics
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/renproject/aw/handshake"
+	"github.com/renproject/aw/protocol"
+)
+
+// Options are used to parameterise the behaviour of Metrics.
+type Options struct {
+	// Namespace of the names of the metrics. Defaults to "aw".
+	Namespace string
+
+	// Registry that the metrics are registered with, and gathered from.
+	// Defaults to a new registry, so that the metrics of different Metrics do
+	// not collide.
+	Registry *prometheus.Registry
+
+	// HandshakeBuckets are the upper bounds, in seconds, of the buckets of
+	// the histogram of handshake durations. Defaults to the
+	// prometheus.DefBuckets.
+	HandshakeBuckets []float64
+}
+
+func (options *Options) setZerosToDefaults() {
+	if options.Namespace == "" {
+		options.Namespace = "aw"
+	}
+	if options.Registry == nil {
+		options.Registry = prometheus.NewRegistry()
+	}
+	if len(options.HandshakeBuckets) == 0 {
+		options.HandshakeBuckets = prometheus.DefBuckets
+	}
+}
+
+// Metrics of a Peer that are exported to Prometheus, so that operators can
+// monitor the health of the gossip. Counters and histograms are updated by the
+// subsystems of the Peer, and gauges are read from the Peer when the metrics
+// are gathered (see Gauge and Counter). It is safe for concurrent use, and a
+// nil Metrics does not record anything. A Metrics must not be shared by Peers.
+type Metrics struct {
+	options Options
+
+	messagesSent           *prometheus.CounterVec
+	messagesReceived       *prometheus.CounterVec
+	broadcastsDeduplicated prometheus.Counter
+	handshakeDuration      *prometheus.HistogramVec
+	sessionRekeys          *prometheus.CounterVec
+	downgrades             *prometheus.CounterVec
+}
+
+// New returns Metrics with all of their counters and histograms registered.
+func New(options Options) *Metrics {
+	options.setZerosToDefaults()
+	metrics := &Metrics{
+		options: options,
+
+		messagesSent: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: options.Namespace,
+			Name:      "messages_sent_total",
+			Help:      "Messages sent to the client, by variant.",
+		}, []string{"variant"}),
+		messagesReceived: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: options.Namespace,
+			Name:      "messages_received_total",
+			Help:      "Messages received from the server, by variant.",
+		}, []string{"variant"}),
+		broadcastsDeduplicated: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: options.Namespace,
+			Name:      "broadcasts_deduplicated_total",
+			Help:      "Broadcasts accepted from other peers that had already been seen.",
+		}),
+		handshakeDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: options.Namespace,
+			Name:      "handshake_duration_seconds",
+			Help:      "Duration of handshakes, by direction and result.",
+			Buckets:   options.HandshakeBuckets,
+		}, []string{"direction", "result"}),
+		sessionRekeys: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: options.Namespace,
+			Name:      "session_rekeys_total",
+			Help:      "Keys of sessions that were rekeyed, by direction.",
+		}, []string{"direction"}),
+		downgrades: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: options.Namespace,
+			Name:      "downgrades_total",
+			Help:      "Downgrades of handshakes and sessions, by kind and whether they were refused.",
+		}, []string{"kind", "refused"}),
+	}
+	options.Registry.MustRegister(metrics.messagesSent, metrics.messagesReceived, metrics.broadcastsDeduplicated, metrics.handshakeDuration, metrics.sessionRekeys, metrics.downgrades)
+	return metrics
+}
+
+// Sent counts a message that was sent.
+func (metrics *Metrics) Sent(variant protocol.MessageVariant) {
+	if metrics == nil {
+		return
+	}
+	metrics.messagesSent.WithLabelValues(variant.String()).Inc()
+}
+
+// Received counts a message that was received.
+func (metrics *Metrics) Received(variant protocol.MessageVariant) {
+	if metrics == nil {
+		return
+	}
+	metrics.messagesReceived.WithLabelValues(variant.String()).Inc()
+}
+
+// Deduplicated counts a broadcast that was dropped because it had already been
+// seen.
+func (metrics *Metrics) Deduplicated() {
+	if metrics == nil {
+		return
+	}
+	metrics.broadcastsDeduplicated.Inc()
+}
+
+// Handshook observes the duration of a handshake that was initiated, or
+// accepted, by this peer, and whether it failed. Handshakes with peers that
+// are in another network, or that do not speak the protocol, are observed
+// with their own results (see handshake.ErrIdentify), so that they can be told
+// apart from handshakes that failed.
+func (metrics *Metrics) Handshook(accepted bool, duration time.Duration, err error) {
+	if metrics == nil {
+		return
+	}
+	direction, result := "initiated", "ok"
+	if accepted {
+		direction = "accepted"
+	}
+	if err != nil {
+		result = "error"
+		if identifyErr, ok := err.(handshake.ErrIdentify); ok {
+			result = "wrong_" + identifyErr.Kind
+		}
+	}
+	metrics.handshakeDuration.WithLabelValues(direction, result).Observe(duration.Seconds())
+}
+
+// Rekeyed counts a session key that was rekeyed (see
+// handshake.RekeyOptions).
+func (metrics *Metrics) Rekeyed(event handshake.RekeyEvent) {
+	if metrics == nil {
+		return
+	}
+	direction := "read"
+	if event.Written {
+		direction = "written"
+	}
+	metrics.sessionRekeys.WithLabelValues(direction).Inc()
+}
+
+// Downgraded counts a downgrade of a handshake or session (see
+// handshake.Options.Downgraded).
+func (metrics *Metrics) Downgraded(event protocol.EventDowngraded) {
+	if metrics == nil {
+		return
+	}
+	metrics.downgrades.WithLabelValues(event.Kind, strconv.FormatBool(event.Refused)).Inc()
+}
+
+// Gauge registers a gauge with the name (in the Namespace of the Metrics) and
+// the constant labels, that reads its value from the function whenever the
+// metrics are gathered. The function must be safe for concurrent use.
+func (metrics *Metrics) Gauge(name, help string, labels prometheus.Labels, value func() float64) error {
+	if metrics == nil {
+		return nil
+	}
+	return metrics.options.Registry.Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   metrics.options.Namespace,
+		Name:        name,
+		Help:        help,
+		ConstLabels: labels,
+	}, value))
+}
+
+// Counter registers a counter in the same way as Gauge. The function must
+// never return less than it has returned before.
+func (metrics *Metrics) Counter(name, help string, labels prometheus.Labels, value func() float64) error {
+	if metrics == nil {
+		return nil
+	}
+	return metrics.options.Registry.Register(prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace:   metrics.options.Namespace,
+		Name:        name,
+		Help:        help,
+		ConstLabels: labels,
+	}, value))
+}
+
+// Handler returns an http.Handler that serves the metrics in the Prometheus
+// exposition format.
+func (metrics *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(metrics.options.Registry, promhttp.HandlerOpts{})
+}
+
+// Handshaker returns a handshake.Handshaker that observes the duration of the
+// handshakes of the inner handshake.Handshaker. If the inner
+// handshake.Handshaker is a handshake.LegacyHandshaker, so is the returned one.
+func (metrics *Metrics) Handshaker(inner handshake.Handshaker) handshake.Handshaker {
+	if metrics == nil {
+		return inner
+	}
+	if legacy, ok := inner.(handshake.LegacyHandshaker); ok {
+		return &legacyHandshaker{handshaker: handshaker{inner: inner, metrics: metrics}, legacy: legacy}
+	}
+	return &handshaker{inner: inner, metrics: metrics}
+}
+
+type handshaker struct {
+	inner   handshake.Handshaker
+	metrics *Metrics
+}
+
+func (handshaker *handshaker) Handshake(ctx context.Context, rw io.ReadWriter) (protocol.Session, error) {
+	start := time.Now()
+	session, err := handshaker.inner.Handshake(ctx, rw)
+	handshaker.metrics.Handshook(false, time.Since(start), err)
+	return session, err
+}
+
+func (handshaker *handshaker) AcceptHandshake(ctx context.Context, rw io.ReadWriter) (protocol.Session, error) {
+	start := time.Now()
+	session, err := handshaker.inner.AcceptHandshake(ctx, rw)
+	handshaker.metrics.Handshook(true, time.Since(start), err)
+	return session, err
+}
+
+type legacyHandshaker struct {
+	handshaker
+	legacy handshake.LegacyHandshaker
+}
+
+func (handshaker *legacyHandshaker) LegacyHandshake(ctx context.Context, rw io.ReadWriter) (protocol.Session, error) {
+	start := time.Now()
+	session, err := handshaker.legacy.LegacyHandshake(ctx, rw)
+	handshaker.metrics.Handshook(false, time.Since(start), err)
+	return session, err
+}
@@ -0,0 +1,126 @@
+package metrics_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/renproject/aw/handshake"
+	"github.com/renproject/aw/protocol"
+)
+
+type mockHandshaker struct {
+	err error
+}
+
+func (handshaker mockHandshaker) Handshake(ctx context.Context, rw io.ReadWriter) (protocol.Session, error) {
+	return nil, handshaker.err
+}
+
+func (handshaker mockHandshaker) AcceptHandshake(ctx context.Context, rw io.ReadWriter) (protocol.Session, error) {
+	return nil, handshaker.err
+}
+
+var _ = Describe("Metrics", func() {
+	scrape := func(metrics *Metrics) string {
+		recorder := httptest.NewRecorder()
+		metrics.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+		Expect(recorder.Code).To(Equal(200))
+		body, err := ioutil.ReadAll(recorder.Body)
+		Expect(err).NotTo(HaveOccurred())
+		return string(body)
+	}
+
+	Context("when messages are sent and received", func() {
+		It("should count them by variant", func() {
+			metrics := New(Options{})
+			metrics.Sent(protocol.Broadcast)
+			metrics.Sent(protocol.Broadcast)
+			metrics.Received(protocol.Ping)
+			metrics.Deduplicated()
+
+			body := scrape(metrics)
+			Expect(body).To(ContainSubstring(`aw_messages_sent_total{variant="broadcast"} 2`))
+			Expect(body).To(ContainSubstring(`aw_messages_received_total{variant="ping"} 1`))
+			Expect(body).To(ContainSubstring(`aw_broadcasts_deduplicated_total 1`))
+		})
+	})
+
+	Context("when handshaking", func() {
+		It("should observe the duration of handshakes by direction and result", func() {
+			metrics := New(Options{Namespace: "test"})
+			_, err := metrics.Handshaker(mockHandshaker{}).Handshake(context.Background(), nil)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = metrics.Handshaker(mockHandshaker{err: errors.New("bad handshake")}).AcceptHandshake(context.Background(), nil)
+			Expect(err).To(HaveOccurred())
+
+			body := scrape(metrics)
+			Expect(body).To(ContainSubstring(`test_handshake_duration_seconds_count{direction="initiated",result="ok"} 1`))
+			Expect(body).To(ContainSubstring(`test_handshake_duration_seconds_count{direction="accepted",result="error"} 1`))
+		})
+
+		It("should observe handshakes with peers in other networks, or that speak other protocols, with their own results", func() {
+			metrics := New(Options{Namespace: "test"})
+			_, err := metrics.Handshaker(mockHandshaker{err: handshake.ErrIdentify{Kind: handshake.IdentifyWrongNetwork}}).AcceptHandshake(context.Background(), nil)
+			Expect(err).To(HaveOccurred())
+			_, err = metrics.Handshaker(mockHandshaker{err: handshake.ErrIdentify{Kind: handshake.IdentifyWrongProtocol}}).AcceptHandshake(context.Background(), nil)
+			Expect(err).To(HaveOccurred())
+
+			body := scrape(metrics)
+			Expect(body).To(ContainSubstring(`test_handshake_duration_seconds_count{direction="accepted",result="wrong_network"} 1`))
+			Expect(body).To(ContainSubstring(`test_handshake_duration_seconds_count{direction="accepted",result="wrong_protocol"} 1`))
+			Expect(body).NotTo(ContainSubstring(`result="error"`))
+		})
+	})
+
+	Context("when handshakes and sessions are downgraded", func() {
+		It("should count them by kind and whether they were refused", func() {
+			metrics := New(Options{})
+			metrics.Downgraded(protocol.EventDowngraded{Kind: "suite"})
+			metrics.Downgraded(protocol.EventDowngraded{Kind: "framing", Refused: true})
+
+			body := scrape(metrics)
+			Expect(body).To(ContainSubstring(`aw_downgrades_total{kind="suite",refused="false"} 1`))
+			Expect(body).To(ContainSubstring(`aw_downgrades_total{kind="framing",refused="true"} 1`))
+		})
+	})
+
+	Context("when gauges are registered", func() {
+		It("should read their values when the metrics are gathered", func() {
+			metrics := New(Options{})
+			value := 1.0
+			Expect(metrics.Gauge("backlog", "Backlog.", prometheus.Labels{"channel": "server"}, func() float64 { return value })).To(Succeed())
+			Expect(scrape(metrics)).To(ContainSubstring(`aw_backlog{channel="server"} 1`))
+
+			value = 3
+			Expect(scrape(metrics)).To(ContainSubstring(`aw_backlog{channel="server"} 3`))
+		})
+
+		It("should return an error when a gauge is registered twice", func() {
+			metrics := New(Options{})
+			Expect(metrics.Gauge("dht_peers", "Peers.", nil, func() float64 { return 0 })).To(Succeed())
+			Expect(metrics.Gauge("dht_peers", "Peers.", nil, func() float64 { return 0 })).NotTo(Succeed())
+		})
+	})
+
+	Context("when the metrics are nil", func() {
+		It("should not record anything", func() {
+			var metrics *Metrics
+			inner := mockHandshaker{}
+			Expect(func() {
+				metrics.Sent(protocol.Cast)
+				metrics.Received(protocol.Cast)
+				metrics.Deduplicated()
+				Expect(metrics.Gauge("dht_peers", "Peers.", nil, func() float64 { return 0 })).To(Succeed())
+			}).NotTo(Panic())
+			Expect(metrics.Handshaker(inner)).To(Equal(inner))
+		})
+	})
+})
@@ -46,9 +46,9 @@ func (multicaster *multicaster) Multicast(ctx context.Context, groupID protocol.
 	default:
 	}
 
-	protocol.ParForAllAddresses(addrs, multicaster.numWorkers, func(to protocol.PeerAddress) {
+	err = protocol.ParForAllAddressesWithContext(ctx, addrs, multicaster.numWorkers, func(ctx context.Context, to protocol.PeerAddress) error {
 		if to == nil {
-			return
+			return nil
 		}
 		messageWire := protocol.MessageOnTheWire{
 			To:      to,
@@ -58,10 +58,14 @@ func (multicaster *multicaster) Multicast(ctx context.Context, groupID protocol.
 		select {
 		case <-ctx.Done():
 			multicaster.logger.Debugf("cannot send message to %v, %v", to.PeerID(), ctx.Err())
+			return ctx.Err()
 		case multicaster.messages <- messageWire:
+			return nil
 		}
 	})
-
+	if err != nil {
+		return newErrMulticasting(err, groupID)
+	}
 	return nil
 }
 
@@ -79,6 +83,8 @@ func (multicaster *multicaster) AcceptMulticast(ctx context.Context, from protoc
 		Time:    time.Now(),
 		Message: message.Body,
 		From:    from,
+		GroupID: message.GroupID,
+		Hash:    message.Hash(),
 	}
 
 	// Check if context is already expired
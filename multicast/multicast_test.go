@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"testing/quick"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -65,6 +66,29 @@ var _ = Describe("Multicaster", func() {
 			})
 		})
 
+		Context("when the context is done while multicasting", func() {
+			It("should return the addresses that the message was not sent to", func() {
+				messages := make(chan protocol.MessageOnTheWire, 1)
+				events := make(chan protocol.Event, 1)
+				dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+				multicaster := NewMulticaster(logrus.New(), 8, messages, events, dht)
+
+				// Only one of the messages can be enqueued
+				groupID := RandomGroupID()
+				addrs := RandomAddresses(4)
+				for _, addr := range addrs {
+					Expect(dht.AddPeerAddress(addr)).To(Succeed())
+				}
+				Expect(dht.AddGroup(groupID, FromAddressesToIDs(addrs))).To(Succeed())
+
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+				defer cancel()
+				err := multicaster.Multicast(ctx, groupID, RandomMessageBody())
+				Expect(err).To(BeAssignableToTypeOf(ErrMulticasting{}))
+				Expect(messages).Should(HaveLen(1))
+			})
+		})
+
 		Context("when the groupID doesn't exist in dht", func() {
 			It("should return an error", func() {
 				check := func(messageBody []byte) bool {
@@ -0,0 +1,154 @@
+package nat
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ErrNoRouter is returned by Discover when no router answers with UPnP or
+// NAT-PMP.
+var ErrNoRouter = errors.New("no router found")
+
+// A Mapper asks the router of the local network to forward an external port of
+// the router to an internal port of this host, so that peers can dial this host
+// even though it is behind the router (e.g. a home router).
+type Mapper interface {
+	// ExternalIP returns the IP of the router on the internet.
+	ExternalIP() (net.IP, error)
+
+	// AddMapping forwards the external port to the internal port for the
+	// lifetime of the mapping. The protocol is "tcp" or "udp". It returns the
+	// external port that was mapped, which is not always the one that was
+	// requested.
+	AddMapping(protocol string, externalPort, internalPort int, name string, lifetime time.Duration) (int, error)
+
+	// DeleteMapping stops forwarding the external port to the internal port.
+	DeleteMapping(protocol string, externalPort, internalPort int) error
+
+	String() string
+}
+
+// Discover returns a Mapper for the router of the local network, using UPnP or
+// NAT-PMP, whichever answers first. It returns ErrNoRouter if neither answers
+// before the context is done.
+func Discover(ctx context.Context) (Mapper, error) {
+	mappers := make(chan Mapper, 2)
+	go func() {
+		mapper, err := DiscoverUPnP(ctx)
+		if err != nil {
+			mapper = nil
+		}
+		mappers <- mapper
+	}()
+	go func() {
+		mapper, err := DiscoverPMP(ctx)
+		if err != nil {
+			mapper = nil
+		}
+		mappers <- mapper
+	}()
+	for i := 0; i < 2; i++ {
+		if mapper := <-mappers; mapper != nil {
+			return mapper, nil
+		}
+	}
+	return nil, ErrNoRouter
+}
+
+// Options are used to parameterise the mappings made by Map.
+type Options struct {
+	Logger   logrus.FieldLogger
+	Name     string        // Description of the mapping in the router, defaults to "aw"
+	Lifetime time.Duration // Lifetime of the mapping, defaults to 20 minutes
+}
+
+func (options *Options) setZerosToDefaults() {
+	if options.Logger == nil {
+		options.Logger = logrus.New()
+	}
+	if options.Name == "" {
+		options.Name = "aw"
+	}
+	if options.Lifetime <= 0 {
+		options.Lifetime = 20 * time.Minute
+	}
+}
+
+// Map forwards the same external port to the internal port using the Mapper,
+// and refreshes the mapping after half of its Lifetime, until the context is
+// done. The mapping is deleted once the context is done. The external address
+// is passed to the callback whenever it changes (e.g. because the router was
+// restarted). Map blocks until the context is done.
+func Map(ctx context.Context, options Options, mapper Mapper, protocol string, port int, callback func(ip net.IP, port int)) {
+	options.setZerosToDefaults()
+
+	var externalIP net.IP
+	externalPort := port
+	refresh := func() {
+		mappedPort, err := mapper.AddMapping(protocol, externalPort, port, options.Name, options.Lifetime)
+		if err != nil {
+			options.Logger.Errorf("error mapping %v port=%v with %v: %v", protocol, port, mapper, err)
+			return
+		}
+		ip, err := mapper.ExternalIP()
+		if err != nil {
+			options.Logger.Errorf("error loading external ip from %v: %v", mapper, err)
+			return
+		}
+		if !ip.Equal(externalIP) || mappedPort != externalPort {
+			options.Logger.Infof("mapped %v port=%v to %v with %v", protocol, port, net.JoinHostPort(ip.String(), strconv.Itoa(mappedPort)), mapper)
+			externalIP, externalPort = ip, mappedPort
+			if callback != nil {
+				callback(ip, mappedPort)
+			}
+		}
+	}
+
+	refresh()
+	ticker := time.NewTicker(options.Lifetime / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if err := mapper.DeleteMapping(protocol, externalPort, port); err != nil {
+				options.Logger.Errorf("error deleting mapping of %v port=%v with %v: %v", protocol, port, mapper, err)
+			}
+			return
+		case <-ticker.C:
+			refresh()
+		}
+	}
+}
+
+// localIPv4s returns the private IPv4 addresses of the interfaces of this host.
+func localIPv4s() []net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	ips := []net.IP{}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ip := ipNet.IP.To4(); ip != nil && !ip.IsLoopback() && isPrivate(ip) {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+func isPrivate(ip net.IP) bool {
+	return ip[0] == 10 || (ip[0] == 172 && ip[1]&0xf0 == 16) || (ip[0] == 192 && ip[1] == 168)
+}
+
+func normaliseProtocol(protocol string) string {
+	return strings.ToUpper(protocol)
+}
@@ -0,0 +1,13 @@
+package nat_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestNat(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Nat Suite")
+}
@@ -0,0 +1,193 @@
+package nat_test
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/nat"
+	. "github.com/renproject/aw/testutil"
+)
+
+// servePMP answers NAT-PMP requests like a router with the external IP, until
+// the connection is closed. Mappings are made on the requested external port.
+func servePMP(conn *net.UDPConn, ip net.IP, requests chan<- []byte) {
+	buffer := make([]byte, 16)
+	for {
+		n, addr, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		request := append([]byte{}, buffer[:n]...)
+		requests <- request
+		var response []byte
+		switch request[1] {
+		case 0:
+			response = make([]byte, 12)
+			copy(response[8:], ip.To4())
+		default:
+			response = make([]byte, 16)
+			copy(response[8:], request[4:12])
+		}
+		response[1] = request[1] | 128
+		conn.WriteToUDP(response, addr)
+	}
+}
+
+const description = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+  <device>
+    <deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+    <deviceList>
+      <device>
+        <deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+        <deviceList>
+          <device>
+            <deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+            <serviceList>
+              <service>
+                <serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+                <controlURL>/control</controlURL>
+              </service>
+            </serviceList>
+          </device>
+        </deviceList>
+      </device>
+    </deviceList>
+  </device>
+</root>`
+
+var _ = Describe("NAT", func() {
+	Context("when mapping ports with NAT-PMP", func() {
+		It("should request the external IP, and map and unmap ports", func() {
+			conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			Expect(err).NotTo(HaveOccurred())
+			defer conn.Close()
+			requests := make(chan []byte, 16)
+			go servePMP(conn, net.IPv4(1, 2, 3, 4), requests)
+
+			mapper := NewPMP(conn.LocalAddr().(*net.UDPAddr))
+			ip, err := mapper.ExternalIP()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ip.Equal(net.IPv4(1, 2, 3, 4))).To(BeTrue())
+			Eventually(requests).Should(Receive())
+
+			port, err := mapper.AddMapping("tcp", 18514, 18515, "aw", time.Hour)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(port).To(Equal(18514))
+			var request []byte
+			Eventually(requests).Should(Receive(&request))
+			Expect(request[1]).To(Equal(byte(2)))
+			Expect(binary.BigEndian.Uint16(request[4:])).To(Equal(uint16(18515)))
+			Expect(binary.BigEndian.Uint32(request[8:])).To(Equal(uint32(3600)))
+
+			Expect(mapper.DeleteMapping("tcp", 18514, 18515)).To(Succeed())
+			Eventually(requests).Should(Receive(&request))
+			Expect(binary.BigEndian.Uint16(request[6:])).To(BeZero())
+			Expect(binary.BigEndian.Uint32(request[8:])).To(BeZero())
+		})
+
+		It("should return an error when the router does not answer", func() {
+			conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			Expect(err).NotTo(HaveOccurred())
+			defer conn.Close()
+
+			_, err = NewPMP(conn.LocalAddr().(*net.UDPAddr)).ExternalIP()
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("when mapping ports with UPnP", func() {
+		It("should find the service in the description, and call its actions", func() {
+			mu := new(sync.Mutex)
+			actions := []string{}
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/description.xml":
+					fmt.Fprint(w, description)
+				case "/control":
+					body, _ := ioutil.ReadAll(r.Body)
+					mu.Lock()
+					actions = append(actions, r.Header.Get("SOAPAction"))
+					mu.Unlock()
+					if strings.Contains(r.Header.Get("SOAPAction"), "GetExternalIPAddress") {
+						fmt.Fprint(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><u:GetExternalIPAddressResponse xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1"><NewExternalIPAddress>5.6.7.8</NewExternalIPAddress></u:GetExternalIPAddressResponse></s:Body></s:Envelope>`)
+						return
+					}
+					if strings.Contains(r.Header.Get("SOAPAction"), "AddPortMapping") {
+						Expect(string(body)).To(ContainSubstring("<NewExternalPort>18514</NewExternalPort>"))
+						Expect(string(body)).To(ContainSubstring("<NewProtocol>TCP</NewProtocol>"))
+						Expect(string(body)).To(ContainSubstring("<NewInternalClient>127.0.0.1</NewInternalClient>"))
+					}
+				default:
+					http.NotFound(w, r)
+				}
+			}))
+			defer server.Close()
+
+			mapper, err := NewUPnP(context.Background(), server.URL+"/description.xml")
+			Expect(err).NotTo(HaveOccurred())
+			ip, err := mapper.ExternalIP()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ip.Equal(net.IPv4(5, 6, 7, 8))).To(BeTrue())
+			port, err := mapper.AddMapping("tcp", 18514, 18515, "aw", time.Hour)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(port).To(Equal(18514))
+			Expect(mapper.DeleteMapping("tcp", 18514, 18515)).To(Succeed())
+
+			mu.Lock()
+			defer mu.Unlock()
+			Expect(actions).To(Equal([]string{
+				`"urn:schemas-upnp-org:service:WANIPConnection:1#GetExternalIPAddress"`,
+				`"urn:schemas-upnp-org:service:WANIPConnection:1#AddPortMapping"`,
+				`"urn:schemas-upnp-org:service:WANIPConnection:1#DeletePortMapping"`,
+			}))
+		})
+
+		It("should return an error when the device cannot map ports", func() {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, `<?xml version="1.0"?><root><device></device></root>`)
+			}))
+			defer server.Close()
+
+			_, err := NewUPnP(context.Background(), server.URL)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("when keeping a port mapped", func() {
+		It("should refresh the mapping, and delete it when the context is done", func() {
+			mapper := NewMockMapper(net.IPv4(1, 2, 3, 4))
+			addrs := make(chan string, 16)
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				Map(ctx, Options{Lifetime: 20 * time.Millisecond}, mapper, "tcp", 18515, func(ip net.IP, port int) {
+					addrs <- fmt.Sprintf("%v:%v", ip, port)
+				})
+			}()
+
+			Eventually(addrs).Should(Receive(Equal("1.2.3.4:18516")))
+			Eventually(mapper.Adds).Should(BeNumerically(">", 2))
+			Expect(addrs).To(BeEmpty())
+
+			// The callback is called again when the external IP changes
+			mapper.SetExternalIP(net.IPv4(4, 3, 2, 1))
+			Eventually(addrs).Should(Receive(Equal("4.3.2.1:18516")))
+
+			cancel()
+			Eventually(done).Should(BeClosed())
+			Expect(mapper.Mappings()).To(BeEmpty())
+		})
+	})
+})
@@ -0,0 +1,160 @@
+package nat
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+// PMPPort is the port that routers answer NAT-PMP requests on.
+const PMPPort = 5351
+
+// pmpTries is the number of times that a NAT-PMP request is sent before it
+// times out. The first retry is after 250 milliseconds, and the time between
+// retries doubles after every retry.
+const pmpTries = 4
+
+// Opcodes and result codes of NAT-PMP (see RFC 6886).
+const (
+	pmpOpExternalAddress = 0
+	pmpOpMapUDP          = 1
+	pmpOpMapTCP          = 2
+	pmpOpResponse        = 128
+	pmpResultSuccess     = 0
+)
+
+type pmp struct {
+	gateway *net.UDPAddr
+}
+
+// NewPMP returns a Mapper that sends NAT-PMP requests to the gateway (usually
+// on the PMPPort).
+func NewPMP(gateway *net.UDPAddr) Mapper {
+	return &pmp{gateway: gateway}
+}
+
+// DiscoverPMP returns a Mapper for the first gateway that answers a NAT-PMP
+// request. The gateways are guessed from the private IPv4 addresses of this
+// host, by assuming that the gateway is the first address of a /24 subnet.
+func DiscoverPMP(ctx context.Context) (Mapper, error) {
+	gateways := []*net.UDPAddr{}
+	for _, ip := range localIPv4s() {
+		gateway := net.IPv4(ip[0], ip[1], ip[2], 1)
+		if !gateway.Equal(ip) {
+			gateways = append(gateways, &net.UDPAddr{IP: gateway, Port: PMPPort})
+		}
+	}
+	mappers := make(chan Mapper, len(gateways))
+	for _, gateway := range gateways {
+		go func(gateway *net.UDPAddr) {
+			mapper := NewPMP(gateway)
+			if _, err := mapper.ExternalIP(); err != nil {
+				mapper = nil
+			}
+			mappers <- mapper
+		}(gateway)
+	}
+	for range gateways {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case mapper := <-mappers:
+			if mapper != nil {
+				return mapper, nil
+			}
+		}
+	}
+	return nil, ErrNoRouter
+}
+
+func (pmp *pmp) ExternalIP() (net.IP, error) {
+	response, err := pmp.request([]byte{0, pmpOpExternalAddress}, 12)
+	if err != nil {
+		return nil, fmt.Errorf("error requesting external address: %v", err)
+	}
+	return net.IPv4(response[8], response[9], response[10], response[11]), nil
+}
+
+func (pmp *pmp) AddMapping(protocol string, externalPort, internalPort int, name string, lifetime time.Duration) (int, error) {
+	op, err := pmpOpMap(protocol)
+	if err != nil {
+		return 0, err
+	}
+	request := make([]byte, 12)
+	request[1] = op
+	binary.BigEndian.PutUint16(request[4:], uint16(internalPort))
+	binary.BigEndian.PutUint16(request[6:], uint16(externalPort))
+	binary.BigEndian.PutUint32(request[8:], uint32(lifetime/time.Second))
+	response, err := pmp.request(request, 16)
+	if err != nil {
+		return 0, fmt.Errorf("error requesting mapping: %v", err)
+	}
+	return int(binary.BigEndian.Uint16(response[10:])), nil
+}
+
+func (pmp *pmp) DeleteMapping(protocol string, externalPort, internalPort int) error {
+	// Mappings are deleted by requesting a mapping of the internal port to the
+	// zero external port, with a zero lifetime
+	if _, err := pmp.AddMapping(protocol, 0, internalPort, "", 0); err != nil {
+		return fmt.Errorf("error deleting mapping: %v", err)
+	}
+	return nil
+}
+
+func (pmp *pmp) String() string {
+	return fmt.Sprintf("NAT-PMP(%v)", pmp.gateway)
+}
+
+// request sends the request to the gateway until a response of the expected
+// length is received, and returns the response once it has been checked.
+func (pmp *pmp) request(request []byte, length int) ([]byte, error) {
+	conn, err := net.DialUDP("udp", nil, pmp.gateway)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	response := make([]byte, 16)
+	timeout := 250 * time.Millisecond
+	for i := 0; i < pmpTries; i++ {
+		if _, err := conn.Write(request); err != nil {
+			return nil, err
+		}
+		if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			return nil, err
+		}
+		timeout *= 2
+
+		n, err := conn.Read(response)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				continue
+			}
+			return nil, err
+		}
+		if n < length {
+			return nil, fmt.Errorf("expected len=%v, got len=%v", length, n)
+		}
+		if response[0] != 0 || response[1] != request[1]|pmpOpResponse {
+			return nil, fmt.Errorf("unexpected response version=%v opcode=%v", response[0], response[1])
+		}
+		if result := binary.BigEndian.Uint16(response[2:]); result != pmpResultSuccess {
+			return nil, fmt.Errorf("result code=%v", result)
+		}
+		return response[:n], nil
+	}
+	return nil, fmt.Errorf("timeout after %v tries", pmpTries)
+}
+
+func pmpOpMap(protocol string) (byte, error) {
+	switch normaliseProtocol(protocol) {
+	case "TCP":
+		return pmpOpMapTCP, nil
+	case "UDP":
+		return pmpOpMapUDP, nil
+	default:
+		return 0, fmt.Errorf("unsupported protocol=%v", protocol)
+	}
+}
@@ -0,0 +1,267 @@
+package nat
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ssdpAddr is the multicast address that routers answer UPnP searches on.
+const ssdpAddr = "239.255.255.250:1900"
+
+// upnpTimeout is the timeout of every request that is sent to a router.
+const upnpTimeout = 5 * time.Second
+
+// upnpServices are the types of the UPnP services that can map ports, in order
+// of preference.
+var upnpServices = []string{
+	"urn:schemas-upnp-org:service:WANIPConnection:2",
+	"urn:schemas-upnp-org:service:WANIPConnection:1",
+	"urn:schemas-upnp-org:service:WANPPPConnection:1",
+}
+
+type upnp struct {
+	client      *http.Client
+	controlURL  string
+	serviceType string
+	internalIP  net.IP
+}
+
+// NewUPnP returns a Mapper for the UPnP device that is described at the
+// location (usually found by sending a search to the local network, see
+// DiscoverUPnP). The device must have a service that can map ports.
+func NewUPnP(ctx context.Context, location string) (Mapper, error) {
+	client := &http.Client{Timeout: upnpTimeout}
+	request, err := http.NewRequest(http.MethodGet, location, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := client.Do(request.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("error loading device description: %v", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error loading device description: status=%v", response.Status)
+	}
+	description := upnpDescription{}
+	if err := xml.NewDecoder(response.Body).Decode(&description); err != nil {
+		return nil, fmt.Errorf("error decoding device description: %v", err)
+	}
+
+	base, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	if description.URLBase != "" {
+		if base, err = url.Parse(description.URLBase); err != nil {
+			return nil, fmt.Errorf("error parsing url base: %v", err)
+		}
+	}
+	services := description.Device.services()
+	for _, serviceType := range upnpServices {
+		for _, service := range services {
+			if service.ServiceType != serviceType {
+				continue
+			}
+			controlURL, err := base.Parse(service.ControlURL)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing control url: %v", err)
+			}
+			internalIP, err := upnpInternalIP(controlURL)
+			if err != nil {
+				return nil, err
+			}
+			return &upnp{
+				client:      client,
+				controlURL:  controlURL.String(),
+				serviceType: serviceType,
+				internalIP:  internalIP,
+			}, nil
+		}
+	}
+	return nil, fmt.Errorf("error loading device description: device has no service that can map ports")
+}
+
+// DiscoverUPnP searches the local network for a UPnP router, and returns a
+// Mapper for the first one that answers.
+func DiscoverUPnP(ctx context.Context) (Mapper, error) {
+	addr, err := net.ResolveUDPAddr("udp4", ssdpAddr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	go func() {
+		<-ctx.Done()
+		conn.SetReadDeadline(time.Now())
+	}()
+
+	search := strings.Join([]string{
+		"M-SEARCH * HTTP/1.1",
+		"HOST: " + ssdpAddr,
+		"ST: urn:schemas-upnp-org:device:InternetGatewayDevice:1",
+		`MAN: "ssdp:discover"`,
+		"MX: 2",
+		"", "",
+	}, "\r\n")
+	if _, err := conn.WriteTo([]byte(search), addr); err != nil {
+		return nil, fmt.Errorf("error searching for routers: %v", err)
+	}
+
+	buffer := make([]byte, 2048)
+	for {
+		n, _, err := conn.ReadFrom(buffer)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, fmt.Errorf("error searching for routers: %v", err)
+		}
+		response, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buffer[:n])), nil)
+		if err != nil {
+			continue
+		}
+		location := response.Header.Get("Location")
+		if location == "" {
+			continue
+		}
+		if mapper, err := NewUPnP(ctx, location); err == nil {
+			return mapper, nil
+		}
+	}
+}
+
+func (upnp *upnp) ExternalIP() (net.IP, error) {
+	response := struct {
+		IP string `xml:"Body>GetExternalIPAddressResponse>NewExternalIPAddress"`
+	}{}
+	if err := upnp.call("GetExternalIPAddress", nil, &response); err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(strings.TrimSpace(response.IP))
+	if ip == nil {
+		return nil, fmt.Errorf("error parsing external ip=%v", response.IP)
+	}
+	return ip, nil
+}
+
+func (upnp *upnp) AddMapping(protocol string, externalPort, internalPort int, name string, lifetime time.Duration) (int, error) {
+	args := [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(externalPort)},
+		{"NewProtocol", normaliseProtocol(protocol)},
+		{"NewInternalPort", strconv.Itoa(internalPort)},
+		{"NewInternalClient", upnp.internalIP.String()},
+		{"NewEnabled", "1"},
+		{"NewPortMappingDescription", name},
+		{"NewLeaseDuration", strconv.Itoa(int(lifetime / time.Second))},
+	}
+	if err := upnp.call("AddPortMapping", args, nil); err != nil {
+		return 0, err
+	}
+	return externalPort, nil
+}
+
+func (upnp *upnp) DeleteMapping(protocol string, externalPort, internalPort int) error {
+	args := [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(externalPort)},
+		{"NewProtocol", normaliseProtocol(protocol)},
+	}
+	return upnp.call("DeletePortMapping", args, nil)
+}
+
+func (upnp *upnp) String() string {
+	return fmt.Sprintf("UPnP(%v)", upnp.controlURL)
+}
+
+// call the SOAP action of the service, and decode the response into the given
+// value, unless it is nil.
+func (upnp *upnp) call(action string, args [][2]string, value interface{}) error {
+	body := new(bytes.Buffer)
+	body.WriteString(`<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`)
+	fmt.Fprintf(body, `<u:%v xmlns:u="%v">`, action, upnp.serviceType)
+	for _, arg := range args {
+		fmt.Fprintf(body, "<%v>%v</%v>", arg[0], html.EscapeString(arg[1]), arg[0])
+	}
+	fmt.Fprintf(body, "</u:%v></s:Body></s:Envelope>", action)
+
+	request, err := http.NewRequest(http.MethodPost, upnp.controlURL, body)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	request.Header.Set("SOAPAction", fmt.Sprintf(`"%v#%v"`, upnp.serviceType, action))
+	response, err := upnp.client.Do(request)
+	if err != nil {
+		return fmt.Errorf("error calling %v: %v", action, err)
+	}
+	defer response.Body.Close()
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return fmt.Errorf("error calling %v: %v", action, err)
+	}
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("error calling %v: status=%v", action, response.Status)
+	}
+	if value == nil {
+		return nil
+	}
+	if err := xml.Unmarshal(data, value); err != nil {
+		return fmt.Errorf("error decoding response of %v: %v", action, err)
+	}
+	return nil
+}
+
+// upnpInternalIP returns the IP of the interface of this host that the router
+// at the URL is reached from, which is the IP that ports are mapped to.
+func upnpInternalIP(u *url.URL) (net.IP, error) {
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "80")
+	}
+	conn, err := net.Dial("udp", host)
+	if err != nil {
+		return nil, fmt.Errorf("error finding internal ip: %v", err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+type upnpDescription struct {
+	URLBase string     `xml:"URLBase"`
+	Device  upnpDevice `xml:"device"`
+}
+
+type upnpDevice struct {
+	Services []upnpService `xml:"serviceList>service"`
+	Devices  []upnpDevice  `xml:"deviceList>device"`
+}
+
+// services returns the services of the device and all of its embedded devices.
+func (device upnpDevice) services() []upnpService {
+	services := append([]upnpService{}, device.Services...)
+	for _, embedded := range device.Devices {
+		services = append(services, embedded.services()...)
+	}
+	return services
+}
+
+type upnpService struct {
+	ServiceType string `xml:"serviceType"`
+	ControlURL  string `xml:"controlURL"`
+}
@@ -0,0 +1,83 @@
+package peer
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/renproject/aw/ban"
+	"github.com/renproject/aw/capture"
+	"github.com/renproject/aw/schedule"
+)
+
+// NewAdminHandler returns an http.Handler that only passes authorised requests
+// to the inner http.Handler. When the token is empty, requests are authorised
+// if they come from a loopback address. Otherwise, requests are authorised if
+// they have the token as the bearer token of their Authorization header.
+func NewAdminHandler(handler http.Handler, token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			host, _, err := net.SplitHostPort(r.RemoteAddr)
+			if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+				w.WriteHeader(http.StatusForbidden)
+				fmt.Fprintln(w, "admin api is only served to loopback addresses")
+				return
+			}
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		bearer := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintln(w, "invalid admin token")
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// serveAdmin at the admin address until the context is done. The admin API of
+// the connections is always served, and the admin APIs of the ban list, the
+// capture tap, the schedule and the metrics are served if the peer has them.
+func (peer *peer) serveAdmin(ctx context.Context) {
+	mux := http.NewServeMux()
+	conns := NewConnsHandler(peer)
+	mux.Handle("/conns", conns)
+	mux.Handle("/conns/redial", conns)
+	if peer.options.Bans != nil {
+		mux.Handle("/bans", ban.NewHandler(peer.options.Bans))
+	}
+	if peer.options.Capture != nil {
+		mux.Handle("/capture", capture.NewHandler(peer.options.Capture))
+	}
+	if peer.options.Schedule != nil {
+		mux.Handle("/schedule", schedule.NewHandler(peer.options.Schedule))
+	}
+	if peer.options.Metrics != nil {
+		mux.Handle("/metrics", peer.options.Metrics.Handler())
+	}
+	peer.serveHTTP(ctx, "admin api", peer.options.AdminAddress, NewAdminHandler(mux, peer.options.AdminToken))
+}
+
+// serveHTTP at the address until the context is done.
+func (peer *peer) serveHTTP(ctx context.Context, name, addr string, handler http.Handler) {
+	server := &http.Server{
+		Addr:    addr,
+		Handler: handler,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		peer.logger.Errorf("error serving %v at %v: %v", name, addr, err)
+	}
+}
@@ -0,0 +1,100 @@
+package peer_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/testutil"
+
+	"github.com/renproject/aw/ban"
+	"github.com/renproject/aw/capture"
+	"github.com/renproject/aw/metrics"
+	"github.com/renproject/aw/peer"
+	"github.com/renproject/aw/protocol"
+	"github.com/renproject/aw/schedule"
+	"github.com/sirupsen/logrus"
+)
+
+var _ = Describe("Admin API", func() {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	serve := func(handler http.Handler, remoteAddr, authorization string) int {
+		request := httptest.NewRequest(http.MethodGet, "/conns", nil)
+		request.RemoteAddr = remoteAddr
+		if authorization != "" {
+			request.Header.Set("Authorization", authorization)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+
+	Context("when there is no admin token", func() {
+		It("should only serve loopback addresses", func() {
+			handler := peer.NewAdminHandler(ok, "")
+			Expect(serve(handler, "127.0.0.1:1234", "")).To(Equal(http.StatusNoContent))
+			Expect(serve(handler, "[::1]:1234", "")).To(Equal(http.StatusNoContent))
+			Expect(serve(handler, "10.0.0.1:1234", "")).To(Equal(http.StatusForbidden))
+			Expect(serve(handler, "10.0.0.1:1234", "Bearer ")).To(Equal(http.StatusForbidden))
+		})
+	})
+
+	Context("when there is an admin token", func() {
+		It("should only serve requests with the token", func() {
+			handler := peer.NewAdminHandler(ok, "secret")
+			Expect(serve(handler, "10.0.0.1:1234", "Bearer secret")).To(Equal(http.StatusNoContent))
+			Expect(serve(handler, "10.0.0.1:1234", "Bearer wrong")).To(Equal(http.StatusUnauthorized))
+			Expect(serve(handler, "127.0.0.1:1234", "")).To(Equal(http.StatusUnauthorized))
+		})
+	})
+
+	Context("when the peer is running", func() {
+		It("should serve the admin api at the admin address, and not at the probe address", func() {
+			probeAddress, adminAddress := freeAddress(), freeAddress()
+			me := RandomAddress()
+			bans, err := ban.NewList(NewTable("bans"))
+			Expect(err).NotTo(HaveOccurred())
+			s, err := schedule.New(schedule.Options{}, nil, nil)
+			Expect(err).NotTo(HaveOccurred())
+			options := peer.Options{
+				Me:           me,
+				ProbeAddress: probeAddress,
+				AdminAddress: adminAddress,
+				Bans:         bans,
+				Capture:      capture.NewTap(capture.Options{}),
+				Schedule:     s,
+				Metrics:      metrics.New(metrics.Options{}),
+			}
+			p := peer.New(options, logrus.New(), NewSimpleTCPPeerAddressCodec(), NewDHT(me, NewTable("dht"), nil), nil, mockClient(make(chan protocol.MessageOnTheWire, 128)), mockServer(nil), make(chan protocol.Event))
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go p.Run(ctx)
+
+			get := func(url string) int {
+				response, err := http.Get(url)
+				if err != nil {
+					return 0
+				}
+				defer response.Body.Close()
+				return response.StatusCode
+			}
+			Eventually(func() int { return get("http://" + adminAddress + "/conns") }, time.Second).Should(Equal(http.StatusOK))
+			Eventually(func() int { return get("http://" + probeAddress + "/healthz") }, time.Second).Should(Equal(http.StatusOK))
+			Expect(get("http://" + adminAddress + "/bans")).To(Equal(http.StatusOK))
+			Expect(get("http://" + adminAddress + "/capture")).To(Equal(http.StatusOK))
+			Expect(get("http://" + adminAddress + "/schedule")).To(Equal(http.StatusOK))
+			Expect(get("http://" + adminAddress + "/metrics")).To(Equal(http.StatusOK))
+			Expect(get("http://" + probeAddress + "/conns")).To(Equal(http.StatusNotFound))
+			Expect(get("http://" + probeAddress + "/bans")).To(Equal(http.StatusNotFound))
+			Expect(get("http://" + probeAddress + "/capture")).To(Equal(http.StatusNotFound))
+			Expect(get("http://" + probeAddress + "/schedule")).To(Equal(http.StatusNotFound))
+			Expect(get("http://" + probeAddress + "/metrics")).To(Equal(http.StatusNotFound))
+		})
+	})
+})
@@ -0,0 +1,199 @@
+package peer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/renproject/aw/protocol"
+	"github.com/renproject/aw/resolver"
+)
+
+// BootstrapStatus is the health of a bootstrap address. An attempt fails if
+// its network address cannot be resolved, if the ping cannot be sent, or if no
+// pong is received before the next attempt. Failures are the number of
+// consecutive failed attempts, and are reset by a pong.
+type BootstrapStatus struct {
+	Address     string    `json:"address"`
+	PeerID      string    `json:"peerID"`
+	Healthy     bool      `json:"healthy"`
+	Resolved    []string  `json:"resolved,omitempty"`
+	LastAttempt time.Time `json:"lastAttempt"`
+	LastSuccess time.Time `json:"lastSuccess"`
+	Successes   int       `json:"successes"`
+	Failures    int       `json:"failures"`
+	LastError   string    `json:"lastError,omitempty"`
+}
+
+type bootstrapEntry struct {
+	BootstrapStatus
+	peerAddress  protocol.PeerAddress
+	awaitingPong bool
+}
+
+// bootstrapTracker keeps the BootstrapStatus of every bootstrap address.
+// Addresses with at least threshold consecutive failures are unhealthy, and
+// are pinged after all other peers.
+type bootstrapTracker struct {
+	threshold int
+	resolver  resolver.Resolver
+
+	mu      *sync.Mutex
+	order   []string
+	entries map[string]*bootstrapEntry
+}
+
+func newBootstrapTracker(addrs protocol.PeerAddresses, threshold int, r resolver.Resolver) *bootstrapTracker {
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	tracker := &bootstrapTracker{
+		threshold: threshold,
+		resolver:  r,
+
+		mu:      new(sync.Mutex),
+		order:   make([]string, 0, len(addrs)),
+		entries: make(map[string]*bootstrapEntry, len(addrs)),
+	}
+	for _, addr := range addrs {
+		id := addr.PeerID().String()
+		if _, ok := tracker.entries[id]; ok {
+			continue
+		}
+		tracker.order = append(tracker.order, id)
+		tracker.entries[id] = &bootstrapEntry{
+			BootstrapStatus: BootstrapStatus{
+				Address: addr.String(),
+				PeerID:  id,
+				Healthy: true,
+			},
+			peerAddress: addr,
+		}
+	}
+	return tracker
+}
+
+// resolve the network address of every bootstrap address again, so that
+// entries that no longer resolve are noticed even if the peer is still
+// connected to them.
+func (tracker *bootstrapTracker) resolve(ctx context.Context) {
+	tracker.mu.Lock()
+	addrs := make(protocol.PeerAddresses, 0, len(tracker.order))
+	for _, id := range tracker.order {
+		addrs = append(addrs, tracker.entries[id].peerAddress)
+	}
+	tracker.mu.Unlock()
+
+	for _, addr := range addrs {
+		resolved, err := resolveNetworkAddress(ctx, tracker.resolver, addr)
+
+		tracker.mu.Lock()
+		entry := tracker.entries[addr.PeerID().String()]
+		entry.Resolved = resolved
+		if err != nil {
+			tracker.failWithoutLock(entry, fmt.Errorf("error resolving network address: %v", err))
+		}
+		tracker.mu.Unlock()
+	}
+}
+
+// attempt records that a bootstrap address is about to be pinged. The previous
+// attempt failed if it was not answered by a pong.
+func (tracker *bootstrapTracker) attempt(id protocol.PeerID) {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	entry, ok := tracker.entries[id.String()]
+	if !ok {
+		return
+	}
+	if entry.awaitingPong {
+		tracker.failWithoutLock(entry, fmt.Errorf("no pong since %v", entry.LastAttempt.Format(time.RFC3339)))
+	}
+	entry.LastAttempt = time.Now()
+	entry.awaitingPong = true
+}
+
+// fail records that an attempt to ping a bootstrap address failed.
+func (tracker *bootstrapTracker) fail(id protocol.PeerID, err error) {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	if entry, ok := tracker.entries[id.String()]; ok {
+		entry.awaitingPong = false
+		tracker.failWithoutLock(entry, err)
+	}
+}
+
+// pong records that a bootstrap address answered a ping.
+func (tracker *bootstrapTracker) pong(id protocol.PeerID) {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	entry, ok := tracker.entries[id.String()]
+	if !ok {
+		return
+	}
+	entry.awaitingPong = false
+	entry.LastSuccess = time.Now()
+	entry.Successes++
+	entry.Failures = 0
+	entry.LastError = ""
+	entry.Healthy = true
+}
+
+func (tracker *bootstrapTracker) failWithoutLock(entry *bootstrapEntry, err error) {
+	entry.Failures++
+	entry.LastError = err.Error()
+	entry.Healthy = entry.Failures < tracker.threshold
+}
+
+// prioritise sorts the peer addresses so that unhealthy bootstrap addresses are
+// pinged last. The order of all other addresses is kept.
+func (tracker *bootstrapTracker) prioritise(addrs protocol.PeerAddresses) {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	unhealthy := func(addr protocol.PeerAddress) bool {
+		entry, ok := tracker.entries[addr.PeerID().String()]
+		return ok && !entry.Healthy
+	}
+	sort.SliceStable(addrs, func(i, j int) bool {
+		return !unhealthy(addrs[i]) && unhealthy(addrs[j])
+	})
+}
+
+// statuses returns the BootstrapStatus of every bootstrap address, in the
+// order they were configured.
+func (tracker *bootstrapTracker) statuses() []BootstrapStatus {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	statuses := make([]BootstrapStatus, 0, len(tracker.order))
+	for _, id := range tracker.order {
+		status := tracker.entries[id].BootstrapStatus
+		status.Resolved = append([]string(nil), status.Resolved...)
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// resolveNetworkAddress returns the IP addresses of a peer address. Host names
+// are looked up using the resolver.
+func resolveNetworkAddress(ctx context.Context, r resolver.Resolver, addr protocol.PeerAddress) ([]string, error) {
+	netAddr := addr.NetworkAddress()
+	if netAddr == nil {
+		return nil, fmt.Errorf("cannot resolve %v", addr)
+	}
+	host, _, err := net.SplitHostPort(netAddr.String())
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+	return r.LookupHost(ctx, host)
+}
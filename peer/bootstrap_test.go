@@ -0,0 +1,84 @@
+package peer_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/testutil"
+
+	"github.com/renproject/aw/peer"
+	"github.com/renproject/aw/protocol"
+	"github.com/sirupsen/logrus"
+)
+
+var _ = Describe("Bootstrap health", func() {
+	Context("when some bootstrap addresses do not answer", func() {
+		It("should report them as unhealthy", func() {
+			me := RandomAddress()
+			bootstrapAddrs := RandomAddresses(2)
+			options := peer.Options{
+				Me:                        me,
+				BootstrapAddresses:        bootstrapAddrs,
+				BootstrapDuration:         20 * time.Millisecond,
+				BootstrapFailureThreshold: 2,
+			}
+			sent := make(chan protocol.MessageOnTheWire, 128)
+			received := make(chan protocol.MessageOnTheWire, 128)
+			codec := NewSimpleTCPPeerAddressCodec()
+			p := peer.New(options, logrus.New(), codec, NewDHT(me, NewTable("dht"), bootstrapAddrs), nil, mockClient(sent), mockServer(received), make(chan protocol.Event, 128))
+
+			statuses := p.BootstrapHealth()
+			Expect(statuses).To(HaveLen(2))
+			for i, status := range statuses {
+				Expect(status.Address).To(Equal(bootstrapAddrs[i].String()))
+				Expect(status.Healthy).To(BeTrue())
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go p.Run(ctx)
+
+			// Only the first bootstrap address answers pings
+			pong, err := codec.Encode(bootstrapAddrs[0])
+			Expect(err).NotTo(HaveOccurred())
+			go func() {
+				for {
+					select {
+					case <-ctx.Done():
+						return
+					case message := <-sent:
+						if message.Message.Variant != protocol.Ping || !message.To.Equal(bootstrapAddrs[0]) {
+							continue
+						}
+						received <- protocol.MessageOnTheWire{
+							From:    bootstrapAddrs[0].PeerID(),
+							Message: protocol.NewMessage(protocol.V1, protocol.Pong, protocol.NilGroupID, pong),
+						}
+					}
+				}
+			}()
+
+			Eventually(func() bool {
+				return !p.BootstrapHealth()[1].Healthy
+			}).Should(BeTrue())
+			statuses = p.BootstrapHealth()
+			Expect(statuses[0].Healthy).To(BeTrue())
+			Expect(statuses[0].Successes).To(BeNumerically(">", 0))
+			Expect(statuses[0].Resolved).To(Equal([]string{bootstrapAddrs[0].(SimpleTCPPeerAddress).IPAddress}))
+			Expect(statuses[1].Failures).To(BeNumerically(">=", 2))
+			Expect(statuses[1].LastError).NotTo(BeEmpty())
+
+			// The health is exposed by the probe handler
+			recorder := httptest.NewRecorder()
+			peer.NewProbeHandler(p).ServeHTTP(recorder, httptest.NewRequest("GET", "/bootstrap", nil))
+			reported := []peer.BootstrapStatus{}
+			Expect(json.Unmarshal(recorder.Body.Bytes(), &reported)).To(Succeed())
+			Expect(reported).To(HaveLen(2))
+			Expect(reported[1].Healthy).To(BeFalse())
+		})
+	})
+})
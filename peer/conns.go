@@ -0,0 +1,132 @@
+package peer
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/renproject/aw/tcp"
+)
+
+// connManager is a Client, or a Server, that keeps its connections (e.g. the
+// tcp.Client and the tcp.Server).
+type connManager interface {
+	Conns() []tcp.ConnState
+	CloseConn(remoteAddr string) error
+}
+
+// redialer is a Client that can dial its connections again (e.g. the
+// tcp.Client).
+type redialer interface {
+	Redial(remoteAddr string) error
+}
+
+// fdServer is a Server that counts the file descriptors of its connections
+// (e.g. the tcp.Server).
+type fdServer interface {
+	FDs() tcp.FDStats
+}
+
+func (peer *peer) connManagers() []connManager {
+	managers := make([]connManager, 0, 2)
+	if client, ok := peer.client.(connManager); ok {
+		managers = append(managers, client)
+	}
+	if server, ok := peer.server.(connManager); ok {
+		managers = append(managers, server)
+	}
+	return managers
+}
+
+func (peer *peer) Conns() []tcp.ConnState {
+	states := []tcp.ConnState{}
+	for _, manager := range peer.connManagers() {
+		states = append(states, manager.Conns()...)
+	}
+	return states
+}
+
+func (peer *peer) FDs() tcp.FDStats {
+	if server, ok := peer.server.(fdServer); ok {
+		return server.FDs()
+	}
+	return tcp.FDStats{}
+}
+
+func (peer *peer) CloseConn(remoteAddr string) error {
+	err := tcp.ErrConnNotFound
+	for _, manager := range peer.connManagers() {
+		closeErr := manager.CloseConn(remoteAddr)
+		if closeErr == tcp.ErrConnNotFound {
+			continue
+		}
+		if closeErr != nil {
+			return closeErr
+		}
+		err = nil
+	}
+	if err == nil {
+		peer.logger.Infof("closed connection with %v", remoteAddr)
+	}
+	return err
+}
+
+func (peer *peer) Redial(remoteAddr string) error {
+	client, ok := peer.client.(redialer)
+	if !ok {
+		return tcp.ErrConnNotFound
+	}
+	if err := client.Redial(remoteAddr); err != nil {
+		return err
+	}
+	peer.logger.Infof("redialed connection to %v", remoteAddr)
+	return nil
+}
+
+// NewConnsHandler returns an http.Handler that serves the admin API of the
+// connections of a Peer at /conns. GET lists the connections, and DELETE
+// closes the connections with the remoteAddr query parameter. POST to
+// /conns/redial dials the connection to the remoteAddr query parameter again.
+func NewConnsHandler(peer Peer) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/conns", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(peer.Conns()); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+
+		case http.MethodDelete:
+			writeConnResult(w, peer.CloseConn(r.URL.Query().Get("remoteAddr")))
+
+		default:
+			w.Header().Set("Allow", "GET, DELETE")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			fmt.Fprintf(w, "method %v is not allowed\n", r.Method)
+		}
+	})
+	mux.HandleFunc("/conns/redial", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			fmt.Fprintf(w, "method %v is not allowed\n", r.Method)
+			return
+		}
+		writeConnResult(w, peer.Redial(r.URL.Query().Get("remoteAddr")))
+	})
+	return mux
+}
+
+func writeConnResult(w http.ResponseWriter, err error) {
+	switch err {
+	case nil:
+		w.WriteHeader(http.StatusNoContent)
+	case tcp.ErrConnNotFound:
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintln(w, err)
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, err)
+	}
+}
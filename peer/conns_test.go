@@ -0,0 +1,105 @@
+package peer_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/testutil"
+
+	"github.com/renproject/aw/peer"
+	"github.com/renproject/aw/protocol"
+	"github.com/renproject/aw/tcp"
+	"github.com/sirupsen/logrus"
+)
+
+// connsClient is a mockClient that keeps connections, which can be closed and
+// redialed.
+type connsClient struct {
+	mockClient
+
+	mu       *sync.Mutex
+	conns    map[string]tcp.ConnState
+	redialed []string
+}
+
+func newConnsClient(remoteAddrs ...string) connsClient {
+	client := connsClient{
+		mockClient: mockClient(make(chan protocol.MessageOnTheWire, 128)),
+		mu:         new(sync.Mutex),
+		conns:      map[string]tcp.ConnState{},
+	}
+	for _, remoteAddr := range remoteAddrs {
+		client.conns[remoteAddr] = tcp.ConnState{RemoteAddr: remoteAddr, Transport: "tcp", Outbound: true}
+	}
+	return client
+}
+
+func (client connsClient) Conns() []tcp.ConnState {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	states := []tcp.ConnState{}
+	for _, state := range client.conns {
+		states = append(states, state)
+	}
+	return states
+}
+
+func (client connsClient) CloseConn(remoteAddr string) error {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	if _, ok := client.conns[remoteAddr]; !ok {
+		return tcp.ErrConnNotFound
+	}
+	delete(client.conns, remoteAddr)
+	return nil
+}
+
+func (client *connsClient) Redial(remoteAddr string) error {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	if _, ok := client.conns[remoteAddr]; !ok {
+		return tcp.ErrConnNotFound
+	}
+	client.redialed = append(client.redialed, remoteAddr)
+	return nil
+}
+
+var _ = Describe("Connections admin API", func() {
+	serve := func(handler http.Handler, method, url string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(method, url, nil))
+		return recorder
+	}
+
+	It("should list, close and redial the connections of the peer", func() {
+		me := RandomAddress()
+		client := newConnsClient("127.0.0.1:8080", "127.0.0.1:9090")
+		p := peer.New(peer.Options{Me: me}, logrus.New(), NewSimpleTCPPeerAddressCodec(), NewDHT(me, NewTable("dht"), nil), nil, &client, mockServer(nil), make(chan protocol.Event, 128))
+		handler := peer.NewConnsHandler(p)
+
+		response := serve(handler, http.MethodGet, "/conns")
+		Expect(response.Code).To(Equal(http.StatusOK))
+		conns := []tcp.ConnState{}
+		Expect(json.Unmarshal(response.Body.Bytes(), &conns)).To(Succeed())
+		Expect(conns).To(HaveLen(2))
+
+		Expect(serve(handler, http.MethodPost, "/conns/redial?remoteAddr=127.0.0.1:8080").Code).To(Equal(http.StatusNoContent))
+		Expect(client.redialed).To(Equal([]string{"127.0.0.1:8080"}))
+
+		Expect(serve(handler, http.MethodDelete, "/conns?remoteAddr=127.0.0.1:8080").Code).To(Equal(http.StatusNoContent))
+		Expect(p.Conns()).To(HaveLen(1))
+		Expect(p.Conns()[0].RemoteAddr).To(Equal("127.0.0.1:9090"))
+
+		Expect(serve(handler, http.MethodDelete, "/conns?remoteAddr=127.0.0.1:8080").Code).To(Equal(http.StatusNotFound))
+		Expect(serve(handler, http.MethodPost, "/conns/redial?remoteAddr=127.0.0.1:8080").Code).To(Equal(http.StatusNotFound))
+		Expect(serve(handler, http.MethodPut, "/conns").Code).To(Equal(http.StatusMethodNotAllowed))
+		Expect(serve(handler, http.MethodGet, "/conns/redial").Code).To(Equal(http.StatusMethodNotAllowed))
+	})
+})
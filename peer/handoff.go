@@ -0,0 +1,77 @@
+package peer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+
+	"github.com/renproject/aw/handoff"
+)
+
+// fileServer is a Server that can hand off the files of its listeners (e.g. the
+// tcp.Server).
+type fileServer interface {
+	Files() ([]*os.File, error)
+}
+
+func (peer *peer) State() (handoff.State, error) {
+	addrs, err := peer.dht.PeerAddresses()
+	if err != nil {
+		return handoff.State{}, fmt.Errorf("error loading peer addresses: %v", err)
+	}
+	state := handoff.State{PeerAddresses: make([][]byte, 0, len(addrs))}
+	for _, addr := range addrs {
+		data, err := peer.codec.Encode(addr)
+		if err != nil {
+			return handoff.State{}, fmt.Errorf("error encoding peer address=%v: %v", addr, err)
+		}
+		state.PeerAddresses = append(state.PeerAddresses, data)
+	}
+	if state.Broadcaster, err = peer.broadcaster.State(); err != nil {
+		return handoff.State{}, err
+	}
+	return state, nil
+}
+
+func (peer *peer) Handoff(ctx context.Context, cmd *exec.Cmd) error {
+	server, ok := peer.server.(fileServer)
+	if !ok {
+		return fmt.Errorf("cannot hand off listeners of server of type %T", peer.server)
+	}
+	files, err := server.Files()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	state, err := peer.State()
+	if err != nil {
+		return err
+	}
+	return handoff.Start(ctx, cmd, files, state)
+}
+
+// restore the State that was handed off by the process that the peer
+// replaces. Peer addresses that cannot be decoded are skipped.
+func (peer *peer) restore(state handoff.State) {
+	for _, data := range state.PeerAddresses {
+		addr, err := peer.codec.Decode(data)
+		if err != nil {
+			peer.logger.Errorf("error restoring peer address: %v", err)
+			continue
+		}
+		if addr.PeerID().Equal(peer.dht.Me().PeerID()) {
+			continue
+		}
+		if _, err := peer.dht.UpdatePeerAddress(addr); err != nil {
+			peer.logger.Errorf("error restoring peer address=%v: %v", addr, err)
+		}
+	}
+	if err := peer.broadcaster.Restore(state.Broadcaster); err != nil {
+		peer.logger.Errorf("error restoring broadcasts: %v", err)
+	}
+}
@@ -0,0 +1,237 @@
+package peer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/renproject/aw/protocol"
+	"github.com/renproject/phi"
+)
+
+// HealthStatus is the outcome of a single check in a HealthReport.
+type HealthStatus string
+
+// Outcomes of the checks in a HealthReport. Checks are skipped when the Peer
+// is not configured to need them (e.g. there are no bootstrap addresses).
+const (
+	HealthPassed  = HealthStatus("passed")
+	HealthFailed  = HealthStatus("failed")
+	HealthSkipped = HealthStatus("skipped")
+)
+
+// Names of the checks in a HealthReport.
+const (
+	HealthCheckConfig    = "config"
+	HealthCheckBind      = "bind"
+	HealthCheckHandshake = "handshake"
+	HealthCheckStore     = "store"
+	HealthCheckBootstrap = "bootstrap"
+)
+
+// HealthCheck is the result of a single check in a HealthReport.
+type HealthCheck struct {
+	Name     string        `json:"name"`
+	Status   HealthStatus  `json:"status"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+// HealthReport is returned by a Peer healthcheck. It can be marshaled to JSON
+// and served to readiness probes.
+type HealthReport struct {
+	Time   time.Time     `json:"time"`
+	Checks []HealthCheck `json:"checks"`
+}
+
+// Healthy returns true if none of the checks in the report failed.
+func (report HealthReport) Healthy() bool {
+	for _, check := range report.Checks {
+		if check.Status == HealthFailed {
+			return false
+		}
+	}
+	return true
+}
+
+// Check returns the check with the given name, and false if the report does
+// not have that check.
+func (report HealthReport) Check(name string) (HealthCheck, bool) {
+	for _, check := range report.Checks {
+		if check.Name == name {
+			return check, true
+		}
+	}
+	return HealthCheck{}, false
+}
+
+// errHealthCheckSkipped is returned by a check that does not apply to the
+// Peer.
+var errHealthCheckSkipped = errors.New("skipped")
+
+func (peer *peer) Healthcheck(ctx context.Context) HealthReport {
+	report := HealthReport{Time: time.Now()}
+	checks := []struct {
+		name  string
+		check func(context.Context) error
+	}{
+		{HealthCheckConfig, peer.checkConfig},
+		{HealthCheckBind, peer.checkBind},
+		{HealthCheckHandshake, peer.checkHandshake},
+		{HealthCheckStore, peer.checkStore},
+		{HealthCheckBootstrap, peer.checkBootstrap},
+	}
+	for _, check := range checks {
+		start := time.Now()
+		err := check.check(ctx)
+		result := HealthCheck{
+			Name:     check.name,
+			Status:   HealthPassed,
+			Duration: time.Since(start),
+		}
+		switch err {
+		case nil:
+		case errHealthCheckSkipped:
+			result.Status = HealthSkipped
+		default:
+			result.Status = HealthFailed
+			result.Error = err.Error()
+		}
+		report.Checks = append(report.Checks, result)
+	}
+	return report
+}
+
+// checkConfig validates the options of the Peer.
+func (peer *peer) checkConfig(ctx context.Context) error {
+	options := peer.options
+	return options.SetZeroToDefault()
+}
+
+// checkBind checks that the ports of the Peer are either free to be bound, or
+// already accepting connections (usually because the Peer is running).
+func (peer *peer) checkBind(ctx context.Context) error {
+	addrs := protocol.NetworkAddresses(peer.dht.Me())
+	if len(addrs) == 0 {
+		return errHealthCheckSkipped
+	}
+	for _, addr := range addrs {
+		if err := checkBindAddress(ctx, addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkBindAddress(ctx context.Context, addr net.Addr) error {
+	_, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return err
+	}
+
+	listener, err := net.Listen(addr.Network(), net.JoinHostPort("", port))
+	if err == nil {
+		return listener.Close()
+	}
+	conn, dialErr := dial(ctx, addr.Network(), net.JoinHostPort("localhost", port))
+	if dialErr != nil {
+		return fmt.Errorf("cannot bind to port=%v: %v", port, err)
+	}
+	return conn.Close()
+}
+
+// checkHandshake performs a handshake with the Peer itself, to check that its
+// SignVerifier and SessionManager are able to establish a session.
+func (peer *peer) checkHandshake(ctx context.Context) error {
+	if peer.handshaker == nil {
+		return errHealthCheckSkipped
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, peer.options.MaxPingTimeout)
+		defer cancel()
+	}
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	var clientErr, serverErr error
+	phi.ParBegin(func() {
+		_, clientErr = peer.handshaker.Handshake(ctx, clientConn)
+		if clientErr != nil {
+			clientConn.Close()
+		}
+	}, func() {
+		_, serverErr = peer.handshaker.AcceptHandshake(ctx, serverConn)
+		if serverErr != nil {
+			serverConn.Close()
+		}
+	})
+	if clientErr != nil {
+		return fmt.Errorf("error handshaking: %v", clientErr)
+	}
+	if serverErr != nil {
+		return fmt.Errorf("error accepting handshake: %v", serverErr)
+	}
+	return nil
+}
+
+// checkStore checks that the DHT, and the catch-up log (if any), can be read.
+func (peer *peer) checkStore(ctx context.Context) error {
+	if _, err := peer.dht.PeerAddresses(); err != nil {
+		return err
+	}
+	if peer.catchUpper != nil {
+		if _, err := peer.catchUpper.ReadSince(protocol.NilGroupID, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkBootstrap connects to the bootstrap addresses until one of them is
+// reachable, and pings it.
+func (peer *peer) checkBootstrap(ctx context.Context) error {
+	if len(peer.options.BootstrapAddresses) == 0 {
+		return errHealthCheckSkipped
+	}
+
+	var err error
+	for _, bootstrapAddr := range peer.options.BootstrapAddresses {
+		if bootstrapAddr.PeerID().Equal(peer.dht.Me().PeerID()) {
+			continue
+		}
+		if err = peer.checkBootstrapAddress(ctx, bootstrapAddr); err == nil {
+			return nil
+		}
+	}
+	if err == nil {
+		return errHealthCheckSkipped
+	}
+	return fmt.Errorf("no bootstrap address is reachable: %v", err)
+}
+
+func (peer *peer) checkBootstrapAddress(ctx context.Context, bootstrapAddr protocol.PeerAddress) error {
+	pingCtx, pingCancel := context.WithTimeout(ctx, peer.options.MinPingTimeout)
+	defer pingCancel()
+
+	if addr := bootstrapAddr.NetworkAddress(); addr != nil {
+		conn, err := dial(pingCtx, addr.Network(), addr.String())
+		if err != nil {
+			return fmt.Errorf("error connecting to bootstrap address=%v: %v", bootstrapAddr, err)
+		}
+		conn.Close()
+	}
+	if err := peer.pingPonger.Ping(pingCtx, bootstrapAddr.PeerID()); err != nil {
+		return fmt.Errorf("error pinging bootstrap address=%v: %v", bootstrapAddr, err)
+	}
+	return nil
+}
+
+func dial(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := net.Dialer{}
+	return dialer.DialContext(ctx, network, address)
+}
@@ -0,0 +1,101 @@
+package peer_test
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/testutil"
+
+	"github.com/renproject/aw/crypto"
+	"github.com/renproject/aw/handshake"
+	"github.com/renproject/aw/peer"
+	"github.com/renproject/aw/protocol"
+	"github.com/sirupsen/logrus"
+)
+
+var _ = Describe("Healthcheck", func() {
+	newPeer := func(me protocol.PeerAddress, bootstrapAddrs protocol.PeerAddresses, signVerifier protocol.SignVerifier) peer.Peer {
+		options := peer.Options{
+			Me:                 me,
+			BootstrapAddresses: bootstrapAddrs,
+		}
+		table := NewDHT(me, NewTable("dht"), bootstrapAddrs)
+		handshaker := handshake.New(signVerifier, handshake.NewGCMSessionManager())
+		return peer.New(options, logrus.New(), NewSimpleTCPPeerAddressCodec(), table, handshaker, mockClient(make(chan protocol.MessageOnTheWire, 128)), mockServer(nil), make(chan protocol.Event))
+	}
+
+	newSignVerifier := func() protocol.SignVerifier {
+		privKey, err := crypto.GenerateEd25519Key()
+		Expect(err).NotTo(HaveOccurred())
+		return crypto.NewEd25519SignVerifier(privKey)
+	}
+
+	Context("when the peer is healthy", func() {
+		It("should pass all checks", func() {
+			bootstrap, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+			defer bootstrap.Close()
+			_, port, err := net.SplitHostPort(bootstrap.Addr().String())
+			Expect(err).NotTo(HaveOccurred())
+			bootstrapAddr := NewSimpleTCPPeerAddress(RandomPeerID().String(), "127.0.0.1", port)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			me := NewSimpleTCPPeerAddress(RandomPeerID().String(), "127.0.0.1", "0")
+			report := newPeer(me, protocol.PeerAddresses{bootstrapAddr}, newSignVerifier()).Healthcheck(ctx)
+			Expect(report.Healthy()).Should(BeTrue())
+			for _, name := range []string{peer.HealthCheckConfig, peer.HealthCheckBind, peer.HealthCheckHandshake, peer.HealthCheckStore, peer.HealthCheckBootstrap} {
+				check, ok := report.Check(name)
+				Expect(ok).Should(BeTrue())
+				Expect(check.Status).Should(Equal(peer.HealthPassed))
+			}
+
+			data, err := json.Marshal(report)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(data)).Should(ContainSubstring(`"status":"passed"`))
+		})
+
+		It("should skip the bootstrap check without bootstrap addresses", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			me := NewSimpleTCPPeerAddress(RandomPeerID().String(), "127.0.0.1", "0")
+			report := newPeer(me, nil, newSignVerifier()).Healthcheck(ctx)
+			Expect(report.Healthy()).Should(BeTrue())
+			check, ok := report.Check(peer.HealthCheckBootstrap)
+			Expect(ok).Should(BeTrue())
+			Expect(check.Status).Should(Equal(peer.HealthSkipped))
+		})
+	})
+
+	Context("when the peer is not healthy", func() {
+		It("should fail the checks that do not pass", func() {
+			// Find a port that nothing is listening on
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+			_, port, err := net.SplitHostPort(listener.Addr().String())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(listener.Close()).To(Succeed())
+			bootstrapAddr := NewSimpleTCPPeerAddress(RandomPeerID().String(), "127.0.0.1", port)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			me := NewSimpleTCPPeerAddress(RandomPeerID().String(), "127.0.0.1", "0")
+
+			// The mock SignVerifier does not authenticate peers that are not
+			// whitelisted, including itself
+			report := newPeer(me, protocol.PeerAddresses{bootstrapAddr}, NewMockSignVerifier()).Healthcheck(ctx)
+			Expect(report.Healthy()).Should(BeFalse())
+			check, ok := report.Check(peer.HealthCheckHandshake)
+			Expect(ok).Should(BeTrue())
+			Expect(check.Status).Should(Equal(peer.HealthFailed))
+			Expect(check.Error).ShouldNot(BeEmpty())
+			check, ok = report.Check(peer.HealthCheckBootstrap)
+			Expect(ok).Should(BeTrue())
+			Expect(check.Status).Should(Equal(peer.HealthFailed))
+		})
+	})
+})
@@ -0,0 +1,85 @@
+package peer
+
+import (
+	"context"
+	"time"
+
+	"github.com/renproject/aw/protocol"
+)
+
+// activateGroup starts tracking the activity of the group, if idle groups are
+// removed. Adding a group counts as activity.
+func (peer *peer) activateGroup(groupID protocol.GroupID) {
+	if peer.options.GroupIdleTimeout <= 0 {
+		return
+	}
+
+	peer.groupActivityMu.Lock()
+	defer peer.groupActivityMu.Unlock()
+
+	peer.groupActivity[groupID] = time.Now()
+}
+
+func (peer *peer) deactivateGroup(groupID protocol.GroupID) {
+	peer.groupActivityMu.Lock()
+	defer peer.groupActivityMu.Unlock()
+
+	delete(peer.groupActivity, groupID)
+}
+
+// touchGroup records that a message was broadcast, or multicast, to the group.
+// Groups that are not tracked are ignored.
+func (peer *peer) touchGroup(groupID protocol.GroupID) {
+	if peer.options.GroupIdleTimeout <= 0 || groupID.Equal(protocol.NilGroupID) {
+		return
+	}
+
+	peer.groupActivityMu.Lock()
+	defer peer.groupActivityMu.Unlock()
+
+	if _, ok := peer.groupActivity[groupID]; ok {
+		peer.groupActivity[groupID] = time.Now()
+	}
+}
+
+func (peer *peer) PinGroup(groupID protocol.GroupID, pinned bool) {
+	peer.groupActivityMu.Lock()
+	defer peer.groupActivityMu.Unlock()
+
+	if pinned {
+		peer.pinnedGroups[groupID] = struct{}{}
+		return
+	}
+	delete(peer.pinnedGroups, groupID)
+}
+
+// expireGroups removes the groups that have not been active for the
+// GroupIdleTimeout, unless they are pinned, and emits an event for each of
+// them. Groups are removed while holding the lock, so that a group that is
+// added again at the same time is not removed.
+func (peer *peer) expireGroups(ctx context.Context, now time.Time) {
+	peer.groupActivityMu.Lock()
+	events := []protocol.EventGroupExpired{}
+	for groupID, lastActive := range peer.groupActivity {
+		if _, ok := peer.pinnedGroups[groupID]; ok || now.Sub(lastActive) < peer.options.GroupIdleTimeout {
+			continue
+		}
+		delete(peer.groupActivity, groupID)
+		peer.removeGroup(groupID)
+		events = append(events, protocol.EventGroupExpired{
+			Time:       now,
+			GroupID:    groupID,
+			LastActive: lastActive,
+		})
+	}
+	peer.groupActivityMu.Unlock()
+
+	for _, event := range events {
+		peer.logger.Infof("group=%v expired: idle since %v", event.GroupID, event.LastActive)
+		select {
+		case <-ctx.Done():
+			return
+		case peer.events <- event:
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package peer_test
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/testutil"
+
+	"github.com/renproject/aw/peer"
+	"github.com/renproject/aw/protocol"
+	"github.com/sirupsen/logrus"
+)
+
+var _ = Describe("Idle groups", func() {
+	newExpiringPeer := func() (peer.Peer, chan protocol.MessageOnTheWire, chan protocol.Event) {
+		me := RandomAddress()
+		received := make(chan protocol.MessageOnTheWire, 128)
+		events := make(chan protocol.Event, 128)
+		options := peer.Options{
+			Me:               me,
+			GroupIdleTimeout: 200 * time.Millisecond,
+		}
+		p := peer.New(options, logrus.New(), NewSimpleTCPPeerAddressCodec(), NewDHT(me, NewTable("dht"), nil), nil, mockClient(make(chan protocol.MessageOnTheWire, 128)), mockServer(received), events)
+		return p, received, events
+	}
+
+	// expiredGroups returns a function that returns the groups that have
+	// expired so far.
+	expiredGroups := func(events chan protocol.Event) func() []protocol.GroupID {
+		expired := []protocol.GroupID{}
+		return func() []protocol.GroupID {
+			for {
+				select {
+				case event := <-events:
+					if event, ok := event.(protocol.EventGroupExpired); ok {
+						expired = append(expired, event.GroupID)
+					}
+				default:
+					return expired
+				}
+			}
+		}
+	}
+
+	Context("when groups are idle", func() {
+		It("should remove them, unless they are pinned or active", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			p, received, events := newExpiringPeer()
+			idle, pinned, active := RandomGroupID(), RandomGroupID(), RandomGroupID()
+			for _, groupID := range []protocol.GroupID{idle, pinned, active} {
+				Expect(p.AddGroup(groupID, RandomPeerIDs())).To(Succeed())
+			}
+			p.PinGroup(pinned, true)
+			go p.Run(ctx)
+
+			// Keep one group active with broadcasts from other peers
+			go func() {
+				ticker := time.NewTicker(50 * time.Millisecond)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-ctx.Done():
+						return
+					case <-ticker.C:
+						message := protocol.NewMessage(protocol.V1, protocol.Broadcast, active, RandomMessageBody())
+						select {
+						case <-ctx.Done():
+							return
+						case received <- protocol.MessageOnTheWire{From: RandomPeerID(), Message: message}:
+						}
+					}
+				}
+			}()
+
+			expired := expiredGroups(events)
+			Eventually(expired, time.Second).Should(ConsistOf([]protocol.GroupID{idle}))
+			Consistently(expired, 500*time.Millisecond).Should(ConsistOf([]protocol.GroupID{idle}))
+			_, err := p.GroupIDs(idle)
+			Expect(err).To(HaveOccurred())
+			_, err = p.GroupIDs(pinned)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = p.GroupIDs(active)
+			Expect(err).NotTo(HaveOccurred())
+
+			// Unpinned groups expire
+			p.PinGroup(pinned, false)
+			Eventually(expired, time.Second).Should(ConsistOf([]protocol.GroupID{idle, pinned}))
+		})
+	})
+})
@@ -0,0 +1,155 @@
+package peer
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/renproject/aw/protocol"
+)
+
+// powerMode is whether the Peer is in low-power mode. The goroutines of the
+// Peer that depend on it are notified when it changes.
+type powerMode struct {
+	lowPower int32
+
+	// Notifications for the Run loop, and for batchOutbound
+	bootstrapChanged chan struct{}
+	batchChanged     chan struct{}
+}
+
+func newPowerMode(lowPower bool) *powerMode {
+	mode := &powerMode{
+		bootstrapChanged: make(chan struct{}, 1),
+		batchChanged:     make(chan struct{}, 1),
+	}
+	if lowPower {
+		mode.lowPower = 1
+	}
+	return mode
+}
+
+// set the mode, and notify the goroutines that depend on it. It returns false
+// if the mode did not change.
+func (mode *powerMode) set(lowPower bool) bool {
+	value := int32(0)
+	if lowPower {
+		value = 1
+	}
+	if atomic.SwapInt32(&mode.lowPower, value) == value {
+		return false
+	}
+	notify(mode.bootstrapChanged)
+	notify(mode.batchChanged)
+	return true
+}
+
+func (mode *powerMode) get() bool {
+	return atomic.LoadInt32(&mode.lowPower) == 1
+}
+
+// notify the goroutine waiting on the channel, without blocking. Notifications
+// are coalesced until they are received.
+func notify(ch chan<- struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// SetLowPower enables, or disables, the low-power mode of the Peer.
+// Applications call it when they move to the background, and when they return
+// to the foreground, so that the Peer saves battery and bandwidth in between
+// (see Options.LowPower). When low-power mode is disabled, the messages that
+// are waiting to be sent are sent, and peers are pinged, straight away.
+func (peer *peer) SetLowPower(lowPower bool) {
+	if !peer.power.set(lowPower) {
+		return
+	}
+	peer.broadcaster.PauseRelaying(lowPower)
+	peer.logger.Infof("low-power mode: %v", lowPower)
+}
+
+func (peer *peer) LowPower() bool {
+	return peer.power.get()
+}
+
+// bootstrapDuration returns the time between bootstrapping in the current
+// power mode.
+func (peer *peer) bootstrapDuration() time.Duration {
+	if peer.power.get() {
+		return peer.options.LowPowerBootstrapDuration
+	}
+	return peer.options.BootstrapDuration
+}
+
+// batchOutbound forwards the messages sent by the messengers to the client. In
+// low-power mode, messages are held back, and sent together once the first of
+// them has been held for the LowPowerBatchInterval, so that the radio of a
+// mobile device is idle between batches. Held messages are also sent when
+// Capacity messages are held, and when low-power mode is disabled.
+func (peer *peer) batchOutbound(ctx context.Context, messages protocol.MessageReceiver, outbound protocol.MessageSender) {
+	batch := make([]protocol.MessageOnTheWire, 0, peer.options.Capacity)
+	var timer *time.Timer
+	var flushes <-chan time.Time
+
+	send := func(messageOtw protocol.MessageOnTheWire) bool {
+		select {
+		case <-ctx.Done():
+			return false
+		case outbound <- messageOtw:
+			return true
+		}
+	}
+	flush := func() bool {
+		if timer != nil {
+			timer.Stop()
+			timer, flushes = nil, nil
+		}
+		for i, messageOtw := range batch {
+			if !send(messageOtw) {
+				return false
+			}
+			batch[i] = protocol.MessageOnTheWire{}
+		}
+		batch = batch[:0]
+		return true
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-peer.power.batchChanged:
+			if !peer.power.get() && !flush() {
+				return
+			}
+
+		case <-flushes:
+			timer, flushes = nil, nil
+			if !flush() {
+				return
+			}
+
+		case messageOtw := <-messages:
+			if !peer.power.get() {
+				if !flush() || !send(messageOtw) {
+					return
+				}
+				continue
+			}
+			batch = append(batch, messageOtw)
+			if len(batch) >= peer.options.Capacity {
+				if !flush() {
+					return
+				}
+				continue
+			}
+			if timer == nil {
+				timer = time.NewTimer(peer.options.LowPowerBatchInterval)
+				flushes = timer.C
+			}
+		}
+	}
+}
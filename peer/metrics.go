@@ -0,0 +1,72 @@
+package peer
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/renproject/aw/protocol"
+)
+
+// registerGauges of the DHT, the connections, the backlogs of the channels and
+// the outbound queue of the peer with its Metrics, so that they are read
+// whenever the metrics are gathered.
+func (peer *peer) registerGauges() {
+	gauges := []struct {
+		name   string
+		help   string
+		labels prometheus.Labels
+		value  func() float64
+	}{
+		{"dht_peers", "Peers in the DHT.", nil, func() float64 {
+			n, err := peer.dht.NumPeers()
+			if err != nil {
+				return 0
+			}
+			return float64(n)
+		}},
+		{"connections", "Live connections, by direction.", prometheus.Labels{"direction": "inbound"}, func() float64 {
+			return float64(peer.numConns(false))
+		}},
+		{"connections", "Live connections, by direction.", prometheus.Labels{"direction": "outbound"}, func() float64 {
+			return float64(peer.numConns(true))
+		}},
+		{"backlog", "Messages, or events, waiting in a channel, by channel.", prometheus.Labels{"channel": "server"}, func() float64 {
+			return float64(len(peer.serverMessages))
+		}},
+		{"backlog", "Messages, or events, waiting in a channel, by channel.", prometheus.Labels{"channel": "client"}, func() float64 {
+			return float64(len(peer.clientMessages))
+		}},
+		{"backlog", "Messages, or events, waiting in a channel, by channel.", prometheus.Labels{"channel": "events"}, func() float64 {
+			return float64(len(peer.events))
+		}},
+	}
+	for _, gauge := range gauges {
+		if err := peer.options.Metrics.Gauge(gauge.name, gauge.help, gauge.labels, gauge.value); err != nil {
+			peer.logger.Errorf("error registering %v metric: %v", gauge.name, err)
+		}
+	}
+
+	// The outbound queue has a backlog, and drops messages, in every lane
+	for _, priority := range []protocol.MessagePriority{protocol.PriorityHigh, protocol.PriorityNormal, protocol.PriorityLow} {
+		priority := priority
+		if err := peer.options.Metrics.Gauge("backlog", "Messages, or events, waiting in a channel, by channel.", prometheus.Labels{"channel": "outbound_" + priority.String()}, func() float64 {
+			return float64(peer.outboundQueue.Len(priority))
+		}); err != nil {
+			peer.logger.Errorf("error registering backlog metric: %v", err)
+		}
+		if err := peer.options.Metrics.Counter("outbound_dropped_total", "Messages dropped by the outbound queue, by priority.", prometheus.Labels{"priority": priority.String()}, func() float64 {
+			return float64(peer.outboundQueue.Stats().Dropped[priority])
+		}); err != nil {
+			peer.logger.Errorf("error registering outbound_dropped_total metric: %v", err)
+		}
+	}
+}
+
+// numConns returns the number of live connections in the direction.
+func (peer *peer) numConns(outbound bool) int {
+	n := 0
+	for _, conn := range peer.Conns() {
+		if conn.Outbound == outbound {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,135 @@
+package peer
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/renproject/aw/broadcast"
+	"github.com/renproject/aw/protocol"
+)
+
+// maxNackPeers is the number of peers that the times of the last Nacks are
+// kept for, before the times that are older than the NackInterval are pruned.
+const maxNackPeers = 4096
+
+// errRejected is returned when the peer rejects a message for a reason that
+// is not described by the type of the error.
+type errRejected struct {
+	error
+	reason protocol.RejectReason
+}
+
+func newErrRejected(reason protocol.RejectReason, err error) error {
+	return errRejected{error: err, reason: reason}
+}
+
+// rejectReason returns the reason why the message was rejected with the error,
+// and false if the error does not mean that the message was rejected (e.g. the
+// context was done before the message was handled).
+func rejectReason(err error) (protocol.RejectReason, bool) {
+	switch err := err.(type) {
+	case errRejected:
+		return err.reason, true
+	case broadcast.ErrGroupRateLimited:
+		return protocol.RejectedOverloaded, true
+	case protocol.ErrMessageVersionIsNotSupported:
+		return protocol.RejectedVersion, true
+	case protocol.ErrMessageVariantIsNotSupported:
+		return protocol.RejectedVariant, true
+	case protocol.ErrMessageLengthIsTooLow, protocol.ErrHasherIsNotSupported, protocol.ErrNonCanonicalMessage:
+		return protocol.RejectedInvalid, true
+	default:
+		return 0, false
+	}
+}
+
+// nackLimiter limits the Nacks sent to each peer to one every interval, so
+// that peers cannot turn the messages that are rejected into a flood of Nacks.
+type nackLimiter struct {
+	mu       *sync.Mutex
+	interval time.Duration
+	sent     map[string]time.Time
+}
+
+func newNackLimiter(interval time.Duration) *nackLimiter {
+	return &nackLimiter{
+		mu:       new(sync.Mutex),
+		interval: interval,
+		sent:     map[string]time.Time{},
+	}
+}
+
+// allow returns true, and records the Nack, if a Nack can be sent to the peer.
+func (limiter *nackLimiter) allow(peerID protocol.PeerID, now time.Time) bool {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	key := peerID.String()
+	if sent, ok := limiter.sent[key]; ok && now.Sub(sent) < limiter.interval {
+		return false
+	}
+	if len(limiter.sent) >= maxNackPeers {
+		for k, sent := range limiter.sent {
+			if now.Sub(sent) >= limiter.interval {
+				delete(limiter.sent, k)
+			}
+		}
+		if len(limiter.sent) >= maxNackPeers {
+			return false
+		}
+	}
+	limiter.sent[key] = now
+	return true
+}
+
+// reject the message by sending a Nack to the peer that sent it, if the peer
+// sends Nacks, and the NackInterval since the last Nack to the peer has
+// passed. Nacks are never sent in response to Nacks, and are dropped when the
+// address of the peer is unknown, or the client is busy.
+func (peer *peer) reject(messageOtw protocol.MessageOnTheWire, reason protocol.RejectReason) {
+	if !peer.options.SendNacks || messageOtw.From == nil || messageOtw.Message.Variant == protocol.Nack {
+		return
+	}
+	to, err := peer.dht.PeerAddress(messageOtw.From)
+	if err != nil || to == nil {
+		return
+	}
+	if !peer.nacks.allow(messageOtw.From, time.Now()) {
+		return
+	}
+	nack := protocol.MessageOnTheWire{
+		To:      to,
+		Message: protocol.NewNack(messageOtw.Message, reason),
+	}
+	select {
+	case peer.clientMessages <- nack:
+	default:
+		peer.logger.Debugf("dropping nack to peer=%v: client is busy", messageOtw.From)
+	}
+}
+
+// acceptNack from another peer, and emit it as an EventMessageRejected.
+func (peer *peer) acceptNack(ctx context.Context, from protocol.PeerID, message protocol.Message) error {
+	if message.Version != protocol.V1 {
+		return protocol.NewErrMessageVersionIsNotSupported(message.Version)
+	}
+	body := protocol.NackBody{}
+	if err := body.UnmarshalBinary(message.Body); err != nil {
+		return fmt.Errorf("error decoding nack from peer=%v: %v", from, err)
+	}
+	event := protocol.EventMessageRejected{
+		Time:    time.Now(),
+		From:    from,
+		Variant: body.Variant,
+		Hash:    body.Hash,
+		Reason:  body.Reason,
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case peer.events <- event:
+		return nil
+	}
+}
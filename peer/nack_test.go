@@ -0,0 +1,125 @@
+package peer_test
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/testutil"
+
+	"github.com/renproject/aw/peer"
+	"github.com/renproject/aw/protocol"
+	"github.com/sirupsen/logrus"
+)
+
+var _ = Describe("Nacks", func() {
+	newPeer := func(sendNacks bool) (peer.Peer, protocol.PeerAddress, chan protocol.MessageOnTheWire, chan protocol.MessageOnTheWire, chan protocol.Event) {
+		me := RandomAddress()
+		dht := NewDHT(me, NewTable("dht"), nil)
+		from := RandomAddress()
+		Expect(dht.AddPeerAddress(from)).To(Succeed())
+
+		sent := make(chan protocol.MessageOnTheWire, 128)
+		received := make(chan protocol.MessageOnTheWire, 128)
+		events := make(chan protocol.Event, 128)
+		options := peer.Options{
+			Me:                   me,
+			DisablePeerDiscovery: true,
+			SendNacks:            sendNacks,
+			NackInterval:         time.Hour,
+		}
+		p := peer.New(options, logrus.New(), NewSimpleTCPPeerAddressCodec(), dht, nil, mockClient(sent), mockServer(received), events)
+		return p, from, sent, received, events
+	}
+
+	nacks := func(sent chan protocol.MessageOnTheWire) chan protocol.MessageOnTheWire {
+		filtered := make(chan protocol.MessageOnTheWire, 128)
+		go func() {
+			for messageOtw := range sent {
+				if messageOtw.Message.Variant == protocol.Nack {
+					filtered <- messageOtw
+				}
+			}
+		}()
+		return filtered
+	}
+
+	Context("when the peer sends nacks", func() {
+		It("should respond to rejected messages with a nack, at most once every nack interval", func() {
+			p, from, sent, received, _ := newPeer(true)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go p.Run(ctx)
+			sentNacks := nacks(sent)
+
+			ping := protocol.NewMessage(protocol.V1, protocol.Ping, protocol.NilGroupID, RandomMessageBody())
+			ping.Version = protocol.V2
+			ping.Hasher = protocol.BLAKE3
+			received <- protocol.MessageOnTheWire{From: from.PeerID(), Message: ping}
+
+			var nack protocol.MessageOnTheWire
+			Eventually(sentNacks).Should(Receive(&nack))
+			Expect(nack.To.Equal(from)).To(BeTrue())
+			body := protocol.NackBody{}
+			Expect(body.UnmarshalBinary(nack.Message.Body)).To(Succeed())
+			Expect(body.Reason).To(Equal(protocol.RejectedVersion))
+			Expect(body.Variant).To(Equal(protocol.Ping))
+			Expect(body.Hash).To(Equal(ping.Hash()))
+
+			received <- protocol.MessageOnTheWire{From: from.PeerID(), Message: ping}
+			Consistently(sentNacks).ShouldNot(Receive())
+		})
+
+		It("should not respond to nacks with nacks", func() {
+			p, from, sent, received, _ := newPeer(true)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go p.Run(ctx)
+			sentNacks := nacks(sent)
+
+			nack := protocol.NewNack(protocol.NewMessage(protocol.V1, protocol.Cast, protocol.NilGroupID, RandomMessageBody()), protocol.RejectedInvalid)
+			nack.Body = nack.Body[:10]
+			nack.Length = protocol.MessageLength(nack.Variant.NonBodyLength() + len(nack.Body))
+			received <- protocol.MessageOnTheWire{From: from.PeerID(), Message: nack}
+			Consistently(sentNacks).ShouldNot(Receive())
+		})
+	})
+
+	Context("when the peer does not send nacks", func() {
+		It("should drop rejected messages silently", func() {
+			p, from, sent, received, _ := newPeer(false)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go p.Run(ctx)
+			sentNacks := nacks(sent)
+
+			ping := protocol.NewMessage(protocol.V1, protocol.Ping, protocol.NilGroupID, RandomMessageBody())
+			ping.Version = protocol.V2
+			ping.Hasher = protocol.BLAKE3
+			received <- protocol.MessageOnTheWire{From: from.PeerID(), Message: ping}
+			Consistently(sentNacks).ShouldNot(Receive())
+		})
+	})
+
+	Context("when the peer receives a nack", func() {
+		It("should emit the rejection", func() {
+			p, from, _, received, events := newPeer(false)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go p.Run(ctx)
+
+			cast := protocol.NewMessage(protocol.V1, protocol.Cast, protocol.NilGroupID, RandomMessageBody())
+			received <- protocol.MessageOnTheWire{From: from.PeerID(), Message: protocol.NewNack(cast, protocol.RejectedOverloaded)}
+
+			var event protocol.Event
+			Eventually(events).Should(Receive(&event))
+			rejected, ok := event.(protocol.EventMessageRejected)
+			Expect(ok).To(BeTrue())
+			Expect(rejected.From.Equal(from.PeerID())).To(BeTrue())
+			Expect(rejected.Variant).To(Equal(protocol.Cast))
+			Expect(rejected.Hash).To(Equal(cast.Hash()))
+			Expect(rejected.Reason).To(Equal(protocol.RejectedOverloaded))
+		})
+	})
+})
@@ -2,10 +2,24 @@ package peer
 
 import (
 	"fmt"
+	"net"
 	"runtime"
 	"time"
 
+	"github.com/renproject/aw/ban"
+	"github.com/renproject/aw/broadcast"
+	"github.com/renproject/aw/budget"
+	"github.com/renproject/aw/capture"
+	"github.com/renproject/aw/handoff"
+	"github.com/renproject/aw/handshake"
+	"github.com/renproject/aw/metrics"
+	"github.com/renproject/aw/nat"
 	"github.com/renproject/aw/protocol"
+	"github.com/renproject/aw/resolver"
+	"github.com/renproject/aw/schedule"
+	"github.com/renproject/aw/value"
+	"github.com/renproject/kv"
+	"github.com/sirupsen/logrus"
 )
 
 type Options struct {
@@ -20,6 +34,407 @@ type Options struct {
 	BootstrapDuration    time.Duration `json:"bootstrapDuration"`    // Defaults to 1 hour
 	MinPingTimeout       time.Duration `json:"minPingTimeout"`       // Defaults to 1 second
 	MaxPingTimeout       time.Duration `json:"maxPingTimeout"`       // Defaults to 30 seconds
+
+	// BootstrapFailureThreshold is the number of consecutive failed attempts
+	// to reach a bootstrap address after which it is unhealthy. Unhealthy
+	// bootstrap addresses are pinged after all other peers.
+	BootstrapFailureThreshold int `json:"bootstrapFailureThreshold"` // Defaults to 3
+
+	AsyncBroadcastPropagation bool `json:"asyncBroadcastPropagation"` // Re-broadcast accepted messages in the background
+	EnableCatchUp             bool `json:"enableCatchUp"`             // Retain group broadcasts for members that were offline
+
+	// MaxPeersPerSubnet limits the number of peers from the same subnet that
+	// are learnt from other peers, and that are chosen together as gossip
+	// targets, to make it harder for an attacker that controls a subnet to
+	// eclipse the peer. It is not enforced unless it is positive.
+	MaxPeersPerSubnet int `json:"maxPeersPerSubnet"`
+
+	// BucketSize limits the number of peers learnt from other peers in each
+	// of the k-buckets of the DHT, and PreferClosePeers makes the random peers
+	// that pings are propagated to prefer the peers that are closest to the
+	// peer (see dht.Options).
+	BucketSize       int  `json:"bucketSize"`
+	PreferClosePeers bool `json:"preferClosePeers"`
+
+	// QueryPeers makes the peer ask its bootstrap peers for a batch of the
+	// addresses of the peers that they know every time it bootstraps, so that
+	// it can join the network from a single bootstrap peer (see
+	// discovery.Discoverer). Queries from other peers are always answered.
+	QueryPeers          bool `json:"queryPeers"`
+	QueryPeersBatchSize int  `json:"queryPeersBatchSize"` // Defaults to 32
+
+	// OrderedBroadcasts makes the peer emit broadcasts from the same origin to
+	// the same group in the order they were broadcast. Missing broadcasts are
+	// waited for during the OrderWindow. It must be enabled by all peers in
+	// the network.
+	OrderedBroadcasts bool          `json:"orderedBroadcasts"`
+	OrderWindow       time.Duration `json:"orderWindow"` // Defaults to 1 second
+
+	// ReliableBroadcasts makes the peer acknowledge the broadcasts it accepts,
+	// and resend its broadcasts to the peers that have not acknowledged them.
+	// A protocol.EventBroadcastAcked is emitted whenever the fraction of peers
+	// that acknowledged a broadcast crosses one of the BroadcastAckThresholds
+	// (see broadcast.Options). It must be enabled by all peers in the network.
+	ReliableBroadcasts     bool      `json:"reliableBroadcasts"`
+	BroadcastAckThresholds []float64 `json:"broadcastAckThresholds"` // Defaults to 50% and 100%
+
+	// BroadcastDeadlineSkew tolerates the clocks of other peers being ahead
+	// when checking the deadlines of the broadcasts accepted from them, and
+	// deadlines further than the BroadcastMaxDeadline in the future are
+	// rejected, or clamped, by the BroadcastDeadlinePolicy (see
+	// broadcast.Options).
+	BroadcastDeadlineSkew   time.Duration            `json:"broadcastDeadlineSkew"`
+	BroadcastMaxDeadline    time.Duration            `json:"broadcastMaxDeadline"`
+	BroadcastDeadlinePolicy broadcast.DeadlinePolicy `json:"broadcastDeadlinePolicy"` // Defaults to rejecting them
+
+	// BroadcastStrategy decides to which members of a group the peer sends,
+	// and relays, broadcasts (see broadcast.Strategy). Defaults to flooding
+	// all members. The later rounds of a strategy are sent every
+	// BroadcastRoundInterval.
+	BroadcastStrategy      broadcast.Strategy `json:"-"`
+	BroadcastRoundInterval time.Duration      `json:"broadcastRoundInterval"`
+
+	// BroadcastGroupLimits limit the rate at which the peer accepts new
+	// broadcasts to each group, and BroadcastGroupLimit limits the groups that
+	// are not in them (see broadcast.Options). Broadcasts that are shed are
+	// rejected as protocol.RejectedOverloaded when the peer SendNacks, and are
+	// counted by ShedBroadcasts.
+	BroadcastGroupLimits map[protocol.GroupID]broadcast.GroupLimit `json:"-"`
+	BroadcastGroupLimit  broadcast.GroupLimit                      `json:"broadcastGroupLimit"`
+
+	// ClockSync makes the peer estimate the offset of its clock from the
+	// clocks of other peers using its pings and their pongs (see
+	// pingpong.Clock), and check the deadlines of broadcasts using the
+	// corrected clock. It must be enabled by all peers in the network.
+	ClockSync bool `json:"clockSync"`
+
+	// SendNacks makes the peer respond to the messages it rejects (e.g.
+	// because their version is not supported, or because they were shed) with
+	// a protocol.Nack that carries the reason, so that senders can adapt. At
+	// most one Nack is sent to a peer every NackInterval, and Nacks are never
+	// sent in response to Nacks. Nacks that are received are always emitted as
+	// a protocol.EventMessageRejected.
+	SendNacks    bool          `json:"sendNacks"`
+	NackInterval time.Duration `json:"nackInterval"` // Defaults to 1 second
+
+	// HandlerTimeouts are the longest times that messages of each variant are
+	// handled for (e.g. 50 milliseconds for pings, and 1 second for
+	// broadcasts), so that one slow handler cannot back up the messages
+	// waiting to be handled. Handlers that time out are cancelled by their
+	// context, and counted in the Stats of the peer that sent the message.
+	// Variants without a timeout are handled for as long as they take.
+	HandlerTimeouts map[protocol.MessageVariant]time.Duration `json:"handlerTimeouts"`
+
+	// LookUpMissingAddresses makes the peer look up the addresses of the peers
+	// that are not in the DHT when it casts or broadcasts to them, instead of
+	// skipping them (see cast.Options and broadcast.Options). Lookups are
+	// bounded by the context of the cast or broadcast.
+	LookUpMissingAddresses bool `json:"lookUpMissingAddresses"`
+
+	// FilterSelf makes the peer drop the messages that it would send to
+	// itself: broadcasts to groups that it is a member of, and pings
+	// propagated to its own address (see broadcast.Options and
+	// pingpong.Options). Peers created with NewTCP also drop any other
+	// messages addressed to themselves, instead of dialing their own server
+	// (see tcp.ClientOptions). LoopbackCasts makes casts from the peer to itself
+	// emit an event straight away (see cast.Options), so that they are not
+	// dropped by FilterSelf.
+	FilterSelf    bool `json:"filterSelf"`
+	LoopbackCasts bool `json:"loopbackCasts"`
+
+	// SendRetries and SendRetryBackoff configure how many times peers created
+	// with NewTCP retry a message that cannot be sent to any of the addresses
+	// of its recipient, and how long they initially back off between retries
+	// (see tcp.ClientOptions). Messages that are still not sent are dropped,
+	// and emitted as a protocol.EventMessageDropped.
+	SendRetries      int           `json:"sendRetries"`
+	SendRetryBackoff time.Duration `json:"sendRetryBackoff"`
+
+	// RelayPolicy is optional. When set, broadcasts accepted from other peers
+	// are bridged into the groups it returns (see broadcast.RelayPolicy), so
+	// that peers in many groups can mirror one group into another.
+	RelayPolicy broadcast.RelayPolicy `json:"-"`
+
+	// OutboundHooks are optional. They are applied in order to every message
+	// sent by the peer before it reaches the client (see
+	// protocol.OutboundHook), so that gateways can rewrite messages for
+	// specific destinations without forking the pipeline.
+	OutboundHooks []protocol.OutboundHook `json:"-"`
+
+	// OutboundQueueCapacity is the capacity of every lane of the queue of
+	// messages that are waiting to be sent by the client (see
+	// protocol.MessageQueue), so that pings and pongs are sent before casts,
+	// and casts before gossip, when the client is slow. Lanes of pings, pongs
+	// and casts that are full drop messages according to the
+	// OutboundDropPolicy, and the lane of gossip according to the
+	// OutboundGossipDropPolicy. A protocol.EventMessageDropped is emitted for
+	// every dropped message.
+	OutboundQueueCapacity    int                 `json:"outboundQueueCapacity"`    // Defaults to the Capacity
+	OutboundDropPolicy       protocol.DropPolicy `json:"outboundDropPolicy"`       // Defaults to blocking until there is room
+	OutboundGossipDropPolicy protocol.DropPolicy `json:"outboundGossipDropPolicy"` // Defaults to dropping the oldest message
+
+	// RequireAuthenticatedOrigins makes the peer reject the messages that rely
+	// on the peer that sent them (e.g. casts and pings) unless they were read
+	// from a connection that was authenticated by a handshake (see
+	// protocol.MessageOnTheWire). It is used when the peer runs Servers that
+	// cannot verify the identity of remote peers.
+	RequireAuthenticatedOrigins bool `json:"requireAuthenticatedOrigins"`
+
+	// RelayOnly peers relay broadcasts and answer pings, but never originate
+	// messages or emit events to the application. They are used to deploy
+	// dedicated relay infrastructure, and must discover peers to be useful.
+	RelayOnly bool `json:"relayOnly"`
+
+	// Observer peers are light clients that only keep the addresses of the
+	// bootstrap peers and of the members of the groups they join, in memory.
+	// Instead of relying on being part of the routing table, they pull the
+	// broadcasts of the groups they join from the other members every
+	// CatchUpInterval.
+	Observer        bool          `json:"observer"`
+	CatchUpInterval time.Duration `json:"catchUpInterval"` // Defaults to 1 minute
+
+	// LowPower starts the peer in low-power mode, which is intended for peers
+	// in mobile applications (e.g. built with gomobile) while they are in the
+	// background (see Peer.SetLowPower). In low-power mode, peers are pinged
+	// every LowPowerBootstrapDuration, broadcasts accepted from other peers
+	// are not relayed, and messages are sent in batches at most
+	// LowPowerBatchInterval after they are sent by the application.
+	LowPower                  bool          `json:"lowPower"`
+	LowPowerBootstrapDuration time.Duration `json:"lowPowerBootstrapDuration"` // Defaults to 4x the BootstrapDuration
+	LowPowerBatchInterval     time.Duration `json:"lowPowerBatchInterval"`     // Defaults to 30 seconds
+
+	// GroupRepairInterval enables the repair of groups when it is positive.
+	// Every GroupRepairInterval, the members of the groups added to the peer
+	// that have not been seen since the last repair are pinged. When the
+	// fraction of members that have been seen within the
+	// GroupReachabilityWindow falls below the GroupReachabilityThreshold, a
+	// protocol.EventGroupDegraded is emitted, and the peer re-bootstraps and
+	// looks up the members it has no address for, until a
+	// protocol.EventGroupRepaired is emitted.
+	GroupRepairInterval        time.Duration `json:"groupRepairInterval"`
+	GroupReachabilityWindow    time.Duration `json:"groupReachabilityWindow"`    // Defaults to 3x the GroupRepairInterval
+	GroupReachabilityThreshold float64       `json:"groupReachabilityThreshold"` // Defaults to 50%
+
+	// GroupIdleTimeout enables the removal of idle groups when it is
+	// positive. Groups added to the peer that have not been broadcast, or
+	// multicast, to by any peer for the GroupIdleTimeout are removed (see
+	// RemoveGroup), and a protocol.EventGroupExpired is emitted, so that
+	// applications that churn many short-lived groups do not have to remove
+	// them. Groups that are pinned (see PinGroup) are never removed.
+	GroupIdleTimeout time.Duration `json:"groupIdleTimeout"`
+
+	// PeerStaleWindow enables the removal of stale peers when it is positive.
+	// Peers that no message (including pongs) has been received from within
+	// the PeerStaleWindow are removed from the DHT, so that they are no longer
+	// dialed. Peers are pinged every BootstrapDuration, so it should be
+	// several times longer than the BootstrapDuration. Bootstrap peers are
+	// never removed.
+	PeerStaleWindow time.Duration `json:"peerStaleWindow"`
+
+	// PiggybackAddresses is the number of recently seen PeerAddresses that
+	// are piggybacked onto pongs, and onto the acknowledgements of reliable
+	// broadcasts, so that fresh addresses are disseminated without relying on
+	// the propagation of pings alone. It must be set by all peers in the
+	// network, and is capped at protocol.MaxPiggybackedAddresses.
+	PiggybackAddresses int `json:"piggybackAddresses"`
+
+	Hasher protocol.Hasher `json:"hasher"` // Hasher used to identify broadcasts, defaults to SHA256
+
+	// ProbeAddress is the address on which the /healthz and /readyz HTTP
+	// probes, and the health of the bootstrap addresses at /bootstrap, are
+	// served while the peer is running. Probes are not served if it is empty.
+	ProbeAddress    string        `json:"probeAddress"`
+	ReadyMinPeers   int           `json:"readyMinPeers"`   // Minimum number of peers to be ready, defaults to 0
+	LivenessTimeout time.Duration `json:"livenessTimeout"` // Defaults to 10 seconds
+
+	// AdminAddress is the address on which the admin APIs are served while
+	// the peer is running, starting with the API of the connections at
+	// /conns (see NewConnsHandler). The admin APIs are not served if it is
+	// empty. When the AdminToken is empty, they are only served to loopback
+	// addresses. Otherwise, requests must have the AdminToken as a bearer
+	// token (see NewAdminHandler).
+	AdminAddress string `json:"adminAddress"`
+	AdminToken   string `json:"-"`
+
+	// Bans is optional. When set, it is served as an admin API at /bans on
+	// the AdminAddress, so that bans can be listed, added and removed at
+	// runtime. NewTCP also enforces it on the server, unless the server
+	// options have their own ban list.
+	Bans ban.List `json:"-"`
+
+	// Schedule is optional. When set, the broadcasts that are scheduled in it
+	// are broadcast by the peer when they are due, once the peer has
+	// bootstrapped. It is served as an admin API at /schedule on the
+	// AdminAddress, so that broadcasts can be scheduled, listed and cancelled
+	// at runtime.
+	Schedule schedule.Schedule `json:"-"`
+
+	// PingStore is optional. When set, the pings that have been propagated by
+	// the peer are recorded in it (see pingpong.Options), so that they can be
+	// persisted across restarts, and inspected. It must not be shared with
+	// other peers.
+	PingStore    kv.Table      `json:"-"`
+	PingSeenTTL  time.Duration `json:"pingSeenTTL"`  // Defaults to 10 minutes
+	MaxSeenPings int           `json:"maxSeenPings"` // Defaults to 65536
+
+	// BroadcastStore is optional. When set, the hashes of the broadcasts that
+	// have been seen by the peer are recorded in it (see broadcast.Options),
+	// so that broadcasts are not emitted or propagated again after a restart.
+	// It must not be shared with other peers.
+	BroadcastStore   kv.Table      `json:"-"`
+	BroadcastSeenTTL time.Duration `json:"broadcastSeenTTL"` // Defaults to 1 hour
+
+	// PSK is an optional pre-shared key that is mixed into the handshakes of
+	// peers created with NewTCP, so that only the peers that know the PSK can
+	// join the network.
+	PSK []byte `json:"-"`
+
+	// PaddingBucketSize pads the messages of peers created with NewTCP to
+	// uniform sizes when it is positive (see handshake.Options). Cover
+	// traffic is enabled by the CoverInterval of the tcp.ConnPoolOptions.
+	PaddingBucketSize int `json:"paddingBucketSize"`
+
+	// BodyCompression is optional. When it is set (e.g. to
+	// handshake.CompressionBodySnappy), peers created with NewTCP prefer to
+	// compress the bodies of the messages that they send, before they are
+	// encrypted, so that large broadcasts use less bandwidth. Connections to
+	// peers that do not support it are not compressed. Padded connections are
+	// never compressed.
+	BodyCompression handshake.Compression `json:"bodyCompression"`
+
+	// NetworkID is optional. When it is set, peers created with NewTCP
+	// exchange it in an identify frame before the handshake, and reject
+	// connections from peers in other networks, or that do not speak the
+	// protocol, before doing any cryptography (see handshake.Options). It
+	// must be set by all peers in the network.
+	NetworkID string `json:"networkID"`
+
+	// Strict makes peers created with NewTCP reject messages that are not
+	// encoded canonically, instead of parsing them on a best-effort basis
+	// (see handshake.Options). It should be enabled by validating nodes once
+	// every peer in the network encodes its messages canonically.
+	Strict bool `json:"strict"`
+
+	// Framed makes peers created with NewTCP write their messages with a
+	// magic number and a checksum around them (see handshake.Options), so
+	// that corrupted streams are detected. Framed messages are always read,
+	// so it can be enabled once every peer in the network has been upgraded.
+	Framed bool `json:"framed"`
+
+	// RefuseDowngrades makes peers created with NewTCP refuse handshakes
+	// that negotiate a weaker suite than their most preferred suite (e.g.
+	// when PreferECDH is set), and, when Framed is set, close connections
+	// that read messages that are not framed (see handshake.Options).
+	// Downgrades are logged, counted by the Metrics, and emitted as a
+	// protocol.EventDowngraded, whether they are refused or not.
+	RefuseDowngrades bool `json:"refuseDowngrades"`
+
+	// MACOnly makes peers created with NewTCP authenticate their messages
+	// with an HMAC, instead of encrypting them (see
+	// handshake.NewHMACSessionManager), for deployments where confidentiality
+	// is not needed. It must be enabled by all peers in the network.
+	MACOnly bool `json:"macOnly"`
+
+	// PreferECDH makes peers created with NewTCP prefer handshakes with an
+	// ECDH key agreement on secp256k1 (see handshake.SuiteSecp256k1ECDH),
+	// which complete in one round trip, when they are supported by the remote
+	// peer.
+	PreferECDH bool `json:"preferECDH"`
+
+	// DuplexEncryption makes peers created with NewTCP encrypt the messages
+	// sent in each direction of a connection with their own key (see
+	// handshake.NewDuplexGCMSessionManager), so that encrypted sessions are
+	// full duplex. It is ignored when MACOnly is enabled. It must be enabled
+	// by all peers in the network.
+	DuplexEncryption bool `json:"duplexEncryption"`
+
+	// RekeyInterval and RekeyBytes make peers created with NewTCP rekey their
+	// DuplexEncryption sessions once the messages sent with the same key
+	// exceed either of them (see handshake.NewRekeyingGCMSessionManager), so
+	// that the compromise of a session key does not expose the messages sent
+	// before it. Sessions are rekeyed when either of them is set, and the
+	// other defaults. They require DuplexEncryption, and must be set by all
+	// peers in the network.
+	RekeyInterval time.Duration `json:"rekeyInterval"`
+	RekeyBytes    uint64        `json:"rekeyBytes"`
+
+	// FullDuplex makes peers created with NewTCP send messages on the
+	// connections that other peers have dialed, and read messages from the
+	// connections that they have dialed, so that two peers only need one
+	// connection between them (see tcp.ServerOptions and
+	// tcp.ConnPoolOptions). When two peers dial each other at the same time,
+	// the connection dialed by the peer with the lower PeerID is kept. Only
+	// sessions that are full duplex are reused, so it requires MACOnly or
+	// DuplexEncryption sessions. It must be enabled by all peers in the network.
+	FullDuplex bool `json:"fullDuplex"`
+
+	// NAT is optional. When set, peers created with NewTCP ask the router of
+	// the local network to forward their port from the internet (see
+	// tcp.ServerOptions). Whenever the external address changes, Readdress is
+	// called to return the PeerAddress that the peer advertises instead of Me
+	// (usually with a newer nonce, so that other peers accept it).
+	NAT       nat.Mapper                                                                         `json:"-"`
+	Readdress func(me protocol.PeerAddress, external *net.TCPAddr) (protocol.PeerAddress, error) `json:"-"`
+
+	// Resolver is optional. When set, it is used to look up the host names of
+	// bootstrap addresses and, for peers created with NewTCP, of the peers
+	// that are dialed. Otherwise, when DoHURL is set, host names are looked up
+	// using DNS-over-HTTPS at that URL (see resolver.NewDoH), which is useful
+	// in networks where DNS is censored or tampered with. Lookups are cached.
+	Resolver resolver.Resolver `json:"-"`
+	DoHURL   string            `json:"dohURL"`
+
+	// Handoff is optional. When set, the Peer is restored from the State that
+	// was handed off by the process it replaces (see handoff.Inherit), so
+	// that it keeps the network position of that process.
+	Handoff *handoff.State `json:"-"`
+
+	// Budget is optional. When set, messages that have been received, but not
+	// handled, hold their bytes in the budget.Inbound subsystem, and are shed
+	// once it exceeds the watermark for their priority, so that a gossip storm
+	// cannot exhaust the memory of the host. NewTCP also enforces it on the
+	// client, in the budget.Outbound subsystem.
+	Budget *budget.Budget `json:"-"`
+
+	// Capture is optional. When set, the messages that are sent to the
+	// client, and the messages that are received from the server, are
+	// captured while it is capturing. It is served as an admin API at
+	// /capture on the AdminAddress, so that it can be started and stopped at
+	// runtime.
+	Capture *capture.Tap `json:"-"`
+
+	// Metrics is optional. When set, the messages sent and received by the
+	// peer, its handshakes, its broadcasts that are deduplicated, its
+	// connections, the size of its DHT and the backlogs of its channels are
+	// exported to Prometheus. They are served at /metrics on the
+	// AdminAddress. A Metrics must not be shared by Peers.
+	Metrics *metrics.Metrics `json:"-"`
+
+	// SignVerifier signs the provider records of the keys provided by the
+	// peer, and verifies the provider records of other peers. NewTCP uses its
+	// own SignVerifier when it is nil. Keys cannot be provided, or their
+	// providers found, without a SignVerifier.
+	SignVerifier protocol.SignVerifier `json:"-"`
+	ProviderTTL  time.Duration         `json:"providerTTL"` // Time until a provider record expires, defaults to 24 hours
+
+	// SignBroadcasts makes the peer sign the bodies of its broadcasts with the
+	// SignVerifier, and reject the broadcasts of other peers that are not
+	// signed (see broadcast.Options). It must be enabled by all peers in the
+	// network.
+	SignBroadcasts bool `json:"signBroadcasts"`
+
+	// Validators of the namespaces of the values that can be put and got by
+	// the peer (see value.Validator). Values in other namespaces are
+	// rejected.
+	Validators map[string]value.Validator `json:"-"`
+	ValueTTL   time.Duration              `json:"valueTTL"` // Time until a value record expires, defaults to 24 hours
+
+	// RecordRepublishInterval is the time between republishing the provider
+	// and value records of the peer, and RecordReplicationInterval is the
+	// time between replicating the records of other peers that are stored at
+	// the peer, so that records survive peer churn.
+	RecordRepublishInterval   time.Duration `json:"recordRepublishInterval"`   // Defaults to half of the TTL of the records
+	RecordReplicationInterval time.Duration `json:"recordReplicationInterval"` // Defaults to 1 hour
 }
 
 func (options *Options) SetZeroToDefault() error {
@@ -30,6 +445,15 @@ func (options *Options) SetZeroToDefault() error {
 	if options.Capacity == 0 {
 		options.Capacity = 1024
 	}
+	if options.OutboundQueueCapacity <= 0 {
+		options.OutboundQueueCapacity = options.Capacity
+	}
+	if options.OutboundDropPolicy == 0 {
+		options.OutboundDropPolicy = protocol.BlockWhenFull
+	}
+	if options.OutboundGossipDropPolicy == 0 {
+		options.OutboundGossipDropPolicy = protocol.DropOldest
+	}
 	if options.NumWorkers == 0 {
 		options.NumWorkers = 2 * runtime.NumCPU()
 	}
@@ -50,6 +474,79 @@ func (options *Options) SetZeroToDefault() error {
 	if options.MaxPingTimeout <= 0 {
 		options.MaxPingTimeout = 30 * time.Second
 	}
+	if options.BootstrapFailureThreshold <= 0 {
+		options.BootstrapFailureThreshold = 3
+	}
+	if options.CatchUpInterval <= 0 {
+		options.CatchUpInterval = time.Minute
+	}
+	if options.LowPowerBootstrapDuration <= 0 {
+		options.LowPowerBootstrapDuration = 4 * options.BootstrapDuration
+	}
+	if options.LowPowerBatchInterval <= 0 {
+		options.LowPowerBatchInterval = 30 * time.Second
+	}
+	if options.GroupReachabilityWindow <= 0 {
+		options.GroupReachabilityWindow = 3 * options.GroupRepairInterval
+	}
+	if options.GroupReachabilityThreshold <= 0 {
+		options.GroupReachabilityThreshold = 0.5
+	}
+	if options.GroupReachabilityThreshold > 1 {
+		return fmt.Errorf("group reachability threshold is greater than 1")
+	}
+	if options.OrderWindow <= 0 {
+		options.OrderWindow = time.Second
+	}
+	if options.NackInterval <= 0 {
+		options.NackInterval = time.Second
+	}
+	if options.LivenessTimeout <= 0 {
+		options.LivenessTimeout = 10 * time.Second
+	}
+	if options.ReadyMinPeers < 0 {
+		return fmt.Errorf("negative minimum number of peers to be ready")
+	}
+	if options.ProviderTTL <= 0 {
+		options.ProviderTTL = 24 * time.Hour
+	}
+	if options.ValueTTL <= 0 {
+		options.ValueTTL = 24 * time.Hour
+	}
+	if options.Hasher == 0 {
+		options.Hasher = protocol.SHA256
+	}
+	if err := protocol.ValidateHasher(options.Hasher); err != nil {
+		return err
+	}
+	if options.RelayOnly && options.DisablePeerDiscovery {
+		return fmt.Errorf("relay-only peers cannot disable peer discovery")
+	}
+	if options.RelayOnly && options.Observer {
+		return fmt.Errorf("observer peers cannot be relay-only")
+	}
+	if options.RelayOnly && options.Schedule != nil {
+		return fmt.Errorf("relay-only peers cannot schedule broadcasts")
+	}
+	if options.BodyCompression != 0 && options.BodyCompression != handshake.CompressionBodyGzip && options.BodyCompression != handshake.CompressionBodySnappy {
+		return fmt.Errorf("body compression=%v does not compress message bodies", options.BodyCompression)
+	}
+	if len(options.NetworkID) > handshake.MaxNetworkIDLength {
+		return fmt.Errorf("network id is longer than %v bytes", handshake.MaxNetworkIDLength)
+	}
+	if (options.RekeyInterval != 0 || options.RekeyBytes != 0) && (!options.DuplexEncryption || options.MACOnly) {
+		return fmt.Errorf("rekeying requires duplex encryption")
+	}
 
 	return nil
 }
+
+// newResolver returns the Resolver of the options, or a cached DNS-over-HTTPS
+// Resolver when only the DoHURL is set. It returns nil when neither are set, in
+// which case the system resolver is used.
+func newResolver(options Options, logger logrus.FieldLogger) resolver.Resolver {
+	if options.Resolver != nil || options.DoHURL == "" {
+		return options.Resolver
+	}
+	return resolver.NewCache(resolver.CacheOptions{}, resolver.NewDoH(resolver.DoHOptions{Logger: logger, URL: options.DoHURL}))
+}
@@ -8,6 +8,8 @@ import (
 	. "github.com/onsi/gomega"
 	. "github.com/renproject/aw/peer"
 	. "github.com/renproject/aw/testutil"
+
+	"github.com/renproject/aw/schedule"
 )
 
 var _ = Describe("options", func() {
@@ -26,6 +28,57 @@ var _ = Describe("options", func() {
 			Expect(option.NumWorkers).Should(Equal(2 * runtime.NumCPU()))
 			Expect(option.Alpha).Should(Equal(24))
 			Expect(option.BootstrapDuration).Should(Equal(time.Hour))
+			Expect(option.BootstrapFailureThreshold).Should(Equal(3))
+			Expect(option.CatchUpInterval).Should(Equal(time.Minute))
+			Expect(option.LowPowerBootstrapDuration).Should(Equal(4 * time.Hour))
+			Expect(option.LowPowerBatchInterval).Should(Equal(30 * time.Second))
+			Expect(option.GroupReachabilityThreshold).Should(Equal(0.5))
+			Expect(option.LivenessTimeout).Should(Equal(10 * time.Second))
+			Expect(option.OrderWindow).Should(Equal(time.Second))
+		})
+
+		It("should return an error if a relay-only peer disables peer discovery", func() {
+			option := Options{
+				Me:                   RandomAddress(),
+				RelayOnly:            true,
+				DisablePeerDiscovery: true,
+			}
+			Expect(option.SetZeroToDefault()).To(HaveOccurred())
+
+			option.DisablePeerDiscovery = false
+			Expect(option.SetZeroToDefault()).NotTo(HaveOccurred())
+		})
+
+		It("should return an error if an observer is relay-only", func() {
+			option := Options{
+				Me:        RandomAddress(),
+				RelayOnly: true,
+				Observer:  true,
+			}
+			Expect(option.SetZeroToDefault()).To(HaveOccurred())
+		})
+
+		It("should return an error if a relay-only peer has a schedule", func() {
+			s, err := schedule.New(schedule.Options{}, nil, nil)
+			Expect(err).NotTo(HaveOccurred())
+			option := Options{
+				Me:        RandomAddress(),
+				RelayOnly: true,
+				Schedule:  s,
+			}
+			Expect(option.SetZeroToDefault()).To(HaveOccurred())
+		})
+
+		It("should default the group reachability window to a multiple of the repair interval", func() {
+			option := Options{
+				Me:                  RandomAddress(),
+				GroupRepairInterval: time.Minute,
+			}
+			Expect(option.SetZeroToDefault()).NotTo(HaveOccurred())
+			Expect(option.GroupReachabilityWindow).Should(Equal(3 * time.Minute))
+
+			option.GroupReachabilityThreshold = 1.5
+			Expect(option.SetZeroToDefault()).To(HaveOccurred())
 		})
 	})
 })
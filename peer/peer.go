@@ -2,17 +2,32 @@ package peer
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net"
+	"os/exec"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/renproject/aw/broadcast"
+	"github.com/renproject/aw/budget"
+	"github.com/renproject/aw/capture"
 	"github.com/renproject/aw/cast"
+	"github.com/renproject/aw/catchup"
+	"github.com/renproject/aw/crypto"
 	"github.com/renproject/aw/dht"
+	"github.com/renproject/aw/discovery"
+	"github.com/renproject/aw/findnode"
+	"github.com/renproject/aw/handoff"
 	"github.com/renproject/aw/handshake"
 	"github.com/renproject/aw/multicast"
 	"github.com/renproject/aw/pingpong"
 	"github.com/renproject/aw/protocol"
+	"github.com/renproject/aw/provider"
 	"github.com/renproject/aw/tcp"
+	"github.com/renproject/aw/value"
+	"github.com/renproject/id"
 	"github.com/renproject/kv"
 	"github.com/sirupsen/logrus"
 )
@@ -20,113 +35,708 @@ import (
 type Peer interface {
 	dht.DHT
 
-	Run(context.Context)
+	// Run the Peer until the context is done, or until one of its subsystems
+	// fails. The subsystems (e.g. the Broadcaster) are started in order before
+	// the Peer bootstraps, and are stopped in the reverse order (see
+	// protocol.RunGroup). It returns a protocol.ErrRunners with the errors of
+	// the subsystems that failed, or nil if none of them failed.
+	Run(context.Context) error
+
+	// Ping a peer in the DHT, so that it learns the address of the Peer, and
+	// responds with its own address.
+	Ping(context.Context, protocol.PeerID) error
 
 	Cast(context.Context, protocol.PeerID, protocol.MessageBody) error
 
+	// CastWithHash casts a message in the same way as Cast, and returns its
+	// hash, so that it can be correlated with the events that are emitted for
+	// it.
+	CastWithHash(context.Context, protocol.PeerID, protocol.MessageBody) (id.Hash, error)
+
 	Multicast(context.Context, protocol.GroupID, protocol.MessageBody) error
 
 	Broadcast(context.Context, protocol.GroupID, protocol.MessageBody) error
+
+	BroadcastWithReport(context.Context, protocol.GroupID, protocol.MessageBody) (broadcast.Report, error)
+
+	// BroadcastWithDeadline broadcasts a message that every peer drops, and
+	// stops propagating, once the deadline has passed.
+	BroadcastWithDeadline(context.Context, protocol.GroupID, protocol.MessageBody, time.Time) (broadcast.Report, error)
+
+	// BroadcastWithOptions broadcasts a message that can have a deadline, and
+	// that is not sent to the excluded peers by this Peer.
+	BroadcastWithOptions(context.Context, protocol.GroupID, protocol.MessageBody, broadcast.BroadcastOptions) (broadcast.Report, error)
+
+	CatchUp(context.Context, protocol.GroupID, catchup.Since) error
+
+	ReadSince(protocol.GroupID, uint64) ([]catchup.Entry, error)
+
+	// FindNode returns the address of a peer that is not in the DHT by
+	// iteratively asking the peers that are closest to it.
+	FindNode(context.Context, protocol.PeerID) (protocol.PeerAddress, error)
+
+	// Provide advertises that the Peer provides the content or service
+	// identified by the key, until the Peer stops running.
+	Provide(context.Context, string) error
+
+	// FindProviders returns the addresses of the peers that provide the key.
+	FindProviders(context.Context, string) (protocol.PeerAddresses, error)
+
+	// PutValue stores the value of the key in the network. The namespace of
+	// the key must have a Validator.
+	PutValue(context.Context, string, []byte) error
+
+	// GetValue returns the value of the key that is stored in the network.
+	GetValue(context.Context, string) ([]byte, error)
+
+	// RecordStats returns the ReplicationStats of the provider and value
+	// records, so that operators can notice when records are not replicated
+	// to enough peers.
+	RecordStats() RecordStats
+
+	// ShedBroadcasts returns the broadcasts accepted from other peers that
+	// were shed by every group, because the group exceeded its limit (see
+	// Options).
+	ShedBroadcasts() map[protocol.GroupID]broadcast.GroupShed
+
+	// Live returns an error if the event loop of the Peer does not respond
+	// within the liveness timeout.
+	Live(context.Context) error
+
+	// Ready returns an error if the Peer has not bootstrapped yet, or does not
+	// know enough peers.
+	Ready() error
+
+	// BootstrapHealth returns the health of every bootstrap address, so that
+	// operators can notice when the bootstrap addresses are no longer
+	// reachable.
+	BootstrapHealth() []BootstrapStatus
+
+	// State returns the minimal runtime state of the Peer, so that it can be
+	// handed off to the process that replaces it during a restart.
+	State() (handoff.State, error)
+
+	// Handoff starts the process that replaces the Peer during a restart, and
+	// hands off the listeners of its server and its State (see
+	// handoff.Start). Once it returns, the Peer should be stopped. The new
+	// process must Inherit the handoff.
+	Handoff(context.Context, *exec.Cmd) error
+
+	// Stats returns the Stats of the messages sent to, and received from, the
+	// peer. The Stats of peers that have not been seen are zero.
+	Stats(protocol.PeerID) Stats
+
+	// Healthcheck validates the configuration of the Peer and its ability to
+	// bind, handshake, read its stores and reach a bootstrap node. It is
+	// intended for readiness probes.
+	Healthcheck(context.Context) HealthReport
+
+	// SetLowPower enables, or disables, low-power mode (e.g. when a mobile
+	// application moves to the background, or returns to the foreground).
+	SetLowPower(bool)
+
+	// LowPower returns true if the Peer is in low-power mode.
+	LowPower() bool
+
+	// Conns returns the state of the live connections of the Peer, in both
+	// directions, if its client and server keep them (e.g. those of NewTCP).
+	Conns() []tcp.ConnState
+
+	// OutboundQueue returns the messages that are waiting to be sent by the
+	// client, and that have been dropped, by priority.
+	OutboundQueue() protocol.MessageQueueStats
+
+	// FDs returns the usage of file descriptors by the connections of the
+	// Peer, if its server counts them (e.g. that of NewTCP).
+	FDs() tcp.FDStats
+
+	// CloseConn closes the connections with the remote address. It returns
+	// tcp.ErrConnNotFound if there are none.
+	CloseConn(remoteAddr string) error
+
+	// PinGroup stops, or resumes, the removal of the group when it is idle
+	// (see Options). Groups stay pinned when they are removed.
+	PinGroup(protocol.GroupID, bool)
+
+	// Redial closes the connection that was dialed to the remote address, and
+	// dials it again straight away. It returns tcp.ErrConnNotFound if there is
+	// no such connection.
+	Redial(remoteAddr string) error
 }
 
+// RecordStats are the ReplicationStats of the provider and value records of a
+// Peer.
+type RecordStats struct {
+	Providers dht.ReplicationStats `json:"providers"`
+	Values    dht.ReplicationStats `json:"values"`
+}
+
+// ErrRelayOnly is returned when a relay-only peer is asked to originate a
+// message, or receives a message that is meant for the application.
+var ErrRelayOnly = errors.New("peer is relay-only")
+
+// ErrUnauthenticatedOrigin is returned when a peer that requires authenticated
+// origins receives a message that relies on its origin from a connection that
+// was not authenticated by a handshake.
+var ErrUnauthenticatedOrigin = errors.New("origin is not authenticated")
+
 type peer struct {
 	// General
-	logger     logrus.FieldLogger
-	options    Options
-	dht        dht.DHT
-	handshaker handshake.Handshaker
-	events     protocol.EventSender
+	logger      logrus.FieldLogger
+	options     Options
+	codec       protocol.PeerAddressCodec
+	dht         dht.ExtendedDHT
+	handshaker  handshake.Handshaker
+	events      protocol.EventSender
+	relayEvents chan protocol.Event // Discarded events of a relay-only peer
 
 	// network connections
 	client         protocol.Client
 	clientMessages chan protocol.MessageOnTheWire
 	server         protocol.Server
 	serverMessages chan protocol.MessageOnTheWire
+	outboundQueue  *protocol.MessageQueue
 
 	// messengers
-	caster      cast.Caster
+	caster      cast.ExtendedCaster
 	pingPonger  pingpong.PingPonger
 	multicaster multicast.Multicaster
-	broadcaster broadcast.Broadcaster
+	broadcaster broadcast.ExtendedBroadcaster
+	catchUpper  catchup.CatchUpper
+	nodeFinder  findnode.NodeFinder
+	discoverer  discovery.Discoverer
+	router      provider.Router
+	valueStore  value.Store
+
+	// subsystems that are run by the Peer, in the order they are started
+	runners []protocol.Runner
+
+	// low-power mode
+	power *powerMode
+
+	// groups joined by an observer, and the time they were last pulled
+	observedGroupsMu *sync.Mutex
+	observedGroups   map[protocol.GroupID]time.Time
+
+	// groups that are repaired when they are degraded
+	groupHealthMu *sync.Mutex
+	groupHealth   map[protocol.GroupID]*groupHealth
+
+	// groups that are removed when they are idle, and the time they were
+	// last active
+	groupActivityMu *sync.Mutex
+	groupActivity   map[protocol.GroupID]time.Time
+	pinnedGroups    map[protocol.GroupID]struct{}
+
+	// probes
+	bootstrapTracker *bootstrapTracker
+	stats            *statsTracker
+	nacks            *nackLimiter
+	bootstrapped     int32
+	liveness         chan chan struct{}
 }
 
-func New(options Options, logger logrus.FieldLogger, codec protocol.PeerAddressCodec, dht dht.DHT, handshaker handshake.Handshaker, client protocol.Client, server protocol.Server, events protocol.EventSender) Peer {
+func New(options Options, logger logrus.FieldLogger, codec protocol.PeerAddressCodec, table dht.DHT, handshaker handshake.Handshaker, client protocol.Client, server protocol.Server, events protocol.EventSender) Peer {
 	if err := options.SetZeroToDefault(); err != nil {
 		panic(fmt.Errorf("pre-condition violation: invalid peer option, err = %v", err))
 	}
+	options.Resolver = newResolver(options, logger)
 
 	serverMessages := make(chan protocol.MessageOnTheWire, options.Capacity)
 	clientMessages := make(chan protocol.MessageOnTheWire, options.Capacity)
 
+	// Relay-only peers never emit events to the application, so events are
+	// sent to a channel that is drained while the peer is running.
+	var relayEvents chan protocol.Event
+	if options.RelayOnly {
+		relayEvents = make(chan protocol.Event, options.Capacity)
+		events = relayEvents
+	}
+
 	pingpongOption := pingpong.Options{
 		Logger:     logger,
 		NumWorkers: options.NumWorkers,
 		Alpha:      options.Alpha,
+		Store:      options.PingStore,
+		SeenTTL:    options.PingSeenTTL,
+		MaxSeen:    options.MaxSeenPings,
+		FilterSelf: options.FilterSelf,
+		Piggyback:  options.PiggybackAddresses,
 	}
-	caster := cast.NewCaster(logger, clientMessages, events, dht)
-	pingponger := pingpong.NewPingPonger(pingpongOption, dht, clientMessages, events, codec)
-	multicaster := multicast.NewMulticaster(logger, options.NumWorkers, clientMessages, events, dht)
-	broadcaster := broadcast.NewBroadcaster(logger, options.NumWorkers, clientMessages, events, dht)
+	broadcastOptions := broadcast.Options{
+		Logger:           logger,
+		NumWorkers:       options.NumWorkers,
+		AsyncPropagation: options.AsyncBroadcastPropagation,
+		Hasher:           options.Hasher,
+		Ordered:          options.OrderedBroadcasts,
+		OrderWindow:      options.OrderWindow,
+		RelayPolicy:      options.RelayPolicy,
+		Reliable:         options.ReliableBroadcasts,
+		AckThresholds:    options.BroadcastAckThresholds,
+		DeadlineSkew:     options.BroadcastDeadlineSkew,
+		MaxDeadline:      options.BroadcastMaxDeadline,
+		DeadlinePolicy:   options.BroadcastDeadlinePolicy,
+		Store:            options.BroadcastStore,
+		SeenTTL:          options.BroadcastSeenTTL,
+		FilterSelf:       options.FilterSelf,
+		Strategy:         options.BroadcastStrategy,
+		RoundInterval:    options.BroadcastRoundInterval,
 
-	return &peer{
+		GroupLimits:       options.BroadcastGroupLimits,
+		DefaultGroupLimit: options.BroadcastGroupLimit,
+		Metrics:           options.Metrics,
+
+		Piggyback: options.PiggybackAddresses,
+		Codec:     codec,
+	}
+	if options.SignBroadcasts {
+		if options.SignVerifier == nil {
+			panic("pre-condition violation: cannot sign broadcasts without a SignVerifier")
+		}
+		broadcastOptions.SignVerifier = options.SignVerifier
+	}
+	if options.ClockSync {
+		clock := pingpong.NewClock()
+		pingpongOption.Clock = clock
+		broadcastOptions.Clock = clock.Now
+	}
+	routerOptions := provider.Options{
+		Logger:              logger,
+		TTL:                 options.ProviderTTL,
+		RepublishInterval:   options.RecordRepublishInterval,
+		ReplicationInterval: options.RecordReplicationInterval,
+	}
+	valueOptions := value.Options{
+		Logger:              logger,
+		TTL:                 options.ValueTTL,
+		Validators:          options.Validators,
+		RepublishInterval:   options.RecordRepublishInterval,
+		ReplicationInterval: options.RecordReplicationInterval,
+	}
+	castOptions := cast.Options{Logger: logger, Loopback: options.LoopbackCasts}
+
+	// Components are declared with the components that they use, and are
+	// built, and run, after them
+	var (
+		catchUpper  catchup.CatchUpper
+		nodeFinder  findnode.NodeFinder
+		discoverer  discovery.Discoverer
+		caster      cast.ExtendedCaster
+		pingponger  pingpong.PingPonger
+		multicaster multicast.Multicaster
+		broadcaster broadcast.ExtendedBroadcaster
+		router      provider.Router
+		valueStore  value.Store
+	)
+	components := newWiring()
+	components.declare("dht", nil, func() interface{} {
+		return table
+	})
+	components.declare("nodeFinder", []string{"dht"}, func() interface{} {
+		nodeFinder = findnode.NewNodeFinder(findnode.Options{Logger: logger}, table, clientMessages, codec)
+		return nodeFinder
+	})
+	components.declare("discoverer", []string{"dht"}, func() interface{} {
+		discoverer = discovery.NewDiscoverer(discovery.Options{Logger: logger, BatchSize: options.QueryPeersBatchSize}, table, clientMessages, codec)
+		return discoverer
+	})
+	// Observers pull broadcasts from other peers, and peers that enable
+	// catching up retain broadcasts for other peers
+	if options.EnableCatchUp || options.Observer {
+		components.declare("catchUpper", []string{"dht"}, func() interface{} {
+			catchUpper = catchup.NewCatchUpper(catchup.Options{Logger: logger}, clientMessages, table)
+			return catchUpper
+		})
+	}
+	components.declare("pingponger", []string{"dht"}, func() interface{} {
+		pingponger = pingpong.NewPingPonger(pingpongOption, table, clientMessages, events, codec)
+		return pingponger
+	})
+	casterDeps, broadcasterDeps := []string{"dht"}, []string{"dht"}
+	if options.LookUpMissingAddresses {
+		casterDeps = append(casterDeps, "nodeFinder")
+		broadcasterDeps = append(broadcasterDeps, "nodeFinder")
+	}
+	if options.EnableCatchUp {
+		broadcasterDeps = append(broadcasterDeps, "catchUpper")
+	}
+	components.declare("caster", casterDeps, func() interface{} {
+		if options.LookUpMissingAddresses {
+			castOptions.Finder = nodeFinder
+		}
+		caster = cast.NewCasterWithOptions(castOptions, clientMessages, events, table)
+		return caster
+	})
+	components.declare("multicaster", []string{"dht"}, func() interface{} {
+		multicaster = multicast.NewMulticaster(logger, options.NumWorkers, clientMessages, events, table)
+		return multicaster
+	})
+	components.declare("broadcaster", broadcasterDeps, func() interface{} {
+		if options.LookUpMissingAddresses {
+			broadcastOptions.Finder = nodeFinder
+		}
+		if options.EnableCatchUp {
+			broadcastOptions.Retainer = catchUpper
+		}
+		broadcaster = broadcast.NewBroadcasterWithOptions(broadcastOptions, clientMessages, events, table)
+		broadcaster.PauseRelaying(options.LowPower)
+		return broadcaster
+	})
+	components.declare("router", []string{"dht"}, func() interface{} {
+		router = provider.NewRouter(routerOptions, table, clientMessages, options.SignVerifier, codec)
+		return router
+	})
+	components.declare("valueStore", []string{"dht"}, func() interface{} {
+		valueStore = value.NewStore(valueOptions, table, clientMessages, options.SignVerifier, codec)
+		return valueStore
+	})
+	if err := components.build(); err != nil {
+		panic(fmt.Errorf("invariant violation: cannot wire peer: %v", err))
+	}
+
+	p := &peer{
 		logger:         logger,
 		options:        options,
-		dht:            dht,
+		codec:          codec,
+		dht:            dht.Extend(table),
 		handshaker:     handshaker,
 		events:         events,
+		relayEvents:    relayEvents,
 		client:         client,
 		clientMessages: clientMessages,
 		server:         server,
 		serverMessages: serverMessages,
+		outboundQueue:  protocol.NewMessageQueue(protocol.MessageQueueOptions{Capacity: options.OutboundQueueCapacity, DropPolicy: options.OutboundDropPolicy, LowPriorityDropPolicy: options.OutboundGossipDropPolicy, Events: events}),
 		caster:         caster,
 		pingPonger:     pingponger,
 		multicaster:    multicaster,
 		broadcaster:    broadcaster,
+		catchUpper:     catchUpper,
+		nodeFinder:     nodeFinder,
+		discoverer:     discoverer,
+		router:         router,
+		valueStore:     valueStore,
+		runners:        components.runners(),
+
+		power: newPowerMode(options.LowPower),
+
+		observedGroupsMu: new(sync.Mutex),
+		observedGroups:   map[protocol.GroupID]time.Time{},
+
+		groupHealthMu: new(sync.Mutex),
+		groupHealth:   map[protocol.GroupID]*groupHealth{},
+
+		groupActivityMu: new(sync.Mutex),
+		groupActivity:   map[protocol.GroupID]time.Time{},
+		pinnedGroups:    map[protocol.GroupID]struct{}{},
+
+		bootstrapTracker: newBootstrapTracker(options.BootstrapAddresses, options.BootstrapFailureThreshold, options.Resolver),
+		stats:            newStatsTracker(),
+		nacks:            newNackLimiter(options.NackInterval),
+		liveness:         make(chan chan struct{}),
 	}
+	if options.Handoff != nil {
+		p.restore(*options.Handoff)
+	}
+	if options.Metrics != nil {
+		p.registerGauges()
+	}
+	return p
 }
 
 func NewTCP(options Options, logger logrus.FieldLogger, codec protocol.PeerAddressCodec, events protocol.EventSender, signVerifier protocol.SignVerifier, poolOptions tcp.ConnPoolOptions, serverOptions tcp.ServerOptions) Peer {
 	if err := options.SetZeroToDefault(); err != nil {
 		panic(fmt.Errorf("pre-condition violation: invalid peer option, err = %v", err))
 	}
-	store := kv.NewTable(kv.NewMemDB(kv.JSONCodec), "dht")
-	dht, err := dht.New(options.Me, codec, store, options.BootstrapAddresses...)
+	var table dht.ExtendedDHT
+	var err error
+	if options.Observer {
+		table, err = dht.NewObserver(options.Me, codec, options.BootstrapAddresses...)
+	} else {
+		store := kv.NewTable(kv.NewMemDB(kv.JSONCodec), "dht")
+		table, err = dht.NewWithOptions(dht.Options{MaxPeersPerSubnet: options.MaxPeersPerSubnet, BucketSize: options.BucketSize, PreferClosePeers: options.PreferClosePeers}, options.Me, codec, store, options.BootstrapAddresses...)
+	}
 	if err != nil {
 		panic(fmt.Errorf("pre-condition violation: fail to initialize dht, err = %v", err))
 	}
-	handshaker := handshake.New(signVerifier, handshake.NewGCMSessionManager())
-	connPool := tcp.NewConnPool(poolOptions, logger, handshaker)
-	client := tcp.NewClient(logger, connPool)
+	sessionManager := handshake.NewGCMSessionManager()
+	if options.DuplexEncryption {
+		sessionManager = handshake.NewDuplexGCMSessionManager(options.Me.PeerID())
+		if options.RekeyInterval != 0 || options.RekeyBytes != 0 {
+			sessionManager = handshake.NewRekeyingGCMSessionManager(options.Me.PeerID(), handshake.RekeyOptions{Interval: options.RekeyInterval, Bytes: options.RekeyBytes, Rekeyed: options.Metrics.Rekeyed})
+		}
+	}
+	if options.MACOnly {
+		sessionManager = handshake.NewHMACSessionManager(options.Me.PeerID())
+	}
+	handshakeOptions := handshake.Options{PSK: options.PSK, PaddingBucketSize: options.PaddingBucketSize, Strict: options.Strict, Framed: options.Framed, RefuseDowngrades: options.RefuseDowngrades, NetworkID: options.NetworkID}
+	handshakeOptions.Downgraded = func(event protocol.EventDowngraded) {
+		logger.Warnf("downgraded %v from %v to %v with peer=%v (refused=%v)", event.Kind, event.Preferred, event.Negotiated, event.PeerID, event.Refused)
+		options.Metrics.Downgraded(event)
+		select {
+		case events <- event:
+		default:
+		}
+	}
+	if options.BodyCompression != 0 {
+		handshakeOptions.Compressions = handshake.Compressions{options.BodyCompression, handshake.CompressionNone, handshake.CompressionSnappy, handshake.CompressionBodySnappy, handshake.CompressionBodyGzip}
+	}
+	if options.PreferECDH {
+		handshakeOptions.Suites = handshake.Suites{handshake.SuiteSecp256k1ECDH, handshake.SuiteSecp256k1ECIES, handshake.SuiteP256ECDH}
+	}
+	handshaker := options.Metrics.Handshaker(handshake.NewWithOptions(handshakeOptions, signVerifier, sessionManager))
+	options.Resolver = newResolver(options, logger)
+	if poolOptions.Resolver == nil {
+		poolOptions.Resolver = options.Resolver
+	}
+	if serverOptions.Bans == nil {
+		serverOptions.Bans = options.Bans
+	}
+	if serverOptions.Events == nil {
+		serverOptions.Events = events
+	}
+	if serverOptions.FDs == nil && poolOptions.FDs == nil {
+		// The server and the pool share the file descriptors of the process
+		serverOptions.FDs = tcp.NewFDGuard()
+		poolOptions.FDs = serverOptions.FDs
+	}
+	clientOptions := tcp.ClientOptions{Budget: options.Budget, Retries: options.SendRetries, RetryBackoff: options.SendRetryBackoff, Events: events}
+	if options.FilterSelf {
+		clientOptions.Self = options.Me.PeerID()
+	}
+	if options.NAT != nil {
+		serverOptions.NAT = options.NAT
+		onExternalAddr := serverOptions.OnExternalAddr
+		serverOptions.OnExternalAddr = func(addr *net.TCPAddr) {
+			if onExternalAddr != nil {
+				onExternalAddr(addr)
+			}
+			readdress(logger, table, options.Readdress, addr)
+		}
+	}
+	if options.FullDuplex {
+		serverOptions.FullDuplex = true
+		if serverOptions.Me == nil {
+			serverOptions.Me = options.Me.PeerID()
+		}
+	}
 	server := tcp.NewServer(serverOptions, logger, handshaker)
-	return New(options, logger, codec, dht, handshaker, client, server, events)
+	if options.FullDuplex {
+		poolOptions.Duplex = server
+		clientOptions.Inbound = server
+	}
+	connPool := tcp.NewConnPool(poolOptions, logger, handshaker)
+	client := tcp.NewClientWithOptions(clientOptions, logger, connPool)
+	if options.SignVerifier == nil {
+		options.SignVerifier = signVerifier
+	}
+	return New(options, logger, codec, table, handshaker, client, server, events)
+}
+
+// readdress the peer with the external address that the router of its local
+// network forwards to it, so that the address is advertised to other peers.
+func readdress(logger logrus.FieldLogger, table dht.ExtendedDHT, readdress func(protocol.PeerAddress, *net.TCPAddr) (protocol.PeerAddress, error), addr *net.TCPAddr) {
+	if readdress == nil {
+		return
+	}
+	me, err := readdress(table.Me(), addr)
+	if err != nil {
+		logger.Errorf("error readdressing peer with external address=%v: %v", addr, err)
+		return
+	}
+	if err := table.UpdateMe(me); err != nil {
+		logger.Errorf("error readdressing peer with external address=%v: %v", addr, err)
+	}
 }
 
-func (peer *peer) Run(ctx context.Context) {
+// NewTCPWithEvents is the same as NewTCP, but it makes the channel that the
+// events of the Peer are sent to, with the Capacity of the options, and returns
+// it, so that applications do not need to wire any channels themselves. The
+// events must be read while the Peer is running.
+func NewTCPWithEvents(options Options, logger logrus.FieldLogger, codec protocol.PeerAddressCodec, signVerifier protocol.SignVerifier, poolOptions tcp.ConnPoolOptions, serverOptions tcp.ServerOptions) (Peer, protocol.EventReceiver) {
+	if err := options.SetZeroToDefault(); err != nil {
+		panic(fmt.Errorf("pre-condition violation: invalid peer option, err = %v", err))
+	}
+	events := make(chan protocol.Event, options.Capacity)
+	return NewTCP(options, logger, codec, events, signVerifier, poolOptions, serverOptions), events
+}
+
+// KeyFile is an encrypted key file that stores the identity key of a Peer. A
+// new key of the given type is generated if the file does not exist. The Hash
+// is only used by secp256k1 keys, and defaults to Keccak256.
+type KeyFile struct {
+	Filename   string
+	Type       crypto.KeyType
+	Passphrase []byte
+	Hash       crypto.HashFunc
+	Options    crypto.KeyFileOptions
+}
+
+// NewTCPFromKeyFile returns a Peer that authenticates itself using the key in
+// the KeyFile, so that its identity survives restarts.
+func NewTCPFromKeyFile(options Options, logger logrus.FieldLogger, codec protocol.PeerAddressCodec, events protocol.EventSender, keyFile KeyFile, poolOptions tcp.ConnPoolOptions, serverOptions tcp.ServerOptions) (Peer, error) {
+	if keyFile.Hash == nil {
+		keyFile.Hash = crypto.Keccak256
+	}
+	signVerifier, err := crypto.LoadOrGenerateEncryptedSignVerifier(keyFile.Filename, keyFile.Type, keyFile.Passphrase, keyFile.Hash, keyFile.Options)
+	if err != nil {
+		return nil, fmt.Errorf("error loading identity key: %v", err)
+	}
+	return NewTCP(options, logger, codec, events, signVerifier, poolOptions, serverOptions), nil
+}
+
+func (peer *peer) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Start the subsystems before the client and server, so that they are
+	// ready to handle messages
+	subsystems := peer.subsystems()
+	done := make(chan error, 1)
+	go func() {
+		done <- subsystems.Run(ctx)
+	}()
+	select {
+	case <-subsystems.Ready():
+	case err := <-done:
+		return err
+	}
+
 	// Start both the client and server before bootstrapping
-	go peer.client.Run(ctx, peer.clientMessages)
-	go peer.server.Run(ctx, peer.serverMessages)
+	var clientMessages protocol.MessageReceiver = peer.clientMessages
+	if len(peer.options.OutboundHooks) > 0 {
+		outbound := make(chan protocol.MessageOnTheWire, peer.options.Capacity)
+		go peer.applyOutboundHooks(ctx, clientMessages, outbound)
+		clientMessages = outbound
+	}
+	batched := make(chan protocol.MessageOnTheWire, peer.options.Capacity)
+	go peer.batchOutbound(ctx, clientMessages, batched)
+	go peer.observeOutbound(ctx, batched)
+	// Messages wait in the outbound queue, rather than in the client, so that
+	// they can be sent in the order of their priority. Clients that cannot pop
+	// from the queue themselves are given its messages one at a time.
+	if client, ok := peer.client.(protocol.QueueClient); ok {
+		go client.RunQueue(ctx, peer.outboundQueue)
+	} else {
+		outbound := make(chan protocol.MessageOnTheWire)
+		go peer.outboundQueue.Run(ctx, outbound)
+		go peer.client.Run(ctx, outbound)
+	}
+	if peer.options.Budget != nil {
+		inbound := make(chan protocol.MessageOnTheWire, peer.options.Capacity)
+		go peer.server.Run(ctx, inbound)
+		go peer.admitInbound(ctx, inbound)
+	} else {
+		go peer.server.Run(ctx, peer.serverMessages)
+	}
 	go peer.handleMessage(ctx)
+	if peer.relayEvents != nil {
+		go peer.discardEvents(ctx)
+	}
+	if peer.options.ProbeAddress != "" {
+		go peer.serveProbes(ctx)
+	}
+	if peer.options.AdminAddress != "" {
+		go peer.serveAdmin(ctx)
+	}
 
 	// Start bootstrapping
 	peer.bootstrap(ctx)
-	ticker := time.NewTicker(peer.options.BootstrapDuration)
-	defer ticker.Stop()
+	atomic.StoreInt32(&peer.bootstrapped, 1)
+	if peer.options.Schedule != nil {
+		go peer.options.Schedule.Run(ctx, peer)
+	}
+	timer := time.NewTimer(peer.bootstrapDuration())
+	defer timer.Stop()
+
+	// Observers pull the broadcasts of the groups they join
+	var catchUpTicks <-chan time.Time
+	if peer.options.Observer {
+		catchUpTicker := time.NewTicker(peer.options.CatchUpInterval)
+		defer catchUpTicker.Stop()
+		catchUpTicks = catchUpTicker.C
+	}
+
+	// Groups are repaired when too few of their members are reachable
+	var repairTicks <-chan time.Time
+	if peer.options.GroupRepairInterval > 0 {
+		repairTicker := time.NewTicker(peer.options.GroupRepairInterval)
+		defer repairTicker.Stop()
+		repairTicks = repairTicker.C
+	}
+
+	// Groups are removed when they have been idle for too long
+	var expiryTicks <-chan time.Time
+	if peer.options.GroupIdleTimeout > 0 {
+		expiryTicker := time.NewTicker(peer.options.GroupIdleTimeout / 2)
+		defer expiryTicker.Stop()
+		expiryTicks = expiryTicker.C
+	}
+
+	// Peers are removed from the DHT when they have not been seen for too long
+	var staleTicks <-chan time.Time
+	if peer.options.PeerStaleWindow > 0 {
+		staleTicker := time.NewTicker(peer.options.PeerStaleWindow / 2)
+		defer staleTicker.Stop()
+		staleTicks = staleTicker.C
+	}
 
 	for {
 		select {
 		case <-ctx.Done():
-			return
+			return <-done
 
-		case <-ticker.C:
+		case err := <-done:
+			return err
+
+		case <-timer.C:
 			peer.bootstrap(ctx)
+			timer.Reset(peer.bootstrapDuration())
+
+		case <-peer.power.bootstrapChanged:
+			// Peers are pinged straight away when low-power mode is
+			// disabled, because they may have changed in the background
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			if !peer.power.get() {
+				peer.bootstrap(ctx)
+			}
+			timer.Reset(peer.bootstrapDuration())
+
+		case <-catchUpTicks:
+			peer.pullObservedGroups(ctx)
+
+		case <-repairTicks:
+			peer.repairGroups(ctx)
+
+		case now := <-expiryTicks:
+			peer.expireGroups(ctx, now)
+
+		case now := <-staleTicks:
+			peer.removeStalePeers(now)
 		}
 	}
 }
 
+// subsystems returns a protocol.RunGroup of the subsystems of the Peer, in the
+// order in which they are started. Subsystems are started after the subsystems
+// that they use (see wiring).
+func (peer *peer) subsystems() *protocol.RunGroup {
+	return protocol.NewRunGroup(peer.runners...)
+}
+
 func (peer *peer) Me() protocol.PeerAddress {
 	return peer.dht.Me()
 }
 
+func (peer *peer) UpdateMe(me protocol.PeerAddress) error {
+	return peer.dht.UpdateMe(me)
+}
+
 func (peer *peer) NumPeers() (int, error) {
 	return peer.dht.NumPeers()
 }
@@ -139,10 +749,46 @@ func (peer *peer) PeerAddresses() (protocol.PeerAddresses, error) {
 	return peer.dht.PeerAddresses()
 }
 
+func (peer *peer) Seen(id protocol.PeerID) {
+	peer.dht.Seen(id)
+}
+
+func (peer *peer) LastSeen(id protocol.PeerID) (time.Time, error) {
+	return peer.dht.LastSeen(id)
+}
+
+func (peer *peer) RemoveStalePeers(since time.Time) (protocol.PeerIDs, error) {
+	return peer.dht.RemoveStalePeers(since)
+}
+
+func (peer *peer) RecentPeerAddresses(n int) (protocol.PeerAddresses, error) {
+	return peer.dht.RecentPeerAddresses(n)
+}
+
+// removeStalePeers removes the peers that have not been seen within the
+// PeerStaleWindow from the DHT.
+func (peer *peer) removeStalePeers(now time.Time) {
+	stale, err := peer.dht.RemoveStalePeers(now.Add(-peer.options.PeerStaleWindow))
+	if err != nil {
+		peer.logger.Errorf("error removing stale peers: %v", err)
+	}
+	if len(stale) > 0 {
+		peer.logger.Infof("removed %v stale peers: not seen for %v", len(stale), peer.options.PeerStaleWindow)
+	}
+}
+
+func (peer *peer) Subscribe(changes chan<- dht.PeerChange) func() {
+	return peer.dht.Subscribe(changes)
+}
+
 func (peer *peer) RandomPeerAddresses(id protocol.GroupID, n int) (protocol.PeerAddresses, error) {
 	return peer.dht.RandomPeerAddresses(id, n)
 }
 
+func (peer *peer) ClosestPeerAddresses(target protocol.PeerID, n int) (protocol.PeerAddresses, error) {
+	return peer.dht.ClosestPeerAddresses(target, n)
+}
+
 func (peer *peer) AddPeerAddress(addrs protocol.PeerAddress) error {
 	return peer.dht.AddPeerAddress(addrs)
 }
@@ -156,33 +802,179 @@ func (peer *peer) RemovePeerAddress(id protocol.PeerID) error {
 }
 
 func (peer *peer) AddGroup(groupID protocol.GroupID, ids protocol.PeerIDs) error {
-	return peer.dht.AddGroup(groupID, ids)
+	// The group is active before it is added, so that it cannot expire while
+	// it is being added again
+	peer.activateGroup(groupID)
+	if err := peer.dht.AddGroup(groupID, ids); err != nil {
+		peer.deactivateGroup(groupID)
+		return err
+	}
+	peer.trackGroup(groupID)
+	if peer.options.Observer {
+		peer.observedGroupsMu.Lock()
+		defer peer.observedGroupsMu.Unlock()
+
+		if _, ok := peer.observedGroups[groupID]; !ok {
+			peer.observedGroups[groupID] = time.Time{}
+		}
+	}
+	return nil
 }
 
 func (peer *peer) GroupIDs(groupID protocol.GroupID) (protocol.PeerIDs, error) {
-	return peer.GroupIDs(groupID)
+	return peer.dht.GroupIDs(groupID)
 }
 
 func (peer *peer) GroupAddresses(groupID protocol.GroupID) (protocol.PeerAddresses, error) {
-	return peer.GroupAddresses(groupID)
+	return peer.dht.GroupAddresses(groupID)
+}
+
+func (peer *peer) GroupInfo(groupID protocol.GroupID) (dht.GroupInfo, error) {
+	return peer.dht.GroupInfo(groupID)
 }
 
 func (peer *peer) RemoveGroup(groupID protocol.GroupID) {
+	peer.deactivateGroup(groupID)
+	peer.removeGroup(groupID)
+}
+
+func (peer *peer) removeGroup(groupID protocol.GroupID) {
 	peer.dht.RemoveGroup(groupID)
+	peer.untrackGroup(groupID)
+
+	peer.observedGroupsMu.Lock()
+	defer peer.observedGroupsMu.Unlock()
+
+	delete(peer.observedGroups, groupID)
+}
+
+func (peer *peer) AddSubgroup(parent, child protocol.GroupID) error {
+	return peer.dht.AddSubgroup(parent, child)
+}
+
+func (peer *peer) Subgroups(groupID protocol.GroupID) []protocol.GroupID {
+	return peer.dht.Subgroups(groupID)
+}
+
+func (peer *peer) RemoveSubgroup(parent, child protocol.GroupID) {
+	peer.dht.RemoveSubgroup(parent, child)
 }
 
 func (peer *peer) Cast(ctx context.Context, to protocol.PeerID, data protocol.MessageBody) error {
+	if peer.options.RelayOnly {
+		return ErrRelayOnly
+	}
 	return peer.caster.Cast(ctx, to, data)
 }
 
+func (peer *peer) Ping(ctx context.Context, to protocol.PeerID) error {
+	return peer.pingPonger.Ping(ctx, to)
+}
+
+func (peer *peer) CastWithHash(ctx context.Context, to protocol.PeerID, data protocol.MessageBody) (id.Hash, error) {
+	if peer.options.RelayOnly {
+		return id.Hash{}, ErrRelayOnly
+	}
+	return peer.caster.CastWithHash(ctx, to, data)
+}
+
 func (peer *peer) Multicast(ctx context.Context, groupID protocol.GroupID, data protocol.MessageBody) error {
+	if peer.options.RelayOnly {
+		return ErrRelayOnly
+	}
 	return peer.multicaster.Multicast(ctx, groupID, data)
 }
 
 func (peer *peer) Broadcast(ctx context.Context, groupID protocol.GroupID, data protocol.MessageBody) error {
+	if peer.options.RelayOnly {
+		return ErrRelayOnly
+	}
 	return peer.broadcaster.Broadcast(ctx, groupID, data)
 }
 
+func (peer *peer) BroadcastWithReport(ctx context.Context, groupID protocol.GroupID, data protocol.MessageBody) (broadcast.Report, error) {
+	if peer.options.RelayOnly {
+		return broadcast.Report{}, ErrRelayOnly
+	}
+	return peer.broadcaster.BroadcastWithReport(ctx, groupID, data)
+}
+
+func (peer *peer) BroadcastWithDeadline(ctx context.Context, groupID protocol.GroupID, data protocol.MessageBody, deadline time.Time) (broadcast.Report, error) {
+	if peer.options.RelayOnly {
+		return broadcast.Report{}, ErrRelayOnly
+	}
+	return peer.broadcaster.BroadcastWithDeadline(ctx, groupID, data, deadline)
+}
+
+func (peer *peer) BroadcastWithOptions(ctx context.Context, groupID protocol.GroupID, data protocol.MessageBody, options broadcast.BroadcastOptions) (broadcast.Report, error) {
+	if peer.options.RelayOnly {
+		return broadcast.Report{}, ErrRelayOnly
+	}
+	return peer.broadcaster.BroadcastWithOptions(ctx, groupID, data, options)
+}
+
+func (peer *peer) CatchUp(ctx context.Context, groupID protocol.GroupID, since catchup.Since) error {
+	if peer.options.RelayOnly {
+		return ErrRelayOnly
+	}
+	if peer.catchUpper == nil {
+		return fmt.Errorf("error catching up with group=%v: catch-up is not enabled", groupID)
+	}
+	return peer.catchUpper.CatchUp(ctx, groupID, since)
+}
+
+func (peer *peer) ReadSince(groupID protocol.GroupID, seq uint64) ([]catchup.Entry, error) {
+	if peer.catchUpper == nil {
+		return nil, fmt.Errorf("error reading log of group=%v: catch-up is not enabled", groupID)
+	}
+	return peer.catchUpper.ReadSince(groupID, seq)
+}
+
+func (peer *peer) FindNode(ctx context.Context, target protocol.PeerID) (protocol.PeerAddress, error) {
+	return peer.nodeFinder.FindNode(ctx, target)
+}
+
+func (peer *peer) Provide(ctx context.Context, key string) error {
+	if peer.options.RelayOnly {
+		return ErrRelayOnly
+	}
+	return peer.router.Provide(ctx, key)
+}
+
+func (peer *peer) FindProviders(ctx context.Context, key string) (protocol.PeerAddresses, error) {
+	return peer.router.FindProviders(ctx, key)
+}
+
+func (peer *peer) PutValue(ctx context.Context, key string, value []byte) error {
+	if peer.options.RelayOnly {
+		return ErrRelayOnly
+	}
+	return peer.valueStore.PutValue(ctx, key, value)
+}
+
+func (peer *peer) GetValue(ctx context.Context, key string) ([]byte, error) {
+	return peer.valueStore.GetValue(ctx, key)
+}
+
+func (peer *peer) RecordStats() RecordStats {
+	return RecordStats{
+		Providers: peer.router.Stats(),
+		Values:    peer.valueStore.Stats(),
+	}
+}
+
+func (peer *peer) OutboundQueue() protocol.MessageQueueStats {
+	return peer.outboundQueue.Stats()
+}
+
+func (peer *peer) ShedBroadcasts() map[protocol.GroupID]broadcast.GroupShed {
+	return peer.broadcaster.ShedByGroup()
+}
+
+func (peer *peer) BootstrapHealth() []BootstrapStatus {
+	return peer.bootstrapTracker.statuses()
+}
+
 func (peer *peer) bootstrap(ctx context.Context) {
 	if peer.options.DisablePeerDiscovery {
 		return
@@ -194,6 +986,14 @@ func (peer *peer) bootstrap(ctx context.Context) {
 		return
 	}
 
+	// Bootstrap addresses that keep failing are pinged last, so that they do
+	// not hold up the workers
+	peer.bootstrapTracker.resolve(ctx)
+	peer.bootstrapTracker.prioritise(peerAddrs)
+	if peer.options.QueryPeers {
+		peer.queryBootstrapPeers(ctx)
+	}
+
 	protocol.ParForAllAddresses(peerAddrs, peer.options.NumWorkers, func(peerAddr protocol.PeerAddress) {
 		// Timeout is computed to ensure that we are ready for the next
 		// bootstrap tick even if every single ping takes the maximum amount of
@@ -211,39 +1011,272 @@ func (peer *peer) bootstrap(ctx context.Context) {
 
 		pingCtx, pingCancel := context.WithTimeout(ctx, pingTimeout)
 		defer pingCancel()
+		peer.bootstrapTracker.attempt(peerAddr.PeerID())
 		if err := peer.pingPonger.Ping(pingCtx, peerAddr.PeerID()); err != nil {
+			peer.bootstrapTracker.fail(peerAddr.PeerID(), err)
 			peer.logger.Errorf("error bootstrapping: error ping/ponging peer address=%v: %v", peerAddr, err)
 			return
 		}
 	})
 }
 
+// queryBootstrapPeers asks the bootstrap peers for the peers that they know.
+// The latest addresses of the bootstrap peers in the DHT are preferred over
+// the addresses in the options.
+func (peer *peer) queryBootstrapPeers(ctx context.Context) {
+	for _, bootstrapAddr := range peer.options.BootstrapAddresses {
+		addr, err := peer.dht.PeerAddress(bootstrapAddr.PeerID())
+		if err != nil {
+			addr = bootstrapAddr
+		}
+		if err := peer.discoverer.QueryPeers(ctx, addr); err != nil {
+			peer.logger.Errorf("error bootstrapping: error querying peers of peer address=%v: %v", addr, err)
+		}
+	}
+}
+
+// pullObservedGroups asks the other members of every group joined by an
+// observer for the broadcasts since the group was last pulled. Broadcasts that
+// have already been seen are ignored when they are received.
+func (peer *peer) pullObservedGroups(ctx context.Context) {
+	peer.observedGroupsMu.Lock()
+	pulls := make(map[protocol.GroupID]time.Time, len(peer.observedGroups))
+	now := time.Now()
+	for groupID, since := range peer.observedGroups {
+		pulls[groupID] = since
+		peer.observedGroups[groupID] = now
+	}
+	peer.observedGroupsMu.Unlock()
+
+	for groupID, since := range pulls {
+		if err := peer.catchUpper.CatchUp(ctx, groupID, catchup.SinceTime(since)); err != nil {
+			peer.logger.Errorf("error pulling broadcasts of group=%v: %v", groupID, err)
+		}
+	}
+}
+
 func (peer *peer) handleMessage(ctx context.Context) {
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case messageOtw := <-peer.serverMessages:
-			if err := peer.receiveMessageOnTheWire(ctx, messageOtw); err != nil {
+			peer.options.Capture.Capture(messageOtw.From, capture.Received, messageOtw.Message)
+			peer.stats.received(messageOtw.From, messageOtw.Message)
+			peer.options.Metrics.Received(messageOtw.Message.Variant)
+			if messageOtw.From != nil {
+				peer.dht.Seen(messageOtw.From)
+			}
+			bytes := len(messageOtw.Message.Body)
+			if err := peer.handleMessageOnTheWire(ctx, messageOtw); err != nil {
+				peer.stats.failed(messageOtw.From)
 				peer.logger.Error(err)
+				if reason, ok := rejectReason(err); ok {
+					peer.reject(messageOtw, reason)
+				}
+			}
+			peer.options.Budget.Release(budget.Inbound, false, bytes)
+		case alive := <-peer.liveness:
+			close(alive)
+		}
+	}
+}
+
+// handleMessageOnTheWire within the timeout of its variant, if it has one.
+// Handlers that have timed out are cancelled by their context, and counted in
+// the Stats of the peer that sent the message.
+func (peer *peer) handleMessageOnTheWire(ctx context.Context, messageOtw protocol.MessageOnTheWire) error {
+	timeout, ok := peer.options.HandlerTimeouts[messageOtw.Message.Variant]
+	if !ok || timeout <= 0 {
+		return peer.receiveMessageOnTheWire(ctx, messageOtw)
+	}
+
+	handlerCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	err := peer.receiveMessageOnTheWire(handlerCtx, messageOtw)
+	if handlerCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		peer.stats.timedOut(messageOtw.From, messageOtw.Message.Variant)
+		if err == nil {
+			return nil
+		}
+		return fmt.Errorf("error handling %v from peer=%v within %v: %v", messageOtw.Message.Variant, messageOtw.From, timeout, err)
+	}
+	return err
+}
+
+// admitInbound forwards the messages received by the server to be handled,
+// unless the Budget sheds them, either because the queue of messages waiting to
+// be handled is under pressure or because the budget.Inbound subsystem exceeds
+// its Limits. The bytes of the messages that are forwarded
+// are released once they have been handled.
+func (peer *peer) admitInbound(ctx context.Context, inbound <-chan protocol.MessageOnTheWire) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case messageOtw := <-inbound:
+			pressure := float64(len(peer.serverMessages)) / float64(cap(peer.serverMessages))
+			if peer.options.Budget.Shed(budget.Inbound, messageOtw.Message, pressure) {
+				peer.logger.Debugf("shedding %v message from %v: inbound queue is under pressure", messageOtw.Message.Variant, messageOtw.From)
+				peer.reject(messageOtw, protocol.RejectedOverloaded)
+				continue
+			}
+			if !peer.options.Budget.Acquire(budget.Inbound, messageOtw.Message.Variant, false, len(messageOtw.Message.Body)) {
+				peer.logger.Debugf("shedding %v message from %v: inbound budget exceeded", messageOtw.Message.Variant, messageOtw.From)
+				peer.reject(messageOtw, protocol.RejectedOverloaded)
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case peer.serverMessages <- messageOtw:
+			}
+		}
+	}
+}
+
+// discardEvents emitted by a relay-only peer until the context is done.
+func (peer *peer) discardEvents(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-peer.relayEvents:
+		}
+	}
+}
+
+// applyOutboundHooks applies the OutboundHooks to the messages sent by the
+// messengers, and forwards them to the client. Messages are dropped when a
+// hook returns an error.
+func (peer *peer) applyOutboundHooks(ctx context.Context, messages protocol.MessageReceiver, outbound protocol.MessageSender) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case messageOtw := <-messages:
+			message, err := peer.transformOutbound(messageOtw.To, messageOtw.Message)
+			if err != nil {
+				peer.logger.Errorf("error sending %v to peer=%v: %v", messageOtw.Message.Variant, messageOtw.To.PeerID(), err)
+				continue
+			}
+			messageOtw.Message = message
+			select {
+			case <-ctx.Done():
+				return
+			case outbound <- messageOtw:
 			}
 		}
 	}
 }
 
+// observeOutbound records the Stats of the messages that are sent, and
+// captures them, after the OutboundHooks have been applied to them, and
+// pushes them to the outbound queue of the client.
+func (peer *peer) observeOutbound(ctx context.Context, messages protocol.MessageReceiver) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case messageOtw := <-messages:
+			peer.stats.sent(messageOtw.To.PeerID(), messageOtw.Message)
+			peer.options.Metrics.Sent(messageOtw.Message.Variant)
+			if messageOtw.Message.Variant == protocol.Broadcast || messageOtw.Message.Variant == protocol.Multicast {
+				peer.touchGroup(messageOtw.Message.GroupID)
+			}
+			peer.options.Capture.Capture(messageOtw.To.PeerID(), capture.Sent, messageOtw.Message)
+			if err := peer.outboundQueue.Push(ctx, messageOtw); err != nil {
+				peer.logger.Debugf("dropping %v to peer=%v: %v", messageOtw.Message.Variant, messageOtw.To.PeerID(), err)
+			}
+		}
+	}
+}
+
+func (peer *peer) transformOutbound(to protocol.PeerAddress, message protocol.Message) (protocol.Message, error) {
+	for i, hook := range peer.options.OutboundHooks {
+		transformed, err := hook.Outbound(to, message)
+		if err != nil {
+			return protocol.Message{}, fmt.Errorf("error applying outbound hook %v: %v", i, err)
+		}
+		message = transformed
+	}
+	return message, nil
+}
+
 func (peer *peer) receiveMessageOnTheWire(ctx context.Context, messageOtw protocol.MessageOnTheWire) error {
+	// Casts and multicasts are only ever meant for the application, and are
+	// not relayed
+	if peer.options.RelayOnly && (messageOtw.Message.Variant == protocol.Cast || messageOtw.Message.Variant == protocol.Multicast) {
+		return newErrRejected(protocol.RejectedRelayOnly, fmt.Errorf("error receiving %v from peer=%v: %v", messageOtw.Message.Variant, messageOtw.From, ErrRelayOnly))
+	}
+
+	if peer.options.RequireAuthenticatedOrigins && !messageOtw.Authenticated && peer.reliesOnOrigin(messageOtw.Message.Variant) {
+		return newErrRejected(protocol.RejectedUnauthenticated, fmt.Errorf("error receiving %v from peer=%v: %v", messageOtw.Message.Variant, messageOtw.From, ErrUnauthenticatedOrigin))
+	}
+
 	switch messageOtw.Message.Variant {
 	case protocol.Ping:
 		return peer.pingPonger.AcceptPing(ctx, messageOtw.Message)
 	case protocol.Pong:
+		if messageOtw.From != nil {
+			peer.bootstrapTracker.pong(messageOtw.From)
+		}
 		return peer.pingPonger.AcceptPong(ctx, messageOtw.Message)
 	case protocol.Broadcast:
+		peer.touchGroup(messageOtw.Message.GroupID)
 		return peer.broadcaster.AcceptBroadcast(ctx, messageOtw.From, messageOtw.Message)
+	case protocol.BroadcastAck:
+		return peer.broadcaster.AcceptBroadcastAck(ctx, messageOtw.From, messageOtw.Message)
+	case protocol.Nack:
+		return peer.acceptNack(ctx, messageOtw.From, messageOtw.Message)
 	case protocol.Multicast:
+		peer.touchGroup(messageOtw.Message.GroupID)
 		return peer.multicaster.AcceptMulticast(ctx, messageOtw.From, messageOtw.Message)
 	case protocol.Cast:
 		return peer.caster.AcceptCast(ctx, messageOtw.From, messageOtw.Message)
+	case protocol.CatchUp:
+		if peer.catchUpper == nil {
+			return protocol.NewErrMessageVariantIsNotSupported(messageOtw.Message.Variant)
+		}
+		return peer.catchUpper.AcceptCatchUp(ctx, messageOtw.From, messageOtw.Message)
+	case protocol.FindNode:
+		return peer.nodeFinder.AcceptFindNode(ctx, messageOtw.From, messageOtw.Message)
+	case protocol.Nodes:
+		return peer.nodeFinder.AcceptNodes(ctx, messageOtw.From, messageOtw.Message)
+	case protocol.QueryPeers:
+		return peer.discoverer.AcceptQueryPeers(ctx, messageOtw.From, messageOtw.Message)
+	case protocol.AnswerPeers:
+		return peer.discoverer.AcceptAnswerPeers(ctx, messageOtw.From, messageOtw.Message)
+	case protocol.Provide:
+		return peer.router.AcceptProvide(ctx, messageOtw.From, messageOtw.Message)
+	case protocol.FindProviders:
+		return peer.router.AcceptFindProviders(ctx, messageOtw.From, messageOtw.Message)
+	case protocol.Providers:
+		return peer.router.AcceptProviders(ctx, messageOtw.From, messageOtw.Message)
+	case protocol.PutValue:
+		return peer.valueStore.AcceptPutValue(ctx, messageOtw.From, messageOtw.Message)
+	case protocol.GetValue:
+		return peer.valueStore.AcceptGetValue(ctx, messageOtw.From, messageOtw.Message)
+	case protocol.Value:
+		return peer.valueStore.AcceptValue(ctx, messageOtw.From, messageOtw.Message)
 	default:
 		return protocol.NewErrMessageVariantIsNotSupported(messageOtw.Message.Variant)
 	}
 }
+
+// reliesOnOrigin returns true if messages of the variant are attributed to the
+// peer that sent them, because they are emitted to the application as being
+// from it, answered by sending a message to it, or accepted as the response of
+// a request that was sent to it. Broadcasts are gossiped, and identified by
+// their hash, so they only rely on their origin when they are acknowledged.
+// Provider and value records are signed by the peer that published them.
+func (peer *peer) reliesOnOrigin(variant protocol.MessageVariant) bool {
+	switch variant {
+	case protocol.Broadcast:
+		return peer.options.ReliableBroadcasts
+	case protocol.Provide, protocol.PutValue:
+		return false
+	default:
+		return true
+	}
+}
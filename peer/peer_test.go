@@ -4,7 +4,10 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
+	"os"
+	"path/filepath"
 	"testing/quick"
 	"time"
 
@@ -12,8 +15,12 @@ import (
 	. "github.com/onsi/gomega"
 	. "github.com/renproject/aw/testutil"
 
+	"github.com/renproject/aw/crypto"
+	"github.com/renproject/aw/dht"
+	"github.com/renproject/aw/discovery"
 	"github.com/renproject/aw/peer"
 	"github.com/renproject/aw/protocol"
+	"github.com/renproject/aw/tcp"
 	"github.com/renproject/phi"
 	"github.com/sirupsen/logrus"
 )
@@ -149,4 +156,594 @@ var _ = Describe("Peer", func() {
 			})
 		}
 	})
+
+	Context("when pinging a peer", func() {
+		It("should send a ping to its address", func() {
+			me := RandomAddress()
+			dht := NewDHT(me, NewTable("dht"), nil)
+			to := RandomAddress()
+			Expect(dht.AddPeerAddress(to)).To(Succeed())
+
+			sent := make(chan protocol.MessageOnTheWire, 128)
+			options := peer.Options{
+				Me:                   me,
+				DisablePeerDiscovery: true,
+			}
+			p := peer.New(options, logrus.New(), NewSimpleTCPPeerAddressCodec(), dht, nil, mockClient(sent), mockServer(nil), make(chan protocol.Event, 128))
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go p.Run(ctx)
+
+			Expect(p.Ping(ctx, to.PeerID())).To(Succeed())
+			Eventually(sent).Should(Receive(WithTransform(func(messageOtw protocol.MessageOnTheWire) bool {
+				return messageOtw.Message.Variant == protocol.Ping && messageOtw.To.Equal(to)
+			}, BeTrue())))
+			Expect(p.Ping(ctx, RandomPeerID())).NotTo(Succeed())
+		})
+	})
+
+	Context("when running", func() {
+		It("should stop its subsystems, and return without an error, once the context is done", func() {
+			me := RandomAddress()
+			dht := NewDHT(me, NewTable("dht"), nil)
+			options := peer.Options{
+				Me:                   me,
+				DisablePeerDiscovery: true,
+			}
+			p := peer.New(options, logrus.New(), NewSimpleTCPPeerAddressCodec(), dht, nil, mockClient(nil), mockServer(nil), make(chan protocol.Event, 128))
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error, 1)
+			go func() {
+				done <- p.Run(ctx)
+			}()
+			Eventually(dht.(protocol.Runner).Ready()).Should(BeClosed())
+
+			cancel()
+			Eventually(done).Should(Receive(BeNil()))
+		})
+	})
+
+	Context("when the peer makes its own events channel", func() {
+		It("should return an events channel with the capacity of the options", func() {
+			signVerifier := NewSignVerifiers(1)[0]
+			options := peer.Options{
+				Me:       NewSimpleTCPPeerAddress(signVerifier.ID(), "127.0.0.1", "0"),
+				Capacity: 16,
+			}
+			p, events := peer.NewTCPWithEvents(options, logrus.New(), NewSimpleTCPPeerAddressCodec(), signVerifier, tcp.ConnPoolOptions{}, tcp.ServerOptions{Host: "127.0.0.1:0"})
+			Expect(p).NotTo(BeNil())
+			Expect(cap(events)).To(Equal(16))
+		})
+	})
+
+	Context("when the peer requires authenticated origins", func() {
+		It("should only accept messages that rely on their origin from authenticated connections", func() {
+			me := RandomAddress()
+			dht := NewDHT(me, NewTable("dht"), nil)
+			from := RandomAddress()
+			Expect(dht.AddPeerAddress(from)).To(Succeed())
+
+			received := make(chan protocol.MessageOnTheWire, 128)
+			events := make(chan protocol.Event, 128)
+			options := peer.Options{
+				Me:                          me,
+				DisablePeerDiscovery:        true,
+				RequireAuthenticatedOrigins: true,
+			}
+			p := peer.New(options, logrus.New(), NewSimpleTCPPeerAddressCodec(), dht, nil, mockClient(make(chan protocol.MessageOnTheWire, 128)), mockServer(received), events)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go p.Run(ctx)
+
+			cast := protocol.NewMessage(protocol.V1, protocol.Cast, protocol.NilGroupID, RandomMessageBody())
+			received <- protocol.MessageOnTheWire{From: from.PeerID(), Message: cast}
+			Consistently(events).ShouldNot(Receive())
+
+			received <- protocol.MessageOnTheWire{From: from.PeerID(), Message: cast, Authenticated: true}
+			var event protocol.Event
+			Eventually(events).Should(Receive(&event))
+			Expect(event.(protocol.EventMessageReceived).Message).To(Equal(cast.Body))
+
+			// Broadcasts do not rely on their origin, unless they are acknowledged
+			broadcast := protocol.NewMessage(protocol.V1, protocol.Broadcast, protocol.NilGroupID, RandomMessageBody())
+			received <- protocol.MessageOnTheWire{From: from.PeerID(), Message: broadcast}
+			Eventually(events).Should(Receive(&event))
+			Expect(event.(protocol.EventMessageReceived).Message).To(Equal(broadcast.Body))
+		})
+	})
+
+	Context("when the peer is relay-only", func() {
+		newRelay := func() (peer.Peer, chan protocol.MessageOnTheWire, chan protocol.MessageOnTheWire, chan protocol.Event, protocol.PeerAddresses) {
+			me := RandomAddress()
+			dht := NewDHT(me, NewTable("dht"), nil)
+			addrs := RandomAddresses(4)
+			for _, addr := range addrs {
+				Expect(dht.AddPeerAddress(addr)).To(Succeed())
+			}
+
+			sent := make(chan protocol.MessageOnTheWire, 128)
+			received := make(chan protocol.MessageOnTheWire, 128)
+			events := make(chan protocol.Event, 128)
+			options := peer.Options{
+				Me:        me,
+				RelayOnly: true,
+			}
+			relay := peer.New(options, logrus.New(), NewSimpleTCPPeerAddressCodec(), dht, nil, mockClient(sent), mockServer(received), events)
+			return relay, sent, received, events, addrs
+		}
+
+		It("should not originate messages", func() {
+			relay, sent, _, _, _ := newRelay()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go relay.Run(ctx)
+
+			Expect(relay.Cast(ctx, RandomPeerID(), RandomMessageBody())).To(Equal(peer.ErrRelayOnly))
+			Expect(relay.Multicast(ctx, protocol.NilGroupID, RandomMessageBody())).To(Equal(peer.ErrRelayOnly))
+			Expect(relay.Broadcast(ctx, protocol.NilGroupID, RandomMessageBody())).To(Equal(peer.ErrRelayOnly))
+			_, err := relay.BroadcastWithReport(ctx, protocol.NilGroupID, RandomMessageBody())
+			Expect(err).To(Equal(peer.ErrRelayOnly))
+			Consistently(sent).ShouldNot(Receive(WithTransform(func(message protocol.MessageOnTheWire) protocol.MessageVariant {
+				return message.Message.Variant
+			}, Not(Equal(protocol.Ping)))))
+		})
+
+		It("should relay broadcasts without emitting events", func() {
+			relay, sent, received, events, addrs := newRelay()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go relay.Run(ctx)
+
+			message := protocol.NewMessage(protocol.V1, protocol.Broadcast, protocol.NilGroupID, RandomMessageBody())
+			received <- protocol.MessageOnTheWire{From: addrs[0].PeerID(), Message: message}
+
+			relayed := map[string]bool{}
+			Eventually(func() int {
+				select {
+				case messageOtw := <-sent:
+					if messageOtw.Message.Variant == protocol.Broadcast && bytes.Equal(messageOtw.Message.Body, message.Body) {
+						relayed[messageOtw.To.String()] = true
+					}
+				default:
+				}
+				return len(relayed)
+			}).Should(Equal(len(addrs)))
+			Consistently(events).ShouldNot(Receive())
+		})
+
+		It("should drop casts and multicasts", func() {
+			relay, sent, received, events, addrs := newRelay()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go relay.Run(ctx)
+
+			received <- protocol.MessageOnTheWire{From: addrs[0].PeerID(), Message: protocol.NewMessage(protocol.V1, protocol.Cast, protocol.NilGroupID, RandomMessageBody())}
+			received <- protocol.MessageOnTheWire{From: addrs[0].PeerID(), Message: protocol.NewMessage(protocol.V1, protocol.Multicast, protocol.NilGroupID, RandomMessageBody())}
+			Consistently(events).ShouldNot(Receive())
+			Consistently(sent).ShouldNot(Receive(WithTransform(func(message protocol.MessageOnTheWire) protocol.MessageVariant {
+				return message.Message.Variant
+			}, Not(Equal(protocol.Ping)))))
+		})
+	})
+
+	Context("when outbound hooks are set", func() {
+		It("should transform the messages of each destination", func() {
+			me := RandomAddress()
+			dht := NewDHT(me, NewTable("dht"), nil)
+			addrs := RandomAddresses(2)
+			for _, addr := range addrs {
+				Expect(dht.AddPeerAddress(addr)).To(Succeed())
+			}
+
+			annotate := protocol.OutboundHookFunc(func(to protocol.PeerAddress, message protocol.Message) (protocol.Message, error) {
+				if message.Variant != protocol.Multicast {
+					return message, nil
+				}
+				if to.PeerID().Equal(addrs[1].PeerID()) {
+					return protocol.Message{}, fmt.Errorf("peer=%v is not supported", to.PeerID())
+				}
+				return protocol.NewMessage(message.Version, message.Variant, message.GroupID, append(append(protocol.MessageBody{}, message.Body...), to.PeerID().String()...)), nil
+			})
+			sent := make(chan protocol.MessageOnTheWire, 128)
+			options := peer.Options{
+				Me:            me,
+				OutboundHooks: []protocol.OutboundHook{annotate},
+			}
+			p := peer.New(options, logrus.New(), NewSimpleTCPPeerAddressCodec(), dht, nil, mockClient(sent), mockServer(nil), make(chan protocol.Event, 128))
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go p.Run(ctx)
+
+			body := RandomMessageBody()
+			Expect(p.Multicast(ctx, protocol.NilGroupID, body)).To(Succeed())
+
+			multicasts := map[string]protocol.MessageBody{}
+			Eventually(func() int {
+				select {
+				case messageOtw := <-sent:
+					if messageOtw.Message.Variant == protocol.Multicast {
+						multicasts[messageOtw.To.String()] = messageOtw.Message.Body
+					}
+				default:
+				}
+				return len(multicasts)
+			}).Should(Equal(1))
+			Consistently(func() int {
+				select {
+				case messageOtw := <-sent:
+					if messageOtw.Message.Variant == protocol.Multicast {
+						multicasts[messageOtw.To.String()] = messageOtw.Message.Body
+					}
+				default:
+				}
+				return len(multicasts)
+			}).Should(Equal(1))
+			Expect(multicasts[addrs[0].String()]).To(Equal(append(append(protocol.MessageBody{}, body...), addrs[0].PeerID().String()...)))
+		})
+	})
+
+	Context("when querying bootstrap peers", func() {
+		It("should learn the peers known by a single bootstrap peer", func() {
+			me, seed := RandomAddress(), RandomAddress()
+			seedDHT := NewDHT(seed, NewTable("seed"), nil)
+			known := RandomAddresses(4)
+			for _, addr := range known {
+				Expect(seedDHT.AddPeerAddress(addr)).To(Succeed())
+			}
+			seedMessages := make(chan protocol.MessageOnTheWire, 128)
+			seedDiscoverer := discovery.NewDiscoverer(discovery.Options{}, seedDHT, seedMessages, NewSimpleTCPPeerAddressCodec())
+
+			sent := make(chan protocol.MessageOnTheWire, 128)
+			received := make(chan protocol.MessageOnTheWire, 128)
+			options := peer.Options{Me: me, BootstrapAddresses: protocol.PeerAddresses{seed}, QueryPeers: true}
+			p := peer.New(options, logrus.New(), NewSimpleTCPPeerAddressCodec(), NewDHT(me, NewTable("dht"), nil), nil, mockClient(sent), mockServer(received), make(chan protocol.Event, 128))
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go p.Run(ctx)
+
+			// The query is answered by the seed
+			var query protocol.MessageOnTheWire
+			Eventually(sent).Should(Receive(&query))
+			Expect(query.To.Equal(seed)).To(BeTrue())
+			Expect(query.Message.Variant).To(Equal(protocol.QueryPeers))
+			Expect(seedDiscoverer.AcceptQueryPeers(ctx, me.PeerID(), query.Message)).To(Succeed())
+			var answer protocol.MessageOnTheWire
+			Eventually(seedMessages).Should(Receive(&answer))
+			received <- protocol.MessageOnTheWire{From: seed.PeerID(), Message: answer.Message}
+
+			Eventually(func() int {
+				num, err := p.NumPeers()
+				Expect(err).NotTo(HaveOccurred())
+				return num
+			}).Should(Equal(len(known)))
+			for _, addr := range known {
+				_, err := p.PeerAddress(addr.PeerID())
+				Expect(err).NotTo(HaveOccurred())
+			}
+		})
+	})
+
+	Context("when casts to self loop back", func() {
+		It("should emit the cast without sending it", func() {
+			me := RandomAddress()
+			sent := make(chan protocol.MessageOnTheWire, 1)
+			events := make(chan protocol.Event, 1)
+			options := peer.Options{Me: me, FilterSelf: true, LoopbackCasts: true}
+			p := peer.New(options, logrus.New(), NewSimpleTCPPeerAddressCodec(), NewDHT(me, NewTable("dht"), nil), nil, mockClient(sent), mockServer(nil), events)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go p.Run(ctx)
+
+			body := RandomMessageBody()
+			Expect(p.Cast(ctx, me.PeerID(), body)).To(Succeed())
+			var event protocol.Event
+			Eventually(events).Should(Receive(&event))
+			Expect(event.(protocol.EventMessageReceived).From.Equal(me.PeerID())).To(BeTrue())
+			Expect([]byte(event.(protocol.EventMessageReceived).Message)).To(Equal([]byte(body)))
+			Consistently(sent).ShouldNot(Receive())
+		})
+	})
+
+	Context("when recording stats", func() {
+		It("should count the messages sent to, and received from, each peer", func() {
+			me := RandomAddress()
+			dht := NewDHT(me, NewTable("dht"), nil)
+			other := RandomAddress()
+			Expect(dht.AddPeerAddress(other)).To(Succeed())
+
+			sent := make(chan protocol.MessageOnTheWire, 128)
+			received := make(chan protocol.MessageOnTheWire, 128)
+			p := peer.New(peer.Options{Me: me}, logrus.New(), NewSimpleTCPPeerAddressCodec(), dht, nil, mockClient(sent), mockServer(received), make(chan protocol.Event, 128))
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go p.Run(ctx)
+
+			stats := p.Stats(other.PeerID())
+			Expect(stats.MessagesIn).To(BeZero())
+			Expect(stats.MessagesOut).To(BeZero())
+
+			// Requests are timed until their response is received
+			body := RandomMessageBody()
+			Expect(p.Cast(ctx, other.PeerID(), body)).To(Succeed())
+			go p.FindNode(ctx, RandomPeerID())
+			Eventually(func() protocol.MessageVariant {
+				select {
+				case messageOtw := <-sent:
+					return messageOtw.Message.Variant
+				default:
+					return 0
+				}
+			}).Should(Equal(protocol.FindNode))
+			time.Sleep(10 * time.Millisecond)
+			received <- protocol.MessageOnTheWire{From: other.PeerID(), Message: protocol.NewMessage(protocol.V1, protocol.Nodes, protocol.NilGroupID, protocol.MessageBody("malformed"))}
+
+			Eventually(func() uint64 {
+				return p.Stats(other.PeerID()).MessagesIn
+			}).Should(Equal(uint64(1)))
+			stats = p.Stats(other.PeerID())
+			Expect(stats.Variants[protocol.Cast]).To(Equal(peer.VariantStats{MessagesOut: 1, BytesOut: uint64(len(body))}))
+			Expect(stats.Variants[protocol.FindNode].MessagesOut).To(Equal(uint64(1)))
+			Expect(stats.Variants[protocol.Nodes]).To(Equal(peer.VariantStats{MessagesIn: 1, BytesIn: uint64(len("malformed"))}))
+			Expect(stats.BytesIn).To(Equal(uint64(len("malformed"))))
+			Expect(stats.MessagesInRate).To(BeNumerically(">", 0))
+			Expect(stats.MessagesOutRate).To(BeNumerically(">", 0))
+			Expect(stats.LastSeen).To(BeTemporally("~", time.Now(), time.Second))
+			Expect(stats.RTT).To(BeNumerically(">=", 10*time.Millisecond))
+			Eventually(func() uint64 {
+				return p.Stats(other.PeerID()).Errors
+			}).Should(Equal(uint64(1)))
+		})
+	})
+
+	Context("when a variant has a handler timeout", func() {
+		It("should cancel handlers that time out, and count them", func() {
+			me := RandomAddress()
+			dht := NewDHT(me, NewTable("dht"), nil)
+			other := RandomAddress()
+			Expect(dht.AddPeerAddress(other)).To(Succeed())
+
+			// Nobody reads the events, so casts cannot be handled
+			received := make(chan protocol.MessageOnTheWire, 128)
+			events := make(chan protocol.Event)
+			options := peer.Options{
+				Me:                   me,
+				DisablePeerDiscovery: true,
+				HandlerTimeouts:      map[protocol.MessageVariant]time.Duration{protocol.Cast: 50 * time.Millisecond},
+			}
+			p := peer.New(options, logrus.New(), NewSimpleTCPPeerAddressCodec(), dht, nil, mockClient(make(chan protocol.MessageOnTheWire, 128)), mockServer(received), events)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go p.Run(ctx)
+
+			cast := protocol.NewMessage(protocol.V1, protocol.Cast, protocol.NilGroupID, RandomMessageBody())
+			received <- protocol.MessageOnTheWire{From: other.PeerID(), Message: cast}
+			received <- protocol.MessageOnTheWire{From: other.PeerID(), Message: cast}
+			Eventually(func() uint64 {
+				return p.Stats(other.PeerID()).Timeouts
+			}).Should(Equal(uint64(2)))
+			stats := p.Stats(other.PeerID())
+			Expect(stats.Variants[protocol.Cast].Timeouts).To(Equal(uint64(2)))
+			Expect(stats.Errors).To(Equal(uint64(2)))
+		})
+	})
+
+	Context("when the peer is an observer", func() {
+		It("should pull the broadcasts of the groups it joins", func() {
+			me := RandomAddress()
+			table, err := dht.NewObserver(me, NewSimpleTCPPeerAddressCodec())
+			Expect(err).NotTo(HaveOccurred())
+			sent := make(chan protocol.MessageOnTheWire, 128)
+			events := make(chan protocol.Event, 128)
+			options := peer.Options{
+				Me:              me,
+				Observer:        true,
+				CatchUpInterval: 100 * time.Millisecond,
+			}
+			observer := peer.New(options, logrus.New(), NewSimpleTCPPeerAddressCodec(), table, nil, mockClient(sent), mockServer(nil), events)
+
+			groupID := RandomGroupID()
+			addrs := RandomAddresses(4)
+			Expect(observer.AddGroup(groupID, FromAddressesToIDs(addrs))).To(Succeed())
+			for _, addr := range addrs {
+				Expect(observer.AddPeerAddress(addr)).To(Succeed())
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go observer.Run(ctx)
+
+			pulled := map[string]bool{}
+			Eventually(func() int {
+				select {
+				case messageOtw := <-sent:
+					if messageOtw.Message.Variant == protocol.CatchUp && messageOtw.Message.GroupID.Equal(groupID) {
+						pulled[messageOtw.To.String()] = true
+					}
+				default:
+				}
+				return len(pulled)
+			}).Should(Equal(len(addrs)))
+		})
+	})
+
+	Context("when the peer is in low-power mode", func() {
+		newLowPowerPeer := func(batchInterval time.Duration) (peer.Peer, chan protocol.MessageOnTheWire, chan protocol.MessageOnTheWire, chan protocol.Event, protocol.PeerAddresses) {
+			me := RandomAddress()
+			dht := NewDHT(me, NewTable("dht"), nil)
+			addrs := RandomAddresses(2)
+			for _, addr := range addrs {
+				Expect(dht.AddPeerAddress(addr)).To(Succeed())
+			}
+
+			sent := make(chan protocol.MessageOnTheWire, 128)
+			received := make(chan protocol.MessageOnTheWire, 128)
+			events := make(chan protocol.Event, 128)
+			options := peer.Options{
+				Me:                    me,
+				LowPower:              true,
+				LowPowerBatchInterval: batchInterval,
+			}
+			p := peer.New(options, logrus.New(), NewSimpleTCPPeerAddressCodec(), dht, nil, mockClient(sent), mockServer(received), events)
+			return p, sent, received, events, addrs
+		}
+
+		// sentVariant returns a function that returns true once a message of
+		// the variant has been sent.
+		sentVariant := func(sent chan protocol.MessageOnTheWire, variant protocol.MessageVariant) func() bool {
+			return func() bool {
+				for {
+					select {
+					case messageOtw := <-sent:
+						if messageOtw.Message.Variant == variant {
+							return true
+						}
+					default:
+						return false
+					}
+				}
+			}
+		}
+
+		It("should send messages in batches, without relaying broadcasts", func() {
+			p, sent, received, events, addrs := newLowPowerPeer(500 * time.Millisecond)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go p.Run(ctx)
+			Expect(p.LowPower()).To(BeTrue())
+
+			Expect(p.Cast(ctx, addrs[0].PeerID(), RandomMessageBody())).To(Succeed())
+			Consistently(sentVariant(sent, protocol.Cast), 250*time.Millisecond).Should(BeFalse())
+			Eventually(sentVariant(sent, protocol.Cast), 2*time.Second).Should(BeTrue())
+
+			message := protocol.NewMessage(protocol.V1, protocol.Broadcast, protocol.NilGroupID, RandomMessageBody())
+			received <- protocol.MessageOnTheWire{From: addrs[0].PeerID(), Message: message}
+			Eventually(events).Should(Receive(BeAssignableToTypeOf(protocol.EventMessageReceived{})))
+			Consistently(sentVariant(sent, protocol.Broadcast), 1500*time.Millisecond).Should(BeFalse())
+		})
+
+		It("should send held messages, and relay broadcasts, once low-power mode is disabled", func() {
+			p, sent, received, events, addrs := newLowPowerPeer(time.Hour)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go p.Run(ctx)
+
+			Expect(p.Cast(ctx, addrs[0].PeerID(), RandomMessageBody())).To(Succeed())
+			Consistently(sentVariant(sent, protocol.Cast), 250*time.Millisecond).Should(BeFalse())
+
+			p.SetLowPower(false)
+			Expect(p.LowPower()).To(BeFalse())
+			Eventually(sentVariant(sent, protocol.Cast)).Should(BeTrue())
+
+			message := protocol.NewMessage(protocol.V1, protocol.Broadcast, protocol.NilGroupID, RandomMessageBody())
+			received <- protocol.MessageOnTheWire{From: addrs[0].PeerID(), Message: message}
+			Eventually(events).Should(Receive(BeAssignableToTypeOf(protocol.EventMessageReceived{})))
+			Eventually(sentVariant(sent, protocol.Broadcast)).Should(BeTrue())
+		})
+	})
+
+	Context("when the peer is restarted with a handoff", func() {
+		It("should restore the peer addresses and the seen broadcasts", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			// Run a peer until it accepts a broadcast
+			me := RandomAddress()
+			table := NewDHT(me, NewTable("dht"), nil)
+			addrs := RandomAddresses(4)
+			for _, addr := range addrs {
+				Expect(table.AddPeerAddress(addr)).To(Succeed())
+			}
+			received := make(chan protocol.MessageOnTheWire, 128)
+			events := make(chan protocol.Event, 128)
+			old := peer.New(peer.Options{Me: me}, logrus.New(), NewSimpleTCPPeerAddressCodec(), table, nil, mockClient(make(chan protocol.MessageOnTheWire, 128)), mockServer(received), events)
+			go old.Run(ctx)
+			message := protocol.NewMessage(protocol.V1, protocol.Broadcast, protocol.NilGroupID, RandomMessageBody())
+			received <- protocol.MessageOnTheWire{From: addrs[0].PeerID(), Message: message}
+			Eventually(events).Should(Receive())
+
+			// The listeners of mock servers cannot be handed off
+			Expect(old.Handoff(ctx, nil)).NotTo(Succeed())
+			state, err := old.State()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(state.PeerAddresses).Should(HaveLen(len(addrs)))
+			Expect(state.Broadcaster.Seen).Should(ContainElement(message.Hash()))
+
+			// Expect the new peer to know the peer addresses, and to not emit
+			// the broadcast again
+			received = make(chan protocol.MessageOnTheWire, 128)
+			events = make(chan protocol.Event, 128)
+			restarted := peer.New(peer.Options{Me: me, Handoff: &state}, logrus.New(), NewSimpleTCPPeerAddressCodec(), NewDHT(me, NewTable("dht"), nil), nil, mockClient(make(chan protocol.MessageOnTheWire, 128)), mockServer(received), events)
+			numPeers, err := restarted.NumPeers()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(numPeers).Should(Equal(len(addrs)))
+			go restarted.Run(ctx)
+			received <- protocol.MessageOnTheWire{From: addrs[1].PeerID(), Message: message}
+			Consistently(events).ShouldNot(Receive())
+		})
+	})
+
+	Context("when creating a peer from a key file", func() {
+		It("should generate the identity key once and load it afterwards", func() {
+			dir, err := ioutil.TempDir("", "aw-peer")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(dir)
+
+			keyFile := peer.KeyFile{
+				Filename:   filepath.Join(dir, "identity.json"),
+				Type:       crypto.KeyTypeEd25519,
+				Passphrase: []byte("passphrase"),
+				Options:    crypto.KeyFileOptions{ScryptN: 1 << 10},
+			}
+			options := peer.Options{Me: RandomAddress()}
+			_, err = peer.NewTCPFromKeyFile(options, logrus.New(), NewSimpleTCPPeerAddressCodec(), make(chan protocol.Event), keyFile, tcp.ConnPoolOptions{}, tcp.ServerOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			data, err := ioutil.ReadFile(keyFile.Filename)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = peer.NewTCPFromKeyFile(options, logrus.New(), NewSimpleTCPPeerAddressCodec(), make(chan protocol.Event), keyFile, tcp.ConnPoolOptions{}, tcp.ServerOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			reloaded, err := ioutil.ReadFile(keyFile.Filename)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reloaded).Should(Equal(data))
+
+			keyFile.Passphrase = []byte("wrong")
+			_, err = peer.NewTCPFromKeyFile(options, logrus.New(), NewSimpleTCPPeerAddressCodec(), make(chan protocol.Event), keyFile, tcp.ConnPoolOptions{}, tcp.ServerOptions{})
+			Expect(err).To(HaveOccurred())
+		})
+	})
 })
+
+// mockClient forwards the messages sent by a peer to a channel.
+type mockClient chan protocol.MessageOnTheWire
+
+func (client mockClient) Run(ctx context.Context, messages protocol.MessageReceiver) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case message := <-messages:
+			select {
+			case <-ctx.Done():
+				return
+			case client <- message:
+			}
+		}
+	}
+}
+
+// mockServer forwards the messages received on a channel to a peer.
+type mockServer chan protocol.MessageOnTheWire
+
+func (server mockServer) Run(ctx context.Context, messages protocol.MessageSender) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case message := <-server:
+			select {
+			case <-ctx.Done():
+				return
+			case messages <- message:
+			}
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package peer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+func (peer *peer) Live(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, peer.options.LivenessTimeout)
+	defer cancel()
+
+	alive := make(chan struct{})
+	select {
+	case <-ctx.Done():
+		return fmt.Errorf("event loop is not responsive: %v", ctx.Err())
+	case peer.liveness <- alive:
+	}
+	select {
+	case <-ctx.Done():
+		return fmt.Errorf("event loop is not responsive: %v", ctx.Err())
+	case <-alive:
+		return nil
+	}
+}
+
+func (peer *peer) Ready() error {
+	if atomic.LoadInt32(&peer.bootstrapped) == 0 {
+		return fmt.Errorf("not bootstrapped")
+	}
+	numPeers, err := peer.dht.NumPeers()
+	if err != nil {
+		return err
+	}
+	if numPeers < peer.options.ReadyMinPeers {
+		return fmt.Errorf("not enough peers: expected at least %v, got %v", peer.options.ReadyMinPeers, numPeers)
+	}
+	return nil
+}
+
+// NewProbeHandler returns an http.Handler that serves the liveness probe of the
+// Peer at /healthz, and its readiness probe at /readyz. Probes respond with
+// 200 OK if they pass, and 503 Service Unavailable otherwise. The health of the
+// bootstrap addresses is served as JSON at /bootstrap.
+func NewProbeHandler(peer Peer) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeProbe(w, peer.Live(r.Context()))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		writeProbe(w, peer.Ready())
+	})
+	mux.HandleFunc("/bootstrap", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(peer.BootstrapHealth()); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	})
+	return mux
+}
+
+func writeProbe(w http.ResponseWriter, err error) {
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "ok")
+}
+
+// serveProbes at the probe address until the context is done. Admin APIs are
+// never served alongside the probes (see serveAdmin).
+func (peer *peer) serveProbes(ctx context.Context) {
+	peer.serveHTTP(ctx, "probes", peer.options.ProbeAddress, NewProbeHandler(peer))
+}
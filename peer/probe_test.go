@@ -0,0 +1,75 @@
+package peer_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/testutil"
+
+	"github.com/renproject/aw/peer"
+	"github.com/renproject/aw/protocol"
+	"github.com/sirupsen/logrus"
+)
+
+// freeAddress returns a loopback address that is not being listened on.
+func freeAddress() string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).NotTo(HaveOccurred())
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+var _ = Describe("Probes", func() {
+	newPeer := func(probeAddress string) peer.Peer {
+		me := RandomAddress()
+		options := peer.Options{
+			Me:              me,
+			ProbeAddress:    probeAddress,
+			ReadyMinPeers:   2,
+			LivenessTimeout: 100 * time.Millisecond,
+		}
+		return peer.New(options, logrus.New(), NewSimpleTCPPeerAddressCodec(), NewDHT(me, NewTable("dht"), nil), nil, mockClient(make(chan protocol.MessageOnTheWire, 128)), mockServer(nil), make(chan protocol.Event))
+	}
+
+	probe := func(url string) int {
+		response, err := http.Get(url)
+		if err != nil {
+			return 0
+		}
+		defer response.Body.Close()
+		return response.StatusCode
+	}
+
+	Context("when the peer is not running", func() {
+		It("should be neither live nor ready", func() {
+			p := newPeer("")
+			Expect(p.Live(context.Background())).NotTo(Succeed())
+			Expect(p.Ready()).NotTo(Succeed())
+		})
+	})
+
+	Context("when the peer is running", func() {
+		It("should be live, and ready once it knows enough peers", func() {
+			probeAddress := freeAddress()
+			p := newPeer(probeAddress)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go p.Run(ctx)
+
+			Eventually(func() error { return p.Live(ctx) }).Should(Succeed())
+			Eventually(func() int { return probe("http://" + probeAddress + "/healthz") }).Should(Equal(http.StatusOK))
+			Expect(p.Ready()).NotTo(Succeed())
+			Expect(probe("http://" + probeAddress + "/readyz")).Should(Equal(http.StatusServiceUnavailable))
+
+			for _, addr := range RandomAddresses(2) {
+				Expect(p.AddPeerAddress(addr)).To(Succeed())
+			}
+			Eventually(p.Ready).Should(Succeed())
+			Expect(probe("http://" + probeAddress + "/readyz")).Should(Equal(http.StatusOK))
+		})
+	})
+})
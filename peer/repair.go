@@ -0,0 +1,174 @@
+package peer
+
+import (
+	"context"
+	"time"
+
+	"github.com/renproject/aw/protocol"
+	"github.com/renproject/phi"
+)
+
+// groupHealth is whether a group added to the Peer is degraded. Groups are not
+// judged until they have been added for the GroupReachabilityWindow, so that
+// members have had time to be seen.
+type groupHealth struct {
+	added    time.Time
+	degraded bool
+}
+
+// trackGroup starts judging the health of the group, if the repair of groups
+// is enabled.
+func (peer *peer) trackGroup(groupID protocol.GroupID) {
+	if peer.options.GroupRepairInterval <= 0 {
+		return
+	}
+
+	peer.groupHealthMu.Lock()
+	defer peer.groupHealthMu.Unlock()
+
+	if _, ok := peer.groupHealth[groupID]; !ok {
+		peer.groupHealth[groupID] = &groupHealth{added: time.Now()}
+	}
+}
+
+func (peer *peer) untrackGroup(groupID protocol.GroupID) {
+	peer.groupHealthMu.Lock()
+	defer peer.groupHealthMu.Unlock()
+
+	delete(peer.groupHealth, groupID)
+}
+
+// repairGroups probes the members of every tracked group that have not been
+// seen since the last repair. Groups in which too few members have been seen
+// within the GroupReachabilityWindow are degraded, and are repaired by
+// re-bootstrapping, and by looking up the members that are not in the DHT.
+// Peers are bootstrapped at most once, no matter how many groups are degraded.
+func (peer *peer) repairGroups(ctx context.Context) {
+	peer.groupHealthMu.Lock()
+	groupIDs := make([]protocol.GroupID, 0, len(peer.groupHealth))
+	for groupID := range peer.groupHealth {
+		groupIDs = append(groupIDs, groupID)
+	}
+	peer.groupHealthMu.Unlock()
+
+	bootstrapped := false
+	for _, groupID := range groupIDs {
+		ids, err := peer.dht.GroupIDs(groupID)
+		if err != nil {
+			peer.logger.Errorf("error repairing group=%v: error loading members: %v", groupID, err)
+			continue
+		}
+		now := time.Now()
+		me := peer.dht.Me().PeerID()
+		reachable, total := 0, 0
+		idle := make(protocol.PeerIDs, 0, len(ids))
+		for _, id := range ids {
+			if id.Equal(me) {
+				continue
+			}
+			total++
+			sinceSeen := now.Sub(peer.stats.lastSeen(id))
+			if sinceSeen <= peer.options.GroupReachabilityWindow {
+				reachable++
+			}
+			if sinceSeen > peer.options.GroupRepairInterval {
+				idle = append(idle, id)
+			}
+		}
+		if total == 0 {
+			continue
+		}
+
+		degraded, ok := peer.judgeGroup(ctx, groupID, reachable, total, now)
+		if !ok {
+			continue
+		}
+		if degraded && !bootstrapped && !peer.options.DisablePeerDiscovery {
+			peer.bootstrap(ctx)
+			bootstrapped = true
+		}
+		peer.probeMembers(ctx, idle, degraded, bootstrapped)
+	}
+}
+
+// judgeGroup updates whether the group is degraded, and emits an event when it
+// changes. It returns false if the group is no longer tracked.
+func (peer *peer) judgeGroup(ctx context.Context, groupID protocol.GroupID, reachable, total int, now time.Time) (bool, bool) {
+	peer.groupHealthMu.Lock()
+	health, ok := peer.groupHealth[groupID]
+	if !ok {
+		peer.groupHealthMu.Unlock()
+		return false, false
+	}
+	if now.Sub(health.added) < peer.options.GroupReachabilityWindow {
+		peer.groupHealthMu.Unlock()
+		return false, true
+	}
+	wasDegraded := health.degraded
+	health.degraded = float64(reachable) < peer.options.GroupReachabilityThreshold*float64(total)
+	degraded := health.degraded
+	peer.groupHealthMu.Unlock()
+
+	var event protocol.Event
+	switch {
+	case degraded && !wasDegraded:
+		peer.logger.Infof("group=%v is degraded: %v/%v peers reachable", groupID, reachable, total)
+		event = protocol.EventGroupDegraded{
+			Time:           now,
+			GroupID:        groupID,
+			ReachablePeers: reachable,
+			TotalPeers:     total,
+		}
+	case !degraded && wasDegraded:
+		peer.logger.Infof("group=%v is repaired: %v/%v peers reachable", groupID, reachable, total)
+		event = protocol.EventGroupRepaired{
+			Time:           now,
+			GroupID:        groupID,
+			ReachablePeers: reachable,
+			TotalPeers:     total,
+		}
+	default:
+		return degraded, true
+	}
+	select {
+	case <-ctx.Done():
+	case peer.events <- event:
+	}
+	return degraded, true
+}
+
+// probeMembers pings the members that have not been seen recently, unless they
+// have just been pinged by bootstrapping. Members that are not in the DHT are
+// looked up first, but only when their group is degraded.
+func (peer *peer) probeMembers(ctx context.Context, ids protocol.PeerIDs, degraded, bootstrapped bool) {
+	missing := make(protocol.PeerIDs, 0, len(ids))
+	for _, id := range ids {
+		if peerAddr, err := peer.dht.PeerAddress(id); err != nil || peerAddr == nil {
+			missing = append(missing, id)
+			continue
+		}
+		if !bootstrapped {
+			peer.ping(ctx, id)
+		}
+	}
+	if !degraded {
+		return
+	}
+	phi.ParForAll(missing, func(i int) {
+		findCtx, findCancel := context.WithTimeout(ctx, peer.options.MaxPingTimeout)
+		defer findCancel()
+		if _, err := peer.nodeFinder.FindNode(findCtx, missing[i]); err != nil {
+			peer.logger.Errorf("error repairing group: error looking up peer=%v: %v", missing[i], err)
+			return
+		}
+		peer.ping(ctx, missing[i])
+	})
+}
+
+func (peer *peer) ping(ctx context.Context, id protocol.PeerID) {
+	pingCtx, pingCancel := context.WithTimeout(ctx, peer.options.MaxPingTimeout)
+	defer pingCancel()
+	if err := peer.pingPonger.Ping(pingCtx, id); err != nil {
+		peer.logger.Errorf("error repairing group: error pinging peer=%v: %v", id, err)
+	}
+}
@@ -0,0 +1,188 @@
+package peer_test
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/testutil"
+
+	"github.com/renproject/aw/peer"
+	"github.com/renproject/aw/protocol"
+	"github.com/sirupsen/logrus"
+)
+
+// churn is the set of peers that are online. Online peers respond to the
+// pings they are sent.
+type churn struct {
+	mu     *sync.Mutex
+	online map[string]bool
+}
+
+func newChurn(addrs protocol.PeerAddresses) churn {
+	c := churn{mu: new(sync.Mutex), online: map[string]bool{}}
+	c.set(addrs, true)
+	return c
+}
+
+func (c churn) set(addrs protocol.PeerAddresses, online bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, addr := range addrs {
+		c.online[addr.PeerID().String()] = online
+	}
+}
+
+func (c churn) isOnline(addr protocol.PeerAddress) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.online[addr.PeerID().String()]
+}
+
+// respond to the pings sent to online peers with a pong.
+func (c churn) respond(ctx context.Context, sent, received chan protocol.MessageOnTheWire) {
+	codec := NewSimpleTCPPeerAddressCodec()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case messageOtw := <-sent:
+			if messageOtw.Message.Variant != protocol.Ping || !c.isOnline(messageOtw.To) {
+				continue
+			}
+			body, err := codec.Encode(messageOtw.To)
+			Expect(err).ToNot(HaveOccurred())
+			pong := protocol.MessageOnTheWire{
+				From:    messageOtw.To.PeerID(),
+				Message: protocol.NewMessage(protocol.V1, protocol.Pong, protocol.NilGroupID, body),
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case received <- pong:
+			}
+		}
+	}
+}
+
+var _ = Describe("Group repair", func() {
+	newRepairingPeer := func(addrs protocol.PeerAddresses) (peer.Peer, chan protocol.MessageOnTheWire, chan protocol.MessageOnTheWire, chan protocol.Event) {
+		me := RandomAddress()
+		dht := NewDHT(me, NewTable("dht"), nil)
+		for _, addr := range addrs {
+			Expect(dht.AddPeerAddress(addr)).To(Succeed())
+		}
+
+		sent := make(chan protocol.MessageOnTheWire, 128)
+		received := make(chan protocol.MessageOnTheWire, 128)
+		events := make(chan protocol.Event, 128)
+		options := peer.Options{
+			Me:                      me,
+			GroupRepairInterval:     50 * time.Millisecond,
+			GroupReachabilityWindow: 200 * time.Millisecond,
+		}
+		p := peer.New(options, logrus.New(), NewSimpleTCPPeerAddressCodec(), dht, nil, mockClient(sent), mockServer(received), events)
+		return p, sent, received, events
+	}
+
+	// groupEvents returns a function that returns the next group event, or
+	// nil if there is none.
+	groupEvents := func(events chan protocol.Event) func() protocol.Event {
+		return func() protocol.Event {
+			for {
+				select {
+				case event := <-events:
+					switch event.(type) {
+					case protocol.EventGroupDegraded, protocol.EventGroupRepaired:
+						return event
+					}
+				default:
+					return nil
+				}
+			}
+		}
+	}
+
+	Context("when members of a group churn", func() {
+		It("should emit an event when the group is degraded, and when it is repaired", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			addrs := RandomAddresses(4)
+			p, sent, received, events := newRepairingPeer(addrs)
+			groupID := RandomGroupID()
+			Expect(p.AddGroup(groupID, FromAddressesToIDs(addrs))).To(Succeed())
+
+			members := newChurn(addrs)
+			go members.respond(ctx, sent, received)
+			go p.Run(ctx)
+			Consistently(groupEvents(events), time.Second).Should(BeNil())
+
+			// Three of the four members go offline
+			members.set(addrs[1:], false)
+			var event protocol.Event
+			Eventually(groupEvents(events), 2*time.Second).Should(BeAssignableToTypeOf(protocol.EventGroupDegraded{}))
+			Consistently(groupEvents(events), 500*time.Millisecond).Should(BeNil())
+
+			// Two of them come back online
+			members.set(addrs[1:3], true)
+			Eventually(func() protocol.Event {
+				event = groupEvents(events)()
+				return event
+			}, 2*time.Second).Should(BeAssignableToTypeOf(protocol.EventGroupRepaired{}))
+			Expect(event.(protocol.EventGroupRepaired).GroupID).To(Equal(groupID))
+			Expect(event.(protocol.EventGroupRepaired).ReachablePeers).To(Equal(3))
+			Expect(event.(protocol.EventGroupRepaired).TotalPeers).To(Equal(4))
+		})
+
+		It("should look up members that are not in the DHT once the group is degraded", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			addrs := RandomAddresses(3)
+			p, sent, _, events := newRepairingPeer(addrs[:1])
+			groupID := RandomGroupID()
+			Expect(p.AddGroup(groupID, FromAddressesToIDs(addrs))).To(Succeed())
+			go p.Run(ctx)
+
+			var event protocol.Event
+			Eventually(func() protocol.Event {
+				event = groupEvents(events)()
+				return event
+			}, 2*time.Second).Should(BeAssignableToTypeOf(protocol.EventGroupDegraded{}))
+			Expect(event.(protocol.EventGroupDegraded).ReachablePeers).To(Equal(0))
+			Expect(event.(protocol.EventGroupDegraded).TotalPeers).To(Equal(3))
+
+			Eventually(func() bool {
+				for {
+					select {
+					case messageOtw := <-sent:
+						if messageOtw.Message.Variant == protocol.FindNode {
+							return true
+						}
+					default:
+						return false
+					}
+				}
+			}, 2*time.Second).Should(BeTrue())
+		})
+
+		It("should not repair groups that are removed", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			addrs := RandomAddresses(2)
+			p, _, _, events := newRepairingPeer(addrs)
+			groupID := RandomGroupID()
+			Expect(p.AddGroup(groupID, FromAddressesToIDs(addrs))).To(Succeed())
+			p.RemoveGroup(groupID)
+			go p.Run(ctx)
+
+			Consistently(groupEvents(events), time.Second).Should(BeNil())
+		})
+	})
+})
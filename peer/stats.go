@@ -0,0 +1,290 @@
+package peer
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/renproject/aw/protocol"
+)
+
+// maxStatsPeers is the number of peers that statistics are kept for. The
+// statistics of the peer that was seen least recently are dropped when a new
+// peer is seen.
+const maxStatsPeers = 4096
+
+// rateWindow is the time constant of the rolling rates. Rates are
+// exponentially weighted, so that messages sent or received within the last
+// rateWindow dominate the rate.
+const rateWindow = time.Minute
+
+// maxRTT is the longest time that a response is waited for. Responses that are
+// received later are not used to estimate the round trip time, because
+// requests are not always responded to (e.g. pings that do not update the DHT
+// of the peer).
+const maxRTT = 10 * time.Second
+
+// responses are the variants of the responses to requests, by the variant of
+// the request. The round trip time to a peer is estimated from the time
+// between sending a request to the peer and receiving its response.
+var responses = map[protocol.MessageVariant]protocol.MessageVariant{
+	protocol.Ping:          protocol.Pong,
+	protocol.FindNode:      protocol.Nodes,
+	protocol.FindProviders: protocol.Providers,
+	protocol.GetValue:      protocol.Value,
+	protocol.QueryPeers:    protocol.AnswerPeers,
+}
+
+// VariantStats are the number of messages, and bytes of their bodies, of one
+// variant that were sent to, and received from, a peer, and the number of
+// messages received from the peer that were not handled within the timeout of
+// the variant.
+type VariantStats struct {
+	MessagesIn  uint64 `json:"messagesIn"`
+	MessagesOut uint64 `json:"messagesOut"`
+	BytesIn     uint64 `json:"bytesIn"`
+	BytesOut    uint64 `json:"bytesOut"`
+	Timeouts    uint64 `json:"timeouts"`
+}
+
+// Stats of a peer, as seen by this Peer. Messages are counted when they are
+// received from the server, and when they are sent to the client. Rates are
+// per second, rolling over the last minute. The RTT is a smoothed estimate of
+// the time between sending a request (e.g. a ping) and receiving its response,
+// and is zero until a response is received. Errors are the number of messages
+// from the peer that could not be handled, and Timeouts are the number of them
+// that were not handled within the HandlerTimeouts of the Peer. The Score is
+// the score of the peer at the server, if it keeps scores.
+type Stats struct {
+	Variants        map[protocol.MessageVariant]VariantStats `json:"variants"`
+	MessagesIn      uint64                                   `json:"messagesIn"`
+	MessagesOut     uint64                                   `json:"messagesOut"`
+	BytesIn         uint64                                   `json:"bytesIn"`
+	BytesOut        uint64                                   `json:"bytesOut"`
+	MessagesInRate  float64                                  `json:"messagesInRate"`
+	MessagesOutRate float64                                  `json:"messagesOutRate"`
+	BytesInRate     float64                                  `json:"bytesInRate"`
+	BytesOutRate    float64                                  `json:"bytesOutRate"`
+	LastSeen        time.Time                                `json:"lastSeen"`
+	RTT             time.Duration                            `json:"rtt"`
+	Errors          uint64                                   `json:"errors"`
+	Timeouts        uint64                                   `json:"timeouts"`
+	Score           int                                      `json:"score"`
+}
+
+// rate is an exponentially weighted rolling rate.
+type rate struct {
+	value   float64
+	updated time.Time
+}
+
+func (r *rate) add(n int, now time.Time) {
+	r.value = r.at(now) + float64(n)/rateWindow.Seconds()
+	r.updated = now
+}
+
+func (r *rate) at(now time.Time) float64 {
+	if r.updated.IsZero() {
+		return 0
+	}
+	return r.value * math.Exp(-now.Sub(r.updated).Seconds()/rateWindow.Seconds())
+}
+
+type statsEntry struct {
+	Stats
+	messagesIn, messagesOut, bytesIn, bytesOut rate
+
+	// Times at which requests were sent, by the variant of their response
+	requests map[protocol.MessageVariant]time.Time
+}
+
+// statsTracker keeps the Stats of the peers that this Peer has sent messages
+// to, or received messages from.
+type statsTracker struct {
+	mu      *sync.Mutex
+	entries map[string]*statsEntry
+}
+
+func newStatsTracker() *statsTracker {
+	return &statsTracker{
+		mu:      new(sync.Mutex),
+		entries: map[string]*statsEntry{},
+	}
+}
+
+// received records a message received from the peer.
+func (tracker *statsTracker) received(peerID protocol.PeerID, message protocol.Message) {
+	if peerID == nil {
+		return
+	}
+	now := time.Now()
+	bytes := len(message.Body)
+
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	entry := tracker.entry(peerID.String())
+	variant := entry.Variants[message.Variant]
+	variant.MessagesIn++
+	variant.BytesIn += uint64(bytes)
+	entry.Variants[message.Variant] = variant
+	entry.MessagesIn++
+	entry.BytesIn += uint64(bytes)
+	entry.messagesIn.add(1, now)
+	entry.bytesIn.add(bytes, now)
+	entry.LastSeen = now
+
+	if sent, ok := entry.requests[message.Variant]; ok {
+		delete(entry.requests, message.Variant)
+		// Smooth the estimate in the same way as TCP (see RFC 6298)
+		sample := now.Sub(sent)
+		if sample > maxRTT {
+			return
+		}
+		if entry.RTT == 0 {
+			entry.RTT = sample
+		} else {
+			entry.RTT = (7*entry.RTT + sample) / 8
+		}
+	}
+}
+
+// sent records a message sent to the peer.
+func (tracker *statsTracker) sent(peerID protocol.PeerID, message protocol.Message) {
+	now := time.Now()
+	bytes := len(message.Body)
+
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	entry := tracker.entry(peerID.String())
+	variant := entry.Variants[message.Variant]
+	variant.MessagesOut++
+	variant.BytesOut += uint64(bytes)
+	entry.Variants[message.Variant] = variant
+	entry.MessagesOut++
+	entry.BytesOut += uint64(bytes)
+	entry.messagesOut.add(1, now)
+	entry.bytesOut.add(bytes, now)
+
+	// Only the first of concurrent requests is timed, so that retries do not
+	// shorten the estimate
+	if response, ok := responses[message.Variant]; ok {
+		if sent, ok := entry.requests[response]; !ok || now.Sub(sent) > maxRTT {
+			entry.requests[response] = now
+		}
+	}
+}
+
+// failed records a message from the peer that could not be handled.
+func (tracker *statsTracker) failed(peerID protocol.PeerID) {
+	if peerID == nil {
+		return
+	}
+
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	tracker.entry(peerID.String()).Errors++
+}
+
+// timedOut records a message from the peer that was not handled within the
+// timeout of its variant.
+func (tracker *statsTracker) timedOut(peerID protocol.PeerID, variant protocol.MessageVariant) {
+	if peerID == nil {
+		return
+	}
+
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	entry := tracker.entry(peerID.String())
+	variantStats := entry.Variants[variant]
+	variantStats.Timeouts++
+	entry.Variants[variant] = variantStats
+	entry.Timeouts++
+}
+
+// lastSeen returns the time at which a message was last received from the
+// peer, or the zero time if no message has been received from it.
+func (tracker *statsTracker) lastSeen(peerID protocol.PeerID) time.Time {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	entry, ok := tracker.entries[peerID.String()]
+	if !ok {
+		return time.Time{}
+	}
+	return entry.LastSeen
+}
+
+// stats returns a copy of the Stats of the peer.
+func (tracker *statsTracker) stats(peerID protocol.PeerID) Stats {
+	now := time.Now()
+
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	entry, ok := tracker.entries[peerID.String()]
+	if !ok {
+		return Stats{Variants: map[protocol.MessageVariant]VariantStats{}}
+	}
+	stats := entry.Stats
+	stats.Variants = make(map[protocol.MessageVariant]VariantStats, len(entry.Variants))
+	for variant, variantStats := range entry.Variants {
+		stats.Variants[variant] = variantStats
+	}
+	stats.MessagesInRate = entry.messagesIn.at(now)
+	stats.MessagesOutRate = entry.messagesOut.at(now)
+	stats.BytesInRate = entry.bytesIn.at(now)
+	stats.BytesOutRate = entry.bytesOut.at(now)
+	return stats
+}
+
+// entry returns the entry of the peer, creating it if it does not exist. It
+// must be called while holding the mutex.
+func (tracker *statsTracker) entry(id string) *statsEntry {
+	entry, ok := tracker.entries[id]
+	if ok {
+		return entry
+	}
+	if len(tracker.entries) >= maxStatsPeers {
+		tracker.evict()
+	}
+	entry = &statsEntry{
+		Stats: Stats{
+			Variants: map[protocol.MessageVariant]VariantStats{},
+		},
+		requests: map[protocol.MessageVariant]time.Time{},
+	}
+	tracker.entries[id] = entry
+	return entry
+}
+
+// evict the entry of the peer that was seen least recently. Peers that have
+// never been seen are evicted first.
+func (tracker *statsTracker) evict() {
+	var oldest string
+	var oldestSeen time.Time
+	first := true
+	for id, entry := range tracker.entries {
+		if first || entry.LastSeen.Before(oldestSeen) {
+			oldest, oldestSeen, first = id, entry.LastSeen, false
+		}
+	}
+	delete(tracker.entries, oldest)
+}
+
+// scoredServer is a Server that keeps the scores of peers (e.g. the
+// tcp.Server).
+type scoredServer interface {
+	Score(protocol.PeerID) int
+}
+
+func (peer *peer) Stats(peerID protocol.PeerID) Stats {
+	stats := peer.stats.stats(peerID)
+	if server, ok := peer.server.(scoredServer); ok {
+		stats.Score = server.Score(peerID)
+	}
+	return stats
+}
@@ -0,0 +1,121 @@
+package peer
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/renproject/aw/protocol"
+)
+
+// A wiring declares the components of a Peer, and the components that every
+// one of them depends on, so that every component is built, and started, after
+// its dependencies. Alternate assemblies of a Peer (e.g. observers, and
+// relay-only peers) declare different components, or different dependencies,
+// without having to order them by hand.
+type wiring struct {
+	components map[string]*component
+	declared   []string // Names of the components, in the order they were declared
+
+	built []*component // Components in the order they were built
+}
+
+// A component of a Peer. Its build function returns the component once its
+// dependencies have been built. Components that are protocol.Runners are run
+// by the Peer.
+type component struct {
+	name  string
+	deps  []string
+	build func() interface{}
+	value interface{}
+}
+
+func newWiring() *wiring {
+	return &wiring{
+		components: map[string]*component{},
+	}
+}
+
+// declare a component with the names of the components that it depends on.
+// Declaring a component twice replaces it.
+func (w *wiring) declare(name string, deps []string, build func() interface{}) {
+	if _, ok := w.components[name]; !ok {
+		w.declared = append(w.declared, name)
+	}
+	w.components[name] = &component{name: name, deps: deps, build: build}
+}
+
+// order returns the components in an order in which every component comes
+// after its dependencies. Components that do not depend on each other are kept
+// in the order they were declared. It returns an error if a component depends
+// on a component that has not been declared, or if the dependencies have a
+// cycle.
+func (w *wiring) order() ([]*component, error) {
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := map[string]int{}
+	ordered := make([]*component, 0, len(w.components))
+	path := []string{}
+
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch state[name] {
+		case visited:
+			return nil
+		case visiting:
+			for i := range path {
+				if path[i] == name {
+					return fmt.Errorf("dependency cycle: %v", strings.Join(append(path[i:], name), " -> "))
+				}
+			}
+		}
+		component := w.components[name]
+		state[name] = visiting
+		path = append(path, name)
+		for _, dep := range component.deps {
+			if _, ok := w.components[dep]; !ok {
+				return fmt.Errorf("component=%v depends on undeclared component=%v", name, dep)
+			}
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		state[name] = visited
+		ordered = append(ordered, component)
+		return nil
+	}
+	for _, name := range w.declared {
+		if err := visit(name); err != nil {
+			return nil, err
+		}
+	}
+	return ordered, nil
+}
+
+// build all of the components in order.
+func (w *wiring) build() error {
+	ordered, err := w.order()
+	if err != nil {
+		return err
+	}
+	for _, component := range ordered {
+		component.value = component.build()
+	}
+	w.built = ordered
+	return nil
+}
+
+// runners returns the components that are protocol.Runners, in the order they
+// were built, so that they are started after their dependencies, and stopped
+// before them.
+func (w *wiring) runners() []protocol.Runner {
+	runners := []protocol.Runner{}
+	for _, component := range w.built {
+		if runner, ok := component.value.(protocol.Runner); ok {
+			runners = append(runners, runner)
+		}
+	}
+	return runners
+}
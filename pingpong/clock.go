@@ -0,0 +1,93 @@
+package pingpong
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/renproject/aw/protocol"
+)
+
+// maxClockPeers is the number of peers that offsets are kept for. The offset
+// that was observed least recently is dropped when a new peer is observed.
+const maxClockPeers = 256
+
+// maxPongDelay is the longest time that a pong is waited for. Pongs that are
+// received later are not used to estimate the offset of the local clock,
+// because the longer the round trip, the less accurate the estimate.
+const maxPongDelay = 10 * time.Second
+
+// A Clock estimates the offset of the local clock from the clocks of other
+// peers, in the same way as NTP. Peers respond to pings with pongs that carry
+// the time at which they were sent, and the offset from a peer is the
+// difference between that time and the midpoint of the round trip. The offset
+// of the local clock is the median of the offsets from all peers, so that a
+// minority of peers with drifting (or lying) clocks cannot skew it.
+type Clock struct {
+	mu      *sync.Mutex
+	offsets map[string]clockSample
+}
+
+type clockSample struct {
+	offset   time.Duration
+	observed time.Time
+}
+
+// NewClock returns a Clock that has not observed any peers, and has no offset.
+func NewClock() *Clock {
+	return &Clock{
+		mu:      new(sync.Mutex),
+		offsets: map[string]clockSample{},
+	}
+}
+
+// Observe a ping that was sent to the peer at the sent time, and responded to
+// with a pong that the peer sent at the remote time, and that was received at
+// the received time. The sent and received times are according to the local
+// clock.
+func (clock *Clock) Observe(peerID protocol.PeerID, sent, remote, received time.Time) {
+	if received.Before(sent) || received.Sub(sent) > maxPongDelay {
+		return
+	}
+	offset := remote.Sub(sent.Add(received.Sub(sent) / 2))
+
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+
+	key := peerID.String()
+	if _, ok := clock.offsets[key]; !ok && len(clock.offsets) >= maxClockPeers {
+		oldest := ""
+		for k, sample := range clock.offsets {
+			if oldest == "" || sample.observed.Before(clock.offsets[oldest].observed) {
+				oldest = k
+			}
+		}
+		delete(clock.offsets, oldest)
+	}
+	clock.offsets[key] = clockSample{offset: offset, observed: received}
+}
+
+// Offset returns the estimated offset of the clocks of other peers from the
+// local clock, or zero if no peers have been observed.
+func (clock *Clock) Offset() time.Duration {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+
+	if len(clock.offsets) == 0 {
+		return 0
+	}
+	offsets := make([]time.Duration, 0, len(clock.offsets))
+	for _, sample := range clock.offsets {
+		offsets = append(offsets, sample.offset)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	if len(offsets)%2 == 0 {
+		return (offsets[len(offsets)/2-1] + offsets[len(offsets)/2]) / 2
+	}
+	return offsets[len(offsets)/2]
+}
+
+// Now returns the local time corrected by the estimated Offset.
+func (clock *Clock) Now() time.Time {
+	return time.Now().Add(clock.Offset())
+}
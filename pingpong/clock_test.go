@@ -0,0 +1,55 @@
+package pingpong_test
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/pingpong"
+	. "github.com/renproject/aw/testutil"
+)
+
+var _ = Describe("Clock", func() {
+	Context("when no peers have been observed", func() {
+		It("should have no offset", func() {
+			clock := NewClock()
+			Expect(clock.Offset()).To(BeZero())
+			Expect(clock.Now()).To(BeTemporally("~", time.Now(), 100*time.Millisecond))
+		})
+	})
+
+	Context("when peers have been observed", func() {
+		It("should estimate the offset from the midpoint of the round trip", func() {
+			clock := NewClock()
+			sent := time.Now()
+			clock.Observe(RandomPeerID(), sent, sent.Add(time.Minute+time.Second), sent.Add(2*time.Second))
+			Expect(clock.Offset()).To(Equal(time.Minute))
+		})
+
+		It("should use the median offset of the peers", func() {
+			clock := NewClock()
+			sent := time.Now()
+			clock.Observe(RandomPeerID(), sent, sent.Add(time.Second), sent)
+			clock.Observe(RandomPeerID(), sent, sent.Add(2*time.Second), sent)
+			clock.Observe(RandomPeerID(), sent, sent.Add(time.Hour), sent)
+			Expect(clock.Offset()).To(Equal(2 * time.Second))
+		})
+
+		It("should only use the latest offset of a peer", func() {
+			clock := NewClock()
+			peerID := RandomPeerID()
+			sent := time.Now()
+			clock.Observe(peerID, sent, sent.Add(time.Hour), sent)
+			clock.Observe(peerID, sent, sent.Add(time.Second), sent)
+			Expect(clock.Offset()).To(Equal(time.Second))
+		})
+
+		It("should ignore round trips that are too long", func() {
+			clock := NewClock()
+			sent := time.Now()
+			clock.Observe(RandomPeerID(), sent, sent.Add(time.Hour), sent.Add(time.Minute))
+			clock.Observe(RandomPeerID(), sent, sent.Add(time.Hour), sent.Add(-time.Second))
+			Expect(clock.Offset()).To(BeZero())
+		})
+	})
+})
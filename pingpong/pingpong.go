@@ -3,11 +3,16 @@ package pingpong
 import (
 	"context"
 	"encoding/base64"
+	"encoding/binary"
 	"fmt"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/renproject/aw/dht"
 	"github.com/renproject/aw/protocol"
+	"github.com/renproject/id"
+	"github.com/renproject/kv"
 	"github.com/sirupsen/logrus"
 )
 
@@ -15,33 +20,143 @@ type Options struct {
 	Logger     logrus.FieldLogger
 	NumWorkers int
 	Alpha      int
+
+	// Store is optional. When set, the pings that have been propagated are
+	// recorded in it, instead of in memory, so that they can be persisted
+	// across restarts, and inspected (see ExtendedPingPonger.State). Pings
+	// that have been recorded within the SeenTTL are not propagated again, so
+	// that they cannot loop through the network. The Store must not be shared
+	// by PingPongers that are running at the same time, otherwise a ping that
+	// is recorded by one of them would not be propagated by the others.
+	Store   kv.Table
+	SeenTTL time.Duration // Defaults to 10 minutes
+	MaxSeen int           // Maximum number of pings that are recorded, defaults to 65536
+
+	// Clock is optional. When set, pongs carry the time at which they were
+	// sent, and the pongs that respond to the pings sent by the PingPonger are
+	// observed by the Clock to estimate the offset of the local clock. It must
+	// be set by all peers in the network, because pongs that carry a time
+	// cannot be decoded by peers that do not expect one, and vice versa.
+	Clock *Clock
+
+	// Piggyback is the number of recently seen PeerAddresses that are
+	// piggybacked onto pongs, so that fresh addresses are disseminated
+	// without relying on the propagation of pings alone. Piggybacked addresses
+	// are added to the DHT of the peer that receives the pong. It must be set
+	// by all peers in the network (although its value can differ), because
+	// pongs that carry addresses cannot be decoded by peers that do not
+	// expect them, and vice versa. Defaults to zero (i.e. nothing is
+	// piggybacked), and is capped at protocol.MaxPiggybackedAddresses.
+	Piggyback int
+
+	// FilterSelf stops the PingPonger from pinging the local peer, and from
+	// propagating pings to it when it is in the DHT (e.g. because another peer
+	// advertised its address). Pinging the local peer returns ErrPingingSelf.
+	FilterSelf bool
 }
 
+func (options *Options) setZerosToDefaults() {
+	if options.Store == nil {
+		options.Store = kv.NewTable(kv.NewMemDB(kv.GobCodec), "pingponger")
+	}
+	if options.SeenTTL <= 0 {
+		options.SeenTTL = 10 * time.Minute
+	}
+	if options.MaxSeen <= 0 {
+		options.MaxSeen = 65536
+	}
+	if options.Piggyback > protocol.MaxPiggybackedAddresses {
+		options.Piggyback = protocol.MaxPiggybackedAddresses
+	}
+}
+
+// ErrPingingSelf is returned when pinging the local peer, if the PingPonger
+// filters self.
+var ErrPingingSelf = protocol.NewError(protocol.ErrInvalid, "pinging self")
+
 type PingPonger interface {
 	Ping(ctx context.Context, to protocol.PeerID) error
 	AcceptPing(ctx context.Context, message protocol.Message) error
 	AcceptPong(ctx context.Context, message protocol.Message) error
 }
 
+// An ExtendedPingPonger is a PingPonger that reports on the pings that it has
+// propagated, and that can be run. The PingPongers returned by this package are
+// ExtendedPingPongers, so that a PingPonger can be type asserted to use these
+// features without breaking other implementations of the PingPonger.
+type ExtendedPingPonger interface {
+	PingPonger
+
+	// State returns the pings that have been propagated within the SeenTTL.
+	State() (State, error)
+
+	// Run until the context is done. The PingPonger has no background loops,
+	// so it can be used without running it.
+	protocol.Runner
+}
+
+// State of a PingPonger.
+type State struct {
+	Seen []SeenPing `json:"seen"` // Pings that have been propagated, oldest first
+}
+
+// SeenPing is a ping that has been propagated.
+type SeenPing struct {
+	Hash id.Hash   `json:"hash"` // SHA256 hash of the body of the ping
+	At   time.Time `json:"at"`   // Time at which the ping was first propagated
+}
+
 type pingPonger struct {
 	options  Options
-	dht      dht.DHT
+	dht      dht.ExtendedDHT
 	messages protocol.MessageSender
 	events   protocol.EventSender
 	codec    protocol.PeerAddressCodec
+
+	readiness protocol.Readiness
+
+	// seenMu serialises checking and recording pings, so that concurrent
+	// pings with the same body are only propagated once.
+	seenMu *sync.Mutex
+
+	// Times at which pings were sent, by the peer they were sent to. Only
+	// used when the PingPonger has a Clock.
+	pingsMu *sync.Mutex
+	pings   map[string]time.Time
 }
 
-func NewPingPonger(options Options, dht dht.DHT, messages protocol.MessageSender, events protocol.EventSender, codec protocol.PeerAddressCodec) PingPonger {
+func NewPingPonger(options Options, table dht.DHT, messages protocol.MessageSender, events protocol.EventSender, codec protocol.PeerAddressCodec) PingPonger {
+	options.setZerosToDefaults()
 	return &pingPonger{
 		options:  options,
-		dht:      dht,
+		dht:      dht.Extend(table),
 		messages: messages,
 		events:   events,
 		codec:    codec,
+
+		readiness: protocol.NewReadiness(),
+
+		seenMu: new(sync.Mutex),
+
+		pingsMu: new(sync.Mutex),
+		pings:   map[string]time.Time{},
 	}
 }
 
+func (pp *pingPonger) Run(ctx context.Context) error {
+	pp.readiness.Signal()
+	<-ctx.Done()
+	return nil
+}
+
+func (pp *pingPonger) Ready() <-chan struct{} {
+	return pp.readiness.Ready()
+}
+
 func (pp *pingPonger) Ping(ctx context.Context, to protocol.PeerID) error {
+	if pp.options.FilterSelf && to.Equal(pp.dht.Me().PeerID()) {
+		return ErrPingingSelf
+	}
 	peerAddr, err := pp.dht.PeerAddress(to)
 	if err != nil {
 		return err
@@ -60,6 +175,7 @@ func (pp *pingPonger) Ping(ctx context.Context, to protocol.PeerID) error {
 	case <-ctx.Done():
 		return ctx.Err()
 	case pp.messages <- messageWire:
+		pp.sentPing(to)
 		return nil
 	}
 }
@@ -94,6 +210,13 @@ func (pp *pingPonger) AcceptPing(ctx context.Context, message protocol.Message)
 		return err
 	}
 
+	// Pings that have already been propagated are not propagated again, even
+	// if the sender was forgotten in the meantime
+	firstSeen, err := pp.see(message.Body)
+	if err != nil || !firstSeen {
+		return err
+	}
+
 	// Propagating the ping will downgrade the ping to the version of this
 	// pinger/ponger
 	return pp.propagatePing(ctx, peerAddr.PeerID(), message.Body)
@@ -108,12 +231,81 @@ func (pp *pingPonger) AcceptPong(ctx context.Context, message protocol.Message)
 		return protocol.NewErrMessageVariantIsNotSupported(message.Variant)
 	}
 
-	peerAddr, err := pp.codec.Decode(message.Body)
+	body := message.Body
+	var remote time.Time
+	if pp.options.Clock != nil {
+		if len(body) < 8 {
+			return newErrDecodingMessage(fmt.Errorf("expected time, got len=%v", len(body)), protocol.Pong, message.Body)
+		}
+		remote = time.Unix(0, int64(binary.BigEndian.Uint64(body[len(body)-8:])))
+		body = body[:len(body)-8]
+	}
+	var piggybacked protocol.PeerAddresses
+	if pp.options.Piggyback > 0 {
+		var err error
+		if body, piggybacked, err = protocol.SplitPeerAddresses(body, pp.codec); err != nil {
+			return newErrDecodingMessage(err, protocol.Pong, message.Body)
+		}
+	}
+
+	peerAddr, err := pp.codec.Decode(body)
 	if err != nil {
 		return newErrDecodingMessage(err, protocol.Pong, message.Body)
 	}
-	_, err = pp.updatePeerAddress(ctx, peerAddr)
-	return err
+	if pp.options.Clock != nil {
+		if sent, ok := pp.receivedPong(peerAddr.PeerID()); ok {
+			pp.options.Clock.Observe(peerAddr.PeerID(), sent, remote, time.Now())
+		}
+	}
+	if _, err := pp.updatePeerAddress(ctx, peerAddr); err != nil {
+		return err
+	}
+
+	me := pp.dht.Me().PeerID()
+	for _, addr := range piggybacked {
+		if addr.PeerID().Equal(me) || addr.PeerID().Equal(peerAddr.PeerID()) {
+			continue
+		}
+		if _, err := pp.updatePeerAddress(ctx, addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sentPing records the time at which a ping was sent to the peer, so that the
+// Clock can observe the pong that responds to it. Pings that have not been
+// responded to within the maxPongDelay are forgotten.
+func (pp *pingPonger) sentPing(to protocol.PeerID) {
+	if pp.options.Clock == nil {
+		return
+	}
+	now := time.Now()
+
+	pp.pingsMu.Lock()
+	defer pp.pingsMu.Unlock()
+
+	for peerID, sent := range pp.pings {
+		if now.Sub(sent) > maxPongDelay {
+			delete(pp.pings, peerID)
+		}
+	}
+	// Only the first of concurrent pings is timed, so that retries do not
+	// shorten the round trip
+	if _, ok := pp.pings[to.String()]; !ok {
+		pp.pings[to.String()] = now
+	}
+}
+
+// receivedPong returns the time at which a ping was sent to the peer, and
+// forgets it, so that only the first pong that responds to it is observed.
+func (pp *pingPonger) receivedPong(from protocol.PeerID) (time.Time, bool) {
+	pp.pingsMu.Lock()
+	defer pp.pingsMu.Unlock()
+
+	sent, ok := pp.pings[from.String()]
+	delete(pp.pings, from.String())
+	return sent, ok
 }
 
 func (pp *pingPonger) pong(ctx context.Context, to protocol.PeerAddress) error {
@@ -121,6 +313,16 @@ func (pp *pingPonger) pong(ctx context.Context, to protocol.PeerAddress) error {
 	if err != nil {
 		return err
 	}
+	if pp.options.Piggyback > 0 {
+		if me, err = pp.piggyback(me, to.PeerID()); err != nil {
+			return err
+		}
+	}
+	if pp.options.Clock != nil {
+		now := make([]byte, 8)
+		binary.BigEndian.PutUint64(now, uint64(time.Now().UnixNano()))
+		me = append(me, now...)
+	}
 	messageWire := protocol.MessageOnTheWire{
 		To:      to,
 		Message: protocol.NewMessage(protocol.V1, protocol.Pong, protocol.NilGroupID, me),
@@ -133,14 +335,36 @@ func (pp *pingPonger) pong(ctx context.Context, to protocol.PeerAddress) error {
 	}
 }
 
+// piggyback the PeerAddresses of the peers that have been seen most recently
+// onto the body of a pong, except for the local peer and the recipient.
+func (pp *pingPonger) piggyback(body protocol.MessageBody, to protocol.PeerID) (protocol.MessageBody, error) {
+	recent, err := pp.dht.RecentPeerAddresses(pp.options.Piggyback + 2)
+	if err != nil {
+		return nil, err
+	}
+	me := pp.dht.Me().PeerID()
+	peerAddrs := make(protocol.PeerAddresses, 0, pp.options.Piggyback)
+	for _, addr := range recent {
+		if len(peerAddrs) == pp.options.Piggyback {
+			break
+		}
+		if addr.PeerID().Equal(me) || addr.PeerID().Equal(to) {
+			continue
+		}
+		peerAddrs = append(peerAddrs, addr)
+	}
+	return protocol.AppendPeerAddresses(body, pp.codec, peerAddrs)
+}
+
 func (pp *pingPonger) propagatePing(ctx context.Context, sender protocol.PeerID, body protocol.MessageBody) error {
 	peerAddrs, err := pp.dht.RandomPeerAddresses(protocol.NilGroupID, pp.options.Alpha)
 	if err != nil {
 		return err
 	}
 
+	me := pp.dht.Me().PeerID()
 	protocol.ParForAllAddresses(peerAddrs, pp.options.NumWorkers, func(addr protocol.PeerAddress) {
-		if addr.PeerID().Equal(sender) {
+		if addr.PeerID().Equal(sender) || (pp.options.FilterSelf && addr.PeerID().Equal(me)) {
 			return
 		}
 		messageWire := protocol.MessageOnTheWire{
@@ -175,6 +399,95 @@ func (pp *pingPonger) updatePeerAddress(ctx context.Context, peerAddr protocol.P
 	}
 }
 
+// State implements the PingPonger interface.
+func (pp *pingPonger) State() (State, error) {
+	seen, err := pp.loadSeen(time.Now())
+	if err != nil {
+		return State{}, err
+	}
+	return State{Seen: seen}, nil
+}
+
+// see records the ping with the given body, and returns whether it has not
+// been seen within the SeenTTL.
+func (pp *pingPonger) see(body protocol.MessageBody) (bool, error) {
+	pp.seenMu.Lock()
+	defer pp.seenMu.Unlock()
+
+	now := time.Now()
+	key := protocol.SHA256.Sum(body).String()
+	var at int64
+	switch err := pp.options.Store.Get(key, &at); err {
+	case nil:
+		if now.Sub(time.Unix(0, at)) < pp.options.SeenTTL {
+			return false, nil
+		}
+	case kv.ErrKeyNotFound:
+	default:
+		return false, fmt.Errorf("error loading ping hash=%v: %v", key, err)
+	}
+	if err := pp.options.Store.Insert(key, now.UnixNano()); err != nil {
+		return false, fmt.Errorf("error inserting ping hash=%v: %v", key, err)
+	}
+	return true, pp.prune(now)
+}
+
+// prune the pings that have expired once there are more than MaxSeen of them,
+// and then the oldest pings until there are at most three quarters of MaxSeen,
+// so that pruning is not needed for every ping.
+func (pp *pingPonger) prune(now time.Time) error {
+	size, err := pp.options.Store.Size()
+	if err != nil {
+		return fmt.Errorf("error loading number of pings: %v", err)
+	}
+	if size <= pp.options.MaxSeen {
+		return nil
+	}
+	seen, err := pp.loadSeen(time.Time{})
+	if err != nil {
+		return err
+	}
+	keep := pp.options.MaxSeen * 3 / 4
+	for i, ping := range seen {
+		if len(seen)-i <= keep && now.Sub(ping.At) < pp.options.SeenTTL {
+			break
+		}
+		if err := pp.options.Store.Delete(ping.Hash.String()); err != nil && err != kv.ErrKeyNotFound {
+			return fmt.Errorf("error deleting ping hash=%v: %v", ping.Hash, err)
+		}
+	}
+	return nil
+}
+
+// loadSeen returns the pings in the store, oldest first. If now is not zero,
+// the pings that have expired are skipped.
+func (pp *pingPonger) loadSeen(now time.Time) ([]SeenPing, error) {
+	seen := []SeenPing{}
+	iter := pp.options.Store.Iterator()
+	defer iter.Close()
+	for iter.Next() {
+		key, err := iter.Key()
+		if err != nil {
+			return nil, fmt.Errorf("error loading ping hash: %v", err)
+		}
+		var at int64
+		if err := iter.Value(&at); err != nil {
+			return nil, fmt.Errorf("error loading ping hash=%v: %v", key, err)
+		}
+		var hash id.Hash
+		if err := hash.UnmarshalText([]byte(key)); err != nil {
+			return nil, fmt.Errorf("error decoding ping hash=%v: %v", key, err)
+		}
+		ping := SeenPing{Hash: hash, At: time.Unix(0, at)}
+		if !now.IsZero() && now.Sub(ping.At) >= pp.options.SeenTTL {
+			continue
+		}
+		seen = append(seen, ping)
+	}
+	sort.Slice(seen, func(i, j int) bool { return seen[i].At.Before(seen[j].At) })
+	return seen, nil
+}
+
 func newErrDecodingMessage(err error, variant protocol.MessageVariant, message []byte) error {
-	return fmt.Errorf("cannot decode %v message [%v], err = %v", variant, base64.RawStdEncoding.EncodeToString(message), err)
+	return protocol.NewErrInvalidMessage(variant, fmt.Errorf("cannot decode [%v], err = %v", base64.RawStdEncoding.EncodeToString(message), err))
 }
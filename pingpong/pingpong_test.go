@@ -3,8 +3,11 @@ package pingpong_test
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
+	"errors"
 	"math/rand"
 	"testing/quick"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -92,6 +95,23 @@ var _ = Describe("Pingpong", func() {
 				Expect(quick.Check(test, nil)).NotTo(HaveOccurred())
 			})
 		})
+		Context("when pinging self, and self is filtered", func() {
+			It("should return an error without sending a ping", func() {
+				me := RandomAddress()
+				messages := make(chan protocol.MessageOnTheWire, 1)
+				events := make(chan protocol.Event, 1)
+				dht := NewDHT(me, NewTable("dht"), nil)
+				Expect(dht.AddPeerAddress(me)).NotTo(HaveOccurred())
+				options := TestOptions
+				options.FilterSelf = true
+				pingpong := NewPingPonger(options, dht, messages, events, SimpleTCPPeerAddressCodec{})
+
+				err := pingpong.Ping(context.Background(), me.ID)
+				Expect(errors.Is(err, ErrPingingSelf)).Should(BeTrue())
+				Expect(errors.Is(err, protocol.ErrInvalid)).Should(BeTrue())
+				Expect(messages).Should(BeEmpty())
+			})
+		})
 	})
 
 	Context("when accepting a ping", func() {
@@ -188,6 +208,75 @@ var _ = Describe("Pingpong", func() {
 			})
 		})
 
+		Context("when the ping has already been propagated", func() {
+			It("should not propagate it again, even after restarting with the same store", func() {
+				codec := SimpleTCPPeerAddressCodec{}
+				options := TestOptions
+				options.Store = NewTable("pingponger")
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				sender := RandomAddress()
+				data, err := codec.Encode(sender)
+				Expect(err).NotTo(HaveOccurred())
+				ping := protocol.NewMessage(protocol.V1, protocol.Ping, protocol.NilGroupID, data)
+
+				// The second pingponger replaces the first one
+				for i := 0; i < 2; i++ {
+					messages := make(chan protocol.MessageOnTheWire, 128)
+					events := make(chan protocol.Event, 2)
+					dht := NewDHT(RandomAddress(), NewTable("dht"), RandomAddresses(4))
+					pingpong := NewPingPonger(options, dht, messages, events, codec).(ExtendedPingPonger)
+
+					Expect(pingpong.AcceptPing(ctx, ping)).NotTo(HaveOccurred())
+					// Forgetting the sender makes the ping update the dht
+					// again, but it must not be propagated again
+					Expect(dht.RemovePeerAddress(sender.ID)).NotTo(HaveOccurred())
+					Expect(pingpong.AcceptPing(ctx, ping)).NotTo(HaveOccurred())
+
+					pings := 0
+					for len(messages) > 0 {
+						if message := <-messages; message.Message.Variant == protocol.Ping {
+							pings++
+						}
+					}
+					if i == 0 {
+						Expect(pings).To(Equal(4))
+					} else {
+						Expect(pings).To(BeZero())
+					}
+
+					state, err := pingpong.State()
+					Expect(err).NotTo(HaveOccurred())
+					Expect(state.Seen).To(HaveLen(1))
+					Expect(state.Seen[0].Hash).To(Equal(protocol.SHA256.Sum(data)))
+				}
+			})
+		})
+
+		Context("when more pings than the maximum have been propagated", func() {
+			It("should forget the oldest pings", func() {
+				codec := SimpleTCPPeerAddressCodec{}
+				options := TestOptions
+				options.MaxSeen = 4
+				messages := make(chan protocol.MessageOnTheWire, 128)
+				events := make(chan protocol.Event, 16)
+				pingpong := NewPingPonger(options, NewDHT(RandomAddress(), NewTable("dht"), nil), messages, events, codec).(ExtendedPingPonger)
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				for i := 0; i < 10; i++ {
+					data, err := codec.Encode(RandomAddress())
+					Expect(err).NotTo(HaveOccurred())
+					Expect(pingpong.AcceptPing(ctx, protocol.NewMessage(protocol.V1, protocol.Ping, protocol.NilGroupID, data))).NotTo(HaveOccurred())
+
+					state, err := pingpong.State()
+					Expect(err).NotTo(HaveOccurred())
+					Expect(len(state.Seen)).To(BeNumerically("<=", options.MaxSeen))
+				}
+			})
+		})
+
 		Context("when the message has wrong version or variant", func() {
 			It("should not update the dht", func() {
 				test := func() bool {
@@ -219,6 +308,33 @@ var _ = Describe("Pingpong", func() {
 			})
 		})
 
+		Context("when self is in the dht, and self is filtered", func() {
+			It("should not propagate the ping to self", func() {
+				me := RandomAddress()
+				messages := make(chan protocol.MessageOnTheWire, 128)
+				events := make(chan protocol.Event, 1)
+				dht := NewDHT(me, NewTable("dht"), RandomAddresses(8))
+				Expect(dht.AddPeerAddress(me)).NotTo(HaveOccurred())
+				codec := SimpleTCPPeerAddressCodec{}
+				options := TestOptions
+				options.FilterSelf = true
+				pingpong := NewPingPonger(options, dht, messages, events, codec)
+
+				sender := RandomAddress()
+				data, err := codec.Encode(sender)
+				Expect(err).NotTo(HaveOccurred())
+				ping := protocol.NewMessage(protocol.V1, protocol.Ping, protocol.NilGroupID, data)
+				Expect(pingpong.AcceptPing(context.Background(), ping)).NotTo(HaveOccurred())
+
+				// Expect a pong, and the ping to be propagated to every other peer
+				Expect(messages).Should(HaveLen(9))
+				for i := 0; i < 9; i++ {
+					message := <-messages
+					Expect(message.To.PeerID().Equal(me.PeerID())).Should(BeFalse())
+				}
+			})
+		})
+
 		Context("when the ping comes from self", func() {
 			It("should ignore the ping and not return any error", func() {
 				test := func() bool {
@@ -336,5 +452,131 @@ var _ = Describe("Pingpong", func() {
 				Expect(quick.Check(test, nil)).NotTo(HaveOccurred())
 			})
 		})
+
+		Context("when the pingponger has a clock", func() {
+			It("should estimate the offset of the clock from the pongs to its pings", func() {
+				messages := make(chan protocol.MessageOnTheWire, 128)
+				events := make(chan protocol.Event, 16)
+				dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+				codec := SimpleTCPPeerAddressCodec{}
+				options := TestOptions
+				options.Clock = NewClock()
+				pingpong := NewPingPonger(options, dht, messages, events, codec)
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				pong := func(from protocol.PeerAddress, at time.Time) protocol.Message {
+					data, err := codec.Encode(from)
+					Expect(err).NotTo(HaveOccurred())
+					remote := make([]byte, 8)
+					binary.BigEndian.PutUint64(remote, uint64(at.UnixNano()))
+					return protocol.NewMessage(protocol.V1, protocol.Pong, protocol.NilGroupID, append(data, remote...))
+				}
+
+				// Pongs that do not respond to a ping are not observed
+				to := RandomAddress()
+				Expect(pingpong.AcceptPong(ctx, pong(to, time.Now().Add(time.Hour)))).To(Succeed())
+				Expect(options.Clock.Offset()).To(BeZero())
+
+				Expect(pingpong.Ping(ctx, to.ID)).To(Succeed())
+				Eventually(messages).Should(Receive())
+				Expect(pingpong.AcceptPong(ctx, pong(to, time.Now().Add(time.Minute)))).To(Succeed())
+				Expect(options.Clock.Offset()).To(BeNumerically("~", time.Minute, time.Second))
+				Expect(options.Clock.Now()).To(BeTemporally("~", time.Now().Add(time.Minute), time.Second))
+
+				// Pongs without a time are rejected
+				data, err := codec.Encode(to)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(pingpong.AcceptPong(ctx, protocol.NewMessage(protocol.V1, protocol.Pong, protocol.NilGroupID, data[:4]))).To(HaveOccurred())
+			})
+
+			It("should respond to pings with pongs that carry the time", func() {
+				messages := make(chan protocol.MessageOnTheWire, 128)
+				events := make(chan protocol.Event, 16)
+				dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+				codec := SimpleTCPPeerAddressCodec{}
+				options := TestOptions
+				options.Clock = NewClock()
+				pingpong := NewPingPonger(options, dht, messages, events, codec)
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				sender := RandomAddress()
+				data, err := codec.Encode(sender)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(pingpong.AcceptPing(ctx, protocol.NewMessage(protocol.V1, protocol.Ping, protocol.NilGroupID, data))).To(Succeed())
+
+				var message protocol.MessageOnTheWire
+				Eventually(messages).Should(Receive(&message))
+				Expect(message.Message.Variant).To(Equal(protocol.Pong))
+				me, err := codec.Encode(dht.Me())
+				Expect(err).NotTo(HaveOccurred())
+				Expect(message.Message.Body).To(HaveLen(len(me) + 8))
+				Expect(bytes.Equal(message.Message.Body[:len(me)], me)).To(BeTrue())
+				at := time.Unix(0, int64(binary.BigEndian.Uint64(message.Message.Body[len(me):])))
+				Expect(at).To(BeTemporally("~", time.Now(), time.Second))
+			})
+		})
+
+		Context("when the pingponger piggybacks addresses", func() {
+			It("should piggyback recently seen addresses onto pongs, and add the addresses piggybacked onto pongs to the dht", func() {
+				messages := make(chan protocol.MessageOnTheWire, 128)
+				events := make(chan protocol.Event, 16)
+				dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+				codec := SimpleTCPPeerAddressCodec{}
+				options := TestOptions
+				options.Piggyback = 2
+				pingpong := NewPingPonger(options, dht, messages, events, codec)
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				fresh := RandomAddresses(3)
+				for _, addr := range fresh {
+					Expect(dht.AddPeerAddress(addr)).To(Succeed())
+					time.Sleep(time.Millisecond)
+				}
+				sender := RandomAddress()
+				data, err := codec.Encode(sender)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(pingpong.AcceptPing(ctx, protocol.NewMessage(protocol.V1, protocol.Ping, protocol.NilGroupID, data))).To(Succeed())
+
+				// The sender is seen most recently, but is not piggybacked
+				// onto its own pong
+				var message protocol.MessageOnTheWire
+				Eventually(messages).Should(Receive(&message))
+				Expect(message.Message.Variant).To(Equal(protocol.Pong))
+				body, piggybacked, err := protocol.SplitPeerAddresses(message.Message.Body, codec)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(piggybacked).To(Equal(protocol.PeerAddresses{fresh[2], fresh[1]}))
+				me, err := codec.Encode(dht.Me())
+				Expect(err).NotTo(HaveOccurred())
+				Expect(bytes.Equal(body, me)).To(BeTrue())
+
+				// Addresses piggybacked onto pongs are added to the dht, except
+				// for the local peer
+				from, unknown := RandomAddress(), RandomAddress()
+				data, err = codec.Encode(from)
+				Expect(err).NotTo(HaveOccurred())
+				data, err = protocol.AppendPeerAddresses(data, codec, protocol.PeerAddresses{unknown, dht.Me()})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(pingpong.AcceptPong(ctx, protocol.NewMessage(protocol.V1, protocol.Pong, protocol.NilGroupID, data))).To(Succeed())
+				for _, addr := range []protocol.PeerAddress{from, unknown} {
+					peerAddr, err := dht.PeerAddress(addr.PeerID())
+					Expect(err).NotTo(HaveOccurred())
+					Expect(peerAddr).To(Equal(addr))
+				}
+				num, err := dht.NumPeers()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(num).To(Equal(len(fresh) + 3))
+
+				// Pongs without piggybacked addresses are rejected
+				data, err = codec.Encode(from)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(pingpong.AcceptPong(ctx, protocol.NewMessage(protocol.V1, protocol.Pong, protocol.NilGroupID, data[:1]))).To(HaveOccurred())
+			})
+		})
 	})
 })
@@ -28,6 +28,29 @@ type PeerAddress interface {
 // PeerAddresses is a list of PeerAddress.
 type PeerAddresses []PeerAddress
 
+// A MultiPeerAddress is a PeerAddress of a peer that listens on several
+// network addresses at once (e.g. on different interfaces or transports), and
+// advertises all of them. The NetworkAddress is the preferred one.
+type MultiPeerAddress interface {
+	PeerAddress
+	NetworkAddresses() []net.Addr
+}
+
+// NetworkAddresses returns the network addresses of a peer in order of
+// preference. It returns all of the addresses of a MultiPeerAddress, and the
+// NetworkAddress of other PeerAddresses.
+func NetworkAddresses(addr PeerAddress) []net.Addr {
+	if multiAddr, ok := addr.(MultiPeerAddress); ok {
+		if netAddrs := multiAddr.NetworkAddresses(); len(netAddrs) > 0 {
+			return netAddrs
+		}
+	}
+	if netAddr := addr.NetworkAddress(); netAddr != nil {
+		return []net.Addr{netAddr}
+	}
+	return nil
+}
+
 // PeerAddressCodec can encode and decode between PeerAddress and bytes.
 type PeerAddressCodec interface {
 	Encode(PeerAddress) ([]byte, error)
@@ -40,6 +63,38 @@ type PeerIDCodec interface {
 	Decode([]byte) (PeerID, error)
 }
 
+// Subnet returns the subnet of the IP of a network address, using the given
+// prefix lengths for IPv4 and IPv6 addresses (e.g. 24 and 64). It returns
+// false if the network address does not have an IP.
+func Subnet(addr net.Addr, prefixIPv4, prefixIPv6 int) (string, bool) {
+	if addr == nil {
+		return "", false
+	}
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	case *net.UDPAddr:
+		ip = addr.IP
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return "", false
+		}
+		ip = net.ParseIP(host)
+	}
+	if ip == nil {
+		return "", false
+	}
+	mask := net.CIDRMask(prefixIPv6, 128)
+	if ip4 := ip.To4(); ip4 != nil {
+		mask = net.CIDRMask(prefixIPv4, 32)
+		ip = ip4
+	}
+	subnet := net.IPNet{IP: ip.Mask(mask), Mask: mask}
+	return subnet.String(), true
+}
+
 // GroupID uniquely identifies a group of PeerIDs.
 type GroupID [32]byte
 
@@ -54,7 +109,7 @@ func (id GroupID) Equal(another GroupID) bool {
 // ValidateGroupID checks if the GroupID is valid under the given message
 // variant
 func ValidateGroupID(groupID GroupID, variant MessageVariant) error {
-	if variant != Broadcast && variant != Multicast {
+	if variant != Broadcast && variant != Multicast && variant != CatchUp {
 		if groupID != NilGroupID {
 			return ErrInvalidGroupID
 		}
@@ -1,6 +1,7 @@
 package protocol_test
 
 import (
+	"net"
 	"testing/quick"
 
 	. "github.com/onsi/ginkgo"
@@ -10,6 +11,45 @@ import (
 )
 
 var _ = Describe("PeerAddress", func() {
+	Context("Subnet", func() {
+		It("should return the subnet of the IP of a network address", func() {
+			subnet, ok := Subnet(&net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 80}, 24, 64)
+			Expect(ok).To(BeTrue())
+			Expect(subnet).To(Equal("10.1.2.0/24"))
+
+			subnet, ok = Subnet(&net.TCPAddr{IP: net.ParseIP("2001:db8:1:2:3::4"), Port: 80}, 24, 48)
+			Expect(ok).To(BeTrue())
+			Expect(subnet).To(Equal("2001:db8:1::/48"))
+
+			subnet, ok = Subnet(&net.UnixAddr{Name: "10.1.2.3:80", Net: "unix"}, 16, 64)
+			Expect(ok).To(BeTrue())
+			Expect(subnet).To(Equal("10.1.0.0/16"))
+		})
+
+		It("should return false if the network address does not have an IP", func() {
+			_, ok := Subnet(nil, 24, 64)
+			Expect(ok).To(BeFalse())
+			_, ok = Subnet(&net.UnixAddr{Name: "/tmp/aw.sock", Net: "unix"}, 24, 64)
+			Expect(ok).To(BeFalse())
+		})
+	})
+
+	Context("NetworkAddresses", func() {
+		It("should return the network address of a PeerAddress", func() {
+			addr := NewSimpleTCPPeerAddress(RandomPeerID().String(), "10.1.2.3", "80")
+			Expect(NetworkAddresses(addr)).To(Equal([]net.Addr{addr.NetworkAddress()}))
+		})
+
+		It("should return all of the network addresses of a MultiPeerAddress", func() {
+			addr := NewSimpleMultiTCPPeerAddress(RandomPeerID().String(), "10.1.2.3", "80", "10.1.2.3:8080", "[::1]:80")
+			netAddrs := NetworkAddresses(addr)
+			Expect(netAddrs).Should(HaveLen(3))
+			Expect(netAddrs[0].String()).To(Equal("10.1.2.3:80"))
+			Expect(netAddrs[1].String()).To(Equal("10.1.2.3:8080"))
+			Expect(netAddrs[2].String()).To(Equal("[::1]:80"))
+		})
+	})
+
 	Context("GroupID", func() {
 		Context("when validating message GroupID", func() {
 			It("should be nil for Ping, Pong and Cast message", func() {
@@ -0,0 +1,212 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+// WireFormat is a machine-readable description of the wire format of messages,
+// so that peers can be built, and verified, in other languages. It is encoded
+// as JSON using its tags.
+type WireFormat struct {
+	ByteOrder string          `json:"byteOrder"`
+	Versions  []VersionFormat `json:"versions"`
+	Variants  []VariantFormat `json:"variants"`
+	Hashers   []HasherFormat  `json:"hashers"`
+	Frame     []FieldFormat   `json:"frame"` // Fields of framed messages (see FrameMagic)
+	Rules     []string        `json:"rules"` // Rules of the canonical encoding (see ValidateCanonicalMessage)
+}
+
+// VersionFormat describes the fields of the messages of a version, in the
+// order in which they are encoded.
+type VersionFormat struct {
+	Version MessageVersion `json:"version"`
+	Name    string         `json:"name"`
+	Fields  []FieldFormat  `json:"fields"`
+}
+
+// FieldFormat describes a field of a message. Fields with a Condition are only
+// encoded when the Condition holds.
+type FieldFormat struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Size        int    `json:"size"` // Size in bytes, or zero if the size is variable
+	Condition   string `json:"condition,omitempty"`
+	Description string `json:"description"`
+}
+
+// VariantFormat describes a variant of message.
+type VariantFormat struct {
+	Variant MessageVariant `json:"variant"`
+	Name    string         `json:"name"`
+	Grouped bool           `json:"grouped"` // Whether the messages of the variant have a group id
+}
+
+// HasherFormat describes a Hasher that can be declared by messages.
+type HasherFormat struct {
+	Hasher Hasher `json:"hasher"`
+	Name   string `json:"name"`
+}
+
+var (
+	lengthField = FieldFormat{
+		Name:        "length",
+		Type:        "uint32",
+		Size:        4,
+		Description: "length of the entire message in bytes, including the length itself",
+	}
+	versionField = FieldFormat{
+		Name:        "version",
+		Type:        "uint16",
+		Size:        2,
+		Description: "version of the message",
+	}
+	variantField = FieldFormat{
+		Name:        "variant",
+		Type:        "uint16",
+		Size:        2,
+		Description: "variant of the message",
+	}
+	hasherField = FieldFormat{
+		Name:        "hasher",
+		Type:        "uint8",
+		Size:        1,
+		Description: "hasher used to identify the message",
+	}
+	deadlineField = FieldFormat{
+		Name:        "deadline",
+		Type:        "int64",
+		Size:        8,
+		Description: "unix time in nanoseconds after which the message is dropped, or zero if there is no deadline",
+	}
+	groupIDField = FieldFormat{
+		Name:        "groupID",
+		Type:        "bytes",
+		Size:        32,
+		Condition:   "variant is grouped",
+		Description: "group that the message is sent to",
+	}
+	bodyField = FieldFormat{
+		Name:        "body",
+		Type:        "bytes",
+		Description: "body of the message, up to the length of the message",
+	}
+
+	frameMagicField = FieldFormat{
+		Name:        "magic",
+		Type:        "uint32",
+		Size:        4,
+		Description: "0xf2465741, which is longer than any unframed message can be",
+	}
+	frameFlagsField = FieldFormat{
+		Name:        "flags",
+		Type:        "uint16",
+		Size:        2,
+		Description: "reserved flags, which must be zero",
+	}
+	frameMessageField = FieldFormat{
+		Name:        "message",
+		Type:        "bytes",
+		Description: "message of any version, starting with its length",
+	}
+	frameChecksumField = FieldFormat{
+		Name:        "checksum",
+		Type:        "uint32",
+		Size:        4,
+		Description: "crc32 (castagnoli) of the flags and the message",
+	}
+)
+
+// DescribeWireFormat returns a description of the wire format of messages, with
+// all of the versions, variants and hashers that are supported.
+func DescribeWireFormat() WireFormat {
+	format := WireFormat{
+		ByteOrder: "little-endian",
+		Versions:  []VersionFormat{},
+		Variants:  []VariantFormat{},
+		Hashers:   []HasherFormat{},
+		Rules: []string{
+			"the length is the length of the header and the body",
+			"v1 messages are always identified using sha256",
+			"v2 messages do not declare sha256, because they are v1 messages",
+			"v3 messages declare a deadline, because otherwise they are v1 or v2 messages",
+			"only the messages of grouped variants encode a group id",
+			"messages are hashed using their v1 encoding, without a hasher or a deadline",
+			"messages of any version can be framed, by prefixing them with the frame magic and flags, and suffixing them with the checksum",
+			"frames do not set their reserved flags",
+		},
+		Frame: []FieldFormat{frameMagicField, frameFlagsField, frameMessageField, frameChecksumField},
+	}
+	for version := V1; ValidateMessageVersion(version) == nil; version++ {
+		fields := []FieldFormat{lengthField, versionField, variantField}
+		if version == V2 || version == V3 {
+			fields = append(fields, hasherField)
+		}
+		if version == V3 {
+			fields = append(fields, deadlineField)
+		}
+		fields = append(fields, groupIDField, bodyField)
+		format.Versions = append(format.Versions, VersionFormat{Version: version, Name: version.String(), Fields: fields})
+	}
+	for variant := Ping; ValidateMessageVariant(variant) == nil; variant++ {
+		format.Variants = append(format.Variants, VariantFormat{
+			Variant: variant,
+			Name:    variant.String(),
+			Grouped: variant == Broadcast || variant == Multicast || variant == CatchUp,
+		})
+	}
+	for hasher := SHA256; ValidateHasher(hasher) == nil; hasher++ {
+		format.Hashers = append(format.Hashers, HasherFormat{Hasher: hasher, Name: hasher.String()})
+	}
+	return format
+}
+
+// ValidateStream reads messages from the stream until it ends, and checks that
+// every one of them is encoded canonically (see UnmarshalBinaryStrict). It
+// returns the number of messages that conform, and an ErrInvalidStream for the
+// first message that does not, including a message that is cut off by the end
+// of the stream.
+func ValidateStream(r io.Reader) (int, error) {
+	offset := int64(0)
+	for n := 0; ; n++ {
+		var length MessageLength
+		if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
+			if err == io.EOF {
+				return n, nil
+			}
+			return n, NewErrInvalidStream(n, offset, err)
+		}
+		if uint32(length) == FrameMagic {
+			data, err := readFrame(r)
+			if err != nil {
+				return n, NewErrInvalidStream(n, offset, err)
+			}
+			var message Message
+			if err := message.UnmarshalBinaryStrict(data); err != nil {
+				return n, NewErrInvalidStream(n, offset, err)
+			}
+			offset += int64(len(data) + frameOverhead)
+			continue
+		}
+		if int(length) < Ping.NonBodyLength() {
+			return n, NewErrInvalidStream(n, offset, NewErrMessageLengthIsTooLow(length))
+		}
+
+		// The buffer grows as the message is read, so that a corrupt length
+		// does not allocate more than the stream has
+		data := new(bytes.Buffer)
+		binary.Write(data, binary.LittleEndian, length)
+		if _, err := io.CopyN(data, r, int64(length)-4); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return n, NewErrInvalidStream(n, offset, err)
+		}
+		var message Message
+		if err := message.UnmarshalBinaryStrict(data.Bytes()); err != nil {
+			return n, NewErrInvalidStream(n, offset, err)
+		}
+		offset += int64(length)
+	}
+}
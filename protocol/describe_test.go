@@ -0,0 +1,103 @@
+package protocol_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/protocol"
+	. "github.com/renproject/aw/testutil"
+)
+
+var _ = Describe("Wire format", func() {
+	Context("when describing the wire format", func() {
+		It("should describe every supported version, variant and hasher", func() {
+			format := DescribeWireFormat()
+			Expect(format.Versions).To(HaveLen(3))
+			Expect(format.Variants).To(HaveLen(int(AnswerPeers)))
+			Expect(format.Hashers).To(HaveLen(2))
+			Expect(format.Frame).To(HaveLen(4))
+
+			// The fixed fields of a version add up to the length of the
+			// header of its grouped variants
+			for _, version := range format.Versions {
+				size := 0
+				for _, field := range version.Fields {
+					size += field.Size
+				}
+				message := NewMessage(version.Version, Broadcast, RandomGroupID(), nil)
+				Expect(size).To(Equal(message.NonBodyLength()))
+			}
+
+			data, err := json.Marshal(format)
+			Expect(err).NotTo(HaveOccurred())
+			var decoded WireFormat
+			Expect(json.Unmarshal(data, &decoded)).To(Succeed())
+			Expect(decoded).To(Equal(format))
+		})
+	})
+
+	Context("when validating a stream", func() {
+		stream := func(messages ...Message) *bytes.Buffer {
+			buffer := new(bytes.Buffer)
+			for _, message := range messages {
+				data, err := message.MarshalBinary()
+				Expect(err).NotTo(HaveOccurred())
+				buffer.Write(data)
+			}
+			return buffer
+		}
+
+		It("should accept a stream of canonical messages", func() {
+			n, err := ValidateStream(stream(
+				NewMessage(V1, Cast, NilGroupID, RandomMessageBody()),
+				NewMessageWithHasher(Broadcast, RandomGroupID(), RandomMessageBody(), BLAKE3),
+				NewMessageWithDeadline(Multicast, RandomGroupID(), RandomMessageBody(), SHA256, time.Now()),
+			))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(n).To(Equal(3))
+		})
+
+		It("should accept a stream of framed and unframed messages", func() {
+			framed := NewMessageWithHasher(Broadcast, RandomGroupID(), RandomMessageBody(), BLAKE3)
+			framed.Framed = true
+			buffer := stream(framed, NewMessage(V1, Cast, NilGroupID, RandomMessageBody()), framed)
+			n, err := ValidateStream(buffer)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(n).To(Equal(3))
+		})
+
+		It("should reject a framed message with a corrupt checksum", func() {
+			framed := NewMessage(V1, Ping, NilGroupID, nil)
+			framed.Framed = true
+			buffer := stream(NewMessage(V1, Ping, NilGroupID, nil), framed)
+			buffer.Bytes()[buffer.Len()-1] ^= 0xFF
+			n, err := ValidateStream(buffer)
+			Expect(n).To(Equal(1))
+			Expect(errors.Is(err, ErrInvalid)).To(BeTrue())
+			Expect(err.(ErrInvalidStream).Offset).To(Equal(int64(8)))
+		})
+
+		It("should reject the first message that is not canonical", func() {
+			nonCanonical := NewMessage(V2, Cast, NilGroupID, RandomMessageBody())
+			buffer := stream(NewMessage(V1, Ping, NilGroupID, nil), nonCanonical)
+			n, err := ValidateStream(buffer)
+			Expect(n).To(Equal(1))
+			Expect(errors.Is(err, ErrInvalid)).To(BeTrue())
+			Expect(err.(ErrInvalidStream).Index).To(Equal(1))
+			Expect(err.(ErrInvalidStream).Offset).To(Equal(int64(8)))
+		})
+
+		It("should reject a message that is cut off", func() {
+			buffer := stream(NewMessage(V1, Cast, NilGroupID, RandomMessageBody()))
+			buffer.Truncate(buffer.Len() - 1)
+			n, err := ValidateStream(buffer)
+			Expect(n).To(BeZero())
+			Expect(errors.Is(err, io.ErrUnexpectedEOF)).To(BeTrue())
+		})
+	})
+})
@@ -5,12 +5,43 @@ import (
 	"fmt"
 )
 
+// Classes of errors. The errors returned by the packages of this module match
+// their class using errors.Is, so that callers can handle errors by their class
+// without knowing their type. Errors that are caused by another error also
+// match their cause (e.g. context.Canceled).
 var (
-	ErrInvalidGroupID = errors.New("invalid group id")
+	ErrNotFound    = errors.New("not found")
+	ErrInvalid     = errors.New("invalid")
+	ErrUnsupported = errors.New("unsupported")
+	ErrUnavailable = errors.New("unavailable")
+	ErrInternal    = errors.New("internal error")
+)
+
+var (
+	ErrInvalidGroupID = NewError(ErrInvalid, "invalid group id")
 
-	ErrInvalidMessageLength = errors.New("invalid message length")
+	ErrInvalidMessageLength = NewError(ErrInvalid, "invalid message length")
 )
 
+// NewError returns a new error with the given text that matches the given class
+// of errors. It is used to declare sentinel errors that belong to a class.
+func NewError(class error, text string) error {
+	return &classError{text: text, class: class}
+}
+
+type classError struct {
+	text  string
+	class error
+}
+
+func (err *classError) Error() string {
+	return err.text
+}
+
+func (err *classError) Is(target error) bool {
+	return target == err.class
+}
+
 type ErrMessageLengthIsTooLow struct {
 	error
 	Length MessageLength
@@ -25,6 +56,10 @@ func NewErrMessageLengthIsTooLow(length MessageLength) error {
 	}
 }
 
+func (err ErrMessageLengthIsTooLow) Unwrap() error {
+	return ErrInvalidMessageLength
+}
+
 type ErrMessageVersionIsNotSupported struct {
 	error
 	Version MessageVersion
@@ -39,6 +74,10 @@ func NewErrMessageVersionIsNotSupported(version MessageVersion) error {
 	}
 }
 
+func (err ErrMessageVersionIsNotSupported) Is(target error) bool {
+	return target == ErrUnsupported
+}
+
 type ErrMessageVariantIsNotSupported struct {
 	error
 	Variant MessageVariant
@@ -52,3 +91,161 @@ func NewErrMessageVariantIsNotSupported(variant MessageVariant) error {
 		Variant: variant,
 	}
 }
+
+func (err ErrMessageVariantIsNotSupported) Is(target error) bool {
+	return target == ErrUnsupported
+}
+
+type ErrPlaintextSession struct {
+	error
+	PeerID PeerID
+}
+
+// NewErrPlaintextSession creates a new error which is returned when a Session
+// with the given Peer is not encrypted, but the EncryptionPolicy requires it to
+// be.
+func NewErrPlaintextSession(peerID PeerID) error {
+	return ErrPlaintextSession{
+		error:  fmt.Errorf("plaintext session with peer=%v is not allowed", peerID),
+		PeerID: peerID,
+	}
+}
+
+type ErrHasherIsNotSupported struct {
+	error
+	Hasher Hasher
+}
+
+// NewErrHasherIsNotSupported creates a new error which is returned when the
+// given hasher is not supported.
+func NewErrHasherIsNotSupported(hasher Hasher) error {
+	return ErrHasherIsNotSupported{
+		error:  fmt.Errorf("hasher=%d is not supported", hasher),
+		Hasher: hasher,
+	}
+}
+
+func (err ErrHasherIsNotSupported) Is(target error) bool {
+	return target == ErrUnsupported
+}
+
+type ErrNonCanonicalMessage struct {
+	error
+	Variant MessageVariant
+}
+
+// NewErrNonCanonicalMessage creates a new error which is returned when strict
+// decoding reads a message of the given variant that is not encoded
+// canonically.
+func NewErrNonCanonicalMessage(variant MessageVariant, reason string) error {
+	return ErrNonCanonicalMessage{
+		error:   fmt.Errorf("non-canonical %v message: %v", variant, reason),
+		Variant: variant,
+	}
+}
+
+func (err ErrNonCanonicalMessage) Is(target error) bool {
+	return target == ErrInvalid
+}
+
+type ErrInvalidMessage struct {
+	error
+	Variant MessageVariant
+	cause   error
+}
+
+// NewErrInvalidMessage creates a new error which is returned when a message of
+// the given variant is rejected, because it is malformed or fails validation.
+func NewErrInvalidMessage(variant MessageVariant, err error) error {
+	return ErrInvalidMessage{
+		error:   fmt.Errorf("invalid %v message: %v", variant, err),
+		Variant: variant,
+		cause:   err,
+	}
+}
+
+func (err ErrInvalidMessage) Is(target error) bool {
+	return target == ErrInvalid
+}
+
+func (err ErrInvalidMessage) Unwrap() error {
+	return err.cause
+}
+
+type ErrInvalidStream struct {
+	error
+	Index  int   // Index of the message in the stream
+	Offset int64 // Offset of the message in the stream, in bytes
+	cause  error
+}
+
+// NewErrInvalidStream creates a new error which is returned when the message at
+// the given index, and offset, of a stream does not conform to the wire format.
+func NewErrInvalidStream(index int, offset int64, err error) error {
+	return ErrInvalidStream{
+		error:  fmt.Errorf("invalid message=%d at offset=%d: %v", index, offset, err),
+		Index:  index,
+		Offset: offset,
+		cause:  err,
+	}
+}
+
+func (err ErrInvalidStream) Is(target error) bool {
+	return target == ErrInvalid
+}
+
+func (err ErrInvalidStream) Unwrap() error {
+	return err.cause
+}
+
+type ErrInvalidFrame struct {
+	error
+}
+
+// NewErrInvalidFrame creates a new error which is returned when a framed
+// message is read with reserved flags that are set, or with a checksum that
+// does not match.
+func NewErrInvalidFrame(reason string) error {
+	return ErrInvalidFrame{
+		error: fmt.Errorf("invalid frame: %v", reason),
+	}
+}
+
+func (err ErrInvalidFrame) Is(target error) bool {
+	return target == ErrInvalid
+}
+
+// AddressError is the error of a single address in an ErrAddresses.
+type AddressError struct {
+	PeerAddress PeerAddress
+	Err         error
+}
+
+type ErrAddresses struct {
+	error
+	Errs []AddressError
+}
+
+// NewErrAddresses creates a new error which is returned when processing some of
+// the given addresses failed.
+func NewErrAddresses(errs []AddressError) error {
+	return ErrAddresses{
+		error: fmt.Errorf("%d address(es) failed, first error: %v", len(errs), errs[0].Err),
+		Errs:  errs,
+	}
+}
+
+// ErrRunners is returned by a RunGroup when some of its Runners failed.
+type ErrRunners struct {
+	error
+	Errs []error
+}
+
+// NewErrRunners creates a new error which is returned when running some of the
+// Runners of a RunGroup failed.
+func NewErrRunners(errs []error) error {
+	return ErrRunners{
+		error: fmt.Errorf("%d runner(s) failed, first error: %v", len(errs), errs[0]),
+		Errs:  errs,
+	}
+}
@@ -1 +1,45 @@
 package protocol_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/protocol"
+	. "github.com/renproject/aw/testutil"
+)
+
+var _ = Describe("Errors", func() {
+	Context("when matching errors by their class", func() {
+		It("should match sentinel errors with their class", func() {
+			err := NewError(ErrNotFound, "peer not found")
+			Expect(err.Error()).To(Equal("peer not found"))
+			Expect(errors.Is(err, err)).To(BeTrue())
+			Expect(errors.Is(err, ErrNotFound)).To(BeTrue())
+			Expect(errors.Is(err, ErrInvalid)).To(BeFalse())
+			Expect(errors.Is(ErrInvalidGroupID, ErrInvalid)).To(BeTrue())
+		})
+
+		It("should match typed errors with their class", func() {
+			Expect(errors.Is(NewErrMessageVersionIsNotSupported(InvalidMessageVersion()), ErrUnsupported)).To(BeTrue())
+			Expect(errors.Is(NewErrMessageVariantIsNotSupported(InvalidMessageVariant()), ErrUnsupported)).To(BeTrue())
+			Expect(errors.Is(NewErrNonCanonicalMessage(Ping, "trailing bytes"), ErrInvalid)).To(BeTrue())
+
+			err := NewErrMessageLengthIsTooLow(0)
+			Expect(errors.Is(err, ErrInvalidMessageLength)).To(BeTrue())
+			Expect(errors.Is(err, ErrInvalid)).To(BeTrue())
+			var tooLow ErrMessageLengthIsTooLow
+			Expect(errors.As(fmt.Errorf("error reading message: %w", err), &tooLow)).To(BeTrue())
+			Expect(tooLow.Length).To(Equal(MessageLength(0)))
+		})
+
+		It("should match invalid messages with their class and their cause", func() {
+			err := NewErrInvalidMessage(Ping, context.Canceled)
+			Expect(errors.Is(err, ErrInvalid)).To(BeTrue())
+			Expect(errors.Is(err, context.Canceled)).To(BeTrue())
+			Expect(errors.Is(err, ErrNotFound)).To(BeFalse())
+		})
+	})
+})
@@ -1,6 +1,10 @@
 package protocol
 
-import "time"
+import (
+	"time"
+
+	"github.com/renproject/id"
+)
 
 // EventSender is used for sending Event.
 type EventSender chan<- Event
@@ -22,12 +26,177 @@ type EventPeerChanged struct {
 // EventPeerChanged implements the Event interface.
 func (EventPeerChanged) IsEvent() {}
 
-// EventMessageReceived is triggered when we receive an AW message.
+// EventMessageReceived is triggered when we receive an AW message. The GroupID
+// is the group that the message was sent to, and is the NilGroupID for casts.
+// The Hash identifies the message, and is the same hash that was returned to
+// the application that sent it (e.g. in the Report of a broadcast), so that
+// sends can be correlated with their delivery. Identical messages have the same
+// Hash.
 type EventMessageReceived struct {
 	Time    time.Time
 	Message MessageBody
 	From    PeerID
+	GroupID GroupID
+	Hash    id.Hash
 }
 
 // EventMessageReceived implements the Event interface.
 func (EventMessageReceived) IsEvent() {}
+
+// EventBroadcastAcked is triggered when the fraction of peers that acknowledged
+// a reliable broadcast crosses one of the acknowledgement thresholds of the
+// Broadcaster. AckedPeers is the number of peers that acknowledged the message,
+// out of the TotalPeers that it was sent to.
+type EventBroadcastAcked struct {
+	Time       time.Time
+	Hash       id.Hash
+	GroupID    GroupID
+	AckedPeers int
+	TotalPeers int
+}
+
+// EventBroadcastAcked implements the Event interface.
+func (EventBroadcastAcked) IsEvent() {}
+
+// EventMessageRejected is triggered when a peer responds to a message that was
+// sent to it with a Nack. Variant and Hash identify the message that was
+// rejected (see NackBody), so that senders can adapt (e.g. by downgrading the
+// version of their messages, or backing off) instead of guessing.
+type EventMessageRejected struct {
+	Time    time.Time
+	From    PeerID
+	Variant MessageVariant
+	Hash    id.Hash
+	Reason  RejectReason
+}
+
+// EventMessageRejected implements the Event interface.
+func (EventMessageRejected) IsEvent() {}
+
+// EventBroadcastFailed is triggered when a reliable broadcast is no longer
+// resent, because it has been resent the maximum number of times or its
+// deadline has passed, before all of the peers it was sent to acknowledged it.
+// AckedPeers is the number of peers that acknowledged the message, out of the
+// TotalPeers that it was sent to.
+type EventBroadcastFailed struct {
+	Time       time.Time
+	Hash       id.Hash
+	GroupID    GroupID
+	AckedPeers int
+	TotalPeers int
+}
+
+// EventBroadcastFailed implements the Event interface.
+func (EventBroadcastFailed) IsEvent() {}
+
+// EventLoadShed is triggered when a subsystem of a Peer exceeds its budget of
+// goroutines or buffered bytes, and starts shedding messages. It is not
+// triggered again until the subsystem is back within its budget. Variant is the
+// variant of the first message that was shed, and Goroutines and Bytes are the
+// usage of the subsystem at that time.
+type EventLoadShed struct {
+	Time       time.Time
+	Subsystem  string
+	Variant    MessageVariant
+	Goroutines int
+	Bytes      int
+}
+
+// EventLoadShed implements the Event interface.
+func (EventLoadShed) IsEvent() {}
+
+// EventGroupDegraded is triggered when fewer of the other members of a group
+// are reachable than the reachability threshold of the Peer, and it starts
+// repairing its connectivity to the group. It is not triggered again until the
+// group has been repaired. ReachablePeers is the number of members that have
+// been seen recently, out of the TotalPeers in the group.
+type EventGroupDegraded struct {
+	Time           time.Time
+	GroupID        GroupID
+	ReachablePeers int
+	TotalPeers     int
+}
+
+// EventGroupDegraded implements the Event interface.
+func (EventGroupDegraded) IsEvent() {}
+
+// EventGroupRepaired is triggered when enough of the other members of a
+// degraded group are reachable again. ReachablePeers is the number of members
+// that have been seen recently, out of the TotalPeers in the group.
+type EventGroupRepaired struct {
+	Time           time.Time
+	GroupID        GroupID
+	ReachablePeers int
+	TotalPeers     int
+}
+
+// EventGroupRepaired implements the Event interface.
+func (EventGroupRepaired) IsEvent() {}
+
+// EventGroupExpired is triggered when a group is removed from a Peer, because
+// no messages were broadcast, or multicast, to it for the idle timeout of the
+// Peer. LastActive is the last time that the group was active.
+type EventGroupExpired struct {
+	Time       time.Time
+	GroupID    GroupID
+	LastActive time.Time
+}
+
+// EventGroupExpired implements the Event interface.
+func (EventGroupExpired) IsEvent() {}
+
+// EventPeerRateLimited is triggered when a Server starts rejecting the
+// connections from a remote IP, or dropping the messages of a peer, because
+// they exceed the rate limits of the Server. It is not triggered again until
+// the remote IP or peer is back within its limit. PeerID is nil when
+// connections are rejected, because they are rejected before the handshake.
+type EventPeerRateLimited struct {
+	Time       time.Time
+	PeerID     PeerID
+	RemoteAddr string
+	Messages   bool // True when messages are dropped, false when connections are rejected
+}
+
+// EventPeerRateLimited implements the Event interface.
+func (EventPeerRateLimited) IsEvent() {}
+
+// EventDowngraded is triggered when a handshake negotiates a weaker algorithm
+// than the one that is preferred locally, or when a session reads a message in
+// an older wire format than the one that it writes, so that operators can
+// detect peers that lag behind an upgrade (or that force downgrades). Kind is
+// what was downgraded (e.g. "suite" or "framing"), from the Preferred
+// algorithm or format to the Negotiated one. Refused is true when the
+// downgrade was refused, in which case the PeerID is nil if the handshake was
+// refused before the remote peer was authenticated.
+type EventDowngraded struct {
+	Time       time.Time
+	PeerID     PeerID
+	Kind       string
+	Preferred  string
+	Negotiated string
+	Refused    bool
+}
+
+// EventDowngraded implements the Event interface.
+func (EventDowngraded) IsEvent() {}
+
+// EventMessageDropped is triggered when a client gives up on sending a message
+// to a peer, because it could not be sent to any of the network addresses of
+// the peer after retrying, so that applications can act on peers that are
+// undeliverable (e.g. by finding their new addresses, or by sending the message
+// through another peer) instead of losing messages silently. Attempts is the
+// number of times that the message was sent to every address of the peer, and
+// Reason is the error of the last attempt. It is also triggered when a
+// MessageQueue drops a message because its lane is full, in which case
+// Attempts is zero.
+type EventMessageDropped struct {
+	Time     time.Time
+	PeerID   PeerID
+	Variant  MessageVariant
+	Hash     id.Hash
+	Attempts int
+	Reason   string
+}
+
+// EventMessageDropped implements the Event interface.
+func (EventMessageDropped) IsEvent() {}
@@ -18,4 +18,52 @@ var _ = Describe("Events", func() {
 			Expect(func() { EventMessageReceived{}.IsEvent() }).ToNot(Panic())
 		})
 	})
+
+	Context("when defining EventBroadcastAcked", func() {
+		It("should implement the Event interface", func() {
+			Expect(func() { EventBroadcastAcked{}.IsEvent() }).ToNot(Panic())
+		})
+	})
+
+	Context("when defining EventBroadcastFailed", func() {
+		It("should implement the Event interface", func() {
+			Expect(func() { EventBroadcastFailed{}.IsEvent() }).ToNot(Panic())
+		})
+	})
+
+	Context("when defining EventMessageRejected", func() {
+		It("should implement the Event interface", func() {
+			Expect(func() { EventMessageRejected{}.IsEvent() }).ToNot(Panic())
+		})
+	})
+
+	Context("when defining EventLoadShed", func() {
+		It("should implement the Event interface", func() {
+			Expect(func() { EventLoadShed{}.IsEvent() }).ToNot(Panic())
+		})
+	})
+
+	Context("when defining EventGroupDegraded", func() {
+		It("should implement the Event interface", func() {
+			Expect(func() { EventGroupDegraded{}.IsEvent() }).ToNot(Panic())
+		})
+	})
+
+	Context("when defining EventGroupRepaired", func() {
+		It("should implement the Event interface", func() {
+			Expect(func() { EventGroupRepaired{}.IsEvent() }).ToNot(Panic())
+		})
+	})
+
+	Context("when defining EventDowngraded", func() {
+		It("should implement the Event interface", func() {
+			Expect(func() { EventDowngraded{}.IsEvent() }).ToNot(Panic())
+		})
+	})
+
+	Context("when defining EventMessageDropped", func() {
+		It("should implement the Event interface", func() {
+			Expect(func() { EventMessageDropped{}.IsEvent() }).ToNot(Panic())
+		})
+	})
 })
@@ -0,0 +1,58 @@
+//go:build go1.21
+// +build go1.21
+
+package protocol
+
+import (
+	"context"
+)
+
+// An Emitter sends events of type T to an EventSender, so that components
+// that only emit one type of event cannot emit events of another type. The
+// events are received from the untyped EventReceiver as usual.
+type Emitter[T Event] struct {
+	events EventSender
+}
+
+// NewEmitter returns an Emitter of events of type T to the EventSender.
+func NewEmitter[T Event](events EventSender) Emitter[T] {
+	return Emitter[T]{events: events}
+}
+
+// Emit the event, blocking until it is sent or the context is done.
+func (emitter Emitter[T]) Emit(ctx context.Context, event T) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case emitter.events <- event:
+		return nil
+	}
+}
+
+// TryEmit the event without blocking. It returns false if the event could not
+// be sent.
+func (emitter Emitter[T]) TryEmit(event T) bool {
+	select {
+	case emitter.events <- event:
+		return true
+	default:
+		return false
+	}
+}
+
+// ReceiveEvent returns the next event of type T from the EventReceiver,
+// discarding events of other types, or an error if the context is done first.
+// It is intended for components that own their EventReceiver.
+func ReceiveEvent[T Event](ctx context.Context, events EventReceiver) (T, error) {
+	for {
+		select {
+		case <-ctx.Done():
+			var zero T
+			return zero, ctx.Err()
+		case event := <-events:
+			if typed, ok := event.(T); ok {
+				return typed, nil
+			}
+		}
+	}
+}
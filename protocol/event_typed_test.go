@@ -0,0 +1,45 @@
+//go:build go1.21
+// +build go1.21
+
+package protocol_test
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/protocol"
+)
+
+var _ = Describe("Typed events", func() {
+	Context("when emitting events", func() {
+		It("should send them to the untyped channel", func() {
+			events := make(chan Event, 1)
+			emitter := NewEmitter[EventLoadShed](events)
+			Expect(emitter.TryEmit(EventLoadShed{Subsystem: "inbound"})).To(BeTrue())
+			Expect(emitter.TryEmit(EventLoadShed{})).To(BeFalse())
+			Expect(<-events).To(Equal(EventLoadShed{Subsystem: "inbound"}))
+
+			Expect(emitter.Emit(context.Background(), EventLoadShed{})).To(Succeed())
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			Expect(emitter.Emit(ctx, EventLoadShed{})).To(Equal(context.Canceled))
+		})
+	})
+
+	Context("when receiving events", func() {
+		It("should discard events of other types", func() {
+			events := make(chan Event, 3)
+			events <- EventPeerChanged{}
+			events <- EventLoadShed{Subsystem: "outbound"}
+			event, err := ReceiveEvent[EventLoadShed](context.Background(), events)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(event.Subsystem).To(Equal("outbound"))
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			_, err = ReceiveEvent[EventLoadShed](ctx, events)
+			Expect(err).To(Equal(context.Canceled))
+		})
+	})
+})
@@ -0,0 +1,99 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// FrameMagic is the first field of every framed message. Read as the length of
+// an unframed message, it is longer than any message can be, so that readers
+// can tell framed and unframed messages apart.
+//
+// Framing is not a version of messages (V2 and V3 already declare the hashers
+// and the deadlines of messages), and it is not negotiated by the handshake.
+// Instead, every message of any version can be framed, and UnmarshalReader
+// tells framed messages apart by their magic, so each end of a connection
+// decides whether to write framed messages on its own (see
+// handshake.Options.Framed), and reads whatever the other end writes. Peers
+// that do not read framed messages reject them, because their reserved flags
+// are read as an unsupported version, so framing must only be written once
+// every peer in the network has been upgraded. An end that frames its
+// messages learns that the other end does not when it reads an unframed
+// message (see EventDowngraded).
+const FrameMagic = uint32(0xF2465741) // "AWF\xf2" in little-endian
+
+// FrameFlags are the flags of a framed message. They are reserved, and must be
+// zero.
+type FrameFlags uint16
+
+// FrameHeaderLength is the number of bytes of a framed message before the
+// message itself, which is 4(uint32) for the magic + 2(uint16) for the flags,
+// and FrameChecksumLength is the number of bytes after it, which is 4(uint32)
+// for the checksum.
+const (
+	FrameHeaderLength   = 6
+	FrameChecksumLength = 4
+)
+
+// frameOverhead is the number of bytes that framing adds to a message.
+const frameOverhead = FrameHeaderLength + FrameChecksumLength
+
+// frameTable is the CRC32 table of the checksums of framed messages.
+var frameTable = crc32.MakeTable(crc32.Castagnoli)
+
+// marshalFrame returns the framed encoding of the data of an unframed message.
+// The checksum covers the flags and the data, so that corrupted messages are
+// detected instead of desynchronising the reader.
+func marshalFrame(data []byte) []byte {
+	framed := make([]byte, 6, len(data)+frameOverhead)
+	binary.LittleEndian.PutUint32(framed, FrameMagic)
+	binary.LittleEndian.PutUint16(framed[4:], 0)
+	framed = append(framed, data...)
+	checksum := crc32.Checksum(framed[4:], frameTable)
+	return append(framed, byte(checksum), byte(checksum>>8), byte(checksum>>16), byte(checksum>>24))
+}
+
+// readFrame reads the rest of a framed message, after its magic, and returns
+// the data of the unframed message once its checksum has been verified.
+func readFrame(reader io.Reader) ([]byte, error) {
+	var flags FrameFlags
+	if err := binary.Read(reader, binary.LittleEndian, &flags); err != nil {
+		return nil, fmt.Errorf("error unmarshaling frame flags: %v", err)
+	}
+	if flags != 0 {
+		return nil, NewErrInvalidFrame(fmt.Sprintf("reserved flags=%#x are set", flags))
+	}
+	var length MessageLength
+	if err := binary.Read(reader, binary.LittleEndian, &length); err != nil {
+		return nil, fmt.Errorf("error unmarshaling message length: %v", err)
+	}
+	if int(length) < Ping.NonBodyLength() {
+		return nil, NewErrMessageLengthIsTooLow(length)
+	}
+
+	// The buffer grows as the message is read, so that a corrupt length does
+	// not allocate more than the stream has
+	data := new(bytes.Buffer)
+	binary.Write(data, binary.LittleEndian, flags)
+	binary.Write(data, binary.LittleEndian, length)
+	if _, err := io.CopyN(data, reader, int64(length)-4); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("error unmarshaling framed message: %v", err)
+	}
+	var checksum uint32
+	if err := binary.Read(reader, binary.LittleEndian, &checksum); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("error unmarshaling frame checksum: %v", err)
+	}
+	if expected := crc32.Checksum(data.Bytes(), frameTable); checksum != expected {
+		return nil, NewErrInvalidFrame(fmt.Sprintf("expected checksum=%#x, got checksum=%#x", expected, checksum))
+	}
+	return data.Bytes()[2:], nil
+}
@@ -0,0 +1,53 @@
+package protocol
+
+import (
+	"crypto/sha256"
+
+	"github.com/renproject/id"
+	"lukechampine.com/blake3"
+)
+
+// Hasher identifies the hash function used to identify messages (e.g. when
+// deduplicating broadcasts). V1 messages are always hashed with SHA256. V2
+// messages declare their Hasher in the header, so that every peer hashes a
+// message in the same way, regardless of their own preference.
+type Hasher uint8
+
+const (
+	SHA256 = Hasher(1)
+	BLAKE3 = Hasher(2)
+)
+
+// String implements the `fmt.Stringer` interface.
+func (hasher Hasher) String() string {
+	switch hasher {
+	case SHA256:
+		return "sha256"
+	case BLAKE3:
+		return "blake3"
+	default:
+		panic(NewErrHasherIsNotSupported(hasher))
+	}
+}
+
+// Sum returns the hash of the data.
+func (hasher Hasher) Sum(data []byte) id.Hash {
+	switch hasher {
+	case SHA256:
+		return sha256.Sum256(data)
+	case BLAKE3:
+		return blake3.Sum256(data)
+	default:
+		panic(NewErrHasherIsNotSupported(hasher))
+	}
+}
+
+// ValidateHasher checks if the given hasher is supported.
+func ValidateHasher(hasher Hasher) error {
+	switch hasher {
+	case SHA256, BLAKE3:
+		return nil
+	default:
+		return NewErrHasherIsNotSupported(hasher)
+	}
+}
@@ -0,0 +1,101 @@
+package protocol_test
+
+import (
+	"encoding/hex"
+	"math/rand"
+	"testing/quick"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/protocol"
+	. "github.com/renproject/aw/testutil"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+var _ = Describe("Hasher", func() {
+	Context("when hashing data", func() {
+		It("should return the digest of the hash function", func() {
+			sha256Digest := SHA256.Sum([]byte("abc"))
+			Expect(hex.EncodeToString(sha256Digest[:])).To(Equal("ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"))
+			blake3Digest := BLAKE3.Sum([]byte("abc"))
+			Expect(hex.EncodeToString(blake3Digest[:])).To(Equal("6437b3ac38465133ffb63b75273a8db548c558465d79db03fd359c6cd5bd9d85"))
+		})
+
+		It("should implement the Stringer interface", func() {
+			Expect(SHA256.String()).To(Equal("sha256"))
+			Expect(BLAKE3.String()).To(Equal("blake3"))
+			Expect(func() { _ = Hasher(0).String() }).To(Panic())
+		})
+
+		It("should return an error for unsupported hashers", func() {
+			Expect(ValidateHasher(SHA256)).To(Succeed())
+			Expect(ValidateHasher(BLAKE3)).To(Succeed())
+			Expect(ValidateHasher(Hasher(0))).To(BeAssignableToTypeOf(ErrHasherIsNotSupported{}))
+			Expect(func() { Hasher(0).Sum(nil) }).To(Panic())
+		})
+	})
+
+	Context("when declaring the hasher of a message", func() {
+		It("should create V1 messages for SHA256 and V2 messages otherwise", func() {
+			body := RandomMessageBody()
+			message := NewMessageWithHasher(Broadcast, RandomGroupID(), body, SHA256)
+			Expect(message.Version).To(Equal(V1))
+			Expect(message.HasherOrDefault()).To(Equal(SHA256))
+
+			message = NewMessageWithHasher(Broadcast, RandomGroupID(), body, BLAKE3)
+			Expect(message.Version).To(Equal(V2))
+			Expect(message.HasherOrDefault()).To(Equal(BLAKE3))
+			Expect(int(message.Length)).To(Equal(Broadcast.NonBodyLength() + 1 + len(body)))
+			Expect(func() { NewMessageWithHasher(Broadcast, RandomGroupID(), body, Hasher(0)) }).To(Panic())
+		})
+
+		It("should hash messages with their declared hasher", func() {
+			test := func() bool {
+				groupID := RandomGroupID()
+				body := RandomMessageBody()
+				v1 := NewMessage(V1, Broadcast, groupID, body)
+				sha256Message := NewMessage(V2, Broadcast, groupID, body)
+				blake3Message := NewMessageWithHasher(Broadcast, groupID, body, BLAKE3)
+
+				// The hash does not depend on the version of the message.
+				Expect(sha256Message.Hash()).To(Equal(v1.Hash()))
+				Expect(blake3Message.Hash()).NotTo(Equal(v1.Hash()))
+
+				data, err := v1.MarshalBinary()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(blake3Message.Hash()).To(Equal(BLAKE3.Sum(data)))
+				return true
+			}
+
+			Expect(quick.Check(test, nil)).Should(Succeed())
+		})
+
+		It("should get the same V2 message after marshaling and unmarshaling", func() {
+			test := func() bool {
+				message := RandomMessage(V2, RandomMessageVariant())
+
+				data, err := message.MarshalBinary()
+				Expect(err).NotTo(HaveOccurred())
+
+				var newMessage Message
+				Expect(newMessage.UnmarshalBinary(data)).Should(Succeed())
+
+				return cmp.Equal(message, newMessage, cmpopts.EquateEmpty())
+			}
+
+			Expect(quick.Check(test, nil)).Should(Succeed())
+		})
+
+		It("should return an error when unmarshaling an unsupported hasher", func() {
+			message := RandomMessage(V2, RandomMessageVariant())
+			data, err := message.MarshalBinary()
+			Expect(err).NotTo(HaveOccurred())
+			data[8] = byte(3 + rand.Intn(253))
+
+			var newMessage Message
+			Expect(newMessage.UnmarshalBinary(data)).To(BeAssignableToTypeOf(ErrHasherIsNotSupported{}))
+		})
+	})
+})
@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"time"
 )
 
 // MarshalBinary implements `BinaryMarshaler` interface.
@@ -20,6 +21,14 @@ func (message Message) MarshalBinary() ([]byte, error) {
 	if err := ValidateMessageVariant(message.Variant); err != nil {
 		return nil, err
 	}
+	if int(message.Length) < message.NonBodyLength() {
+		return nil, NewErrMessageLengthIsTooLow(message.Length)
+	}
+	if message.Version == V2 || message.Version == V3 {
+		if err := ValidateHasher(message.Hasher); err != nil {
+			return nil, err
+		}
+	}
 
 	buffer := new(bytes.Buffer)
 	if err := binary.Write(buffer, binary.LittleEndian, message.Length); err != nil {
@@ -31,8 +40,22 @@ func (message Message) MarshalBinary() ([]byte, error) {
 	if err := binary.Write(buffer, binary.LittleEndian, message.Variant); err != nil {
 		return nil, fmt.Errorf("error marshaling message variant=%v: %v", message.Variant, err)
 	}
-	if message.Version == V1 {
-		if message.Variant == Broadcast || message.Variant == Multicast {
+	if message.Version == V2 || message.Version == V3 {
+		if err := binary.Write(buffer, binary.LittleEndian, message.Hasher); err != nil {
+			return nil, fmt.Errorf("error marshaling message hasher=%v: %v", message.Hasher, err)
+		}
+	}
+	if message.Version == V3 {
+		deadline := int64(0)
+		if !message.Deadline.IsZero() {
+			deadline = message.Deadline.UnixNano()
+		}
+		if err := binary.Write(buffer, binary.LittleEndian, deadline); err != nil {
+			return nil, fmt.Errorf("error marshaling message deadline=%v: %v", message.Deadline, err)
+		}
+	}
+	if message.Version == V1 || message.Version == V2 || message.Version == V3 {
+		if message.Variant == Broadcast || message.Variant == Multicast || message.Variant == CatchUp {
 			if err := binary.Write(buffer, binary.LittleEndian, message.GroupID); err != nil {
 				return nil, fmt.Errorf("error marshaling message group id=%v: %v", message.GroupID, err)
 			}
@@ -41,6 +64,9 @@ func (message Message) MarshalBinary() ([]byte, error) {
 	if err := binary.Write(buffer, binary.LittleEndian, message.Body); err != nil {
 		return nil, fmt.Errorf("error marshaling message body: %v", err)
 	}
+	if message.Framed {
+		return marshalFrame(buffer.Bytes()), nil
+	}
 	return buffer.Bytes(), nil
 }
 
@@ -49,14 +75,47 @@ func (message *Message) UnmarshalBinary(data []byte) error {
 	return message.UnmarshalReader(bytes.NewBuffer(data))
 }
 
+// UnmarshalBinaryStrict is the same as UnmarshalBinary, except that it rejects
+// data with trailing bytes, and messages that are not encoded canonically (see
+// ValidateCanonicalMessage), instead of parsing them on a best-effort basis.
+func (message *Message) UnmarshalBinaryStrict(data []byte) error {
+	reader := bytes.NewReader(data)
+	if err := message.UnmarshalReader(reader); err != nil {
+		return err
+	}
+	if reader.Len() > 0 {
+		return NewErrNonCanonicalMessage(message.Variant, fmt.Sprintf("%d trailing bytes", reader.Len()))
+	}
+	return ValidateCanonicalMessage(*message)
+}
+
 // UnmarshalReader reads bytes from an `io.Reader` and unmarshals them into
-// itself.
+// itself. It reads both framed and unframed messages, and sets Framed
+// accordingly, so that peers can read messages from peers that do not frame
+// them.
 func (message *Message) UnmarshalReader(reader io.Reader) error {
-	// Read the message length
-	if err := binary.Read(reader, binary.LittleEndian, &message.Length); err != nil {
+	// Read the message length, or the magic of a framed message
+	var prefix uint32
+	if err := binary.Read(reader, binary.LittleEndian, &prefix); err != nil {
 		return err
 	}
+	if prefix == FrameMagic {
+		data, err := readFrame(reader)
+		if err != nil {
+			return err
+		}
+		frame := bytes.NewReader(data[4:])
+		message.Length = MessageLength(binary.LittleEndian.Uint32(data))
+		message.Framed = true
+		return message.unmarshalUnframed(frame)
+	}
+	message.Length = MessageLength(prefix)
+	message.Framed = false
+	return message.unmarshalUnframed(reader)
+}
 
+// unmarshalUnframed reads the rest of an unframed message, after its length.
+func (message *Message) unmarshalUnframed(reader io.Reader) error {
 	// Read the message version
 	if err := binary.Read(reader, binary.LittleEndian, &message.Version); err != nil {
 		return fmt.Errorf("error unmarshaling message version: %v", err)
@@ -78,9 +137,36 @@ func (message *Message) UnmarshalReader(reader io.Reader) error {
 		return err
 	}
 
-	// Read the group ID if the message is a Broadcast or a Multicast
-	if message.Version == V1 {
-		if message.Variant == Broadcast || message.Variant == Multicast {
+	// Read the hasher if the message declares it (V1 messages always use
+	// SHA256)
+	message.Hasher = 0
+	if message.Version == V2 || message.Version == V3 {
+		if err := binary.Read(reader, binary.LittleEndian, &message.Hasher); err != nil {
+			return fmt.Errorf("error unmarshaling message hasher: %v", err)
+		}
+		if err := ValidateHasher(message.Hasher); err != nil {
+			return err
+		}
+		if int(message.Length) < message.NonBodyLength() {
+			return NewErrMessageLengthIsTooLow(message.Length)
+		}
+	}
+
+	// Read the deadline if the message declares it
+	message.Deadline = time.Time{}
+	if message.Version == V3 {
+		deadline := int64(0)
+		if err := binary.Read(reader, binary.LittleEndian, &deadline); err != nil {
+			return fmt.Errorf("error unmarshaling message deadline: %v", err)
+		}
+		if deadline != 0 {
+			message.Deadline = time.Unix(0, deadline)
+		}
+	}
+
+	// Read the group ID if the message is a Broadcast, a Multicast or a CatchUp
+	if message.Version == V1 || message.Version == V2 || message.Version == V3 {
+		if message.Variant == Broadcast || message.Variant == Multicast || message.Variant == CatchUp {
 			if err := binary.Read(reader, binary.LittleEndian, &message.GroupID); err != nil {
 				return fmt.Errorf("error unmarshaling message group id: %v", err)
 			}
@@ -88,7 +174,7 @@ func (message *Message) UnmarshalReader(reader io.Reader) error {
 	}
 
 	// Read the message body.
-	message.Body = make(MessageBody, int(message.Length)-message.Variant.NonBodyLength())
+	message.Body = make(MessageBody, int(message.Length)-message.NonBodyLength())
 	if err := binary.Read(reader, binary.LittleEndian, message.Body); err != nil {
 		return fmt.Errorf("error unmarshaling message body: %v", err)
 	}
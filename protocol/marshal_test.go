@@ -1,9 +1,12 @@
 package protocol_test
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"math/rand"
 	"testing/quick"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -97,4 +100,161 @@ var _ = Describe("marshaling and unmarshaling", func() {
 			Expect(quick.Check(test, nil)).Should(Succeed())
 		})
 	})
+
+	Context("when unmarshaling a message strictly", func() {
+		It("should accept canonical messages", func() {
+			test := func() bool {
+				variant := RandomMessageVariant()
+				groupID := NilGroupID
+				if variant == Broadcast || variant == Multicast || variant == CatchUp {
+					groupID = RandomGroupID()
+				}
+				body := MessageBody(RandomBytes(rand.Intn(100)))
+				for _, message := range []Message{
+					NewMessageWithDeadline(variant, groupID, body, SHA256, time.Time{}),
+					NewMessageWithDeadline(variant, groupID, body, BLAKE3, time.Time{}),
+					NewMessageWithDeadline(variant, groupID, body, SHA256, time.Now().Add(time.Minute)),
+				} {
+					data, err := message.MarshalBinary()
+					Expect(err).NotTo(HaveOccurred())
+
+					var newMessage Message
+					Expect(newMessage.UnmarshalBinaryStrict(data)).Should(Succeed())
+					Expect(newMessage.Version).Should(Equal(message.Version))
+				}
+				return true
+			}
+
+			Expect(quick.Check(test, nil)).Should(Succeed())
+		})
+
+		It("should return an error when the data has trailing bytes", func() {
+			data, err := NewMessage(V1, Cast, NilGroupID, MessageBody("cast")).MarshalBinary()
+			Expect(err).NotTo(HaveOccurred())
+			data = append(data, 0)
+
+			var message Message
+			Expect(message.UnmarshalBinary(data)).Should(Succeed())
+			err = message.UnmarshalBinaryStrict(data)
+			Expect(err).To(BeAssignableToTypeOf(ErrNonCanonicalMessage{}))
+		})
+
+		It("should return an error when the message is not encoded canonically", func() {
+			for _, message := range []Message{
+				NewMessage(V2, Cast, NilGroupID, MessageBody("sha256 is declared by v1 messages")),
+				NewMessage(V3, Cast, NilGroupID, MessageBody("deadlines are declared by v3 messages")),
+			} {
+				data, err := message.MarshalBinary()
+				Expect(err).NotTo(HaveOccurred())
+
+				var newMessage Message
+				Expect(newMessage.UnmarshalBinary(data)).Should(Succeed())
+				err = newMessage.UnmarshalBinaryStrict(data)
+				Expect(err).To(BeAssignableToTypeOf(ErrNonCanonicalMessage{}))
+			}
+		})
+
+		It("should return an error when the message variant is unknown", func() {
+			data := make([]byte, 8)
+			binary.LittleEndian.PutUint32(data, 8)
+			binary.LittleEndian.PutUint16(data[4:], uint16(V1))
+			binary.LittleEndian.PutUint16(data[6:], 0xFFFF)
+
+			var message Message
+			err := message.UnmarshalBinaryStrict(data)
+			Expect(err).To(BeAssignableToTypeOf(ErrMessageVariantIsNotSupported{}))
+		})
+
+		It("should return an error when the length does not match the body", func() {
+			message := NewMessage(V1, Cast, NilGroupID, MessageBody("cast"))
+			message.Length++
+			Expect(ValidateCanonicalMessage(message)).To(BeAssignableToTypeOf(ErrNonCanonicalMessage{}))
+		})
+	})
+
+	Context("when framing a message", func() {
+		It("should get the same message after marshaling and unmarshaling", func() {
+			test := func() bool {
+				message := RandomMessage(V1, RandomMessageVariant())
+				message.Framed = true
+
+				data, err := message.MarshalBinary()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(binary.LittleEndian.Uint32(data)).To(Equal(FrameMagic))
+
+				var newMessage Message
+				Expect(newMessage.UnmarshalBinaryStrict(data)).Should(Succeed())
+				return cmp.Equal(message, newMessage, cmpopts.EquateEmpty())
+			}
+
+			Expect(quick.Check(test, nil)).Should(Succeed())
+		})
+
+		It("should read framed and unframed messages from the same stream", func() {
+			framed := NewMessage(V1, Cast, NilGroupID, MessageBody("framed"))
+			framed.Framed = true
+			unframed := NewMessage(V1, Cast, NilGroupID, MessageBody("unframed"))
+
+			buffer := new(bytes.Buffer)
+			for _, message := range []Message{framed, unframed, framed} {
+				data, err := message.MarshalBinary()
+				Expect(err).NotTo(HaveOccurred())
+				buffer.Write(data)
+			}
+			for _, message := range []Message{framed, unframed, framed} {
+				var newMessage Message
+				Expect(newMessage.UnmarshalReader(buffer)).Should(Succeed())
+				Expect(newMessage).To(Equal(message))
+			}
+		})
+
+		It("should be rejected by readers that do not read framed messages", func() {
+			message := RandomMessage(V1, RandomMessageVariant())
+			message.Framed = true
+			data, err := message.MarshalBinary()
+			Expect(err).NotTo(HaveOccurred())
+
+			// The reserved flags are where unframed messages declare their
+			// version
+			Expect(ValidateMessageVersion(MessageVersion(binary.LittleEndian.Uint16(data[4:])))).To(HaveOccurred())
+		})
+
+		It("should not change the hash of the message", func() {
+			message := NewMessage(V1, Cast, NilGroupID, MessageBody("hash"))
+			framed := message
+			framed.Framed = true
+			Expect(framed.Hash()).To(Equal(message.Hash()))
+		})
+
+		It("should return an error when the message is corrupted", func() {
+			message := NewMessage(V1, Cast, NilGroupID, MessageBody("corrupted"))
+			message.Framed = true
+			data, err := message.MarshalBinary()
+			Expect(err).NotTo(HaveOccurred())
+
+			for i := 4; i < len(data); i++ {
+				corrupted := append([]byte{}, data...)
+				corrupted[i] ^= 0x01
+				var newMessage Message
+				err := newMessage.UnmarshalBinary(corrupted)
+				Expect(err).To(HaveOccurred())
+			}
+			data[len(data)-1] ^= 0x01
+			var newMessage Message
+			err = newMessage.UnmarshalBinary(data)
+			Expect(err).To(BeAssignableToTypeOf(ErrInvalidFrame{}))
+			Expect(errors.Is(err, ErrInvalid)).To(BeTrue())
+		})
+
+		It("should return an error when the reserved flags are set", func() {
+			message := NewMessage(V1, Ping, NilGroupID, nil)
+			message.Framed = true
+			data, err := message.MarshalBinary()
+			Expect(err).NotTo(HaveOccurred())
+			data[4] = 0x01
+
+			var newMessage Message
+			Expect(newMessage.UnmarshalBinary(data)).To(BeAssignableToTypeOf(ErrInvalidFrame{}))
+		})
+	})
 })
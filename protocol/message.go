@@ -1,9 +1,9 @@
 package protocol
 
 import (
-	"crypto/sha256"
 	"encoding/base64"
 	"fmt"
+	"time"
 
 	"github.com/renproject/id"
 )
@@ -13,6 +13,11 @@ type MessageOnTheWire struct {
 	To      PeerAddress
 	From    PeerID
 	Message Message
+
+	// Authenticated is set by Servers when From is the PeerID that was
+	// verified by the handshake of the connection the message was read from.
+	// Otherwise, From is only claimed by the Server.
+	Authenticated bool
 }
 
 // MessageSender is used for sending MessageOnTheWire.
@@ -27,11 +32,11 @@ type MessageLength uint32
 // ValidateMessageVersion checks if the length is valid.
 func ValidateMessageLength(length MessageLength, variant MessageVariant) error {
 	switch variant {
-	case Cast, Ping, Pong:
+	case Cast, Ping, Pong, FindNode, Nodes, Provide, FindProviders, Providers, PutValue, GetValue, Value, BroadcastAck, Nack, QueryPeers, AnswerPeers:
 		if int(length) < variant.NonBodyLength() {
 			return NewErrMessageLengthIsTooLow(length)
 		}
-	case Multicast, Broadcast:
+	case Multicast, Broadcast, CatchUp:
 		if int(length) < variant.NonBodyLength() {
 			return NewErrMessageLengthIsTooLow(length)
 		}
@@ -46,12 +51,25 @@ type MessageVersion uint16
 
 const (
 	V1 = MessageVersion(1)
+
+	// V2 is the same as V1, except that the header also declares the Hasher
+	// used to identify the message.
+	V2 = MessageVersion(2)
+
+	// V3 is the same as V2, except that the header also declares the Deadline
+	// after which the message is dropped, and no longer forwarded, by every
+	// peer.
+	V3 = MessageVersion(3)
 )
 
 func (version MessageVersion) String() string {
 	switch version {
 	case V1:
 		return "v1"
+	case V2:
+		return "v2"
+	case V3:
+		return "v3"
 	default:
 		panic(NewErrMessageVersionIsNotSupported(version))
 	}
@@ -60,7 +78,7 @@ func (version MessageVersion) String() string {
 // ValidateMessageVersion checks if the given version is supported.
 func ValidateMessageVersion(version MessageVersion) error {
 	switch version {
-	case V1:
+	case V1, V2, V3:
 		return nil
 	default:
 		return NewErrMessageVersionIsNotSupported(version)
@@ -76,6 +94,36 @@ const (
 	Cast      = MessageVariant(3)
 	Multicast = MessageVariant(4)
 	Broadcast = MessageVariant(5)
+	CatchUp   = MessageVariant(6)
+
+	// FindNode asks a peer for the addresses of the peers closest to a
+	// target PeerID that it knows, and Nodes is the response.
+	FindNode = MessageVariant(7)
+	Nodes    = MessageVariant(8)
+
+	// Provide stores a signed provider record at a peer, FindProviders asks a
+	// peer for the provider records of a key, and Providers is the response.
+	Provide       = MessageVariant(9)
+	FindProviders = MessageVariant(10)
+	Providers     = MessageVariant(11)
+
+	// PutValue stores a signed value record at a peer, GetValue asks a peer
+	// for the value record of a key, and Value is the response.
+	PutValue = MessageVariant(12)
+	GetValue = MessageVariant(13)
+	Value    = MessageVariant(14)
+
+	// BroadcastAck acknowledges a reliable broadcast to the peer that sent it.
+	BroadcastAck = MessageVariant(15)
+
+	// Nack tells the peer that sent a message that it was rejected, and why
+	// (see NackBody).
+	Nack = MessageVariant(16)
+
+	// QueryPeers asks a peer for a batch of the addresses of the peers that it
+	// knows, and AnswerPeers is the response.
+	QueryPeers  = MessageVariant(17)
+	AnswerPeers = MessageVariant(18)
 )
 
 func (variant MessageVariant) String() string {
@@ -90,6 +138,32 @@ func (variant MessageVariant) String() string {
 		return "multicast"
 	case Broadcast:
 		return "broadcast"
+	case CatchUp:
+		return "catchup"
+	case FindNode:
+		return "findnode"
+	case Nodes:
+		return "nodes"
+	case Provide:
+		return "provide"
+	case FindProviders:
+		return "findproviders"
+	case Providers:
+		return "providers"
+	case PutValue:
+		return "putvalue"
+	case GetValue:
+		return "getvalue"
+	case Value:
+		return "value"
+	case BroadcastAck:
+		return "broadcastack"
+	case Nack:
+		return "nack"
+	case QueryPeers:
+		return "querypeers"
+	case AnswerPeers:
+		return "answerpeers"
 	default:
 		panic(NewErrMessageVariantIsNotSupported(variant))
 	}
@@ -99,9 +173,9 @@ func (variant MessageVariant) String() string {
 // len(MessageLength) + len(MessageVersion) + len(MessageVariant) + len(GroupID)
 func (variant MessageVariant) NonBodyLength() int {
 	switch variant {
-	case Ping, Pong, Cast:
+	case Ping, Pong, Cast, FindNode, Nodes, Provide, FindProviders, Providers, PutValue, GetValue, Value, BroadcastAck, Nack, QueryPeers, AnswerPeers:
 		return 8 // 4(uint32) + 2(uint16) + 2(uint16) + 0
-	case Multicast, Broadcast:
+	case Multicast, Broadcast, CatchUp:
 		return 40 // 4(uint32) + 2(uint16) + 2(uint16) + 32([32]byte)
 	default:
 		panic(NewErrMessageVariantIsNotSupported(variant))
@@ -111,7 +185,7 @@ func (variant MessageVariant) NonBodyLength() int {
 // ValidateMessageVariant checks if the given variant is supported.
 func ValidateMessageVariant(variant MessageVariant) error {
 	switch variant {
-	case Ping, Pong, Cast, Multicast, Broadcast:
+	case Ping, Pong, Cast, Multicast, Broadcast, CatchUp, FindNode, Nodes, Provide, FindProviders, Providers, PutValue, GetValue, Value, BroadcastAck, Nack, QueryPeers, AnswerPeers:
 		return nil
 	default:
 		return NewErrMessageVariantIsNotSupported(variant)
@@ -128,11 +202,19 @@ func (body MessageBody) String() string {
 
 // Message is the object used for communicating in the network.
 type Message struct {
-	Length  MessageLength
-	Version MessageVersion
-	Variant MessageVariant
-	GroupID GroupID
-	Body    MessageBody
+	Length   MessageLength
+	Version  MessageVersion
+	Variant  MessageVariant
+	Hasher   Hasher    // Only used by V2 and V3 messages, V1 messages always use SHA256
+	Deadline time.Time // Only used by V3 messages, the zero time means that there is no deadline
+	GroupID  GroupID
+	Body     MessageBody
+
+	// Framed messages are encoded with a magic number, reserved flags and a
+	// checksum around them (see FrameMagic), so that corrupted streams are
+	// detected. Framing is independent of the version of the message, and
+	// is not part of its Length, or of its identity.
+	Framed bool
 }
 
 // NewMessage returns a new message with given version, variant and body.
@@ -146,22 +228,140 @@ func NewMessage(version MessageVersion, variant MessageVariant, groupID GroupID,
 	if err := ValidateGroupID(groupID, variant); err != nil {
 		panic(err)
 	}
-	length := MessageLength(variant.NonBodyLength() + len(body))
-
-	return Message{
-		Length:  length,
+	message := Message{
 		Version: version,
 		Variant: variant,
 		GroupID: groupID,
 		Body:    body,
 	}
+	if version == V2 || version == V3 {
+		message.Hasher = SHA256
+	}
+	message.Length = MessageLength(message.NonBodyLength() + len(body))
+	return message
+}
+
+// NewMessageWithHasher returns a new message with given variant and body that
+// is identified using the given hasher. SHA256 messages are V1 messages, so
+// that they can be read by peers that do not support V2, and other messages
+// are V2 messages.
+func NewMessageWithHasher(variant MessageVariant, groupID GroupID, body MessageBody, hasher Hasher) Message {
+	if err := ValidateHasher(hasher); err != nil {
+		panic(err)
+	}
+	if hasher == SHA256 {
+		return NewMessage(V1, variant, groupID, body)
+	}
+	message := NewMessage(V2, variant, groupID, body)
+	message.Hasher = hasher
+	return message
 }
 
-// Hash returns the hash of the message.
+// NewMessageWithDeadline returns a new message with given variant and body
+// that is identified using the given hasher, and that is dropped by every peer
+// after the deadline. Messages without a deadline are created using
+// NewMessageWithHasher, and other messages are V3 messages.
+func NewMessageWithDeadline(variant MessageVariant, groupID GroupID, body MessageBody, hasher Hasher, deadline time.Time) Message {
+	if deadline.IsZero() {
+		return NewMessageWithHasher(variant, groupID, body, hasher)
+	}
+	if err := ValidateHasher(hasher); err != nil {
+		panic(err)
+	}
+	message := NewMessage(V3, variant, groupID, body)
+	message.Hasher = hasher
+	message.Deadline = deadline
+	return message
+}
+
+// Expired returns true if the message has a deadline that has passed at the
+// given time.
+func (message Message) Expired(now time.Time) bool {
+	return message.Version == V3 && !message.Deadline.IsZero() && !now.Before(message.Deadline)
+}
+
+// NonBodyLength returns the length of the message (ex-messageBody), which
+// depends on both the version and the variant of the message.
+func (message Message) NonBodyLength() int {
+	switch message.Version {
+	case V2:
+		return message.Variant.NonBodyLength() + 1 // 1(uint8) for the Hasher
+	case V3:
+		return message.Variant.NonBodyLength() + 9 // 1(uint8) for the Hasher + 8(int64) for the Deadline
+	}
+	return message.Variant.NonBodyLength()
+}
+
+// Hash returns the hash of the message, using the Hasher of the message. V2
+// and V3 messages are hashed using their V1 encoding, so that the hash does
+// not change when the message is sent using a different version. The Deadline
+// of a message is not part of its identity.
 func (message Message) Hash() id.Hash {
+	message.Framed = false
 	data, err := message.MarshalBinary()
 	if err != nil {
 		panic(fmt.Errorf("invariant violation: malformed message: %v", err))
 	}
-	return sha256.Sum256(data)
+	if message.Version == V2 || message.Version == V3 {
+		v1 := message
+		v1.Length = MessageLength(v1.Variant.NonBodyLength() + len(v1.Body))
+		v1.Version = V1
+		v1.Hasher = 0
+		v1.Deadline = time.Time{}
+		if data, err = v1.MarshalBinary(); err != nil {
+			panic(fmt.Errorf("invariant violation: malformed message: %v", err))
+		}
+	}
+	return message.HasherOrDefault().Sum(data)
+}
+
+// ValidateCanonicalMessage checks that the message is encoded the way that
+// NewMessageWithDeadline would encode it, so that every message has exactly one
+// encoding. It rejects unsupported versions, variants and hashers, lengths that
+// do not match the body, V2 messages that declare SHA256 (which are V1
+// messages), V3 messages without a deadline (which are V1 or V2 messages), and
+// group IDs on variants that are not sent to groups.
+func ValidateCanonicalMessage(message Message) error {
+	if err := ValidateMessageVersion(message.Version); err != nil {
+		return err
+	}
+	if err := ValidateMessageVariant(message.Variant); err != nil {
+		return err
+	}
+	if err := ValidateGroupID(message.GroupID, message.Variant); err != nil {
+		return err
+	}
+	if message.Version == V2 || message.Version == V3 {
+		if err := ValidateHasher(message.Hasher); err != nil {
+			return err
+		}
+	} else if message.Hasher != 0 {
+		return NewErrNonCanonicalMessage(message.Variant, fmt.Sprintf("%v message declares hasher=%v", message.Version, message.Hasher))
+	}
+	if expected := message.NonBodyLength() + len(message.Body); int(message.Length) != expected {
+		return NewErrNonCanonicalMessage(message.Variant, fmt.Sprintf("expected length=%v, got length=%v", expected, message.Length))
+	}
+	switch message.Version {
+	case V2:
+		if message.Hasher == SHA256 {
+			return NewErrNonCanonicalMessage(message.Variant, "v2 message declares the default hasher")
+		}
+	case V3:
+		if message.Deadline.IsZero() {
+			return NewErrNonCanonicalMessage(message.Variant, "v3 message does not declare a deadline")
+		}
+	default:
+		if !message.Deadline.IsZero() {
+			return NewErrNonCanonicalMessage(message.Variant, fmt.Sprintf("%v message declares a deadline", message.Version))
+		}
+	}
+	return nil
+}
+
+// HasherOrDefault returns the Hasher used to identify the message.
+func (message Message) HasherOrDefault() Hasher {
+	if message.Version == V2 || message.Version == V3 {
+		return message.Hasher
+	}
+	return SHA256
 }
@@ -4,11 +4,15 @@ import (
 	"bytes"
 	"encoding/base64"
 	"testing/quick"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	. "github.com/renproject/aw/protocol"
 	. "github.com/renproject/aw/testutil"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 )
 
 var _ = Describe("Protocol", func() {
@@ -30,6 +34,19 @@ var _ = Describe("Protocol", func() {
 			Expect(Cast.String()).To(Equal("cast"))
 			Expect(Multicast.String()).To(Equal("multicast"))
 			Expect(Broadcast.String()).To(Equal("broadcast"))
+			Expect(CatchUp.String()).To(Equal("catchup"))
+			Expect(FindNode.String()).To(Equal("findnode"))
+			Expect(Nodes.String()).To(Equal("nodes"))
+			Expect(Provide.String()).To(Equal("provide"))
+			Expect(FindProviders.String()).To(Equal("findproviders"))
+			Expect(Providers.String()).To(Equal("providers"))
+			Expect(PutValue.String()).To(Equal("putvalue"))
+			Expect(GetValue.String()).To(Equal("getvalue"))
+			Expect(Value.String()).To(Equal("value"))
+			Expect(BroadcastAck.String()).To(Equal("broadcastack"))
+			Expect(Nack.String()).To(Equal("nack"))
+			Expect(QueryPeers.String()).To(Equal("querypeers"))
+			Expect(AnswerPeers.String()).To(Equal("answerpeers"))
 		})
 
 		It("should panic for invalid variants", func() {
@@ -42,6 +59,19 @@ var _ = Describe("Protocol", func() {
 			Expect(Cast.NonBodyLength()).To(Equal(8))
 			Expect(Multicast.NonBodyLength()).To(Equal(40))
 			Expect(Broadcast.NonBodyLength()).To(Equal(40))
+			Expect(CatchUp.NonBodyLength()).To(Equal(40))
+			Expect(FindNode.NonBodyLength()).To(Equal(8))
+			Expect(Nodes.NonBodyLength()).To(Equal(8))
+			Expect(Provide.NonBodyLength()).To(Equal(8))
+			Expect(FindProviders.NonBodyLength()).To(Equal(8))
+			Expect(Providers.NonBodyLength()).To(Equal(8))
+			Expect(PutValue.NonBodyLength()).To(Equal(8))
+			Expect(GetValue.NonBodyLength()).To(Equal(8))
+			Expect(Value.NonBodyLength()).To(Equal(8))
+			Expect(BroadcastAck.NonBodyLength()).To(Equal(8))
+			Expect(Nack.NonBodyLength()).To(Equal(8))
+			Expect(QueryPeers.NonBodyLength()).To(Equal(8))
+			Expect(AnswerPeers.NonBodyLength()).To(Equal(8))
 		})
 	})
 
@@ -102,4 +132,46 @@ var _ = Describe("Protocol", func() {
 			Expect(func() { message.Hash() }).To(Panic())
 		})
 	})
+
+	Context("when declaring the deadline of a message", func() {
+		It("should create V3 messages only when there is a deadline", func() {
+			body := RandomMessageBody()
+			message := NewMessageWithDeadline(Broadcast, RandomGroupID(), body, BLAKE3, time.Time{})
+			Expect(message.Version).To(Equal(V2))
+			Expect(message.Expired(time.Now())).To(BeFalse())
+
+			deadline := time.Now().Add(time.Minute)
+			message = NewMessageWithDeadline(Broadcast, RandomGroupID(), body, BLAKE3, deadline)
+			Expect(message.Version).To(Equal(V3))
+			Expect(V3.String()).To(Equal("v3"))
+			Expect(message.HasherOrDefault()).To(Equal(BLAKE3))
+			Expect(int(message.Length)).To(Equal(Broadcast.NonBodyLength() + 9 + len(body)))
+			Expect(message.Expired(time.Now())).To(BeFalse())
+			Expect(message.Expired(deadline)).To(BeTrue())
+		})
+
+		It("should not include the deadline in the hash of the message", func() {
+			groupID := RandomGroupID()
+			body := RandomMessageBody()
+			v1 := NewMessage(V1, Broadcast, groupID, body)
+			v3 := NewMessageWithDeadline(Broadcast, groupID, body, SHA256, time.Now().Add(time.Minute))
+			Expect(v3.Hash()).To(Equal(v1.Hash()))
+		})
+
+		It("should get the same V3 message after marshaling and unmarshaling", func() {
+			test := func() bool {
+				message := RandomMessage(V3, RandomMessageVariant())
+
+				data, err := message.MarshalBinary()
+				Expect(err).NotTo(HaveOccurred())
+
+				var newMessage Message
+				Expect(newMessage.UnmarshalBinary(data)).Should(Succeed())
+
+				return cmp.Equal(message, newMessage, cmpopts.EquateEmpty())
+			}
+
+			Expect(quick.Check(test, nil)).Should(Succeed())
+		})
+	})
 })
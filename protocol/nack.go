@@ -0,0 +1,107 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/renproject/id"
+)
+
+// RejectReason is the reason why a peer rejected a message.
+type RejectReason uint8
+
+const (
+	// RejectedVersion means the version of the message is not supported.
+	RejectedVersion = RejectReason(1)
+	// RejectedVariant means the variant of the message is not supported.
+	RejectedVariant = RejectReason(2)
+	// RejectedInvalid means the message is malformed, or not encoded
+	// canonically.
+	RejectedInvalid = RejectReason(3)
+	// RejectedUnauthenticated means the message relies on its origin, but its
+	// origin is not authenticated.
+	RejectedUnauthenticated = RejectReason(4)
+	// RejectedRelayOnly means the message is meant for the application, but
+	// the peer is relay-only.
+	RejectedRelayOnly = RejectReason(5)
+	// RejectedOverloaded means the message was shed, because the peer is over
+	// its budget.
+	RejectedOverloaded = RejectReason(6)
+)
+
+func (reason RejectReason) String() string {
+	switch reason {
+	case RejectedVersion:
+		return "version"
+	case RejectedVariant:
+		return "variant"
+	case RejectedInvalid:
+		return "invalid"
+	case RejectedUnauthenticated:
+		return "unauthenticated"
+	case RejectedRelayOnly:
+		return "relay-only"
+	case RejectedOverloaded:
+		return "overloaded"
+	default:
+		return fmt.Sprintf("rejectReason(%d)", uint8(reason))
+	}
+}
+
+// NackBody is the body of a Nack. It identifies the message that was rejected
+// by its variant and its hash, and carries the reason why it was rejected. The
+// hash is zero when the rejected message could not be hashed (e.g. because its
+// variant is not supported).
+type NackBody struct {
+	Reason  RejectReason
+	Variant MessageVariant
+	Hash    id.Hash
+}
+
+// nackBodyLength is 1(uint8) for the Reason + 2(uint16) for the Variant +
+// 32([32]byte) for the Hash.
+const nackBodyLength = 35
+
+// MarshalBinary implements the encoding.BinaryMarshaler interface.
+func (body NackBody) MarshalBinary() ([]byte, error) {
+	data := make([]byte, nackBodyLength)
+	data[0] = uint8(body.Reason)
+	binary.LittleEndian.PutUint16(data[1:3], uint16(body.Variant))
+	copy(data[3:], body.Hash[:])
+	return data, nil
+}
+
+// UnmarshalBinary implements the encoding.BinaryUnmarshaler interface.
+func (body *NackBody) UnmarshalBinary(data []byte) error {
+	if len(data) != nackBodyLength {
+		return fmt.Errorf("expected len=%v, got len=%v", nackBodyLength, len(data))
+	}
+	body.Reason = RejectReason(data[0])
+	body.Variant = MessageVariant(binary.LittleEndian.Uint16(data[1:3]))
+	copy(body.Hash[:], data[3:])
+	return nil
+}
+
+// NewNack returns a Nack that rejects the message for the given reason.
+func NewNack(message Message, reason RejectReason) Message {
+	body := NackBody{Reason: reason, Variant: message.Variant}
+	if canHash(message) {
+		body.Hash = message.Hash()
+	}
+	data, err := body.MarshalBinary()
+	if err != nil {
+		panic(fmt.Errorf("invariant violation: malformed nack: %v", err))
+	}
+	return NewMessage(V1, Nack, NilGroupID, data)
+}
+
+// canHash returns true if the message can be hashed without panicking.
+func canHash(message Message) bool {
+	if ValidateMessageVersion(message.Version) != nil || ValidateMessageVariant(message.Variant) != nil {
+		return false
+	}
+	if ValidateGroupID(message.GroupID, message.Variant) != nil || int(message.Length) < message.NonBodyLength() {
+		return false
+	}
+	return ValidateHasher(message.HasherOrDefault()) == nil
+}
@@ -0,0 +1,66 @@
+package protocol_test
+
+import (
+	"testing/quick"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/protocol"
+	. "github.com/renproject/aw/testutil"
+
+	"github.com/renproject/id"
+)
+
+var _ = Describe("Nacks", func() {
+	Context("when rejecting a message", func() {
+		It("should identify the message by its variant and hash", func() {
+			test := func() bool {
+				message := RandomMessage(V1, RandomMessageVariant())
+				nack := NewNack(message, RejectedInvalid)
+				Expect(nack.Version).To(Equal(V1))
+				Expect(nack.Variant).To(Equal(Nack))
+				Expect(ValidateCanonicalMessage(nack)).To(Succeed())
+
+				body := NackBody{}
+				Expect(body.UnmarshalBinary(nack.Body)).To(Succeed())
+				Expect(body.Reason).To(Equal(RejectedInvalid))
+				Expect(body.Variant).To(Equal(message.Variant))
+				Expect(body.Hash).To(Equal(message.Hash()))
+				return true
+			}
+			Expect(quick.Check(test, nil)).NotTo(HaveOccurred())
+		})
+
+		It("should not hash messages that cannot be hashed", func() {
+			message := RandomMessage(V1, Cast)
+			message.Variant = InvalidMessageVariant()
+			nack := NewNack(message, RejectedVariant)
+
+			body := NackBody{}
+			Expect(body.UnmarshalBinary(nack.Body)).To(Succeed())
+			Expect(body.Reason).To(Equal(RejectedVariant))
+			Expect(body.Variant).To(Equal(message.Variant))
+			Expect(body.Hash).To(Equal(id.Hash{}))
+		})
+	})
+
+	Context("when unmarshaling a nack body", func() {
+		It("should reject bodies with the wrong length", func() {
+			body := NackBody{}
+			Expect(body.UnmarshalBinary(make([]byte, 34))).NotTo(Succeed())
+			Expect(body.UnmarshalBinary(make([]byte, 36))).NotTo(Succeed())
+		})
+	})
+
+	Context("when stringifying reject reasons", func() {
+		It("should implement the Stringer interface", func() {
+			Expect(RejectedVersion.String()).To(Equal("version"))
+			Expect(RejectedVariant.String()).To(Equal("variant"))
+			Expect(RejectedInvalid.String()).To(Equal("invalid"))
+			Expect(RejectedUnauthenticated.String()).To(Equal("unauthenticated"))
+			Expect(RejectedRelayOnly.String()).To(Equal("relay-only"))
+			Expect(RejectedOverloaded.String()).To(Equal("overloaded"))
+			Expect(RejectReason(0).String()).To(Equal("rejectReason(0)"))
+		})
+	})
+})
@@ -0,0 +1,83 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// MaxPiggybackedAddresses is the maximum number of PeerAddresses that can be
+// piggybacked onto the body of a message.
+const MaxPiggybackedAddresses = 16
+
+// AppendPeerAddresses appends the PeerAddresses to the body of a message, so
+// that they can be piggybacked onto responses (e.g. pongs, and the
+// acknowledgements of broadcasts) and disseminated without flooding. Every
+// address is encoded using the codec, and prefixed by its length as a uint16.
+// The addresses are followed by their total length as a uint16, so that they
+// can be split from the end of the body by SplitPeerAddresses. At most
+// MaxPiggybackedAddresses are appended.
+func AppendPeerAddresses(body MessageBody, codec PeerAddressCodec, addrs PeerAddresses) (MessageBody, error) {
+	if len(addrs) > MaxPiggybackedAddresses {
+		addrs = addrs[:MaxPiggybackedAddresses]
+	}
+	block := []byte{}
+	for _, addr := range addrs {
+		data, err := codec.Encode(addr)
+		if err != nil {
+			return nil, fmt.Errorf("error encoding address of peer=%v: %v", addr.PeerID(), err)
+		}
+		if len(block)+2+len(data) > math.MaxUint16 {
+			break
+		}
+		block = append(block, 0, 0)
+		binary.LittleEndian.PutUint16(block[len(block)-2:], uint16(len(data)))
+		block = append(block, data...)
+	}
+
+	appended := make(MessageBody, 0, len(body)+len(block)+2)
+	appended = append(appended, body...)
+	appended = append(appended, block...)
+	appended = append(appended, 0, 0)
+	binary.LittleEndian.PutUint16(appended[len(appended)-2:], uint16(len(block)))
+	return appended, nil
+}
+
+// SplitPeerAddresses splits the PeerAddresses that were appended by
+// AppendPeerAddresses from the end of the body of a message, and returns the
+// rest of the body. Addresses that cannot be decoded by the codec are
+// skipped, but a body that is truncated, or that has more than
+// MaxPiggybackedAddresses, returns an error.
+func SplitPeerAddresses(body MessageBody, codec PeerAddressCodec) (MessageBody, PeerAddresses, error) {
+	if len(body) < 2 {
+		return nil, nil, fmt.Errorf("expected piggybacked addresses, got len=%v", len(body))
+	}
+	blockLen := int(binary.LittleEndian.Uint16(body[len(body)-2:]))
+	if blockLen > len(body)-2 {
+		return nil, nil, fmt.Errorf("expected piggybacked addresses of len=%v, got len=%v", blockLen, len(body)-2)
+	}
+	rest := body[:len(body)-2-blockLen]
+	block := body[len(body)-2-blockLen : len(body)-2]
+
+	addrs := PeerAddresses{}
+	for len(block) > 0 {
+		if len(addrs) == MaxPiggybackedAddresses {
+			return nil, nil, fmt.Errorf("expected at most %v piggybacked addresses", MaxPiggybackedAddresses)
+		}
+		if len(block) < 2 {
+			return nil, nil, fmt.Errorf("expected length of piggybacked address, got len=%v", len(block))
+		}
+		addrLen := int(binary.LittleEndian.Uint16(block))
+		block = block[2:]
+		if addrLen > len(block) {
+			return nil, nil, fmt.Errorf("expected piggybacked address of len=%v, got len=%v", addrLen, len(block))
+		}
+		addr, err := codec.Decode(block[:addrLen])
+		block = block[addrLen:]
+		if err != nil {
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+	return rest, addrs, nil
+}
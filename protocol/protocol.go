@@ -22,6 +22,79 @@ type Session interface {
 	WriteMessage(io.Writer, Message) error
 }
 
+// An IdentifiedSession is a Session that knows the remote Peer, and whether
+// its messages are encrypted. The Sessions of the handshake package are
+// IdentifiedSessions, so that a Session can be type asserted to expose its
+// security state without breaking other implementations of the Session.
+type IdentifiedSession interface {
+	Session
+
+	// PeerID of the remote Peer.
+	PeerID() PeerID
+
+	// Encrypted returns true if messages are encrypted before being written.
+	Encrypted() bool
+}
+
+// SessionPeerID returns the PeerID of the remote Peer of the Session, or nil if
+// the Session is not an IdentifiedSession.
+func SessionPeerID(session Session) PeerID {
+	if session, ok := session.(IdentifiedSession); ok {
+		return session.PeerID()
+	}
+	return nil
+}
+
+// SessionEncrypted returns true if the Session is an IdentifiedSession that
+// encrypts its messages. Other Sessions are assumed to be plaintext.
+func SessionEncrypted(session Session) bool {
+	if session, ok := session.(IdentifiedSession); ok {
+		return session.Encrypted()
+	}
+	return false
+}
+
+// EncryptionPolicy specifies the Peers with which all traffic must be sent
+// over encrypted Sessions. The zero value does not require encryption.
+type EncryptionPolicy struct {
+	RequireAll bool    // Require encryption with all Peers
+	Peers      PeerIDs // Require encryption with these Peers
+}
+
+// Requires returns true if traffic with the Peer must be encrypted.
+func (policy EncryptionPolicy) Requires(peerID PeerID) bool {
+	if policy.RequireAll {
+		return true
+	}
+	for _, id := range policy.Peers {
+		if id.Equal(peerID) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check returns an ErrPlaintextSession if the Session is not encrypted, but
+// the policy requires encryption with its Peer. Sessions that are not
+// IdentifiedSessions are only allowed if the policy does not require
+// encryption at all.
+func (policy EncryptionPolicy) Check(session Session) error {
+	peerID := SessionPeerID(session)
+	if SessionEncrypted(session) {
+		return nil
+	}
+	if peerID == nil {
+		if policy.RequireAll || len(policy.Peers) > 0 {
+			return NewErrPlaintextSession(nil)
+		}
+		return nil
+	}
+	if !policy.Requires(peerID) {
+		return nil
+	}
+	return NewErrPlaintextSession(peerID)
+}
+
 // SessionManager is able to establish new Session with a Peer.
 type SessionManager interface {
 	NewSession(peerID PeerID, key []byte) Session
@@ -34,12 +107,59 @@ type Client interface {
 	Run(context.Context, MessageReceiver)
 }
 
+// A QueueClient is a Client that can also pop the messages that it sends from
+// a MessageQueue, only as fast as it can send them, so that messages wait in
+// the queue in the order of their priority rather than in the Client. Peers
+// use RunQueue instead of Run when their Client implements it.
+type QueueClient interface {
+	Client
+	RunQueue(context.Context, *MessageQueue)
+}
+
+// An OutboundHook transforms the messages that are sent to other Peers before
+// they are given to the Client (e.g. to re-encrypt, re-sign or annotate the
+// messages of specific Peers). Gateways that translate between versions or
+// encodings of the network use it to rewrite messages per destination. The
+// message is dropped if an error is returned. Hooks are called by a single
+// goroutine, so they must not block.
+type OutboundHook interface {
+	Outbound(to PeerAddress, message Message) (Message, error)
+}
+
+// OutboundHookFunc is a function that implements the OutboundHook interface.
+type OutboundHookFunc func(to PeerAddress, message Message) (Message, error)
+
+// Outbound implements the OutboundHook interface.
+func (f OutboundHookFunc) Outbound(to PeerAddress, message Message) (Message, error) {
+	return f(to, message)
+}
+
+// An AddressFinder finds the PeerAddress of a Peer that is not known locally,
+// by asking other Peers for it (e.g. see findnode.NodeFinder). It is used to
+// refresh the address of a Peer when a message is sent to it, and must return
+// once the context is done.
+type AddressFinder interface {
+	FindNode(ctx context.Context, target PeerID) (PeerAddress, error)
+}
+
 // Server listens for messages sent by other Peers and pipes it to the message
 // handler through the provided MessageSender
 type Server interface {
 	Run(context.Context, MessageSender)
 }
 
+// Servers is a list of Servers that is itself a Server. It runs all of them at
+// once, and pipes the messages they receive to the same MessageSender, so that
+// a Peer can listen on several addresses or transports at once.
+type Servers []Server
+
+// Run all of the Servers until they return.
+func (servers Servers) Run(ctx context.Context, messages MessageSender) {
+	phi.ParForAll(servers, func(i int) {
+		servers[i].Run(ctx, messages)
+	})
+}
+
 // Spawn multiple goroutine workers to process the peer addresses in the queue one-by-one.
 func ParForAllAddresses(addrs PeerAddresses, numWorkers int, f func(PeerAddress)) {
 	peerAddrsQ := make(chan PeerAddress, len(addrs))
@@ -54,3 +174,46 @@ func ParForAllAddresses(addrs PeerAddresses, numWorkers int, f func(PeerAddress)
 		}
 	})
 }
+
+// ParForAllAddressesWithContext spawns multiple goroutine workers to process
+// the peer addresses one-by-one, until all addresses have been processed or
+// the context is done. Addresses that have not been processed when the context
+// is done are not passed to f, and fail with the error of the context. It
+// returns an ErrAddresses with the error of every address that failed, or nil
+// if none of them failed.
+func ParForAllAddressesWithContext(ctx context.Context, addrs PeerAddresses, numWorkers int, f func(context.Context, PeerAddress) error) error {
+	if numWorkers < 1 {
+		numWorkers = 1
+	}
+	indices := make(chan int, len(addrs))
+	for i := range addrs {
+		indices <- i
+	}
+	close(indices)
+
+	// Every address is processed by exactly one worker, so workers can write
+	// their errors without synchronisation.
+	errs := make([]error, len(addrs))
+	phi.ForAll(numWorkers, func(_ int) {
+		for i := range indices {
+			select {
+			case <-ctx.Done():
+				errs[i] = ctx.Err()
+				continue
+			default:
+			}
+			errs[i] = f(ctx, addrs[i])
+		}
+	})
+
+	addrErrs := []AddressError{}
+	for i, err := range errs {
+		if err != nil {
+			addrErrs = append(addrErrs, AddressError{PeerAddress: addrs[i], Err: err})
+		}
+	}
+	if len(addrErrs) == 0 {
+		return nil
+	}
+	return NewErrAddresses(addrErrs)
+}
@@ -1 +1,141 @@
 package protocol_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync/atomic"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/protocol"
+	. "github.com/renproject/aw/testutil"
+
+	"github.com/renproject/aw/handshake"
+)
+
+var _ = Describe("Encryption policy", func() {
+	Context("when checking a session", func() {
+		It("should only reject plaintext sessions with the required peers", func() {
+			required, other := RandomPeerID(), RandomPeerID()
+			policy := EncryptionPolicy{Peers: PeerIDs{required}}
+			Expect(policy.Requires(required)).Should(BeTrue())
+			Expect(policy.Requires(other)).Should(BeFalse())
+
+			insecure := handshake.NewInsecureSessionManager()
+			err := policy.Check(insecure.NewSession(required, nil))
+			Expect(err).To(BeAssignableToTypeOf(ErrPlaintextSession{}))
+			Expect(err.(ErrPlaintextSession).PeerID.Equal(required)).Should(BeTrue())
+			Expect(policy.Check(insecure.NewSession(other, nil))).To(Succeed())
+
+			gcm := handshake.NewGCMSessionManager()
+			Expect(policy.Check(gcm.NewSession(required, gcm.NewSessionKey()))).To(Succeed())
+		})
+
+		It("should reject all plaintext sessions when required for all peers", func() {
+			policy := EncryptionPolicy{RequireAll: true}
+			Expect(policy.Requires(RandomPeerID())).Should(BeTrue())
+			Expect(policy.Check(handshake.NewInsecureSessionManager().NewSession(RandomPeerID(), nil))).NotTo(Succeed())
+		})
+
+		It("should not reject any session with the zero policy", func() {
+			Expect(EncryptionPolicy{}.Check(handshake.NewInsecureSessionManager().NewSession(RandomPeerID(), nil))).To(Succeed())
+		})
+
+		It("should treat sessions that are not identified as plaintext sessions with an unknown peer", func() {
+			session := unidentifiedSession{handshake.NewGCMSessionManager().NewSession(RandomPeerID(), make([]byte, 32))}
+			Expect(SessionPeerID(session)).To(BeNil())
+			Expect(SessionEncrypted(session)).Should(BeFalse())
+			Expect(EncryptionPolicy{}.Check(session)).To(Succeed())
+			Expect(EncryptionPolicy{Peers: PeerIDs{RandomPeerID()}}.Check(session)).To(BeAssignableToTypeOf(ErrPlaintextSession{}))
+			Expect(EncryptionPolicy{RequireAll: true}.Check(session)).To(BeAssignableToTypeOf(ErrPlaintextSession{}))
+		})
+	})
+})
+
+// unidentifiedSession hides the PeerID and the encryption of the Session that
+// it wraps.
+type unidentifiedSession struct {
+	session Session
+}
+
+func (session unidentifiedSession) ReadMessageOnTheWire(r io.Reader) (MessageOnTheWire, error) {
+	return session.session.ReadMessageOnTheWire(r)
+}
+
+func (session unidentifiedSession) WriteMessage(w io.Writer, message Message) error {
+	return session.session.WriteMessage(w, message)
+}
+
+var _ = Describe("Parallel for all addresses", func() {
+	Context("when processing addresses with a context", func() {
+		It("should process every address once and return nil if none of them fail", func() {
+			addrs := RandomAddresses(16)
+			var processed int64
+			err := ParForAllAddressesWithContext(context.Background(), addrs, 4, func(ctx context.Context, addr PeerAddress) error {
+				atomic.AddInt64(&processed, 1)
+				return nil
+			})
+			Expect(err).To(BeNil())
+			Expect(processed).Should(Equal(int64(len(addrs))))
+		})
+
+		It("should return the error of every address that fails", func() {
+			addrs := RandomAddresses(16)
+			failed := map[string]bool{}
+			for i, addr := range addrs {
+				failed[addr.String()] = i%3 == 0
+			}
+			err := ParForAllAddressesWithContext(context.Background(), addrs, 4, func(ctx context.Context, addr PeerAddress) error {
+				if failed[addr.String()] {
+					return errors.New("failed")
+				}
+				return nil
+			})
+			Expect(err).To(BeAssignableToTypeOf(ErrAddresses{}))
+			Expect(err.(ErrAddresses).Errs).Should(HaveLen(6))
+			for _, addrErr := range err.(ErrAddresses).Errs {
+				Expect(failed[addrErr.PeerAddress.String()]).Should(BeTrue())
+				Expect(addrErr.Err).To(HaveOccurred())
+			}
+		})
+
+		It("should not process addresses once the context is done", func() {
+			addrs := RandomAddresses(16)
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			var processed int64
+			err := ParForAllAddressesWithContext(ctx, addrs, 4, func(ctx context.Context, addr PeerAddress) error {
+				atomic.AddInt64(&processed, 1)
+				return nil
+			})
+			Expect(processed).Should(BeZero())
+			Expect(err).To(BeAssignableToTypeOf(ErrAddresses{}))
+			Expect(err.(ErrAddresses).Errs).Should(HaveLen(len(addrs)))
+			for _, addrErr := range err.(ErrAddresses).Errs {
+				Expect(addrErr.Err).To(Equal(context.Canceled))
+			}
+		})
+	})
+})
+
+var _ = Describe("Servers", func() {
+	Context("when running several servers", func() {
+		It("should pipe the messages of all of them to the same sender", func() {
+			servers := Servers{}
+			for i := 0; i < 3; i++ {
+				servers = append(servers, mockServer(RandomMessage(V1, Ping)))
+			}
+			messages := make(chan MessageOnTheWire, len(servers))
+			servers.Run(context.Background(), messages)
+			Expect(messages).Should(HaveLen(len(servers)))
+		})
+	})
+})
+
+// mockServer is a Server that sends a message and returns.
+type mockServer Message
+
+func (server mockServer) Run(ctx context.Context, messages MessageSender) {
+	messages <- MessageOnTheWire{Message: Message(server)}
+}
@@ -0,0 +1,319 @@
+package protocol
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrMessageQueueFull is returned when a message is dropped, instead of being
+// pushed, because its lane of the MessageQueue is full.
+var ErrMessageQueueFull = NewError(ErrUnavailable, "message queue is full")
+
+// MessagePriority of a message in a MessageQueue. Messages with a higher
+// priority are popped first.
+type MessagePriority uint8
+
+const (
+	// PriorityLow messages are gossiped to groups of peers (e.g. broadcasts),
+	// and are relayed by other peers when they are dropped.
+	PriorityLow = MessagePriority(0)
+	// PriorityNormal messages are sent from one peer to another (e.g. casts,
+	// and lookups).
+	PriorityNormal = MessagePriority(1)
+	// PriorityHigh messages maintain liveness (i.e. pings and pongs), and are
+	// never stuck behind a backlog of other messages.
+	PriorityHigh = MessagePriority(2)
+
+	numPriorities = 3
+)
+
+func (priority MessagePriority) String() string {
+	switch priority {
+	case PriorityLow:
+		return "low"
+	case PriorityNormal:
+		return "normal"
+	case PriorityHigh:
+		return "high"
+	default:
+		return fmt.Sprintf("messagePriority(%d)", uint8(priority))
+	}
+}
+
+// MessagePriorityOf returns the priority of messages of the variant in a
+// MessageQueue.
+func MessagePriorityOf(variant MessageVariant) MessagePriority {
+	switch variant {
+	case Ping, Pong:
+		return PriorityHigh
+	case Broadcast, Multicast, CatchUp:
+		return PriorityLow
+	default:
+		return PriorityNormal
+	}
+}
+
+// DropPolicy decides what happens to a message that is pushed to a full lane
+// of a MessageQueue.
+type DropPolicy uint8
+
+const (
+	// DropOldest drops the oldest message in the lane to make room for the
+	// message.
+	DropOldest = DropPolicy(1)
+	// DropNewest drops the message.
+	DropNewest = DropPolicy(2)
+	// BlockWhenFull waits until there is room in the lane for the message.
+	BlockWhenFull = DropPolicy(3)
+)
+
+func (policy DropPolicy) String() string {
+	switch policy {
+	case DropOldest:
+		return "drop-oldest"
+	case DropNewest:
+		return "drop-newest"
+	case BlockWhenFull:
+		return "block-when-full"
+	default:
+		return fmt.Sprintf("dropPolicy(%d)", uint8(policy))
+	}
+}
+
+// MessageQueueOptions are used to parameterise the behaviour of a
+// MessageQueue.
+type MessageQueueOptions struct {
+	// Capacity of every lane of the queue. Defaults to 1024.
+	Capacity int
+	// DropPolicy of the PriorityHigh and PriorityNormal lanes of the queue.
+	// Defaults to BlockWhenFull, so that pings, pongs and casts are never
+	// dropped by the queue.
+	DropPolicy DropPolicy
+	// LowPriorityDropPolicy of the PriorityLow lane of the queue. Defaults to
+	// DropOldest, because gossip is relayed by other peers when it is dropped,
+	// and so that a backlog of gossip never blocks the other lanes.
+	LowPriorityDropPolicy DropPolicy
+
+	// Events is optional. When set, an EventMessageDropped is sent to it,
+	// without blocking, for every message that is dropped by the queue.
+	Events EventSender
+}
+
+func (options *MessageQueueOptions) setZerosToDefaults() {
+	if options.Capacity <= 0 {
+		options.Capacity = 1024
+	}
+	if options.DropPolicy == 0 {
+		options.DropPolicy = BlockWhenFull
+	}
+	if options.LowPriorityDropPolicy == 0 {
+		options.LowPriorityDropPolicy = DropOldest
+	}
+}
+
+// MessageQueueStats are the number of messages in every lane of a
+// MessageQueue, and the number of messages that every lane has dropped, by
+// MessagePriority.
+type MessageQueueStats struct {
+	Queued  map[MessagePriority]int    `json:"queued"`
+	Dropped map[MessagePriority]uint64 `json:"dropped"`
+}
+
+// A MessageQueue is a bounded queue of messages with a lane for every
+// MessagePriority. Messages are popped from the lane with the highest priority
+// first, and in the order they were pushed within a lane, so that a backlog of
+// gossip cannot hold up the pings and pongs behind it (e.g. when the
+// connections to other peers are slow to write). Lanes that are full drop
+// messages according to their DropPolicy. It is safe for concurrent use.
+type MessageQueue struct {
+	options MessageQueueOptions
+
+	mu      *sync.Mutex
+	lanes   [numPriorities][]MessageOnTheWire
+	dropped [numPriorities]uint64
+
+	ready chan struct{}                // Signalled when a message is pushed
+	space [numPriorities]chan struct{} // Signalled when a message is popped from a lane
+}
+
+// NewMessageQueue returns an empty MessageQueue.
+func NewMessageQueue(options MessageQueueOptions) *MessageQueue {
+	options.setZerosToDefaults()
+	queue := &MessageQueue{
+		options: options,
+
+		mu:    new(sync.Mutex),
+		ready: make(chan struct{}, 1),
+	}
+	for i := range queue.space {
+		queue.space[i] = make(chan struct{}, 1)
+	}
+	return queue
+}
+
+// Push the message to the lane of its priority. It returns
+// ErrMessageQueueFull if the message is dropped by the DropNewest policy, and
+// the error of the context if it is done while the BlockWhenFull policy is
+// waiting for room in the lane.
+func (queue *MessageQueue) Push(ctx context.Context, messageOtw MessageOnTheWire) error {
+	priority := MessagePriorityOf(messageOtw.Message.Variant)
+	policy := queue.options.DropPolicy
+	if priority == PriorityLow {
+		policy = queue.options.LowPriorityDropPolicy
+	}
+	for {
+		queue.mu.Lock()
+		lane := queue.lanes[priority]
+		if len(lane) < queue.options.Capacity {
+			queue.lanes[priority] = append(lane, messageOtw)
+			// Wake up the next push that is waiting for room in the lane,
+			// because only one push is woken up by every pop
+			if len(lane)+1 < queue.options.Capacity {
+				signal(queue.space[priority])
+			}
+			queue.mu.Unlock()
+			signal(queue.ready)
+			return nil
+		}
+		switch policy {
+		case DropOldest:
+			oldest := lane[0]
+			copy(lane, lane[1:])
+			lane[len(lane)-1] = messageOtw
+			queue.dropped[priority]++
+			queue.mu.Unlock()
+			queue.drop(oldest)
+			signal(queue.ready)
+			return nil
+		case DropNewest:
+			queue.dropped[priority]++
+			queue.mu.Unlock()
+			queue.drop(messageOtw)
+			return ErrMessageQueueFull
+		}
+		queue.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-queue.space[priority]:
+		}
+	}
+}
+
+// Pop the oldest message from the lane with the highest priority that is not
+// empty. It waits until a message is pushed if the queue is empty, and returns
+// the error of the context if it is done first.
+func (queue *MessageQueue) Pop(ctx context.Context) (MessageOnTheWire, error) {
+	for {
+		if messageOtw, ok := queue.tryPop(); ok {
+			return messageOtw, nil
+		}
+		select {
+		case <-ctx.Done():
+			return MessageOnTheWire{}, ctx.Err()
+		case <-queue.ready:
+		}
+	}
+}
+
+func (queue *MessageQueue) tryPop() (MessageOnTheWire, bool) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	for priority := numPriorities - 1; priority >= 0; priority-- {
+		lane := queue.lanes[priority]
+		if len(lane) == 0 {
+			continue
+		}
+		messageOtw := lane[0]
+		lane[0] = MessageOnTheWire{}
+		queue.lanes[priority] = lane[1:]
+		if len(queue.lanes[priority]) == 0 {
+			// Release the backing array of the lane once it has drained
+			queue.lanes[priority] = nil
+		}
+		signal(queue.space[priority])
+		return messageOtw, true
+	}
+	return MessageOnTheWire{}, false
+}
+
+// Run pops messages from the queue, and sends them to the MessageSender, until
+// the context is done.
+func (queue *MessageQueue) Run(ctx context.Context, messages MessageSender) {
+	for {
+		messageOtw, err := queue.Pop(ctx)
+		if err != nil {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case messages <- messageOtw:
+		}
+	}
+}
+
+// drop emits an EventMessageDropped for the message to the Events without
+// blocking, so that a slow reader cannot block the queue.
+func (queue *MessageQueue) drop(messageOtw MessageOnTheWire) {
+	if queue.options.Events == nil {
+		return
+	}
+	var peerID PeerID
+	if messageOtw.To != nil {
+		peerID = messageOtw.To.PeerID()
+	}
+	event := EventMessageDropped{
+		Time:    time.Now(),
+		PeerID:  peerID,
+		Variant: messageOtw.Message.Variant,
+		Hash:    messageOtw.Message.Hash(),
+		Reason:  ErrMessageQueueFull.Error(),
+	}
+	select {
+	case queue.options.Events <- event:
+	default:
+	}
+}
+
+// Len returns the number of messages in the lane of the priority.
+func (queue *MessageQueue) Len(priority MessagePriority) int {
+	if priority >= numPriorities {
+		return 0
+	}
+
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	return len(queue.lanes[priority])
+}
+
+// Stats returns the number of messages that are in every lane, and that every
+// lane has dropped.
+func (queue *MessageQueue) Stats() MessageQueueStats {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	stats := MessageQueueStats{
+		Queued:  make(map[MessagePriority]int, numPriorities),
+		Dropped: make(map[MessagePriority]uint64, numPriorities),
+	}
+	for priority := MessagePriority(0); priority < numPriorities; priority++ {
+		stats.Queued[priority] = len(queue.lanes[priority])
+		stats.Dropped[priority] = queue.dropped[priority]
+	}
+	return stats
+}
+
+// signal the channel without blocking. Channels that have already been
+// signalled stay signalled.
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
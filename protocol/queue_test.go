@@ -0,0 +1,171 @@
+package protocol_test
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/protocol"
+	. "github.com/renproject/aw/testutil"
+)
+
+var _ = Describe("Message queues", func() {
+	messageOf := func(variant MessageVariant, body byte) MessageOnTheWire {
+		groupID := NilGroupID
+		if variant == Broadcast || variant == Multicast {
+			groupID = RandomGroupID()
+		}
+		return MessageOnTheWire{Message: NewMessage(V1, variant, groupID, MessageBody{body})}
+	}
+
+	Context("when popping messages", func() {
+		It("should pop pings and pongs before casts, and casts before broadcasts", func() {
+			queue := NewMessageQueue(MessageQueueOptions{})
+			ctx := context.Background()
+			pushed := []MessageOnTheWire{
+				messageOf(Broadcast, 0),
+				messageOf(Cast, 1),
+				messageOf(Broadcast, 2),
+				messageOf(Ping, 3),
+				messageOf(Cast, 4),
+				messageOf(Pong, 5),
+			}
+			for _, messageOtw := range pushed {
+				Expect(queue.Push(ctx, messageOtw)).To(Succeed())
+			}
+			Expect(queue.Len(PriorityHigh)).To(Equal(2))
+			Expect(queue.Len(PriorityNormal)).To(Equal(2))
+			Expect(queue.Len(PriorityLow)).To(Equal(2))
+
+			for _, i := range []int{3, 5, 1, 4, 0, 2} {
+				messageOtw, err := queue.Pop(ctx)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(messageOtw).To(Equal(pushed[i]))
+			}
+		})
+
+		It("should wait for a message to be pushed until the context is done", func() {
+			queue := NewMessageQueue(MessageQueueOptions{})
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			_, err := queue.Pop(ctx)
+			Expect(err).To(Equal(context.DeadlineExceeded))
+
+			messageOtw := messageOf(Cast, 0)
+			go func() {
+				time.Sleep(10 * time.Millisecond)
+				queue.Push(context.Background(), messageOtw)
+			}()
+			Expect(queue.Pop(context.Background())).To(Equal(messageOtw))
+		})
+
+		It("should send the messages to the MessageSender when running", func() {
+			queue := NewMessageQueue(MessageQueueOptions{})
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			Expect(queue.Push(ctx, messageOf(Broadcast, 0))).To(Succeed())
+			Expect(queue.Push(ctx, messageOf(Ping, 1))).To(Succeed())
+
+			messages := make(chan MessageOnTheWire)
+			go queue.Run(ctx, messages)
+			var messageOtw MessageOnTheWire
+			Eventually(messages).Should(Receive(&messageOtw))
+			Expect(messageOtw.Message.Variant).To(Equal(Ping))
+			Eventually(messages).Should(Receive(&messageOtw))
+			Expect(messageOtw.Message.Variant).To(Equal(Broadcast))
+		})
+	})
+
+	Context("when a lane is full", func() {
+		It("should drop the oldest gossip of the lane, and emit an event, by default", func() {
+			events := make(chan Event, 1)
+			queue := NewMessageQueue(MessageQueueOptions{Capacity: 2, Events: events})
+			ctx := context.Background()
+			pushed := make([]MessageOnTheWire, 3)
+			for i := range pushed {
+				pushed[i] = messageOf(Broadcast, byte(i))
+				Expect(queue.Push(ctx, pushed[i])).To(Succeed())
+			}
+			Expect(queue.Push(ctx, messageOf(Ping, 3))).To(Succeed())
+			Expect(queue.Stats()).To(Equal(MessageQueueStats{
+				Queued:  map[MessagePriority]int{PriorityLow: 2, PriorityNormal: 0, PriorityHigh: 1},
+				Dropped: map[MessagePriority]uint64{PriorityLow: 1, PriorityNormal: 0, PriorityHigh: 0},
+			}))
+			var event Event
+			Expect(events).To(Receive(&event))
+			Expect(event).To(Equal(EventMessageDropped{
+				Time:    event.(EventMessageDropped).Time,
+				Variant: Broadcast,
+				Hash:    pushed[0].Message.Hash(),
+				Reason:  ErrMessageQueueFull.Error(),
+			}))
+
+			for _, body := range []byte{3, 1, 2} {
+				messageOtw, err := queue.Pop(ctx)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(messageOtw.Message.Body).To(Equal(MessageBody{body}))
+			}
+		})
+
+		It("should not drop pings, pongs or casts by default", func() {
+			events := make(chan Event, 1)
+			queue := NewMessageQueue(MessageQueueOptions{Capacity: 1, Events: events})
+			for _, variant := range []MessageVariant{Ping, Cast} {
+				Expect(queue.Push(context.Background(), messageOf(variant, 0))).To(Succeed())
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+				Expect(queue.Push(ctx, messageOf(variant, 1))).To(Equal(context.DeadlineExceeded))
+				cancel()
+			}
+			Expect(queue.Stats().Dropped).To(Equal(map[MessagePriority]uint64{PriorityLow: 0, PriorityNormal: 0, PriorityHigh: 0}))
+			Expect(events).ShouldNot(Receive())
+		})
+
+		It("should drop the message when dropping the newest", func() {
+			events := make(chan Event, 1)
+			queue := NewMessageQueue(MessageQueueOptions{Capacity: 1, DropPolicy: DropNewest, Events: events})
+			ctx := context.Background()
+			Expect(queue.Push(ctx, messageOf(Cast, 0))).To(Succeed())
+			dropped := messageOf(Cast, 1)
+			Expect(queue.Push(ctx, dropped)).To(Equal(ErrMessageQueueFull))
+			Expect(queue.Stats().Dropped[PriorityNormal]).To(Equal(uint64(1)))
+			var event Event
+			Expect(events).To(Receive(&event))
+			Expect(event.(EventMessageDropped).Hash).To(Equal(dropped.Message.Hash()))
+
+			messageOtw, err := queue.Pop(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(messageOtw.Message.Body).To(Equal(MessageBody{0}))
+		})
+
+		It("should wait for room in the lane when blocking", func() {
+			queue := NewMessageQueue(MessageQueueOptions{Capacity: 1, DropPolicy: BlockWhenFull})
+			Expect(queue.Push(context.Background(), messageOf(Cast, 0))).To(Succeed())
+
+			// Other lanes are not blocked by the full lane
+			Expect(queue.Push(context.Background(), messageOf(Ping, 1))).To(Succeed())
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			Expect(queue.Push(ctx, messageOf(Cast, 2))).To(Equal(context.DeadlineExceeded))
+
+			pushed := make(chan error, 2)
+			for i := 3; i < 5; i++ {
+				go func(i int) {
+					pushed <- queue.Push(context.Background(), messageOf(Cast, byte(i)))
+				}(i)
+			}
+			Consistently(pushed, 20*time.Millisecond).ShouldNot(Receive())
+			for i := 0; i < 3; i++ {
+				_, err := queue.Pop(context.Background())
+				Expect(err).NotTo(HaveOccurred())
+				Eventually(queue.Stats).Should(Equal(MessageQueueStats{
+					Queued:  map[MessagePriority]int{PriorityLow: 0, PriorityNormal: 1, PriorityHigh: 0},
+					Dropped: map[MessagePriority]uint64{PriorityLow: 0, PriorityNormal: 0, PriorityHigh: 0},
+				}))
+			}
+			Expect(pushed).To(HaveLen(2))
+			Expect(queue.Stats().Dropped[PriorityNormal]).To(BeZero())
+		})
+	})
+})
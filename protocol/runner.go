@@ -0,0 +1,144 @@
+package protocol
+
+import (
+	"context"
+	"sync"
+)
+
+// A Runner is a subsystem of a Peer with a lifecycle (e.g. a Broadcaster, that
+// propagates messages in the background). Runners are started, and stopped, by
+// the Peer in a consistent order (see RunGroup).
+type Runner interface {
+	// Run the subsystem until the context is done, or until it fails. It
+	// returns nil once the context is done, and must not be called more than
+	// once.
+	Run(ctx context.Context) error
+
+	// Ready returns a channel that is closed once the subsystem is running,
+	// and ready to be used.
+	Ready() <-chan struct{}
+}
+
+// Readiness is the channel returned by the Ready method of a Runner. It can be
+// signalled any number of times, but is only closed once.
+type Readiness struct {
+	once  *sync.Once
+	ready chan struct{}
+}
+
+// NewReadiness returns a Readiness that has not been signalled.
+func NewReadiness() Readiness {
+	return Readiness{
+		once:  new(sync.Once),
+		ready: make(chan struct{}),
+	}
+}
+
+// Signal that the Runner is ready.
+func (readiness Readiness) Signal() {
+	readiness.once.Do(func() {
+		close(readiness.ready)
+	})
+}
+
+// Ready returns a channel that is closed once the Runner is ready.
+func (readiness Readiness) Ready() <-chan struct{} {
+	return readiness.ready
+}
+
+// A RunGroup is a list of Runners that is itself a Runner. The Runners are
+// started in order, each one once the previous one is ready, and are stopped
+// in the reverse order, each one once the next one has returned, so that
+// subsystems are never used by other subsystems after they have stopped.
+type RunGroup struct {
+	runners   []Runner
+	readiness Readiness
+}
+
+// NewRunGroup returns a RunGroup of the Runners, in the order in which they
+// are started.
+func NewRunGroup(runners ...Runner) *RunGroup {
+	return &RunGroup{
+		runners:   runners,
+		readiness: NewReadiness(),
+	}
+}
+
+// Run all of the Runners until the context is done, or until one of them
+// fails, and then stop all of them. It returns an ErrRunners with the error of
+// every Runner that failed, or nil if none of them failed. Runners that return
+// the error of their context once they are stopped have not failed.
+func (group *RunGroup) Run(ctx context.Context) error {
+	errs := make([]error, len(group.runners))
+	exited := make([]bool, len(group.runners))
+	exits := make(chan int, len(group.runners))
+	failed := false
+
+	// wait until the ready channel is closed, the Runner at the index exits,
+	// any of the Runners fails, or the context is done
+	wait := func(ready <-chan struct{}, index int) {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ready:
+				return
+			case i := <-exits:
+				exited[i] = true
+				if errs[i] != nil {
+					failed = true
+					return
+				}
+				if i == index {
+					return
+				}
+			}
+		}
+	}
+
+	// Runners are not given the context, because they must keep running
+	// until the Runners after them have stopped
+	cancels := make([]context.CancelFunc, 0, len(group.runners))
+	for i, runner := range group.runners {
+		if failed || ctx.Err() != nil {
+			break
+		}
+		runnerCtx, cancel := context.WithCancel(context.Background())
+		cancels = append(cancels, cancel)
+		go func(i int, runner Runner) {
+			if err := runner.Run(runnerCtx); err != context.Canceled {
+				errs[i] = err
+			}
+			exits <- i
+		}(i, runner)
+		wait(runner.Ready(), i)
+	}
+	if !failed && ctx.Err() == nil {
+		group.readiness.Signal()
+		wait(nil, -1)
+	}
+
+	// Stop the Runners in the reverse order
+	for i := len(cancels) - 1; i >= 0; i-- {
+		cancels[i]()
+		for !exited[i] {
+			exited[<-exits] = true
+		}
+	}
+
+	runErrs := []error{}
+	for _, err := range errs {
+		if err != nil {
+			runErrs = append(runErrs, err)
+		}
+	}
+	if len(runErrs) == 0 {
+		return nil
+	}
+	return NewErrRunners(runErrs)
+}
+
+// Ready returns a channel that is closed once all of the Runners are ready.
+func (group *RunGroup) Ready() <-chan struct{} {
+	return group.readiness.Ready()
+}
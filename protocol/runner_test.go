@@ -0,0 +1,102 @@
+package protocol_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/protocol"
+)
+
+// mockRunner records when it starts and stops, and fails with its error before
+// it is ready, if it has one.
+type mockRunner struct {
+	name      string
+	err       error
+	readiness Readiness
+
+	mu  *sync.Mutex
+	log *[]string
+}
+
+func newMockRunner(name string, err error, mu *sync.Mutex, log *[]string) *mockRunner {
+	return &mockRunner{name: name, err: err, readiness: NewReadiness(), mu: mu, log: log}
+}
+
+func (runner *mockRunner) record(event string) {
+	runner.mu.Lock()
+	defer runner.mu.Unlock()
+	*runner.log = append(*runner.log, event+" "+runner.name)
+}
+
+func (runner *mockRunner) Run(ctx context.Context) error {
+	runner.record("start")
+	defer runner.record("stop")
+
+	// Runners that are not ready yet must not be used by the next Runner
+	time.Sleep(5 * time.Millisecond)
+	if runner.err != nil {
+		return runner.err
+	}
+	runner.readiness.Signal()
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (runner *mockRunner) Ready() <-chan struct{} {
+	return runner.readiness.Ready()
+}
+
+var _ = Describe("Run groups", func() {
+	Context("when running", func() {
+		It("should start the runners in order, and stop them in the reverse order", func() {
+			mu, log := new(sync.Mutex), []string{}
+			group := NewRunGroup(
+				newMockRunner("a", nil, mu, &log),
+				newMockRunner("b", nil, mu, &log),
+				newMockRunner("c", nil, mu, &log),
+			)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error, 1)
+			go func() {
+				done <- group.Run(ctx)
+			}()
+			Eventually(group.Ready()).Should(BeClosed())
+			cancel()
+			Eventually(done).Should(Receive(BeNil()))
+
+			Expect(log).To(Equal([]string{"start a", "start b", "start c", "stop c", "stop b", "stop a"}))
+		})
+	})
+
+	Context("when a runner fails", func() {
+		It("should stop the other runners, and return the errors of the runners that failed", func() {
+			mu, log := new(sync.Mutex), []string{}
+			failure := errors.New("failure")
+			group := NewRunGroup(
+				newMockRunner("a", nil, mu, &log),
+				newMockRunner("b", failure, mu, &log),
+				newMockRunner("c", nil, mu, &log),
+			)
+
+			done := make(chan error, 1)
+			go func() {
+				done <- group.Run(context.Background())
+			}()
+			var err error
+			Eventually(done).Should(Receive(&err))
+			Expect(err).To(BeAssignableToTypeOf(ErrRunners{}))
+			Expect(err.(ErrRunners).Errs).To(Equal([]error{failure}))
+			Expect(group.Ready()).NotTo(BeClosed())
+
+			// Runners after the failed runner are never started
+			mu.Lock()
+			defer mu.Unlock()
+			Expect(log).To(Equal([]string{"start a", "start b", "stop b", "stop a"}))
+		})
+	})
+})
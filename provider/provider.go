@@ -0,0 +1,546 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/renproject/aw/dht"
+	"github.com/renproject/aw/protocol"
+	"github.com/sirupsen/logrus"
+)
+
+// A Router advertises and discovers the providers of keys. Provider records
+// are stored at the peers whose PeerIDs are the closest to the key (see
+// dht.Distance), and that is where they are looked for.
+type Router interface {
+	// Run republishes the records of the keys provided by this peer,
+	// replicates the records of other providers that are stored at this peer,
+	// and removes the expired records, until the context is done.
+	protocol.Runner
+
+	// Stats returns the ReplicationStats of the last republishing or
+	// replication round.
+	Stats() dht.ReplicationStats
+
+	// Provide advertises that this peer provides the key. The record is
+	// republished until the Router stops running.
+	Provide(ctx context.Context, key string) error
+
+	// FindProviders returns the addresses of the providers of the key that
+	// are known by this peer, or by the peers closest to the key that respond
+	// before the timeout.
+	FindProviders(ctx context.Context, key string) (protocol.PeerAddresses, error)
+
+	// AcceptProvide from a peer and store its record. The record does not
+	// need to be sent by its provider, so that it can be replicated.
+	AcceptProvide(ctx context.Context, from protocol.PeerID, message protocol.Message) error
+
+	// AcceptFindProviders from a peer and send it the records of the key that
+	// are stored at this peer.
+	AcceptFindProviders(ctx context.Context, from protocol.PeerID, message protocol.Message) error
+
+	// AcceptProviders from a peer that was asked for the records of a key.
+	AcceptProviders(ctx context.Context, from protocol.PeerID, message protocol.Message) error
+}
+
+// Options are used to parameterise the behaviour of a Router.
+type Options struct {
+	Logger              logrus.FieldLogger
+	K                   int           // Number of closest peers that store, and are asked for, records, defaults to 20
+	TTL                 time.Duration // Time until a record expires, defaults to 24 hours
+	RepublishInterval   time.Duration // Time between republishing the records of this peer, defaults to half of the TTL
+	ReplicationInterval time.Duration // Time between replicating the records of other peers, defaults to 1 hour
+	Timeout             time.Duration // Time to wait for the responses when finding providers, defaults to 1 second
+	MaxProvidersPerKey  int           // Number of records stored for every key, defaults to 20
+}
+
+func (options *Options) setZerosToDefaults() {
+	if options.Logger == nil {
+		options.Logger = logrus.New()
+	}
+	if options.K <= 0 {
+		options.K = 20
+	}
+	if options.TTL <= 0 {
+		options.TTL = 24 * time.Hour
+	}
+	if options.RepublishInterval <= 0 || options.RepublishInterval >= options.TTL {
+		options.RepublishInterval = options.TTL / 2
+	}
+	if options.ReplicationInterval <= 0 {
+		options.ReplicationInterval = time.Hour
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = time.Second
+	}
+	if options.MaxProvidersPerKey <= 0 {
+		options.MaxProvidersPerKey = 20
+	}
+}
+
+type router struct {
+	logger       logrus.FieldLogger
+	options      Options
+	dht          dht.ExtendedDHT
+	messages     protocol.MessageSender
+	signVerifier protocol.SignVerifier
+	codec        protocol.PeerAddressCodec
+	readiness    protocol.Readiness
+	replicator   *dht.Replicator
+	lookups      *dht.Lookups
+
+	mu       *sync.Mutex
+	provided map[string]struct{}
+	records  map[string]map[string]Record
+}
+
+// NewRouter returns a Router that signs and verifies records using the given
+// SignVerifier, and sends Provide, FindProviders and Providers messages using
+// the given MessageSender.
+func NewRouter(options Options, table dht.DHT, messages protocol.MessageSender, signVerifier protocol.SignVerifier, codec protocol.PeerAddressCodec) Router {
+	options.setZerosToDefaults()
+	extended := dht.Extend(table)
+	return &router{
+		logger:       options.Logger,
+		options:      options,
+		dht:          extended,
+		messages:     messages,
+		signVerifier: signVerifier,
+		codec:        codec,
+		readiness:    protocol.NewReadiness(),
+		replicator:   dht.NewReplicator(options.K, extended, messages, protocol.Provide),
+		lookups:      dht.NewLookups(),
+
+		mu:       new(sync.Mutex),
+		provided: map[string]struct{}{},
+		records:  map[string]map[string]Record{},
+	}
+}
+
+func (router *router) Run(ctx context.Context) error {
+	republishTicker := time.NewTicker(router.options.RepublishInterval)
+	defer republishTicker.Stop()
+	replicationTicker := time.NewTicker(router.options.ReplicationInterval)
+	defer replicationTicker.Stop()
+
+	router.readiness.Signal()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-republishTicker.C:
+			router.prune()
+			router.republish(ctx)
+		case <-replicationTicker.C:
+			router.prune()
+			router.replicateAll(ctx)
+		}
+	}
+}
+
+func (router *router) Ready() <-chan struct{} {
+	return router.readiness.Ready()
+}
+
+func (router *router) Provide(ctx context.Context, key string) error {
+	if _, err := router.publish(ctx, key); err != nil {
+		return newErrProviding(err, key)
+	}
+
+	router.mu.Lock()
+	defer router.mu.Unlock()
+
+	router.provided[key] = struct{}{}
+	return nil
+}
+
+func (router *router) Stats() dht.ReplicationStats {
+	return router.replicator.Stats()
+}
+
+// republish new records of the keys provided by this peer.
+func (router *router) republish(ctx context.Context) {
+	router.mu.Lock()
+	keys := make([]string, 0, len(router.provided))
+	for key := range router.provided {
+		keys = append(keys, key)
+	}
+	router.mu.Unlock()
+
+	router.replicator.Round(len(keys), func(i int) int {
+		factor, err := router.publish(ctx, keys[i])
+		if err != nil {
+			router.logger.Errorf("error republishing provider record of key=%v: %v", keys[i], err)
+		}
+		return factor
+	})
+}
+
+// replicateAll sends the records of other providers that are stored at this
+// peer to the peers closest to their keys, so that the records survive when
+// the peers that stored them leave the network.
+func (router *router) replicateAll(ctx context.Context) {
+	me := router.dht.Me().PeerID().String()
+	router.mu.Lock()
+	records := []Record{}
+	for _, stored := range router.records {
+		for id, record := range stored {
+			if id != me {
+				records = append(records, record)
+			}
+		}
+	}
+	router.mu.Unlock()
+
+	router.replicator.Round(len(records), func(i int) int {
+		factor, err := router.replicate(ctx, records[i])
+		if err != nil {
+			router.logger.Errorf("error replicating provider record of key=%v: %v", records[i].Key, err)
+		}
+		return factor
+	})
+}
+
+// prune the expired records stored at this peer.
+func (router *router) prune() {
+	router.mu.Lock()
+	defer router.mu.Unlock()
+
+	now := time.Now()
+	for key, records := range router.records {
+		for id, record := range records {
+			if record.Expired(now) {
+				delete(records, id)
+			}
+		}
+		if len(records) == 0 {
+			delete(router.records, key)
+		}
+	}
+}
+
+// publish a new record of the key, at this peer and at the peers closest to
+// the key. It returns the number of peers that the record was sent to.
+func (router *router) publish(ctx context.Context, key string) (int, error) {
+	if router.signVerifier == nil {
+		return 0, fmt.Errorf("nil sign verifier")
+	}
+	record, err := newRecord(router.signVerifier, router.codec, key, router.dht.Me(), time.Now().Add(router.options.TTL))
+	if err != nil {
+		return 0, err
+	}
+	router.store(record)
+	return router.replicate(ctx, record)
+}
+
+// replicate a record at the peers closest to its key. It returns the number of
+// peers that the record was sent to.
+func (router *router) replicate(ctx context.Context, record Record) (int, error) {
+	buffer := new(bytes.Buffer)
+	if err := marshalRecord(buffer, router.codec, record); err != nil {
+		return 0, err
+	}
+	return router.replicator.Replicate(ctx, record.Key, record.Provider.PeerID(), buffer.Bytes())
+}
+
+func (router *router) FindProviders(ctx context.Context, key string) (protocol.PeerAddresses, error) {
+	closest, err := router.dht.ClosestPeerAddresses(dht.KeyID(key), router.options.K)
+	if err != nil {
+		return nil, newErrFindingProviders(err, key)
+	}
+	me, err := router.codec.Encode(router.dht.Me())
+	if err != nil {
+		return nil, newErrFindingProviders(err, key)
+	}
+	buffer := new(bytes.Buffer)
+	if err := writeBytes(buffer, []byte(key)); err != nil {
+		return nil, newErrFindingProviders(err, key)
+	}
+	if err := writeBytes(buffer, me); err != nil {
+		return nil, newErrFindingProviders(err, key)
+	}
+
+	l, err := router.lookups.Ask(ctx, router.messages, key, closest, protocol.FindProviders, buffer.Bytes())
+	if err != nil {
+		return nil, newErrFindingProviders(err, key)
+	}
+	defer l.Close()
+
+	providers := protocol.PeerAddresses{}
+	seen := map[string]struct{}{}
+	add := func(records []Record) {
+		for _, record := range records {
+			if _, ok := seen[record.Provider.PeerID().String()]; ok {
+				continue
+			}
+			seen[record.Provider.PeerID().String()] = struct{}{}
+			providers = append(providers, record.Provider)
+		}
+	}
+	add(router.stored(key))
+	l.Wait(ctx, router.options.Timeout, func(resp dht.LookupResponse) {
+		add(resp.Records.([]Record))
+	})
+	return providers, nil
+}
+
+func (router *router) AcceptProvide(ctx context.Context, from protocol.PeerID, message protocol.Message) error {
+	// Pre-condition checks
+	if message.Version != protocol.V1 {
+		return protocol.NewErrMessageVersionIsNotSupported(message.Version)
+	}
+	if message.Variant != protocol.Provide {
+		return protocol.NewErrMessageVariantIsNotSupported(message.Variant)
+	}
+
+	buffer := bytes.NewBuffer(message.Body)
+	record, err := unmarshalRecord(buffer, router.codec)
+	if err != nil {
+		return newErrAcceptingProvide(err)
+	}
+	if buffer.Len() != 0 {
+		return newErrAcceptingProvide(fmt.Errorf("%v trailing bytes", buffer.Len()))
+	}
+	if router.signVerifier == nil {
+		return newErrAcceptingProvide(fmt.Errorf("nil sign verifier"))
+	}
+	if err := record.verify(router.signVerifier, router.codec, time.Now()); err != nil {
+		return newErrAcceptingProvide(err)
+	}
+	if record.Expires.After(time.Now().Add(router.options.TTL)) {
+		return newErrAcceptingProvide(fmt.Errorf("record of peer=%v expires after the ttl", record.Provider.PeerID()))
+	}
+	if !router.store(record) {
+		return newErrAcceptingProvide(fmt.Errorf("too many providers of key=%v", record.Key))
+	}
+	return nil
+}
+
+func (router *router) AcceptFindProviders(ctx context.Context, from protocol.PeerID, message protocol.Message) error {
+	// Pre-condition checks
+	if message.Version != protocol.V1 {
+		return protocol.NewErrMessageVersionIsNotSupported(message.Version)
+	}
+	if message.Variant != protocol.FindProviders {
+		return protocol.NewErrMessageVariantIsNotSupported(message.Variant)
+	}
+
+	buffer := bytes.NewBuffer(message.Body)
+	key, err := readBytes(buffer)
+	if err != nil {
+		return newErrAcceptingFindProviders(fmt.Errorf("error unmarshaling key: %v", err))
+	}
+	data, err := readBytes(buffer)
+	if err != nil {
+		return newErrAcceptingFindProviders(fmt.Errorf("error unmarshaling address: %v", err))
+	}
+	if buffer.Len() != 0 {
+		return newErrAcceptingFindProviders(fmt.Errorf("%v trailing bytes", buffer.Len()))
+	}
+	requester, err := router.codec.Decode(data)
+	if err != nil {
+		return newErrAcceptingFindProviders(fmt.Errorf("error decoding address: %v", err))
+	}
+	// Responses are only sent to the authenticated sender, so that the
+	// Router cannot be used to send messages to arbitrary addresses.
+	if from == nil || !requester.PeerID().Equal(from) {
+		return newErrAcceptingFindProviders(fmt.Errorf("address of peer=%v sent by peer=%v", requester.PeerID(), from))
+	}
+
+	records := router.stored(string(key))
+	response := new(bytes.Buffer)
+	if err := writeBytes(response, key); err != nil {
+		return newErrAcceptingFindProviders(err)
+	}
+	if err := binary.Write(response, binary.LittleEndian, uint32(len(records))); err != nil {
+		return newErrAcceptingFindProviders(err)
+	}
+	for _, record := range records {
+		if err := marshalRecord(response, router.codec, record); err != nil {
+			return newErrAcceptingFindProviders(err)
+		}
+	}
+
+	messageWire := protocol.MessageOnTheWire{
+		To:      requester,
+		Message: protocol.NewMessage(protocol.V1, protocol.Providers, protocol.NilGroupID, response.Bytes()),
+	}
+	select {
+	case <-ctx.Done():
+		return newErrAcceptingFindProviders(ctx.Err())
+	case router.messages <- messageWire:
+		return nil
+	}
+}
+
+func (router *router) AcceptProviders(ctx context.Context, from protocol.PeerID, message protocol.Message) error {
+	// Pre-condition checks
+	if message.Version != protocol.V1 {
+		return protocol.NewErrMessageVersionIsNotSupported(message.Version)
+	}
+	if message.Variant != protocol.Providers {
+		return protocol.NewErrMessageVariantIsNotSupported(message.Variant)
+	}
+	if from == nil {
+		return newErrAcceptingProviders(fmt.Errorf("unknown sender"))
+	}
+
+	buffer := bytes.NewBuffer(message.Body)
+	key, err := readBytes(buffer)
+	if err != nil {
+		return newErrAcceptingProviders(fmt.Errorf("error unmarshaling key: %v", err))
+	}
+	numRecords := uint32(0)
+	if err := binary.Read(buffer, binary.LittleEndian, &numRecords); err != nil {
+		return newErrAcceptingProviders(fmt.Errorf("error unmarshaling number of records: %v", err))
+	}
+	if int(numRecords) > router.options.MaxProvidersPerKey {
+		return newErrAcceptingProviders(fmt.Errorf("expected at most %v records, got %v", router.options.MaxProvidersPerKey, numRecords))
+	}
+	records := make([]Record, 0, numRecords)
+	for i := uint32(0); i < numRecords; i++ {
+		record, err := unmarshalRecord(buffer, router.codec)
+		if err != nil {
+			return newErrAcceptingProviders(err)
+		}
+		records = append(records, record)
+	}
+	if buffer.Len() != 0 {
+		return newErrAcceptingProviders(fmt.Errorf("%v trailing bytes", buffer.Len()))
+	}
+
+	// Records that are forged, expired, or for another key are dropped, but
+	// do not invalidate the other records in the response.
+	if !router.lookups.Awaiting(string(key), from) {
+		return nil
+	}
+	verified := make([]Record, 0, len(records))
+	now := time.Now()
+	for _, record := range records {
+		if record.Key != string(key) || router.signVerifier == nil {
+			continue
+		}
+		if err := record.verify(router.signVerifier, router.codec, now); err != nil {
+			router.logger.Warnf("dropping provider record from peer=%v: %v", from, err)
+			continue
+		}
+		verified = append(verified, record)
+	}
+	router.lookups.Respond(string(key), from, verified)
+	return nil
+}
+
+// store a record, replacing the previous record of the same provider if it
+// expires earlier. It returns false if the key already has the maximum number
+// of providers.
+func (router *router) store(record Record) bool {
+	router.mu.Lock()
+	defer router.mu.Unlock()
+
+	records, ok := router.records[record.Key]
+	if !ok {
+		records = map[string]Record{}
+		router.records[record.Key] = records
+	}
+	id := record.Provider.PeerID().String()
+	if stored, ok := records[id]; ok && !record.Expires.After(stored.Expires) {
+		// Replicated records can be older than the stored record
+		return true
+	}
+	if _, ok := records[id]; !ok && len(records) >= router.options.MaxProvidersPerKey {
+		now := time.Now()
+		for id, record := range records {
+			if record.Expired(now) {
+				delete(records, id)
+			}
+		}
+		if len(records) >= router.options.MaxProvidersPerKey {
+			return false
+		}
+	}
+	records[id] = record
+	return true
+}
+
+// stored returns the records of the key that are stored at this peer, and
+// have not expired.
+func (router *router) stored(key string) []Record {
+	router.mu.Lock()
+	defer router.mu.Unlock()
+
+	now := time.Now()
+	records := make([]Record, 0, len(router.records[key]))
+	for _, record := range router.records[key] {
+		if !record.Expired(now) {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+// ErrProviding is returned when there is an error when advertising a key.
+type ErrProviding struct {
+	error
+	Key string
+}
+
+func newErrProviding(err error, key string) error {
+	return ErrProviding{
+		error: fmt.Errorf("error providing key=%v: %v", key, err),
+		Key:   key,
+	}
+}
+
+// ErrFindingProviders is returned when there is an error when finding the
+// providers of a key.
+type ErrFindingProviders struct {
+	error
+	Key string
+}
+
+func newErrFindingProviders(err error, key string) error {
+	return ErrFindingProviders{
+		error: fmt.Errorf("error finding providers of key=%v: %v", key, err),
+		Key:   key,
+	}
+}
+
+// ErrAcceptingProvide is returned when there is an error when accepting a
+// Provide message.
+type ErrAcceptingProvide struct {
+	error
+}
+
+func newErrAcceptingProvide(err error) error {
+	return ErrAcceptingProvide{
+		error: fmt.Errorf("error accepting provide: %v", err),
+	}
+}
+
+// ErrAcceptingFindProviders is returned when there is an error when accepting
+// a FindProviders message.
+type ErrAcceptingFindProviders struct {
+	error
+}
+
+func newErrAcceptingFindProviders(err error) error {
+	return ErrAcceptingFindProviders{
+		error: fmt.Errorf("error accepting findproviders: %v", err),
+	}
+}
+
+// ErrAcceptingProviders is returned when there is an error when accepting a
+// Providers message.
+type ErrAcceptingProviders struct {
+	error
+}
+
+func newErrAcceptingProviders(err error) error {
+	return ErrAcceptingProviders{
+		error: fmt.Errorf("error accepting providers: %v", err),
+	}
+}
@@ -0,0 +1,199 @@
+package provider_test
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/provider"
+	. "github.com/renproject/aw/testutil"
+
+	"github.com/renproject/aw/protocol"
+	"github.com/sirupsen/logrus"
+)
+
+var TestOptions = Options{
+	Logger:             logrus.New(),
+	K:                  3,
+	TTL:                time.Hour,
+	Timeout:            100 * time.Millisecond,
+	MaxProvidersPerKey: 4,
+}
+
+type node struct {
+	DHTNode
+	router Router
+}
+
+func newNode(i int) node {
+	return newNodeWithOptions(i, TestOptions)
+}
+
+func newNodeWithOptions(i int, options Options) node {
+	n := node{DHTNode: NewDHTNode(46632 + i)}
+	n.router = NewRouter(options, n.DHT, n.Messages, n.SignVerifier, SimpleTCPPeerAddressCodec{})
+	return n
+}
+
+// newNetwork returns n nodes that know each other. Messages are routed between
+// the nodes until the context is done.
+func newNetwork(ctx context.Context, n int) []node {
+	nodes := make([]node, n)
+	dhtNodes := make([]DHTNode, n)
+	for i := range nodes {
+		nodes[i] = newNode(i)
+		dhtNodes[i] = nodes[i].DHTNode
+	}
+	ConnectDHTNodes(ctx, dhtNodes, func(ctx context.Context, to int, from protocol.PeerID, message protocol.Message) {
+		switch message.Variant {
+		case protocol.Provide:
+			_ = nodes[to].router.AcceptProvide(ctx, from, message)
+		case protocol.FindProviders:
+			_ = nodes[to].router.AcceptFindProviders(ctx, from, message)
+		case protocol.Providers:
+			_ = nodes[to].router.AcceptProviders(ctx, from, message)
+		}
+	})
+	return nodes
+}
+
+var _ = Describe("Provider records", func() {
+	Context("when a key is provided", func() {
+		It("should be found by the other peers", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			nodes := newNetwork(ctx, 6)
+			Expect(nodes[0].router.Provide(ctx, "content")).To(Succeed())
+			Expect(nodes[1].router.Provide(ctx, "content")).To(Succeed())
+
+			for _, node := range nodes {
+				Eventually(func() int {
+					providers, err := node.router.FindProviders(ctx, "content")
+					Expect(err).NotTo(HaveOccurred())
+					return len(providers)
+				}).Should(Equal(2))
+			}
+
+			providers, err := nodes[5].router.FindProviders(ctx, "other content")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(providers).To(BeEmpty())
+		})
+	})
+
+	Context("when a record is sent by a peer that is not its provider", func() {
+		It("should store the record", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			provider := newNode(0)
+			Expect(provider.DHT.AddPeerAddress(RandomAddress())).To(Succeed())
+			Expect(provider.router.Provide(ctx, "content")).To(Succeed())
+			var message protocol.MessageOnTheWire
+			Eventually(provider.Messages).Should(Receive(&message))
+
+			receiver := newNode(1)
+			Expect(receiver.router.AcceptProvide(ctx, RandomPeerID(), message.Message)).To(Succeed())
+			Eventually(func() int {
+				providers, err := receiver.router.FindProviders(ctx, "content")
+				Expect(err).NotTo(HaveOccurred())
+				return len(providers)
+			}).Should(Equal(1))
+		})
+	})
+
+	Context("when a record is forged", func() {
+		It("should not store the record", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			provider := newNode(0)
+			Expect(provider.DHT.AddPeerAddress(RandomAddress())).To(Succeed())
+			Expect(provider.router.Provide(ctx, "content")).To(Succeed())
+			var message protocol.MessageOnTheWire
+			Eventually(provider.Messages).Should(Receive(&message))
+
+			// Flip a bit of the signature
+			message.Message.Body[len(message.Message.Body)-1] ^= 1
+			receiver := newNode(1)
+			Expect(receiver.router.AcceptProvide(ctx, provider.Addr.ID, message.Message)).NotTo(Succeed())
+		})
+	})
+
+	Context("when a key has the maximum number of providers", func() {
+		It("should not store more records", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			receiver := newNode(0)
+			for i := 1; i <= TestOptions.MaxProvidersPerKey+1; i++ {
+				provider := newNode(i)
+				Expect(provider.DHT.AddPeerAddress(receiver.Addr)).To(Succeed())
+				Expect(provider.router.Provide(ctx, "content")).To(Succeed())
+				var message protocol.MessageOnTheWire
+				Eventually(provider.Messages).Should(Receive(&message))
+
+				err := receiver.router.AcceptProvide(ctx, provider.Addr.ID, message.Message)
+				if i <= TestOptions.MaxProvidersPerKey {
+					Expect(err).NotTo(HaveOccurred())
+				} else {
+					Expect(err).To(HaveOccurred())
+				}
+			}
+		})
+	})
+
+	Context("when the router is running", func() {
+		It("should republish the records of the provided keys", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			options := TestOptions
+			options.RepublishInterval = 10 * time.Millisecond
+			provider := newNodeWithOptions(0, options)
+			Expect(provider.DHT.AddPeerAddress(RandomAddress())).To(Succeed())
+			go provider.router.Run(ctx)
+
+			Expect(provider.router.Provide(ctx, "content")).To(Succeed())
+			for i := 0; i < 3; i++ {
+				var message protocol.MessageOnTheWire
+				Eventually(provider.Messages).Should(Receive(&message))
+				Expect(message.Message.Variant).To(Equal(protocol.Provide))
+			}
+			Eventually(func() uint64 { return provider.router.Stats().Rounds }).Should(BeNumerically(">", 0))
+			stats := provider.router.Stats()
+			Expect(stats.Records).To(Equal(1))
+			Expect(stats.MinReplication).To(Equal(1))
+			Expect(stats.UnderReplicated).To(Equal(1))
+		})
+
+		It("should replicate the records of other providers", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			provider := newNode(0)
+			Expect(provider.DHT.AddPeerAddress(RandomAddress())).To(Succeed())
+			Expect(provider.router.Provide(ctx, "content")).To(Succeed())
+			var message protocol.MessageOnTheWire
+			Eventually(provider.Messages).Should(Receive(&message))
+
+			options := TestOptions
+			options.ReplicationInterval = 10 * time.Millisecond
+			replica := newNodeWithOptions(1, options)
+			other := RandomAddress()
+			Expect(replica.DHT.AddPeerAddress(other)).To(Succeed())
+			Expect(replica.DHT.AddPeerAddress(provider.Addr)).To(Succeed())
+			Expect(replica.router.AcceptProvide(ctx, provider.Addr.ID, message.Message)).To(Succeed())
+			go replica.router.Run(ctx)
+
+			// The record is not sent back to its provider
+			var replicated protocol.MessageOnTheWire
+			Eventually(replica.Messages).Should(Receive(&replicated))
+			Expect(replicated.To.Equal(other)).To(BeTrue())
+			Expect(replicated.Message.Body).To(Equal(message.Message.Body))
+			Eventually(func() int { return replica.router.Stats().Records }).Should(Equal(1))
+			Expect(replica.router.Stats().MinReplication).To(Equal(1))
+		})
+	})
+})
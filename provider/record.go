@@ -0,0 +1,150 @@
+package provider
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/renproject/aw/protocol"
+)
+
+// A Record advertises that a peer provides the content or service identified
+// by a key. Records are signed by the provider, so that they cannot be forged
+// by the peers that store them, and expire so that providers that leave the
+// network are eventually forgotten.
+type Record struct {
+	Key       string
+	Provider  protocol.PeerAddress
+	Expires   time.Time
+	Signature []byte
+}
+
+// Expired returns true if the record has expired at the given time.
+func (record Record) Expired(now time.Time) bool {
+	return !now.Before(record.Expires)
+}
+
+// newRecord returns a record for the key that is signed by the SignVerifier of
+// the provider.
+func newRecord(signVerifier protocol.SignVerifier, codec protocol.PeerAddressCodec, key string, provider protocol.PeerAddress, expires time.Time) (Record, error) {
+	record := Record{
+		Key:      key,
+		Provider: provider,
+		Expires:  time.Unix(expires.Unix(), 0),
+	}
+	digest, err := record.digest(signVerifier, codec)
+	if err != nil {
+		return Record{}, err
+	}
+	if record.Signature, err = signVerifier.Sign(digest); err != nil {
+		return Record{}, fmt.Errorf("error signing record: %v", err)
+	}
+	return record, nil
+}
+
+// verify returns an error if the record is not signed by its provider, or if
+// it has expired.
+func (record Record) verify(signVerifier protocol.SignVerifier, codec protocol.PeerAddressCodec, now time.Time) error {
+	if record.Expired(now) {
+		return fmt.Errorf("record of peer=%v expired at %v", record.Provider.PeerID(), record.Expires)
+	}
+	digest, err := record.digest(signVerifier, codec)
+	if err != nil {
+		return err
+	}
+	signer, err := signVerifier.Verify(digest, record.Signature)
+	if err != nil {
+		return fmt.Errorf("error verifying record of peer=%v: %v", record.Provider.PeerID(), err)
+	}
+	if signer == nil || signer.String() != record.Provider.PeerID().String() {
+		return fmt.Errorf("record of peer=%v is signed by peer=%v", record.Provider.PeerID(), signer)
+	}
+	return nil
+}
+
+func (record Record) digest(signVerifier protocol.SignVerifier, codec protocol.PeerAddressCodec) ([]byte, error) {
+	provider, err := codec.Encode(record.Provider)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding provider: %v", err)
+	}
+	buffer := new(bytes.Buffer)
+	if err := writeBytes(buffer, []byte(record.Key)); err != nil {
+		return nil, err
+	}
+	if err := writeBytes(buffer, provider); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(buffer, binary.LittleEndian, record.Expires.Unix()); err != nil {
+		return nil, err
+	}
+	return signVerifier.Hash(buffer.Bytes()), nil
+}
+
+func marshalRecord(buffer *bytes.Buffer, codec protocol.PeerAddressCodec, record Record) error {
+	provider, err := codec.Encode(record.Provider)
+	if err != nil {
+		return fmt.Errorf("error encoding provider: %v", err)
+	}
+	if err := writeBytes(buffer, []byte(record.Key)); err != nil {
+		return fmt.Errorf("error marshaling key: %v", err)
+	}
+	if err := writeBytes(buffer, provider); err != nil {
+		return fmt.Errorf("error marshaling provider: %v", err)
+	}
+	if err := binary.Write(buffer, binary.LittleEndian, record.Expires.Unix()); err != nil {
+		return fmt.Errorf("error marshaling expiry: %v", err)
+	}
+	if err := writeBytes(buffer, record.Signature); err != nil {
+		return fmt.Errorf("error marshaling signature: %v", err)
+	}
+	return nil
+}
+
+func unmarshalRecord(buffer *bytes.Buffer, codec protocol.PeerAddressCodec) (Record, error) {
+	key, err := readBytes(buffer)
+	if err != nil {
+		return Record{}, fmt.Errorf("error unmarshaling key: %v", err)
+	}
+	data, err := readBytes(buffer)
+	if err != nil {
+		return Record{}, fmt.Errorf("error unmarshaling provider: %v", err)
+	}
+	provider, err := codec.Decode(data)
+	if err != nil {
+		return Record{}, fmt.Errorf("error decoding provider: %v", err)
+	}
+	expires := int64(0)
+	if err := binary.Read(buffer, binary.LittleEndian, &expires); err != nil {
+		return Record{}, fmt.Errorf("error unmarshaling expiry: %v", err)
+	}
+	sig, err := readBytes(buffer)
+	if err != nil {
+		return Record{}, fmt.Errorf("error unmarshaling signature: %v", err)
+	}
+	return Record{
+		Key:       string(key),
+		Provider:  provider,
+		Expires:   time.Unix(expires, 0),
+		Signature: sig,
+	}, nil
+}
+
+func writeBytes(buffer *bytes.Buffer, data []byte) error {
+	if err := binary.Write(buffer, binary.LittleEndian, uint32(len(data))); err != nil {
+		return err
+	}
+	_, err := buffer.Write(data)
+	return err
+}
+
+func readBytes(buffer *bytes.Buffer) ([]byte, error) {
+	length := uint32(0)
+	if err := binary.Read(buffer, binary.LittleEndian, &length); err != nil {
+		return nil, err
+	}
+	if int(length) > buffer.Len() {
+		return nil, fmt.Errorf("expected len<=%v, got len=%v", buffer.Len(), length)
+	}
+	return buffer.Next(int(length)), nil
+}
@@ -0,0 +1,274 @@
+package pubsub
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/renproject/aw/broadcast"
+	"github.com/renproject/aw/dht"
+	"github.com/renproject/aw/protocol"
+	"github.com/sirupsen/logrus"
+)
+
+// TopicID returns the GroupID of a topic. Messages published on the topic are
+// broadcast to the group with this ID, so the members of the topic are the
+// members of the group in the DHT (which can be built from subgroups).
+func TopicID(topic string) protocol.GroupID {
+	return protocol.GroupID(sha256.Sum256([]byte(topic)))
+}
+
+// A Message is published on a topic, and delivered to the subscribers of the
+// topic.
+type Message struct {
+	Time  time.Time
+	Topic string
+	From  protocol.PeerID
+	Body  protocol.MessageBody
+}
+
+// A Validator checks the body of a message published on a topic. Messages that
+// are not valid are neither delivered to subscribers nor propagated to other
+// peers.
+type Validator func(from protocol.PeerID, body protocol.MessageBody) error
+
+// A PubSub publishes messages on topics, and delivers the messages published
+// by other peers to the subscribers of the topics. It is a Broadcaster, and
+// replaces the Broadcaster of a peer: messages accepted from other peers on
+// topics with subscribers are delivered to the subscribers, and all other
+// events are forwarded to the events of the application.
+type PubSub interface {
+	broadcast.ExtendedBroadcaster
+
+	// Publish a message on a topic. The message is checked by the Validator
+	// of the topic, and is delivered to local subscribers.
+	Publish(ctx context.Context, topic string, body protocol.MessageBody) error
+
+	// Subscribe to messages published on a topic. Messages are delivered to
+	// the given channel without blocking, so the subscriber must read them
+	// quickly enough (or give the channel enough capacity) to avoid dropping
+	// messages. The returned function unsubscribes the channel.
+	Subscribe(topic string, messages chan<- Message) (unsubscribe func())
+
+	// SetValidator sets the Validator of a topic. A nil Validator removes the
+	// Validator of the topic.
+	SetValidator(topic string, validator Validator)
+}
+
+// Options are used to parameterise the behaviour of a PubSub. The Validator of
+// the Broadcast options is replaced by the Validators of the topics.
+type Options struct {
+	Logger        logrus.FieldLogger
+	Broadcast     broadcast.Options
+	EventCapacity int // Defaults to 1024
+}
+
+func (options *Options) setZerosToDefaults() {
+	if options.Logger == nil {
+		options.Logger = logrus.New()
+	}
+	if options.Broadcast.Logger == nil {
+		options.Broadcast.Logger = options.Logger
+	}
+	if options.EventCapacity <= 0 {
+		options.EventCapacity = 1024
+	}
+}
+
+type topic struct {
+	name        string
+	validator   Validator
+	subscribers map[uint64]chan<- Message
+}
+
+type pubSub struct {
+	broadcast.ExtendedBroadcaster
+
+	logger    logrus.FieldLogger
+	options   Options
+	dht       dht.DHT
+	events    protocol.EventSender
+	broadcast chan protocol.Event
+
+	mu     *sync.RWMutex
+	nextID uint64
+	topics map[protocol.GroupID]*topic
+}
+
+// New returns a PubSub that broadcasts messages using the given MessageSender
+// and DHT. Events that are not delivered to subscribers are forwarded to the
+// EventSender while the PubSub is running.
+func New(options Options, messages protocol.MessageSender, events protocol.EventSender, dht dht.DHT) PubSub {
+	options.setZerosToDefaults()
+	ps := &pubSub{
+		logger:    options.Logger,
+		options:   options,
+		dht:       dht,
+		events:    events,
+		broadcast: make(chan protocol.Event, options.EventCapacity),
+
+		mu:     new(sync.RWMutex),
+		topics: map[protocol.GroupID]*topic{},
+	}
+	options.Broadcast.Validator = ps
+	ps.ExtendedBroadcaster = broadcast.NewBroadcasterWithOptions(options.Broadcast, messages, ps.broadcast, dht)
+	return ps
+}
+
+func (ps *pubSub) Publish(ctx context.Context, topic string, body protocol.MessageBody) error {
+	from := ps.dht.Me().PeerID()
+	message := protocol.NewMessage(protocol.V1, protocol.Broadcast, TopicID(topic), body)
+	if err := ps.Validate(from, message); err != nil {
+		return newErrPublishing(err, topic)
+	}
+	report, err := ps.BroadcastWithReport(ctx, message.GroupID, body)
+	if err != nil {
+		return newErrPublishing(err, topic)
+	}
+	if report.AlreadySeen {
+		return nil
+	}
+	ps.deliver(protocol.EventMessageReceived{
+		Time:    time.Now(),
+		Message: body,
+		From:    from,
+		GroupID: message.GroupID,
+		Hash:    report.Hash,
+	})
+	return nil
+}
+
+func (ps *pubSub) Subscribe(name string, messages chan<- Message) func() {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	topicID := TopicID(name)
+	t := ps.topicWithoutLock(name)
+	id := ps.nextID
+	ps.nextID++
+	t.subscribers[id] = messages
+
+	return func() {
+		ps.mu.Lock()
+		defer ps.mu.Unlock()
+
+		delete(t.subscribers, id)
+		ps.removeTopicIfUnusedWithoutLock(topicID)
+	}
+}
+
+func (ps *pubSub) SetValidator(name string, validator Validator) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	ps.topicWithoutLock(name).validator = validator
+	ps.removeTopicIfUnusedWithoutLock(TopicID(name))
+}
+
+// Validate implements the broadcast.Validator interface by checking messages
+// using the Validator of their topic. Messages sent to groups that are not
+// topics, or to topics without a Validator, are valid.
+func (ps *pubSub) Validate(from protocol.PeerID, message protocol.Message) error {
+	ps.mu.RLock()
+	t, ok := ps.topics[message.GroupID]
+	var validator Validator
+	if ok {
+		validator = t.validator
+	}
+	ps.mu.RUnlock()
+
+	if validator == nil {
+		return nil
+	}
+	return validator(from, message.Body)
+}
+
+// Run the Broadcaster, and deliver the messages that it accepts to subscribers
+// until the context is done. The PubSub is ready once the Broadcaster is.
+func (ps *pubSub) Run(ctx context.Context) error {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- ps.ExtendedBroadcaster.Run(ctx)
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-errs:
+			if err != nil {
+				return err
+			}
+		case event := <-ps.broadcast:
+			if received, ok := event.(protocol.EventMessageReceived); ok && ps.deliver(received) {
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				return nil
+			case ps.events <- event:
+			}
+		}
+	}
+}
+
+// deliver the message in the event to all subscribers of its topic. It returns
+// false if the topic has no subscribers.
+func (ps *pubSub) deliver(event protocol.EventMessageReceived) bool {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	t, ok := ps.topics[event.GroupID]
+	if !ok || len(t.subscribers) == 0 {
+		return false
+	}
+	message := Message{
+		Time:  event.Time,
+		Topic: t.name,
+		From:  event.From,
+		Body:  event.Message,
+	}
+	for _, subscriber := range t.subscribers {
+		select {
+		case subscriber <- message:
+		default:
+			ps.logger.Warnf("dropping message on topic=%v: subscriber is not reading fast enough", t.name)
+		}
+	}
+	return true
+}
+
+func (ps *pubSub) topicWithoutLock(name string) *topic {
+	topicID := TopicID(name)
+	t, ok := ps.topics[topicID]
+	if !ok {
+		t = &topic{
+			name:        name,
+			subscribers: map[uint64]chan<- Message{},
+		}
+		ps.topics[topicID] = t
+	}
+	return t
+}
+
+func (ps *pubSub) removeTopicIfUnusedWithoutLock(topicID protocol.GroupID) {
+	if t, ok := ps.topics[topicID]; ok && t.validator == nil && len(t.subscribers) == 0 {
+		delete(ps.topics, topicID)
+	}
+}
+
+// ErrPublishing is returned when there is an error when publishing a message
+// on a topic.
+type ErrPublishing struct {
+	error
+	Topic string
+}
+
+func newErrPublishing(err error, topic string) error {
+	return ErrPublishing{
+		error: fmt.Errorf("error publishing on topic=%v: %v", topic, err),
+		Topic: topic,
+	}
+}
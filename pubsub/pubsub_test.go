@@ -0,0 +1,158 @@
+package pubsub_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing/quick"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/pubsub"
+	. "github.com/renproject/aw/testutil"
+
+	"github.com/renproject/aw/protocol"
+	"github.com/sirupsen/logrus"
+)
+
+var TestOptions = Options{
+	Logger: logrus.New(),
+}
+
+var _ = Describe("PubSub", func() {
+
+	Context("when hashing topics", func() {
+		It("should return the same GroupID for the same topic", func() {
+			check := func(topic1, topic2 string) bool {
+				Expect(TopicID(topic1)).Should(Equal(TopicID(topic1)))
+				Expect(TopicID(topic1)).ShouldNot(Equal(protocol.NilGroupID))
+				return topic1 == topic2 || TopicID(topic1) != TopicID(topic2)
+			}
+
+			Expect(quick.Check(check, nil)).Should(BeNil())
+		})
+	})
+
+	Context("when publishing", func() {
+		It("should broadcast the message to the members of the topic and deliver it to local subscribers", func() {
+			messages := make(chan protocol.MessageOnTheWire, 128)
+			events := make(chan protocol.Event, 1)
+			dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+			ps := New(TestOptions, messages, events, dht)
+
+			addrs := RandomAddresses(8)
+			for _, addr := range addrs {
+				Expect(dht.AddPeerAddress(addr)).To(Succeed())
+			}
+			Expect(dht.AddGroup(TopicID("blocks"), FromAddressesToIDs(addrs))).To(Succeed())
+			subscriber := make(chan Message, 1)
+			_ = ps.Subscribe("blocks", subscriber)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			body := RandomMessageBody()
+			Expect(ps.Publish(ctx, "blocks", body)).To(Succeed())
+
+			for range addrs {
+				var message protocol.MessageOnTheWire
+				Eventually(messages).Should(Receive(&message))
+				Expect(addrs).Should(ContainElement(message.To))
+				Expect(message.Message.GroupID).Should(Equal(TopicID("blocks")))
+				Expect(bytes.Equal(message.Message.Body, body)).Should(BeTrue())
+			}
+			var message Message
+			Eventually(subscriber).Should(Receive(&message))
+			Expect(message.Topic).Should(Equal("blocks"))
+			Expect(message.From.Equal(dht.Me().PeerID())).Should(BeTrue())
+		})
+
+		It("should return an error if the topic has no members", func() {
+			messages := make(chan protocol.MessageOnTheWire, 128)
+			events := make(chan protocol.Event, 1)
+			dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+			ps := New(TestOptions, messages, events, dht)
+
+			Expect(ps.Publish(context.Background(), "blocks", RandomMessageBody())).To(BeAssignableToTypeOf(ErrPublishing{}))
+		})
+	})
+
+	Context("when accepting messages", func() {
+		It("should deliver messages on subscribed topics and forward all other events", func() {
+			messages := make(chan protocol.MessageOnTheWire, 128)
+			events := make(chan protocol.Event, 16)
+			dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+			ps := New(TestOptions, messages, events, dht)
+			Expect(dht.AddGroup(TopicID("blocks"), RandomPeerIDs())).To(Succeed())
+			Expect(dht.AddGroup(TopicID("txs"), RandomPeerIDs())).To(Succeed())
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go ps.Run(ctx)
+
+			subscriber1, subscriber2 := make(chan Message, 1), make(chan Message, 1)
+			_ = ps.Subscribe("blocks", subscriber1)
+			unsubscribe := ps.Subscribe("blocks", subscriber2)
+
+			// Both subscribers should receive messages on the topic
+			from := RandomPeerID()
+			message := protocol.NewMessage(protocol.V1, protocol.Broadcast, TopicID("blocks"), RandomMessageBody())
+			Expect(ps.AcceptBroadcast(ctx, from, message)).To(Succeed())
+			for _, subscriber := range []chan Message{subscriber1, subscriber2} {
+				var received Message
+				Eventually(subscriber).Should(Receive(&received))
+				Expect(received.Topic).Should(Equal("blocks"))
+				Expect(received.From.Equal(from)).Should(BeTrue())
+				Expect(bytes.Equal(received.Body, message.Body)).Should(BeTrue())
+			}
+			Expect(events).ShouldNot(Receive())
+
+			// Unsubscribed channels should not receive messages
+			unsubscribe()
+			message = protocol.NewMessage(protocol.V1, protocol.Broadcast, TopicID("blocks"), RandomMessageBody())
+			Expect(ps.AcceptBroadcast(ctx, from, message)).To(Succeed())
+			Eventually(subscriber1).Should(Receive())
+			Consistently(subscriber2).ShouldNot(Receive())
+
+			// Messages on other groups should be forwarded
+			message = protocol.NewMessage(protocol.V1, protocol.Broadcast, TopicID("txs"), RandomMessageBody())
+			Expect(ps.AcceptBroadcast(ctx, from, message)).To(Succeed())
+			var event protocol.Event
+			Eventually(events).Should(Receive(&event))
+			Expect(event.(protocol.EventMessageReceived).GroupID).Should(Equal(TopicID("txs")))
+			Expect(subscriber1).ShouldNot(Receive())
+		})
+
+		It("should drop messages that are not valid", func() {
+			messages := make(chan protocol.MessageOnTheWire, 128)
+			events := make(chan protocol.Event, 16)
+			dht := NewDHT(RandomAddress(), NewTable("dht"), nil)
+			ps := New(TestOptions, messages, events, dht)
+			Expect(dht.AddGroup(TopicID("blocks"), RandomPeerIDs())).To(Succeed())
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go ps.Run(ctx)
+
+			subscriber := make(chan Message, 1)
+			_ = ps.Subscribe("blocks", subscriber)
+			ps.SetValidator("blocks", func(from protocol.PeerID, body protocol.MessageBody) error {
+				if len(body) == 0 || body[0] != 1 {
+					return errors.New("invalid block")
+				}
+				return nil
+			})
+
+			// Invalid messages should neither be delivered nor propagated
+			message := protocol.NewMessage(protocol.V1, protocol.Broadcast, TopicID("blocks"), protocol.MessageBody{0})
+			Expect(ps.AcceptBroadcast(ctx, RandomPeerID(), message)).NotTo(Succeed())
+			Expect(ps.Publish(ctx, "blocks", protocol.MessageBody{0})).NotTo(Succeed())
+			Consistently(subscriber).ShouldNot(Receive())
+			Expect(messages).ShouldNot(Receive())
+
+			// Valid messages should be delivered
+			message = protocol.NewMessage(protocol.V1, protocol.Broadcast, TopicID("blocks"), protocol.MessageBody{1})
+			Expect(ps.AcceptBroadcast(ctx, RandomPeerID(), message)).To(Succeed())
+			Eventually(subscriber).Should(Receive())
+		})
+	})
+})
@@ -0,0 +1,193 @@
+package replay
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/renproject/aw/protocol"
+	"github.com/sirupsen/logrus"
+)
+
+// Options are used to parameterise the behaviour of a Buffer.
+type Options struct {
+	Logger   logrus.FieldLogger
+	Capacity int // Number of recent events that are kept, defaults to 1024
+}
+
+func (options *Options) setZerosToDefaults() {
+	if options.Logger == nil {
+		options.Logger = logrus.New()
+	}
+	if options.Capacity <= 0 {
+		options.Capacity = 1024
+	}
+}
+
+// SubscribeOptions control which of the recent events are replayed to a
+// subscriber before it receives new events. By default, no events are
+// replayed.
+type SubscribeOptions struct {
+	// Replay is the maximum number of recent events that are replayed. It is
+	// limited by the Capacity of the Buffer.
+	Replay int
+
+	// Since is optional. When set, only events that were received by the
+	// Buffer after it are replayed.
+	Since time.Time
+
+	// Filter is optional. When set, only events for which it returns true are
+	// replayed and delivered to the subscriber. It must not block.
+	Filter func(protocol.Event) bool
+}
+
+type entry struct {
+	time  time.Time
+	event protocol.Event
+}
+
+type subscriber struct {
+	send    func(protocol.Event) bool // Sends the event without blocking
+	filter  func(protocol.Event) bool
+	dropped *uint64
+}
+
+// A Buffer keeps the most recent events of a Peer in a ring buffer, and fans
+// them out to subscribers, so that components that subscribe after the Peer
+// has started (e.g. a UI) can receive recent history. Events are delivered to
+// subscribers without blocking, so subscribers must read them quickly enough
+// (or give their channel enough capacity for the events that are replayed) to
+// avoid dropping events.
+type Buffer struct {
+	logger  logrus.FieldLogger
+	options Options
+
+	mu          *sync.Mutex
+	entries     []entry
+	next        int
+	nextID      uint64
+	subscribers map[uint64]subscriber
+}
+
+// New returns a Buffer without events or subscribers.
+func New(options Options) *Buffer {
+	options.setZerosToDefaults()
+	return &Buffer{
+		logger:  options.Logger,
+		options: options,
+
+		mu:          new(sync.Mutex),
+		entries:     make([]entry, 0, options.Capacity),
+		subscribers: map[uint64]subscriber{},
+	}
+}
+
+// Run the Buffer, reading events from the EventReceiver (e.g. the events of a
+// Peer) until the context is done.
+func (buffer *Buffer) Run(ctx context.Context, events protocol.EventReceiver) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-events:
+			buffer.Publish(event)
+		}
+	}
+}
+
+// Publish an event to the subscribers, and keep it in the Buffer.
+func (buffer *Buffer) Publish(event protocol.Event) {
+	buffer.mu.Lock()
+	defer buffer.mu.Unlock()
+
+	e := entry{time: time.Now(), event: event}
+	if len(buffer.entries) < buffer.options.Capacity {
+		buffer.entries = append(buffer.entries, e)
+	} else {
+		buffer.entries[buffer.next] = e
+		buffer.next = (buffer.next + 1) % len(buffer.entries)
+	}
+	for _, sub := range buffer.subscribers {
+		sub.deliver(event)
+	}
+}
+
+// Subscribe to events. The recent events selected by the SubscribeOptions are
+// replayed to the channel, in the order they were received, before any new
+// events are delivered to it. No events are missed or repeated between the
+// replayed events and the new events. The returned function unsubscribes the
+// channel, and returns the number of events that were dropped because the
+// channel was full.
+func (buffer *Buffer) Subscribe(events chan<- protocol.Event, options SubscribeOptions) (unsubscribe func() uint64) {
+	return buffer.subscribe(func(event protocol.Event) bool {
+		select {
+		case events <- event:
+			return true
+		default:
+			return false
+		}
+	}, options)
+}
+
+func (buffer *Buffer) subscribe(send func(protocol.Event) bool, options SubscribeOptions) func() uint64 {
+	buffer.mu.Lock()
+	defer buffer.mu.Unlock()
+
+	sub := subscriber{
+		send:    send,
+		filter:  options.Filter,
+		dropped: new(uint64),
+	}
+	if options.Replay < 0 {
+		options.Replay = 0
+	}
+	replay := make([]protocol.Event, 0, options.Replay)
+	for i := len(buffer.entries) - 1; i >= 0 && len(replay) < options.Replay; i-- {
+		e := buffer.entries[(buffer.next+i)%len(buffer.entries)]
+		if !options.Since.IsZero() && !e.time.After(options.Since) {
+			break
+		}
+		if sub.filter == nil || sub.filter(e.event) {
+			replay = append(replay, e.event)
+		}
+	}
+	for i := len(replay) - 1; i >= 0; i-- {
+		sub.sendOrDrop(replay[i])
+	}
+
+	id := buffer.nextID
+	buffer.nextID++
+	buffer.subscribers[id] = sub
+
+	return func() uint64 {
+		buffer.mu.Lock()
+		defer buffer.mu.Unlock()
+
+		delete(buffer.subscribers, id)
+		return *sub.dropped
+	}
+}
+
+// Len returns the number of events in the Buffer.
+func (buffer *Buffer) Len() int {
+	buffer.mu.Lock()
+	defer buffer.mu.Unlock()
+
+	return len(buffer.entries)
+}
+
+// deliver the event to the subscriber, if it passes its filter. It must be
+// called while holding the mutex of the Buffer.
+func (sub subscriber) deliver(event protocol.Event) {
+	if sub.filter == nil || sub.filter(event) {
+		sub.sendOrDrop(event)
+	}
+}
+
+// sendOrDrop the event, counting it as dropped if it cannot be sent without
+// blocking. It must be called while holding the mutex of the Buffer.
+func (sub subscriber) sendOrDrop(event protocol.Event) {
+	if !sub.send(event) {
+		*sub.dropped++
+	}
+}
@@ -0,0 +1,113 @@
+package replay_test
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/replay"
+
+	"github.com/renproject/aw/protocol"
+	"github.com/renproject/aw/testutil"
+)
+
+var _ = Describe("Replay", func() {
+	event := func(i int) protocol.Event {
+		return protocol.EventMessageReceived{Message: protocol.MessageBody{byte(i)}, From: testutil.SimplePeerID("peer")}
+	}
+	body := func(event protocol.Event) byte {
+		return event.(protocol.EventMessageReceived).Message[0]
+	}
+	receive := func(events chan protocol.Event) []byte {
+		bodies := []byte{}
+		for {
+			select {
+			case event := <-events:
+				bodies = append(bodies, body(event))
+			default:
+				return bodies
+			}
+		}
+	}
+
+	Context("when subscribing after events were published", func() {
+		It("should replay the most recent events in order", func() {
+			buffer := New(Options{Capacity: 4})
+			for i := 0; i < 6; i++ {
+				buffer.Publish(event(i))
+			}
+			Expect(buffer.Len()).To(Equal(4))
+
+			events := make(chan protocol.Event, 16)
+			buffer.Subscribe(events, SubscribeOptions{Replay: 3})
+			buffer.Publish(event(6))
+			Expect(receive(events)).To(Equal([]byte{3, 4, 5, 6}))
+
+			all := make(chan protocol.Event, 16)
+			buffer.Subscribe(all, SubscribeOptions{Replay: 100})
+			Expect(receive(all)).To(Equal([]byte{3, 4, 5, 6}))
+
+			none := make(chan protocol.Event, 16)
+			buffer.Subscribe(none, SubscribeOptions{})
+			Expect(receive(none)).To(BeEmpty())
+		})
+
+		It("should only replay events after the given time", func() {
+			buffer := New(Options{})
+			buffer.Publish(event(0))
+			time.Sleep(10 * time.Millisecond)
+			since := time.Now()
+			buffer.Publish(event(1))
+
+			events := make(chan protocol.Event, 16)
+			buffer.Subscribe(events, SubscribeOptions{Replay: 10, Since: since})
+			Expect(receive(events)).To(Equal([]byte{1}))
+		})
+
+		It("should only replay and deliver the events that pass the filter", func() {
+			buffer := New(Options{})
+			for i := 0; i < 6; i++ {
+				buffer.Publish(event(i))
+			}
+
+			events := make(chan protocol.Event, 16)
+			even := func(event protocol.Event) bool { return body(event)%2 == 0 }
+			buffer.Subscribe(events, SubscribeOptions{Replay: 2, Filter: even})
+			buffer.Publish(event(6))
+			buffer.Publish(event(7))
+			Expect(receive(events)).To(Equal([]byte{2, 4, 6}))
+		})
+	})
+
+	Context("when a subscriber is slow", func() {
+		It("should drop events instead of blocking", func() {
+			buffer := New(Options{})
+			events := make(chan protocol.Event, 1)
+			unsubscribe := buffer.Subscribe(events, SubscribeOptions{})
+			buffer.Publish(event(0))
+			buffer.Publish(event(1))
+			buffer.Publish(event(2))
+			Expect(unsubscribe()).To(Equal(uint64(2)))
+
+			buffer.Publish(event(3))
+			Expect(receive(events)).To(Equal([]byte{0}))
+		})
+	})
+
+	Context("when running", func() {
+		It("should publish the events that it reads", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			buffer := New(Options{})
+			input := make(chan protocol.Event)
+			go buffer.Run(ctx, input)
+
+			events := make(chan protocol.Event, 16)
+			buffer.Subscribe(events, SubscribeOptions{})
+			input <- event(1)
+			Eventually(events).Should(Receive(Equal(event(1))))
+			Expect(buffer.Len()).To(Equal(1))
+		})
+	})
+})
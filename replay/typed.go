@@ -0,0 +1,38 @@
+//go:build go1.21
+// +build go1.21
+
+package replay
+
+import (
+	"github.com/renproject/aw/protocol"
+)
+
+// Subscribe to the events of type T, without type switches. It returns a
+// channel with the given capacity that the events are delivered to, and a
+// function that unsubscribes the channel (see Buffer.Subscribe). The Filter of
+// the SubscribeOptions is only given events of type T. For example:
+//
+//	received, unsubscribe := replay.Subscribe[protocol.EventMessageReceived](buffer, 64, replay.SubscribeOptions{})
+//	defer unsubscribe()
+//	for event := range received {
+//		...
+//	}
+//
+// The channel is never closed.
+func Subscribe[T protocol.Event](buffer *Buffer, capacity int, options SubscribeOptions) (<-chan T, func() uint64) {
+	events := make(chan T, capacity)
+	filter := options.Filter
+	options.Filter = func(event protocol.Event) bool {
+		_, ok := event.(T)
+		return ok && (filter == nil || filter(event))
+	}
+	unsubscribe := buffer.subscribe(func(event protocol.Event) bool {
+		select {
+		case events <- event.(T):
+			return true
+		default:
+			return false
+		}
+	}, options)
+	return events, unsubscribe
+}
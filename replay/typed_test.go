@@ -0,0 +1,47 @@
+//go:build go1.21
+// +build go1.21
+
+package replay_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/replay"
+
+	"github.com/renproject/aw/protocol"
+	"github.com/renproject/aw/testutil"
+)
+
+var _ = Describe("Typed subscriptions", func() {
+	Context("when subscribing to a type of event", func() {
+		It("should only replay and deliver events of that type", func() {
+			buffer := New(Options{})
+			buffer.Publish(protocol.EventMessageReceived{Message: protocol.MessageBody{0}, From: testutil.SimplePeerID("peer")})
+			buffer.Publish(protocol.EventPeerChanged{})
+
+			received, unsubscribe := Subscribe[protocol.EventMessageReceived](buffer, 4, SubscribeOptions{
+				Replay: 10,
+				Filter: func(event protocol.Event) bool {
+					return event.(protocol.EventMessageReceived).Message[0] != 2
+				},
+			})
+			buffer.Publish(protocol.EventLoadShed{})
+			buffer.Publish(protocol.EventMessageReceived{Message: protocol.MessageBody{1}, From: testutil.SimplePeerID("peer")})
+			buffer.Publish(protocol.EventMessageReceived{Message: protocol.MessageBody{2}, From: testutil.SimplePeerID("peer")})
+
+			Expect(received).To(HaveLen(2))
+			Expect((<-received).Message).To(Equal(protocol.MessageBody{0}))
+			Expect((<-received).Message).To(Equal(protocol.MessageBody{1}))
+			Expect(unsubscribe()).To(BeZero())
+		})
+
+		It("should count the events that are dropped", func() {
+			buffer := New(Options{})
+			_, unsubscribe := Subscribe[protocol.EventPeerChanged](buffer, 1, SubscribeOptions{})
+			for i := 0; i < 3; i++ {
+				buffer.Publish(protocol.EventPeerChanged{})
+			}
+			Expect(unsubscribe()).To(Equal(uint64(2)))
+		})
+	})
+})
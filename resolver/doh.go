@@ -0,0 +1,178 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsMessageType is the media type of DNS messages sent over HTTPS.
+const dnsMessageType = "application/dns-message"
+
+// maxResponseLength is the maximum length of a DNS message.
+const maxResponseLength = 65535
+
+// DoHOptions are used to parameterise the behaviour of a DNS-over-HTTPS
+// Resolver.
+type DoHOptions struct {
+	Logger logrus.FieldLogger
+
+	// URL of the DoH endpoint (e.g. "https://cloudflare-dns.com/dns-query").
+	URL string
+	// Client used to send the queries, defaults to an http.Client with the
+	// Timeout.
+	Client *http.Client
+	// Timeout of each query, defaults to 5 seconds.
+	Timeout time.Duration
+}
+
+func (options *DoHOptions) setZerosToDefaults() {
+	if options.Logger == nil {
+		options.Logger = logrus.New()
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = 5 * time.Second
+	}
+	if options.Client == nil {
+		options.Client = &http.Client{Timeout: options.Timeout}
+	}
+}
+
+type doh struct {
+	logger  logrus.FieldLogger
+	options DoHOptions
+}
+
+// NewDoH returns a Resolver that looks up host names using DNS-over-HTTPS (RFC
+// 8484), so that lookups cannot be observed or tampered with by the network
+// between the peer and the DoH endpoint. Both the A and AAAA records of a host
+// are looked up. It should be wrapped in a cache (see NewCache).
+func NewDoH(options DoHOptions) Resolver {
+	options.setZerosToDefaults()
+	return &doh{
+		logger:  options.Logger,
+		options: options,
+	}
+}
+
+// LookupHost implements the Resolver interface.
+func (doh *doh) LookupHost(ctx context.Context, host string) ([]string, error) {
+	addrs := []string{}
+	var lastErr error
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		ips, err := doh.query(ctx, host, qtype)
+		if err != nil {
+			doh.logger.Debugf("error querying %v records of host=%v: %v", qtype, host, err)
+			lastErr = err
+			continue
+		}
+		addrs = append(addrs, ips...)
+	}
+	if len(addrs) == 0 {
+		if lastErr == nil {
+			lastErr = fmt.Errorf("no such host")
+		}
+		return nil, newErrResolving(host, lastErr)
+	}
+	return addrs, nil
+}
+
+func (doh *doh) query(ctx context.Context, host string, qtype dnsmessage.Type) ([]string, error) {
+	name, err := dnsmessage.NewName(strings.TrimSuffix(host, ".") + ".")
+	if err != nil {
+		return nil, fmt.Errorf("invalid host: %v", err)
+	}
+	// The ID of DoH queries is zero, so that they can be cached by HTTP
+	// caches
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{RecursionDesired: true})
+	if err := builder.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := builder.Question(dnsmessage.Question{Name: name, Type: qtype, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, err
+	}
+	query, err := builder.Finish()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, doh.options.Timeout)
+	defer cancel()
+	request, err := http.NewRequest(http.MethodPost, doh.options.URL, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("Content-Type", dnsMessageType)
+	request.Header.Set("Accept", dnsMessageType)
+	response, err := doh.options.Client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status=%v", response.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(response.Body, maxResponseLength))
+	if err != nil {
+		return nil, fmt.Errorf("error reading response: %v", err)
+	}
+	return parseAnswers(data, qtype)
+}
+
+// parseAnswers returns the IP addresses in the answers of a DNS response.
+// Other answers (e.g. CNAMEs) are skipped.
+func parseAnswers(data []byte, qtype dnsmessage.Type) ([]string, error) {
+	parser := dnsmessage.Parser{}
+	header, err := parser.Start(data)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing response: %v", err)
+	}
+	if !header.Response {
+		return nil, fmt.Errorf("error parsing response: not a response")
+	}
+	if header.RCode != dnsmessage.RCodeSuccess {
+		return nil, fmt.Errorf("error in response: %v", header.RCode)
+	}
+	if err := parser.SkipAllQuestions(); err != nil {
+		return nil, fmt.Errorf("error parsing questions: %v", err)
+	}
+
+	ips := []string{}
+	for {
+		answer, err := parser.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			return ips, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error parsing answers: %v", err)
+		}
+		switch {
+		case answer.Type == dnsmessage.TypeA && qtype == dnsmessage.TypeA:
+			resource, err := parser.AResource()
+			if err != nil {
+				return nil, fmt.Errorf("error parsing A record: %v", err)
+			}
+			ips = append(ips, net.IP(resource.A[:]).String())
+		case answer.Type == dnsmessage.TypeAAAA && qtype == dnsmessage.TypeAAAA:
+			resource, err := parser.AAAAResource()
+			if err != nil {
+				return nil, fmt.Errorf("error parsing AAAA record: %v", err)
+			}
+			ips = append(ips, net.IP(resource.AAAA[:]).String())
+		default:
+			if err := parser.SkipAnswer(); err != nil {
+				return nil, fmt.Errorf("error parsing answers: %v", err)
+			}
+		}
+	}
+}
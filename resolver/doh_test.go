@@ -0,0 +1,97 @@
+package resolver_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/resolver"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var _ = Describe("DoH resolver", func() {
+	Context("when looking up a host", func() {
+		It("should return its A and AAAA records", func() {
+			server := httptest.NewServer(newMockDoHHandler(map[string][4]byte{"seed.example.com.": {1, 2, 3, 4}}, map[string][16]byte{"seed.example.com.": {15: 1}}))
+			defer server.Close()
+
+			resolver := NewDoH(DoHOptions{URL: server.URL})
+			addrs, err := resolver.LookupHost(context.Background(), "seed.example.com")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(addrs).To(Equal([]string{"1.2.3.4", "::1"}))
+		})
+
+		It("should return an error when the host does not exist", func() {
+			server := httptest.NewServer(newMockDoHHandler(nil, nil))
+			defer server.Close()
+
+			resolver := NewDoH(DoHOptions{URL: server.URL})
+			_, err := resolver.LookupHost(context.Background(), "seed.example.com")
+			Expect(err).To(BeAssignableToTypeOf(ErrResolving{}))
+		})
+
+		It("should return an error when the endpoint fails", func() {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusInternalServerError)
+			}))
+			defer server.Close()
+
+			resolver := NewDoH(DoHOptions{URL: server.URL, Timeout: time.Second})
+			_, err := resolver.LookupHost(context.Background(), "seed.example.com")
+			Expect(err).To(BeAssignableToTypeOf(ErrResolving{}))
+		})
+	})
+})
+
+// newMockDoHHandler returns an http.Handler that answers DNS queries with the
+// given A and AAAA records, and with NXDOMAIN for other hosts.
+func newMockDoHHandler(as map[string][4]byte, aaaas map[string][16]byte) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil || r.Header.Get("Content-Type") != "application/dns-message" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		parser := dnsmessage.Parser{}
+		header, err := parser.Start(data)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		question, err := parser.Question()
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		header.Response = true
+		a, hasA := as[question.Name.String()]
+		aaaa, hasAAAA := aaaas[question.Name.String()]
+		if !hasA && !hasAAAA {
+			header.RCode = dnsmessage.RCodeNameError
+		}
+		builder := dnsmessage.NewBuilder(nil, header)
+		_ = builder.StartQuestions()
+		_ = builder.Question(question)
+		_ = builder.StartAnswers()
+		resourceHeader := dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: 60}
+		if hasA && question.Type == dnsmessage.TypeA {
+			_ = builder.AResource(resourceHeader, dnsmessage.AResource{A: a})
+		}
+		if hasAAAA && question.Type == dnsmessage.TypeAAAA {
+			_ = builder.AAAAResource(resourceHeader, dnsmessage.AAAAResource{AAAA: aaaa})
+		}
+		response, err := builder.Finish()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/dns-message")
+		_, _ = w.Write(response)
+	})
+}
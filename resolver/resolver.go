@@ -0,0 +1,144 @@
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// A Resolver looks up the IP addresses of host names. The net.Resolver
+// implements it, and is used when no other Resolver is configured.
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// ResolveAddr returns the addresses that a "host:port" address resolves to,
+// using the Resolver to look up host names. IP addresses are returned as they
+// are.
+func ResolveAddr(ctx context.Context, resolver Resolver, addr string) ([]string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return []string{addr}, nil
+	}
+	ips, err := resolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, net.JoinHostPort(ip, port))
+	}
+	return addrs, nil
+}
+
+// CacheOptions are used to parameterise the behaviour of a cache.
+type CacheOptions struct {
+	TTL         time.Duration // Time that the addresses of a host are cached, defaults to 5 minutes
+	NegativeTTL time.Duration // Time that failed lookups are cached, defaults to 10 seconds
+	MaxEntries  int           // Maximum number of cached hosts, defaults to 1024
+}
+
+func (options *CacheOptions) setZerosToDefaults() {
+	if options.TTL <= 0 {
+		options.TTL = 5 * time.Minute
+	}
+	if options.NegativeTTL <= 0 {
+		options.NegativeTTL = 10 * time.Second
+	}
+	if options.MaxEntries <= 0 {
+		options.MaxEntries = 1024
+	}
+}
+
+type cacheEntry struct {
+	addrs   []string
+	err     error
+	expires time.Time
+}
+
+type cache struct {
+	options  CacheOptions
+	resolver Resolver
+
+	mu      *sync.Mutex
+	entries map[string]cacheEntry
+}
+
+// NewCache returns a Resolver that caches the lookups of another Resolver, so
+// that host names are not looked up every time a peer is dialed. It is safe for
+// concurrent use.
+func NewCache(options CacheOptions, resolver Resolver) Resolver {
+	options.setZerosToDefaults()
+	return &cache{
+		options:  options,
+		resolver: resolver,
+
+		mu:      new(sync.Mutex),
+		entries: map[string]cacheEntry{},
+	}
+}
+
+// LookupHost implements the Resolver interface.
+func (cache *cache) LookupHost(ctx context.Context, host string) ([]string, error) {
+	now := time.Now()
+	cache.mu.Lock()
+	entry, ok := cache.entries[host]
+	cache.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return append([]string(nil), entry.addrs...), entry.err
+	}
+
+	addrs, err := cache.resolver.LookupHost(ctx, host)
+	entry = cacheEntry{addrs: addrs, err: err, expires: now.Add(cache.options.TTL)}
+	if err != nil {
+		// Lookups that were cancelled by the caller are not cached
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		entry.expires = now.Add(cache.options.NegativeTTL)
+	}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if _, ok := cache.entries[host]; !ok && len(cache.entries) >= cache.options.MaxEntries {
+		cache.evictWithoutLock(now)
+	}
+	cache.entries[host] = entry
+	return append([]string(nil), addrs...), err
+}
+
+// evictWithoutLock removes the expired entries, or the entry that expires
+// first if none have expired.
+func (cache *cache) evictWithoutLock(now time.Time) {
+	first := ""
+	for host, entry := range cache.entries {
+		if !now.Before(entry.expires) {
+			delete(cache.entries, host)
+			continue
+		}
+		if first == "" || entry.expires.Before(cache.entries[first].expires) {
+			first = host
+		}
+	}
+	if len(cache.entries) >= cache.options.MaxEntries {
+		delete(cache.entries, first)
+	}
+}
+
+// ErrResolving is returned when a host name cannot be resolved.
+type ErrResolving struct {
+	error
+	Host string
+}
+
+func newErrResolving(host string, err error) error {
+	return ErrResolving{
+		error: fmt.Errorf("error resolving host=%v: %v", host, err),
+		Host:  host,
+	}
+}
@@ -0,0 +1,113 @@
+package resolver_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/resolver"
+)
+
+var _ = Describe("Resolver", func() {
+	Context("when resolving addresses", func() {
+		It("should look up host names and keep the port", func() {
+			resolver := newMockResolver(map[string][]string{"seed.example.com": {"1.2.3.4", "::1"}})
+			addrs, err := ResolveAddr(context.Background(), resolver, "seed.example.com:18514")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(addrs).To(Equal([]string{"1.2.3.4:18514", "[::1]:18514"}))
+		})
+
+		It("should not look up IP addresses", func() {
+			resolver := newMockResolver(nil)
+			addrs, err := ResolveAddr(context.Background(), resolver, "1.2.3.4:18514")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(addrs).To(Equal([]string{"1.2.3.4:18514"}))
+			Expect(resolver.lookups()).To(Equal(0))
+		})
+
+		It("should return an error for invalid addresses", func() {
+			_, err := ResolveAddr(context.Background(), newMockResolver(nil), "seed.example.com")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("when caching lookups", func() {
+		It("should only look up a host again after the TTL", func() {
+			resolver := newMockResolver(map[string][]string{"seed.example.com": {"1.2.3.4"}})
+			cache := NewCache(CacheOptions{TTL: 100 * time.Millisecond}, resolver)
+
+			for i := 0; i < 3; i++ {
+				addrs, err := cache.LookupHost(context.Background(), "seed.example.com")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(addrs).To(Equal([]string{"1.2.3.4"}))
+			}
+			Expect(resolver.lookups()).To(Equal(1))
+
+			time.Sleep(150 * time.Millisecond)
+			_, err := cache.LookupHost(context.Background(), "seed.example.com")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resolver.lookups()).To(Equal(2))
+		})
+
+		It("should cache failed lookups for the negative TTL", func() {
+			resolver := newMockResolver(nil)
+			cache := NewCache(CacheOptions{NegativeTTL: 100 * time.Millisecond}, resolver)
+
+			for i := 0; i < 3; i++ {
+				_, err := cache.LookupHost(context.Background(), "seed.example.com")
+				Expect(err).To(HaveOccurred())
+			}
+			Expect(resolver.lookups()).To(Equal(1))
+
+			time.Sleep(150 * time.Millisecond)
+			_, err := cache.LookupHost(context.Background(), "seed.example.com")
+			Expect(err).To(HaveOccurred())
+			Expect(resolver.lookups()).To(Equal(2))
+		})
+
+		It("should evict hosts when it is full", func() {
+			resolver := newMockResolver(map[string][]string{"a": {"1.1.1.1"}, "b": {"2.2.2.2"}, "c": {"3.3.3.3"}})
+			cache := NewCache(CacheOptions{MaxEntries: 2}, resolver)
+
+			for _, host := range []string{"a", "b", "c", "c", "a"} {
+				_, err := cache.LookupHost(context.Background(), host)
+				Expect(err).NotTo(HaveOccurred())
+			}
+			// The first host was evicted when the third was cached
+			Expect(resolver.lookups()).To(Equal(4))
+		})
+	})
+})
+
+// mockResolver resolves the hosts in a map, and counts its lookups.
+type mockResolver struct {
+	mu    *sync.Mutex
+	hosts map[string][]string
+	n     int
+}
+
+func newMockResolver(hosts map[string][]string) *mockResolver {
+	return &mockResolver{mu: new(sync.Mutex), hosts: hosts}
+}
+
+func (resolver *mockResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	resolver.mu.Lock()
+	defer resolver.mu.Unlock()
+
+	resolver.n++
+	addrs, ok := resolver.hosts[host]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	return addrs, nil
+}
+
+func (resolver *mockResolver) lookups() int {
+	resolver.mu.Lock()
+	defer resolver.mu.Unlock()
+
+	return resolver.n
+}
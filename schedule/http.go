@@ -0,0 +1,75 @@
+package schedule
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// NewHandler returns an http.Handler that serves the admin API of a Schedule
+// at /schedule. GET lists the scheduled broadcasts, POST schedules the
+// broadcast in the JSON body, and DELETE cancels the broadcast identified by
+// the id query parameter. When scheduling a broadcast, an in query parameter
+// (e.g. "10m") sets its time relative to now. It does not authorise requests,
+// so it must only be served to operators (see peer.NewAdminHandler).
+func NewHandler(schedule Schedule) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/schedule", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, schedule.Broadcasts())
+
+		case http.MethodPost:
+			scheduled := Broadcast{}
+			if err := json.NewDecoder(r.Body).Decode(&scheduled); err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("error decoding scheduled broadcast: %v", err))
+				return
+			}
+			if in := r.URL.Query().Get("in"); in != "" {
+				d, err := time.ParseDuration(in)
+				if err != nil {
+					writeError(w, http.StatusBadRequest, fmt.Errorf("invalid in=%v: %v", in, err))
+					return
+				}
+				scheduled.At = time.Now().Add(d)
+			}
+			if err := scheduled.Validate(); err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			scheduled, err := schedule.Add(scheduled)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			writeJSON(w, http.StatusCreated, scheduled)
+
+		case http.MethodDelete:
+			switch err := schedule.Cancel(r.URL.Query().Get("id")); err {
+			case nil:
+				w.WriteHeader(http.StatusNoContent)
+			case ErrNotFound:
+				writeError(w, http.StatusNotFound, err)
+			default:
+				writeError(w, http.StatusInternalServerError, err)
+			}
+
+		default:
+			w.Header().Set("Allow", "GET, POST, DELETE")
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %v is not allowed", r.Method))
+		}
+	})
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	w.WriteHeader(status)
+	fmt.Fprintln(w, err)
+}
@@ -0,0 +1,60 @@
+package schedule_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/schedule"
+
+	"github.com/sirupsen/logrus"
+)
+
+var _ = Describe("Schedule admin API", func() {
+	serve := func(handler http.Handler, method, url string, body []byte) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(method, url, bytes.NewReader(body)))
+		return recorder
+	}
+
+	It("should schedule, list and cancel broadcasts", func() {
+		schedule, err := New(Options{}, logrus.New(), nil)
+		Expect(err).NotTo(HaveOccurred())
+		handler := NewHandler(schedule)
+
+		response := serve(handler, http.MethodPost, "/schedule?in=1h", []byte(`{"body":"cGFyYW1z"}`))
+		Expect(response.Code).To(Equal(http.StatusCreated))
+		scheduled := Broadcast{}
+		Expect(json.Unmarshal(response.Body.Bytes(), &scheduled)).To(Succeed())
+		Expect(scheduled.ID).NotTo(BeEmpty())
+		Expect(string(scheduled.Body)).To(Equal("params"))
+		Expect(scheduled.At).To(BeTemporally("~", time.Now().Add(time.Hour), time.Minute))
+
+		response = serve(handler, http.MethodGet, "/schedule", nil)
+		Expect(response.Code).To(Equal(http.StatusOK))
+		broadcasts := []Broadcast{}
+		Expect(json.Unmarshal(response.Body.Bytes(), &broadcasts)).To(Succeed())
+		Expect(broadcasts).To(HaveLen(1))
+		Expect(broadcasts[0].ID).To(Equal(scheduled.ID))
+
+		Expect(serve(handler, http.MethodDelete, "/schedule?id="+scheduled.ID, nil).Code).To(Equal(http.StatusNoContent))
+		Expect(schedule.Broadcasts()).To(BeEmpty())
+		Expect(serve(handler, http.MethodDelete, "/schedule?id="+scheduled.ID, nil).Code).To(Equal(http.StatusNotFound))
+	})
+
+	It("should reject invalid broadcasts", func() {
+		schedule, err := New(Options{}, logrus.New(), nil)
+		Expect(err).NotTo(HaveOccurred())
+		handler := NewHandler(schedule)
+
+		Expect(serve(handler, http.MethodPost, "/schedule", []byte(`{`)).Code).To(Equal(http.StatusBadRequest))
+		Expect(serve(handler, http.MethodPost, "/schedule", []byte(`{}`)).Code).To(Equal(http.StatusBadRequest))
+		Expect(serve(handler, http.MethodPost, "/schedule?in=soon", []byte(`{}`)).Code).To(Equal(http.StatusBadRequest))
+		Expect(serve(handler, http.MethodPut, "/schedule", nil).Code).To(Equal(http.StatusMethodNotAllowed))
+		Expect(schedule.Broadcasts()).To(BeEmpty())
+	})
+})
@@ -0,0 +1,331 @@
+package schedule
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/renproject/aw/broadcast"
+	"github.com/renproject/aw/protocol"
+	"github.com/renproject/kv"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrNotFound is returned when there is no scheduled broadcast with an ID.
+var ErrNotFound = errors.New("scheduled broadcast not found")
+
+// A Broadcast is a message that is broadcast to a group at a future time (e.g.
+// to coordinate a change of parameters across the network). Broadcasts with a
+// deadline are dropped, by the sender and by every peer, once the deadline has
+// passed.
+type Broadcast struct {
+	ID       string               `json:"id"`
+	GroupID  protocol.GroupID     `json:"groupID"`
+	Body     protocol.MessageBody `json:"body"`
+	At       time.Time            `json:"at"`
+	Deadline time.Time            `json:"deadline,omitempty"`
+	Created  time.Time            `json:"created"`
+}
+
+// Validate returns an error if the broadcast does not have a time, or if its
+// deadline is not after its time.
+func (scheduled Broadcast) Validate() error {
+	if scheduled.At.IsZero() {
+		return fmt.Errorf("scheduled broadcast must have a time")
+	}
+	if !scheduled.Deadline.IsZero() && !scheduled.Deadline.After(scheduled.At) {
+		return fmt.Errorf("expected deadline after %v, got deadline=%v", scheduled.At, scheduled.Deadline)
+	}
+	return nil
+}
+
+// A Broadcaster broadcasts the messages of a Schedule when they are due (e.g.
+// a peer.Peer).
+type Broadcaster interface {
+	BroadcastWithDeadline(context.Context, protocol.GroupID, protocol.MessageBody, time.Time) (broadcast.Report, error)
+}
+
+// Options are used to parameterise the behaviour of a Schedule.
+type Options struct {
+	Timeout       time.Duration // Timeout of each broadcast, defaults to 30 seconds
+	RetryInterval time.Duration // Time between attempts at a broadcast that has failed, defaults to 10 seconds
+
+	// MaxLateness is the time after which broadcasts that are due are
+	// dropped, instead of being broadcast (e.g. when the Schedule was not
+	// running at the time). Broadcasts are never dropped for being late
+	// unless it is positive.
+	MaxLateness time.Duration
+}
+
+func (options *Options) setZerosToDefaults() {
+	if options.Timeout <= 0 {
+		options.Timeout = 30 * time.Second
+	}
+	if options.RetryInterval <= 0 {
+		options.RetryInterval = 10 * time.Second
+	}
+}
+
+// A Schedule keeps the broadcasts that are scheduled for a future time, and
+// broadcasts them when they are due while it is running. It is safe for
+// concurrent use.
+type Schedule interface {
+	// Add schedules the broadcast, and returns it. Broadcasts without an ID
+	// are given a random ID, and a broadcast with the same ID as an existing
+	// broadcast replaces it.
+	Add(Broadcast) (Broadcast, error)
+
+	// Cancel the broadcast with the given ID. It returns ErrNotFound if there
+	// is no such broadcast.
+	Cancel(id string) error
+
+	// Broadcasts returns the broadcasts that have not been broadcast yet, in
+	// the order that they are due.
+	Broadcasts() []Broadcast
+
+	// Run the Schedule until the context is done. Broadcasts are broadcast
+	// using the Broadcaster, in the order that they are due, and are removed
+	// once they have been broadcast. Broadcasts that fail are attempted again
+	// every RetryInterval.
+	Run(context.Context, Broadcaster)
+}
+
+type schedule struct {
+	logger  logrus.FieldLogger
+	options Options
+
+	mu         *sync.Mutex
+	store      kv.Table
+	broadcasts map[string]Broadcast
+	retries    map[string]time.Time // Time of the next attempt at broadcasts that have failed
+
+	changed chan struct{}
+}
+
+// New returns a Schedule that persists its broadcasts in the given store, so
+// that they survive restarts. Broadcasts that are already in the store are
+// loaded. An in-memory store is used if the store is nil.
+func New(options Options, logger logrus.FieldLogger, store kv.Table) (Schedule, error) {
+	if logger == nil {
+		logger = logrus.New()
+	}
+	options.setZerosToDefaults()
+	if store == nil {
+		store = kv.NewTable(kv.NewMemDB(kv.JSONCodec), "schedule")
+	}
+	s := &schedule{
+		logger:  logger,
+		options: options,
+
+		mu:         new(sync.Mutex),
+		store:      store,
+		broadcasts: map[string]Broadcast{},
+		retries:    map[string]time.Time{},
+
+		changed: make(chan struct{}, 1),
+	}
+
+	iter := store.Iterator()
+	defer iter.Close()
+	for iter.Next() {
+		scheduled := Broadcast{}
+		if err := iter.Value(&scheduled); err != nil {
+			return nil, fmt.Errorf("error scanning schedule iterator: %v", err)
+		}
+		s.broadcasts[scheduled.ID] = scheduled
+	}
+	return s, nil
+}
+
+func (s *schedule) Add(scheduled Broadcast) (Broadcast, error) {
+	if err := scheduled.Validate(); err != nil {
+		return Broadcast{}, err
+	}
+	if scheduled.ID == "" {
+		id := [16]byte{}
+		if _, err := rand.Read(id[:]); err != nil {
+			return Broadcast{}, fmt.Errorf("error generating id: %v", err)
+		}
+		scheduled.ID = hex.EncodeToString(id[:])
+	}
+	if scheduled.Created.IsZero() {
+		scheduled.Created = time.Now()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.store.Insert(scheduled.ID, scheduled); err != nil {
+		return Broadcast{}, fmt.Errorf("error inserting scheduled broadcast=%v: %v", scheduled.ID, err)
+	}
+	s.broadcasts[scheduled.ID] = scheduled
+	delete(s.retries, scheduled.ID)
+	s.notify()
+	return scheduled, nil
+}
+
+func (s *schedule) Cancel(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.broadcasts[id]; !ok {
+		return ErrNotFound
+	}
+	if err := s.removeWithoutLock(id); err != nil {
+		return err
+	}
+	s.notify()
+	return nil
+}
+
+func (s *schedule) Broadcasts() []Broadcast {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	broadcasts := make([]Broadcast, 0, len(s.broadcasts))
+	for _, scheduled := range s.broadcasts {
+		broadcasts = append(broadcasts, scheduled)
+	}
+	sortByTime(broadcasts)
+	return broadcasts
+}
+
+func (s *schedule) Run(ctx context.Context, broadcaster Broadcaster) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		due, next := s.due(time.Now())
+		for _, scheduled := range due {
+			s.broadcast(ctx, broadcaster, scheduled)
+		}
+		if len(due) > 0 {
+			// Broadcasting takes time, so the schedule is checked again
+			// straight away
+			continue
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		var wakeups <-chan time.Time
+		if !next.IsZero() {
+			timer.Reset(time.Until(next))
+			wakeups = timer.C
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.changed:
+		case <-wakeups:
+		}
+	}
+}
+
+// due returns the broadcasts that are due at the given time, in the order that
+// they are due, and the time at which the next broadcast is due. The time is
+// zero if no other broadcast is scheduled.
+func (s *schedule) due(now time.Time) ([]Broadcast, time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	due := []Broadcast{}
+	next := time.Time{}
+	for id, scheduled := range s.broadcasts {
+		at := scheduled.At
+		if retry, ok := s.retries[id]; ok {
+			at = retry
+		}
+		if !at.After(now) {
+			due = append(due, scheduled)
+			continue
+		}
+		if next.IsZero() || at.Before(next) {
+			next = at
+		}
+	}
+	sortByTime(due)
+	return due, next
+}
+
+// broadcast the scheduled broadcast, and remove it from the Schedule, unless it
+// fails. Broadcasts that are too late, or whose deadline has passed, are
+// removed without being broadcast.
+func (s *schedule) broadcast(ctx context.Context, broadcaster Broadcaster, scheduled Broadcast) {
+	now := time.Now()
+	switch {
+	case s.options.MaxLateness > 0 && now.Sub(scheduled.At) > s.options.MaxLateness:
+		s.logger.Errorf("dropping scheduled broadcast=%v to group=%v: %v late", scheduled.ID, scheduled.GroupID, now.Sub(scheduled.At))
+	case !scheduled.Deadline.IsZero() && !now.Before(scheduled.Deadline):
+		s.logger.Errorf("dropping scheduled broadcast=%v to group=%v: deadline has passed", scheduled.ID, scheduled.GroupID)
+	default:
+		broadcastCtx, cancel := context.WithTimeout(ctx, s.options.Timeout)
+		_, err := broadcaster.BroadcastWithDeadline(broadcastCtx, scheduled.GroupID, scheduled.Body, scheduled.Deadline)
+		cancel()
+		if err != nil {
+			s.logger.Errorf("error broadcasting scheduled broadcast=%v to group=%v: %v", scheduled.ID, scheduled.GroupID, err)
+			s.retry(scheduled.ID, now.Add(s.options.RetryInterval))
+			return
+		}
+		s.logger.Infof("broadcast scheduled broadcast=%v to group=%v", scheduled.ID, scheduled.GroupID)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The broadcast may have been cancelled, or replaced, in the meantime
+	if current, ok := s.broadcasts[scheduled.ID]; !ok || !current.Created.Equal(scheduled.Created) {
+		return
+	}
+	if err := s.removeWithoutLock(scheduled.ID); err != nil {
+		// The broadcast is not broadcast again, unless it is loaded from the
+		// store after a restart
+		s.logger.Errorf("error removing scheduled broadcast=%v: %v", scheduled.ID, err)
+		delete(s.broadcasts, scheduled.ID)
+		delete(s.retries, scheduled.ID)
+	}
+}
+
+func (s *schedule) retry(id string, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.broadcasts[id]; ok {
+		s.retries[id] = at
+	}
+}
+
+func (s *schedule) removeWithoutLock(id string) error {
+	if err := s.store.Delete(id); err != nil && err != kv.ErrKeyNotFound {
+		return fmt.Errorf("error deleting scheduled broadcast=%v: %v", id, err)
+	}
+	delete(s.broadcasts, id)
+	delete(s.retries, id)
+	return nil
+}
+
+// notify the Run loop that the broadcasts have changed, without blocking. It
+// must be called while holding the lock.
+func (s *schedule) notify() {
+	select {
+	case s.changed <- struct{}{}:
+	default:
+	}
+}
+
+func sortByTime(broadcasts []Broadcast) {
+	sort.Slice(broadcasts, func(i, j int) bool {
+		if broadcasts[i].At.Equal(broadcasts[j].At) {
+			return broadcasts[i].ID < broadcasts[j].ID
+		}
+		return broadcasts[i].At.Before(broadcasts[j].At)
+	})
+}
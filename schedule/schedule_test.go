@@ -0,0 +1,162 @@
+package schedule_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/schedule"
+	. "github.com/renproject/aw/testutil"
+
+	"github.com/renproject/aw/broadcast"
+	"github.com/renproject/aw/protocol"
+	"github.com/sirupsen/logrus"
+)
+
+// mockBroadcaster sends the bodies it is asked to broadcast to a channel, after
+// failing the first few times.
+type mockBroadcaster struct {
+	bodies   chan protocol.MessageBody
+	failures *int64
+}
+
+func newMockBroadcaster(failures int64) mockBroadcaster {
+	return mockBroadcaster{
+		bodies:   make(chan protocol.MessageBody, 16),
+		failures: &failures,
+	}
+}
+
+func (broadcaster mockBroadcaster) BroadcastWithDeadline(ctx context.Context, groupID protocol.GroupID, body protocol.MessageBody, deadline time.Time) (broadcast.Report, error) {
+	if atomic.AddInt64(broadcaster.failures, -1) >= 0 {
+		return broadcast.Report{}, errors.New("failed")
+	}
+	broadcaster.bodies <- body
+	return broadcast.Report{}, nil
+}
+
+var _ = Describe("Schedule", func() {
+	Context("when validating a scheduled broadcast", func() {
+		It("should require a time, and a deadline after it", func() {
+			now := time.Now()
+			Expect(Broadcast{}.Validate()).NotTo(Succeed())
+			Expect(Broadcast{At: now, Deadline: now}.Validate()).NotTo(Succeed())
+			Expect(Broadcast{At: now}.Validate()).To(Succeed())
+			Expect(Broadcast{At: now, Deadline: now.Add(time.Second)}.Validate()).To(Succeed())
+		})
+	})
+
+	Context("when broadcasts are due", func() {
+		It("should broadcast them in the order that they are due, and remove them", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			schedule, err := New(Options{}, logrus.New(), nil)
+			Expect(err).NotTo(HaveOccurred())
+			broadcaster := newMockBroadcaster(0)
+			go schedule.Run(ctx, broadcaster)
+
+			now := time.Now()
+			for i, in := range []time.Duration{300, 100, 200} {
+				_, err := schedule.Add(Broadcast{GroupID: RandomGroupID(), Body: []byte{byte(i)}, At: now.Add(in * time.Millisecond)})
+				Expect(err).NotTo(HaveOccurred())
+			}
+			Expect(schedule.Broadcasts()).To(HaveLen(3))
+			Expect(schedule.Broadcasts()[0].Body).To(Equal(protocol.MessageBody{1}))
+
+			for _, body := range []protocol.MessageBody{{1}, {2}, {0}} {
+				Eventually(broadcaster.bodies).Should(Receive(Equal(body)))
+			}
+			Eventually(schedule.Broadcasts).Should(BeEmpty())
+		})
+
+		It("should retry the broadcasts that fail", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			schedule, err := New(Options{RetryInterval: 50 * time.Millisecond}, logrus.New(), nil)
+			Expect(err).NotTo(HaveOccurred())
+			broadcaster := newMockBroadcaster(2)
+			go schedule.Run(ctx, broadcaster)
+
+			_, err = schedule.Add(Broadcast{GroupID: RandomGroupID(), Body: []byte{1}, At: time.Now()})
+			Expect(err).NotTo(HaveOccurred())
+			Consistently(broadcaster.bodies, 75*time.Millisecond).ShouldNot(Receive())
+			Eventually(broadcaster.bodies).Should(Receive(Equal(protocol.MessageBody{1})))
+			Eventually(schedule.Broadcasts).Should(BeEmpty())
+		})
+
+		It("should drop the broadcasts that are too late, or whose deadline has passed", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			schedule, err := New(Options{MaxLateness: time.Minute}, logrus.New(), nil)
+			Expect(err).NotTo(HaveOccurred())
+			now := time.Now()
+			_, err = schedule.Add(Broadcast{GroupID: RandomGroupID(), Body: []byte{1}, At: now.Add(-time.Hour)})
+			Expect(err).NotTo(HaveOccurred())
+			_, err = schedule.Add(Broadcast{GroupID: RandomGroupID(), Body: []byte{2}, At: now.Add(-time.Second), Deadline: now})
+			Expect(err).NotTo(HaveOccurred())
+			broadcaster := newMockBroadcaster(0)
+			go schedule.Run(ctx, broadcaster)
+
+			Eventually(schedule.Broadcasts).Should(BeEmpty())
+			Consistently(broadcaster.bodies).ShouldNot(Receive())
+		})
+	})
+
+	Context("when a broadcast is cancelled", func() {
+		It("should not broadcast it", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			schedule, err := New(Options{}, logrus.New(), nil)
+			Expect(err).NotTo(HaveOccurred())
+			broadcaster := newMockBroadcaster(0)
+			go schedule.Run(ctx, broadcaster)
+
+			scheduled, err := schedule.Add(Broadcast{GroupID: RandomGroupID(), Body: []byte{1}, At: time.Now().Add(100 * time.Millisecond)})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(scheduled.ID).NotTo(BeEmpty())
+			Expect(schedule.Cancel(scheduled.ID)).To(Succeed())
+			Expect(schedule.Cancel(scheduled.ID)).To(Equal(ErrNotFound))
+			Consistently(broadcaster.bodies, 200*time.Millisecond).ShouldNot(Receive())
+		})
+	})
+
+	Context("when the schedule is restarted", func() {
+		It("should load the broadcasts from the store", func() {
+			store := NewTable("schedule")
+			schedule, err := New(Options{}, logrus.New(), store)
+			Expect(err).NotTo(HaveOccurred())
+			groupID := RandomGroupID()
+			at := time.Now().Add(time.Hour)
+			scheduled, err := schedule.Add(Broadcast{GroupID: groupID, Body: []byte{1}, At: at, Deadline: at.Add(time.Hour)})
+			Expect(err).NotTo(HaveOccurred())
+			_, err = schedule.Add(Broadcast{GroupID: groupID, Body: []byte{2}, At: at})
+			Expect(err).NotTo(HaveOccurred())
+
+			restarted, err := New(Options{}, logrus.New(), store)
+			Expect(err).NotTo(HaveOccurred())
+			broadcasts := restarted.Broadcasts()
+			Expect(broadcasts).To(HaveLen(2))
+			for _, loaded := range broadcasts {
+				if loaded.ID != scheduled.ID {
+					continue
+				}
+				Expect(loaded.GroupID).To(Equal(groupID))
+				Expect(loaded.Body).To(Equal(scheduled.Body))
+				Expect(loaded.At.Equal(scheduled.At)).To(BeTrue())
+				Expect(loaded.Deadline.Equal(scheduled.Deadline)).To(BeTrue())
+			}
+
+			Expect(restarted.Cancel(scheduled.ID)).To(Succeed())
+			restarted, err = New(Options{}, logrus.New(), store)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(restarted.Broadcasts()).To(HaveLen(1))
+		})
+	})
+})
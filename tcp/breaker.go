@@ -0,0 +1,132 @@
+package tcp
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/renproject/aw/protocol"
+)
+
+// BreakerStatus is the status of the circuit breaker of a remote peer.
+type BreakerStatus uint8
+
+// Statuses of a circuit breaker. A closed breaker allows sends. An open
+// breaker fails sends immediately until its cooldown has passed, after which
+// it is half-open and allows one send to probe the remote peer. A successful
+// probe closes the breaker, and a failed probe opens it again.
+const (
+	BreakerClosed = BreakerStatus(iota)
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+// String implements the `fmt.Stringer` interface.
+func (status BreakerStatus) String() string {
+	switch status {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(status))
+	}
+}
+
+// BreakerState describes the circuit breaker of a remote peer that sends have
+// failed to.
+type BreakerState struct {
+	RemoteAddr string        // Network address of the remote peer.
+	Status     BreakerStatus // Status of the breaker.
+	Failures   int           // Number of consecutive failed sends.
+	OpenUntil  time.Time     // Time at which an open breaker becomes half-open.
+}
+
+type breaker struct {
+	failures  int
+	openUntil time.Time
+}
+
+func (b breaker) status(now time.Time) BreakerStatus {
+	if b.openUntil.IsZero() {
+		return BreakerClosed
+	}
+	if now.Before(b.openUntil) {
+		return BreakerOpen
+	}
+	return BreakerHalfOpen
+}
+
+// breakers tracks the consecutive failed sends to remote peers. It is not safe
+// for concurrent use.
+type breakers struct {
+	threshold int
+	cooldown  time.Duration
+	breakers  map[string]breaker
+}
+
+func newBreakers(threshold int, cooldown time.Duration) breakers {
+	return breakers{
+		threshold: threshold,
+		cooldown:  cooldown,
+		breakers:  map[string]breaker{},
+	}
+}
+
+// allow returns an ErrCircuitOpen if sends to the address must fail fast.
+func (bs breakers) allow(addr string) error {
+	b, ok := bs.breakers[addr]
+	if !ok || b.status(time.Now()) != BreakerOpen {
+		return nil
+	}
+	return newErrCircuitOpen(addr, b.openUntil)
+}
+
+func (bs breakers) success(addr string) {
+	delete(bs.breakers, addr)
+}
+
+func (bs breakers) failure(addr string) {
+	b := bs.breakers[addr]
+	b.failures++
+	if b.failures >= bs.threshold {
+		b.openUntil = time.Now().Add(bs.cooldown)
+	}
+	bs.breakers[addr] = b
+}
+
+func (bs breakers) states() []BreakerState {
+	now := time.Now()
+	states := make([]BreakerState, 0, len(bs.breakers))
+	for addr, b := range bs.breakers {
+		states = append(states, BreakerState{
+			RemoteAddr: addr,
+			Status:     b.status(now),
+			Failures:   b.failures,
+			OpenUntil:  b.openUntil,
+		})
+	}
+	return states
+}
+
+// ErrCircuitOpen is returned when sending to a remote peer that recent sends
+// have repeatedly failed to, until the cooldown of its circuit breaker has
+// passed.
+type ErrCircuitOpen struct {
+	error
+	RemoteAddr string
+	OpenUntil  time.Time
+}
+
+func newErrCircuitOpen(addr string, openUntil time.Time) error {
+	return ErrCircuitOpen{
+		error:      fmt.Errorf("circuit to %v is open until %v", addr, openUntil.Format(time.RFC3339Nano)),
+		RemoteAddr: addr,
+		OpenUntil:  openUntil,
+	}
+}
+
+func (err ErrCircuitOpen) Is(target error) bool {
+	return target == protocol.ErrUnavailable
+}
@@ -2,19 +2,27 @@ package tcp
 
 import (
 	"context"
-	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/renproject/aw/handshake"
 	"github.com/renproject/aw/protocol"
+	"github.com/renproject/aw/resolver"
 	"github.com/sirupsen/logrus"
 )
 
 // ErrTooManyConnections is returned the current number of connections exceeds the limit.
-var ErrTooManyConnections = errors.New("too many connections")
+var ErrTooManyConnections = protocol.NewError(protocol.ErrUnavailable, "too many connections")
+
+// ErrConnNotFound is returned when there is no connection with a remote
+// address.
+var ErrConnNotFound = protocol.NewError(protocol.ErrNotFound, "connection not found")
 
 // A ConnPool maintains multiple connections to different remote peers and
 // re-uses these connections when sending multiple message to the peer. If a
@@ -25,11 +33,148 @@ type ConnPool interface {
 	Send(net.Addr, protocol.Message) error
 }
 
+// An ExtendedConnPool is a ConnPool that reports on, and manages, its
+// connections. The ConnPools returned by this package are ExtendedConnPools, so
+// that a ConnPool can be type asserted to use these features without breaking
+// other implementations of the ConnPool.
+type ExtendedConnPool interface {
+	ConnPool
+
+	// Conns returns the state of all connections currently in the pool.
+	Conns() []ConnState
+
+	// Breakers returns the state of the circuit breakers of all remote peers
+	// that the most recent sends have failed to.
+	Breakers() []BreakerState
+
+	// CloseConn closes the connection to the remote address. A new
+	// connection is dialed by the next send to the remote address.
+	CloseConn(remoteAddr string) error
+
+	// Redial closes the connection to the remote address, and dials a new
+	// connection to it straight away.
+	Redial(remoteAddr string) error
+}
+
+// ConnState describes an established connection with a remote peer. Bytes are
+// counted on the wire, including the handshake.
+type ConnState struct {
+	RemoteAddr        string                     // Network address of the remote peer.
+	PeerID            protocol.PeerID            // Authenticated identity of the remote peer.
+	Transport         string                     // Transport of the connection (e.g. "tcp").
+	Outbound          bool                       // Whether the connection was dialed by this peer.
+	Age               time.Duration              // Time since the connection was established.
+	BytesIn           uint64                     // Bytes read from the connection.
+	BytesOut          uint64                     // Bytes written to the connection.
+	Encrypted         bool                       // Whether the session is encrypted.
+	Compression       handshake.Compression      // Compression of the stream.
+	CompressionStats  handshake.CompressionStats // Bandwidth and time spent compressing the stream.
+	PaddingBucketSize int                        // Bucket size of padded messages, or zero.
+}
+
+func newConnState(remoteAddr string, session protocol.Session, m *meter, established time.Time, outbound bool) ConnState {
+	state := ConnState{
+		RemoteAddr:  remoteAddr,
+		PeerID:      protocol.SessionPeerID(session),
+		Transport:   "tcp",
+		Outbound:    outbound,
+		Age:         time.Since(established),
+		BytesIn:     atomic.LoadUint64(&m.bytesIn),
+		BytesOut:    atomic.LoadUint64(&m.bytesOut),
+		Encrypted:   protocol.SessionEncrypted(session),
+		Compression: handshake.CompressionNone,
+	}
+	if compressed, ok := session.(handshake.CompressedSession); ok {
+		state.Compression = compressed.Compression()
+		state.CompressionStats = compressed.CompressionStats()
+	}
+	if padded, ok := session.(handshake.PaddedSession); ok {
+		state.PaddingBucketSize = padded.BucketSize()
+	}
+	return state
+}
+
+// meter counts the bytes read from, and written to, a connection.
+type meter struct {
+	bytesIn  uint64
+	bytesOut uint64
+}
+
+// meteredConn is a net.Conn that is counted by a meter.
+type meteredConn struct {
+	net.Conn
+	meter *meter
+}
+
+func newMeteredConn(conn net.Conn) meteredConn {
+	return meteredConn{Conn: conn, meter: new(meter)}
+}
+
+func (conn meteredConn) Read(p []byte) (int, error) {
+	n, err := conn.Conn.Read(p)
+	atomic.AddUint64(&conn.meter.bytesIn, uint64(n))
+	return n, err
+}
+
+func (conn meteredConn) Write(p []byte) (int, error) {
+	n, err := conn.Conn.Write(p)
+	atomic.AddUint64(&conn.meter.bytesOut, uint64(n))
+	return n, err
+}
+
 // ConnPoolOptions are used to parameterise the behaviour of a ConnPool.
 type ConnPoolOptions struct {
-	Timeout        time.Duration // Timeout when dialing new connections.
-	TimeToLive     time.Duration // Time-to-live for connections.
-	MaxConnections int           // Max connections allowed.
+	Timeout          time.Duration             // Timeout when dialing new connections.
+	TimeToLive       time.Duration             // Time-to-live for connections.
+	MaxConnections   int                       // Max connections allowed.
+	EncryptionPolicy protocol.EncryptionPolicy // Peers that must only be sent encrypted messages.
+	BreakerThreshold int                       // Consecutive failed sends before failing fast.
+	BreakerCooldown  time.Duration             // Time to fail fast before probing the remote peer again.
+
+	// WriteTimeout is optional. When it is positive, every write to a
+	// connection must complete within it, otherwise the connection is closed
+	// and the send fails, so that a peer that stops reading cannot block the
+	// senders to it. Writes to full duplex connections must complete within
+	// the Timeout when it is not set.
+	WriteTimeout time.Duration
+
+	// CoverInterval enables cover traffic when it is positive. Connections
+	// with padded sessions that have been idle for about the CoverInterval
+	// are sent cover messages, at randomised times, which makes traffic
+	// analysis of the timing of messages harder.
+	CoverInterval time.Duration
+
+	// RedialAttempts is the number of times that a connection dropped by the
+	// remote peer is re-dialed in the background, so that the next send does
+	// not have to wait for it. Attempts are made after a backoff that starts
+	// at the RedialBackoff and doubles after every attempt. Connections that
+	// are dropped within the RedialBackoff of being established (e.g. because
+	// the remote peer rejected them) are not re-dialed in the background, and
+	// neither are any connections if RedialAttempts is negative. Until it is
+	// replaced, a dropped connection stays in the pool, and the next send to
+	// the remote peer re-dials it straight away. Re-dialed connections are
+	// closed when the connection they replace would have been.
+	RedialAttempts int           // Defaults to 3
+	RedialBackoff  time.Duration // Defaults to 1 second
+
+	// Resolver is optional. When set, it is used to look up the host names of
+	// remote peers (e.g. to use DNS-over-HTTPS, see resolver.NewDoH), instead
+	// of the system resolver.
+	Resolver resolver.Resolver
+
+	// Duplex is optional. When set, connections with full duplex sessions
+	// (see handshake.DuplexSession) are read by it, so that remote peers can
+	// send messages on the connections that the pool has dialed (e.g. a Server
+	// with FullDuplex). Every write to a full duplex connection must complete
+	// within the Timeout, otherwise the connection is closed.
+	Duplex ConnHandler
+
+	// FDs counts the connections of the pool, and pauses dialing them when
+	// the process runs out of file descriptors, closing the connection that
+	// has transferred the fewest bytes to free one. Sends return
+	// ErrFDsExhausted while dialing is paused. It should be shared with the
+	// Server of the peer (defaults to an FDGuard of its own).
+	FDs *FDGuard
 }
 
 func (options *ConnPoolOptions) setZerosToDefaults() {
@@ -42,6 +187,21 @@ func (options *ConnPoolOptions) setZerosToDefaults() {
 	if options.MaxConnections == 0 {
 		options.MaxConnections = 512
 	}
+	if options.BreakerThreshold <= 0 {
+		options.BreakerThreshold = 5
+	}
+	if options.BreakerCooldown <= 0 {
+		options.BreakerCooldown = 30 * time.Second
+	}
+	if options.RedialAttempts == 0 {
+		options.RedialAttempts = 3
+	}
+	if options.RedialBackoff <= 0 {
+		options.RedialBackoff = time.Second
+	}
+	if options.FDs == nil {
+		options.FDs = NewFDGuard()
+	}
 }
 
 type connPool struct {
@@ -49,13 +209,32 @@ type connPool struct {
 	options    ConnPoolOptions
 	handshaker handshake.Handshaker // Handshaker to use while making connections
 
-	mu    *sync.RWMutex
-	conns map[string]conn
+	mu       *sync.RWMutex
+	conns    map[string]conn
+	breakers breakers
+	legacy   map[string]struct{} // Remote addresses of legacy peers
 }
 
 type conn struct {
-	conn    net.Conn
-	session protocol.Session
+	addr        net.Addr
+	conn        meteredConn
+	session     protocol.Session
+	established time.Time
+	expires     time.Time
+	lastWrite   time.Time
+	duplex      bool          // Whether the connection is read by the Duplex handler.
+	dropped     chan struct{} // Closed once the connection is closed.
+}
+
+// isDropped returns true if the connection has been closed, which means that it
+// was dropped by the remote peer if it is still in the pool.
+func (c conn) isDropped() bool {
+	select {
+	case <-c.dropped:
+		return true
+	default:
+		return false
+	}
 }
 
 // NewConnPool returns a ConnPool with no existing connections. It is safe for
@@ -69,8 +248,10 @@ func NewConnPool(options ConnPoolOptions, logger logrus.FieldLogger, handshaker
 		panic("ConnPool cannot have a nil handshaker")
 	}
 	return &connPool{
-		mu:    new(sync.RWMutex),
-		conns: map[string]conn{},
+		mu:       new(sync.RWMutex),
+		conns:    map[string]conn{},
+		breakers: newBreakers(options.BreakerThreshold, options.BreakerCooldown),
+		legacy:   map[string]struct{}{},
 
 		options:    options,
 		handshaker: handshaker,
@@ -83,69 +264,229 @@ func (pool *connPool) Send(to net.Addr, m protocol.Message) error {
 
 	toStr := to.String()
 	c, ok := pool.conns[toStr]
-	if !ok {
-		if len(pool.conns) >= pool.options.MaxConnections {
+	if !ok || c.isDropped() {
+		if err := pool.breakers.allow(toStr); err != nil {
+			return err
+		}
+		if !ok && len(pool.conns) >= pool.options.MaxConnections {
 			return ErrTooManyConnections
 		}
 
 		var err error
-		c, err = pool.connect(to)
+		c, err = pool.open(to, time.Now().Add(pool.options.TimeToLive))
 		if err != nil {
 			return err
 		}
-
-		pool.conns[toStr] = c
-		go pool.closeConn(toStr)
 	}
 
+	if err := pool.setWriteDeadline(c); err != nil {
+		pool.closeConnImmediately(toStr)
+		return err
+	}
 	if err := c.session.WriteMessage(c.conn, m); err != nil {
 		pool.logger.Errorf("error in session: %v, closing connection...", err)
 		pool.closeConnImmediately(toStr)
+		pool.breakers.failure(toStr)
+		return fmt.Errorf("error writing %v message to %v: %v", m.Variant, toStr, err)
 	}
+	c.lastWrite = time.Now()
+	pool.conns[toStr] = c
+	pool.breakers.success(toStr)
 	return nil
 }
 
+func (pool *connPool) Breakers() []BreakerState {
+	pool.mu.RLock()
+	defer pool.mu.RUnlock()
+
+	return pool.breakers.states()
+}
+
+func (pool *connPool) Conns() []ConnState {
+	pool.mu.RLock()
+	defer pool.mu.RUnlock()
+
+	states := make([]ConnState, 0, len(pool.conns))
+	for addr, c := range pool.conns {
+		states = append(states, newConnState(addr, c.session, c.conn.meter, c.established, true))
+	}
+	return states
+}
+
+func (pool *connPool) CloseConn(remoteAddr string) error {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	if _, ok := pool.conns[remoteAddr]; !ok {
+		return ErrConnNotFound
+	}
+	pool.closeConnImmediately(remoteAddr)
+	return nil
+}
+
+func (pool *connPool) Redial(remoteAddr string) error {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	c, ok := pool.conns[remoteAddr]
+	if !ok {
+		return ErrConnNotFound
+	}
+	pool.closeConnImmediately(remoteAddr)
+	_, err := pool.open(c.addr, time.Now().Add(pool.options.TimeToLive))
+	return err
+}
+
+// open a connection to the remote peer that expires at the given time, and add
+// it to the pool, replacing any existing connection to the remote peer. It must
+// be called while holding the lock of the pool.
+func (pool *connPool) open(to net.Addr, expires time.Time) (conn, error) {
+	toStr := to.String()
+	if pool.options.FDs.paused(time.Now()) {
+		return conn{}, ErrFDsExhausted
+	}
+	c, err := pool.connect(to)
+	if err != nil {
+		if isFDExhausted(err) {
+			// The remote peer is not at fault, so its breaker is not tripped
+			pause := pool.options.FDs.exhaust(time.Now())
+			pool.logger.Warnf("conn pool ran out of file descriptors: pausing dialing for %v: %v", pause, err)
+			pool.shedWithoutLock()
+			return conn{}, ErrFDsExhausted
+		}
+		pool.breakers.failure(toStr)
+		return conn{}, err
+	}
+	pool.options.FDs.recover()
+	c.expires = expires
+
+	pool.closeConnImmediately(toStr)
+	pool.conns[toStr] = c
+	go pool.closeConn(toStr, c.conn, expires)
+	go pool.watch(c)
+	if _, ok := c.session.(handshake.PaddedSession); ok && pool.options.CoverInterval > 0 {
+		go pool.sendCover(toStr, c.conn)
+	}
+	return c, nil
+}
+
+// setWriteDeadline of the connection, so that the next write to it must
+// complete within the WriteTimeout. Writes to full duplex connections have a
+// deadline even when there is no WriteTimeout, because they are read at the
+// same time.
+func (pool *connPool) setWriteDeadline(c conn) error {
+	timeout := pool.options.WriteTimeout
+	if timeout <= 0 && c.duplex {
+		timeout = pool.options.Timeout
+	}
+	if timeout <= 0 {
+		return nil
+	}
+	return c.conn.SetWriteDeadline(time.Now().Add(timeout))
+}
+
+// dial the remote peer. When the pool has a Resolver, the host name of the peer
+// is looked up using the Resolver, and its addresses are dialed in order until
+// one succeeds.
+func (pool *connPool) dial(ctx context.Context, to net.Addr) (net.Conn, error) {
+	if pool.options.Resolver == nil {
+		return net.DialTimeout(to.Network(), to.String(), pool.options.Timeout)
+	}
+	addrs, err := resolver.ResolveAddr(ctx, pool.options.Resolver, to.String())
+	if err != nil {
+		return nil, err
+	}
+	err = fmt.Errorf("no addresses for %v", to)
+	for _, addr := range addrs {
+		var netConn net.Conn
+		if netConn, err = net.DialTimeout(to.Network(), addr, pool.options.Timeout); err == nil {
+			return netConn, nil
+		}
+	}
+	return nil, err
+}
+
 func (pool *connPool) connect(to net.Addr) (conn, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), pool.options.Timeout)
 	defer cancel()
 
-	netConn, err := net.DialTimeout(to.Network(), to.String(), pool.options.Timeout)
+	rawConn, err := pool.dial(ctx, to)
 	if err != nil {
 		return conn{}, err
 	}
+	netConn := newMeteredConn(pool.options.FDs.track(rawConn))
 
 	// Set a timeout for the handshake process
 	deadline := time.Now().Add(pool.options.Timeout)
 	if err := netConn.SetDeadline(deadline); err != nil {
+		netConn.Close()
 		return conn{}, err
 	}
 
-	session, err := pool.handshaker.Handshake(ctx, netConn)
+	session, err := pool.handshake(ctx, to.String(), netConn)
 	if err != nil {
+		netConn.Close()
 		return conn{}, err
 	}
 	if session == nil {
+		netConn.Close()
 		return conn{}, fmt.Errorf("nil session [addr = %v] returned by handshaker", to)
 	}
+	if err := pool.options.EncryptionPolicy.Check(session); err != nil {
+		netConn.Close()
+		return conn{}, err
+	}
 
 	// Reset the timeout back
 	if err := netConn.SetDeadline(time.Time{}); err != nil {
+		netConn.Close()
 		return conn{}, err
 	}
 
 	return conn{
-		conn:    netConn,
-		session: session,
+		addr:        to,
+		conn:        netConn,
+		session:     session,
+		established: time.Now(),
+		duplex:      pool.options.Duplex != nil && handshake.IsDuplex(session),
+		dropped:     make(chan struct{}),
 	}, nil
 }
 
-func (pool *connPool) closeConn(to string) {
-	<-time.After(pool.options.TimeToLive)
+// handshake with the remote peer. Once the remote peer is found to be a legacy
+// peer, the legacy handshake is used from the next connection onwards (see
+// handshake.LegacyHandshaker), because legacy servers refuse connections that
+// are made too soon after the last one. It must be called while holding the
+// lock of the pool.
+func (pool *connPool) handshake(ctx context.Context, to string, netConn net.Conn) (protocol.Session, error) {
+	legacyHandshaker, ok := pool.handshaker.(handshake.LegacyHandshaker)
+	if !ok {
+		return pool.handshaker.Handshake(ctx, netConn)
+	}
+	if _, ok := pool.legacy[to]; ok {
+		session, err := legacyHandshaker.LegacyHandshake(ctx, netConn)
+		if err != nil {
+			delete(pool.legacy, to)
+		}
+		return session, err
+	}
+	session, err := pool.handshaker.Handshake(ctx, netConn)
+	if legacyErr, ok := err.(handshake.ErrLegacyPeer); ok && legacyErr.Fallback {
+		pool.logger.Warnf("falling back to the legacy handshake with %v: %v", to, err)
+		pool.legacy[to] = struct{}{}
+	}
+	return session, err
+}
+
+// closeConn closes the connection once it has expired, unless it has already
+// been replaced.
+func (pool *connPool) closeConn(to string, netConn meteredConn, expires time.Time) {
+	<-time.After(time.Until(expires))
 	pool.mu.Lock()
 	defer pool.mu.Unlock()
 
 	c, ok := pool.conns[to]
-	if !ok {
+	if !ok || c.conn.meter != netConn.meter {
 		return
 	}
 	if err := c.conn.Close(); err != nil {
@@ -154,6 +495,135 @@ func (pool *connPool) closeConn(to string) {
 	delete(pool.conns, to)
 }
 
+// watch the connection until it is closed. Remote peers only write to the
+// connections of the pool when they are full duplex, in which case they are
+// read by the Duplex handler, otherwise reading from them only returns once
+// they are closed. If the connection was dropped by the remote peer, rather
+// than closed by the pool, or closed as a duplicate, it is re-dialed in the
+// background.
+func (pool *connPool) watch(c conn) {
+	var err error
+	if c.duplex {
+		err = pool.options.Duplex.HandleConn(c.conn, c.session)
+	} else {
+		// Reading from the underlying connection does not count towards the
+		// metered bytes of the connection
+		io.Copy(ioutil.Discard, c.conn.Conn)
+	}
+	close(c.dropped)
+
+	to := c.addr.String()
+	if err == ErrDuplicateConn {
+		pool.mu.Lock()
+		defer pool.mu.Unlock()
+
+		if current, ok := pool.conns[to]; ok && current.conn.meter == c.conn.meter {
+			pool.logger.Debugf("connection to %v was closed as a duplicate", to)
+			delete(pool.conns, to)
+		}
+		return
+	}
+	pool.mu.RLock()
+	defer pool.mu.RUnlock()
+
+	current, ok := pool.conns[to]
+	if !ok || current.conn.meter != c.conn.meter {
+		return
+	}
+	pool.logger.Debugf("connection to %v was dropped", to)
+	if pool.options.RedialAttempts > 0 && time.Since(c.established) >= pool.options.RedialBackoff {
+		go pool.redial(c)
+	}
+}
+
+// redial the remote peer after its connection was dropped, backing off between
+// attempts, until the dropped connection has been replaced or closed, or it
+// would have expired.
+func (pool *connPool) redial(dropped conn) {
+	to := dropped.addr.String()
+	backoff := pool.options.RedialBackoff
+	for attempt := 0; attempt < pool.options.RedialAttempts; attempt++ {
+		time.Sleep(backoff)
+		backoff *= 2
+		if time.Now().After(dropped.expires) {
+			return
+		}
+
+		pool.mu.Lock()
+		if c, ok := pool.conns[to]; !ok || c.conn.meter != dropped.conn.meter {
+			// A send has already re-dialed the remote peer, or the dropped
+			// connection has been closed
+			pool.mu.Unlock()
+			return
+		}
+		if pool.breakers.allow(to) != nil {
+			pool.mu.Unlock()
+			return
+		}
+		_, err := pool.open(dropped.addr, dropped.expires)
+		if err == nil {
+			pool.breakers.success(to)
+		}
+		pool.mu.Unlock()
+
+		if err == nil {
+			return
+		}
+		pool.logger.Debugf("error re-dialing %v (attempt %v): %v", to, attempt+1, err)
+	}
+}
+
+// sendCover writes a cover message to the connection whenever it has been idle
+// for the CoverInterval, until the connection is closed. The connection is
+// checked at random times between half and one and a half CoverIntervals.
+func (pool *connPool) sendCover(to string, netConn meteredConn) {
+	for {
+		interval := pool.options.CoverInterval
+		time.Sleep(interval/2 + time.Duration(rand.Int63n(int64(interval))))
+
+		pool.mu.Lock()
+		c, ok := pool.conns[to]
+		if !ok || c.conn.meter != netConn.meter {
+			pool.mu.Unlock()
+			return
+		}
+		if time.Since(c.lastWrite) >= interval {
+			err := pool.setWriteDeadline(c)
+			if err == nil {
+				err = c.session.(handshake.PaddedSession).WriteCover(c.conn)
+			}
+			if err != nil {
+				pool.logger.Errorf("error writing cover message to %v: %v, closing connection...", to, err)
+				pool.closeConnImmediately(to)
+				pool.mu.Unlock()
+				return
+			}
+			c.lastWrite = time.Now()
+			pool.conns[to] = c
+		}
+		pool.mu.Unlock()
+	}
+}
+
+// shedWithoutLock closes the connection that has transferred the fewest bytes,
+// so that its file descriptor can be used by a more valuable connection. It
+// must be called while holding the lock of the pool.
+func (pool *connPool) shedWithoutLock() {
+	addrs := make([]string, 0, len(pool.conns))
+	meters := make([]*meter, 0, len(pool.conns))
+	for addr, c := range pool.conns {
+		addrs = append(addrs, addr)
+		meters = append(meters, c.conn.meter)
+	}
+	i := leastValuable(meters)
+	if i < 0 {
+		return
+	}
+	pool.closeConnImmediately(addrs[i])
+	pool.options.FDs.shedConn()
+	pool.logger.Infof("conn pool shed connection to %v to free a file descriptor", addrs[i])
+}
+
 func (pool *connPool) closeConnImmediately(to string) {
 	c, ok := pool.conns[to]
 	if !ok {
@@ -2,6 +2,7 @@ package tcp_test
 
 import (
 	"context"
+	"errors"
 	"net"
 	"testing/quick"
 	"time"
@@ -103,6 +104,116 @@ var _ = Describe("Connection pool", func() {
 			})
 		})
 
+		Context("when the connection is padded and idle", func() {
+			It("should send cover messages that are not received by the server", func() {
+				ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+				defer func() {
+					cancel()
+					time.Sleep(200 * time.Millisecond)
+				}()
+
+				// Initialize a connPool that pads messages and sends cover
+				// traffic
+				clientSignVerifier := NewMockSignVerifier()
+				handshaker := handshake.NewWithOptions(handshake.Options{PaddingBucketSize: 256}, clientSignVerifier, handshake.NewGCMSessionManager())
+				pool := NewConnPool(ConnPoolOptions{CoverInterval: 20 * time.Millisecond}, logrus.New(), handshaker).(ExtendedConnPool)
+
+				// Initialize a server
+				serverAddr, err := net.ResolveTCPAddr("tcp", ":8080")
+				Expect(err).NotTo(HaveOccurred())
+				options := ServerOptions{Host: serverAddr.String(), RateLimit: -1} // no rate limiting on server
+				messages := NewTCPServer(ctx, options, clientSignVerifier)
+
+				message1 := RandomMessage(protocol.V1, RandomMessageVariant())
+				Expect(pool.Send(serverAddr, message1)).NotTo(HaveOccurred())
+				var received1 protocol.MessageOnTheWire
+				Eventually(messages, 3*time.Second).Should(Receive(&received1))
+				Expect(cmp.Equal(message1, received1.Message, cmpopts.EquateEmpty())).Should(BeTrue())
+				Expect(pool.Conns()).Should(HaveLen(1))
+				Expect(pool.Conns()[0].PaddingBucketSize).Should(Equal(256))
+
+				// Expect the cover messages to be discarded by the server,
+				// without corrupting the stream
+				Consistently(messages, 300*time.Millisecond).ShouldNot(Receive())
+				message2 := RandomMessage(protocol.V1, RandomMessageVariant())
+				Expect(pool.Send(serverAddr, message2)).NotTo(HaveOccurred())
+				var received2 protocol.MessageOnTheWire
+				Eventually(messages, 3*time.Second).Should(Receive(&received2))
+				Expect(cmp.Equal(message2, received2.Message, cmpopts.EquateEmpty())).Should(BeTrue())
+			})
+		})
+
+		Context("when the remote peer stops reading", func() {
+			It("should fail the send and close the connection once the write timeout has passed", func() {
+				ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+				defer cancel()
+
+				// Initialize a listener that completes the handshake, and
+				// then never reads from the connection
+				signVerifier := NewMockSignVerifier()
+				listener, err := net.Listen("tcp", "127.0.0.1:0")
+				Expect(err).NotTo(HaveOccurred())
+				defer listener.Close()
+				go func() {
+					conn, err := listener.Accept()
+					if err != nil {
+						return
+					}
+					defer conn.Close()
+					handshaker := handshake.New(signVerifier, handshake.NewGCMSessionManager())
+					if _, err := handshaker.AcceptHandshake(ctx, conn); err != nil {
+						return
+					}
+					<-ctx.Done()
+				}()
+
+				handshaker := handshake.New(signVerifier, handshake.NewGCMSessionManager())
+				pool := NewConnPool(ConnPoolOptions{WriteTimeout: 100 * time.Millisecond}, logrus.New(), handshaker).(ExtendedConnPool)
+
+				// Send messages until the buffers of the connection are full,
+				// and a write cannot complete
+				message := protocol.NewMessage(protocol.V1, protocol.Cast, protocol.NilGroupID, make([]byte, 64*1024))
+				start := time.Now()
+				for err == nil && time.Since(start) < 10*time.Second {
+					err = pool.Send(listener.Addr(), message)
+				}
+				Expect(err).To(HaveOccurred())
+				Expect(pool.Conns()).To(BeEmpty())
+			})
+		})
+
+		Context("when the connPool has a resolver", func() {
+			It("should dial the addresses that the host name resolves to", func() {
+				ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+				defer func() {
+					cancel()
+					time.Sleep(200 * time.Millisecond)
+				}()
+
+				// Initialize a connPool that resolves a host name to the
+				// loopback address
+				clientSignVerifier := NewMockSignVerifier()
+				handshaker := handshake.New(clientSignVerifier, handshake.NewGCMSessionManager())
+				resolver := mockResolver{"seed.example.com": {"127.0.0.1"}}
+				pool := NewConnPool(ConnPoolOptions{Resolver: resolver}, logrus.New(), handshaker)
+
+				// Initialize a server
+				options := ServerOptions{Host: "127.0.0.1:8080", RateLimit: -1} // no rate limiting on server
+				messages := NewTCPServer(ctx, options, clientSignVerifier)
+
+				// Send a message to the host name and expect the server
+				// receives it
+				message := RandomMessage(protocol.V1, RandomMessageVariant())
+				Expect(pool.Send(hostAddr("seed.example.com:8080"), message)).NotTo(HaveOccurred())
+				var received protocol.MessageOnTheWire
+				Eventually(messages, 3*time.Second).Should(Receive(&received))
+				Expect(cmp.Equal(message, received.Message, cmpopts.EquateEmpty())).Should(BeTrue())
+
+				// Expect unknown host names to fail
+				Expect(pool.Send(hostAddr("unknown.example.com:8080"), message)).To(HaveOccurred())
+			})
+		})
+
 		Context("when the connection has been open more than TimeToLive time", func() {
 			It("should close the connection to release the resources", func() {
 				test := func() bool {
@@ -147,6 +258,165 @@ var _ = Describe("Connection pool", func() {
 		})
 	})
 
+	Context("when sends to a remote peer keep failing", func() {
+		It("should fail fast until the cooldown has passed, and then probe the peer", func() {
+			clientSignVerifier := NewMockSignVerifier()
+			handshaker := handshake.New(clientSignVerifier, handshake.NewGCMSessionManager())
+			options := ConnPoolOptions{
+				Timeout:          time.Second,
+				BreakerThreshold: 3,
+				BreakerCooldown:  200 * time.Millisecond,
+			}
+			pool := NewConnPool(options, logrus.New(), handshaker).(ExtendedConnPool)
+
+			// Find an address that nothing is listening on
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+			addr := listener.Addr()
+			Expect(listener.Close()).To(Succeed())
+
+			message := RandomMessage(protocol.V1, RandomMessageVariant())
+			for i := 0; i < options.BreakerThreshold; i++ {
+				err := pool.Send(addr, message)
+				Expect(err).To(HaveOccurred())
+				Expect(err).NotTo(BeAssignableToTypeOf(ErrCircuitOpen{}))
+			}
+			Expect(pool.Send(addr, message)).To(BeAssignableToTypeOf(ErrCircuitOpen{}))
+			Expect(errors.Is(pool.Send(addr, message), protocol.ErrUnavailable)).To(BeTrue())
+			Expect(pool.Breakers()).Should(HaveLen(1))
+			Expect(pool.Breakers()[0].RemoteAddr).Should(Equal(addr.String()))
+			Expect(pool.Breakers()[0].Status).Should(Equal(BreakerOpen))
+			Expect(pool.Breakers()[0].Failures).Should(Equal(options.BreakerThreshold))
+
+			// After the cooldown, the next send probes the peer and opens the
+			// breaker again when it fails
+			Eventually(func() BreakerStatus { return pool.Breakers()[0].Status }).Should(Equal(BreakerHalfOpen))
+			err = pool.Send(addr, message)
+			Expect(err).To(HaveOccurred())
+			Expect(err).NotTo(BeAssignableToTypeOf(ErrCircuitOpen{}))
+			Expect(pool.Send(addr, message)).To(BeAssignableToTypeOf(ErrCircuitOpen{}))
+
+			// A successful probe closes the breaker
+			ctx, cancel := context.WithCancel(context.Background())
+			defer func() {
+				cancel()
+				time.Sleep(200 * time.Millisecond)
+			}()
+			messages := NewTCPServer(ctx, ServerOptions{Host: addr.String()}, clientSignVerifier)
+			Eventually(func() error { return pool.Send(addr, message) }, 3*time.Second).Should(Succeed())
+			Eventually(messages, 3*time.Second).Should(Receive())
+			Expect(pool.Breakers()).Should(BeEmpty())
+		})
+	})
+
+	Context("when the remote peer drops the connection", func() {
+		It("should re-dial it in the background, and reuse the new connection", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer func() {
+				cancel()
+				time.Sleep(200 * time.Millisecond)
+			}()
+
+			clientSignVerifier := NewMockSignVerifier()
+			serverSignVerifier := NewMockSignVerifier(clientSignVerifier.ID())
+			clientSignVerifier.Whitelist(serverSignVerifier.ID())
+			handshaker := handshake.New(clientSignVerifier, handshake.NewGCMSessionManager())
+			pool := NewConnPool(ConnPoolOptions{RedialBackoff: 100 * time.Millisecond}, logrus.New(), handshaker).(ExtendedConnPool)
+
+			// Initialize a server that does not rate limit the re-dial
+			serverAddr, err := net.ResolveTCPAddr("tcp", "127.0.0.1:8082")
+			Expect(err).NotTo(HaveOccurred())
+			server := NewServer(ServerOptions{Host: serverAddr.String(), RateLimit: -1}, logrus.New(), handshake.New(serverSignVerifier, handshake.NewGCMSessionManager()))
+			messages := make(chan protocol.MessageOnTheWire, 128)
+			go server.Run(ctx, messages)
+			time.Sleep(50 * time.Millisecond)
+
+			Expect(pool.Send(serverAddr, RandomMessage(protocol.V1, RandomMessageVariant()))).To(Succeed())
+			Eventually(messages, 3*time.Second).Should(Receive())
+			Expect(server.Conns()).Should(HaveLen(1))
+			dropped := server.Conns()[0].RemoteAddr
+
+			// Drop the connection from the server, once it has been open for
+			// long enough not to look like it was rejected, and expect the
+			// pool to replace it without sending anything
+			time.Sleep(100 * time.Millisecond)
+			droppedAt := time.Now()
+			Expect(server.CloseConn(dropped)).To(Succeed())
+			Eventually(func() []ConnState { return server.Conns() }, 3*time.Second).Should(And(
+				HaveLen(1),
+				WithTransform(func(states []ConnState) string { return states[0].RemoteAddr }, Not(Equal(dropped))),
+			))
+			Expect(pool.Conns()).Should(HaveLen(1))
+			Expect(pool.Conns()[0].Age).Should(BeNumerically("<", time.Since(droppedAt)))
+
+			message := RandomMessage(protocol.V1, RandomMessageVariant())
+			Expect(pool.Send(serverAddr, message)).To(Succeed())
+			var received protocol.MessageOnTheWire
+			Eventually(messages, 3*time.Second).Should(Receive(&received))
+			Expect(cmp.Equal(message, received.Message, cmpopts.EquateEmpty())).Should(BeTrue())
+			Expect(server.Conns()).Should(HaveLen(1))
+		})
+	})
+
+	Context("when the encryption policy requires encrypted sessions", func() {
+		It("should reject plaintext sessions with a typed error", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer func() {
+				cancel()
+				time.Sleep(200 * time.Millisecond)
+			}()
+
+			// Initialize a connPool that only has plaintext sessions
+			clientSignVerifier := NewMockSignVerifier()
+			serverSignVerifier := NewMockSignVerifier(clientSignVerifier.ID())
+			clientSignVerifier.Whitelist(serverSignVerifier.ID())
+			handshaker := handshake.New(clientSignVerifier, handshake.NewInsecureSessionManager())
+			options := ConnPoolOptions{EncryptionPolicy: protocol.EncryptionPolicy{RequireAll: true}}
+			pool := NewConnPool(options, logrus.New(), handshaker).(ExtendedConnPool)
+
+			// Initialize a server
+			serverAddr, err := net.ResolveTCPAddr("tcp", ":8080")
+			Expect(err).NotTo(HaveOccurred())
+			server := NewServer(ServerOptions{Host: serverAddr.String()}, logrus.New(), handshake.New(serverSignVerifier, handshake.NewInsecureSessionManager()))
+			go server.Run(ctx, make(chan protocol.MessageOnTheWire, 128))
+			time.Sleep(50 * time.Millisecond)
+
+			message := RandomMessage(protocol.V1, RandomMessageVariant())
+			err = pool.Send(serverAddr, message)
+			Expect(err).To(BeAssignableToTypeOf(protocol.ErrPlaintextSession{}))
+			Expect(err.(protocol.ErrPlaintextSession).PeerID.String()).Should(Equal(serverSignVerifier.ID()))
+			Expect(pool.Conns()).Should(BeEmpty())
+		})
+
+		It("should expose the security state of encrypted sessions", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer func() {
+				cancel()
+				time.Sleep(200 * time.Millisecond)
+			}()
+
+			// Initialize a connPool
+			clientSignVerifier := NewMockSignVerifier()
+			handshaker := handshake.New(clientSignVerifier, handshake.NewGCMSessionManager())
+			options := ConnPoolOptions{EncryptionPolicy: protocol.EncryptionPolicy{RequireAll: true}}
+			pool := NewConnPool(options, logrus.New(), handshaker).(ExtendedConnPool)
+
+			// Initialize a server
+			serverAddr, err := net.ResolveTCPAddr("tcp", ":8080")
+			Expect(err).NotTo(HaveOccurred())
+			messages := NewTCPServer(ctx, ServerOptions{Host: serverAddr.String()}, clientSignVerifier)
+
+			message := RandomMessage(protocol.V1, RandomMessageVariant())
+			Expect(pool.Send(serverAddr, message)).NotTo(HaveOccurred())
+			Eventually(messages, 3*time.Second).Should(Receive())
+
+			conns := pool.Conns()
+			Expect(conns).Should(HaveLen(1))
+			Expect(conns[0].RemoteAddr).Should(Equal(serverAddr.String()))
+			Expect(conns[0].Encrypted).Should(BeTrue())
+		})
+	})
+
 	Context("when trying to connect to a malicious server", func() {
 		Context("when server doesn't respond in time", func() {
 			It("should timeout the handshake process", func() {
@@ -179,3 +449,21 @@ var _ = Describe("Connection pool", func() {
 		})
 	})
 })
+
+// hostAddr is a TCP address with a host name instead of an IP address.
+type hostAddr string
+
+func (addr hostAddr) Network() string { return "tcp" }
+
+func (addr hostAddr) String() string { return string(addr) }
+
+// mockResolver resolves the host names in a map.
+type mockResolver map[string][]string
+
+func (resolver mockResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	addrs, ok := resolver[host]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	return addrs, nil
+}
@@ -0,0 +1,156 @@
+package tcp
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/renproject/aw/handshake"
+	"github.com/renproject/aw/protocol"
+)
+
+// ErrDuplicateConn is returned by a ConnHandler when a connection was closed
+// because there is another full duplex connection with the same remote peer,
+// that was dialed in the other direction. Connections closed as duplicates
+// must not be re-dialed.
+var ErrDuplicateConn = errors.New("duplicate connection")
+
+// A ConnHandler reads the messages that remote peers write to the full duplex
+// connections dialed by a ConnPool (see ConnPoolOptions). HandleConn must block
+// until the connection is closed.
+type ConnHandler interface {
+	HandleConn(conn net.Conn, session protocol.Session) error
+}
+
+// A ConnSender writes messages to the full duplex connections that remote peers
+// have dialed (see ClientOptions). SendTo must return ErrConnNotFound when
+// there is no such connection to the remote peer.
+type ConnSender interface {
+	SendTo(peerID protocol.PeerID, message protocol.Message) error
+}
+
+// duplexConns are the full duplex connections with a remote peer, that were
+// dialed in each direction.
+type duplexConns struct {
+	inbound  net.Conn
+	outbound net.Conn
+}
+
+// HandleConn implements the ConnHandler interface. Messages read from the
+// connection are sent to the messages of the running server, as if the remote
+// peer had dialed the server. When the server is not running, or is not full
+// duplex, the connection is only watched until it is closed.
+func (server *Server) HandleConn(conn net.Conn, session protocol.Session) error {
+	server.runMu.RLock()
+	ctx, messages := server.runCtx, server.runMessages
+	server.runMu.RUnlock()
+
+	peerID := protocol.SessionPeerID(session)
+	if server.options.FullDuplex && messages != nil && handshake.IsDuplex(session) && peerID != nil {
+		server.dedupe(peerID, conn, true)
+		server.read(ctx, conn, session, messages)
+		if !server.release(peerID, conn, true) {
+			return ErrDuplicateConn
+		}
+		if ctx.Err() == nil {
+			return nil
+		}
+	}
+	io.Copy(ioutil.Discard, conn)
+	return nil
+}
+
+// dedupe the full duplex connections with the remote peer, after a connection
+// has been established in one direction. When both peers dial each other at
+// the same time, both of them keep the connection that was dialed by the peer
+// with the lower PeerID, so that exactly one connection survives. The other
+// connection is closed by the peer that dialed it, so that the messages that
+// were already written to it are still read by the other peer, and it is never
+// written to again. Connections are not deduplicated unless the server knows
+// its own PeerID (see ServerOptions).
+func (server *Server) dedupe(peerID protocol.PeerID, conn net.Conn, outbound bool) {
+	server.connsMu.Lock()
+	defer server.connsMu.Unlock()
+
+	key := peerID.String()
+	conns := server.duplex[key]
+	if outbound {
+		conns.outbound = conn
+	} else {
+		conns.inbound = conn
+	}
+	if conns.inbound != nil && conns.outbound != nil && server.options.Me != nil {
+		if server.options.Me.String() < key {
+			server.logger.Debugf("keeping connection dialed to peer=%v: peer dialed a duplicate connection", peerID)
+			conns.inbound = nil
+		} else {
+			server.logger.Debugf("closing connection dialed to peer=%v: peer dialed a duplicate connection", peerID)
+			conns.outbound.Close()
+			conns.outbound = nil
+		}
+	}
+	server.duplex[key] = conns
+}
+
+// release the full duplex connection once it has been closed, and return false
+// if it was no longer kept (e.g. because it was closed as a duplicate).
+func (server *Server) release(peerID protocol.PeerID, conn net.Conn, outbound bool) bool {
+	server.connsMu.Lock()
+	defer server.connsMu.Unlock()
+
+	key := peerID.String()
+	conns, ok := server.duplex[key]
+	if !ok {
+		return false
+	}
+	kept := false
+	if outbound && conns.outbound == conn {
+		conns.outbound, kept = nil, true
+	}
+	if !outbound && conns.inbound == conn {
+		conns.inbound, kept = nil, true
+	}
+	if conns.inbound == nil && conns.outbound == nil {
+		delete(server.duplex, key)
+	} else {
+		server.duplex[key] = conns
+	}
+	return kept
+}
+
+// SendTo implements the ConnSender interface. The message is written to a full
+// duplex connection that the remote peer has dialed, within the WriteTimeout.
+// Connections that cannot be written to are closed.
+func (server *Server) SendTo(peerID protocol.PeerID, message protocol.Message) error {
+	if !server.options.FullDuplex {
+		return ErrConnNotFound
+	}
+
+	// Only the inbound connection that was kept by the deduplication is
+	// written to
+	server.connsMu.RLock()
+	c, ok := serverConn{}, false
+	if inbound := server.duplex[peerID.String()].inbound; inbound != nil {
+		c, ok = server.conns[inbound.RemoteAddr().String()]
+	}
+	server.connsMu.RUnlock()
+	if !ok {
+		return ErrConnNotFound
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if err := c.conn.SetWriteDeadline(time.Now().Add(server.options.WriteTimeout)); err != nil {
+		c.conn.Close()
+		return err
+	}
+	if err := c.session.WriteMessage(c.conn, message); err != nil {
+		server.logger.Errorf("error writing to %v: %v, closing connection...", c.conn.RemoteAddr(), err)
+		c.conn.Close()
+		return err
+	}
+	return nil
+}
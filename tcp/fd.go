@@ -0,0 +1,190 @@
+package tcp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/renproject/aw/protocol"
+)
+
+// ErrFDsExhausted is returned when a connection is not dialed because the
+// process has run out of file descriptors, and dialing is paused.
+var ErrFDsExhausted = protocol.NewError(protocol.ErrUnavailable, "file descriptors exhausted")
+
+const (
+	minFDBackoff = 10 * time.Millisecond
+	maxFDBackoff = time.Second
+)
+
+// FDStats describes the file descriptors used by the connections of the
+// Servers and ConnPools that share an FDGuard.
+type FDStats struct {
+	Open        int64     // Connections that are open.
+	Limit       uint64    // Max open files of the process, or zero if it is not known (e.g. on Windows).
+	Exhausted   uint64    // Times that accepting, or dialing, failed because there were no file descriptors.
+	Shed        uint64    // Connections that were closed to free file descriptors.
+	PausedUntil time.Time // Accepting and dialing are paused until this time.
+}
+
+// An FDGuard counts the connections that are open, and pauses accepting and
+// dialing connections when the process runs out of file descriptors (EMFILE
+// and ENFILE, or WSAEMFILE and WSAENOBUFS on Windows), instead of retrying
+// straight away. The pause starts at 10 milliseconds, and doubles every time
+// that the file descriptors run out again, up to one second, until a
+// connection is accepted, or dialed. A Server and a ConnPool should share an
+// FDGuard, because they share the file descriptors of the process. It is safe
+// for concurrent use.
+type FDGuard struct {
+	limit uint64
+	open  int64
+
+	mu          *sync.Mutex
+	backoff     time.Duration
+	pausedUntil time.Time
+	exhausted   uint64
+	shed        uint64
+}
+
+// NewFDGuard returns an FDGuard with no open connections.
+func NewFDGuard() *FDGuard {
+	return &FDGuard{
+		limit: fdLimit(),
+		mu:    new(sync.Mutex),
+	}
+}
+
+// Stats returns the current usage of file descriptors.
+func (guard *FDGuard) Stats() FDStats {
+	guard.mu.Lock()
+	defer guard.mu.Unlock()
+
+	return FDStats{
+		Open:        atomic.LoadInt64(&guard.open),
+		Limit:       guard.limit,
+		Exhausted:   guard.exhausted,
+		Shed:        guard.shed,
+		PausedUntil: guard.pausedUntil,
+	}
+}
+
+// paused returns true if accepting and dialing are paused at the given time.
+func (guard *FDGuard) paused(now time.Time) bool {
+	guard.mu.Lock()
+	defer guard.mu.Unlock()
+
+	return now.Before(guard.pausedUntil)
+}
+
+// wait until accepting and dialing are no longer paused. It returns false if
+// the context is done first.
+func (guard *FDGuard) wait(ctx context.Context) bool {
+	guard.mu.Lock()
+	pause := time.Until(guard.pausedUntil)
+	guard.mu.Unlock()
+
+	if pause <= 0 {
+		return true
+	}
+	timer := time.NewTimer(pause)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// exhaust records that the file descriptors ran out, and pauses accepting and
+// dialing. It returns the duration of the pause.
+func (guard *FDGuard) exhaust(now time.Time) time.Duration {
+	guard.mu.Lock()
+	defer guard.mu.Unlock()
+
+	guard.exhausted++
+	if now.Before(guard.pausedUntil) {
+		// Another connection has already paused, so the backoff is not
+		// doubled again
+		return guard.pausedUntil.Sub(now)
+	}
+	switch {
+	case guard.backoff == 0:
+		guard.backoff = minFDBackoff
+	case guard.backoff < maxFDBackoff:
+		guard.backoff *= 2
+		if guard.backoff > maxFDBackoff {
+			guard.backoff = maxFDBackoff
+		}
+	}
+	guard.pausedUntil = now.Add(guard.backoff)
+	return guard.backoff
+}
+
+// recover resets the backoff after a connection has been accepted, or dialed.
+func (guard *FDGuard) recover() {
+	guard.mu.Lock()
+	defer guard.mu.Unlock()
+
+	guard.backoff = 0
+}
+
+func (guard *FDGuard) shedConn() {
+	guard.mu.Lock()
+	defer guard.mu.Unlock()
+
+	guard.shed++
+}
+
+// track the connection, so that it is counted as open until it is closed.
+func (guard *FDGuard) track(conn net.Conn) net.Conn {
+	atomic.AddInt64(&guard.open, 1)
+	return &trackedConn{Conn: conn, guard: guard, once: new(sync.Once)}
+}
+
+// trackedConn is a net.Conn that is counted by an FDGuard until it is closed.
+type trackedConn struct {
+	net.Conn
+	guard *FDGuard
+	once  *sync.Once
+}
+
+func (conn *trackedConn) Close() error {
+	conn.once.Do(func() {
+		atomic.AddInt64(&conn.guard.open, -1)
+	})
+	return conn.Conn.Close()
+}
+
+// isFDExhausted returns true if the error was caused by the process running
+// out of file descriptors.
+func isFDExhausted(err error) bool {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return false
+	}
+	for _, exhausted := range fdExhaustedErrnos {
+		if errno == exhausted {
+			return true
+		}
+	}
+	return false
+}
+
+// leastValuable returns the index of the connection that has transferred the
+// fewest bytes, so that the busiest connections survive when connections are
+// shed. It returns -1 if there are no connections.
+func leastValuable(meters []*meter) int {
+	least, leastBytes := -1, uint64(0)
+	for i, m := range meters {
+		bytes := atomic.LoadUint64(&m.bytesIn) + atomic.LoadUint64(&m.bytesOut)
+		if least == -1 || bytes < leastBytes {
+			least, leastBytes = i, bytes
+		}
+	}
+	return least
+}
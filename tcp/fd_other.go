@@ -0,0 +1,13 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !windows
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!windows
+
+package tcp
+
+import "syscall"
+
+var fdExhaustedErrnos = []syscall.Errno{}
+
+// fdLimit returns zero, because the limit of open files is not known.
+func fdLimit() uint64 {
+	return 0
+}
@@ -0,0 +1,17 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package tcp
+
+import "syscall"
+
+var fdExhaustedErrnos = []syscall.Errno{syscall.EMFILE, syscall.ENFILE}
+
+// fdLimit returns the soft limit of open files of the process.
+func fdLimit() uint64 {
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		return 0
+	}
+	return uint64(limit.Cur)
+}
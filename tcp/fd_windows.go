@@ -0,0 +1,16 @@
+//go:build windows
+// +build windows
+
+package tcp
+
+import "syscall"
+
+// Winsock returns WSAEMFILE when the process has no more socket handles, and
+// WSAENOBUFS when the system has no more buffer space for sockets.
+var fdExhaustedErrnos = []syscall.Errno{syscall.Errno(10024), syscall.Errno(10055)}
+
+// fdLimit returns zero, because Windows has no limit of open files that can
+// be queried.
+func fdLimit() uint64 {
+	return 0
+}
@@ -0,0 +1,119 @@
+package tcp
+
+import (
+	"net"
+	"sync"
+
+	"github.com/renproject/aw/protocol"
+)
+
+// ConnRejections counts the connections rejected by a Server because of its
+// connection limits.
+type ConnRejections struct {
+	MaxConnections uint64 // Rejected because the Server had MaxConnections
+	PerIP          uint64 // Rejected because the remote IP had MaxConnectionsPerIP
+	PerSubnet      uint64 // Rejected because the remote subnet had MaxConnectionsPerSubnet
+	RateLimited    uint64 // Rejected because the remote IP exceeded the ConnectionRate
+}
+
+// connLimits counts the concurrent connections from every remote IP and
+// subnet. Limits that are not positive are not enforced.
+type connLimits struct {
+	maxPerIP         int
+	maxPerSubnet     int
+	subnetPrefixIPv4 int
+	subnetPrefixIPv6 int
+
+	mu         *sync.Mutex
+	ips        map[string]int
+	subnets    map[string]int
+	rejections ConnRejections
+}
+
+func newConnLimits(options ServerOptions) *connLimits {
+	return &connLimits{
+		maxPerIP:         options.MaxConnectionsPerIP,
+		maxPerSubnet:     options.MaxConnectionsPerSubnet,
+		subnetPrefixIPv4: options.SubnetPrefixIPv4,
+		subnetPrefixIPv6: options.SubnetPrefixIPv6,
+
+		mu:      new(sync.Mutex),
+		ips:     map[string]int{},
+		subnets: map[string]int{},
+	}
+}
+
+// acquire a connection from the remote address. It returns false, without
+// acquiring the connection, if the remote IP or subnet is at its limit.
+// Acquired connections must be released.
+func (limits *connLimits) acquire(remoteAddr net.Addr) bool {
+	ip, subnet, ok := limits.keys(remoteAddr)
+	if !ok {
+		return true
+	}
+
+	limits.mu.Lock()
+	defer limits.mu.Unlock()
+
+	if limits.maxPerIP > 0 && limits.ips[ip] >= limits.maxPerIP {
+		limits.rejections.PerIP++
+		return false
+	}
+	if limits.maxPerSubnet > 0 && limits.subnets[subnet] >= limits.maxPerSubnet {
+		limits.rejections.PerSubnet++
+		return false
+	}
+	limits.ips[ip]++
+	limits.subnets[subnet]++
+	return true
+}
+
+// release a connection that was acquired from the remote address.
+func (limits *connLimits) release(remoteAddr net.Addr) {
+	ip, subnet, ok := limits.keys(remoteAddr)
+	if !ok {
+		return
+	}
+
+	limits.mu.Lock()
+	defer limits.mu.Unlock()
+
+	if limits.ips[ip]--; limits.ips[ip] <= 0 {
+		delete(limits.ips, ip)
+	}
+	if limits.subnets[subnet]--; limits.subnets[subnet] <= 0 {
+		delete(limits.subnets, subnet)
+	}
+}
+
+func (limits *connLimits) rejectMaxConnections() {
+	limits.mu.Lock()
+	defer limits.mu.Unlock()
+
+	limits.rejections.MaxConnections++
+}
+
+func (limits *connLimits) rejectRateLimited() {
+	limits.mu.Lock()
+	defer limits.mu.Unlock()
+
+	limits.rejections.RateLimited++
+}
+
+func (limits *connLimits) rejected() ConnRejections {
+	limits.mu.Lock()
+	defer limits.mu.Unlock()
+
+	return limits.rejections
+}
+
+// keys returns the IP and the subnet of the remote address. Addresses that are
+// not TCP addresses are not limited.
+func (limits *connLimits) keys(remoteAddr net.Addr) (string, string, bool) {
+	addr, ok := remoteAddr.(*net.TCPAddr)
+	if !ok {
+		return "", "", false
+	}
+	subnet, ok := protocol.Subnet(addr, limits.subnetPrefixIPv4, limits.subnetPrefixIPv6)
+	return addr.IP.String(), subnet, ok
+}
@@ -0,0 +1,71 @@
+package tcp
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd socket
+// activation.
+const listenFDsStart = 3
+
+// SystemdListeners returns the listeners passed to the process by systemd
+// socket activation (see sd_listen_fds(3)), in the order they are configured in
+// the socket unit, so that they can be used as the Listeners of a Server. It
+// returns no listeners if the process was not socket activated. The
+// environment variables of socket activation are unset, so that they are not
+// inherited by child processes.
+func SystemdListeners() ([]net.Listener, error) {
+	pid, pidErr := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	n, nErr := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	if pidErr != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	if nErr != nil || n < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS=%v", os.Getenv("LISTEN_FDS"))
+	}
+	files := make([]*os.File, n)
+	for i := range files {
+		name := fmt.Sprintf("LISTEN_FD_%d", listenFDsStart+i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		files[i] = os.NewFile(uintptr(listenFDsStart+i), name)
+	}
+	return FileListeners(files...)
+}
+
+// FileListeners returns the listeners of inherited socket files (e.g. passed
+// by the process that a restarting peer replaces, using the ExtraFiles of an
+// exec.Cmd), so that they can be used as the Listeners of a Server. The files
+// are closed, whether or not an error is returned.
+func FileListeners(files ...*os.File) ([]net.Listener, error) {
+	listeners := make([]net.Listener, 0, len(files))
+	var err error
+	for _, file := range files {
+		if err == nil {
+			var listener net.Listener
+			if listener, err = net.FileListener(file); err == nil {
+				listeners = append(listeners, listener)
+			} else {
+				err = fmt.Errorf("error inheriting listener %v: %v", file.Name(), err)
+			}
+		}
+		file.Close()
+	}
+	if err != nil {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+		return nil, err
+	}
+	return listeners, nil
+}
@@ -0,0 +1,96 @@
+package tcp
+
+import (
+	"sync"
+	"time"
+)
+
+// rateSweepInterval is how often the buckets that are full again are dropped,
+// so that the buckets of peers that have gone away do not accumulate.
+const rateSweepInterval = time.Minute
+
+// rateLimiter is a token bucket for every key (e.g. a remote IP, or a PeerID).
+// Every bucket holds at most burst tokens, and is refilled at rate tokens per
+// second. It is not enforced unless the rate is positive.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu        *sync.Mutex
+	buckets   map[string]*rateBucket
+	lastSweep time.Time
+}
+
+type rateBucket struct {
+	tokens  float64
+	updated time.Time
+	limited bool // True once the bucket has run out, until it is refilled
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst <= 0 {
+		burst = int(rate)
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:  rate,
+		burst: float64(burst),
+
+		mu:        new(sync.Mutex),
+		buckets:   map[string]*rateBucket{},
+		lastSweep: time.Now(),
+	}
+}
+
+// allow takes a token from the bucket of the key. It returns false if the
+// bucket is empty, and also returns true for first when this is the first time
+// that the key is limited since its bucket last had tokens.
+func (limiter *rateLimiter) allow(key string) (ok bool, first bool) {
+	if limiter.rate <= 0 {
+		return true, false
+	}
+
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(limiter.lastSweep) >= rateSweepInterval {
+		limiter.sweepWithoutLock(now)
+	}
+	bucket, exists := limiter.buckets[key]
+	if !exists {
+		bucket = &rateBucket{tokens: limiter.burst, updated: now}
+		limiter.buckets[key] = bucket
+	}
+	limiter.refillWithoutLock(bucket, now)
+	if bucket.tokens < 1 {
+		first = !bucket.limited
+		bucket.limited = true
+		return false, first
+	}
+	bucket.tokens--
+	bucket.limited = false
+	return true, false
+}
+
+func (limiter *rateLimiter) refillWithoutLock(bucket *rateBucket, now time.Time) {
+	bucket.tokens += now.Sub(bucket.updated).Seconds() * limiter.rate
+	if bucket.tokens > limiter.burst {
+		bucket.tokens = limiter.burst
+	}
+	bucket.updated = now
+}
+
+// sweepWithoutLock drops the buckets that are full, because they are the same
+// as new buckets.
+func (limiter *rateLimiter) sweepWithoutLock(now time.Time) {
+	for key, bucket := range limiter.buckets {
+		limiter.refillWithoutLock(bucket, now)
+		if bucket.tokens >= limiter.burst {
+			delete(limiter.buckets, key)
+		}
+	}
+	limiter.lastSweep = now
+}
@@ -4,55 +4,361 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"math/rand"
 	"net"
+	"os"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/renproject/aw/ban"
+	"github.com/renproject/aw/budget"
 	"github.com/renproject/aw/handshake"
+	"github.com/renproject/aw/nat"
 	"github.com/renproject/aw/protocol"
+	"github.com/renproject/phi"
 	"github.com/sirupsen/logrus"
 )
 
+type ClientOptions struct {
+	// Budget is optional. When set, every message that is being sent holds a
+	// goroutine and the bytes of its body in the budget.Outbound subsystem, and
+	// messages are shed, instead of being sent, once the subsystem exceeds the
+	// watermark for their priority.
+	Budget *budget.Budget
+
+	// Inbound is optional. When set, messages are written to the full duplex
+	// connections that the recipients have dialed (e.g. those of a Server with
+	// FullDuplex), and the recipients are only dialed when there are none.
+	Inbound ConnSender
+
+	// Self is optional. When set, messages addressed to it are dropped instead
+	// of being sent, so that the client never dials the server of the local
+	// peer.
+	Self protocol.PeerID
+
+	// Retries is the number of times that a message is sent again, when it
+	// cannot be sent to any of the network addresses of its recipient. Retries
+	// are made after a backoff that starts at the RetryBackoff and doubles
+	// after every retry, up to the MaxRetryBackoff. Messages are not retried
+	// if Retries is negative.
+	Retries         int           // Defaults to 4
+	RetryBackoff    time.Duration // Defaults to 1 second
+	MaxRetryBackoff time.Duration // Defaults to 30 seconds
+
+	// Events is optional. When set, a protocol.EventMessageDropped is sent to
+	// it, without blocking, whenever a message is dropped because it could not
+	// be sent after retrying.
+	Events protocol.EventSender
+
+	// NumWorkers is the number of messages that are sent at the same time by
+	// RunQueue. Messages that have to be retried are retried in the
+	// background, so that unreachable peers do not hold up the workers.
+	NumWorkers int // Defaults to 16
+}
+
+func (options *ClientOptions) setZerosToDefaults() {
+	if options.Retries == 0 {
+		options.Retries = 4
+	}
+	if options.RetryBackoff <= 0 {
+		options.RetryBackoff = time.Second
+	}
+	if options.MaxRetryBackoff <= 0 {
+		options.MaxRetryBackoff = 30 * time.Second
+	}
+	if options.NumWorkers <= 0 {
+		options.NumWorkers = 16
+	}
+}
+
 type Client struct {
-	logger logrus.FieldLogger
-	pool   ConnPool
+	logger  logrus.FieldLogger
+	options ClientOptions
+	pool    ConnPool
 }
 
 func NewClient(logger logrus.FieldLogger, pool ConnPool) *Client {
+	return NewClientWithOptions(ClientOptions{}, logger, pool)
+}
+
+func NewClientWithOptions(options ClientOptions, logger logrus.FieldLogger, pool ConnPool) *Client {
+	options.setZerosToDefaults()
 	return &Client{
-		logger: logger,
-		pool:   pool,
+		logger:  logger,
+		options: options,
+		pool:    pool,
 	}
 }
 
+// Conns returns the state of all connections in the ConnPool of the client.
+// There are none if the ConnPool is not an ExtendedConnPool.
+func (client *Client) Conns() []ConnState {
+	pool, ok := client.pool.(ExtendedConnPool)
+	if !ok {
+		return []ConnState{}
+	}
+	return pool.Conns()
+}
+
+// CloseConn closes the connection in the ConnPool of the client to the remote
+// address. It is not found if the ConnPool is not an ExtendedConnPool.
+func (client *Client) CloseConn(remoteAddr string) error {
+	pool, ok := client.pool.(ExtendedConnPool)
+	if !ok {
+		return ErrConnNotFound
+	}
+	return pool.CloseConn(remoteAddr)
+}
+
+// Redial the connection in the ConnPool of the client to the remote address.
+// It is not found if the ConnPool is not an ExtendedConnPool.
+func (client *Client) Redial(remoteAddr string) error {
+	pool, ok := client.pool.(ExtendedConnPool)
+	if !ok {
+		return ErrConnNotFound
+	}
+	return pool.Redial(remoteAddr)
+}
+
 func (client *Client) Run(ctx context.Context, messages protocol.MessageReceiver) {
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case messageOtw := <-messages:
-			go client.handleMessageOnTheWire(messageOtw)
+			bytes, ok := client.admit(messageOtw)
+			if !ok {
+				continue
+			}
+			go func() {
+				defer client.options.Budget.Release(budget.Outbound, true, bytes)
+				client.handleMessageOnTheWire(ctx, messageOtw)
+			}()
 		}
 	}
 }
 
-func (client *Client) handleMessageOnTheWire(message protocol.MessageOnTheWire) {
-	for i := 0; i < 5; i++ {
-		err := client.pool.Send(message.To.NetworkAddress(), message.Message)
-		if err == nil {
+// RunQueue pops messages from the queue, and sends them with a fixed number of
+// workers, until the context is done. Unlike Run, messages are only popped
+// when a worker is free to send them, so that the backlog of messages waits
+// in the queue, in the order of their priority.
+func (client *Client) RunQueue(ctx context.Context, queue *protocol.MessageQueue) {
+	wg := new(sync.WaitGroup)
+	for i := 0; i < client.options.NumWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				messageOtw, err := queue.Pop(ctx)
+				if err != nil {
+					return
+				}
+				bytes, ok := client.admit(messageOtw)
+				if !ok {
+					continue
+				}
+				if err := client.sendOnce(messageOtw); err != nil {
+					go func() {
+						defer client.options.Budget.Release(budget.Outbound, true, bytes)
+						client.retry(ctx, messageOtw, err)
+					}()
+					continue
+				}
+				client.options.Budget.Release(budget.Outbound, true, bytes)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// admit the message to be sent, and acquire its bytes in the budget. It
+// returns false if the message is addressed to self, or is shed by the budget.
+func (client *Client) admit(messageOtw protocol.MessageOnTheWire) (int, bool) {
+	if client.options.Self != nil && messageOtw.To != nil && messageOtw.To.PeerID().Equal(client.options.Self) {
+		client.logger.Debugf("dropping %v message to self", messageOtw.Message.Variant)
+		return 0, false
+	}
+	bytes := len(messageOtw.Message.Body)
+	if !client.options.Budget.Acquire(budget.Outbound, messageOtw.Message.Variant, true, bytes) {
+		client.logger.Debugf("shedding %v message to %v: outbound budget exceeded", messageOtw.Message.Variant, messageOtw.To)
+		return 0, false
+	}
+	return bytes, true
+}
+
+// handleMessageOnTheWire sends the message to the network addresses of the
+// recipient in order, until it is sent to one of them, and retries with an
+// exponential backoff if it cannot be sent to any of them. The message is
+// dropped once it has been retried the maximum number of times, or the context
+// is done.
+func (client *Client) handleMessageOnTheWire(ctx context.Context, message protocol.MessageOnTheWire) {
+	if err := client.sendOnce(message); err != nil {
+		client.retry(ctx, message, err)
+	}
+}
+
+// sendOnce sends the message to the recipient over an inbound connection, if
+// there is one, or else to its network addresses in order, until it is sent to
+// one of them. It returns the error of the last network address otherwise.
+func (client *Client) sendOnce(message protocol.MessageOnTheWire) error {
+	if client.options.Inbound != nil && message.To != nil {
+		if err := client.options.Inbound.SendTo(message.To.PeerID(), message.Message); err == nil {
+			return nil
+		}
+	}
+	err := fmt.Errorf("no network addresses")
+	for _, netAddr := range protocol.NetworkAddresses(message.To) {
+		if err = client.pool.Send(netAddr, message.Message); err == nil {
+			return nil
+		}
+		client.logger.Debugf("error send %v message to %v: %v", message.Message.Variant, netAddr, err)
+	}
+	return err
+}
+
+// retry the message, after it has been sent once and failed with the error,
+// with an exponential backoff, until it is sent or it has been retried the
+// maximum number of times.
+func (client *Client) retry(ctx context.Context, message protocol.MessageOnTheWire, err error) {
+	backoff := client.options.RetryBackoff
+	for attempts := 1; ; attempts++ {
+		if attempts > client.options.Retries {
+			client.drop(message, attempts, err)
+			return
+		}
+		select {
+		case <-ctx.Done():
+			client.drop(message, attempts, ctx.Err())
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > client.options.MaxRetryBackoff {
+			backoff = client.options.MaxRetryBackoff
+		}
+		if err = client.sendOnce(message); err == nil {
 			return
 		}
-		client.logger.Debugf("error send %v message to %v: %v", message.Message.Variant, message.To.NetworkAddress(), err)
-		time.Sleep(time.Second)
 	}
 }
 
+// drop the message after it could not be sent, and emit a
+// protocol.EventMessageDropped to the Events without blocking, so that a slow
+// reader cannot block the client.
+func (client *Client) drop(message protocol.MessageOnTheWire, attempts int, err error) {
+	client.logger.Debugf("dropping %v message to %v after %v attempts: %v", message.Message.Variant, message.To, attempts, err)
+	if client.options.Events == nil {
+		return
+	}
+	var peerID protocol.PeerID
+	if message.To != nil {
+		peerID = message.To.PeerID()
+	}
+	event := protocol.EventMessageDropped{
+		Time:     time.Now(),
+		PeerID:   peerID,
+		Variant:  message.Message.Variant,
+		Hash:     message.Message.Hash(),
+		Attempts: attempts,
+		Reason:   err.Error(),
+	}
+	select {
+	case client.options.Events <- event:
+	default:
+	}
+}
+
+const (
+	minAcceptBackoff = 5 * time.Millisecond
+	maxAcceptBackoff = time.Second
+)
+
 type ServerOptions struct {
-	Host           string        // Host address
-	Timeout        time.Duration // Timeout when establish a connection
-	RateLimit      time.Duration // Minimum time interval before accepting connection from same peer.
-	MaxConnections int           // Max connections allowed.
+	Host             string                    // Host address
+	Hosts            []string                  // Additional host addresses that are listened on at the same time
+	Timeout          time.Duration             // Timeout when establish a connection
+	RateLimit        time.Duration             // Minimum time interval before accepting connection from same peer.
+	MaxConnections   int                       // Max connections allowed.
+	EncryptionPolicy protocol.EncryptionPolicy // Peers that must only send encrypted messages.
+	Penalty          int                       // Score deducted from peers that exceed decompression limits.
+
+	// Listeners are optional. When set, the server accepts connections from
+	// them instead of listening on the Host and Hosts itself, so that it can
+	// use listeners inherited from systemd socket activation, or from the
+	// process it replaces during a restart (see SystemdListeners and
+	// FileListeners). They are closed when the server stops.
+	Listeners []net.Listener
+
+	// MaxConnectionsPerIP and MaxConnectionsPerSubnet limit the concurrent
+	// connections from a single remote IP, and from a single subnet, so that
+	// one host or provider range cannot take all of the connections. They are
+	// not enforced unless they are positive. Subnets are /24 for IPv4 and /64
+	// for IPv6 by default.
+	MaxConnectionsPerIP     int
+	MaxConnectionsPerSubnet int
+	SubnetPrefixIPv4        int
+	SubnetPrefixIPv6        int
+
+	// ConnectionRate and MessageRate limit the connections accepted from a
+	// single remote IP, and the messages read from a single peer across all
+	// of its connections, to a number per second, with token buckets that
+	// hold up to ConnectionBurst and MessageBurst tokens (they default to the
+	// rate, and to at least one). Connections that exceed the limit are
+	// closed, and messages that exceed it are dropped, so that a flooding
+	// peer cannot take all of the file descriptors or fill the messages. They
+	// are not enforced unless they are positive. Events is optional. When
+	// set, an EventPeerRateLimited is sent to it (without blocking) when a
+	// remote IP or peer starts being limited.
+	ConnectionRate  float64
+	ConnectionBurst int
+	MessageRate     float64
+	MessageBurst    int
+	Events          protocol.EventSender
+
+	// Bans is optional. When set, connections from banned IPs are closed as
+	// soon as they are accepted, and connections from banned peers are closed
+	// after the handshake. Peers whose score falls to -BanThreshold or below
+	// are banned for BanDuration (defaults to 24 hours). Peers are not banned
+	// for their score unless BanThreshold is positive.
+	Bans         ban.List
+	BanThreshold int
+	BanDuration  time.Duration
+
+	// FullDuplex makes the server write to the connections that remote peers
+	// have dialed, when their sessions are full duplex (see SendTo and
+	// handshake.DuplexSession), so that it can reply to the remote peers
+	// without dialing them. Every write must complete within the WriteTimeout
+	// (defaults to 5 seconds), otherwise the connection is closed. Me is
+	// optional. When set, the connections of peers that dial each other at
+	// the same time are deduplicated, so that only one connection between
+	// them survives.
+	FullDuplex   bool
+	WriteTimeout time.Duration
+	Me           protocol.PeerID
+
+	// NAT is optional. When set, the server asks the router of the local
+	// network to forward the port of its first listener from the internet
+	// (see nat.Map), refreshes the mapping while it is running, and deletes
+	// it when it stops. The external address of the server is returned by
+	// ExternalAddr, and is passed to OnExternalAddr whenever it changes, so
+	// that it can be advertised in the PeerAddress of the peer.
+	NAT            nat.Mapper
+	NATLifetime    time.Duration // Defaults to 20 minutes
+	OnExternalAddr func(addr *net.TCPAddr)
+
+	// MaxAcceptErrors is the number of times in a row that accepting a
+	// connection from a listener can fail before the server stops (defaults
+	// to 100). Failures are backed off exponentially, with jitter, from 5
+	// milliseconds up to one second. The server never stops if it is
+	// negative. Failures caused by running out of file descriptors are not
+	// counted, because they pass once connections are closed.
+	MaxAcceptErrors int
+
+	// FDs counts the connections of the server, and pauses accepting them
+	// when the process runs out of file descriptors, closing the connection
+	// that has transferred the fewest bytes to free one. It should be shared
+	// with the ConnPool of the peer (defaults to an FDGuard of its own).
+	FDs *FDGuard
 }
 
 func (options *ServerOptions) setZerosToDefaults() {
@@ -68,16 +374,74 @@ func (options *ServerOptions) setZerosToDefaults() {
 	if options.MaxConnections == 0 {
 		options.MaxConnections = 256
 	}
+	if options.Penalty == 0 {
+		options.Penalty = 100
+	}
+	if options.BanDuration <= 0 {
+		options.BanDuration = 24 * time.Hour
+	}
+	if options.SubnetPrefixIPv4 <= 0 || options.SubnetPrefixIPv4 > 32 {
+		options.SubnetPrefixIPv4 = 24
+	}
+	if options.SubnetPrefixIPv6 <= 0 || options.SubnetPrefixIPv6 > 128 {
+		options.SubnetPrefixIPv6 = 64
+	}
+	if options.WriteTimeout <= 0 {
+		options.WriteTimeout = 5 * time.Second
+	}
+	if options.MaxAcceptErrors == 0 {
+		options.MaxAcceptErrors = 100
+	}
+	if options.FDs == nil {
+		options.FDs = NewFDGuard()
+	}
+}
+
+// serverConn is a connection that has established a session with the server.
+type serverConn struct {
+	conn        meteredConn
+	session     protocol.Session
+	established time.Time
+	writeMu     *sync.Mutex // Only used when the connection is full duplex
 }
 
 type Server struct {
-	logger      logrus.FieldLogger
-	options     ServerOptions
-	handshaker  handshake.Handshaker
-	connections int64
+	logger       logrus.FieldLogger
+	options      ServerOptions
+	handshaker   handshake.Handshaker
+	connections  int64
+	acceptErrors uint64
+	limits       *connLimits
+	connRate     *rateLimiter // Connections by remote IP
+	messageRate  *rateLimiter // Messages by PeerID
 
 	lastConnAttemptsMu *sync.RWMutex
 	lastConnAttempts   map[string]time.Time
+
+	connsMu *sync.RWMutex
+	conns   map[string]serverConn
+	duplex  map[string]duplexConns // Full duplex connections by PeerID
+
+	scoresMu *sync.RWMutex
+	scores   map[string]int
+
+	listenersMu  *sync.Mutex
+	listeners    []net.Listener
+	externalAddr *net.TCPAddr
+
+	// The context and the messages of the running server, that are used to
+	// read the full duplex connections dialed by a ConnPool
+	runMu       *sync.RWMutex
+	runCtx      context.Context
+	runCancel   context.CancelFunc
+	runMessages protocol.MessageSender
+
+	// Handlers of accepted connections, that are drained by Shutdown
+	handlers     *sync.WaitGroup
+	shutdownOnce *sync.Once
+	shutdown     chan struct{} // Closed when the server starts shutting down
+	drainOnce    *sync.Once
+	drained      chan struct{} // Closed when the server has shut down
 }
 
 func NewServer(options ServerOptions, logger logrus.FieldLogger, handshaker handshake.Handshaker) *Server {
@@ -93,48 +457,432 @@ func NewServer(options ServerOptions, logger logrus.FieldLogger, handshaker hand
 		options:     options,
 		handshaker:  handshaker,
 		connections: 0,
+		limits:      newConnLimits(options),
+		connRate:    newRateLimiter(options.ConnectionRate, options.ConnectionBurst),
+		messageRate: newRateLimiter(options.MessageRate, options.MessageBurst),
 
 		lastConnAttemptsMu: new(sync.RWMutex),
 		lastConnAttempts:   map[string]time.Time{},
+
+		connsMu: new(sync.RWMutex),
+		conns:   map[string]serverConn{},
+		duplex:  map[string]duplexConns{},
+
+		scoresMu: new(sync.RWMutex),
+		scores:   map[string]int{},
+
+		listenersMu: new(sync.Mutex),
+
+		runMu: new(sync.RWMutex),
+
+		handlers:     new(sync.WaitGroup),
+		shutdownOnce: new(sync.Once),
+		shutdown:     make(chan struct{}),
+		drainOnce:    new(sync.Once),
+		drained:      make(chan struct{}),
 	}
 }
 
-// Run the server until the context is done. The server will continuously listen
-// for new connections, spawning each one into a background goroutine so that it
-// can be handled concurrently.
-func (server *Server) Run(ctx context.Context, messages protocol.MessageSender) {
-	server.logger.Debugf("server start listening at %v", server.options.Host)
-	listener, err := net.Listen("tcp", server.options.Host)
-	if err != nil {
-		server.logger.Fatalf("failed to listen on %s: %v", server.options.Host, err)
+// Conns returns the state of all connections that have established a session
+// with the server.
+func (server *Server) Conns() []ConnState {
+	server.connsMu.RLock()
+	defer server.connsMu.RUnlock()
+
+	states := make([]ConnState, 0, len(server.conns))
+	for remoteAddr, c := range server.conns {
+		states = append(states, newConnState(remoteAddr, c.session, c.conn.meter, c.established, false))
+	}
+	return states
+}
+
+// CloseConn closes the connection from the remote address. The remote peer has
+// to dial the server again to send it more messages.
+func (server *Server) CloseConn(remoteAddr string) error {
+	server.connsMu.RLock()
+	c, ok := server.conns[remoteAddr]
+	server.connsMu.RUnlock()
+
+	if !ok {
+		return ErrConnNotFound
+	}
+	return c.conn.Close()
+}
+
+// Rejections returns the number of connections that have been rejected because
+// of the connection limits of the server.
+func (server *Server) Rejections() ConnRejections {
+	return server.limits.rejected()
+}
+
+// AcceptErrors returns the number of times that accepting a connection has
+// failed.
+func (server *Server) AcceptErrors() uint64 {
+	return atomic.LoadUint64(&server.acceptErrors)
+}
+
+// FDs returns the usage of file descriptors by the connections of the server,
+// and of any ConnPool that shares its FDGuard.
+func (server *Server) FDs() FDStats {
+	return server.options.FDs.Stats()
+}
+
+// Score returns the score of a peer. Peers start with a score of zero, and are
+// penalised when they misbehave (e.g. by sending compressed messages that
+// exceed the decompression limits). Applications can use the score to decide
+// which peers to ban.
+func (server *Server) Score(peerID protocol.PeerID) int {
+	server.scoresMu.RLock()
+	defer server.scoresMu.RUnlock()
+
+	return server.scores[peerID.String()]
+}
+
+func (server *Server) penalise(peerID protocol.PeerID) {
+	server.scoresMu.Lock()
+	server.scores[peerID.String()] -= server.options.Penalty
+	score := server.scores[peerID.String()]
+	server.scoresMu.Unlock()
+
+	if server.options.Bans == nil || server.options.BanThreshold <= 0 || score > -server.options.BanThreshold {
 		return
 	}
+	now := time.Now()
+	misbehaviour := ban.Ban{
+		PeerID:  peerID.String(),
+		Reason:  ban.ReasonMisbehaviour,
+		Note:    fmt.Sprintf("score=%v", score),
+		Created: now,
+		Expires: now.Add(server.options.BanDuration),
+	}
+	if err := server.options.Bans.Add(misbehaviour); err != nil {
+		server.logger.Errorf("error banning peer=%v: %v", peerID, err)
+	}
+}
+
+// isBanned returns true if the remote address, or the peer if it is not nil,
+// is banned.
+func (server *Server) isBanned(peerID protocol.PeerID, remoteAddr net.Addr) bool {
+	if server.options.Bans == nil {
+		return false
+	}
+	var ip net.IP
+	if addr, ok := remoteAddr.(*net.TCPAddr); ok {
+		ip = addr.IP
+	}
+	if banned, ok := server.options.Bans.IsBanned(peerID, ip); ok {
+		server.logger.Infof("closing connection from %v: banned for %v", remoteAddr, banned.Reason)
+		return true
+	}
+	return false
+}
+
+// ErrAcceptFailing is returned by Listen when accepting connections from one of
+// its listeners has failed MaxAcceptErrors times in a row (e.g. because the
+// listener is broken).
+type ErrAcceptFailing struct {
+	error
+	Addr   net.Addr
+	Errors int
+}
+
+func newErrAcceptFailing(addr net.Addr, failures int, err error) error {
+	return ErrAcceptFailing{
+		error:  fmt.Errorf("error accepting connections at %v: failed %v times in a row: %v", addr, failures, err),
+		Addr:   addr,
+		Errors: failures,
+	}
+}
+
+func (err ErrAcceptFailing) Is(target error) bool {
+	return target == protocol.ErrUnavailable
+}
+
+// Run the server until the context is done, logging the error if it stops
+// before then (see Listen).
+func (server *Server) Run(ctx context.Context, messages protocol.MessageSender) {
+	if err := server.Listen(ctx, messages); err != nil {
+		server.logger.Errorf("tcp server stopped: %v", err)
+	}
+}
+
+// Listen runs the server until the context is done, or until the server has
+// been shut down (see Shutdown). The server will continuously listen for new
+// connections on the Host, and on any additional Hosts (or on its Listeners,
+// when they are set), spawning each one into a background goroutine so that it
+// can be handled concurrently. The connection limits are shared by all of the
+// listeners. It returns ErrAcceptFailing, and closes all of the listeners, if
+// accepting connections from one of them fails too many times in a row.
+func (server *Server) Listen(ctx context.Context, messages protocol.MessageSender) error {
+	if server.isShuttingDown() {
+		return nil
+	}
+	listeners := server.options.Listeners
+	if len(listeners) == 0 {
+		listeners = server.listen()
+		if listeners == nil {
+			return fmt.Errorf("error listening on %v", server.options.Host)
+		}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	for _, listener := range server.options.Listeners {
+		server.logger.Debugf("server start accepting at %v", listener.Addr())
+	}
+	server.listenersMu.Lock()
+	server.listeners = listeners
+	server.listenersMu.Unlock()
+	server.runMu.Lock()
+	server.runCtx, server.runCancel, server.runMessages = ctx, cancel, messages
+	server.runMu.Unlock()
+	if server.options.NAT != nil {
+		if addr, ok := listeners[0].Addr().(*net.TCPAddr); ok {
+			go nat.Map(ctx, nat.Options{Logger: server.logger, Lifetime: server.options.NATLifetime}, server.options.NAT, "tcp", addr.Port, server.mapped)
+		}
+	}
 
 	go func() {
-		// When the context is done, explicitly close the listener so that it
-		// does not block on waiting to accept a new connection.
-		<-ctx.Done()
-		if err := listener.Close(); err != nil {
-			server.logger.Errorf("error closing listener: %v", err)
+		// When the context is done, or the server is shutting down,
+		// explicitly close the listeners so that they do not block on
+		// waiting to accept a new connection.
+		select {
+		case <-ctx.Done():
+		case <-server.shutdown:
 		}
+		for _, listener := range listeners {
+			if err := listener.Close(); err != nil {
+				server.logger.Errorf("error closing listener: %v", err)
+			}
+		}
+	}()
+
+	errs := make([]error, len(listeners))
+	phi.ParForAll(listeners, func(i int) {
+		if errs[i] = server.accept(ctx, listeners[i], messages); errs[i] != nil {
+			// Stop accepting from the other listeners too
+			cancel()
+		}
+	})
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	// The context is not canceled until the connections have been drained,
+	// so that the messages that have already been read are still sent
+	select {
+	case <-ctx.Done():
+	case <-server.drained:
+	}
+	return nil
+}
+
+// Shutdown the server gracefully. It stops accepting connections, and stops
+// reading messages from the connections that have been accepted, but sends the
+// messages that have already been read to the messages of the running server,
+// which must keep being read until Shutdown returns. Once every connection has
+// been drained, or the context is done, the remaining connections are closed,
+// and Listen returns. It returns the error of the context if the connections
+// could not be drained in time. A server that has been shut down cannot be
+// run again.
+func (server *Server) Shutdown(ctx context.Context) error {
+	server.shutdownOnce.Do(func() { close(server.shutdown) })
+	defer server.drainOnce.Do(func() { close(server.drained) })
+
+	// Interrupt the connections that are blocked on reading the next message
+	// (connections that are still handshaking stop once they are
+	// established)
+	server.connsMu.RLock()
+	for _, c := range server.conns {
+		c.conn.SetReadDeadline(time.Now())
+	}
+	server.connsMu.RUnlock()
+
+	drained := make(chan struct{})
+	go func() {
+		server.handlers.Wait()
+		close(drained)
 	}()
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+	}
+
+	server.connsMu.RLock()
+	remaining := len(server.conns)
+	for _, c := range server.conns {
+		c.conn.Close()
+	}
+	server.connsMu.RUnlock()
+	server.runMu.RLock()
+	if server.runCancel != nil {
+		server.runCancel()
+	}
+	server.runMu.RUnlock()
+	server.logger.Warnf("tcp server closed %v connections that were not drained: %v", remaining, ctx.Err())
+	<-drained
+	return ctx.Err()
+}
+
+// isShuttingDown returns true once Shutdown has been called.
+func (server *Server) isShuttingDown() bool {
+	select {
+	case <-server.shutdown:
+		return true
+	default:
+		return false
+	}
+}
+
+// Files returns duplicates of the files of the listeners of the running server,
+// so that they can be handed off to the process that replaces it during a
+// restart (see FileListeners). The caller must close them.
+func (server *Server) Files() ([]*os.File, error) {
+	server.listenersMu.Lock()
+	defer server.listenersMu.Unlock()
+
+	if len(server.listeners) == 0 {
+		return nil, fmt.Errorf("server is not listening")
+	}
+	files := make([]*os.File, 0, len(server.listeners))
+	for _, listener := range server.listeners {
+		fileListener, ok := listener.(interface{ File() (*os.File, error) })
+		if !ok {
+			closeFiles(files)
+			return nil, fmt.Errorf("cannot hand off listener of type %T", listener)
+		}
+		file, err := fileListener.File()
+		if err != nil {
+			closeFiles(files)
+			return nil, fmt.Errorf("error handing off listener %v: %v", listener.Addr(), err)
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// ExternalAddr returns the address that the router of the local network
+// forwards to the server from the internet, or nil if the port of the server
+// has not been mapped (see ServerOptions).
+func (server *Server) ExternalAddr() *net.TCPAddr {
+	server.listenersMu.Lock()
+	defer server.listenersMu.Unlock()
+
+	return server.externalAddr
+}
+
+// mapped is called by nat.Map when the external address of the server changes.
+func (server *Server) mapped(ip net.IP, port int) {
+	addr := &net.TCPAddr{IP: ip, Port: port}
+	server.listenersMu.Lock()
+	server.externalAddr = addr
+	server.listenersMu.Unlock()
+
+	if server.options.OnExternalAddr != nil {
+		server.options.OnExternalAddr(addr)
+	}
+}
+
+func closeFiles(files []*os.File) {
+	for _, file := range files {
+		file.Close()
+	}
+}
+
+// listen on the Host and the Hosts. It returns nil if it cannot listen on all
+// of them.
+func (server *Server) listen() []net.Listener {
+	hosts := append([]string{server.options.Host}, server.options.Hosts...)
+	listeners := make([]net.Listener, 0, len(hosts))
+	for _, host := range hosts {
+		server.logger.Debugf("server start listening at %v", host)
+		listener, err := net.Listen("tcp", host)
+		if err != nil {
+			for _, listener := range listeners {
+				listener.Close()
+			}
+			server.logger.Fatalf("failed to listen on %s: %v", host, err)
+			return nil
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners
+}
 
+// accept connections from the listener until the context is done. When
+// accepting fails, the server backs off before accepting again, and returns
+// ErrAcceptFailing once it has failed MaxAcceptErrors times in a row. When it
+// fails because the process has run out of file descriptors, the server sheds a
+// connection instead, and the failure does not count towards the
+// MaxAcceptErrors.
+func (server *Server) accept(ctx context.Context, listener net.Listener, messages protocol.MessageSender) error {
+	var backoff time.Duration
+	failures := 0
 	for {
+		if !server.options.FDs.wait(ctx) {
+			return nil
+		}
 		conn, err := listener.Accept()
 		if err != nil {
 			select {
 			case <-ctx.Done():
 				// Do not log errors because returning from this canceling a
 				// context is the expected way to terminate the run loop.
-				return
+				return nil
+			case <-server.shutdown:
+				return nil
 			default:
 			}
 
+			atomic.AddUint64(&server.acceptErrors, 1)
+			if isFDExhausted(err) {
+				pause := server.options.FDs.exhaust(time.Now())
+				server.logger.Warnf("tcp server ran out of file descriptors: pausing accepting for %v: %v", pause, err)
+				server.shed()
+				continue
+			}
+			failures++
+			if server.options.MaxAcceptErrors > 0 && failures >= server.options.MaxAcceptErrors {
+				return newErrAcceptFailing(listener.Addr(), failures, err)
+			}
 			server.logger.Errorf("error accepting connection: %v", err)
+			if backoff = 2 * backoff; backoff == 0 {
+				backoff = minAcceptBackoff
+			} else if backoff > maxAcceptBackoff {
+				backoff = maxAcceptBackoff
+			}
+			// Jitter the backoff, so that the listeners do not retry in step
+			jittered := backoff/2 + time.Duration(rand.Int63n(int64(backoff)))
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(jittered):
+			}
+			continue
+		}
+		backoff = 0
+		failures = 0
+		server.options.FDs.recover()
+		conn = server.options.FDs.track(conn)
+		if server.isBanned(nil, conn.RemoteAddr()) {
+			conn.Close()
 			continue
 		}
 		if atomic.LoadInt64(&server.connections) >= int64(server.options.MaxConnections) {
 			server.logger.Info("tcp server reaches max number of connections")
+			server.limits.rejectMaxConnections()
+			conn.Close()
+			continue
+		}
+		if !server.allowConnection(conn.RemoteAddr()) {
+			conn.Close()
+			continue
+		}
+		if !server.limits.acquire(conn.RemoteAddr()) {
+			server.logger.Infof("tcp server reaches max number of connections from %v", conn.RemoteAddr())
 			conn.Close()
 			continue
 		}
@@ -142,19 +890,22 @@ func (server *Server) Run(ctx context.Context, messages protocol.MessageSender)
 
 		// Spawn background goroutine to handle this connection so that it does
 		// not block other connections.
-
+		server.handlers.Add(1)
 		go server.handle(ctx, conn, messages)
 	}
 }
 
-func (server *Server) handle(ctx context.Context, conn net.Conn, messages protocol.MessageSender) {
+func (server *Server) handle(ctx context.Context, rawConn net.Conn, messages protocol.MessageSender) {
+	defer server.handlers.Done()
 	defer atomic.AddInt64(&server.connections, -1)
-	defer conn.Close()
+	defer server.limits.release(rawConn.RemoteAddr())
+	defer rawConn.Close()
 
 	// Reject connections from IP addresses that have attempted to connect too recently.
-	if !server.allowRateLimit(conn) {
+	if !server.allowRateLimit(rawConn) {
 		return
 	}
+	conn := newMeteredConn(rawConn)
 
 	// Attempt to establish a session with the client.
 	now := time.Now()
@@ -167,18 +918,86 @@ func (server *Server) handle(ctx context.Context, conn net.Conn, messages protoc
 		server.logger.Errorf("cannot establish session with %v", conn.RemoteAddr().String())
 		return
 	}
+	peerID := protocol.SessionPeerID(session)
+	if server.isBanned(peerID, conn.RemoteAddr()) {
+		return
+	}
 	server.logger.Debugf("new connection with %v takes %v", conn.RemoteAddr().String(), time.Now().Sub(now))
 
+	remoteAddr := conn.RemoteAddr().String()
+	server.connsMu.Lock()
+	server.conns[remoteAddr] = serverConn{conn: conn, session: session, established: time.Now(), writeMu: new(sync.Mutex)}
+	server.connsMu.Unlock()
+	defer func() {
+		server.connsMu.Lock()
+		delete(server.conns, remoteAddr)
+		server.connsMu.Unlock()
+	}()
+	if server.isShuttingDown() {
+		// The connection was established after Shutdown interrupted the
+		// other connections
+		return
+	}
+
+	if server.options.FullDuplex && handshake.IsDuplex(session) && peerID != nil {
+		server.dedupe(peerID, conn, false)
+		defer server.release(peerID, conn, false)
+	}
+	server.read(ctx, conn, session, messages)
+}
+
+// shed the connection that has transferred the fewest bytes, so that its file
+// descriptor can be used by a more valuable connection.
+func (server *Server) shed() {
+	server.connsMu.RLock()
+	remoteAddrs := make([]string, 0, len(server.conns))
+	meters := make([]*meter, 0, len(server.conns))
+	for remoteAddr, c := range server.conns {
+		remoteAddrs = append(remoteAddrs, remoteAddr)
+		meters = append(meters, c.conn.meter)
+	}
+	server.connsMu.RUnlock()
+
+	i := leastValuable(meters)
+	if i < 0 {
+		return
+	}
+	if err := server.CloseConn(remoteAddrs[i]); err != nil {
+		return
+	}
+	server.options.FDs.shedConn()
+	server.logger.Infof("tcp server shed connection from %v to free a file descriptor", remoteAddrs[i])
+}
+
+// read messages from the connection, and send them to the messages, until the
+// connection is closed or the context is done. Messages are from the remote
+// peer of the session, if it is a protocol.IdentifiedSession, and otherwise
+// from the peer that the session reads.
+func (server *Server) read(ctx context.Context, conn net.Conn, session protocol.Session, messages protocol.MessageSender) {
+	peerID := protocol.SessionPeerID(session)
 	for {
 		messageOtw, err := session.ReadMessageOnTheWire(conn)
 
 		if err != nil {
-			if err != io.EOF {
+			switch err.(type) {
+			case handshake.ErrDecompressedMessageTooLarge, handshake.ErrDecompressionTooSlow:
+				if peerID != nil {
+					server.penalise(peerID)
+				}
+			}
+			if err != io.EOF && !server.isShuttingDown() {
 				server.logger.Errorf("error reading incoming message: %v", err)
 			}
 			server.logger.Info("closing connection: EOF")
 			return
 		}
+		if peerID != nil {
+			messageOtw.From = peerID
+		}
+		messageOtw.Authenticated = true
+		if messageOtw.From != nil && !server.allowMessage(messageOtw.From, conn.RemoteAddr()) {
+			continue
+		}
 
 		select {
 		case <-ctx.Done():
@@ -188,6 +1007,50 @@ func (server *Server) handle(ctx context.Context, conn net.Conn, messages protoc
 	}
 }
 
+// allowConnection returns false if the remote IP has exceeded the
+// ConnectionRate.
+func (server *Server) allowConnection(remoteAddr net.Addr) bool {
+	ip := remoteAddr.String()
+	if addr, ok := remoteAddr.(*net.TCPAddr); ok {
+		ip = addr.IP.String()
+	}
+	ok, first := server.connRate.allow(ip)
+	if ok {
+		return true
+	}
+	server.limits.rejectRateLimited()
+	if first {
+		server.logger.Infof("tcp server rate limits connections from %v", remoteAddr)
+		server.emit(protocol.EventPeerRateLimited{Time: time.Now(), RemoteAddr: remoteAddr.String()})
+	}
+	return false
+}
+
+// allowMessage returns false if the peer has exceeded the MessageRate.
+func (server *Server) allowMessage(peerID protocol.PeerID, remoteAddr net.Addr) bool {
+	ok, first := server.messageRate.allow(peerID.String())
+	if ok {
+		return true
+	}
+	if first {
+		server.logger.Infof("tcp server rate limits messages from peer=%v", peerID)
+		server.emit(protocol.EventPeerRateLimited{Time: time.Now(), PeerID: peerID, RemoteAddr: remoteAddr.String(), Messages: true})
+	}
+	return false
+}
+
+// emit the event to the Events without blocking, so that a slow reader cannot
+// block the server.
+func (server *Server) emit(event protocol.Event) {
+	if server.options.Events == nil {
+		return
+	}
+	select {
+	case server.options.Events <- event:
+	default:
+	}
+}
+
 func (server *Server) allowRateLimit(conn net.Conn) bool {
 	server.lastConnAttemptsMu.Lock()
 	defer server.lastConnAttemptsMu.Unlock()
@@ -224,6 +1087,12 @@ func (server *Server) establishSession(ctx context.Context, conn net.Conn) (prot
 	if err != nil {
 		return nil, fmt.Errorf("bad handshake with %v: %v", conn.RemoteAddr().String(), err)
 	}
+	if session == nil {
+		return nil, nil
+	}
+	if err := server.options.EncryptionPolicy.Check(session); err != nil {
+		return nil, err
+	}
 
 	// Reset the timeout back
 	if err := conn.SetDeadline(time.Time{}); err != nil {
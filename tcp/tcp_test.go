@@ -2,7 +2,11 @@ package tcp_test
 
 import (
 	"context"
+	"errors"
 	"net"
+	"os"
+	"strconv"
+	"syscall"
 	"testing/quick"
 	"time"
 
@@ -13,7 +17,10 @@ import (
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/renproject/aw/ban"
+	"github.com/renproject/aw/handshake"
 	"github.com/renproject/aw/protocol"
+	"github.com/renproject/phi"
 	"github.com/sirupsen/logrus"
 )
 
@@ -61,6 +68,8 @@ var _ = Describe("TCP client and server", func() {
 				message := sendRandomMessage(messageSender, serverAddr)
 				var received protocol.MessageOnTheWire
 				Eventually(messageReceiver, 3*time.Second).Should(Receive(&received))
+				Expect(received.Authenticated).To(BeTrue())
+				Expect(received.From.String()).To(Equal(clientSignVerifier.ID()))
 				return cmp.Equal(message, received.Message, cmpopts.EquateEmpty())
 			}
 
@@ -68,6 +77,204 @@ var _ = Describe("TCP client and server", func() {
 		})
 	})
 
+	Context("when the client is given its own peer id", func() {
+		It("should not send the messages addressed to itself", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			self := NewSimpleTCPPeerAddress(RandomPeerID().String(), "127.0.0.1", "18080")
+			other := NewSimpleTCPPeerAddress(RandomPeerID().String(), "127.0.0.1", "18081")
+			pool := recordingPool{sends: make(chan net.Addr, 2)}
+			messages := make(chan protocol.MessageOnTheWire, 2)
+			go NewClientWithOptions(ClientOptions{Self: self.PeerID()}, logrus.New(), pool).Run(ctx, messages)
+
+			sendRandomMessage(messages, self)
+			sendRandomMessage(messages, other)
+			var to net.Addr
+			Eventually(pool.sends).Should(Receive(&to))
+			Expect(to.String()).To(Equal(other.NetworkAddress().String()))
+			Consistently(pool.sends).ShouldNot(Receive())
+		})
+	})
+
+	Context("when a message cannot be sent", func() {
+		It("should retry it with a backoff and then emit an event when it is dropped", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			to := NewSimpleTCPPeerAddress(RandomPeerID().String(), "127.0.0.1", "18082")
+			pool := recordingPool{sends: make(chan net.Addr, 8), err: errors.New("unreachable")}
+			messages := make(chan protocol.MessageOnTheWire, 1)
+			events := make(chan protocol.Event, 1)
+			options := ClientOptions{Retries: 2, RetryBackoff: 50 * time.Millisecond, Events: events}
+			go NewClientWithOptions(options, logrus.New(), pool).Run(ctx, messages)
+
+			start := time.Now()
+			message := sendRandomMessage(messages, to)
+			var event protocol.Event
+			Eventually(events, 3*time.Second).Should(Receive(&event))
+			// The backoff doubles after every retry
+			Expect(time.Since(start)).To(BeNumerically(">=", 150*time.Millisecond))
+			Expect(pool.sends).To(HaveLen(3))
+			Expect(event).To(Equal(protocol.EventMessageDropped{
+				Time:     event.(protocol.EventMessageDropped).Time,
+				PeerID:   to.PeerID(),
+				Variant:  message.Variant,
+				Hash:     message.Hash(),
+				Attempts: 3,
+				Reason:   "unreachable",
+			}))
+		})
+
+		It("should not retry it when retries are disabled", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			to := NewSimpleTCPPeerAddress(RandomPeerID().String(), "127.0.0.1", "18082")
+			pool := recordingPool{sends: make(chan net.Addr, 8), err: errors.New("unreachable")}
+			messages := make(chan protocol.MessageOnTheWire, 1)
+			events := make(chan protocol.Event, 1)
+			go NewClientWithOptions(ClientOptions{Retries: -1, Events: events}, logrus.New(), pool).Run(ctx, messages)
+
+			sendRandomMessage(messages, to)
+			var event protocol.Event
+			Eventually(events).Should(Receive(&event))
+			Expect(event.(protocol.EventMessageDropped).Attempts).To(Equal(1))
+			Expect(pool.sends).To(HaveLen(1))
+		})
+	})
+
+	Context("when sending messages from a queue", func() {
+		It("should send the messages that wait in a full queue in the order of their priority", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			// The pool blocks every send until it is read, so that messages
+			// wait in the queue
+			pool := recordingPool{sends: make(chan net.Addr)}
+			events := make(chan protocol.Event, 1)
+			queue := protocol.NewMessageQueue(protocol.MessageQueueOptions{Capacity: 2, Events: events})
+			go NewClientWithOptions(ClientOptions{NumWorkers: 1}, logrus.New(), pool).RunQueue(ctx, queue)
+
+			push := func(variant protocol.MessageVariant, port int) protocol.MessageOnTheWire {
+				groupID := protocol.NilGroupID
+				if variant == protocol.Broadcast {
+					groupID = RandomGroupID()
+				}
+				messageOtw := protocol.MessageOnTheWire{
+					To:      NewSimpleTCPPeerAddress(RandomPeerID().String(), "127.0.0.1", strconv.Itoa(port)),
+					Message: protocol.NewMessage(protocol.V1, variant, groupID, RandomMessageBody()),
+				}
+				Expect(queue.Push(ctx, messageOtw)).To(Succeed())
+				return messageOtw
+			}
+			push(protocol.Broadcast, 18100)
+			Eventually(func() int { return queue.Len(protocol.PriorityLow) }).Should(BeZero())
+
+			// The oldest broadcast is dropped when the lane of gossip is full,
+			// and the ping and the cast that are pushed after the broadcasts
+			// are sent before them
+			dropped := push(protocol.Broadcast, 18101)
+			push(protocol.Broadcast, 18102)
+			push(protocol.Broadcast, 18103)
+			push(protocol.Cast, 18104)
+			push(protocol.Ping, 18105)
+			var event protocol.Event
+			Eventually(events).Should(Receive(&event))
+			Expect(event.(protocol.EventMessageDropped).Hash).To(Equal(dropped.Message.Hash()))
+
+			var to net.Addr
+			for _, port := range []int{18100, 18105, 18104, 18102, 18103} {
+				Eventually(pool.sends).Should(Receive(&to))
+				Expect(to.String()).To(Equal("127.0.0.1:" + strconv.Itoa(port)))
+			}
+			Consistently(pool.sends).ShouldNot(Receive())
+		})
+	})
+
+	Context("when the server listens on several hosts", func() {
+		It("should receive messages sent to any of them", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			// Initialize a client
+			clientSignVerifier := NewMockSignVerifier()
+			messageSender := NewTCPClient(ctx, ConnPoolOptions{}, clientSignVerifier)
+
+			// Initialize a server that listens on two hosts
+			options := ServerOptions{Host: "127.0.0.1:8080", Hosts: []string{"127.0.0.1:9090"}, RateLimit: -1}
+			messageReceiver := NewTCPServer(ctx, options, clientSignVerifier)
+
+			// Send a message to each host and expect the server receives them.
+			for _, port := range []string{"8080", "9090"} {
+				message := sendRandomMessage(messageSender, NewSimpleTCPPeerAddress(RandomPeerID().String(), "127.0.0.1", port))
+				var received protocol.MessageOnTheWire
+				Eventually(messageReceiver, 3*time.Second).Should(Receive(&received))
+				Expect(cmp.Equal(message, received.Message, cmpopts.EquateEmpty())).Should(BeTrue())
+			}
+
+			// Send a message to a peer address whose preferred network address
+			// is unreachable, and expect it to be sent to the next one.
+			serverAddr := NewSimpleMultiTCPPeerAddress(RandomPeerID().String(), "127.0.0.1", "10001", "127.0.0.1:9090")
+			message := sendRandomMessage(messageSender, serverAddr)
+			var received protocol.MessageOnTheWire
+			Eventually(messageReceiver, 3*time.Second).Should(Receive(&received))
+			Expect(cmp.Equal(message, received.Message, cmpopts.EquateEmpty())).Should(BeTrue())
+		})
+	})
+
+	Context("when the server is given listeners", func() {
+		It("should accept connections from them instead of listening itself", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			// Initialize a client
+			clientSignVerifier := NewMockSignVerifier()
+			messageSender := NewTCPClient(ctx, ConnPoolOptions{}, clientSignVerifier)
+
+			// Inherit the file of a listener, as if it was passed by another
+			// process
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+			file, err := listener.(*net.TCPListener).File()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(listener.Close()).To(Succeed())
+			listeners, err := FileListeners(file)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(listeners).Should(HaveLen(1))
+
+			// Initialize a server with the inherited listener
+			options := ServerOptions{Host: "127.0.0.1:8080", Listeners: listeners}
+			messageReceiver := NewTCPServer(ctx, options, clientSignVerifier)
+
+			// Send a message to the inherited listener and expect the server
+			// receives it.
+			_, port, err := net.SplitHostPort(listeners[0].Addr().String())
+			Expect(err).NotTo(HaveOccurred())
+			message := sendRandomMessage(messageSender, NewSimpleTCPPeerAddress(RandomPeerID().String(), "127.0.0.1", port))
+			var received protocol.MessageOnTheWire
+			Eventually(messageReceiver, 3*time.Second).Should(Receive(&received))
+			Expect(cmp.Equal(message, received.Message, cmpopts.EquateEmpty())).Should(BeTrue())
+
+			// Expect the server to not listen on its host
+			_, err = net.DialTimeout("tcp", "127.0.0.1:8080", time.Second)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should not inherit listeners from systemd unless they were passed to the process", func() {
+			Expect(os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))).To(Succeed())
+			Expect(os.Setenv("LISTEN_FDS", "1")).To(Succeed())
+			listeners, err := SystemdListeners()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(listeners).Should(BeEmpty())
+			Expect(os.Getenv("LISTEN_FDS")).Should(BeEmpty())
+
+			listeners, err = SystemdListeners()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(listeners).Should(BeEmpty())
+		})
+	})
+
 	Context("when reach max number of connection allowed", func() {
 		It("show reject the connection", func() {
 			ctx, cancel := context.WithCancel(context.Background())
@@ -135,6 +342,631 @@ var _ = Describe("TCP client and server", func() {
 		})
 	})
 
+	Context("when the encryption policy requires encrypted sessions", func() {
+		It("should reject clients with plaintext sessions", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			// Initialize a server that requires encryption with all peers
+			clientSignVerifier := NewMockSignVerifier()
+			serverSignVerifier := NewMockSignVerifier(clientSignVerifier.ID())
+			clientSignVerifier.Whitelist(serverSignVerifier.ID())
+			serverAddr := NewSimpleTCPPeerAddress(RandomPeerID().String(), "", "8080")
+			options := ServerOptions{
+				Host:             serverAddr.NetworkAddress().String(),
+				EncryptionPolicy: protocol.EncryptionPolicy{RequireAll: true},
+			}
+			server := NewServer(options, logrus.New(), handshake.New(serverSignVerifier, handshake.NewInsecureSessionManager()))
+			messageReceiver := make(chan protocol.MessageOnTheWire, 128)
+			go server.Run(ctx, messageReceiver)
+			time.Sleep(50 * time.Millisecond)
+
+			// Expect messages over a plaintext session to be rejected
+			pool := NewConnPool(ConnPoolOptions{}, logrus.New(), handshake.New(clientSignVerifier, handshake.NewInsecureSessionManager()))
+			_ = pool.Send(serverAddr.NetworkAddress(), RandomMessage(protocol.V1, RandomMessageVariant()))
+			Eventually(messageReceiver).ShouldNot(Receive())
+			Expect(server.Conns()).Should(BeEmpty())
+		})
+
+		It("should expose the security state of encrypted sessions", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			// Initialize a server that requires encryption with all peers
+			clientSignVerifier := NewMockSignVerifier()
+			serverSignVerifier := NewMockSignVerifier(clientSignVerifier.ID())
+			clientSignVerifier.Whitelist(serverSignVerifier.ID())
+			serverAddr := NewSimpleTCPPeerAddress(RandomPeerID().String(), "", "8080")
+			options := ServerOptions{
+				Host:             serverAddr.NetworkAddress().String(),
+				EncryptionPolicy: protocol.EncryptionPolicy{RequireAll: true},
+			}
+			server := NewServer(options, logrus.New(), handshake.New(serverSignVerifier, handshake.NewGCMSessionManager()))
+			messageReceiver := make(chan protocol.MessageOnTheWire, 128)
+			go server.Run(ctx, messageReceiver)
+			time.Sleep(50 * time.Millisecond)
+
+			// Expect messages over an encrypted session to be accepted
+			pool := NewConnPool(ConnPoolOptions{}, logrus.New(), handshake.New(clientSignVerifier, handshake.NewGCMSessionManager()))
+			Expect(pool.Send(serverAddr.NetworkAddress(), RandomMessage(protocol.V1, RandomMessageVariant()))).To(Succeed())
+			Eventually(messageReceiver, 3*time.Second).Should(Receive())
+
+			conns := server.Conns()
+			Expect(conns).Should(HaveLen(1))
+			Expect(conns[0].PeerID.String()).Should(Equal(clientSignVerifier.ID()))
+			Expect(conns[0].Encrypted).Should(BeTrue())
+		})
+	})
+
+	Context("when managing connections", func() {
+		It("should list, close and redial the connections", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			clientSignVerifier := NewMockSignVerifier()
+			serverSignVerifier := NewMockSignVerifier(clientSignVerifier.ID())
+			clientSignVerifier.Whitelist(serverSignVerifier.ID())
+			serverAddr := NewSimpleTCPPeerAddress(RandomPeerID().String(), "", "8081")
+			// The client dials the server again straight away, so it must
+			// not be rate limited
+			options := ServerOptions{Host: serverAddr.NetworkAddress().String(), RateLimit: time.Nanosecond}
+			server := NewServer(options, logrus.New(), handshake.New(serverSignVerifier, handshake.NewGCMSessionManager()))
+			messageReceiver := make(chan protocol.MessageOnTheWire, 128)
+			go server.Run(ctx, messageReceiver)
+			time.Sleep(50 * time.Millisecond)
+
+			pool := NewConnPool(ConnPoolOptions{}, logrus.New(), handshake.New(clientSignVerifier, handshake.NewGCMSessionManager()))
+			client := NewClient(logrus.New(), pool)
+			Expect(pool.Send(serverAddr.NetworkAddress(), RandomMessage(protocol.V1, RandomMessageVariant()))).To(Succeed())
+			Eventually(messageReceiver, 3*time.Second).Should(Receive())
+
+			conns := client.Conns()
+			Expect(conns).Should(HaveLen(1))
+			remoteAddr := conns[0].RemoteAddr
+			Expect(conns[0].PeerID.String()).Should(Equal(serverSignVerifier.ID()))
+			Expect(conns[0].Transport).Should(Equal("tcp"))
+			Expect(conns[0].Outbound).Should(BeTrue())
+			Expect(conns[0].Age).Should(BeNumerically(">", 0))
+			Expect(conns[0].BytesOut).Should(BeNumerically(">", 0))
+			Expect(conns[0].BytesIn).Should(BeNumerically(">", 0))
+			conns = server.Conns()
+			Expect(conns).Should(HaveLen(1))
+			Expect(conns[0].PeerID.String()).Should(Equal(clientSignVerifier.ID()))
+			Expect(conns[0].Outbound).Should(BeFalse())
+			Expect(conns[0].BytesIn).Should(BeNumerically(">", 0))
+
+			// Redialing replaces the connection
+			Expect(client.Redial(remoteAddr)).To(Succeed())
+			Expect(client.Conns()).Should(HaveLen(1))
+			Expect(client.Conns()[0].Age).Should(BeNumerically("<", conns[0].Age))
+			Eventually(func() int { return len(server.Conns()) }).Should(Equal(1))
+
+			// Closing the connection removes it from the server
+			Expect(server.CloseConn(server.Conns()[0].RemoteAddr)).To(Succeed())
+			Eventually(func() int { return len(server.Conns()) }).Should(Equal(0))
+			Expect(server.CloseConn(remoteAddr)).To(Equal(ErrConnNotFound))
+
+			Expect(client.CloseConn(remoteAddr)).To(Succeed())
+			Expect(client.Conns()).Should(BeEmpty())
+			Expect(client.CloseConn(remoteAddr)).To(Equal(ErrConnNotFound))
+			Expect(client.Redial(remoteAddr)).To(Equal(ErrConnNotFound))
+		})
+	})
+
+	Context("when connections are full duplex", func() {
+		It("should send messages back on the connection that the remote peer dialed", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			clientSignVerifier := NewMockSignVerifier()
+			serverSignVerifier := NewMockSignVerifier(clientSignVerifier.ID())
+			clientSignVerifier.Whitelist(serverSignVerifier.ID())
+			clientHandshaker := handshake.New(clientSignVerifier, handshake.NewHMACSessionManager(SimplePeerID(clientSignVerifier.ID())))
+			serverHandshaker := handshake.New(serverSignVerifier, handshake.NewHMACSessionManager(SimplePeerID(serverSignVerifier.ID())))
+
+			// The server of the client reads the messages that are sent back
+			// on the connections dialed by the client
+			clientAddr := NewSimpleTCPPeerAddress(clientSignVerifier.ID(), "", "8081")
+			clientServer := NewServer(ServerOptions{Host: clientAddr.NetworkAddress().String(), FullDuplex: true}, logrus.New(), clientHandshaker)
+			clientReceiver := make(chan protocol.MessageOnTheWire, 128)
+			go clientServer.Run(ctx, clientReceiver)
+
+			serverAddr := NewSimpleTCPPeerAddress(serverSignVerifier.ID(), "", "8080")
+			server := NewServer(ServerOptions{Host: serverAddr.NetworkAddress().String(), FullDuplex: true}, logrus.New(), serverHandshaker)
+			serverReceiver := make(chan protocol.MessageOnTheWire, 128)
+			go server.Run(ctx, serverReceiver)
+			time.Sleep(50 * time.Millisecond)
+
+			pool := NewConnPool(ConnPoolOptions{Duplex: clientServer}, logrus.New(), clientHandshaker).(ExtendedConnPool)
+			Expect(pool.Send(serverAddr.NetworkAddress(), RandomMessage(protocol.V1, RandomMessageVariant()))).To(Succeed())
+			Eventually(serverReceiver, 3*time.Second).Should(Receive())
+
+			// The server replies without dialing the client
+			messages := make(chan protocol.MessageOnTheWire, 128)
+			go NewClientWithOptions(ClientOptions{Inbound: server}, logrus.New(), NewConnPool(ConnPoolOptions{}, logrus.New(), serverHandshaker)).Run(ctx, messages)
+			for i := 0; i < 8; i++ {
+				message := RandomMessage(protocol.V1, RandomMessageVariant())
+				messages <- protocol.MessageOnTheWire{To: clientAddr, Message: message}
+
+				var received protocol.MessageOnTheWire
+				Eventually(clientReceiver, 3*time.Second).Should(Receive(&received))
+				Expect(received.Authenticated).To(BeTrue())
+				Expect(received.From.String()).To(Equal(serverSignVerifier.ID()))
+				Expect(cmp.Equal(message, received.Message, cmpopts.EquateEmpty())).To(BeTrue())
+			}
+			Expect(clientServer.Conns()).Should(BeEmpty())
+			Expect(pool.Conns()).Should(HaveLen(1))
+			Expect(pool.Conns()[0].BytesIn).Should(BeNumerically(">", 0))
+
+			// The client can keep sending messages on the same connection
+			Expect(pool.Send(serverAddr.NetworkAddress(), RandomMessage(protocol.V1, RandomMessageVariant()))).To(Succeed())
+			Eventually(serverReceiver, 3*time.Second).Should(Receive())
+			Expect(server.Conns()).Should(HaveLen(1))
+		})
+
+		It("should keep one connection when both peers dial each other at the same time", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			signVerifiers := []MockSignVerifier{NewMockSignVerifier(), NewMockSignVerifier()}
+			signVerifiers[0].Whitelist(signVerifiers[1].ID())
+			signVerifiers[1].Whitelist(signVerifiers[0].ID())
+			if signVerifiers[1].ID() < signVerifiers[0].ID() {
+				signVerifiers[0], signVerifiers[1] = signVerifiers[1], signVerifiers[0]
+			}
+
+			// The first peer has the lower PeerID
+			addrs := make([]protocol.PeerAddress, 2)
+			servers := make([]*Server, 2)
+			pools := make([]ExtendedConnPool, 2)
+			receivers := make([]chan protocol.MessageOnTheWire, 2)
+			senders := make([]chan protocol.MessageOnTheWire, 2)
+			for i, port := range []string{"8080", "8081"} {
+				me := SimplePeerID(signVerifiers[i].ID())
+				handshaker := handshake.New(signVerifiers[i], handshake.NewHMACSessionManager(me))
+				addrs[i] = NewSimpleTCPPeerAddress(me.String(), "", port)
+				servers[i] = NewServer(ServerOptions{Host: addrs[i].NetworkAddress().String(), FullDuplex: true, Me: me}, logrus.New(), handshaker)
+				receivers[i] = make(chan protocol.MessageOnTheWire, 128)
+				go servers[i].Run(ctx, receivers[i])
+				pools[i] = NewConnPool(ConnPoolOptions{Duplex: servers[i]}, logrus.New(), handshaker).(ExtendedConnPool)
+				senders[i] = make(chan protocol.MessageOnTheWire, 128)
+				go NewClientWithOptions(ClientOptions{Inbound: servers[i]}, logrus.New(), pools[i]).Run(ctx, senders[i])
+			}
+			time.Sleep(50 * time.Millisecond)
+
+			// Both peers dial each other
+			phi.ParForAll(2, func(i int) {
+				Expect(pools[i].Send(addrs[1-i].NetworkAddress(), RandomMessage(protocol.V1, RandomMessageVariant()))).To(Succeed())
+			})
+			Eventually(receivers[0], 3*time.Second).Should(Receive())
+			Eventually(receivers[1], 3*time.Second).Should(Receive())
+
+			// Only the connection dialed by the lower PeerID survives
+			Eventually(func() int { return len(pools[1].Conns()) }, 3*time.Second).Should(Equal(0))
+			Eventually(func() int { return len(servers[0].Conns()) }, 3*time.Second).Should(Equal(0))
+			Expect(pools[0].Conns()).Should(HaveLen(1))
+			Expect(servers[1].Conns()).Should(HaveLen(1))
+
+			// Messages are sent in both directions on the connection
+			for i := range senders {
+				message := RandomMessage(protocol.V1, RandomMessageVariant())
+				senders[i] <- protocol.MessageOnTheWire{To: addrs[1-i], Message: message}
+				var received protocol.MessageOnTheWire
+				Eventually(receivers[1-i], 3*time.Second).Should(Receive(&received))
+				Expect(cmp.Equal(message, received.Message, cmpopts.EquateEmpty())).To(BeTrue())
+			}
+			Consistently(func() int { return len(pools[1].Conns()) + len(servers[0].Conns()) }).Should(Equal(0))
+		})
+
+		It("should not send messages back on sessions that are not full duplex", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			clientSignVerifier := NewMockSignVerifier()
+			serverSignVerifier := NewMockSignVerifier(clientSignVerifier.ID())
+			clientSignVerifier.Whitelist(serverSignVerifier.ID())
+			serverAddr := NewSimpleTCPPeerAddress(serverSignVerifier.ID(), "", "8080")
+			server := NewServer(ServerOptions{Host: serverAddr.NetworkAddress().String(), FullDuplex: true}, logrus.New(), handshake.New(serverSignVerifier, handshake.NewGCMSessionManager()))
+			serverReceiver := make(chan protocol.MessageOnTheWire, 128)
+			go server.Run(ctx, serverReceiver)
+			time.Sleep(50 * time.Millisecond)
+
+			pool := NewConnPool(ConnPoolOptions{Duplex: server}, logrus.New(), handshake.New(clientSignVerifier, handshake.NewGCMSessionManager()))
+			Expect(pool.Send(serverAddr.NetworkAddress(), RandomMessage(protocol.V1, RandomMessageVariant()))).To(Succeed())
+			Eventually(serverReceiver, 3*time.Second).Should(Receive())
+
+			peerID := SimplePeerID(clientSignVerifier.ID())
+			Expect(server.SendTo(peerID, RandomMessage(protocol.V1, RandomMessageVariant()))).To(Equal(ErrConnNotFound))
+		})
+	})
+
+	Context("when the server is behind a router", func() {
+		It("should map its port, and advertise the external address", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+
+			mapper := NewMockMapper(net.IPv4(1, 2, 3, 4))
+			external := make(chan *net.TCPAddr, 1)
+			options := ServerOptions{Host: "127.0.0.1:0", NAT: mapper, OnExternalAddr: func(addr *net.TCPAddr) { external <- addr }}
+			server := NewServer(options, logrus.New(), handshake.New(NewMockSignVerifier(), handshake.NewInsecureSessionManager()))
+			Expect(server.ExternalAddr()).To(BeNil())
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				server.Run(ctx, make(chan protocol.MessageOnTheWire, 128))
+			}()
+
+			var addr *net.TCPAddr
+			Eventually(external).Should(Receive(&addr))
+			Expect(addr.IP.Equal(net.IPv4(1, 2, 3, 4))).To(BeTrue())
+			Expect(server.ExternalAddr()).To(Equal(addr))
+			Expect(mapper.Mappings()).To(Equal(map[int]int{addr.Port: addr.Port - 1}))
+
+			// The mapping is deleted when the server stops
+			cancel()
+			Eventually(done).Should(BeClosed())
+			Eventually(mapper.Mappings).Should(BeEmpty())
+		})
+	})
+
+	Context("when the client prefers stream compression", func() {
+		It("should expose the compression of the connection", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			// Initialize a server that accepts snappy compression
+			clientSignVerifier := NewMockSignVerifier()
+			serverSignVerifier := NewMockSignVerifier(clientSignVerifier.ID())
+			clientSignVerifier.Whitelist(serverSignVerifier.ID())
+			serverAddr := NewSimpleTCPPeerAddress(RandomPeerID().String(), "", "8080")
+			options := ServerOptions{Host: serverAddr.NetworkAddress().String()}
+			server := NewServer(options, logrus.New(), handshake.New(serverSignVerifier, handshake.NewGCMSessionManager()))
+			messageReceiver := make(chan protocol.MessageOnTheWire, 128)
+			go server.Run(ctx, messageReceiver)
+			time.Sleep(50 * time.Millisecond)
+
+			// Expect messages over a compressed session to be accepted
+			handshakeOptions := handshake.Options{Compressions: handshake.Compressions{handshake.CompressionSnappy}}
+			pool := NewConnPool(ConnPoolOptions{}, logrus.New(), handshake.NewWithOptions(handshakeOptions, clientSignVerifier, handshake.NewGCMSessionManager())).(ExtendedConnPool)
+			message := RandomMessage(protocol.V1, RandomMessageVariant())
+			Expect(pool.Send(serverAddr.NetworkAddress(), message)).To(Succeed())
+			var received protocol.MessageOnTheWire
+			Eventually(messageReceiver, 3*time.Second).Should(Receive(&received))
+			Expect(cmp.Equal(message, received.Message, cmpopts.EquateEmpty())).Should(BeTrue())
+
+			conns := pool.Conns()
+			Expect(conns).Should(HaveLen(1))
+			Expect(conns[0].Compression).Should(Equal(handshake.CompressionSnappy))
+			Expect(conns[0].CompressionStats.CompressedBytesWritten).Should(BeNumerically(">", 0))
+			conns = server.Conns()
+			Expect(conns).Should(HaveLen(1))
+			Expect(conns[0].Compression).Should(Equal(handshake.CompressionSnappy))
+			Expect(conns[0].CompressionStats.CompressedBytesRead).Should(BeNumerically(">", 0))
+		})
+	})
+
+	Context("when a client exceeds the decompression limits", func() {
+		It("should penalise the client", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			// Initialize a server that only accepts small messages
+			clientSignVerifier := NewMockSignVerifier()
+			serverSignVerifier := NewMockSignVerifier(clientSignVerifier.ID())
+			clientSignVerifier.Whitelist(serverSignVerifier.ID())
+			serverAddr := NewSimpleTCPPeerAddress(RandomPeerID().String(), "", "8080")
+			options := ServerOptions{Host: serverAddr.NetworkAddress().String()}
+			serverHandshakeOptions := handshake.Options{MaxDecompressedMessageLength: 1024}
+			server := NewServer(options, logrus.New(), handshake.NewWithOptions(serverHandshakeOptions, serverSignVerifier, handshake.NewGCMSessionManager()))
+			messageReceiver := make(chan protocol.MessageOnTheWire, 128)
+			go server.Run(ctx, messageReceiver)
+			time.Sleep(50 * time.Millisecond)
+
+			// Expect a large compressed message to be rejected
+			handshakeOptions := handshake.Options{Compressions: handshake.Compressions{handshake.CompressionSnappy}}
+			pool := NewConnPool(ConnPoolOptions{}, logrus.New(), handshake.NewWithOptions(handshakeOptions, clientSignVerifier, handshake.NewGCMSessionManager()))
+			message := protocol.NewMessage(protocol.V1, protocol.Cast, protocol.NilGroupID, make(protocol.MessageBody, 4096))
+			_ = pool.Send(serverAddr.NetworkAddress(), message)
+			Eventually(func() int {
+				return server.Score(SimplePeerID(clientSignVerifier.ID()))
+			}, 3*time.Second).Should(BeNumerically("<", 0))
+			Expect(messageReceiver).ShouldNot(Receive())
+		})
+	})
+
+	Context("when a remote IP or subnet reaches its max number of connections", func() {
+		It("should reject the connection", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			// Initialize a server
+			serverAddr := NewSimpleTCPPeerAddress(RandomPeerID().String(), "", "8080")
+			options := ServerOptions{
+				Host:                    serverAddr.NetworkAddress().String(),
+				RateLimit:               time.Millisecond,
+				MaxConnectionsPerIP:     1,
+				MaxConnectionsPerSubnet: 2,
+			}
+			server := NewServer(options, logrus.New(), handshake.New(NewMockSignVerifier(), handshake.NewGCMSessionManager()))
+			go server.Run(ctx, make(chan protocol.MessageOnTheWire, 128))
+			time.Sleep(50 * time.Millisecond)
+
+			dial := func(ip string) net.Conn {
+				dialer := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(ip)}}
+				conn, err := dialer.Dial("tcp", "127.0.0.1:8080")
+				Expect(err).NotTo(HaveOccurred())
+				return conn
+			}
+			isRejected := func(conn net.Conn) bool {
+				Expect(conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))).To(Succeed())
+				_, err := conn.Read(make([]byte, 1))
+				netErr, ok := err.(net.Error)
+				return !ok || !netErr.Timeout()
+			}
+
+			conn1 := dial("127.0.0.1")
+			defer conn1.Close()
+			Expect(isRejected(conn1)).To(BeFalse())
+
+			// Only one connection is allowed from each IP
+			conn2 := dial("127.0.0.1")
+			defer conn2.Close()
+			Expect(isRejected(conn2)).To(BeTrue())
+			Expect(server.Rejections().PerIP).To(Equal(uint64(1)))
+
+			// Only two connections are allowed from each subnet
+			conn3 := dial("127.0.0.2")
+			defer conn3.Close()
+			Expect(isRejected(conn3)).To(BeFalse())
+			conn4 := dial("127.0.0.3")
+			defer conn4.Close()
+			Expect(isRejected(conn4)).To(BeTrue())
+			Expect(server.Rejections().PerSubnet).To(Equal(uint64(1)))
+
+			// Connections are allowed again once they are closed
+			conn1.Close()
+			Eventually(func() bool {
+				conn := dial("127.0.0.1")
+				defer conn.Close()
+				return isRejected(conn)
+			}).Should(BeFalse())
+		})
+	})
+
+	Context("when a remote IP or peer exceeds its rate limit", func() {
+		It("should reject the connections from the remote IP", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			// Initialize a server that accepts one connection from each IP
+			events := make(chan protocol.Event, 16)
+			serverAddr := NewSimpleTCPPeerAddress(RandomPeerID().String(), "", "8080")
+			options := ServerOptions{
+				Host:            serverAddr.NetworkAddress().String(),
+				RateLimit:       time.Millisecond,
+				ConnectionRate:  0.01,
+				ConnectionBurst: 1,
+				Events:          events,
+			}
+			server := NewServer(options, logrus.New(), handshake.New(NewMockSignVerifier(), handshake.NewGCMSessionManager()))
+			go server.Run(ctx, make(chan protocol.MessageOnTheWire, 128))
+			time.Sleep(50 * time.Millisecond)
+
+			isRejected := func() bool {
+				conn, err := net.Dial("tcp", "127.0.0.1:8080")
+				Expect(err).NotTo(HaveOccurred())
+				defer conn.Close()
+				Expect(conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))).To(Succeed())
+				_, err = conn.Read(make([]byte, 1))
+				netErr, ok := err.(net.Error)
+				return !ok || !netErr.Timeout()
+			}
+			Expect(isRejected()).To(BeFalse())
+			Expect(isRejected()).To(BeTrue())
+			Expect(isRejected()).To(BeTrue())
+			Expect(server.Rejections().RateLimited).To(Equal(uint64(2)))
+
+			// The event is only sent once
+			var event protocol.Event
+			Eventually(events).Should(Receive(&event))
+			Expect(event).To(BeAssignableToTypeOf(protocol.EventPeerRateLimited{}))
+			Expect(event.(protocol.EventPeerRateLimited).PeerID).To(BeNil())
+			Expect(event.(protocol.EventPeerRateLimited).Messages).To(BeFalse())
+			Consistently(events).ShouldNot(Receive())
+		})
+
+		It("should drop the messages of the peer", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			// Initialize a server that reads two messages from each peer
+			events := make(chan protocol.Event, 16)
+			clientSignVerifier := NewMockSignVerifier()
+			serverAddr := NewSimpleTCPPeerAddress(RandomPeerID().String(), "", "8080")
+			options := ServerOptions{
+				Host:         serverAddr.NetworkAddress().String(),
+				RateLimit:    time.Millisecond,
+				MessageRate:  0.01,
+				MessageBurst: 2,
+				Events:       events,
+			}
+			messageReceiver := NewTCPServer(ctx, options, clientSignVerifier)
+
+			messageSender := NewTCPClient(ctx, ConnPoolOptions{}, clientSignVerifier)
+			for i := 0; i < 5; i++ {
+				_ = sendRandomMessage(messageSender, serverAddr)
+			}
+			for i := 0; i < 2; i++ {
+				Eventually(messageReceiver, 3*time.Second).Should(Receive())
+			}
+			Consistently(messageReceiver, 500*time.Millisecond).ShouldNot(Receive())
+
+			var event protocol.Event
+			Eventually(events).Should(Receive(&event))
+			Expect(event).To(BeAssignableToTypeOf(protocol.EventPeerRateLimited{}))
+			Expect(event.(protocol.EventPeerRateLimited).PeerID.Equal(SimplePeerID(clientSignVerifier.ID()))).To(BeTrue())
+			Expect(event.(protocol.EventPeerRateLimited).Messages).To(BeTrue())
+			Consistently(events).ShouldNot(Receive())
+		})
+	})
+
+	Context("when the server is shut down", func() {
+		It("should stop accepting, and send the messages that have already been read", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			clientSignVerifier := NewMockSignVerifier()
+			serverSignVerifier := NewMockSignVerifier(clientSignVerifier.ID())
+			clientSignVerifier.Whitelist(serverSignVerifier.ID())
+			serverAddr := NewSimpleTCPPeerAddress(serverSignVerifier.ID(), "", "18090")
+			options := ServerOptions{Host: serverAddr.NetworkAddress().String()}
+			server := NewServer(options, logrus.New(), handshake.New(serverSignVerifier, handshake.NewGCMSessionManager()))
+
+			// The messages are not buffered, so the message is read by the
+			// server before it is shut down, but not sent until after
+			messages := make(chan protocol.MessageOnTheWire)
+			listenErr := make(chan error, 1)
+			go func() { listenErr <- server.Listen(ctx, messages) }()
+			time.Sleep(50 * time.Millisecond)
+
+			message := sendRandomMessage(NewTCPClient(ctx, ConnPoolOptions{}, clientSignVerifier), serverAddr)
+			Eventually(func() int { return len(server.Conns()) }, 3*time.Second).Should(Equal(1))
+			time.Sleep(100 * time.Millisecond)
+
+			shutdownErr := make(chan error, 1)
+			go func() {
+				shutdownCtx, shutdownCancel := context.WithTimeout(ctx, 3*time.Second)
+				defer shutdownCancel()
+				shutdownErr <- server.Shutdown(shutdownCtx)
+			}()
+			var received protocol.MessageOnTheWire
+			Eventually(messages, 3*time.Second).Should(Receive(&received))
+			Expect(cmp.Equal(message, received.Message, cmpopts.EquateEmpty())).To(BeTrue())
+			Eventually(shutdownErr, 3*time.Second).Should(Receive(BeNil()))
+			Eventually(listenErr).Should(Receive(BeNil()))
+			Expect(server.Conns()).To(BeEmpty())
+
+			_, err := net.Dial("tcp", "127.0.0.1:18090")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should close the connections that are not drained before the context is done", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			clientSignVerifier := NewMockSignVerifier()
+			serverSignVerifier := NewMockSignVerifier(clientSignVerifier.ID())
+			clientSignVerifier.Whitelist(serverSignVerifier.ID())
+			serverAddr := NewSimpleTCPPeerAddress(serverSignVerifier.ID(), "", "18091")
+			options := ServerOptions{Host: serverAddr.NetworkAddress().String()}
+			server := NewServer(options, logrus.New(), handshake.New(serverSignVerifier, handshake.NewGCMSessionManager()))
+
+			// The messages are never read, so the connection cannot be
+			// drained
+			listenErr := make(chan error, 1)
+			go func() { listenErr <- server.Listen(ctx, make(chan protocol.MessageOnTheWire)) }()
+			time.Sleep(50 * time.Millisecond)
+
+			_ = sendRandomMessage(NewTCPClient(ctx, ConnPoolOptions{}, clientSignVerifier), serverAddr)
+			Eventually(func() int { return len(server.Conns()) }, 3*time.Second).Should(Equal(1))
+			time.Sleep(100 * time.Millisecond)
+
+			shutdownCtx, shutdownCancel := context.WithTimeout(ctx, 100*time.Millisecond)
+			defer shutdownCancel()
+			Expect(server.Shutdown(shutdownCtx)).To(Equal(context.DeadlineExceeded))
+			Eventually(listenErr).Should(Receive(BeNil()))
+			Expect(server.Conns()).To(BeEmpty())
+		})
+	})
+
+	Context("when the listener is broken", func() {
+		It("should back off, and stop after too many errors in a row", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			signVerifier := NewMockSignVerifier()
+			listener := &failingListener{err: errors.New("broken listener"), accepts: make(chan struct{}, 1024)}
+			options := ServerOptions{Listeners: []net.Listener{listener}, MaxAcceptErrors: 5}
+			server := NewServer(options, logrus.New(), handshake.New(signVerifier, handshake.NewInsecureSessionManager()))
+
+			start := time.Now()
+			err := server.Listen(ctx, make(chan protocol.MessageOnTheWire))
+			Expect(err).To(BeAssignableToTypeOf(ErrAcceptFailing{}))
+			Expect(err.(ErrAcceptFailing).Errors).To(Equal(5))
+			Expect(errors.Is(err, protocol.ErrUnavailable)).To(BeTrue())
+			Expect(listener.accepts).To(HaveLen(5))
+			Expect(server.AcceptErrors()).To(Equal(uint64(5)))
+
+			// The backoff doubles from 5 milliseconds, with jitter, between
+			// the errors
+			Expect(time.Since(start)).To(BeNumerically(">=", 35*time.Millisecond))
+		})
+	})
+
+	Context("when the process runs out of file descriptors", func() {
+		It("should pause accepting and dialing instead of retrying straight away", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			fds := NewFDGuard()
+			signVerifier := NewMockSignVerifier()
+			listener := &failingListener{
+				err:     &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", syscall.EMFILE)},
+				accepts: make(chan struct{}, 1024),
+			}
+			options := ServerOptions{Listeners: []net.Listener{listener}, FDs: fds}
+			server := NewServer(options, logrus.New(), handshake.New(signVerifier, handshake.NewInsecureSessionManager()))
+			go server.Run(ctx, make(chan protocol.MessageOnTheWire))
+
+			// The server backs off, instead of hot-looping on the listener
+			time.Sleep(500 * time.Millisecond)
+			Expect(len(listener.accepts)).To(BeNumerically(">", 1))
+			Expect(len(listener.accepts)).To(BeNumerically("<", 20))
+			stats := server.FDs()
+			Expect(stats.Exhausted).To(BeNumerically(">", 1))
+			Expect(stats.Open).To(BeZero())
+			Expect(stats.PausedUntil.IsZero()).To(BeFalse())
+
+			// A pool that shares the guard does not dial while it is paused
+			pool := NewConnPool(ConnPoolOptions{FDs: fds}, logrus.New(), handshake.New(signVerifier, handshake.NewInsecureSessionManager()))
+			addr := NewSimpleTCPPeerAddress(RandomPeerID().String(), "", "8080")
+			Eventually(func() error {
+				return pool.Send(addr.NetworkAddress(), RandomMessage(protocol.V1, protocol.Cast))
+			}).Should(Equal(ErrFDsExhausted))
+		})
+	})
+
+	Context("when a peer is banned", func() {
+		It("should reject its connections until the ban is removed", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			// Initialize a server that bans the client
+			clientSignVerifier := NewMockSignVerifier()
+			bans, err := ban.NewList(nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(bans.Add(ban.Ban{PeerID: SimplePeerID(clientSignVerifier.ID()).String()})).To(Succeed())
+			serverAddr := NewSimpleTCPPeerAddress(RandomPeerID().String(), "", "8080")
+			options := ServerOptions{
+				Host:      serverAddr.NetworkAddress().String(),
+				RateLimit: time.Millisecond,
+				Bans:      bans,
+			}
+			messageReceiver := NewTCPServer(ctx, options, clientSignVerifier)
+
+			messageSender := NewTCPClient(ctx, ConnPoolOptions{}, clientSignVerifier)
+			_ = sendRandomMessage(messageSender, serverAddr)
+			Consistently(messageReceiver, 500*time.Millisecond).ShouldNot(Receive())
+
+			// Connections are accepted after the ban is removed
+			Expect(bans.Remove(SimplePeerID(clientSignVerifier.ID()).String(), "")).To(Succeed())
+			messageSender = NewTCPClient(ctx, ConnPoolOptions{}, clientSignVerifier)
+			message := sendRandomMessage(messageSender, serverAddr)
+			var received protocol.MessageOnTheWire
+			Eventually(messageReceiver, 3*time.Second).Should(Receive(&received))
+			Expect(cmp.Equal(message, received.Message, cmpopts.EquateEmpty())).Should(BeTrue())
+		})
+	})
+
 	Context("when an honest server is dialed by a malicious client", func() {
 		Context("when client doesn't do anything in the handshake process", func() {
 			It("should timeout after sometime", func() {
@@ -157,3 +989,39 @@ var _ = Describe("TCP client and server", func() {
 		})
 	})
 })
+
+// recordingPool is a ConnPool that records the addresses that messages are
+// sent to, instead of sending them.
+type recordingPool struct {
+	ConnPool
+	sends chan net.Addr
+	err   error
+}
+
+func (pool recordingPool) Send(to net.Addr, m protocol.Message) error {
+	pool.sends <- to
+	return pool.err
+}
+
+// failingListener is a net.Listener that always fails to accept connections
+// with the same error.
+type failingListener struct {
+	err     error
+	accepts chan struct{}
+}
+
+func (listener *failingListener) Accept() (net.Conn, error) {
+	select {
+	case listener.accepts <- struct{}{}:
+	default:
+	}
+	return nil, listener.err
+}
+
+func (listener *failingListener) Close() error {
+	return nil
+}
+
+func (listener *failingListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
@@ -193,6 +193,35 @@ func (address SimpleTCPPeerAddress) IsNewer(peerAddress protocol.PeerAddress) bo
 	return address.Nonce > peerAddr.Nonce
 }
 
+// SimpleMultiTCPPeerAddress is a SimpleTCPPeerAddress of a peer that also
+// listens on other host addresses.
+type SimpleMultiTCPPeerAddress struct {
+	SimpleTCPPeerAddress
+	Hosts []string `json:"hosts"`
+}
+
+func NewSimpleMultiTCPPeerAddress(id, address, port string, hosts ...string) SimpleMultiTCPPeerAddress {
+	return SimpleMultiTCPPeerAddress{
+		SimpleTCPPeerAddress: NewSimpleTCPPeerAddress(id, address, port),
+		Hosts:                hosts,
+	}
+}
+
+func (address SimpleMultiTCPPeerAddress) NetworkAddresses() []net.Addr {
+	netAddresses := []net.Addr{}
+	if netAddress := address.NetworkAddress(); netAddress != nil {
+		netAddresses = append(netAddresses, netAddress)
+	}
+	for _, host := range address.Hosts {
+		netAddress, err := net.ResolveTCPAddr("tcp", host)
+		if err != nil {
+			continue
+		}
+		netAddresses = append(netAddresses, netAddress)
+	}
+	return netAddresses
+}
+
 func Remove(addrs protocol.PeerAddresses, i int) protocol.PeerAddresses {
 	clonedAddrs := ClonePeerAddresses(addrs)
 	return append(clonedAddrs[:i], clonedAddrs[i+1:]...)
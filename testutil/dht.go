@@ -1,8 +1,11 @@
 package testutil
 
 import (
+	"context"
+	"fmt"
 	"math/rand"
 
+	"github.com/renproject/aw/crypto"
 	"github.com/renproject/aw/dht"
 	"github.com/renproject/aw/protocol"
 	"github.com/renproject/kv"
@@ -18,6 +21,16 @@ func NewDHT(address protocol.PeerAddress, store kv.Table, bootstrapAddresses pro
 	return dht
 }
 
+// NewExtendedDHT creates a new ExtendedDHT with given PeerAddress.
+func NewExtendedDHT(address protocol.PeerAddress, store kv.Table, bootstrapAddresses protocol.PeerAddresses) dht.ExtendedDHT {
+	codec := NewSimpleTCPPeerAddressCodec()
+	dht, err := dht.NewWithOptions(dht.Options{}, address, codec, store, bootstrapAddresses...)
+	if err != nil {
+		panic(err)
+	}
+	return dht
+}
+
 func NewTable(name string) kv.Table {
 	db := kv.NewMemDB(kv.JSONCodec)
 	return kv.NewTable(db, name)
@@ -46,3 +59,82 @@ func NewGroup(dht dht.DHT) (protocol.GroupID, protocol.PeerAddresses, error) {
 	err := dht.AddGroup(groupID, ids)
 	return groupID, addrs, err
 }
+
+// MockAddressFinder is a protocol.AddressFinder that finds the addresses it
+// contains, and adds them to the DHT when they are found.
+type MockAddressFinder struct {
+	DHT   dht.DHT
+	Addrs protocol.PeerAddresses
+}
+
+// FindNode implements the protocol.AddressFinder interface.
+func (finder MockAddressFinder) FindNode(ctx context.Context, target protocol.PeerID) (protocol.PeerAddress, error) {
+	for _, addr := range finder.Addrs {
+		if addr.PeerID().Equal(target) {
+			_, err := finder.DHT.UpdatePeerAddress(addr)
+			return addr, err
+		}
+	}
+	return nil, fmt.Errorf("cannot find peer=%v", target)
+}
+
+// A DHTNode is a peer that stores records in a network of DHTNodes (e.g.
+// provider and value records).
+type DHTNode struct {
+	Addr         SimpleTCPPeerAddress
+	SignVerifier protocol.SignVerifier
+	DHT          dht.DHT
+	Messages     chan protocol.MessageOnTheWire
+}
+
+// NewDHTNode returns a DHTNode with a new Ed25519 identity and the given port.
+func NewDHTNode(port int) DHTNode {
+	privKey, err := crypto.GenerateEd25519Key()
+	if err != nil {
+		panic(err)
+	}
+	signVerifier := crypto.NewEd25519SignVerifier(privKey)
+	addr := NewSimpleTCPPeerAddress(signVerifier.ID().String(), "127.0.0.1", fmt.Sprintf("%d", port))
+	return DHTNode{
+		Addr:         addr,
+		SignVerifier: signVerifier,
+		DHT:          NewDHT(addr, NewTable(fmt.Sprintf("dht-%d", port)), nil),
+		Messages:     make(chan protocol.MessageOnTheWire, 128),
+	}
+}
+
+// ConnectDHTNodes adds every DHTNode to the DHTs of the others, and routes the
+// messages sent by the DHTNodes until the context is done. Every message is
+// handled by calling the function with the index of the DHTNode it is sent to.
+func ConnectDHTNodes(ctx context.Context, nodes []DHTNode, handle func(ctx context.Context, to int, from protocol.PeerID, message protocol.Message)) {
+	for i := range nodes {
+		for j := range nodes {
+			if i != j {
+				if err := nodes[i].DHT.AddPeerAddress(nodes[j].Addr); err != nil {
+					panic(err)
+				}
+			}
+		}
+	}
+
+	byID := map[string]int{}
+	for i, node := range nodes {
+		byID[node.Addr.ID.String()] = i
+	}
+	for _, from := range nodes {
+		go func(from DHTNode) {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case messageOtw := <-from.Messages:
+					to, ok := byID[messageOtw.To.PeerID().String()]
+					if !ok {
+						continue
+					}
+					handle(ctx, to, from.Addr.ID, messageOtw.Message)
+				}
+			}
+		}(from)
+	}
+}
@@ -3,18 +3,27 @@ package testutil
 import (
 	"math"
 	"math/rand"
+	"time"
 
 	"github.com/renproject/aw/protocol"
 )
 
 func InvalidMessageVersion() protocol.MessageVersion {
 	version := protocol.V1
-	for version == protocol.V1 {
+	for protocol.ValidateMessageVersion(version) == nil {
 		version = protocol.MessageVersion(rand.Intn(math.MaxUint16))
 	}
 	return version
 }
 
+func RandomHasher() protocol.Hasher {
+	allHashers := []protocol.Hasher{
+		protocol.SHA256,
+		protocol.BLAKE3,
+	}
+	return allHashers[rand.Intn(len(allHashers))]
+}
+
 func InvalidMessageVariant(validVariants ...protocol.MessageVariant) protocol.MessageVariant {
 	variant := protocol.MessageVariant(rand.Intn(math.MaxUint16))
 	valid := func(v protocol.MessageVariant) bool {
@@ -56,6 +65,19 @@ func RandomMessageVariant() protocol.MessageVariant {
 		protocol.Cast,
 		protocol.Multicast,
 		protocol.Broadcast,
+		protocol.CatchUp,
+		protocol.FindNode,
+		protocol.Nodes,
+		protocol.Provide,
+		protocol.FindProviders,
+		protocol.Providers,
+		protocol.PutValue,
+		protocol.GetValue,
+		protocol.Value,
+		protocol.BroadcastAck,
+		protocol.Nack,
+		protocol.QueryPeers,
+		protocol.AnswerPeers,
 	}
 	return allVariants[rand.Intn(len(allVariants))]
 }
@@ -64,15 +86,27 @@ func RandomMessage(version protocol.MessageVersion, variant protocol.MessageVari
 	body := RandomMessageBody()
 	groupID := protocol.NilGroupID
 	length := 8
-	if variant == protocol.Multicast || variant == protocol.Broadcast {
+	if variant == protocol.Multicast || variant == protocol.Broadcast || variant == protocol.CatchUp {
 		groupID = RandomGroupID()
 		length = 40
 	}
+	hasher := protocol.Hasher(0)
+	deadline := time.Time{}
+	if version == protocol.V2 || version == protocol.V3 {
+		hasher = RandomHasher()
+		length++
+	}
+	if version == protocol.V3 {
+		deadline = time.Unix(0, 1+rand.Int63n(math.MaxInt64-1))
+		length += 8
+	}
 	return protocol.Message{
-		Length:  protocol.MessageLength(length + len(body)),
-		Version: version,
-		Variant: variant,
-		GroupID: groupID,
-		Body:    body,
+		Length:   protocol.MessageLength(length + len(body)),
+		Version:  version,
+		Variant:  variant,
+		Hasher:   hasher,
+		Deadline: deadline,
+		GroupID:  groupID,
+		Body:     body,
 	}
 }
@@ -0,0 +1,73 @@
+package testutil
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// MockMapper is a nat.Mapper that maps every internal port to the next
+// external port, and records the mappings that it has.
+type MockMapper struct {
+	mu       *sync.Mutex
+	ip       net.IP
+	mappings map[int]int
+	adds     int
+}
+
+func NewMockMapper(ip net.IP) *MockMapper {
+	return &MockMapper{mu: new(sync.Mutex), ip: ip, mappings: map[int]int{}}
+}
+
+func (mapper *MockMapper) ExternalIP() (net.IP, error) {
+	mapper.mu.Lock()
+	defer mapper.mu.Unlock()
+	return mapper.ip, nil
+}
+
+func (mapper *MockMapper) AddMapping(protocol string, externalPort, internalPort int, name string, lifetime time.Duration) (int, error) {
+	mapper.mu.Lock()
+	defer mapper.mu.Unlock()
+	mapper.adds++
+	mapper.mappings[internalPort+1] = internalPort
+	return internalPort + 1, nil
+}
+
+func (mapper *MockMapper) DeleteMapping(protocol string, externalPort, internalPort int) error {
+	mapper.mu.Lock()
+	defer mapper.mu.Unlock()
+	delete(mapper.mappings, externalPort)
+	return nil
+}
+
+func (mapper *MockMapper) String() string {
+	return "mock"
+}
+
+// SetExternalIP changes the IP that is returned by ExternalIP, as if the
+// router was given a new IP.
+func (mapper *MockMapper) SetExternalIP(ip net.IP) {
+	mapper.mu.Lock()
+	defer mapper.mu.Unlock()
+	mapper.ip = ip
+}
+
+// Mappings returns the external ports that are mapped, and the internal ports
+// that they are mapped to.
+func (mapper *MockMapper) Mappings() map[int]int {
+	mapper.mu.Lock()
+	defer mapper.mu.Unlock()
+	mappings := make(map[int]int, len(mapper.mappings))
+	for external, internal := range mapper.mappings {
+		mappings[external] = internal
+	}
+	return mappings
+}
+
+// Adds returns the number of mappings that have been added, including the ones
+// that were refreshed.
+func (mapper *MockMapper) Adds() int {
+	mapper.mu.Lock()
+	defer mapper.mu.Unlock()
+	return mapper.adds
+}
@@ -0,0 +1,297 @@
+package udp
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/renproject/aw/protocol"
+	"github.com/sirupsen/logrus"
+)
+
+// maxDatagramSize is the largest payload of a UDP datagram.
+const maxDatagramSize = 65507
+
+// isUDP returns true if the network is "udp", "udp4" or "udp6".
+func isUDP(network string) bool {
+	return network == "udp" || network == "udp4" || network == "udp6"
+}
+
+// ClientOptions are used to parameterise the behaviour of a Client.
+type ClientOptions struct {
+	Me             protocol.PeerID           // PeerID of the peer that sends the messages.
+	MaxMessageSize int                       // Largest datagram that is sent, in bytes.
+	Variants       []protocol.MessageVariant // Variants of the messages that are sent over UDP.
+}
+
+func (options *ClientOptions) setZerosToDefaults() {
+	// Datagrams that are larger than the MTU of the path are fragmented, and
+	// are lost if any of their fragments is lost, so the default leaves room
+	// for the IP and UDP headers within the minimum MTU of IPv6
+	if options.MaxMessageSize <= 0 {
+		options.MaxMessageSize = 1200
+	}
+	if options.MaxMessageSize > maxDatagramSize {
+		options.MaxMessageSize = maxDatagramSize
+	}
+	if options.Variants == nil {
+		options.Variants = []protocol.MessageVariant{protocol.Ping, protocol.Pong, protocol.Broadcast}
+	}
+}
+
+// A Client sends messages in UDP datagrams, so that latency-sensitive messages
+// (e.g. pings, and small broadcasts) are not held up by establishing, and
+// handshaking, a connection. Delivery is best-effort: datagrams are neither
+// acknowledged nor retried, and they are neither encrypted nor authenticated,
+// so Servers only know the PeerID that is claimed by the sender.
+//
+// Messages are sent over UDP if their variant is one of the Variants, if they
+// fit in a datagram of MaxMessageSize bytes, and if one of the network
+// addresses of the recipient is a "udp" address. Otherwise, they are given to
+// the fallback Client (e.g. a tcp.Client), or dropped if the fallback Client is
+// nil.
+type Client struct {
+	logger   logrus.FieldLogger
+	options  ClientOptions
+	fallback protocol.Client
+
+	// The encoded PeerID that is prepended to every datagram
+	from     []byte
+	variants map[protocol.MessageVariant]bool
+}
+
+// NewClient returns a Client that sends messages from the PeerID in the
+// options, which is encoded using the codec.
+func NewClient(options ClientOptions, logger logrus.FieldLogger, codec protocol.PeerIDCodec, fallback protocol.Client) *Client {
+	if logger == nil {
+		logger = logrus.New()
+	}
+	options.setZerosToDefaults()
+	if codec == nil {
+		panic("codec cannot be nil")
+	}
+	if options.Me == nil {
+		panic("me cannot be nil")
+	}
+	from, err := encodePeerID(codec, options.Me)
+	if err != nil {
+		panic(fmt.Sprintf("cannot encode me: %v", err))
+	}
+	variants := make(map[protocol.MessageVariant]bool, len(options.Variants))
+	for _, variant := range options.Variants {
+		variants[variant] = true
+	}
+	return &Client{
+		logger:   logger,
+		options:  options,
+		fallback: fallback,
+
+		from:     from,
+		variants: variants,
+	}
+}
+
+// Run the client until the context is done. Datagrams are sent from a socket
+// that is bound to a random port. If the socket cannot be opened, every
+// message is given to the fallback Client.
+func (client *Client) Run(ctx context.Context, messages protocol.MessageReceiver) {
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		client.logger.Errorf("error opening udp socket: %v", err)
+	} else {
+		defer conn.Close()
+	}
+
+	var fallback chan protocol.MessageOnTheWire
+	if client.fallback != nil {
+		fallback = make(chan protocol.MessageOnTheWire, cap(messages))
+		go client.fallback.Run(ctx, fallback)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case messageOtw := <-messages:
+			if conn != nil && client.send(conn, messageOtw) {
+				continue
+			}
+			if fallback == nil {
+				client.logger.Debugf("dropping %v message to %v: cannot be sent over udp", messageOtw.Message.Variant, messageOtw.To)
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case fallback <- messageOtw:
+			}
+		}
+	}
+}
+
+// send the message to the first "udp" network address of the recipient that
+// it can be written to. It returns false if the message cannot be sent over
+// UDP.
+func (client *Client) send(conn *net.UDPConn, message protocol.MessageOnTheWire) bool {
+	if !client.variants[message.Message.Variant] {
+		return false
+	}
+	data, err := encodeDatagram(client.from, message.Message)
+	if err != nil {
+		client.logger.Debugf("error sending %v message to %v: %v", message.Message.Variant, message.To, err)
+		return false
+	}
+	if len(data) > client.options.MaxMessageSize {
+		return false
+	}
+
+	for _, netAddr := range protocol.NetworkAddresses(message.To) {
+		if !isUDP(netAddr.Network()) {
+			continue
+		}
+		udpAddr, err := net.ResolveUDPAddr(netAddr.Network(), netAddr.String())
+		if err != nil {
+			client.logger.Debugf("error sending %v message to %v: %v", message.Message.Variant, netAddr, err)
+			continue
+		}
+		if _, err := conn.WriteToUDP(data, udpAddr); err != nil {
+			client.logger.Debugf("error sending %v message to %v: %v", message.Message.Variant, netAddr, err)
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// ServerOptions are used to parameterise the behaviour of a Server.
+type ServerOptions struct {
+	Host           string // Host address
+	MaxMessageSize int    // Largest datagram that is read, in bytes.
+}
+
+func (options *ServerOptions) setZerosToDefaults() {
+	if options.Host == "" {
+		options.Host = "127.0.0.1:19231"
+	}
+	if options.MaxMessageSize <= 0 || options.MaxMessageSize > maxDatagramSize {
+		options.MaxMessageSize = maxDatagramSize
+	}
+}
+
+// A Server reads the messages that are sent by Clients in UDP datagrams. The
+// From of the messages is the PeerID claimed by the sender, so they are not
+// Authenticated. Datagrams that cannot be decoded are dropped.
+type Server struct {
+	logger  logrus.FieldLogger
+	options ServerOptions
+	codec   protocol.PeerIDCodec
+}
+
+// NewServer returns a Server that decodes the PeerIDs of senders using the
+// codec.
+func NewServer(options ServerOptions, logger logrus.FieldLogger, codec protocol.PeerIDCodec) *Server {
+	if logger == nil {
+		logger = logrus.New()
+	}
+	options.setZerosToDefaults()
+	if codec == nil {
+		panic("codec cannot be nil")
+	}
+	return &Server{
+		logger:  logger,
+		options: options,
+		codec:   codec,
+	}
+}
+
+// Run the server until the context is done, reading datagrams from the Host.
+func (server *Server) Run(ctx context.Context, messages protocol.MessageSender) {
+	conn, err := net.ListenPacket("udp", server.options.Host)
+	if err != nil {
+		server.logger.Errorf("failed to listen on %s: %v", server.options.Host, err)
+		return
+	}
+	go func() {
+		// When the context is done, explicitly close the socket so that it
+		// does not block on waiting to read a datagram.
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	// Datagrams that are larger than the buffer are truncated, so the buffer
+	// is one byte larger than the largest datagram that is read, to tell them
+	// apart
+	buf := make([]byte, server.options.MaxMessageSize+1)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
+			server.logger.Errorf("error reading datagram: %v", err)
+			continue
+		}
+		if n > server.options.MaxMessageSize {
+			server.logger.Debugf("dropping datagram from %v: expected length<=%v", addr, server.options.MaxMessageSize)
+			continue
+		}
+		messageOtw, err := decodeDatagram(server.codec, buf[:n])
+		if err != nil {
+			server.logger.Debugf("dropping datagram from %v: %v", addr, err)
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case messages <- messageOtw:
+		}
+	}
+}
+
+// encodePeerID encodes the PeerID, and prefixes it with its length.
+func encodePeerID(codec protocol.PeerIDCodec, peerID protocol.PeerID) ([]byte, error) {
+	data, err := codec.Encode(peerID)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > 0xFFFF {
+		return nil, fmt.Errorf("expected peer id length<=%v, got length=%v", 0xFFFF, len(data))
+	}
+	from := make([]byte, 2, 2+len(data))
+	binary.LittleEndian.PutUint16(from, uint16(len(data)))
+	return append(from, data...), nil
+}
+
+// encodeDatagram returns a datagram with the encoded PeerID of the sender,
+// followed by the message.
+func encodeDatagram(from []byte, message protocol.Message) ([]byte, error) {
+	data, err := message.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return append(append(make([]byte, 0, len(from)+len(data)), from...), data...), nil
+}
+
+func decodeDatagram(codec protocol.PeerIDCodec, data []byte) (protocol.MessageOnTheWire, error) {
+	if len(data) < 2 {
+		return protocol.MessageOnTheWire{}, fmt.Errorf("expected length>=2, got length=%v", len(data))
+	}
+	n := int(binary.LittleEndian.Uint16(data))
+	data = data[2:]
+	if len(data) < n {
+		return protocol.MessageOnTheWire{}, fmt.Errorf("expected peer id length<=%v, got length=%v", len(data), n)
+	}
+	from, err := codec.Decode(data[:n])
+	if err != nil {
+		return protocol.MessageOnTheWire{}, fmt.Errorf("error decoding peer id: %v", err)
+	}
+	message := protocol.Message{}
+	if err := message.UnmarshalBinary(data[n:]); err != nil {
+		return protocol.MessageOnTheWire{}, fmt.Errorf("error decoding message: %v", err)
+	}
+	return protocol.MessageOnTheWire{From: from, Message: message}, nil
+}
@@ -0,0 +1,154 @@
+package udp_test
+
+import (
+	"context"
+	"net"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/testutil"
+	. "github.com/renproject/aw/udp"
+
+	"github.com/renproject/aw/protocol"
+	"github.com/sirupsen/logrus"
+)
+
+// udpPeerAddress is the address of a peer that reads datagrams at a UDP
+// address.
+type udpPeerAddress struct {
+	SimpleTCPPeerAddress
+	Addr *net.UDPAddr
+}
+
+func (address udpPeerAddress) NetworkAddress() net.Addr {
+	return address.Addr
+}
+
+// fallbackClient is a protocol.Client that forwards the messages it is given.
+type fallbackClient chan protocol.MessageOnTheWire
+
+func (client fallbackClient) Run(ctx context.Context, messages protocol.MessageReceiver) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case message := <-messages:
+			client <- message
+		}
+	}
+}
+
+var _ = Describe("UDP client and server", func() {
+	freeAddress := func() *net.UDPAddr {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+		return conn.LocalAddr().(*net.UDPAddr)
+	}
+
+	// run a server at a free address, and a client with a fallback Client. It
+	// returns the channels that messages are sent to, and received from, and
+	// the address of the server.
+	run := func(ctx context.Context, me protocol.PeerID, fallback protocol.Client) (chan protocol.MessageOnTheWire, chan protocol.MessageOnTheWire, udpPeerAddress) {
+		serverAddr := freeAddress()
+		server := NewServer(ServerOptions{Host: serverAddr.String()}, logrus.New(), SimplePeerIDCodec{})
+		client := NewClient(ClientOptions{Me: me}, logrus.New(), SimplePeerIDCodec{}, fallback)
+		outbound := make(chan protocol.MessageOnTheWire, 16)
+		inbound := make(chan protocol.MessageOnTheWire, 16)
+		go server.Run(ctx, inbound)
+		go client.Run(ctx, outbound)
+		time.Sleep(50 * time.Millisecond)
+
+		to := udpPeerAddress{
+			SimpleTCPPeerAddress: NewSimpleTCPPeerAddress(RandomPeerID().String(), "", ""),
+			Addr:                 serverAddr,
+		}
+		return outbound, inbound, to
+	}
+
+	Context("when initializing a client or a server", func() {
+		It("should panic if providing a nil codec, or no PeerID", func() {
+			Expect(func() {
+				_ = NewClient(ClientOptions{Me: RandomPeerID()}, logrus.New(), nil, nil)
+			}).Should(Panic())
+			Expect(func() {
+				_ = NewClient(ClientOptions{}, logrus.New(), SimplePeerIDCodec{}, nil)
+			}).Should(Panic())
+			Expect(func() {
+				_ = NewServer(ServerOptions{}, logrus.New(), nil)
+			}).Should(Panic())
+		})
+	})
+
+	Context("when sending a small ping", func() {
+		It("should be received by the server with the claimed PeerID", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			me := RandomPeerID()
+			outbound, inbound, to := run(ctx, me, nil)
+			for _, version := range []protocol.MessageVersion{protocol.V1, protocol.V2, protocol.V3} {
+				message := RandomMessage(version, protocol.Ping)
+				outbound <- protocol.MessageOnTheWire{To: to, Message: message}
+
+				var received protocol.MessageOnTheWire
+				Eventually(inbound).Should(Receive(&received))
+				Expect(received.From).To(Equal(me))
+				Expect(received.Authenticated).To(BeFalse())
+				Expect(received.Message.Variant).To(Equal(protocol.Ping))
+				Expect(received.Message.Hash()).To(Equal(message.Hash()))
+			}
+		})
+	})
+
+	Context("when a message cannot be sent over UDP", func() {
+		It("should give it to the fallback client", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			fallback := make(fallbackClient, 16)
+			outbound, inbound, to := run(ctx, RandomPeerID(), fallback)
+
+			// Variants that are not sent over UDP by default
+			cast := protocol.MessageOnTheWire{To: to, Message: RandomMessage(protocol.V1, protocol.Cast)}
+			outbound <- cast
+			Eventually(fallback).Should(Receive(Equal(cast)))
+
+			// Messages that do not fit in a datagram
+			large := protocol.MessageOnTheWire{To: to, Message: protocol.NewMessage(protocol.V1, protocol.Ping, protocol.NilGroupID, make([]byte, 2048))}
+			outbound <- large
+			Eventually(fallback).Should(Receive(Equal(large)))
+
+			// Peers that do not have a UDP address
+			tcpOnly := protocol.MessageOnTheWire{To: RandomAddress(), Message: RandomMessage(protocol.V1, protocol.Ping)}
+			outbound <- tcpOnly
+			Eventually(fallback).Should(Receive(Equal(tcpOnly)))
+
+			Consistently(inbound).ShouldNot(Receive())
+		})
+	})
+
+	Context("when the server reads malformed datagrams", func() {
+		It("should drop them, and keep reading", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			outbound, inbound, to := run(ctx, RandomPeerID(), nil)
+			conn, err := net.DialUDP("udp", nil, to.Addr)
+			Expect(err).NotTo(HaveOccurred())
+			defer conn.Close()
+			for _, datagram := range [][]byte{{}, {0xFF}, {0xFF, 0xFF, 0x01}, {0x00, 0x00, 0x01, 0x02}, RandomBytes(64)} {
+				_, err := conn.Write(datagram)
+				Expect(err).NotTo(HaveOccurred())
+			}
+			Consistently(inbound).ShouldNot(Receive())
+
+			message := RandomMessage(protocol.V1, protocol.Pong)
+			outbound <- protocol.MessageOnTheWire{To: to, Message: message}
+			var received protocol.MessageOnTheWire
+			Eventually(inbound).Should(Receive(&received))
+			Expect(received.Message.Body).To(Equal(message.Body))
+		})
+	})
+})
@@ -0,0 +1,225 @@
+package value
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/renproject/aw/protocol"
+)
+
+// A Record stores a value under a key. Records are signed by their publisher,
+// so that they cannot be forged by the peers that replicate them, and expire
+// so that the values of publishers that leave the network are eventually
+// forgotten. Publishers increment the Seq of a key whenever they put a new
+// value.
+type Record struct {
+	Key       string
+	Value     []byte
+	Publisher protocol.PeerAddress
+	Seq       uint64
+	Expires   time.Time
+	Signature []byte
+}
+
+// Expired returns true if the record has expired at the given time.
+func (record Record) Expired(now time.Time) bool {
+	return !now.Before(record.Expires)
+}
+
+// A Validator checks the records of a namespace. The namespace of a key is its
+// first path segment, so that "/names/alice" is in the "names" namespace.
+type Validator interface {
+	// Validate returns an error if the record is not valid in the namespace.
+	// The signature of the record has already been verified.
+	Validate(record Record) error
+
+	// Select returns the index of the best of the valid records of the same
+	// key.
+	Select(records []Record) int
+}
+
+// SelectLatest returns the index of the record with the greatest Seq. Records
+// with the same Seq are ordered by their expiry.
+func SelectLatest(records []Record) int {
+	best := 0
+	for i, record := range records {
+		if record.Seq > records[best].Seq || (record.Seq == records[best].Seq && record.Expires.After(records[best].Expires)) {
+			best = i
+		}
+	}
+	return best
+}
+
+// OwnerValidator only accepts records whose key is owned by their publisher,
+// which means that the second path segment of the key is the PeerID of the
+// publisher (e.g. "/names/<PeerID>"). The latest record is selected.
+type OwnerValidator struct{}
+
+// Validate implements the Validator interface.
+func (OwnerValidator) Validate(record Record) error {
+	segments := strings.SplitN(strings.TrimPrefix(record.Key, "/"), "/", 3)
+	if len(segments) < 2 || segments[1] != record.Publisher.PeerID().String() {
+		return fmt.Errorf("key=%v is not owned by peer=%v", record.Key, record.Publisher.PeerID())
+	}
+	return nil
+}
+
+// Select implements the Validator interface.
+func (OwnerValidator) Select(records []Record) int {
+	return SelectLatest(records)
+}
+
+// Namespace returns the namespace of a key, or an error if the key does not
+// start with a namespace.
+func Namespace(key string) (string, error) {
+	if !strings.HasPrefix(key, "/") {
+		return "", fmt.Errorf("key=%v does not start with /", key)
+	}
+	namespace := strings.SplitN(key[1:], "/", 2)[0]
+	if namespace == "" {
+		return "", fmt.Errorf("key=%v does not have a namespace", key)
+	}
+	return namespace, nil
+}
+
+// newRecord returns a record that is signed by the SignVerifier of the
+// publisher.
+func newRecord(signVerifier protocol.SignVerifier, codec protocol.PeerAddressCodec, key string, value []byte, publisher protocol.PeerAddress, seq uint64, expires time.Time) (Record, error) {
+	record := Record{
+		Key:       key,
+		Value:     value,
+		Publisher: publisher,
+		Seq:       seq,
+		Expires:   time.Unix(expires.Unix(), 0),
+	}
+	digest, err := record.digest(signVerifier, codec)
+	if err != nil {
+		return Record{}, err
+	}
+	if record.Signature, err = signVerifier.Sign(digest); err != nil {
+		return Record{}, fmt.Errorf("error signing record: %v", err)
+	}
+	return record, nil
+}
+
+// verify returns an error if the record is not signed by its publisher, or if
+// it has expired.
+func (record Record) verify(signVerifier protocol.SignVerifier, codec protocol.PeerAddressCodec, now time.Time) error {
+	if record.Expired(now) {
+		return fmt.Errorf("record of key=%v expired at %v", record.Key, record.Expires)
+	}
+	digest, err := record.digest(signVerifier, codec)
+	if err != nil {
+		return err
+	}
+	signer, err := signVerifier.Verify(digest, record.Signature)
+	if err != nil {
+		return fmt.Errorf("error verifying record of key=%v: %v", record.Key, err)
+	}
+	if signer == nil || signer.String() != record.Publisher.PeerID().String() {
+		return fmt.Errorf("record of key=%v published by peer=%v is signed by peer=%v", record.Key, record.Publisher.PeerID(), signer)
+	}
+	return nil
+}
+
+func (record Record) digest(signVerifier protocol.SignVerifier, codec protocol.PeerAddressCodec) ([]byte, error) {
+	buffer := new(bytes.Buffer)
+	if err := marshalUnsignedRecord(buffer, codec, record); err != nil {
+		return nil, err
+	}
+	return signVerifier.Hash(buffer.Bytes()), nil
+}
+
+func marshalUnsignedRecord(buffer *bytes.Buffer, codec protocol.PeerAddressCodec, record Record) error {
+	publisher, err := codec.Encode(record.Publisher)
+	if err != nil {
+		return fmt.Errorf("error encoding publisher: %v", err)
+	}
+	if err := writeBytes(buffer, []byte(record.Key)); err != nil {
+		return fmt.Errorf("error marshaling key: %v", err)
+	}
+	if err := writeBytes(buffer, record.Value); err != nil {
+		return fmt.Errorf("error marshaling value: %v", err)
+	}
+	if err := writeBytes(buffer, publisher); err != nil {
+		return fmt.Errorf("error marshaling publisher: %v", err)
+	}
+	if err := binary.Write(buffer, binary.LittleEndian, record.Seq); err != nil {
+		return fmt.Errorf("error marshaling seq: %v", err)
+	}
+	if err := binary.Write(buffer, binary.LittleEndian, record.Expires.Unix()); err != nil {
+		return fmt.Errorf("error marshaling expiry: %v", err)
+	}
+	return nil
+}
+
+func marshalRecord(buffer *bytes.Buffer, codec protocol.PeerAddressCodec, record Record) error {
+	if err := marshalUnsignedRecord(buffer, codec, record); err != nil {
+		return err
+	}
+	if err := writeBytes(buffer, record.Signature); err != nil {
+		return fmt.Errorf("error marshaling signature: %v", err)
+	}
+	return nil
+}
+
+func unmarshalRecord(buffer *bytes.Buffer, codec protocol.PeerAddressCodec) (Record, error) {
+	key, err := readBytes(buffer)
+	if err != nil {
+		return Record{}, fmt.Errorf("error unmarshaling key: %v", err)
+	}
+	value, err := readBytes(buffer)
+	if err != nil {
+		return Record{}, fmt.Errorf("error unmarshaling value: %v", err)
+	}
+	data, err := readBytes(buffer)
+	if err != nil {
+		return Record{}, fmt.Errorf("error unmarshaling publisher: %v", err)
+	}
+	publisher, err := codec.Decode(data)
+	if err != nil {
+		return Record{}, fmt.Errorf("error decoding publisher: %v", err)
+	}
+	seq := uint64(0)
+	if err := binary.Read(buffer, binary.LittleEndian, &seq); err != nil {
+		return Record{}, fmt.Errorf("error unmarshaling seq: %v", err)
+	}
+	expires := int64(0)
+	if err := binary.Read(buffer, binary.LittleEndian, &expires); err != nil {
+		return Record{}, fmt.Errorf("error unmarshaling expiry: %v", err)
+	}
+	sig, err := readBytes(buffer)
+	if err != nil {
+		return Record{}, fmt.Errorf("error unmarshaling signature: %v", err)
+	}
+	return Record{
+		Key:       string(key),
+		Value:     value,
+		Publisher: publisher,
+		Seq:       seq,
+		Expires:   time.Unix(expires, 0),
+		Signature: sig,
+	}, nil
+}
+
+func writeBytes(buffer *bytes.Buffer, data []byte) error {
+	if err := binary.Write(buffer, binary.LittleEndian, uint32(len(data))); err != nil {
+		return err
+	}
+	_, err := buffer.Write(data)
+	return err
+}
+
+func readBytes(buffer *bytes.Buffer) ([]byte, error) {
+	length := uint32(0)
+	if err := binary.Read(buffer, binary.LittleEndian, &length); err != nil {
+		return nil, err
+	}
+	if int(length) > buffer.Len() {
+		return nil, fmt.Errorf("expected len<=%v, got len=%v", buffer.Len(), length)
+	}
+	return buffer.Next(int(length)), nil
+}
@@ -0,0 +1,592 @@
+package value
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/renproject/aw/dht"
+	"github.com/renproject/aw/protocol"
+	"github.com/sirupsen/logrus"
+)
+
+// A Store puts and gets values in the network. Value records are stored at
+// the peers whose PeerIDs are the closest to the key (see dht.Distance), and
+// that is where they are looked for. Every key must be in a namespace that has
+// a Validator.
+type Store interface {
+	// Run republishes the records published by this peer, replicates the
+	// records of other publishers that are stored at this peer, and removes
+	// the expired records, until the context is done.
+	protocol.Runner
+
+	// Stats returns the ReplicationStats of the last republishing or
+	// replication round.
+	Stats() dht.ReplicationStats
+
+	// PutValue signs a record with the value of the key, and stores it at
+	// this peer and at the peers closest to the key.
+	PutValue(ctx context.Context, key string, value []byte) error
+
+	// GetValue returns the best value of the key that is known by this peer,
+	// or by the peers closest to the key that respond before the timeout. It
+	// returns an ErrValueNotFound if there is no such value.
+	GetValue(ctx context.Context, key string) ([]byte, error)
+
+	// AcceptPutValue from a peer and store its record, if it is better than
+	// the record stored at this peer.
+	AcceptPutValue(ctx context.Context, from protocol.PeerID, message protocol.Message) error
+
+	// AcceptGetValue from a peer and send it the record of the key that is
+	// stored at this peer.
+	AcceptGetValue(ctx context.Context, from protocol.PeerID, message protocol.Message) error
+
+	// AcceptValue from a peer that was asked for the record of a key.
+	AcceptValue(ctx context.Context, from protocol.PeerID, message protocol.Message) error
+}
+
+// Options are used to parameterise the behaviour of a Store.
+type Options struct {
+	Logger        logrus.FieldLogger
+	K             int                  // Number of closest peers that store, and are asked for, records, defaults to 20
+	TTL           time.Duration        // Time until a record expires, defaults to 24 hours
+	Timeout       time.Duration        // Time to wait for the responses when getting a value, defaults to 1 second
+	PruneInterval time.Duration        // Time between removing expired records, defaults to 1 minute
+	MaxRecords    int                  // Number of records stored at this peer, defaults to 10000
+	Validators    map[string]Validator // Validators of the namespaces
+
+	RepublishInterval   time.Duration // Time between republishing the records of this peer, defaults to half of the TTL
+	ReplicationInterval time.Duration // Time between replicating the records of other peers, defaults to 1 hour
+}
+
+func (options *Options) setZerosToDefaults() {
+	if options.Logger == nil {
+		options.Logger = logrus.New()
+	}
+	if options.K <= 0 {
+		options.K = 20
+	}
+	if options.TTL <= 0 {
+		options.TTL = 24 * time.Hour
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = time.Second
+	}
+	if options.RepublishInterval <= 0 || options.RepublishInterval >= options.TTL {
+		options.RepublishInterval = options.TTL / 2
+	}
+	if options.ReplicationInterval <= 0 {
+		options.ReplicationInterval = time.Hour
+	}
+	if options.PruneInterval <= 0 {
+		options.PruneInterval = time.Minute
+	}
+	if options.MaxRecords <= 0 {
+		options.MaxRecords = 10000
+	}
+	if options.Validators == nil {
+		options.Validators = map[string]Validator{}
+	}
+}
+
+type store struct {
+	logger       logrus.FieldLogger
+	options      Options
+	dht          dht.ExtendedDHT
+	messages     protocol.MessageSender
+	signVerifier protocol.SignVerifier
+	codec        protocol.PeerAddressCodec
+	readiness    protocol.Readiness
+	replicator   *dht.Replicator
+	lookups      *dht.Lookups
+
+	mu      *sync.Mutex
+	records map[string]Record
+}
+
+// NewStore returns a Store that signs and verifies records using the given
+// SignVerifier, and sends PutValue, GetValue and Value messages using the
+// given MessageSender.
+func NewStore(options Options, table dht.DHT, messages protocol.MessageSender, signVerifier protocol.SignVerifier, codec protocol.PeerAddressCodec) Store {
+	options.setZerosToDefaults()
+	extended := dht.Extend(table)
+	return &store{
+		logger:       options.Logger,
+		options:      options,
+		dht:          extended,
+		messages:     messages,
+		signVerifier: signVerifier,
+		codec:        codec,
+		readiness:    protocol.NewReadiness(),
+		replicator:   dht.NewReplicator(options.K, extended, messages, protocol.PutValue),
+		lookups:      dht.NewLookups(),
+
+		mu:      new(sync.Mutex),
+		records: map[string]Record{},
+	}
+}
+
+func (store *store) Run(ctx context.Context) error {
+	pruneTicker := time.NewTicker(store.options.PruneInterval)
+	defer pruneTicker.Stop()
+	republishTicker := time.NewTicker(store.options.RepublishInterval)
+	defer republishTicker.Stop()
+	replicationTicker := time.NewTicker(store.options.ReplicationInterval)
+	defer replicationTicker.Stop()
+
+	store.readiness.Signal()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-pruneTicker.C:
+			store.prune()
+		case <-republishTicker.C:
+			store.prune()
+			store.republish(ctx)
+		case <-replicationTicker.C:
+			store.prune()
+			store.replicateAll(ctx)
+		}
+	}
+}
+
+func (store *store) Ready() <-chan struct{} {
+	return store.readiness.Ready()
+}
+
+func (store *store) Stats() dht.ReplicationStats {
+	return store.replicator.Stats()
+}
+
+// prune the expired records stored at this peer.
+func (store *store) prune() {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	now := time.Now()
+	for key, record := range store.records {
+		if record.Expired(now) {
+			delete(store.records, key)
+		}
+	}
+}
+
+// republish the records published by this peer with a new expiry, unless they
+// have been replaced by the records of other peers.
+func (store *store) republish(ctx context.Context) {
+	if store.signVerifier == nil {
+		return
+	}
+	me := store.dht.Me()
+	store.mu.Lock()
+	records := []Record{}
+	for _, record := range store.records {
+		if record.Publisher.PeerID().Equal(me.PeerID()) {
+			records = append(records, record)
+		}
+	}
+	store.mu.Unlock()
+
+	store.replicator.Round(len(records), func(i int) int {
+		record := records[i]
+		republished, err := newRecord(store.signVerifier, store.codec, record.Key, record.Value, me, record.Seq, time.Now().Add(store.options.TTL))
+		if err == nil {
+			err = store.store(republished)
+		}
+		factor := 0
+		if err == nil {
+			factor, err = store.replicate(ctx, republished)
+		}
+		if err != nil {
+			store.logger.Errorf("error republishing value record of key=%v: %v", record.Key, err)
+		}
+		return factor
+	})
+}
+
+// replicateAll sends the records of other publishers that are stored at this
+// peer to the peers closest to their keys, so that the records survive when
+// the peers that stored them leave the network.
+func (store *store) replicateAll(ctx context.Context) {
+	me := store.dht.Me().PeerID()
+	store.mu.Lock()
+	records := []Record{}
+	for _, record := range store.records {
+		if !record.Publisher.PeerID().Equal(me) {
+			records = append(records, record)
+		}
+	}
+	store.mu.Unlock()
+
+	store.replicator.Round(len(records), func(i int) int {
+		factor, err := store.replicate(ctx, records[i])
+		if err != nil {
+			store.logger.Errorf("error replicating value record of key=%v: %v", records[i].Key, err)
+		}
+		return factor
+	})
+}
+
+func (store *store) PutValue(ctx context.Context, key string, value []byte) error {
+	if store.signVerifier == nil {
+		return newErrPuttingValue(fmt.Errorf("nil sign verifier"), key)
+	}
+
+	seq := uint64(0)
+	store.mu.Lock()
+	if record, ok := store.records[key]; ok {
+		seq = record.Seq + 1
+	}
+	store.mu.Unlock()
+
+	record, err := newRecord(store.signVerifier, store.codec, key, value, store.dht.Me(), seq, time.Now().Add(store.options.TTL))
+	if err != nil {
+		return newErrPuttingValue(err, key)
+	}
+	if err := store.validate(record); err != nil {
+		return newErrPuttingValue(err, key)
+	}
+	if err := store.store(record); err != nil {
+		return newErrPuttingValue(err, key)
+	}
+	if _, err := store.replicate(ctx, record); err != nil {
+		return newErrPuttingValue(err, key)
+	}
+	return nil
+}
+
+// replicate a record at the peers closest to its key. It returns the number of
+// peers that the record was sent to.
+func (store *store) replicate(ctx context.Context, record Record) (int, error) {
+	buffer := new(bytes.Buffer)
+	if err := marshalRecord(buffer, store.codec, record); err != nil {
+		return 0, err
+	}
+	return store.replicator.Replicate(ctx, record.Key, record.Publisher.PeerID(), buffer.Bytes())
+}
+
+func (store *store) GetValue(ctx context.Context, key string) ([]byte, error) {
+	validator, err := store.validator(key)
+	if err != nil {
+		return nil, newErrGettingValue(err, key)
+	}
+	closest, err := store.dht.ClosestPeerAddresses(dht.KeyID(key), store.options.K)
+	if err != nil {
+		return nil, newErrGettingValue(err, key)
+	}
+	me, err := store.codec.Encode(store.dht.Me())
+	if err != nil {
+		return nil, newErrGettingValue(err, key)
+	}
+	buffer := new(bytes.Buffer)
+	if err := writeBytes(buffer, []byte(key)); err != nil {
+		return nil, newErrGettingValue(err, key)
+	}
+	if err := writeBytes(buffer, me); err != nil {
+		return nil, newErrGettingValue(err, key)
+	}
+
+	l, err := store.lookups.Ask(ctx, store.messages, key, closest, protocol.GetValue, buffer.Bytes())
+	if err != nil {
+		return nil, newErrGettingValue(err, key)
+	}
+	defer l.Close()
+
+	records := []Record{}
+	store.mu.Lock()
+	if record, ok := store.records[key]; ok && !record.Expired(time.Now()) {
+		records = append(records, record)
+	}
+	store.mu.Unlock()
+	l.Wait(ctx, store.options.Timeout, func(resp dht.LookupResponse) {
+		records = append(records, resp.Records.([]Record)...)
+	})
+
+	if len(records) == 0 {
+		return nil, newErrValueNotFound(key)
+	}
+	return records[validator.Select(records)].Value, nil
+}
+
+func (store *store) AcceptPutValue(ctx context.Context, from protocol.PeerID, message protocol.Message) error {
+	// Pre-condition checks
+	if message.Version != protocol.V1 {
+		return protocol.NewErrMessageVersionIsNotSupported(message.Version)
+	}
+	if message.Variant != protocol.PutValue {
+		return protocol.NewErrMessageVariantIsNotSupported(message.Variant)
+	}
+
+	buffer := bytes.NewBuffer(message.Body)
+	record, err := unmarshalRecord(buffer, store.codec)
+	if err != nil {
+		return newErrAcceptingPutValue(err)
+	}
+	if buffer.Len() != 0 {
+		return newErrAcceptingPutValue(fmt.Errorf("%v trailing bytes", buffer.Len()))
+	}
+	// Records can be replicated by any peer, because they are signed by their
+	// publisher.
+	if err := store.validate(record); err != nil {
+		return newErrAcceptingPutValue(err)
+	}
+	if err := store.store(record); err != nil {
+		return newErrAcceptingPutValue(err)
+	}
+	return nil
+}
+
+func (store *store) AcceptGetValue(ctx context.Context, from protocol.PeerID, message protocol.Message) error {
+	// Pre-condition checks
+	if message.Version != protocol.V1 {
+		return protocol.NewErrMessageVersionIsNotSupported(message.Version)
+	}
+	if message.Variant != protocol.GetValue {
+		return protocol.NewErrMessageVariantIsNotSupported(message.Variant)
+	}
+
+	buffer := bytes.NewBuffer(message.Body)
+	key, err := readBytes(buffer)
+	if err != nil {
+		return newErrAcceptingGetValue(fmt.Errorf("error unmarshaling key: %v", err))
+	}
+	data, err := readBytes(buffer)
+	if err != nil {
+		return newErrAcceptingGetValue(fmt.Errorf("error unmarshaling address: %v", err))
+	}
+	if buffer.Len() != 0 {
+		return newErrAcceptingGetValue(fmt.Errorf("%v trailing bytes", buffer.Len()))
+	}
+	requester, err := store.codec.Decode(data)
+	if err != nil {
+		return newErrAcceptingGetValue(fmt.Errorf("error decoding address: %v", err))
+	}
+	// Responses are only sent to the authenticated sender, so that the Store
+	// cannot be used to send messages to arbitrary addresses.
+	if from == nil || !requester.PeerID().Equal(from) {
+		return newErrAcceptingGetValue(fmt.Errorf("address of peer=%v sent by peer=%v", requester.PeerID(), from))
+	}
+
+	store.mu.Lock()
+	record, ok := store.records[string(key)]
+	store.mu.Unlock()
+
+	response := new(bytes.Buffer)
+	if err := writeBytes(response, key); err != nil {
+		return newErrAcceptingGetValue(err)
+	}
+	if ok && !record.Expired(time.Now()) {
+		if err := binary.Write(response, binary.LittleEndian, uint32(1)); err != nil {
+			return newErrAcceptingGetValue(err)
+		}
+		if err := marshalRecord(response, store.codec, record); err != nil {
+			return newErrAcceptingGetValue(err)
+		}
+	} else {
+		if err := binary.Write(response, binary.LittleEndian, uint32(0)); err != nil {
+			return newErrAcceptingGetValue(err)
+		}
+	}
+
+	messageWire := protocol.MessageOnTheWire{
+		To:      requester,
+		Message: protocol.NewMessage(protocol.V1, protocol.Value, protocol.NilGroupID, response.Bytes()),
+	}
+	select {
+	case <-ctx.Done():
+		return newErrAcceptingGetValue(ctx.Err())
+	case store.messages <- messageWire:
+		return nil
+	}
+}
+
+func (store *store) AcceptValue(ctx context.Context, from protocol.PeerID, message protocol.Message) error {
+	// Pre-condition checks
+	if message.Version != protocol.V1 {
+		return protocol.NewErrMessageVersionIsNotSupported(message.Version)
+	}
+	if message.Variant != protocol.Value {
+		return protocol.NewErrMessageVariantIsNotSupported(message.Variant)
+	}
+	if from == nil {
+		return newErrAcceptingValue(fmt.Errorf("unknown sender"))
+	}
+
+	buffer := bytes.NewBuffer(message.Body)
+	key, err := readBytes(buffer)
+	if err != nil {
+		return newErrAcceptingValue(fmt.Errorf("error unmarshaling key: %v", err))
+	}
+	numRecords := uint32(0)
+	if err := binary.Read(buffer, binary.LittleEndian, &numRecords); err != nil {
+		return newErrAcceptingValue(fmt.Errorf("error unmarshaling number of records: %v", err))
+	}
+	if numRecords > 1 {
+		return newErrAcceptingValue(fmt.Errorf("expected at most 1 record, got %v", numRecords))
+	}
+	records := make([]Record, 0, numRecords)
+	for i := uint32(0); i < numRecords; i++ {
+		record, err := unmarshalRecord(buffer, store.codec)
+		if err != nil {
+			return newErrAcceptingValue(err)
+		}
+		records = append(records, record)
+	}
+	if buffer.Len() != 0 {
+		return newErrAcceptingValue(fmt.Errorf("%v trailing bytes", buffer.Len()))
+	}
+
+	if !store.lookups.Awaiting(string(key), from) {
+		return nil
+	}
+	// Records that are invalid, or for another key, are dropped.
+	valid := make([]Record, 0, len(records))
+	for _, record := range records {
+		if record.Key != string(key) {
+			continue
+		}
+		if err := store.validate(record); err != nil {
+			store.logger.Warnf("dropping value record from peer=%v: %v", from, err)
+			continue
+		}
+		valid = append(valid, record)
+	}
+	store.lookups.Respond(string(key), from, valid)
+	return nil
+}
+
+// validate returns an error if the record is not signed by its publisher, has
+// expired, expires after the TTL, or is not valid in its namespace.
+func (store *store) validate(record Record) error {
+	if store.signVerifier == nil {
+		return fmt.Errorf("nil sign verifier")
+	}
+	validator, err := store.validator(record.Key)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if err := record.verify(store.signVerifier, store.codec, now); err != nil {
+		return err
+	}
+	if record.Expires.After(now.Add(store.options.TTL)) {
+		return fmt.Errorf("record of key=%v expires after the ttl", record.Key)
+	}
+	return validator.Validate(record)
+}
+
+func (store *store) validator(key string) (Validator, error) {
+	namespace, err := Namespace(key)
+	if err != nil {
+		return nil, err
+	}
+	validator, ok := store.options.Validators[namespace]
+	if !ok {
+		return nil, fmt.Errorf("namespace=%v does not have a validator", namespace)
+	}
+	return validator, nil
+}
+
+// store a record, if it is selected over the record of the same key that is
+// already stored. Records that are not selected are ignored.
+func (store *store) store(record Record) error {
+	validator, err := store.validator(record.Key)
+	if err != nil {
+		return err
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	stored, ok := store.records[record.Key]
+	if !ok || stored.Expired(time.Now()) {
+		if !ok && len(store.records) >= store.options.MaxRecords {
+			return fmt.Errorf("too many records")
+		}
+		store.records[record.Key] = record
+		return nil
+	}
+	if validator.Select([]Record{stored, record}) == 1 {
+		store.records[record.Key] = record
+	}
+	return nil
+}
+
+// ErrValueNotFound is returned when no record of a key is found.
+type ErrValueNotFound struct {
+	error
+	Key string
+}
+
+func newErrValueNotFound(key string) error {
+	return ErrValueNotFound{
+		error: fmt.Errorf("error getting value: key=%v not found", key),
+		Key:   key,
+	}
+}
+
+// ErrPuttingValue is returned when there is an error when putting a value.
+type ErrPuttingValue struct {
+	error
+	Key string
+}
+
+func newErrPuttingValue(err error, key string) error {
+	return ErrPuttingValue{
+		error: fmt.Errorf("error putting value of key=%v: %v", key, err),
+		Key:   key,
+	}
+}
+
+// ErrGettingValue is returned when there is an error when getting a value.
+type ErrGettingValue struct {
+	error
+	Key string
+}
+
+func newErrGettingValue(err error, key string) error {
+	return ErrGettingValue{
+		error: fmt.Errorf("error getting value of key=%v: %v", key, err),
+		Key:   key,
+	}
+}
+
+// ErrAcceptingPutValue is returned when there is an error when accepting a
+// PutValue message.
+type ErrAcceptingPutValue struct {
+	error
+}
+
+func newErrAcceptingPutValue(err error) error {
+	return ErrAcceptingPutValue{
+		error: fmt.Errorf("error accepting putvalue: %v", err),
+	}
+}
+
+// ErrAcceptingGetValue is returned when there is an error when accepting a
+// GetValue message.
+type ErrAcceptingGetValue struct {
+	error
+}
+
+func newErrAcceptingGetValue(err error) error {
+	return ErrAcceptingGetValue{
+		error: fmt.Errorf("error accepting getvalue: %v", err),
+	}
+}
+
+// ErrAcceptingValue is returned when there is an error when accepting a Value
+// message.
+type ErrAcceptingValue struct {
+	error
+}
+
+func newErrAcceptingValue(err error) error {
+	return ErrAcceptingValue{
+		error: fmt.Errorf("error accepting value: %v", err),
+	}
+}
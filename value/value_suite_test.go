@@ -0,0 +1,13 @@
+package value_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestValue(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Value Suite")
+}
@@ -0,0 +1,238 @@
+package value_test
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/testutil"
+	. "github.com/renproject/aw/value"
+
+	"github.com/renproject/aw/protocol"
+	"github.com/sirupsen/logrus"
+)
+
+// latestValidator accepts all records, and selects the latest.
+type latestValidator struct{}
+
+func (latestValidator) Validate(record Record) error {
+	return nil
+}
+
+func (latestValidator) Select(records []Record) int {
+	return SelectLatest(records)
+}
+
+var TestOptions = Options{
+	Logger:  logrus.New(),
+	K:       3,
+	TTL:     time.Hour,
+	Timeout: 100 * time.Millisecond,
+	Validators: map[string]Validator{
+		"any":   latestValidator{},
+		"names": OwnerValidator{},
+	},
+}
+
+type node struct {
+	DHTNode
+	store Store
+}
+
+func newNode(i int) node {
+	return newNodeWithOptions(i, TestOptions)
+}
+
+func newNodeWithOptions(i int, options Options) node {
+	n := node{DHTNode: NewDHTNode(46732 + i)}
+	n.store = NewStore(options, n.DHT, n.Messages, n.SignVerifier, SimpleTCPPeerAddressCodec{})
+	return n
+}
+
+// newNetwork returns n nodes that know each other. Messages are routed between
+// the nodes until the context is done.
+func newNetwork(ctx context.Context, n int) []node {
+	nodes := make([]node, n)
+	dhtNodes := make([]DHTNode, n)
+	for i := range nodes {
+		nodes[i] = newNode(i)
+		dhtNodes[i] = nodes[i].DHTNode
+	}
+	ConnectDHTNodes(ctx, dhtNodes, func(ctx context.Context, to int, from protocol.PeerID, message protocol.Message) {
+		switch message.Variant {
+		case protocol.PutValue:
+			_ = nodes[to].store.AcceptPutValue(ctx, from, message)
+		case protocol.GetValue:
+			_ = nodes[to].store.AcceptGetValue(ctx, from, message)
+		case protocol.Value:
+			_ = nodes[to].store.AcceptValue(ctx, from, message)
+		}
+	})
+	return nodes
+}
+
+var _ = Describe("Value records", func() {
+	Context("when a value is put", func() {
+		It("should be got by the other peers", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			nodes := newNetwork(ctx, 6)
+			Expect(nodes[0].store.PutValue(ctx, "/any/key", []byte("first"))).To(Succeed())
+
+			for _, node := range nodes {
+				Eventually(func() string {
+					value, _ := node.store.GetValue(ctx, "/any/key")
+					return string(value)
+				}).Should(Equal("first"))
+			}
+
+			// The latest value is selected
+			Expect(nodes[0].store.PutValue(ctx, "/any/key", []byte("second"))).To(Succeed())
+			for _, node := range nodes {
+				Eventually(func() string {
+					value, _ := node.store.GetValue(ctx, "/any/key")
+					return string(value)
+				}).Should(Equal("second"))
+			}
+		})
+	})
+
+	Context("when a value has not been put", func() {
+		It("should return an ErrValueNotFound", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			nodes := newNetwork(ctx, 4)
+			_, err := nodes[0].store.GetValue(ctx, "/any/missing")
+			Expect(err).To(BeAssignableToTypeOf(ErrValueNotFound{}))
+		})
+	})
+
+	Context("when the namespace of a key does not have a validator", func() {
+		It("should return an error", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			node := newNode(0)
+			Expect(node.store.PutValue(ctx, "/unknown/key", []byte("value"))).NotTo(Succeed())
+			Expect(node.store.PutValue(ctx, "key", []byte("value"))).NotTo(Succeed())
+			_, err := node.store.GetValue(ctx, "/unknown/key")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("when a key is owned by another peer", func() {
+		It("should reject the record", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			owner := newNode(0)
+			Expect(owner.store.PutValue(ctx, "/names/"+owner.Addr.ID.String(), []byte("owner"))).To(Succeed())
+
+			other := newNode(1)
+			Expect(other.store.PutValue(ctx, "/names/"+owner.Addr.ID.String(), []byte("other"))).NotTo(Succeed())
+		})
+	})
+
+	Context("when a record is replicated", func() {
+		It("should be accepted from any peer, unless it is forged", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			publisher := newNode(0)
+			Expect(publisher.DHT.AddPeerAddress(RandomAddress())).To(Succeed())
+			Expect(publisher.store.PutValue(ctx, "/any/key", []byte("value"))).To(Succeed())
+			var message protocol.MessageOnTheWire
+			Eventually(publisher.Messages).Should(Receive(&message))
+
+			receiver := newNode(1)
+			Expect(receiver.store.AcceptPutValue(ctx, RandomPeerID(), message.Message)).To(Succeed())
+
+			// Flip a bit of the signature
+			message.Message.Body[len(message.Message.Body)-1] ^= 1
+			Expect(receiver.store.AcceptPutValue(ctx, RandomPeerID(), message.Message)).NotTo(Succeed())
+		})
+	})
+})
+
+var _ = Describe("Replication", func() {
+	Context("when the store is running", func() {
+		It("should republish the records of this peer with a new expiry", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			options := TestOptions
+			options.RepublishInterval = 10 * time.Millisecond
+			publisher := newNodeWithOptions(0, options)
+			Expect(publisher.DHT.AddPeerAddress(RandomAddress())).To(Succeed())
+			Expect(publisher.store.PutValue(ctx, "/any/key", []byte("value"))).To(Succeed())
+			var message protocol.MessageOnTheWire
+			Eventually(publisher.Messages).Should(Receive(&message))
+
+			// Expiries are in seconds
+			time.Sleep(time.Second)
+			go publisher.store.Run(ctx)
+
+			var republished protocol.MessageOnTheWire
+			Eventually(publisher.Messages).Should(Receive(&republished))
+			Expect(republished.Message.Variant).To(Equal(protocol.PutValue))
+			Expect(republished.Message.Body).NotTo(Equal(message.Message.Body))
+			Eventually(func() uint64 { return publisher.store.Stats().Rounds }).Should(BeNumerically(">", 0))
+			stats := publisher.store.Stats()
+			Expect(stats.Records).To(Equal(1))
+			Expect(stats.MinReplication).To(Equal(1))
+			Expect(stats.UnderReplicated).To(Equal(1))
+
+			value, err := publisher.store.GetValue(ctx, "/any/key")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(value).To(Equal([]byte("value")))
+		})
+
+		It("should replicate the records of other publishers", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			publisher := newNode(0)
+			Expect(publisher.DHT.AddPeerAddress(RandomAddress())).To(Succeed())
+			Expect(publisher.store.PutValue(ctx, "/any/key", []byte("value"))).To(Succeed())
+			var message protocol.MessageOnTheWire
+			Eventually(publisher.Messages).Should(Receive(&message))
+
+			options := TestOptions
+			options.ReplicationInterval = 10 * time.Millisecond
+			replica := newNodeWithOptions(1, options)
+			other := RandomAddress()
+			Expect(replica.DHT.AddPeerAddress(other)).To(Succeed())
+			Expect(replica.DHT.AddPeerAddress(publisher.Addr)).To(Succeed())
+			Expect(replica.store.AcceptPutValue(ctx, publisher.Addr.ID, message.Message)).To(Succeed())
+			go replica.store.Run(ctx)
+
+			// The record is not sent back to its publisher
+			var replicated protocol.MessageOnTheWire
+			Eventually(replica.Messages).Should(Receive(&replicated))
+			Expect(replicated.To.Equal(other)).To(BeTrue())
+			Expect(replicated.Message.Body).To(Equal(message.Message.Body))
+			Eventually(func() int { return replica.store.Stats().Records }).Should(Equal(1))
+			Expect(replica.store.Stats().MinReplication).To(Equal(1))
+		})
+	})
+})
+
+var _ = Describe("Namespace", func() {
+	It("should return the first path segment of the key", func() {
+		namespace, err := Namespace("/names/alice")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(namespace).To(Equal("names"))
+
+		namespace, err = Namespace("/names")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(namespace).To(Equal("names"))
+
+		_, err = Namespace("names/alice")
+		Expect(err).To(HaveOccurred())
+		_, err = Namespace("//alice")
+		Expect(err).To(HaveOccurred())
+	})
+})
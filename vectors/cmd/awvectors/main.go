@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/renproject/aw/protocol"
+	"github.com/renproject/aw/vectors"
+)
+
+const usage = `usage:
+  awvectors generate           write the golden vectors to stdout
+  awvectors verify <file>      verify the vectors in the file against the Go implementation
+  awvectors describe           write a description of the wire format to stdout
+  awvectors validate <file>    check that the file is a stream of canonically encoded messages`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+	switch os.Args[1] {
+	case "generate":
+		vs, err := vectors.Generate()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if err := vectors.Write(os.Stdout, vs); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	case "verify":
+		if len(os.Args) != 3 {
+			fmt.Fprintln(os.Stderr, usage)
+			os.Exit(2)
+		}
+		if err := verify(os.Args[2]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	case "describe":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(protocol.DescribeWireFormat()); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	case "validate":
+		if len(os.Args) != 3 {
+			fmt.Fprintln(os.Stderr, usage)
+			os.Exit(2)
+		}
+		if err := validate(os.Args[2]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
+
+// validate the stream of messages in the file.
+func validate(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	n, err := protocol.ValidateStream(f)
+	if err != nil {
+		return fmt.Errorf("%v valid messages before: %v", n, err)
+	}
+	fmt.Printf("ok   %v messages\n", n)
+	return nil
+}
+
+// verify every vector in the file, and report the result of each of them.
+func verify(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	vs, err := vectors.Read(f)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, vector := range vs {
+		if err := vectors.Verify(vector); err != nil {
+			fmt.Printf("FAIL %v: %v\n", vector.Name, err)
+			failed++
+			continue
+		}
+		fmt.Printf("ok   %v\n", vector.Name)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%v of %v vectors failed", failed, len(vs))
+	}
+	return nil
+}
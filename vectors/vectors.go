@@ -0,0 +1,327 @@
+package vectors
+
+import (
+	"bytes"
+	"context"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"time"
+
+	"github.com/renproject/aw/crypto"
+	"github.com/renproject/aw/handshake"
+	"github.com/renproject/aw/protocol"
+	"golang.org/x/crypto/ed25519"
+)
+
+// Bytes are encoded as hex strings in JSON, so that vectors can be read by
+// other implementations, and by people.
+type Bytes []byte
+
+// MarshalJSON implements the `json.Marshaler` interface.
+func (b Bytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(hex.EncodeToString(b))
+}
+
+// UnmarshalJSON implements the `json.Unmarshaler` interface.
+func (b *Bytes) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	decoded, err := hex.DecodeString(s)
+	if err != nil {
+		return fmt.Errorf("error decoding hex: %v", err)
+	}
+	*b = decoded
+	return nil
+}
+
+// Options of the Handshaker of a Party (see handshake.Options). Suites and
+// Compressions are in order of preference.
+type Options struct {
+	Suites            []int `json:"suites"`
+	Compressions      []int `json:"compressions"`
+	PaddingBucketSize int   `json:"paddingBucketSize"`
+	PSK               Bytes `json:"psk,omitempty"`
+}
+
+// A Party is the client, or the server, of a Vector. Its identity is the
+// Ed25519 key with the IdentityKey seed, which signs deterministically (see
+// crypto.NewEd25519SignVerifier), and its ephemeral key is the P-256 private
+// key that it generates during the handshake. Messages are the encodings of the messages that it writes after
+// the handshake, and the Transcript is every byte that it writes.
+type Party struct {
+	IdentityKey  Bytes   `json:"identityKey"`
+	EphemeralKey Bytes   `json:"ephemeralKey"`
+	Options      Options `json:"options"`
+	Messages     []Bytes `json:"messages"`
+	Transcript   Bytes   `json:"transcript"`
+}
+
+// A Vector is the byte-exact transcript of a handshake between a client and a
+// server, followed by the messages that they write through their AES-GCM
+// sessions. The client writes all of its messages before the server writes its
+// messages, because the nonces of both directions of a session are drawn from
+// the same sequence. Other implementations can be validated by reproducing the
+// Transcripts of both parties from their keys, options and messages, or by
+// recording their own vectors and checking them with Verify.
+type Vector struct {
+	Name   string `json:"name"`
+	Client Party  `json:"client"`
+	Server Party  `json:"server"`
+}
+
+// Read the Vectors encoded as JSON.
+func Read(r io.Reader) ([]Vector, error) {
+	vectors := []Vector{}
+	if err := json.NewDecoder(r).Decode(&vectors); err != nil {
+		return nil, fmt.Errorf("error decoding vectors: %v", err)
+	}
+	return vectors, nil
+}
+
+// Write the Vectors as indented JSON.
+func Write(w io.Writer, vectors []Vector) error {
+	data, err := json.MarshalIndent(vectors, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding vectors: %v", err)
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// Generate the Vectors of the handshake using SuiteP256ECDH, with and without
+// compression, padding and a PSK. Only SuiteP256ECDH is covered, because it
+// is the only Suite that is implemented entirely by the standard library, so
+// its transcripts are the same whichever versions of the dependencies are
+// used. The keys of every Vector are derived from its name, so the Vectors
+// only change when the handshake, or the framing of messages, changes.
+func Generate() ([]Vector, error) {
+	groupID := protocol.GroupID(sha256.Sum256([]byte("aw/vectors/group")))
+	deadline := time.Unix(1700000000, 0)
+	clientMessages := []protocol.Message{
+		protocol.NewMessage(protocol.V1, protocol.Cast, protocol.NilGroupID, protocol.MessageBody("hello")),
+		protocol.NewMessageWithHasher(protocol.Broadcast, groupID, protocol.MessageBody("blake3"), protocol.BLAKE3),
+		protocol.NewMessageWithDeadline(protocol.Broadcast, groupID, protocol.MessageBody("deadline"), protocol.SHA256, deadline),
+	}
+	serverMessages := []protocol.Message{
+		protocol.NewMessage(protocol.V1, protocol.Multicast, groupID, protocol.MessageBody("world")),
+		protocol.NewMessage(protocol.V1, protocol.Cast, protocol.NilGroupID, protocol.MessageBody{}),
+	}
+
+	p256 := []int{int(handshake.SuiteP256ECDH)}
+	all := []int{int(handshake.SuiteSecp256k1ECIES), int(handshake.SuiteP256ECDH)}
+	none := []int{int(handshake.CompressionNone)}
+	snappy := []int{int(handshake.CompressionSnappy), int(handshake.CompressionNone)}
+	psk := Bytes("aw/vectors/psk")
+	cases := []struct {
+		name           string
+		client, server Options
+	}{
+		{"p256-ecdh", Options{Suites: p256, Compressions: none}, Options{Suites: all, Compressions: snappy}},
+		{"p256-ecdh-snappy", Options{Suites: p256, Compressions: snappy}, Options{Suites: all, Compressions: snappy}},
+		{"p256-ecdh-padding", Options{Suites: p256, Compressions: snappy, PaddingBucketSize: 64}, Options{Suites: p256, Compressions: none, PaddingBucketSize: 256}},
+		{"p256-ecdh-psk", Options{Suites: p256, Compressions: none, PSK: psk}, Options{Suites: p256, Compressions: none, PSK: psk}},
+	}
+
+	vectors := make([]Vector, 0, len(cases))
+	for _, c := range cases {
+		vector := Vector{
+			Name:   c.name,
+			Client: newParty(c.name, "client", c.client, clientMessages),
+			Server: newParty(c.name, "server", c.server, serverMessages),
+		}
+		if err := record(&vector); err != nil {
+			return nil, fmt.Errorf("error generating vector %v: %v", c.name, err)
+		}
+		vectors = append(vectors, vector)
+	}
+	return vectors, nil
+}
+
+// newParty derives the keys of the Party from the name of its Vector and its
+// role.
+func newParty(name, role string, options Options, messages []protocol.Message) Party {
+	identityKey := sha256.Sum256([]byte(fmt.Sprintf("aw/vectors/%v/%v/identity", name, role)))
+	ephemeralSeed := sha256.Sum256([]byte(fmt.Sprintf("aw/vectors/%v/%v/ephemeral", name, role)))
+	one := big.NewInt(1)
+	k := new(big.Int).SetBytes(ephemeralSeed[:])
+	k.Mod(k, new(big.Int).Sub(elliptic.P256().Params().N, one))
+	k.Add(k, one)
+
+	party := Party{
+		IdentityKey:  identityKey[:],
+		EphemeralKey: leftPad(k.Bytes(), 32),
+		Options:      options,
+		Messages:     make([]Bytes, 0, len(messages)),
+	}
+	for _, message := range messages {
+		data, err := message.MarshalBinary()
+		if err != nil {
+			panic(fmt.Errorf("invariant violation: malformed message: %v", err))
+		}
+		party.Messages = append(party.Messages, data)
+	}
+	return party
+}
+
+// record the Transcripts of the Vector by handshaking, and exchanging the
+// messages, between its client and server over an in-memory connection.
+func record(vector *Vector) error {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	client := &recorder{ReadWriter: clientConn}
+	server := &recorder{ReadWriter: serverConn}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	clientErr := make(chan error, 1)
+	go func() {
+		err := run(ctx, vector.Client, vector.Server, client, true)
+		if err != nil {
+			clientConn.Close()
+		}
+		clientErr <- err
+	}()
+	if err := run(ctx, vector.Server, vector.Client, server, false); err != nil {
+		serverConn.Close()
+		<-clientErr
+		return fmt.Errorf("server: %v", err)
+	}
+	if err := <-clientErr; err != nil {
+		return fmt.Errorf("client: %v", err)
+	}
+	vector.Client.Transcript = client.written.Bytes()
+	vector.Server.Transcript = server.written.Bytes()
+	return nil
+}
+
+// run the handshake of the local Party with the remote Party, and exchange
+// their messages. The client writes its messages before reading the messages
+// of the server, and the server reads the messages of the client before
+// writing its messages.
+func run(ctx context.Context, local, remote Party, rw io.ReadWriter, isClient bool) error {
+	handshaker, err := local.handshaker()
+	if err != nil {
+		return err
+	}
+	var session protocol.Session
+	if isClient {
+		session, err = handshaker.Handshake(ctx, rw)
+	} else {
+		session, err = handshaker.AcceptHandshake(ctx, rw)
+	}
+	if err != nil {
+		return fmt.Errorf("error handshaking: %v", err)
+	}
+	if expected := crypto.Ed25519PeerID(ed25519.NewKeyFromSeed(remote.IdentityKey).Public().(ed25519.PublicKey)); !expected.Equal(protocol.SessionPeerID(session)) {
+		return fmt.Errorf("unexpected peer: expected %v, got %v", expected, protocol.SessionPeerID(session))
+	}
+
+	if isClient {
+		if err := writeMessages(session, rw, local.Messages); err != nil {
+			return err
+		}
+		return readMessages(session, rw, remote.Messages)
+	}
+	if err := readMessages(session, rw, remote.Messages); err != nil {
+		return err
+	}
+	return writeMessages(session, rw, local.Messages)
+}
+
+func writeMessages(session protocol.Session, w io.Writer, messages []Bytes) error {
+	for i, data := range messages {
+		message := protocol.Message{}
+		if err := message.UnmarshalBinary(data); err != nil {
+			return fmt.Errorf("error decoding message %v: %v", i, err)
+		}
+		if err := session.WriteMessage(w, message); err != nil {
+			return fmt.Errorf("error writing message %v: %v", i, err)
+		}
+	}
+	return nil
+}
+
+func readMessages(session protocol.Session, r io.Reader, messages []Bytes) error {
+	for i, expected := range messages {
+		otw, err := session.ReadMessageOnTheWire(r)
+		if err != nil {
+			return fmt.Errorf("error reading message %v: %v", i, err)
+		}
+		data, err := otw.Message.MarshalBinary()
+		if err != nil {
+			return fmt.Errorf("error encoding message %v: %v", i, err)
+		}
+		if !bytes.Equal(data, expected) {
+			return fmt.Errorf("unexpected message %v: expected %x, got %x", i, []byte(expected), data)
+		}
+	}
+	return nil
+}
+
+// handshaker returns a Handshaker that generates the ephemeral key of the
+// Party, and uses AES-GCM sessions.
+func (party Party) handshaker() (handshake.Handshaker, error) {
+	if len(party.IdentityKey) != ed25519.SeedSize {
+		return nil, fmt.Errorf("invalid identity key: expected len=%v, got len=%v", ed25519.SeedSize, len(party.IdentityKey))
+	}
+	rand, err := ephemeralRand(party.EphemeralKey)
+	if err != nil {
+		return nil, err
+	}
+	options := handshake.Options{
+		Suites:            make(handshake.Suites, 0, len(party.Options.Suites)),
+		Compressions:      make(handshake.Compressions, 0, len(party.Options.Compressions)),
+		PaddingBucketSize: party.Options.PaddingBucketSize,
+		PSK:               party.Options.PSK,
+		Rand:              rand,
+	}
+	for _, suite := range party.Options.Suites {
+		options.Suites = append(options.Suites, handshake.Suite(suite))
+	}
+	for _, compression := range party.Options.Compressions {
+		options.Compressions = append(options.Compressions, handshake.Compression(compression))
+	}
+	signVerifier := crypto.NewEd25519SignVerifier(ed25519.NewKeyFromSeed(party.IdentityKey))
+	return handshake.NewWithOptions(options, signVerifier, handshake.NewGCMSessionManager()), nil
+}
+
+// ephemeralRand returns the randomness from which the Handshaker derives the
+// P-256 private key (see handshake.Options.Rand). Reading more randomness
+// fails, so that a handshake that is not reproducible cannot be recorded.
+func ephemeralRand(privateKey []byte) (io.Reader, error) {
+	params := elliptic.P256().Params()
+	k := new(big.Int).SetBytes(privateKey)
+	if len(privateKey) != 32 || k.Sign() == 0 || k.Cmp(params.N) >= 0 {
+		return nil, fmt.Errorf("invalid ephemeral key: expected 32 bytes in [1, n)")
+	}
+	k.Sub(k, big.NewInt(1))
+	return bytes.NewReader(leftPad(k.Bytes(), params.BitSize/8+8)), nil
+}
+
+// leftPad the big-endian integer with zeros to the length.
+func leftPad(b []byte, length int) []byte {
+	padded := make([]byte, length)
+	copy(padded[length-len(b):], b)
+	return padded
+}
+
+// A recorder records every byte that is written to its io.ReadWriter.
+type recorder struct {
+	io.ReadWriter
+	written bytes.Buffer
+}
+
+func (rec *recorder) Write(p []byte) (int, error) {
+	n, err := rec.ReadWriter.Write(p)
+	rec.written.Write(p[:n])
+	return n, err
+}
@@ -0,0 +1,13 @@
+package vectors_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestVectors(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Vectors Suite")
+}
@@ -0,0 +1,80 @@
+package vectors_test
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/vectors"
+)
+
+// update the golden vectors, instead of checking them, after an intended
+// change to the handshake or the framing of messages.
+var update = flag.Bool("update", false, "update the golden vectors")
+
+var _ = Describe("Vectors", func() {
+	golden := filepath.Join("testdata", "vectors.json")
+
+	readGolden := func() []Vector {
+		f, err := os.Open(golden)
+		Expect(err).NotTo(HaveOccurred())
+		defer f.Close()
+		vectors, err := Read(f)
+		Expect(err).NotTo(HaveOccurred())
+		return vectors
+	}
+
+	Context("when generating vectors", func() {
+		It("should generate the golden vectors", func() {
+			vectors, err := Generate()
+			Expect(err).NotTo(HaveOccurred())
+			buf := new(bytes.Buffer)
+			Expect(Write(buf, vectors)).To(Succeed())
+			if *update {
+				Expect(ioutil.WriteFile(golden, buf.Bytes(), 0644)).To(Succeed())
+			}
+
+			data, err := ioutil.ReadFile(golden)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(buf.String()).To(Equal(string(data)), "the golden vectors are out of date: run the tests with -update if the change is intended")
+		})
+	})
+
+	Context("when verifying vectors", func() {
+		It("should verify the golden vectors", func() {
+			vectors := readGolden()
+			Expect(vectors).NotTo(BeEmpty())
+			for _, vector := range vectors {
+				Expect(Verify(vector)).To(Succeed(), vector.Name)
+			}
+		})
+
+		It("should return the offset of the first byte that differs", func() {
+			vector := readGolden()[0]
+			offset := len(vector.Client.Transcript) - 1
+			vector.Client.Transcript[offset] ^= 1
+
+			err := Verify(vector)
+			Expect(err).To(BeAssignableToTypeOf(ErrTranscriptMismatch{}))
+			Expect(err.(ErrTranscriptMismatch).Role).To(Equal("client"))
+			Expect(err.(ErrTranscriptMismatch).Offset).To(Equal(offset))
+		})
+
+		It("should reject transcripts that cannot be read", func() {
+			vector := readGolden()[0]
+			vector.Server.Transcript[len(vector.Server.Transcript)-1] ^= 1
+			Expect(Verify(vector)).To(HaveOccurred())
+		})
+
+		It("should reject transcripts that were not written in full", func() {
+			vector := readGolden()[0]
+			vector.Server.Transcript = append(vector.Server.Transcript, 0)
+			err := Verify(vector)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,93 @@
+package vectors
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+)
+
+// ErrTranscriptMismatch is returned when the Go implementation does not write
+// the same bytes as the Transcript of a Party in a Vector. Offset is the
+// offset of the first byte that is different.
+type ErrTranscriptMismatch struct {
+	error
+	Name   string
+	Role   string
+	Offset int
+}
+
+func newErrTranscriptMismatch(name, role string, offset int, reason string) error {
+	return ErrTranscriptMismatch{
+		error:  fmt.Errorf("error verifying %v of vector %v: transcript differs at offset=%v: %v", role, name, offset, reason),
+		Name:   name,
+		Role:   role,
+		Offset: offset,
+	}
+}
+
+// Verify the Vector against the Go implementation, by replaying the
+// Transcript of each Party to the other Party, and checking that the other
+// Party writes its Transcript byte-for-byte, and reads the expected messages.
+// Vectors that are recorded by other implementations can be verified, so long
+// as they use the same SignVerifier and key derivation as the Go
+// implementation (see crypto.NewEd25519SignVerifier and
+// handshake.Options.Rand).
+func Verify(vector Vector) error {
+	if err := verify(vector, vector.Client, vector.Server, "client"); err != nil {
+		return err
+	}
+	return verify(vector, vector.Server, vector.Client, "server")
+}
+
+func verify(vector Vector, local, remote Party, role string) error {
+	replay := &replayer{
+		r:        bytes.NewReader(remote.Transcript),
+		expected: local.Transcript,
+	}
+	err := run(context.Background(), local, remote, replay, role == "client")
+	if replay.mismatch != "" {
+		return newErrTranscriptMismatch(vector.Name, role, replay.written, replay.mismatch)
+	}
+	if err != nil {
+		return fmt.Errorf("error verifying %v of vector %v: %v", role, vector.Name, err)
+	}
+	if replay.written != len(replay.expected) {
+		return newErrTranscriptMismatch(vector.Name, role, replay.written, "transcript is longer than what was written")
+	}
+	if replay.r.Len() > 0 {
+		return fmt.Errorf("error verifying %v of vector %v: %v bytes of the remote transcript were not read", role, vector.Name, replay.r.Len())
+	}
+	return nil
+}
+
+// A replayer reads the Transcript of the remote Party, and checks that the
+// bytes written by the local Party match its expected Transcript.
+type replayer struct {
+	r        *bytes.Reader
+	expected []byte
+	written  int
+	mismatch string
+}
+
+func (replay *replayer) Read(p []byte) (int, error) {
+	return replay.r.Read(p)
+}
+
+func (replay *replayer) Write(p []byte) (int, error) {
+	if replay.mismatch != "" {
+		return 0, io.ErrClosedPipe
+	}
+	for i, b := range p {
+		if replay.written >= len(replay.expected) {
+			replay.mismatch = "transcript is shorter than what was written"
+			return i, io.ErrClosedPipe
+		}
+		if replay.expected[replay.written] != b {
+			replay.mismatch = fmt.Sprintf("expected %#02x, got %#02x", replay.expected[replay.written], b)
+			return i, io.ErrClosedPipe
+		}
+		replay.written++
+	}
+	return len(p), nil
+}
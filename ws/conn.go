@@ -0,0 +1,82 @@
+//go:build !js
+// +build !js
+
+package ws
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/net/websocket"
+)
+
+// dialConn opens a WebSocket connection to the URL. Messages are written as
+// binary frames.
+func dialConn(ctx context.Context, rawurl string) (io.ReadWriteCloser, error) {
+	config, err := websocket.NewConfig(rawurl, origin(rawurl))
+	if err != nil {
+		return nil, err
+	}
+	config.Dialer = new(net.Dialer)
+	if deadline, ok := ctx.Deadline(); ok {
+		config.Dialer.Deadline = deadline
+	}
+	conn, err := websocket.DialConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	conn.PayloadType = websocket.BinaryFrame
+	return conn, nil
+}
+
+// origin returns the origin that is sent when dialing the URL. Peers that are
+// not in a browser do not have an origin, so the origin of the URL itself is
+// used.
+func origin(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return ""
+	}
+	scheme := "http"
+	if u.Scheme == "wss" {
+		scheme = "https"
+	}
+	return (&url.URL{Scheme: scheme, Host: u.Host}).String()
+}
+
+// ServeHTTP accepts a WebSocket connection, and serves it until the remote
+// peer closes it, or until the Server of the Transport stops. The origin of
+// the request is not checked, because remote peers are authenticated by the
+// handshake.
+func (transport *Transport) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	websocket.Server{
+		Handshake: func(*websocket.Config, *http.Request) error {
+			return nil
+		},
+		Handler: func(conn *websocket.Conn) {
+			transport.accept(r.Context(), conn)
+		},
+	}.ServeHTTP(w, r)
+}
+
+func (transport *Transport) accept(ctx context.Context, conn *websocket.Conn) {
+	remoteAddr := conn.Request().RemoteAddr
+	if transport.NumConns() >= transport.options.MaxConnections {
+		transport.logger.Infof("websocket transport reaches max number of connections")
+		return
+	}
+	conn.PayloadType = websocket.BinaryFrame
+
+	handshakeCtx, handshakeCancel := context.WithTimeout(ctx, transport.options.Timeout)
+	c, err := transport.establish(handshakeCtx, conn, remoteAddr, false)
+	handshakeCancel()
+	if err != nil {
+		transport.logger.Errorf("closing connection: error establishing session: %v", err)
+		return
+	}
+	transport.register(c)
+	transport.serve(ctx, c)
+}
@@ -0,0 +1,146 @@
+//go:build js && wasm
+// +build js,wasm
+
+package ws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"syscall/js"
+)
+
+// readyStateOpen is the readyState of a browser WebSocket that is open.
+const readyStateOpen = 1
+
+// jsConn is a connection that uses the WebSocket API of the browser. Binary
+// frames that are received are buffered until they are read, so that the
+// callbacks of the browser never block.
+type jsConn struct {
+	ws        js.Value
+	listeners map[string]js.Func
+
+	mu     *sync.Mutex
+	buf    []byte
+	err    error
+	notify chan struct{}
+}
+
+// dialConn opens a WebSocket connection to the URL using the WebSocket API of
+// the browser. Messages are written as binary frames.
+func dialConn(ctx context.Context, url string) (io.ReadWriteCloser, error) {
+	conn := &jsConn{
+		ws:        js.Global().Get("WebSocket").New(url),
+		listeners: map[string]js.Func{},
+
+		mu:     new(sync.Mutex),
+		notify: make(chan struct{}, 1),
+	}
+	conn.ws.Set("binaryType", "arraybuffer")
+
+	opened := make(chan struct{})
+	openedOnce := new(sync.Once)
+	conn.listen("open", func(js.Value) {
+		openedOnce.Do(func() { close(opened) })
+	})
+	conn.listen("message", func(event js.Value) {
+		data := js.Global().Get("Uint8Array").New(event.Get("data"))
+		b := make([]byte, data.Get("length").Int())
+		js.CopyBytesToGo(b, data)
+		conn.push(b, nil)
+	})
+	conn.listen("error", func(js.Value) {
+		conn.push(nil, errors.New("websocket error"))
+	})
+	conn.listen("close", func(js.Value) {
+		conn.push(nil, io.EOF)
+	})
+
+	select {
+	case <-opened:
+		return conn, nil
+	case <-conn.notify:
+		conn.mu.Lock()
+		err := conn.err
+		conn.mu.Unlock()
+		conn.Close()
+		return nil, fmt.Errorf("cannot open websocket: %v", err)
+	case <-ctx.Done():
+		conn.Close()
+		return nil, ctx.Err()
+	}
+}
+
+// listen for the event, and release the listener when the connection is
+// closed.
+func (conn *jsConn) listen(event string, f func(js.Value)) {
+	listener := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		f(args[0])
+		return nil
+	})
+	conn.listeners[event] = listener
+	conn.ws.Call("addEventListener", event, listener)
+}
+
+// push data, or the first error, to the reader without blocking.
+func (conn *jsConn) push(data []byte, err error) {
+	conn.mu.Lock()
+	if err != nil && conn.err == nil {
+		conn.err = err
+	}
+	conn.buf = append(conn.buf, data...)
+	conn.mu.Unlock()
+
+	select {
+	case conn.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (conn *jsConn) Read(p []byte) (int, error) {
+	for {
+		conn.mu.Lock()
+		if len(conn.buf) > 0 {
+			n := copy(p, conn.buf)
+			conn.buf = conn.buf[n:]
+			conn.mu.Unlock()
+			return n, nil
+		}
+		if conn.err != nil {
+			err := conn.err
+			conn.mu.Unlock()
+			return 0, err
+		}
+		conn.mu.Unlock()
+		<-conn.notify
+	}
+}
+
+func (conn *jsConn) Write(p []byte) (int, error) {
+	if conn.ws.Get("readyState").Int() != readyStateOpen {
+		return 0, errors.New("websocket is not open")
+	}
+	data := js.Global().Get("Uint8Array").New(len(p))
+	js.CopyBytesToJS(data, p)
+	conn.ws.Call("send", data)
+	return len(p), nil
+}
+
+// Close the connection, and release its listeners. Reading from the
+// connection returns io.EOF after it has been closed.
+func (conn *jsConn) Close() error {
+	conn.mu.Lock()
+	listeners := conn.listeners
+	conn.listeners = map[string]js.Func{}
+	conn.mu.Unlock()
+
+	for event, listener := range listeners {
+		conn.ws.Call("removeEventListener", event, listener)
+		listener.Release()
+	}
+	conn.ws.Call("close")
+	conn.push(nil, io.EOF)
+	return nil
+}
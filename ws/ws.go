@@ -0,0 +1,436 @@
+package ws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/renproject/aw/handshake"
+	"github.com/renproject/aw/protocol"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrTooManyConnections is returned when the number of connections of a
+// Transport has reached its limit.
+var ErrTooManyConnections = errors.New("too many connections")
+
+// Addr is the network address of a peer that accepts WebSocket connections.
+// It is the URL of the endpoint that the Transport of the peer is served on
+// (e.g. "wss://example.com/aw").
+type Addr string
+
+// Network returns the scheme of the URL (i.e. "ws" or "wss").
+func (addr Addr) Network() string {
+	u, err := url.Parse(string(addr))
+	if err != nil {
+		return ""
+	}
+	return u.Scheme
+}
+
+// String returns the URL.
+func (addr Addr) String() string {
+	return string(addr)
+}
+
+// isWebSocket returns true if the network of the address is "ws" or "wss".
+func isWebSocket(network string) bool {
+	return network == "ws" || network == "wss"
+}
+
+// Options are used to parameterise the behaviour of a Transport.
+type Options struct {
+	Timeout          time.Duration             // Timeout when dialing and handshaking new connections.
+	MaxConnections   int                       // Max connections allowed.
+	InboundCapacity  int                       // Messages that are buffered before connections stop reading.
+	EncryptionPolicy protocol.EncryptionPolicy // Peers that must only exchange encrypted messages.
+}
+
+func (options *Options) setZerosToDefaults() {
+	if options.Timeout == 0 {
+		options.Timeout = 10 * time.Second
+	}
+	if options.MaxConnections == 0 {
+		options.MaxConnections = 256
+	}
+	if options.InboundCapacity <= 0 {
+		options.InboundCapacity = 1024
+	}
+}
+
+// A Transport sends and receives messages over WebSocket connections, so that
+// peers that cannot open TCP connections, or listen for them (e.g. peers that
+// run in a browser), can participate in the network. Unlike TCP connections,
+// which are one-way, a WebSocket connection is used in both directions: the
+// peer that dials the connection can be sent messages over it without being
+// able to accept connections itself. Each direction has its own session, so
+// two handshakes are done when a connection is established.
+//
+// Nodes accept connections by serving the Transport over HTTP (it is an
+// http.Handler, except when building for js/wasm), and peers in a browser
+// dial them (see Dial). It is safe for concurrent use.
+type Transport struct {
+	logger     logrus.FieldLogger
+	options    Options
+	handshaker handshake.Handshaker
+
+	mu    *sync.RWMutex
+	conns map[string]*conn
+
+	inbound chan protocol.MessageOnTheWire
+}
+
+// conn is an established connection with a remote peer.
+type conn struct {
+	rwc        io.ReadWriteCloser
+	remoteAddr string
+
+	// The outbound session is used to write messages, and the inbound
+	// session is used to read them.
+	writeMu  *sync.Mutex
+	outbound protocol.IdentifiedSession
+	inbound  protocol.IdentifiedSession
+}
+
+// New returns a Transport with no connections.
+func New(options Options, logger logrus.FieldLogger, handshaker handshake.Handshaker) *Transport {
+	if logger == nil {
+		logger = logrus.New()
+	}
+	options.setZerosToDefaults()
+	if handshaker == nil {
+		panic("handshaker cannot be nil")
+	}
+	return &Transport{
+		logger:     logger,
+		options:    options,
+		handshaker: handshaker,
+
+		mu:    new(sync.RWMutex),
+		conns: map[string]*conn{},
+
+		inbound: make(chan protocol.MessageOnTheWire, options.InboundCapacity),
+	}
+}
+
+// Dial the peer at the URL (e.g. "wss://example.com/aw"), and establish a
+// connection with it. Messages are read from the connection until the context
+// is done, or until the connection is closed. It returns the PeerID of the
+// remote peer.
+func (transport *Transport) Dial(ctx context.Context, url string) (protocol.PeerID, error) {
+	c, err := transport.dial(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	return c.inbound.PeerID(), nil
+}
+
+func (transport *Transport) dial(ctx context.Context, url string) (*conn, error) {
+	if transport.NumConns() >= transport.options.MaxConnections {
+		return nil, ErrTooManyConnections
+	}
+	dialCtx, cancel := context.WithTimeout(ctx, transport.options.Timeout)
+	defer cancel()
+
+	rwc, err := dialConn(dialCtx, url)
+	if err != nil {
+		return nil, fmt.Errorf("error dialing %v: %v", url, err)
+	}
+	c, err := transport.establish(dialCtx, rwc, url, true)
+	if err != nil {
+		rwc.Close()
+		return nil, err
+	}
+	transport.register(c)
+	go transport.serve(ctx, c)
+	return c, nil
+}
+
+// NumConns returns the number of established connections.
+func (transport *Transport) NumConns() int {
+	transport.mu.RLock()
+	defer transport.mu.RUnlock()
+
+	return len(transport.conns)
+}
+
+// PeerIDs returns the PeerIDs of the remote peers that connections have been
+// established with.
+func (transport *Transport) PeerIDs() protocol.PeerIDs {
+	transport.mu.RLock()
+	defer transport.mu.RUnlock()
+
+	peerIDs := make(protocol.PeerIDs, 0, len(transport.conns))
+	for _, c := range transport.conns {
+		peerIDs = append(peerIDs, c.inbound.PeerID())
+	}
+	return peerIDs
+}
+
+// establish a connection by handshaking in both directions. The peer that
+// dialed the connection handshakes for its outbound session first. The
+// connection is closed if the context is done before both handshakes are
+// complete.
+func (transport *Transport) establish(ctx context.Context, rwc io.ReadWriteCloser, remoteAddr string, dialed bool) (*conn, error) {
+	stop := closeOnDone(ctx, rwc)
+	defer stop()
+
+	var outboundSession, inboundSession protocol.Session
+	var err error
+	if dialed {
+		if outboundSession, err = transport.handshaker.Handshake(ctx, rwc); err == nil {
+			inboundSession, err = transport.handshaker.AcceptHandshake(ctx, rwc)
+		}
+	} else {
+		if inboundSession, err = transport.handshaker.AcceptHandshake(ctx, rwc); err == nil {
+			outboundSession, err = transport.handshaker.Handshake(ctx, rwc)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("bad handshake with %v: %v", remoteAddr, err)
+	}
+	// Connections are identified by the remote peer of their sessions
+	outbound, ok := outboundSession.(protocol.IdentifiedSession)
+	if !ok {
+		return nil, fmt.Errorf("cannot establish session with %v", remoteAddr)
+	}
+	inbound, ok := inboundSession.(protocol.IdentifiedSession)
+	if !ok {
+		return nil, fmt.Errorf("cannot establish session with %v", remoteAddr)
+	}
+	if !outbound.PeerID().Equal(inbound.PeerID()) {
+		return nil, fmt.Errorf("bad handshake with %v: expected peer=%v, got peer=%v", remoteAddr, outbound.PeerID(), inbound.PeerID())
+	}
+	if err := transport.options.EncryptionPolicy.Check(outbound); err != nil {
+		return nil, err
+	}
+	if err := transport.options.EncryptionPolicy.Check(inbound); err != nil {
+		return nil, err
+	}
+	return &conn{
+		rwc:        rwc,
+		remoteAddr: remoteAddr,
+		writeMu:    new(sync.Mutex),
+		outbound:   outbound,
+		inbound:    inbound,
+	}, nil
+}
+
+// register the connection, so that messages can be sent over it. It replaces
+// any other connection with the same remote peer.
+func (transport *Transport) register(c *conn) {
+	transport.mu.Lock()
+	defer transport.mu.Unlock()
+
+	peerID := c.inbound.PeerID().String()
+	if prev, ok := transport.conns[peerID]; ok {
+		prev.rwc.Close()
+	}
+	transport.conns[peerID] = c
+}
+
+// serve the connection, reading messages from it until the context is done or
+// the connection is closed. The connection is closed, and unregistered, when
+// serving returns.
+func (transport *Transport) serve(ctx context.Context, c *conn) {
+	// Close the connection when the context is done, so that reading does
+	// not block.
+	stop := closeOnDone(ctx, c.rwc)
+	defer func() {
+		stop()
+		c.rwc.Close()
+
+		peerID := c.inbound.PeerID().String()
+		transport.mu.Lock()
+		if transport.conns[peerID] == c {
+			delete(transport.conns, peerID)
+		}
+		transport.mu.Unlock()
+	}()
+
+	for {
+		messageOtw, err := c.inbound.ReadMessageOnTheWire(c.rwc)
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
+			if err != io.EOF {
+				transport.logger.Errorf("error reading incoming message from %v: %v", c.remoteAddr, err)
+			}
+			transport.logger.Infof("closing connection with %v", c.remoteAddr)
+			return
+		}
+		messageOtw.From = c.inbound.PeerID()
+		messageOtw.Authenticated = true
+
+		select {
+		case <-ctx.Done():
+			return
+		case transport.inbound <- messageOtw:
+		}
+	}
+}
+
+// closeAll closes all of the connections.
+func (transport *Transport) closeAll() {
+	transport.mu.RLock()
+	defer transport.mu.RUnlock()
+
+	for _, c := range transport.conns {
+		c.rwc.Close()
+	}
+}
+
+// closeOnDone closes the Closer when the context is done, unless the returned
+// function has been called first.
+func closeOnDone(ctx context.Context, closer io.Closer) (stop func()) {
+	mu := new(sync.Mutex)
+	stopped := false
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			mu.Lock()
+			if !stopped {
+				closer.Close()
+			}
+			mu.Unlock()
+		case <-done:
+		}
+	}()
+	return func() {
+		mu.Lock()
+		stopped = true
+		mu.Unlock()
+		close(done)
+	}
+}
+
+// send the message over the connection with the remote peer, if there is one.
+// It returns false if there is no connection.
+func (transport *Transport) send(peerID protocol.PeerID, message protocol.Message) (bool, error) {
+	transport.mu.RLock()
+	c, ok := transport.conns[peerID.String()]
+	transport.mu.RUnlock()
+	if !ok {
+		return false, nil
+	}
+	return true, c.write(message)
+}
+
+func (c *conn) write(message protocol.Message) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if err := c.outbound.WriteMessage(c.rwc, message); err != nil {
+		c.rwc.Close()
+		return err
+	}
+	return nil
+}
+
+// Client returns a protocol.Client that sends messages over the connections of
+// the Transport. Messages to peers that do not have a connection are sent over
+// a new connection, if one of the network addresses of the peer is a "ws" or
+// "wss" address. Otherwise, they are given to the fallback Client (e.g. a
+// tcp.Client), or dropped if the fallback Client is nil.
+func (transport *Transport) Client(fallback protocol.Client) protocol.Client {
+	return &client{
+		transport: transport,
+		fallback:  fallback,
+	}
+}
+
+type client struct {
+	transport *Transport
+	fallback  protocol.Client
+}
+
+func (client *client) Run(ctx context.Context, messages protocol.MessageReceiver) {
+	var fallback chan protocol.MessageOnTheWire
+	if client.fallback != nil {
+		fallback = make(chan protocol.MessageOnTheWire, cap(messages))
+		go client.fallback.Run(ctx, fallback)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case messageOtw := <-messages:
+			go client.handleMessageOnTheWire(ctx, messageOtw, fallback)
+		}
+	}
+}
+
+func (client *client) handleMessageOnTheWire(ctx context.Context, message protocol.MessageOnTheWire, fallback chan<- protocol.MessageOnTheWire) {
+	logger := client.transport.logger
+	peerID := message.To.PeerID()
+	ok, err := client.transport.send(peerID, message.Message)
+	if ok && err == nil {
+		return
+	}
+	if err != nil {
+		logger.Debugf("error sending %v message to %v: %v", message.Message.Variant, peerID, err)
+	}
+
+	for _, netAddr := range protocol.NetworkAddresses(message.To) {
+		if !isWebSocket(netAddr.Network()) {
+			continue
+		}
+		c, err := client.transport.dial(ctx, netAddr.String())
+		if err != nil {
+			logger.Debugf("error sending %v message to %v: %v", message.Message.Variant, netAddr, err)
+			continue
+		}
+		if err := c.write(message.Message); err != nil {
+			logger.Debugf("error sending %v message to %v: %v", message.Message.Variant, netAddr, err)
+			continue
+		}
+		return
+	}
+
+	if fallback == nil {
+		logger.Debugf("dropping %v message to %v: no websocket connection", message.Message.Variant, peerID)
+		return
+	}
+	select {
+	case <-ctx.Done():
+	case fallback <- message:
+	}
+}
+
+// Server returns a protocol.Server that receives the messages read from the
+// connections of the Transport.
+func (transport *Transport) Server() protocol.Server {
+	return server{transport: transport}
+}
+
+type server struct {
+	transport *Transport
+}
+
+// Run the server until the context is done, and then close all of the
+// connections of the Transport.
+func (server server) Run(ctx context.Context, messages protocol.MessageSender) {
+	defer server.transport.closeAll()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case messageOtw := <-server.transport.inbound:
+			select {
+			case <-ctx.Done():
+				return
+			case messages <- messageOtw:
+			}
+		}
+	}
+}
@@ -0,0 +1,13 @@
+package ws_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestWs(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "WebSocket Suite")
+}
@@ -0,0 +1,181 @@
+package ws_test
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/aw/testutil"
+	. "github.com/renproject/aw/ws"
+
+	"github.com/renproject/aw/handshake"
+	"github.com/renproject/aw/protocol"
+	"github.com/sirupsen/logrus"
+)
+
+// wsPeerAddress is the address of a peer that accepts WebSocket connections.
+type wsPeerAddress struct {
+	SimpleTCPPeerAddress
+	URL string
+}
+
+func (address wsPeerAddress) NetworkAddress() net.Addr {
+	return Addr(address.URL)
+}
+
+// fallbackClient is a protocol.Client that forwards the messages it is given.
+type fallbackClient chan protocol.MessageOnTheWire
+
+func (client fallbackClient) Run(ctx context.Context, messages protocol.MessageReceiver) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case message := <-messages:
+			client <- message
+		}
+	}
+}
+
+var _ = Describe("WebSocket transport", func() {
+
+	// newTransports returns the Transport of a node, which is served over
+	// HTTP at the returned URL, and the Transport of a browser peer, which
+	// can only dial.
+	newTransports := func() (*Transport, MockSignVerifier, *Transport, MockSignVerifier, string, func()) {
+		nodeSignVerifier := NewMockSignVerifier()
+		browserSignVerifier := NewMockSignVerifier()
+		nodeSignVerifier.Whitelist(browserSignVerifier.ID())
+		browserSignVerifier.Whitelist(nodeSignVerifier.ID())
+
+		node := New(Options{}, logrus.New(), handshake.New(nodeSignVerifier, handshake.NewGCMSessionManager()))
+		browser := New(Options{}, logrus.New(), handshake.New(browserSignVerifier, handshake.NewGCMSessionManager()))
+		httpServer := httptest.NewServer(node)
+		url := "ws" + strings.TrimPrefix(httpServer.URL, "http")
+		return node, nodeSignVerifier, browser, browserSignVerifier, url, httpServer.Close
+	}
+
+	run := func(ctx context.Context, transport *Transport, fallback protocol.Client) (chan protocol.MessageOnTheWire, chan protocol.MessageOnTheWire) {
+		outbound := make(chan protocol.MessageOnTheWire, 16)
+		inbound := make(chan protocol.MessageOnTheWire, 16)
+		go transport.Client(fallback).Run(ctx, outbound)
+		go transport.Server().Run(ctx, inbound)
+		return outbound, inbound
+	}
+
+	Context("when initializing a Transport", func() {
+		It("should panic if providing a nil Handshaker", func() {
+			Expect(func() {
+				_ = New(Options{}, logrus.New(), nil)
+			}).Should(Panic())
+		})
+	})
+
+	Context("when a peer dials a node", func() {
+		It("should send and receive messages in both directions over the same connection", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			node, nodeSignVerifier, browser, browserSignVerifier, url, closeServer := newTransports()
+			defer closeServer()
+			nodeOutbound, nodeInbound := run(ctx, node, nil)
+			browserOutbound, browserInbound := run(ctx, browser, nil)
+
+			peerID, err := browser.Dial(ctx, url)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(peerID.String()).To(Equal(nodeSignVerifier.ID()))
+			Eventually(node.NumConns).Should(Equal(1))
+			Expect(node.PeerIDs()[0].String()).To(Equal(browserSignVerifier.ID()))
+
+			// The node is only known by its PeerID, so the message must be
+			// sent over the connection that was dialed
+			request := protocol.NewMessage(protocol.V1, protocol.Cast, protocol.NilGroupID, []byte("request"))
+			browserOutbound <- protocol.MessageOnTheWire{
+				To:      NewSimpleTCPPeerAddress(nodeSignVerifier.ID(), "", ""),
+				Message: request,
+			}
+			var received protocol.MessageOnTheWire
+			Eventually(nodeInbound).Should(Receive(&received))
+			Expect(received.From.String()).To(Equal(browserSignVerifier.ID()))
+			Expect(received.Authenticated).To(BeTrue())
+			Expect(received.Message.Body).To(Equal(request.Body))
+
+			// The browser peer does not accept connections, so the response
+			// must be sent over the same connection
+			response := protocol.NewMessage(protocol.V1, protocol.Cast, protocol.NilGroupID, []byte("response"))
+			nodeOutbound <- protocol.MessageOnTheWire{
+				To:      NewSimpleTCPPeerAddress(browserSignVerifier.ID(), "", ""),
+				Message: response,
+			}
+			Eventually(browserInbound).Should(Receive(&received))
+			Expect(received.From.String()).To(Equal(nodeSignVerifier.ID()))
+			Expect(received.Message.Body).To(Equal(response.Body))
+		})
+
+		It("should close the connections when the server of the node stops", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			node, _, browser, _, url, closeServer := newTransports()
+			defer closeServer()
+			nodeCtx, nodeCancel := context.WithCancel(ctx)
+			run(nodeCtx, node, nil)
+			run(ctx, browser, nil)
+
+			_, err := browser.Dial(ctx, url)
+			Expect(err).ToNot(HaveOccurred())
+			Eventually(node.NumConns).Should(Equal(1))
+
+			nodeCancel()
+			Eventually(node.NumConns).Should(Equal(0))
+			Eventually(browser.NumConns).Should(Equal(0))
+		})
+	})
+
+	Context("when sending a message to a peer without a connection", func() {
+		It("should dial the websocket address of the peer", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			node, nodeSignVerifier, browser, _, url, closeServer := newTransports()
+			defer closeServer()
+			_, nodeInbound := run(ctx, node, nil)
+			browserOutbound, _ := run(ctx, browser, nil)
+
+			message := protocol.NewMessage(protocol.V1, protocol.Cast, protocol.NilGroupID, []byte("message"))
+			browserOutbound <- protocol.MessageOnTheWire{
+				To: wsPeerAddress{
+					SimpleTCPPeerAddress: NewSimpleTCPPeerAddress(nodeSignVerifier.ID(), "", ""),
+					URL:                  url,
+				},
+				Message: message,
+			}
+			var received protocol.MessageOnTheWire
+			Eventually(nodeInbound, 5*time.Second).Should(Receive(&received))
+			Expect(received.Message.Body).To(Equal(message.Body))
+			Expect(browser.NumConns()).To(Equal(1))
+		})
+
+		It("should give the message to the fallback client if the peer has no websocket address", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			node, _, _, _, _, closeServer := newTransports()
+			defer closeServer()
+			fallback := make(fallbackClient, 1)
+			nodeOutbound, _ := run(ctx, node, fallback)
+
+			message := protocol.MessageOnTheWire{
+				To:      RandomAddress(),
+				Message: protocol.NewMessage(protocol.V1, protocol.Cast, protocol.NilGroupID, []byte("message")),
+			}
+			nodeOutbound <- message
+			Eventually(fallback).Should(Receive(Equal(message)))
+			Expect(node.NumConns()).To(Equal(0))
+		})
+	})
+})